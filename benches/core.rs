@@ -0,0 +1,212 @@
+//! Benchmarks for the hot paths: lexing, parsing, evaluating handlers,
+//! memory reads and writes, saving and loading, and similarity recall.
+//!
+//! Run with `cargo bench`, or `cargo bench -- <filter>` for the benchmarks
+//! whose name contains the filter. Each prints the mean time per
+//! iteration; compare runs before and after a change.
+
+use sentience_core::context::AgentContext;
+use sentience_core::lexer::{Lexer, TokenType};
+use sentience_core::parser::{Parser, StatementPool};
+use sentience_core::sentience_core::ast::{Provenance, SentienceToken, TokenMeta};
+use sentience_core::sentience_core::runtime::InMemoryCortex;
+use sentience_core::{Cortex, SentienceAgent, SentienceTokenAst, Span, ThoughtType};
+use std::hint::black_box;
+use std::time::{Duration, Instant};
+
+/// How long each benchmark runs after warming up.
+const TARGET: Duration = Duration::from_millis(500);
+
+struct Bencher {
+    filter: Option<String>,
+}
+
+impl Bencher {
+    /// Time `f`, doubling the iteration count until a batch takes
+    /// [`TARGET`].
+    fn run<T>(&self, name: &str, mut f: impl FnMut() -> T) {
+        if self
+            .filter
+            .as_ref()
+            .is_some_and(|filter| !name.contains(filter.as_str()))
+        {
+            return;
+        }
+        black_box(f());
+        let mut iterations: u64 = 1;
+        loop {
+            let started = Instant::now();
+            for _ in 0..iterations {
+                black_box(f());
+            }
+            let elapsed = started.elapsed();
+            if elapsed >= TARGET {
+                let per_iteration = elapsed.as_nanos() as f64 / iterations as f64;
+                println!(
+                    "{:<32} {:>14} /iter  ({} iterations)",
+                    name,
+                    human(per_iteration),
+                    iterations
+                );
+                return;
+            }
+            iterations *= 2;
+        }
+    }
+}
+
+fn human(nanos: f64) -> String {
+    match nanos {
+        n if n >= 1e9 => format!("{:.2} s", n / 1e9),
+        n if n >= 1e6 => format!("{:.2} ms", n / 1e6),
+        n if n >= 1e3 => format!("{:.2} µs", n / 1e3),
+        n => format!("{:.0} ns", n),
+    }
+}
+
+/// A program with `agents` agents, each using the common statements.
+fn program(agents: usize) -> String {
+    (0..agents)
+        .map(|i| {
+            format!(
+                r#"agent Agent{i} {{
+  mem short
+  mem long
+  goal: "Answer questions about topic {i}"
+  on input(msg) {{
+    embed msg -> mem.short
+    if context includes ["hello", "hi"] {{
+      print "Hello from agent {i}"
+    }}
+    reflect {{
+      mem.short["msg"]
+    }}
+    print "done"
+  }}
+  train {{
+    print "Training {i}"
+  }}
+}}
+"#
+            )
+        })
+        .collect()
+}
+
+fn lex(source: &str) -> usize {
+    let mut lexer = Lexer::new(source);
+    let mut count = 0;
+    while lexer.next_token().token_type != TokenType::Eof {
+        count += 1;
+    }
+    count
+}
+
+fn context_with(entries: usize) -> AgentContext {
+    let mut ctx = AgentContext::new();
+    for i in 0..entries {
+        ctx.set_mem("long", &format!("key{}", i), &format!("value number {}", i));
+    }
+    ctx
+}
+
+fn cortex_with(tokens: usize) -> InMemoryCortex {
+    let mut cortex = InMemoryCortex::new(64);
+    for i in 0..tokens {
+        let embedding: Vec<f32> = (0..64)
+            .map(|d| ((i * 31 + d * 7) % 97) as f32 / 97.0)
+            .collect();
+        let token = SentienceToken::new(
+            format!("token{}", i),
+            SentienceTokenAst::new(ThoughtType::Percept, Span::new(1, 1, 1, 1)),
+            embedding,
+            Provenance {
+                stm_ids: Vec::new(),
+                refnet_id: String::new(),
+                rules_applied: Vec::new(),
+                agent_id: "bench".to_string(),
+                step_id: i as u64,
+                timestamp: 0,
+            },
+            TokenMeta {
+                version: "1".to_string(),
+                strength: 1.0,
+                belief: 1.0,
+                tags: Vec::new(),
+            },
+        );
+        cortex.commit(&token, &[]).expect("commit");
+    }
+    cortex
+}
+
+fn main() {
+    let bencher = Bencher {
+        filter: std::env::args().skip(1).find(|arg| !arg.starts_with("--")),
+    };
+
+    for agents in [1, 100, 10_000] {
+        let source = program(agents);
+        bencher.run(&format!("lex/{}", agents), || lex(&source));
+        bencher.run(&format!("parse/{}", agents), || {
+            let mut lexer = Lexer::new(&source);
+            Parser::new(&mut lexer).parse_program()
+        });
+        let mut pool = StatementPool::new();
+        bencher.run(&format!("reparse_pooled/{}", agents), || {
+            let mut lexer = Lexer::new(&source);
+            let mut parser = Parser::new(&mut lexer).with_pool(std::mem::take(&mut pool));
+            let program = parser.parse_program();
+            pool = parser.take_pool();
+            let statements = program.statements.len();
+            pool.recycle(program);
+            statements
+        });
+    }
+
+    let mut agent = SentienceAgent::new();
+    agent.run_sentience(&program(1)).expect("program runs");
+    bencher.run("eval/input", || agent.handle_input("hello there"));
+    bencher.run("eval/train", || agent.train("example"));
+
+    for entries in [100, 10_000, 1_000_000] {
+        let mut ctx = context_with(entries);
+        let mut i = 0usize;
+        bencher.run(&format!("set_mem/{}", entries), || {
+            i = (i + 1) % entries;
+            ctx.set_mem("long", &format!("key{}", i), "updated");
+        });
+        bencher.run(&format!("get_mem/{}", entries), || {
+            i = (i + 7) % entries;
+            ctx.get_mem("long", &format!("key{}", i))
+        });
+    }
+
+    let path = std::env::temp_dir().join(format!("sentience-bench-{}.json", std::process::id()));
+    let path = path.to_str().expect("temp path is UTF-8");
+    for entries in [100, 10_000] {
+        let ctx = context_with(entries);
+        bencher.run(&format!("save/{}", entries), || {
+            ctx.save(path).expect("save")
+        });
+        ctx.save(path).expect("save");
+        let mut loaded = AgentContext::new();
+        bencher.run(&format!("load/{}", entries), || {
+            loaded.load(path).expect("load")
+        });
+        ctx.save_indexed(path).expect("save");
+        bencher.run(&format!("load_indexed/{}", entries), || {
+            loaded.load(path).expect("load");
+            loaded.get_mem("long", "key1")
+        });
+    }
+    let _ = std::fs::remove_file(path);
+
+    for tokens in [100, 10_000] {
+        let cortex = cortex_with(tokens);
+        let query: Vec<f32> = (0..64).map(|d| (d % 5) as f32).collect();
+        bencher.run(&format!("recall_similar/{}", tokens), || {
+            cortex.recall_similar(&query, 10)
+        });
+    }
+}
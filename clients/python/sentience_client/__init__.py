@@ -0,0 +1,12 @@
+"""Python client for agents served by ``sentience-repl serve --http``."""
+
+from .client import REGIONS, ApiError, Client, MemoryMatch, Snapshot, events
+
+__all__ = [
+    "REGIONS",
+    "ApiError",
+    "Client",
+    "MemoryMatch",
+    "Snapshot",
+    "events",
+]
@@ -0,0 +1,149 @@
+"""Client for the HTTP API of ``sentience-repl serve --http``.
+
+The methods follow the operations in the server's OpenAPI document
+(``sentience-repl openapi``); only the standard library is used.
+"""
+
+import json
+import urllib.error
+import urllib.parse
+import urllib.request
+from dataclasses import dataclass
+from typing import Any, Dict, Iterator, List, Optional, Tuple
+
+REGIONS = ("short", "long")
+
+
+class ApiError(Exception):
+    """The server answered with an error status."""
+
+    def __init__(self, status: int, message: str):
+        super().__init__(f"{status}: {message}")
+        self.status = status
+        self.message = message
+
+
+@dataclass(frozen=True)
+class MemoryMatch:
+    region: str
+    key: str
+    value: str
+
+
+@dataclass
+class Snapshot:
+    """All of an agent's memory and links."""
+
+    mem_short: Dict[str, str]
+    mem_long: Dict[str, str]
+    links: Dict[str, str]
+
+    @classmethod
+    def from_json(cls, data: Dict[str, Any]) -> "Snapshot":
+        return cls(
+            mem_short=dict(data.get("mem_short", {})),
+            mem_long=dict(data.get("mem_long", {})),
+            links=dict(data.get("links", {})),
+        )
+
+    def to_json(self) -> Dict[str, Any]:
+        return {"mem_short": self.mem_short, "mem_long": self.mem_long, "links": self.links}
+
+
+class Client:
+    """One agent served at ``base_url``, e.g. ``http://127.0.0.1:8080``."""
+
+    def __init__(self, base_url: str, timeout: float = 30.0):
+        self.base_url = base_url.rstrip("/")
+        self.timeout = timeout
+
+    def input(self, text: str) -> str:
+        """Run the agent's ``on input`` handler and return its output."""
+        return self._request("POST", "/input", {"text": text})["output"]
+
+    def train(self, text: str) -> str:
+        """Run the agent's ``train`` block and return its output."""
+        return self._request("POST", "/train", {"text": text})["output"]
+
+    def memory(self, region: str) -> Dict[str, str]:
+        """Every entry in the ``short`` or ``long`` region."""
+        return self._request("GET", f"/memory/{_segment(region)}")
+
+    def get(self, region: str, key: str) -> str:
+        """One memory value; missing keys are empty."""
+        return self._request("GET", f"/memory/{_segment(region)}/{_segment(key)}")["value"]
+
+    def set(self, region: str, key: str, value: str) -> None:
+        """Write one memory value, as a handler would."""
+        self._request("PUT", f"/memory/{_segment(region)}/{_segment(key)}", {"value": value})
+
+    def recall(
+        self, query: str, region: Optional[str] = None, limit: Optional[int] = None
+    ) -> List[MemoryMatch]:
+        """Memory entries whose key or value contains ``query``."""
+        params = {"query": query}
+        if region is not None:
+            params["region"] = region
+        if limit is not None:
+            params["limit"] = str(limit)
+        matches = self._request("GET", "/recall?" + urllib.parse.urlencode(params))
+        return [MemoryMatch(**match) for match in matches]
+
+    def stats(self) -> Dict[str, Any]:
+        """Entries and approximate size of each memory region, and the link count."""
+        return self._request("GET", "/stats")
+
+    def snapshot(self) -> Snapshot:
+        return Snapshot.from_json(self._request("GET", "/snapshot"))
+
+    def restore(self, snapshot: Snapshot) -> None:
+        """Replace all of the agent's memory and links."""
+        self._request("PUT", "/snapshot", snapshot.to_json())
+
+    def openapi(self) -> Dict[str, Any]:
+        return self._request("GET", "/openapi.json")
+
+    def _request(self, method: str, path: str, body: Optional[Dict[str, Any]] = None) -> Any:
+        data = json.dumps(body).encode() if body is not None else None
+        request = urllib.request.Request(
+            self.base_url + path,
+            data=data,
+            method=method,
+            headers={"Content-Type": "application/json"} if data is not None else {},
+        )
+        try:
+            with urllib.request.urlopen(request, timeout=self.timeout) as response:
+                payload = response.read()
+        except urllib.error.HTTPError as e:
+            raise ApiError(e.code, _error_message(e.read())) from None
+        return json.loads(payload) if payload else None
+
+
+def events(url: str, timeout: Optional[float] = None) -> Iterator[Tuple[str, Dict[str, Any]]]:
+    """Follow the stream of ``serve --events``, e.g.
+    ``http://127.0.0.1:8090/events``, yielding ``(event name, payload)``.
+    """
+    request = urllib.request.Request(url, headers={"Accept": "text/event-stream"})
+    with urllib.request.urlopen(request, timeout=timeout) as response:
+        name, data = "message", []
+        for raw in response:
+            line = raw.decode().rstrip("\r\n")
+            if not line:
+                if data:
+                    yield name, json.loads("\n".join(data))
+                name, data = "message", []
+            elif line.startswith("event:"):
+                name = line[len("event:"):].strip()
+            elif line.startswith("data:"):
+                data.append(line[len("data:"):].strip())
+
+
+def _segment(value: str) -> str:
+    return urllib.parse.quote(value, safe="")
+
+
+def _error_message(body: bytes) -> str:
+    try:
+        return json.loads(body)["error"]
+    except (ValueError, KeyError, TypeError):
+        return body.decode(errors="replace").strip()
@@ -0,0 +1,90 @@
+import json
+import threading
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+import pytest
+
+from sentience_client import ApiError, Client, MemoryMatch, Snapshot, events
+
+
+class FakeAgent(BaseHTTPRequestHandler):
+    """Answers like `serve --http`, recording each request."""
+
+    requests = []
+
+    def do_GET(self):
+        self._answer()
+
+    def do_POST(self):
+        self._answer()
+
+    def do_PUT(self):
+        self._answer()
+
+    def _answer(self):
+        length = int(self.headers.get("Content-Length") or 0)
+        body = json.loads(self.rfile.read(length)) if length else None
+        self.requests.append((self.command, self.path, body))
+        if self.path == "/events":
+            self._send(200, b"retry: 3000\n\nid: 1\nevent: memory_changed\n"
+                       b'data: {"key":"k","value":"v"}\n\n', "text/event-stream")
+        elif self.path == "/input":
+            self._json(200, {"output": "echo " + body["text"]})
+        elif self.path == "/memory/long/home%20city":
+            self._send(204, b"")
+        elif self.path.startswith("/recall?"):
+            self._json(200, [{"region": "long", "key": "home city", "value": "Belgrade"}])
+        elif self.path == "/snapshot" and self.command == "GET":
+            self._json(200, {"mem_short": {"msg": "hi"}, "mem_long": {}, "links": {}})
+        else:
+            self._json(404, {"error": "unknown memory region `mid`"})
+
+    def _json(self, status, value):
+        self._send(status, json.dumps(value).encode(), "application/json")
+
+    def _send(self, status, body, content_type="application/json"):
+        self.send_response(status)
+        self.send_header("Content-Type", content_type)
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    def log_message(self, *args):
+        pass
+
+
+@pytest.fixture
+def base_url():
+    FakeAgent.requests = []
+    server = HTTPServer(("127.0.0.1", 0), FakeAgent)
+    threading.Thread(target=server.serve_forever, daemon=True).start()
+    yield f"http://127.0.0.1:{server.server_port}"
+    server.shutdown()
+
+
+def test_calls_the_api(base_url):
+    agent = Client(base_url)
+    assert agent.input("hello") == "echo hello"
+    agent.set("long", "home city", "Belgrade")
+    assert agent.recall("belgrade", region="long", limit=5) == [
+        MemoryMatch("long", "home city", "Belgrade")
+    ]
+    assert agent.snapshot() == Snapshot({"msg": "hi"}, {}, {})
+
+    assert FakeAgent.requests[:3] == [
+        ("POST", "/input", {"text": "hello"}),
+        ("PUT", "/memory/long/home%20city", {"value": "Belgrade"}),
+        ("GET", "/recall?query=belgrade&region=long&limit=5", None),
+    ]
+
+
+def test_raises_api_errors(base_url):
+    with pytest.raises(ApiError) as error:
+        Client(base_url).memory("mid")
+    assert error.value.status == 404
+    assert error.value.message == "unknown memory region `mid`"
+
+
+def test_reads_event_streams(base_url):
+    stream = events(base_url + "/events")
+    assert next(stream) == ("memory_changed", {"key": "k", "value": "v"})
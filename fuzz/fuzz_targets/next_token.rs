@@ -0,0 +1,15 @@
+//! The lexer must reach `Eof` on any input, one token at a time.
+
+#![no_main]
+
+use libfuzzer_sys::fuzz_target;
+use sentience_core::lexer::{Lexer, TokenType};
+
+fuzz_target!(|input: &str| {
+    let mut lexer = Lexer::new(input);
+    let mut tokens = 0;
+    while lexer.next_token().token_type != TokenType::Eof {
+        tokens += 1;
+        assert!(tokens <= input.len(), "lexer made no progress");
+    }
+});
@@ -0,0 +1,12 @@
+//! The parser must return a program for any input, however malformed.
+
+#![no_main]
+
+use libfuzzer_sys::fuzz_target;
+use sentience_core::lexer::Lexer;
+use sentience_core::parser::Parser;
+
+fuzz_target!(|input: &str| {
+    let mut lexer = Lexer::new(input);
+    Parser::new(&mut lexer).parse_program();
+});
@@ -0,0 +1,123 @@
+//! Pieces shared by the chat adapters ([Slack](super::slack) and
+//! [Discord](super::discord)).
+
+use crate::adapters::InputMessage;
+use std::fmt;
+
+/// A message posted by a person in a chat channel.
+#[derive(Clone, Debug, PartialEq)]
+pub struct ChatMessage {
+    /// `slack` or `discord`.
+    pub platform: &'static str,
+    pub channel: String,
+    pub user: String,
+    pub text: String,
+    /// Platform id of the message (Discord) or thread (Slack) a reply
+    /// should attach to.
+    pub reply_to: Option<String>,
+}
+
+impl ChatMessage {
+    /// Key isolating each user's memory; see
+    /// [`SentienceAgent::handle_session`](crate::SentienceAgent::handle_session).
+    pub fn session_key(&self) -> String {
+        format!("{}:{}", self.platform, self.user)
+    }
+
+    pub fn to_message(&self) -> InputMessage {
+        InputMessage::new(&self.text)
+            .with_metadata("source", self.platform)
+            .with_metadata("channel", &self.channel)
+            .with_metadata("user", &self.user)
+    }
+}
+
+#[derive(Debug)]
+pub enum ChatError {
+    /// The platform could not be reached.
+    Http(String),
+    /// The platform answered with an error.
+    Api {
+        status: u16,
+        message: String,
+    },
+    Decode(String),
+}
+
+impl fmt::Display for ChatError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            ChatError::Http(msg) => write!(f, "chat request failed: {}", msg),
+            ChatError::Api { status, message } => {
+                write!(f, "chat API returned {}: {}", status, message)
+            }
+            ChatError::Decode(msg) => write!(f, "unexpected chat API response: {}", msg),
+        }
+    }
+}
+
+impl std::error::Error for ChatError {}
+
+/// Split `text` into pieces of at most `limit` characters, preferring to
+/// break at newlines.
+pub fn split_text(text: &str, limit: usize) -> Vec<String> {
+    let mut parts = Vec::new();
+    let mut rest = text;
+    while rest.chars().count() > limit {
+        let cut = rest
+            .char_indices()
+            .nth(limit)
+            .map(|(i, _)| i)
+            .unwrap_or(rest.len());
+        let at = match rest[..cut].rfind('\n') {
+            Some(newline) if newline > 0 => newline,
+            _ => cut,
+        };
+        parts.push(rest[..at].to_string());
+        rest = rest[at..].trim_start_matches('\n');
+    }
+    if !rest.is_empty() {
+        parts.push(rest.to_string());
+    }
+    parts
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn sessions_have_separate_memory() {
+        let mut agent = crate::SentienceAgent::new();
+        agent
+            .run_sentience(r#"agent Bot { on input(msg) { print "ok" } }"#)
+            .unwrap();
+        agent.set_long("greeting", "hello");
+        let from = |user: &str, text: &str| ChatMessage {
+            platform: "slack",
+            channel: "C1".to_string(),
+            user: user.to_string(),
+            text: text.to_string(),
+            reply_to: None,
+        };
+
+        for message in [from("alice", "one"), from("bob", "two")] {
+            agent
+                .handle_session(&message.session_key(), &message.to_message())
+                .unwrap();
+        }
+        // Handlers ran against the sessions, not the agent's own memory,
+        // which sessions copied when they started.
+        assert_eq!(agent.get_short("msg"), "");
+        assert_eq!(agent.get_short("input.user"), "");
+        assert_eq!(agent.get_long("greeting"), "hello");
+    }
+
+    #[test]
+    fn splits_long_replies() {
+        assert_eq!(split_text("short", 10), ["short"]);
+        assert_eq!(split_text("abc\ndefgh\nij", 6), ["abc", "defgh", "ij"]);
+        assert_eq!(split_text("abcdefgh", 3), ["abc", "def", "gh"]);
+        assert!(split_text("", 3).is_empty());
+    }
+}
@@ -0,0 +1,277 @@
+//! Discord bot that polls channels through the REST API, which needs no
+//! gateway connection, and replies to each new message.
+
+use crate::adapters::chat::{split_text, ChatError, ChatMessage};
+use crate::config::{env_or, DiscordConfig};
+use serde::Deserialize;
+use serde_json::json;
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::thread;
+use std::time::Duration;
+
+const DEFAULT_API_URL: &str = "https://discord.com/api/v10";
+const DEFAULT_POLL_INTERVAL: Duration = Duration::from_secs(2);
+const MAX_MESSAGE_CHARS: usize = 2000;
+
+#[derive(Clone, Debug)]
+pub struct DiscordOptions {
+    pub bot_token: String,
+    pub channels: Vec<String>,
+    pub api_url: String,
+    pub poll_interval: Duration,
+}
+
+impl DiscordOptions {
+    pub fn configured(config: &DiscordConfig) -> Result<Self, String> {
+        Ok(Self {
+            bot_token: env_or("DISCORD_BOT_TOKEN", config.bot_token.as_ref())
+                .ok_or("DISCORD_BOT_TOKEN is not set")?,
+            channels: config.channels.clone(),
+            api_url: DEFAULT_API_URL.to_string(),
+            poll_interval: DEFAULT_POLL_INTERVAL,
+        })
+    }
+}
+
+#[derive(Deserialize)]
+struct User {
+    id: String,
+    #[serde(default)]
+    bot: bool,
+}
+
+#[derive(Deserialize)]
+struct Message {
+    id: String,
+    channel_id: String,
+    #[serde(default)]
+    content: String,
+    author: User,
+}
+
+pub struct DiscordAdapter {
+    options: DiscordOptions,
+    client: reqwest::blocking::Client,
+    /// Newest message seen per channel; polling asks for anything after it.
+    last_seen: HashMap<String, String>,
+}
+
+impl DiscordAdapter {
+    /// Check the token and remember each channel's latest message, so only
+    /// messages posted from now on are answered.
+    pub fn connect(options: &DiscordOptions) -> Result<Self, ChatError> {
+        if options.channels.is_empty() {
+            return Err(ChatError::Decode("no channels to watch".to_string()));
+        }
+        let mut adapter = Self {
+            options: options.clone(),
+            client: reqwest::blocking::Client::builder()
+                .timeout(Duration::from_secs(30))
+                .build()
+                .map_err(|e| ChatError::Http(e.to_string()))?,
+            last_seen: HashMap::new(),
+        };
+        let _me: User = adapter.get("/users/@me")?;
+        for channel in &options.channels {
+            let latest: Vec<Message> =
+                adapter.get(&format!("/channels/{}/messages?limit=1", channel))?;
+            if let Some(message) = latest.first() {
+                adapter
+                    .last_seen
+                    .insert(channel.clone(), message.id.clone());
+            }
+        }
+        Ok(adapter)
+    }
+
+    /// New messages from people (not bots) in every watched channel,
+    /// oldest first.
+    pub fn poll(&mut self) -> Result<Vec<ChatMessage>, ChatError> {
+        let mut messages = Vec::new();
+        for channel in self.options.channels.clone() {
+            let path = match self.last_seen.get(&channel) {
+                Some(after) => format!("/channels/{}/messages?after={}&limit=100", channel, after),
+                None => format!("/channels/{}/messages?limit=100", channel),
+            };
+            let mut batch: Vec<Message> = self.get(&path)?;
+            // Discord lists newest first.
+            batch.reverse();
+            if let Some(newest) = batch.last() {
+                self.last_seen.insert(channel.clone(), newest.id.clone());
+            }
+            messages.extend(
+                batch
+                    .into_iter()
+                    .filter(|m| !m.author.bot && !m.content.is_empty())
+                    .map(|m| ChatMessage {
+                        platform: "discord",
+                        channel: m.channel_id,
+                        user: m.author.id,
+                        text: m.content,
+                        reply_to: Some(m.id),
+                    }),
+            );
+        }
+        Ok(messages)
+    }
+
+    /// Post `text` to `channel` as a reply to `message_id` when given.
+    pub fn reply(
+        &self,
+        channel: &str,
+        text: &str,
+        message_id: Option<&str>,
+    ) -> Result<(), ChatError> {
+        for part in split_text(text, MAX_MESSAGE_CHARS) {
+            let mut body = json!({ "content": part });
+            if let Some(id) = message_id {
+                body["message_reference"] = json!({ "message_id": id });
+            }
+            self.send(|client, url| {
+                client
+                    .post(format!("{}/channels/{}/messages", url, channel))
+                    .json(&body)
+            })?;
+        }
+        Ok(())
+    }
+
+    /// Answer every new message with `handler` until `shutdown` is set.
+    pub fn run(
+        &mut self,
+        shutdown: &AtomicBool,
+        mut handler: impl FnMut(&ChatMessage) -> Option<String>,
+    ) -> Result<(), ChatError> {
+        while !shutdown.load(Ordering::SeqCst) {
+            for message in self.poll()? {
+                if let Some(response) = handler(&message) {
+                    self.reply(&message.channel, &response, message.reply_to.as_deref())?;
+                }
+            }
+            thread::sleep(self.options.poll_interval);
+        }
+        Ok(())
+    }
+
+    fn get<T: serde::de::DeserializeOwned>(&self, path: &str) -> Result<T, ChatError> {
+        self.send(|client, url| client.get(format!("{}{}", url, path)))?
+            .json()
+            .map_err(|e| ChatError::Decode(e.to_string()))
+    }
+
+    /// Send a request, waiting out a rate limit once if Discord asks.
+    fn send(
+        &self,
+        build: impl Fn(&reqwest::blocking::Client, &str) -> reqwest::blocking::RequestBuilder,
+    ) -> Result<reqwest::blocking::Response, ChatError> {
+        for attempt in 0..2 {
+            let response = build(&self.client, &self.options.api_url)
+                .header("Authorization", format!("Bot {}", self.options.bot_token))
+                .send()
+                .map_err(|e| ChatError::Http(e.to_string()))?;
+            let status = response.status();
+            if status.is_success() {
+                return Ok(response);
+            }
+            let message = response.text().unwrap_or_default();
+            if status.as_u16() == 429 && attempt == 0 {
+                let wait = serde_json::from_str::<serde_json::Value>(&message)
+                    .ok()
+                    .and_then(|v| v["retry_after"].as_f64())
+                    .unwrap_or(1.0);
+                thread::sleep(Duration::from_secs_f64(wait.clamp(0.0, 60.0)));
+                continue;
+            }
+            return Err(ChatError::Api {
+                status: status.as_u16(),
+                message,
+            });
+        }
+        unreachable!("the loop returns on its last attempt")
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::io::{BufRead, BufReader, Read, Write};
+    use std::net::TcpListener;
+
+    /// Answer requests in order, returning each request line and body.
+    fn serve(responses: Vec<&'static str>) -> (String, thread::JoinHandle<Vec<String>>) {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let url = format!("http://{}", listener.local_addr().unwrap());
+        let handle = thread::spawn(move || {
+            let mut seen = Vec::new();
+            for response in responses {
+                let (stream, _) = listener.accept().unwrap();
+                let mut reader = BufReader::new(stream);
+                let mut request_line = String::new();
+                reader.read_line(&mut request_line).unwrap();
+                let mut length = 0;
+                loop {
+                    let mut line = String::new();
+                    reader.read_line(&mut line).unwrap();
+                    if line.trim().is_empty() {
+                        break;
+                    }
+                    if let Some(v) = line.to_ascii_lowercase().strip_prefix("content-length:") {
+                        length = v.trim().parse().unwrap();
+                    }
+                }
+                let mut body = vec![0; length];
+                reader.read_exact(&mut body).unwrap();
+                seen.push(format!(
+                    "{} {}",
+                    request_line.trim(),
+                    String::from_utf8_lossy(&body)
+                ));
+                let reply = format!(
+                    "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+                    response.len(),
+                    response
+                );
+                reader.get_mut().write_all(reply.as_bytes()).unwrap();
+            }
+            seen
+        });
+        (url, handle)
+    }
+
+    #[test]
+    fn answers_new_messages() {
+        let (url, server) = serve(vec![
+            r#"{"id":"bot","bot":true}"#,
+            r#"[{"id":"10","channel_id":"c1","content":"old","author":{"id":"u1"}}]"#,
+            r#"[{"id":"12","channel_id":"c1","content":"bot says","author":{"id":"bot","bot":true}},
+                {"id":"11","channel_id":"c1","content":"hello","author":{"id":"u2"}}]"#,
+            r#"{"id":"13"}"#,
+        ]);
+        let options = DiscordOptions {
+            bot_token: "token".to_string(),
+            channels: vec!["c1".to_string()],
+            api_url: url,
+            poll_interval: Duration::from_millis(1),
+        };
+        let mut adapter = DiscordAdapter::connect(&options).unwrap();
+        let shutdown = AtomicBool::new(false);
+        let mut received = Vec::new();
+        adapter
+            .run(&shutdown, |message| {
+                received.push(message.clone());
+                shutdown.store(true, Ordering::SeqCst);
+                Some(format!("echo {}", message.text))
+            })
+            .unwrap();
+
+        assert_eq!(received.len(), 1);
+        assert_eq!(received[0].text, "hello");
+        assert_eq!(received[0].session_key(), "discord:u2");
+        let seen = server.join().unwrap();
+        assert!(seen[2].starts_with("GET /channels/c1/messages?after=10&limit=100 "));
+        assert!(seen[3].starts_with("POST /channels/c1/messages "));
+        assert!(seen[3].contains(r#""content":"echo hello""#));
+        assert!(seen[3].contains(r#""message_id":"11""#));
+    }
+}
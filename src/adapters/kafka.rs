@@ -0,0 +1,353 @@
+//! Kafka integration through the Confluent REST Proxy (v2 API), which
+//! avoids linking a native Kafka client.
+
+use crate::adapters::InputMessage;
+use serde::Deserialize;
+use serde_json::{json, Value};
+use std::fmt;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::Duration;
+
+const CONTENT_TYPE: &str = "application/vnd.kafka.v2+json";
+const JSON_CONTENT_TYPE: &str = "application/vnd.kafka.json.v2+json";
+const DEFAULT_POLL_TIMEOUT_MS: u64 = 1000;
+
+#[derive(Clone, Debug)]
+pub struct KafkaOptions {
+    /// Base URL of the REST Proxy, e.g. `http://localhost:8082`.
+    pub rest_url: String,
+    /// Consumer group; committed offsets are kept per group.
+    pub group: String,
+    pub topics: Vec<String>,
+    /// Topic that agent responses are published to, if any.
+    pub output_topic: Option<String>,
+    /// Start from the earliest offset when the group has none committed.
+    pub from_beginning: bool,
+    pub poll_timeout: Duration,
+}
+
+impl KafkaOptions {
+    pub fn new(rest_url: &str, group: &str, topics: &[&str]) -> Self {
+        Self {
+            rest_url: rest_url.trim_end_matches('/').to_string(),
+            group: group.to_string(),
+            topics: topics.iter().map(|t| t.to_string()).collect(),
+            output_topic: None,
+            from_beginning: false,
+            poll_timeout: Duration::from_millis(DEFAULT_POLL_TIMEOUT_MS),
+        }
+    }
+}
+
+#[derive(Debug)]
+pub enum KafkaError {
+    /// The REST Proxy could not be reached.
+    Http(String),
+    /// The REST Proxy answered with an error status.
+    Api {
+        status: u16,
+        message: String,
+    },
+    Decode(String),
+}
+
+impl fmt::Display for KafkaError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            KafkaError::Http(msg) => write!(f, "Kafka REST Proxy request failed: {}", msg),
+            KafkaError::Api { status, message } => {
+                write!(f, "Kafka REST Proxy returned {}: {}", status, message)
+            }
+            KafkaError::Decode(msg) => write!(f, "unexpected Kafka REST Proxy response: {}", msg),
+        }
+    }
+}
+
+impl std::error::Error for KafkaError {}
+
+#[derive(Clone, Debug, Deserialize, PartialEq)]
+pub struct KafkaRecord {
+    pub topic: String,
+    #[serde(default)]
+    pub key: Value,
+    #[serde(default)]
+    pub value: Value,
+    pub partition: i32,
+    pub offset: i64,
+}
+
+impl KafkaRecord {
+    /// The record as agent input; string values are passed through as-is,
+    /// anything else as JSON text.
+    pub fn to_message(&self) -> InputMessage {
+        let payload = match &self.value {
+            Value::String(s) => s.clone(),
+            other => other.to_string(),
+        };
+        let mut message = InputMessage::new(&payload)
+            .with_metadata("source", "kafka")
+            .with_metadata("topic", &self.topic)
+            .with_metadata("partition", &self.partition.to_string())
+            .with_metadata("offset", &self.offset.to_string());
+        if let Value::String(key) = &self.key {
+            message = message.with_metadata("key", key);
+        }
+        message
+    }
+}
+
+#[derive(Deserialize)]
+struct ConsumerInstance {
+    base_uri: String,
+}
+
+/// A consumer instance registered with the REST Proxy. Offsets are only
+/// committed after a batch has been handled, giving at-least-once delivery.
+pub struct KafkaAdapter {
+    options: KafkaOptions,
+    client: reqwest::blocking::Client,
+    base_uri: String,
+}
+
+impl KafkaAdapter {
+    /// Create a consumer instance in `options.group` and subscribe it.
+    pub fn connect(options: &KafkaOptions) -> Result<Self, KafkaError> {
+        let client = reqwest::blocking::Client::builder()
+            .timeout(options.poll_timeout + Duration::from_secs(30))
+            .build()
+            .map_err(|e| KafkaError::Http(e.to_string()))?;
+
+        let body = json!({
+            "name": format!("sentience-{}", std::process::id()),
+            "format": "json",
+            "auto.offset.reset": if options.from_beginning { "earliest" } else { "latest" },
+            "auto.commit.enable": "false",
+        });
+        let instance: ConsumerInstance = send(
+            client
+                .post(format!("{}/consumers/{}", options.rest_url, options.group))
+                .header("Content-Type", CONTENT_TYPE)
+                .body(body.to_string()),
+        )?
+        .json()
+        .map_err(|e| KafkaError::Decode(e.to_string()))?;
+
+        let adapter = Self {
+            options: options.clone(),
+            client,
+            base_uri: instance.base_uri.trim_end_matches('/').to_string(),
+        };
+        send(
+            adapter
+                .client
+                .post(format!("{}/subscription", adapter.base_uri))
+                .header("Content-Type", CONTENT_TYPE)
+                .body(json!({ "topics": options.topics }).to_string()),
+        )?;
+        Ok(adapter)
+    }
+
+    /// Fetch the next batch of records, waiting up to the poll timeout.
+    pub fn poll(&self) -> Result<Vec<KafkaRecord>, KafkaError> {
+        send(
+            self.client
+                .get(format!(
+                    "{}/records?timeout={}",
+                    self.base_uri,
+                    self.options.poll_timeout.as_millis()
+                ))
+                .header("Accept", JSON_CONTENT_TYPE),
+        )?
+        .json()
+        .map_err(|e| KafkaError::Decode(e.to_string()))
+    }
+
+    /// Commit the highest offset of each partition in `records`.
+    pub fn commit(&self, records: &[KafkaRecord]) -> Result<(), KafkaError> {
+        let mut latest: Vec<&KafkaRecord> = Vec::new();
+        for record in records {
+            match latest
+                .iter_mut()
+                .find(|r| r.topic == record.topic && r.partition == record.partition)
+            {
+                Some(r) if r.offset < record.offset => *r = record,
+                Some(_) => {}
+                None => latest.push(record),
+            }
+        }
+        if latest.is_empty() {
+            return Ok(());
+        }
+        let offsets: Vec<_> = latest
+            .iter()
+            .map(|r| json!({ "topic": r.topic, "partition": r.partition, "offset": r.offset }))
+            .collect();
+        send(
+            self.client
+                .post(format!("{}/offsets", self.base_uri))
+                .header("Content-Type", CONTENT_TYPE)
+                .body(json!({ "offsets": offsets }).to_string()),
+        )?;
+        Ok(())
+    }
+
+    pub fn publish(&self, topic: &str, key: &Value, value: &str) -> Result<(), KafkaError> {
+        let record = json!({ "records": [{ "key": key, "value": value }] });
+        send(
+            self.client
+                .post(format!("{}/topics/{}", self.options.rest_url, topic))
+                .header("Content-Type", JSON_CONTENT_TYPE)
+                .body(record.to_string()),
+        )?;
+        Ok(())
+    }
+
+    /// Hand every record to `handler` until `shutdown` is set, publishing
+    /// each response to the output topic and committing after each batch.
+    /// The consumer instance is deleted on the way out.
+    pub fn run(
+        self,
+        shutdown: &AtomicBool,
+        mut handler: impl FnMut(InputMessage) -> Option<String>,
+    ) -> Result<(), KafkaError> {
+        let result = (|| {
+            while !shutdown.load(Ordering::SeqCst) {
+                let records = self.poll()?;
+                for record in &records {
+                    let response = handler(record.to_message());
+                    if let (Some(topic), Some(response)) = (&self.options.output_topic, response) {
+                        self.publish(topic, &record.key, &response)?;
+                    }
+                }
+                self.commit(&records)?;
+            }
+            Ok(())
+        })();
+        let closed = self.close();
+        result.and(closed)
+    }
+
+    /// Delete the consumer instance so the group rebalances immediately.
+    pub fn close(&self) -> Result<(), KafkaError> {
+        send(
+            self.client
+                .delete(&self.base_uri)
+                .header("Content-Type", CONTENT_TYPE),
+        )?;
+        Ok(())
+    }
+}
+
+fn send(
+    request: reqwest::blocking::RequestBuilder,
+) -> Result<reqwest::blocking::Response, KafkaError> {
+    let response = request
+        .send()
+        .map_err(|e| KafkaError::Http(e.to_string()))?;
+    let status = response.status();
+    if !status.is_success() {
+        return Err(KafkaError::Api {
+            status: status.as_u16(),
+            message: response.text().unwrap_or_default(),
+        });
+    }
+    Ok(response)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::io::{BufRead, BufReader, Read, Write};
+    use std::net::TcpListener;
+    use std::thread;
+
+    /// Answer requests in order with the responses `build` returns for the
+    /// server's URL, collecting each request's method, path and body.
+    fn serve(build: impl FnOnce(&str) -> Vec<String>) -> (String, thread::JoinHandle<Vec<String>>) {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let url = format!("http://{}", listener.local_addr().unwrap());
+        let responses = build(&url);
+        let handle = thread::spawn(move || {
+            let mut seen = Vec::new();
+            for response in responses {
+                let (stream, _) = listener.accept().unwrap();
+                let mut reader = BufReader::new(stream);
+                let mut request_line = String::new();
+                reader.read_line(&mut request_line).unwrap();
+                let mut length = 0;
+                loop {
+                    let mut line = String::new();
+                    reader.read_line(&mut line).unwrap();
+                    if line.trim().is_empty() {
+                        break;
+                    }
+                    if let Some(v) = line.to_ascii_lowercase().strip_prefix("content-length:") {
+                        length = v.trim().parse().unwrap();
+                    }
+                }
+                let mut body = vec![0; length];
+                reader.read_exact(&mut body).unwrap();
+                let parts: Vec<_> = request_line.split_whitespace().take(2).collect();
+                seen.push(format!(
+                    "{} {}",
+                    parts.join(" "),
+                    String::from_utf8_lossy(&body)
+                ));
+
+                let reply = format!(
+                    "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+                    response.len(),
+                    response
+                );
+                reader.get_mut().write_all(reply.as_bytes()).unwrap();
+            }
+            seen
+        });
+        (url, handle)
+    }
+
+    #[test]
+    fn consumes_publishes_and_commits() {
+        let (url, server) = serve(|url| {
+            vec![
+                format!(
+                    r#"{{"instance_id":"i1","base_uri":"{}/consumers/g/instances/i1"}}"#,
+                    url
+                ),
+                String::new(),
+                r#"[{"topic":"in","key":"k1","value":"hello","partition":0,"offset":41},
+                    {"topic":"in","key":null,"value":{"n":1},"partition":0,"offset":42}]"#
+                    .to_string(),
+                r#"{"offsets":[]}"#.to_string(),
+                r#"{"offsets":[]}"#.to_string(),
+                String::new(),
+                String::new(),
+            ]
+        });
+
+        let mut options = KafkaOptions::new(&url, "g", &["in"]);
+        options.output_topic = Some("out".to_string());
+        let adapter = KafkaAdapter::connect(&options).unwrap();
+        let shutdown = AtomicBool::new(false);
+        let mut payloads = Vec::new();
+        adapter
+            .run(&shutdown, |message| {
+                payloads.push(message.payload.clone());
+                if payloads.len() == 2 {
+                    shutdown.store(true, Ordering::SeqCst);
+                }
+                Some(format!("echo {}", message.payload))
+            })
+            .unwrap();
+
+        assert_eq!(payloads, ["hello", r#"{"n":1}"#]);
+        let seen = server.join().unwrap();
+        assert!(seen[0].starts_with("POST /consumers/g "));
+        assert!(seen[1].contains(r#"{"topics":["in"]}"#));
+        assert!(seen[3].starts_with("POST /topics/out "));
+        assert!(seen[3].contains(r#""value":"echo hello""#));
+        assert!(seen[5].contains(r#""offset":42"#));
+        assert!(!seen[5].contains(r#""offset":41"#));
+        assert!(seen[6].starts_with("DELETE /consumers/g/instances/i1"));
+    }
+}
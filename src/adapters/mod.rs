@@ -0,0 +1,34 @@
+pub mod chat;
+pub mod discord;
+pub mod kafka;
+pub mod mqtt;
+pub mod nats;
+pub mod slack;
+pub mod speech;
+
+/// A message from an external system, delivered to an agent's `on input`
+/// handler by [`SentienceAgent::handle_message`](crate::SentienceAgent::handle_message).
+#[derive(Clone, Debug, Default, PartialEq)]
+pub struct InputMessage {
+    pub payload: String,
+    /// Source details such as the MQTT topic. Each entry is stored in
+    /// `mem.short` under `input.<name>` before the handler runs.
+    pub metadata: Vec<(String, String)>,
+}
+
+/// Prefix of the `mem.short` keys holding message metadata.
+pub const METADATA_PREFIX: &str = "input.";
+
+impl InputMessage {
+    pub fn new(payload: &str) -> Self {
+        Self {
+            payload: payload.to_string(),
+            metadata: Vec::new(),
+        }
+    }
+
+    pub fn with_metadata(mut self, name: &str, value: &str) -> Self {
+        self.metadata.push((name.to_string(), value.to_string()));
+        self
+    }
+}
@@ -0,0 +1,359 @@
+//! Minimal MQTT 3.1.1 subscriber: enough of the protocol to receive QoS 0
+//! and 1 messages from a broker and keep the connection alive.
+
+use crate::adapters::InputMessage;
+use std::io::{self, ErrorKind, Read, Write};
+use std::net::TcpStream;
+use std::time::{Duration, Instant};
+
+const DEFAULT_PORT: u16 = 1883;
+const DEFAULT_KEEP_ALIVE_SECS: u16 = 30;
+
+mod packet {
+    pub const CONNECT: u8 = 0x10;
+    pub const CONNACK: u8 = 0x20;
+    pub const PUBLISH: u8 = 0x30;
+    pub const PUBACK: u8 = 0x40;
+    pub const SUBSCRIBE: u8 = 0x82;
+    pub const SUBACK: u8 = 0x90;
+    pub const PINGREQ: u8 = 0xC0;
+    pub const PINGRESP: u8 = 0xD0;
+    pub const DISCONNECT: u8 = 0xE0;
+}
+
+#[derive(Clone, Debug)]
+pub struct MqttOptions {
+    /// `host` or `host:port`; the port defaults to 1883.
+    pub broker: String,
+    pub client_id: String,
+    /// Topic filters, which may use the `+` and `#` wildcards.
+    pub topics: Vec<String>,
+    /// Requested QoS for every subscription (0 or 1).
+    pub qos: u8,
+    pub username: Option<String>,
+    pub password: Option<String>,
+    pub keep_alive_secs: u16,
+}
+
+impl MqttOptions {
+    pub fn new(broker: &str, topics: &[&str]) -> Self {
+        Self {
+            broker: broker.to_string(),
+            client_id: format!("sentience-{}", std::process::id()),
+            topics: topics.iter().map(|t| t.to_string()).collect(),
+            qos: 0,
+            username: None,
+            password: None,
+            keep_alive_secs: DEFAULT_KEEP_ALIVE_SECS,
+        }
+    }
+}
+
+/// A connected, subscribed MQTT session.
+pub struct MqttSource {
+    stream: TcpStream,
+    buf: Vec<u8>,
+    keep_alive: Duration,
+    last_sent: Instant,
+}
+
+impl MqttSource {
+    /// Connect to the broker and subscribe to every topic in `options`.
+    pub fn connect(options: &MqttOptions) -> io::Result<Self> {
+        if options.topics.is_empty() {
+            return Err(invalid_input("at least one topic is required"));
+        }
+        if options.qos > 1 {
+            return Err(invalid_input("only QoS 0 and 1 are supported"));
+        }
+        let addr = if options.broker.contains(':') {
+            options.broker.clone()
+        } else {
+            format!("{}:{}", options.broker, DEFAULT_PORT)
+        };
+        let stream = TcpStream::connect(&addr)?;
+        let keep_alive = Duration::from_secs(options.keep_alive_secs.max(1) as u64);
+        // Wake up in time to ping before the broker gives up on us.
+        stream.set_read_timeout(Some(keep_alive / 2))?;
+
+        let mut source = Self {
+            stream,
+            buf: Vec::new(),
+            keep_alive,
+            last_sent: Instant::now(),
+        };
+        source.send(packet::CONNECT, &connect_body(options))?;
+        let (header, body) = source.next_packet()?;
+        if header & 0xF0 != packet::CONNACK || body.len() < 2 {
+            return Err(protocol("expected CONNACK"));
+        }
+        if body[1] != 0 {
+            return Err(io::Error::new(
+                ErrorKind::ConnectionRefused,
+                format!("broker refused connection (code {})", body[1]),
+            ));
+        }
+
+        let mut subscribe = Vec::new();
+        put_u16(&mut subscribe, 1);
+        for topic in &options.topics {
+            put_str(&mut subscribe, topic);
+            subscribe.push(options.qos);
+        }
+        source.send(packet::SUBSCRIBE, &subscribe)?;
+        loop {
+            let (header, body) = source.next_packet()?;
+            if header & 0xF0 != packet::SUBACK {
+                continue;
+            }
+            if body.iter().skip(2).any(|&code| code == 0x80) {
+                return Err(protocol("broker rejected a subscription"));
+            }
+            break;
+        }
+        Ok(source)
+    }
+
+    /// Wait for the next published message, answering pings and
+    /// acknowledging QoS 1 deliveries along the way. Returns `None` when the
+    /// broker closes the connection.
+    pub fn next_message(&mut self) -> io::Result<Option<InputMessage>> {
+        loop {
+            let (header, body) = match self.next_packet() {
+                Ok(packet) => packet,
+                Err(e) if e.kind() == ErrorKind::UnexpectedEof => return Ok(None),
+                Err(e) => return Err(e),
+            };
+            if header & 0xF0 != packet::PUBLISH {
+                continue;
+            }
+
+            let qos = (header >> 1) & 0x03;
+            let mut pos = 0;
+            let topic = take_str(&body, &mut pos)?;
+            if qos > 0 {
+                let id = body
+                    .get(pos..pos + 2)
+                    .ok_or_else(|| protocol("truncated PUBLISH"))?
+                    .to_vec();
+                pos += 2;
+                self.send(packet::PUBACK, &id)?;
+            }
+            let payload = String::from_utf8_lossy(&body[pos..]);
+            return Ok(Some(
+                InputMessage::new(&payload)
+                    .with_metadata("topic", &topic)
+                    .with_metadata("source", "mqtt"),
+            ));
+        }
+    }
+
+    /// Call `handler` for every message until the broker disconnects.
+    pub fn run(&mut self, mut handler: impl FnMut(InputMessage)) -> io::Result<()> {
+        while let Some(message) = self.next_message()? {
+            handler(message);
+        }
+        Ok(())
+    }
+
+    pub fn disconnect(mut self) -> io::Result<()> {
+        self.send(packet::DISCONNECT, &[])
+    }
+
+    fn send(&mut self, header: u8, body: &[u8]) -> io::Result<()> {
+        let mut frame = vec![header];
+        put_len(&mut frame, body.len());
+        frame.extend_from_slice(body);
+        self.stream.write_all(&frame)?;
+        self.last_sent = Instant::now();
+        Ok(())
+    }
+
+    /// Read one complete packet, sending PINGREQ whenever the connection
+    /// has been quiet for half the keep-alive interval.
+    fn next_packet(&mut self) -> io::Result<(u8, Vec<u8>)> {
+        loop {
+            if let Some((header, body, used)) = parse_packet(&self.buf)? {
+                self.buf.drain(..used);
+                if header & 0xF0 == packet::PINGRESP {
+                    continue;
+                }
+                return Ok((header, body));
+            }
+
+            let mut chunk = [0u8; 4096];
+            match self.stream.read(&mut chunk) {
+                Ok(0) => return Err(ErrorKind::UnexpectedEof.into()),
+                Ok(n) => self.buf.extend_from_slice(&chunk[..n]),
+                Err(e) if matches!(e.kind(), ErrorKind::WouldBlock | ErrorKind::TimedOut) => {}
+                Err(e) => return Err(e),
+            }
+            if self.last_sent.elapsed() >= self.keep_alive / 2 {
+                self.send(packet::PINGREQ, &[])?;
+            }
+        }
+    }
+}
+
+fn connect_body(options: &MqttOptions) -> Vec<u8> {
+    let mut flags = 0x02; // clean session
+    if options.username.is_some() {
+        flags |= 0x80;
+    }
+    if options.password.is_some() {
+        flags |= 0x40;
+    }
+
+    let mut body = Vec::new();
+    put_str(&mut body, "MQTT");
+    body.push(4); // protocol level 3.1.1
+    body.push(flags);
+    put_u16(&mut body, options.keep_alive_secs);
+    put_str(&mut body, &options.client_id);
+    if let Some(username) = &options.username {
+        put_str(&mut body, username);
+    }
+    if let Some(password) = &options.password {
+        put_str(&mut body, password);
+    }
+    body
+}
+
+/// Split one packet off the front of `buf`, or `None` if it is incomplete.
+fn parse_packet(buf: &[u8]) -> io::Result<Option<(u8, Vec<u8>, usize)>> {
+    let Some(&header) = buf.first() else {
+        return Ok(None);
+    };
+    let mut len = 0usize;
+    let mut pos = 1;
+    for shift in (0..28).step_by(7) {
+        let Some(&b) = buf.get(pos) else {
+            return Ok(None);
+        };
+        pos += 1;
+        len |= ((b & 0x7F) as usize) << shift;
+        if b & 0x80 == 0 {
+            return Ok(buf
+                .get(pos..pos + len)
+                .map(|body| (header, body.to_vec(), pos + len)));
+        }
+    }
+    Err(protocol("remaining length too long"))
+}
+
+fn put_len(buf: &mut Vec<u8>, mut n: usize) {
+    loop {
+        let mut b = (n % 128) as u8;
+        n /= 128;
+        if n > 0 {
+            b |= 0x80;
+        }
+        buf.push(b);
+        if n == 0 {
+            break;
+        }
+    }
+}
+
+fn put_u16(buf: &mut Vec<u8>, n: u16) {
+    buf.extend_from_slice(&n.to_be_bytes());
+}
+
+fn put_str(buf: &mut Vec<u8>, s: &str) {
+    put_u16(buf, s.len() as u16);
+    buf.extend_from_slice(s.as_bytes());
+}
+
+fn take_str(buf: &[u8], pos: &mut usize) -> io::Result<String> {
+    let len_bytes = buf
+        .get(*pos..*pos + 2)
+        .ok_or_else(|| protocol("truncated string"))?;
+    let len = u16::from_be_bytes([len_bytes[0], len_bytes[1]]) as usize;
+    let bytes = buf
+        .get(*pos + 2..*pos + 2 + len)
+        .ok_or_else(|| protocol("truncated string"))?;
+    *pos += 2 + len;
+    String::from_utf8(bytes.to_vec()).map_err(|_| protocol("string is not valid UTF-8"))
+}
+
+fn protocol(msg: &str) -> io::Error {
+    io::Error::new(ErrorKind::InvalidData, format!("MQTT: {}", msg))
+}
+
+fn invalid_input(msg: &str) -> io::Error {
+    io::Error::new(ErrorKind::InvalidInput, format!("MQTT: {}", msg))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::net::TcpListener;
+    use std::thread;
+
+    fn read_packet(stream: &mut TcpStream) -> (u8, Vec<u8>) {
+        let mut buf = Vec::new();
+        let mut byte = [0u8; 1];
+        loop {
+            if let Some((header, body, _)) = parse_packet(&buf).unwrap() {
+                return (header, body);
+            }
+            stream.read_exact(&mut byte).unwrap();
+            buf.push(byte[0]);
+        }
+    }
+
+    #[test]
+    fn receives_published_messages() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let broker = listener.local_addr().unwrap().to_string();
+        let server = thread::spawn(move || {
+            let (mut stream, _) = listener.accept().unwrap();
+            let (header, body) = read_packet(&mut stream);
+            assert_eq!(header, packet::CONNECT);
+            assert_eq!(&body[2..6], b"MQTT");
+            stream.write_all(&[packet::CONNACK, 2, 0, 0]).unwrap();
+
+            let (header, body) = read_packet(&mut stream);
+            assert_eq!(header, packet::SUBSCRIBE);
+            let mut pos = 2;
+            assert_eq!(take_str(&body, &mut pos).unwrap(), "sensors/#");
+            stream.write_all(&[packet::SUBACK, 3, 0, 1, 1]).unwrap();
+
+            let mut publish = Vec::new();
+            put_str(&mut publish, "sensors/kitchen");
+            put_u16(&mut publish, 7);
+            publish.extend_from_slice(b"21.5C");
+            let mut frame = vec![packet::PUBLISH | 0x02];
+            put_len(&mut frame, publish.len());
+            frame.extend_from_slice(&publish);
+            stream.write_all(&frame).unwrap();
+
+            let (header, body) = read_packet(&mut stream);
+            assert_eq!((header, body), (packet::PUBACK, vec![0, 7]));
+        });
+
+        let mut options = MqttOptions::new(&broker, &["sensors/#"]);
+        options.qos = 1;
+        let mut source = MqttSource::connect(&options).unwrap();
+        let mut received = Vec::new();
+        source.run(|message| received.push(message)).unwrap();
+        server.join().unwrap();
+
+        assert_eq!(received.len(), 1);
+        assert_eq!(received[0].payload, "21.5C");
+        assert!(received[0]
+            .metadata
+            .contains(&("topic".to_string(), "sensors/kitchen".to_string())));
+    }
+
+    #[test]
+    fn encodes_remaining_length() {
+        let mut buf = Vec::new();
+        put_len(&mut buf, 321);
+        assert_eq!(buf, [0xC1, 0x02]);
+        buf.insert(0, packet::PUBLISH);
+        buf.extend(std::iter::repeat(0).take(321));
+        let (_, body, used) = parse_packet(&buf).unwrap().unwrap();
+        assert_eq!((body.len(), used), (321, buf.len()));
+    }
+}
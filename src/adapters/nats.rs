@@ -0,0 +1,536 @@
+//! NATS transport for agents running in separate processes. Each agent
+//! listens on its own subject, `<prefix>.agent.<name>`, and publishes its
+//! events on `<prefix>.events.<name>.<event>`, where other agents can
+//! follow them.
+//!
+//! Only the core text protocol is spoken: no TLS, headers or JetStream.
+
+use crate::adapters::InputMessage;
+use crate::events::AgentEvent;
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::HashMap;
+use std::io::{self, ErrorKind, Read, Write};
+use std::net::TcpStream;
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+const DEFAULT_PORT: u16 = 4222;
+const CONNECT_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Subject prefix used unless one is configured.
+pub const DEFAULT_PREFIX: &str = "sentience";
+
+/// Envelope kind of messages sent to an agent; events use their name.
+pub const MESSAGE_KIND: &str = "message";
+
+#[derive(Clone, Debug)]
+pub struct NatsOptions {
+    /// `host`, `host:port` or `nats://host:port`; the port defaults to 4222.
+    pub server: String,
+    /// Client name shown by the server's monitoring endpoints.
+    pub name: String,
+    pub user: Option<String>,
+    pub password: Option<String>,
+    pub token: Option<String>,
+}
+
+impl NatsOptions {
+    pub fn new(server: &str) -> Self {
+        Self {
+            server: server.to_string(),
+            name: format!("sentience-{}", std::process::id()),
+            user: None,
+            password: None,
+            token: None,
+        }
+    }
+}
+
+/// A message delivered on a subscription.
+#[derive(Clone, Debug, PartialEq)]
+pub struct NatsMessage {
+    pub subject: String,
+    pub reply: Option<String>,
+    pub payload: Vec<u8>,
+}
+
+/// Publishes on a client's connection; clones share it.
+#[derive(Clone)]
+pub struct NatsPublisher {
+    stream: Arc<Mutex<TcpStream>>,
+}
+
+impl NatsPublisher {
+    pub fn publish(&self, subject: &str, reply: Option<&str>, payload: &[u8]) -> io::Result<()> {
+        let mut frame = match reply {
+            Some(reply) => format!("PUB {} {} {}\r\n", subject, reply, payload.len()),
+            None => format!("PUB {} {}\r\n", subject, payload.len()),
+        }
+        .into_bytes();
+        frame.extend_from_slice(payload);
+        frame.extend_from_slice(b"\r\n");
+        self.write(&frame)
+    }
+
+    fn write(&self, bytes: &[u8]) -> io::Result<()> {
+        let mut stream = self
+            .stream
+            .lock()
+            .map_err(|_| io::Error::other("connection lock poisoned"))?;
+        stream.write_all(bytes)?;
+        stream.flush()
+    }
+}
+
+enum Op {
+    Info,
+    Msg(NatsMessage),
+    Ping,
+    Pong,
+    Ok,
+    Err(String),
+}
+
+/// A connection to a NATS server.
+pub struct NatsClient {
+    stream: TcpStream,
+    publisher: NatsPublisher,
+    buf: Vec<u8>,
+    next_sid: u64,
+}
+
+impl NatsClient {
+    pub fn connect(options: &NatsOptions) -> io::Result<Self> {
+        let server = options
+            .server
+            .strip_prefix("nats://")
+            .unwrap_or(&options.server);
+        let addr = if server.contains(':') {
+            server.to_string()
+        } else {
+            format!("{}:{}", server, DEFAULT_PORT)
+        };
+        let stream = TcpStream::connect(&addr)?;
+        let mut client = Self {
+            publisher: NatsPublisher {
+                stream: Arc::new(Mutex::new(stream.try_clone()?)),
+            },
+            stream,
+            buf: Vec::new(),
+            next_sid: 1,
+        };
+
+        let deadline = Instant::now() + CONNECT_TIMEOUT;
+        match client.next_op(deadline)? {
+            Some(Op::Info) => {}
+            _ => return Err(protocol("expected INFO from server")),
+        }
+        let mut connect = serde_json::json!({
+            "verbose": false,
+            "pedantic": false,
+            "lang": "rust",
+            "version": env!("CARGO_PKG_VERSION"),
+            "name": options.name,
+        });
+        if let Some(user) = &options.user {
+            connect["user"] = user.as_str().into();
+            connect["pass"] = options.password.as_deref().unwrap_or_default().into();
+        }
+        if let Some(token) = &options.token {
+            connect["auth_token"] = token.as_str().into();
+        }
+        client
+            .publisher
+            .write(format!("CONNECT {}\r\nPING\r\n", connect).as_bytes())?;
+        loop {
+            match client.next_op(deadline)? {
+                Some(Op::Pong) => return Ok(client),
+                Some(Op::Err(message)) => {
+                    return Err(io::Error::new(ErrorKind::ConnectionRefused, message))
+                }
+                Some(_) => {}
+                None => return Err(io::Error::new(ErrorKind::TimedOut, "no reply to CONNECT")),
+            }
+        }
+    }
+
+    pub fn publisher(&self) -> NatsPublisher {
+        self.publisher.clone()
+    }
+
+    /// Subscribe to `subject`, which may use the `*` and `>` wildcards.
+    /// Returns the subscription id for [`unsubscribe`](Self::unsubscribe).
+    pub fn subscribe(&mut self, subject: &str) -> io::Result<u64> {
+        let sid = self.next_sid;
+        self.next_sid += 1;
+        self.publisher
+            .write(format!("SUB {} {}\r\n", subject, sid).as_bytes())?;
+        Ok(sid)
+    }
+
+    pub fn unsubscribe(&mut self, sid: u64) -> io::Result<()> {
+        self.publisher
+            .write(format!("UNSUB {}\r\n", sid).as_bytes())
+    }
+
+    /// Wait up to `timeout` for the next message, answering the server's
+    /// pings meanwhile.
+    pub fn next_message(&mut self, timeout: Duration) -> io::Result<Option<NatsMessage>> {
+        let deadline = Instant::now() + timeout;
+        while let Some(op) = self.next_op(deadline)? {
+            match op {
+                Op::Msg(message) => return Ok(Some(message)),
+                Op::Err(message) => return Err(protocol(&message)),
+                _ => {}
+            }
+        }
+        Ok(None)
+    }
+
+    /// Next operation from the server, or `None` once `deadline` passes.
+    fn next_op(&mut self, deadline: Instant) -> io::Result<Option<Op>> {
+        loop {
+            if let Some(op) = self.parse_op()? {
+                if let Op::Ping = op {
+                    self.publisher.write(b"PONG\r\n")?;
+                }
+                return Ok(Some(op));
+            }
+            let now = Instant::now();
+            if now >= deadline {
+                return Ok(None);
+            }
+            self.stream.set_read_timeout(Some(deadline - now))?;
+            let mut chunk = [0; 4096];
+            match self.stream.read(&mut chunk) {
+                Ok(0) => {
+                    return Err(io::Error::new(
+                        ErrorKind::UnexpectedEof,
+                        "server closed the connection",
+                    ))
+                }
+                Ok(n) => self.buf.extend_from_slice(&chunk[..n]),
+                Err(e) if matches!(e.kind(), ErrorKind::WouldBlock | ErrorKind::TimedOut) => {
+                    return Ok(None)
+                }
+                Err(e) => return Err(e),
+            }
+        }
+    }
+
+    /// Take one complete operation off the front of the buffer.
+    fn parse_op(&mut self) -> io::Result<Option<Op>> {
+        let Some(end) = self.buf.windows(2).position(|w| w == b"\r\n") else {
+            return Ok(None);
+        };
+        let line = String::from_utf8_lossy(&self.buf[..end]).into_owned();
+        let (verb, rest) = line.split_once(' ').unwrap_or((&line, ""));
+        let op = match verb.to_ascii_uppercase().as_str() {
+            "MSG" => {
+                let parts: Vec<&str> = rest.split_whitespace().collect();
+                let (subject, reply, len) = match parts.as_slice() {
+                    [subject, _sid, len] => (subject, None, len),
+                    [subject, _sid, reply, len] => (subject, Some(reply.to_string()), len),
+                    _ => return Err(protocol(&format!("malformed `{}`", line))),
+                };
+                let len: usize = len
+                    .parse()
+                    .map_err(|_| protocol(&format!("malformed `{}`", line)))?;
+                let start = end + 2;
+                if self.buf.len() < start + len + 2 {
+                    return Ok(None);
+                }
+                let payload = self.buf[start..start + len].to_vec();
+                self.buf.drain(..start + len + 2);
+                return Ok(Some(Op::Msg(NatsMessage {
+                    subject: subject.to_string(),
+                    reply,
+                    payload,
+                })));
+            }
+            "INFO" => Op::Info,
+            "PING" => Op::Ping,
+            "PONG" => Op::Pong,
+            "+OK" => Op::Ok,
+            "-ERR" => Op::Err(rest.trim().trim_matches('\'').to_string()),
+            _ => return Err(protocol(&format!("unexpected `{}`", line))),
+        };
+        self.buf.drain(..end + 2);
+        Ok(Some(op))
+    }
+}
+
+/// What travels between agents: a message from `send`, or one of the
+/// sender's [`AgentEvent`]s.
+#[derive(Clone, Debug, PartialEq, Serialize, Deserialize)]
+pub struct Envelope {
+    pub from: String,
+    /// [`MESSAGE_KIND`] or the event name, e.g. `memory_changed`.
+    pub kind: String,
+    pub payload: Value,
+}
+
+/// Subject `agent` receives messages on.
+pub fn inbox(prefix: &str, agent: &str) -> String {
+    format!("{}.agent.{}", prefix, agent)
+}
+
+/// Subject `agent` publishes `event` on.
+pub fn event_subject(prefix: &str, agent: &str, event: &str) -> String {
+    format!("{}.events.{}.{}", prefix, agent, event)
+}
+
+/// A message for the local agent, and where to send its response.
+#[derive(Clone, Debug, PartialEq)]
+pub struct Delivery {
+    pub message: InputMessage,
+    pub reply: Option<String>,
+}
+
+/// One agent's connection to the others: its inbox plus the event streams
+/// of the agents it follows.
+pub struct NatsTransport {
+    client: NatsClient,
+    prefix: String,
+    agent: String,
+    /// Followed agent name to subscription id.
+    following: HashMap<String, u64>,
+}
+
+impl NatsTransport {
+    /// Connect and subscribe to `agent`'s inbox.
+    pub fn connect(options: &NatsOptions, prefix: &str, agent: &str) -> io::Result<Self> {
+        let mut client = NatsClient::connect(options)?;
+        client.subscribe(&inbox(prefix, agent))?;
+        Ok(Self {
+            client,
+            prefix: prefix.to_string(),
+            agent: agent.to_string(),
+            following: HashMap::new(),
+        })
+    }
+
+    /// Receive `agent`'s events from now on.
+    pub fn follow(&mut self, agent: &str) -> io::Result<()> {
+        if self.following.contains_key(agent) {
+            return Ok(());
+        }
+        let sid = self
+            .client
+            .subscribe(&format!("{}.events.{}.>", self.prefix, agent))?;
+        self.following.insert(agent.to_string(), sid);
+        Ok(())
+    }
+
+    pub fn unfollow(&mut self, agent: &str) -> io::Result<()> {
+        match self.following.remove(agent) {
+            Some(sid) => self.client.unsubscribe(sid),
+            None => Ok(()),
+        }
+    }
+
+    /// Send `text` to the agent named `to`.
+    pub fn send(&self, to: &str, text: &str) -> io::Result<()> {
+        let envelope = Envelope {
+            from: self.agent.clone(),
+            kind: MESSAGE_KIND.to_string(),
+            payload: text.into(),
+        };
+        self.publish(&inbox(&self.prefix, to), None, &envelope)
+    }
+
+    /// Publish `event` of the local agent to its followers.
+    pub fn publish_event(&self, event: &AgentEvent) -> io::Result<()> {
+        publish_event(&self.client.publisher(), &self.prefix, &self.agent, event)
+    }
+
+    /// Callback for [`SentienceAgent::on_event`](crate::SentienceAgent::on_event)
+    /// that publishes the agent's events.
+    pub fn event_sink(&self) -> impl FnMut(&str, &AgentEvent) + Send + 'static {
+        let publisher = self.client.publisher();
+        let prefix = self.prefix.clone();
+        move |agent, event| {
+            if let Err(e) = publish_event(&publisher, &prefix, agent, event) {
+                tracing::warn!("publishing {} to NATS failed: {}", event.name(), e);
+            }
+        }
+    }
+
+    /// Answer the sender of a delivery with the agent's output.
+    pub fn reply(&self, subject: &str, text: &str) -> io::Result<()> {
+        self.client
+            .publisher()
+            .publish(subject, None, text.as_bytes())
+    }
+
+    /// Wait up to `timeout` for the next message or followed event.
+    ///
+    /// Messages become the payload of an input with metadata `from`,
+    /// `kind` and `subject`. Events arrive as their JSON. A payload that is
+    /// not an [`Envelope`], e.g. from `nats pub`, is taken as a message
+    /// from nobody.
+    pub fn next_delivery(&mut self, timeout: Duration) -> io::Result<Option<Delivery>> {
+        let Some(message) = self.client.next_message(timeout)? else {
+            return Ok(None);
+        };
+        let envelope =
+            serde_json::from_slice::<Envelope>(&message.payload).unwrap_or_else(|_| Envelope {
+                from: String::new(),
+                kind: MESSAGE_KIND.to_string(),
+                payload: String::from_utf8_lossy(&message.payload)
+                    .into_owned()
+                    .into(),
+            });
+        let payload = match envelope.payload {
+            Value::String(text) => text,
+            other => other.to_string(),
+        };
+        Ok(Some(Delivery {
+            message: InputMessage::new(&payload)
+                .with_metadata("from", &envelope.from)
+                .with_metadata("kind", &envelope.kind)
+                .with_metadata("subject", &message.subject)
+                .with_metadata("source", "nats"),
+            reply: message.reply,
+        }))
+    }
+
+    fn publish(&self, subject: &str, reply: Option<&str>, envelope: &Envelope) -> io::Result<()> {
+        let body = serde_json::to_vec(envelope).map_err(io::Error::other)?;
+        self.client.publisher().publish(subject, reply, &body)
+    }
+}
+
+fn publish_event(
+    publisher: &NatsPublisher,
+    prefix: &str,
+    agent: &str,
+    event: &AgentEvent,
+) -> io::Result<()> {
+    let envelope = Envelope {
+        from: agent.to_string(),
+        kind: event.name().to_string(),
+        payload: serde_json::to_value(event).map_err(io::Error::other)?,
+    };
+    let body = serde_json::to_vec(&envelope).map_err(io::Error::other)?;
+    publisher.publish(&event_subject(prefix, agent, event.name()), None, &body)
+}
+
+fn protocol(message: &str) -> io::Error {
+    io::Error::new(ErrorKind::InvalidData, message.to_string())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::io::{BufRead, BufReader};
+    use std::net::TcpListener;
+    use std::thread;
+
+    /// Accepts one client, checks its handshake, then reports each line it
+    /// sends and writes whatever the test queues.
+    fn mock_server() -> (String, thread::JoinHandle<Vec<String>>) {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = listener.local_addr().unwrap().to_string();
+        let handle = thread::spawn(move || {
+            let (mut stream, _) = listener.accept().unwrap();
+            stream
+                .write_all(b"INFO {\"server_id\":\"test\",\"max_payload\":1048576}\r\n")
+                .unwrap();
+            let mut reader = BufReader::new(stream.try_clone().unwrap());
+            let mut lines = Vec::new();
+            loop {
+                let mut line = String::new();
+                if reader.read_line(&mut line).unwrap() == 0 {
+                    return lines;
+                }
+                let line = line.trim_end().to_string();
+                if line == "PING" {
+                    stream.write_all(b"PONG\r\n").unwrap();
+                } else if line.starts_with("SUB sentience.agent.Echo") {
+                    // A message with a reply subject, split by a server ping.
+                    stream
+                        .write_all(b"PING\r\nMSG sentience.agent.Echo 1 _INBOX.1 5\r\nhel")
+                        .unwrap();
+                    stream.write_all(b"lo\r\n").unwrap();
+                    let envelope = r#"{"from":"Planner","kind":"message","payload":"plan ready"}"#;
+                    stream
+                        .write_all(
+                            format!(
+                                "MSG sentience.agent.Echo 1 {}\r\n{}\r\n",
+                                envelope.len(),
+                                envelope
+                            )
+                            .as_bytes(),
+                        )
+                        .unwrap();
+                }
+                lines.push(line);
+            }
+        });
+        (addr, handle)
+    }
+
+    #[test]
+    fn delivers_messages_and_publishes_events() {
+        let (addr, server) = mock_server();
+        let mut options = NatsOptions::new(&format!("nats://{}", addr));
+        options.token = Some("secret".to_string());
+        let mut transport = NatsTransport::connect(&options, DEFAULT_PREFIX, "Echo").unwrap();
+
+        let raw = transport
+            .next_delivery(Duration::from_secs(5))
+            .unwrap()
+            .unwrap();
+        assert_eq!(raw.message.payload, "hello");
+        assert_eq!(raw.reply.as_deref(), Some("_INBOX.1"));
+        let sent = transport
+            .next_delivery(Duration::from_secs(5))
+            .unwrap()
+            .unwrap();
+        assert_eq!(sent.message.payload, "plan ready");
+        assert!(sent
+            .message
+            .metadata
+            .contains(&("from".to_string(), "Planner".to_string())));
+
+        transport.follow("Planner").unwrap();
+        transport.follow("Planner").unwrap();
+        transport.unfollow("Planner").unwrap();
+        transport.send("Planner", "thanks").unwrap();
+        transport.reply("_INBOX.1", "got it").unwrap();
+        let mut sink = transport.event_sink();
+        sink(
+            "Echo",
+            &AgentEvent::MemoryChanged {
+                region: "long".to_string(),
+                key: "k".to_string(),
+                value: "v".to_string(),
+            },
+        );
+        drop(sink);
+        drop(transport);
+
+        let lines = server.join().unwrap();
+        assert!(lines[0].starts_with("CONNECT {"));
+        assert!(lines[0].contains("\"auth_token\":\"secret\""));
+        let rest: Vec<&str> = lines[1..].iter().map(String::as_str).collect();
+        assert_eq!(
+            rest,
+            [
+                "PING",
+                "SUB sentience.agent.Echo 1",
+                "PONG",
+                "SUB sentience.events.Planner.> 2",
+                "UNSUB 2",
+                "PUB sentience.agent.Planner 51",
+                r#"{"from":"Echo","kind":"message","payload":"thanks"}"#,
+                "PUB _INBOX.1 6",
+                "got it",
+                "PUB sentience.events.Echo.memory_changed 114",
+                r#"{"from":"Echo","kind":"memory_changed","payload":{"event":"memory_changed","key":"k","region":"long","value":"v"}}"#,
+            ]
+        );
+    }
+}
@@ -0,0 +1,204 @@
+//! Slack bot over the Events API: Slack POSTs channel messages to our
+//! endpoint and replies go out through `chat.postMessage`.
+
+use crate::adapters::chat::{split_text, ChatError, ChatMessage};
+use crate::config::{env_or, SlackConfig};
+use crate::hmac::{constant_time_eq, hmac_sha256};
+use serde_json::{json, Value};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+const DEFAULT_API_URL: &str = "https://slack.com/api";
+/// Requests signed longer ago than this are rejected as possible replays.
+const MAX_SIGNATURE_AGE_SECS: u64 = 5 * 60;
+/// Slack truncates longer messages.
+const MAX_MESSAGE_CHARS: usize = 4000;
+
+#[derive(Clone, Debug)]
+pub struct SlackOptions {
+    pub bot_token: String,
+    /// Used to check that events really come from Slack.
+    pub signing_secret: String,
+    pub api_url: String,
+}
+
+impl SlackOptions {
+    pub fn configured(config: &SlackConfig) -> Result<Self, String> {
+        Ok(Self {
+            bot_token: env_or("SLACK_BOT_TOKEN", config.bot_token.as_ref())
+                .ok_or("SLACK_BOT_TOKEN is not set")?,
+            signing_secret: env_or("SLACK_SIGNING_SECRET", config.signing_secret.as_ref())
+                .ok_or("SLACK_SIGNING_SECRET is not set")?,
+            api_url: DEFAULT_API_URL.to_string(),
+        })
+    }
+}
+
+/// What an Events API request asks of us.
+#[derive(Clone, Debug, PartialEq)]
+pub enum SlackEvent {
+    /// Endpoint verification; the challenge must be echoed back.
+    Challenge(String),
+    Message(ChatMessage),
+    /// Bot messages, edits and event types the agent does not handle.
+    Ignored,
+}
+
+pub struct SlackAdapter {
+    options: SlackOptions,
+    client: reqwest::blocking::Client,
+}
+
+impl SlackAdapter {
+    pub fn new(options: SlackOptions) -> Self {
+        Self {
+            options,
+            client: reqwest::blocking::Client::builder()
+                .timeout(Duration::from_secs(30))
+                .build()
+                .unwrap_or_default(),
+        }
+    }
+
+    /// Check the `X-Slack-Signature` of a request against the signing
+    /// secret.
+    pub fn verify(&self, timestamp: &str, signature: &str, body: &[u8]) -> bool {
+        let Ok(sent) = timestamp.parse::<u64>() else {
+            return false;
+        };
+        let now = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map(|d| d.as_secs())
+            .unwrap_or(0);
+        if now.abs_diff(sent) > MAX_SIGNATURE_AGE_SECS {
+            return false;
+        }
+        let mut base = format!("v0:{}:", timestamp).into_bytes();
+        base.extend_from_slice(body);
+        let expected = format!(
+            "v0={}",
+            hex::encode(hmac_sha256(self.options.signing_secret.as_bytes(), &base))
+        );
+        constant_time_eq(expected.as_bytes(), signature.as_bytes())
+    }
+
+    /// Post `text` to `channel`, in the thread `thread_ts` if given.
+    pub fn post_message(
+        &self,
+        channel: &str,
+        text: &str,
+        thread_ts: Option<&str>,
+    ) -> Result<(), ChatError> {
+        for part in split_text(text, MAX_MESSAGE_CHARS) {
+            let mut body = json!({ "channel": channel, "text": part });
+            if let Some(ts) = thread_ts {
+                body["thread_ts"] = ts.into();
+            }
+            let response = self
+                .client
+                .post(format!("{}/chat.postMessage", self.options.api_url))
+                .bearer_auth(&self.options.bot_token)
+                .json(&body)
+                .send()
+                .map_err(|e| ChatError::Http(e.to_string()))?;
+            let status = response.status().as_u16();
+            let reply: Value = response
+                .json()
+                .map_err(|e| ChatError::Decode(e.to_string()))?;
+            // Slack reports most failures with 200 and `"ok": false`.
+            if reply["ok"] != true {
+                return Err(ChatError::Api {
+                    status,
+                    message: reply["error"]
+                        .as_str()
+                        .unwrap_or("unknown error")
+                        .to_string(),
+                });
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Interpret the JSON body of an Events API request.
+pub fn parse_event(body: &[u8]) -> Result<SlackEvent, ChatError> {
+    let payload: Value =
+        serde_json::from_slice(body).map_err(|e| ChatError::Decode(e.to_string()))?;
+    if payload["type"] == "url_verification" {
+        let challenge = payload["challenge"].as_str().unwrap_or_default();
+        return Ok(SlackEvent::Challenge(challenge.to_string()));
+    }
+    let event = &payload["event"];
+    let is_user_message = payload["type"] == "event_callback"
+        && (event["type"] == "message" || event["type"] == "app_mention")
+        && event.get("subtype").is_none()
+        && event.get("bot_id").is_none();
+    let (Some(channel), Some(user), Some(text)) = (
+        event["channel"].as_str(),
+        event["user"].as_str(),
+        event["text"].as_str(),
+    ) else {
+        return Ok(SlackEvent::Ignored);
+    };
+    if !is_user_message {
+        return Ok(SlackEvent::Ignored);
+    }
+    Ok(SlackEvent::Message(ChatMessage {
+        platform: "slack",
+        channel: channel.to_string(),
+        user: user.to_string(),
+        text: text.to_string(),
+        // Answer inside the thread the message belongs to, if any.
+        reply_to: event["thread_ts"].as_str().map(str::to_string),
+    }))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn verifies_signatures() {
+        let adapter = SlackAdapter::new(SlackOptions {
+            bot_token: "xoxb".to_string(),
+            signing_secret: "secret".to_string(),
+            api_url: DEFAULT_API_URL.to_string(),
+        });
+        let now = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .unwrap()
+            .as_secs()
+            .to_string();
+        let body = br#"{"type":"event_callback"}"#;
+        let mut base = format!("v0:{}:", now).into_bytes();
+        base.extend_from_slice(body);
+        let signature = format!("v0={}", hex::encode(hmac_sha256(b"secret", &base)));
+
+        assert!(adapter.verify(&now, &signature, body));
+        assert!(!adapter.verify(&now, &signature, b"{}"));
+        assert!(!adapter.verify("1000", &signature, body));
+    }
+
+    #[test]
+    fn parses_events() {
+        assert_eq!(
+            parse_event(br#"{"type":"url_verification","challenge":"abc"}"#).unwrap(),
+            SlackEvent::Challenge("abc".to_string())
+        );
+        let message = parse_event(
+            br#"{"type":"event_callback","event":{"type":"message","channel":"C1","user":"U1","text":"hi","ts":"1.2"}}"#,
+        )
+        .unwrap();
+        let SlackEvent::Message(message) = message else {
+            panic!("expected a message");
+        };
+        assert_eq!(message.session_key(), "slack:U1");
+        assert_eq!(message.text, "hi");
+        assert_eq!(
+            parse_event(
+                br#"{"type":"event_callback","event":{"type":"message","channel":"C1","user":"U1","text":"hi","bot_id":"B1"}}"#
+            )
+            .unwrap(),
+            SlackEvent::Ignored
+        );
+    }
+}
@@ -0,0 +1,366 @@
+//! Speech input: audio files, or a raw PCM stream such as a microphone piped
+//! through `arecord`, transcribed to text for `on input`.
+
+use crate::adapters::InputMessage;
+use crate::config::{env_or, SpeechConfig};
+use std::fmt;
+use std::fs;
+use std::io::{self, Read};
+use std::path::Path;
+use std::process::Command;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::time::Duration;
+
+const DEFAULT_BASE_URL: &str = "https://api.openai.com/v1";
+const DEFAULT_MODEL: &str = "whisper-1";
+
+#[derive(Debug)]
+pub enum SpeechError {
+    Io(io::Error),
+    /// The transcription service could not be reached.
+    Http(String),
+    Api {
+        status: u16,
+        message: String,
+    },
+    /// The local transcriber failed.
+    Command(String),
+}
+
+impl fmt::Display for SpeechError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            SpeechError::Io(e) => write!(f, "audio: {}", e),
+            SpeechError::Http(msg) => write!(f, "transcription request failed: {}", msg),
+            SpeechError::Api { status, message } => {
+                write!(f, "transcription API returned {}: {}", status, message)
+            }
+            SpeechError::Command(msg) => write!(f, "transcriber failed: {}", msg),
+        }
+    }
+}
+
+impl std::error::Error for SpeechError {}
+
+impl From<io::Error> for SpeechError {
+    fn from(e: io::Error) -> Self {
+        SpeechError::Io(e)
+    }
+}
+
+/// Turns audio into text.
+pub trait Transcriber {
+    /// Transcribe `audio`, the contents of a file called `filename` (the
+    /// extension tells the service the format).
+    fn transcribe(&self, audio: &[u8], filename: &str) -> Result<String, SpeechError>;
+}
+
+/// The Whisper transcription endpoint of OpenAI or a compatible server.
+pub struct WhisperApi {
+    api_key: String,
+    base_url: String,
+    model: String,
+    language: Option<String>,
+    client: reqwest::blocking::Client,
+}
+
+impl WhisperApi {
+    pub fn new(api_key: &str, base_url: &str, model: &str) -> Self {
+        Self {
+            api_key: api_key.to_string(),
+            base_url: base_url.trim_end_matches('/').to_string(),
+            model: model.to_string(),
+            language: None,
+            client: reqwest::blocking::Client::builder()
+                .timeout(Duration::from_secs(300))
+                .build()
+                .unwrap_or_default(),
+        }
+    }
+}
+
+impl Transcriber for WhisperApi {
+    fn transcribe(&self, audio: &[u8], filename: &str) -> Result<String, SpeechError> {
+        let boundary = format!("sentience-{:016x}", next_id());
+        let mut fields = vec![("model", self.model.as_str()), ("response_format", "text")];
+        if let Some(language) = &self.language {
+            fields.push(("language", language));
+        }
+        let body = multipart(&boundary, &fields, filename, audio);
+
+        let response = self
+            .client
+            .post(format!("{}/audio/transcriptions", self.base_url))
+            .bearer_auth(&self.api_key)
+            .header(
+                "Content-Type",
+                format!("multipart/form-data; boundary={}", boundary),
+            )
+            .body(body)
+            .send()
+            .map_err(|e| SpeechError::Http(e.to_string()))?;
+        let status = response.status();
+        let text = response
+            .text()
+            .map_err(|e| SpeechError::Http(e.to_string()))?;
+        if !status.is_success() {
+            return Err(SpeechError::Api {
+                status: status.as_u16(),
+                message: text,
+            });
+        }
+        Ok(text.trim().to_string())
+    }
+}
+
+/// A local transcriber such as whisper.cpp, run once per file.
+pub struct CommandTranscriber {
+    /// Program and arguments; `{file}` is replaced with the audio path.
+    pub command: Vec<String>,
+}
+
+impl Transcriber for CommandTranscriber {
+    fn transcribe(&self, audio: &[u8], filename: &str) -> Result<String, SpeechError> {
+        let (program, args) = self
+            .command
+            .split_first()
+            .ok_or_else(|| SpeechError::Command("empty command".to_string()))?;
+        let extension = Path::new(filename)
+            .extension()
+            .and_then(|e| e.to_str())
+            .unwrap_or("wav");
+        let path = std::env::temp_dir().join(format!(
+            "sentience-speech-{}-{}.{}",
+            std::process::id(),
+            next_id(),
+            extension
+        ));
+        fs::write(&path, audio)?;
+        let output = Command::new(program)
+            .args(
+                args.iter()
+                    .map(|a| a.replace("{file}", &path.to_string_lossy())),
+            )
+            .output();
+        let _ = fs::remove_file(&path);
+
+        let output = output.map_err(|e| SpeechError::Command(format!("{}: {}", program, e)))?;
+        if !output.status.success() {
+            return Err(SpeechError::Command(
+                String::from_utf8_lossy(&output.stderr).trim().to_string(),
+            ));
+        }
+        Ok(String::from_utf8_lossy(&output.stdout).trim().to_string())
+    }
+}
+
+/// The transcriber described by `config`: its local command if set, else
+/// the Whisper API (which needs an API key).
+pub fn configured(config: &SpeechConfig) -> Result<Box<dyn Transcriber>, String> {
+    if let Some(command) = &config.command {
+        return Ok(Box::new(CommandTranscriber {
+            command: command.clone(),
+        }));
+    }
+    let key = env_or("OPENAI_API_KEY", config.api_key.as_ref())
+        .ok_or("set OPENAI_API_KEY or speech.command for transcription")?;
+    let base_url = env_or("OPENAI_BASE_URL", config.base_url.as_ref())
+        .unwrap_or_else(|| DEFAULT_BASE_URL.to_string());
+    let model = config.model.as_deref().unwrap_or(DEFAULT_MODEL);
+    let mut api = WhisperApi::new(&key, &base_url, model);
+    api.language = config.language.clone();
+    Ok(Box::new(api))
+}
+
+/// Transcribe an audio file into a message for `on input`.
+pub fn transcribe_file(
+    transcriber: &dyn Transcriber,
+    path: &Path,
+) -> Result<InputMessage, SpeechError> {
+    let audio = fs::read(path)?;
+    let filename = path
+        .file_name()
+        .map(|n| n.to_string_lossy().into_owned())
+        .unwrap_or_else(|| "audio.wav".to_string());
+    let text = transcriber.transcribe(&audio, &filename)?;
+    Ok(InputMessage::new(&text)
+        .with_metadata("source", "speech")
+        .with_metadata("file", &path.display().to_string()))
+}
+
+/// Format of a raw PCM stream: signed 16-bit little-endian samples.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub struct PcmFormat {
+    pub sample_rate: u32,
+    pub channels: u16,
+}
+
+impl Default for PcmFormat {
+    /// What Whisper models expect: 16 kHz mono.
+    fn default() -> Self {
+        Self {
+            sample_rate: 16_000,
+            channels: 1,
+        }
+    }
+}
+
+/// Cut a raw PCM stream into `chunk` long WAV segments, transcribe each and
+/// pass non-empty transcripts to `handler` until the stream ends.
+pub fn transcribe_stream(
+    transcriber: &dyn Transcriber,
+    mut stream: impl Read,
+    format: PcmFormat,
+    chunk: Duration,
+    mut handler: impl FnMut(InputMessage),
+) -> Result<(), SpeechError> {
+    let bytes_per_second = format.sample_rate as usize * format.channels as usize * 2;
+    let chunk_bytes = ((bytes_per_second as f64 * chunk.as_secs_f64()) as usize).max(2) & !1;
+    let mut index = 0;
+    loop {
+        let mut pcm = Vec::with_capacity(chunk_bytes);
+        (&mut stream)
+            .take(chunk_bytes as u64)
+            .read_to_end(&mut pcm)?;
+        if pcm.is_empty() {
+            return Ok(());
+        }
+        let text = transcriber.transcribe(&wav(&pcm, format), "chunk.wav")?;
+        if !text.is_empty() {
+            handler(
+                InputMessage::new(&text)
+                    .with_metadata("source", "speech")
+                    .with_metadata("chunk", &index.to_string()),
+            );
+        }
+        index += 1;
+    }
+}
+
+/// Wrap 16-bit PCM samples in a WAV header.
+pub fn wav(pcm: &[u8], format: PcmFormat) -> Vec<u8> {
+    let byte_rate = format.sample_rate * format.channels as u32 * 2;
+    let mut out = Vec::with_capacity(44 + pcm.len());
+    out.extend_from_slice(b"RIFF");
+    out.extend_from_slice(&(36 + pcm.len() as u32).to_le_bytes());
+    out.extend_from_slice(b"WAVEfmt ");
+    out.extend_from_slice(&16u32.to_le_bytes());
+    out.extend_from_slice(&1u16.to_le_bytes()); // PCM
+    out.extend_from_slice(&format.channels.to_le_bytes());
+    out.extend_from_slice(&format.sample_rate.to_le_bytes());
+    out.extend_from_slice(&byte_rate.to_le_bytes());
+    out.extend_from_slice(&(format.channels * 2).to_le_bytes());
+    out.extend_from_slice(&16u16.to_le_bytes());
+    out.extend_from_slice(b"data");
+    out.extend_from_slice(&(pcm.len() as u32).to_le_bytes());
+    out.extend_from_slice(pcm);
+    out
+}
+
+fn multipart(boundary: &str, fields: &[(&str, &str)], filename: &str, file: &[u8]) -> Vec<u8> {
+    let mut body = Vec::new();
+    for (name, value) in fields {
+        body.extend_from_slice(
+            format!(
+                "--{}\r\nContent-Disposition: form-data; name=\"{}\"\r\n\r\n{}\r\n",
+                boundary, name, value
+            )
+            .as_bytes(),
+        );
+    }
+    body.extend_from_slice(
+        format!(
+            "--{}\r\nContent-Disposition: form-data; name=\"file\"; filename=\"{}\"\r\n\
+             Content-Type: application/octet-stream\r\n\r\n",
+            boundary,
+            filename.replace('"', "")
+        )
+        .as_bytes(),
+    );
+    body.extend_from_slice(file);
+    body.extend_from_slice(format!("\r\n--{}--\r\n", boundary).as_bytes());
+    body
+}
+
+fn next_id() -> u64 {
+    static COUNTER: AtomicU64 = AtomicU64::new(0);
+    let nanos = std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)
+        .map(|d| d.subsec_nanos() as u64)
+        .unwrap_or(0);
+    (COUNTER.fetch_add(1, Ordering::Relaxed) << 32) | nanos
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::cell::RefCell;
+
+    /// Reports the size of each WAV it is given.
+    struct Sizes(RefCell<Vec<usize>>);
+
+    impl Transcriber for Sizes {
+        fn transcribe(&self, audio: &[u8], _filename: &str) -> Result<String, SpeechError> {
+            assert_eq!(&audio[..4], b"RIFF");
+            self.0.borrow_mut().push(audio.len() - 44);
+            Ok(format!("{} bytes", audio.len() - 44))
+        }
+    }
+
+    #[test]
+    fn chunks_pcm_streams() {
+        let format = PcmFormat {
+            sample_rate: 100,
+            channels: 1,
+        };
+        let transcriber = Sizes(RefCell::new(Vec::new()));
+        let mut messages = Vec::new();
+        transcribe_stream(
+            &transcriber,
+            &[0u8; 500][..],
+            format,
+            Duration::from_secs(2),
+            |m| messages.push(m),
+        )
+        .unwrap();
+
+        assert_eq!(*transcriber.0.borrow(), [400, 100]);
+        assert_eq!(messages[1].payload, "100 bytes");
+        assert!(messages[1]
+            .metadata
+            .contains(&("chunk".to_string(), "1".to_string())));
+    }
+
+    #[test]
+    fn builds_wav_and_multipart() {
+        let audio = wav(&[1, 2, 3, 4], PcmFormat::default());
+        assert_eq!(audio.len(), 48);
+        assert_eq!(&audio[8..16], b"WAVEfmt ");
+        assert_eq!(
+            u32::from_le_bytes(audio[24..28].try_into().unwrap()),
+            16_000
+        );
+
+        let body = multipart("b", &[("model", "whisper-1")], "a.wav", b"RIFF");
+        let text = String::from_utf8(body).unwrap();
+        assert!(text.starts_with(
+            "--b\r\nContent-Disposition: form-data; name=\"model\"\r\n\r\nwhisper-1\r\n"
+        ));
+        assert!(text.contains("filename=\"a.wav\""));
+        assert!(text.ends_with("RIFF\r\n--b--\r\n"));
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn runs_local_transcribers() {
+        let transcriber = CommandTranscriber {
+            command: vec![
+                "sh".into(),
+                "-c".into(),
+                "wc -c < \"$0\"".into(),
+                "{file}".into(),
+            ],
+        };
+        assert_eq!(transcriber.transcribe(b"12345", "x.wav").unwrap(), "5");
+    }
+}
@@ -0,0 +1,272 @@
+//! An agent's affect: drives such as curiosity, frustration and confidence,
+//! each a level from 0 to 1, that the runtime moves as things happen to the
+//! agent. Handlers act on them with `if state.frustration > 0.7 { ... }`,
+//! and they are saved with memory.
+//!
+//! [`Rule`]s say how far each trigger moves which drives. The triggers are
+//! the [`AgentEvent`](crate::events::AgentEvent)s memory writes and `reflect`
+//! cause (`memory_changed`, `goal_achieved`, `reflected`) and, after every
+//! handler run, `handler_succeeded` or `handler_failed`. They apply whether
+//! or not anyone listens for the events.
+
+use crate::config::AffectConfig;
+use serde::{Deserialize, Deserializer, Serialize, Serializer};
+use std::collections::BTreeMap;
+use std::sync::Arc;
+
+/// Names rules can be triggered by.
+pub const TRIGGERS: [&str; 5] = [
+    "memory_changed",
+    "goal_achieved",
+    "reflected",
+    "handler_succeeded",
+    "handler_failed",
+];
+
+/// Drives every agent starts with, and their levels.
+const DEFAULT_LEVELS: [(&str, f64); 3] = [
+    ("curiosity", 0.5),
+    ("frustration", 0.0),
+    ("confidence", 0.5),
+];
+
+/// How one trigger moves the drives.
+#[derive(Clone, Debug, PartialEq)]
+pub struct Rule {
+    pub on: String,
+    /// For memory triggers, the only key that counts.
+    pub key: Option<String>,
+    /// Amount added to each drive; negative lowers it.
+    pub adjust: Vec<(String, f64)>,
+}
+
+impl Rule {
+    fn new(on: &str, adjust: &[(&str, f64)]) -> Self {
+        Self {
+            on: on.to_string(),
+            key: None,
+            adjust: adjust
+                .iter()
+                .map(|(drive, amount)| (drive.to_string(), *amount))
+                .collect(),
+        }
+    }
+}
+
+/// Rules used unless the config file gives its own: failing frustrates and
+/// shakes confidence, succeeding calms and reassures, reaching the goal
+/// most of all, and reflecting feeds curiosity.
+pub fn default_rules() -> Vec<Rule> {
+    vec![
+        Rule::new(
+            "handler_failed",
+            &[("frustration", 0.2), ("confidence", -0.1)],
+        ),
+        Rule::new(
+            "handler_succeeded",
+            &[("frustration", -0.05), ("confidence", 0.02)],
+        ),
+        Rule::new(
+            "goal_achieved",
+            &[("confidence", 0.3), ("frustration", -1.0)],
+        ),
+        Rule::new("reflected", &[("curiosity", 0.05)]),
+    ]
+}
+
+#[derive(Clone, Debug, PartialEq)]
+pub struct Affect {
+    levels: BTreeMap<String, f64>,
+    rules: Arc<[Rule]>,
+}
+
+impl Default for Affect {
+    fn default() -> Self {
+        Self::new(BTreeMap::new(), default_rules())
+    }
+}
+
+impl Affect {
+    /// The default drives, with `levels` on top, moved by `rules`.
+    pub fn new(levels: BTreeMap<String, f64>, rules: Vec<Rule>) -> Self {
+        let mut affect = Self {
+            levels: DEFAULT_LEVELS
+                .iter()
+                .map(|(drive, level)| (drive.to_string(), *level))
+                .collect(),
+            rules: rules.into(),
+        };
+        affect.restore(levels);
+        affect
+    }
+
+    pub fn from_config(config: &AffectConfig) -> Result<Self, String> {
+        let rules = match &config.rules {
+            None => default_rules(),
+            Some(rules) => rules
+                .iter()
+                .map(|rule| {
+                    if !TRIGGERS.contains(&rule.on.as_str()) {
+                        return Err(format!(
+                            "affect rule on unknown trigger `{}` (expected {})",
+                            rule.on,
+                            TRIGGERS.join(", ")
+                        ));
+                    }
+                    Ok(Rule {
+                        on: rule.on.clone(),
+                        key: rule.key.clone(),
+                        adjust: rule.adjust.clone().into_iter().collect(),
+                    })
+                })
+                .collect::<Result<_, _>>()?,
+        };
+        Ok(Self::new(config.initial.clone(), rules))
+    }
+
+    pub fn level(&self, drive: &str) -> Option<f64> {
+        self.levels.get(drive).copied()
+    }
+
+    pub fn levels(&self) -> &BTreeMap<String, f64> {
+        &self.levels
+    }
+
+    /// Set `drive`, adding it if new, to `level` kept between 0 and 1.
+    pub fn set(&mut self, drive: &str, level: f64) {
+        if level.is_finite() {
+            self.levels.insert(drive.to_string(), level.clamp(0.0, 1.0));
+        }
+    }
+
+    /// Apply the rules for `trigger`; `key` is the memory key a memory
+    /// trigger is about.
+    pub fn react(&mut self, trigger: &str, key: Option<&str>) {
+        let rules = Arc::clone(&self.rules);
+        for rule in rules.iter().filter(|rule| rule.on == trigger) {
+            if rule.key.is_some() && rule.key.as_deref() != key {
+                continue;
+            }
+            for (drive, amount) in &rule.adjust {
+                let level = self.level(drive).unwrap_or(0.0);
+                self.set(drive, level + amount);
+            }
+        }
+    }
+
+    /// Take the levels saved with memory, keeping drives they do not name.
+    pub fn restore(&mut self, levels: BTreeMap<String, f64>) {
+        for (drive, level) in levels {
+            self.set(&drive, level);
+        }
+    }
+}
+
+/// Saved as its levels alone.
+impl Serialize for Affect {
+    fn serialize<S: Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+        self.levels.serialize(serializer)
+    }
+}
+
+/// Saved levels over the defaults, moved by the default rules.
+impl<'de> Deserialize<'de> for Affect {
+    fn deserialize<D: Deserializer<'de>>(deserializer: D) -> Result<Self, D::Error> {
+        Ok(Self::new(
+            BTreeMap::deserialize(deserializer)?,
+            default_rules(),
+        ))
+    }
+}
+
+/// Whether `level <op> value`, for `<`, `<=`, `>`, `>=`, `==` and `!=`.
+pub fn compare(level: f64, op: &str, value: f64) -> bool {
+    match op {
+        "<" => level < value,
+        "<=" => level <= value,
+        ">" => level > value,
+        ">=" => level >= value,
+        "==" => (level - value).abs() < 1e-9,
+        "!=" => (level - value).abs() >= 1e-9,
+        _ => false,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::config::AffectRule;
+    use crate::replkit::Repl;
+
+    #[test]
+    fn rules_move_drives_within_bounds() {
+        let mut affect = Affect::default();
+        for _ in 0..10 {
+            affect.react("handler_failed", None);
+        }
+        assert_eq!(affect.level("frustration"), Some(1.0));
+        assert!((affect.level("confidence").unwrap()).abs() < 1e-9);
+        affect.react("goal_achieved", Some("goal.achieved"));
+        assert_eq!(affect.level("frustration"), Some(0.0));
+
+        let config = AffectConfig {
+            initial: BTreeMap::from([("boredom".to_string(), 0.9)]),
+            rules: Some(vec![AffectRule {
+                on: "memory_changed".to_string(),
+                key: Some("news".to_string()),
+                adjust: BTreeMap::from([("boredom".to_string(), -0.5)]),
+            }]),
+        };
+        let mut affect = Affect::from_config(&config).unwrap();
+        affect.react("memory_changed", Some("msg"));
+        assert_eq!(affect.level("boredom"), Some(0.9));
+        affect.react("memory_changed", Some("news"));
+        assert!((affect.level("boredom").unwrap() - 0.4).abs() < 1e-9);
+        affect.react("handler_failed", None);
+        assert_eq!(affect.level("frustration"), Some(0.0));
+
+        let mut config = config;
+        config.rules.as_mut().unwrap()[0].on = "bored".to_string();
+        assert!(Affect::from_config(&config)
+            .unwrap_err()
+            .starts_with("affect rule on unknown trigger `bored`"));
+    }
+
+    #[test]
+    fn handlers_branch_on_state() {
+        let mut out = Vec::new();
+        let mut repl = Repl::new(&b""[..], &mut out);
+        repl.eval_source(concat!(
+            "agent Moody {\n",
+            "  on input(msg) {\n",
+            "    if state.frustration >= 0.2 {\n",
+            "      print \"calm down\"\n",
+            "    }\n",
+            "    if state.curiosity > 0.5 {\n",
+            "      print \"tell me more\"\n",
+            "    }\n",
+            "  }\n",
+            "}\n",
+        ))
+        .unwrap();
+        repl.handle_command(".input hi").unwrap();
+        repl.context_mut().affect.react("handler_failed", None);
+        repl.context_mut().affect.set("curiosity", 0.8);
+        repl.handle_command(".input hi").unwrap();
+        repl.handle_command(".state").unwrap();
+        drop(repl);
+        let out = String::from_utf8(out).unwrap();
+        assert_eq!(
+            out,
+            concat!(
+                "Agent: Moody\n",
+                "Agent: Moody [registered]\n",
+                "  calm down\n",
+                "  tell me more\n",
+                "confidence: 0.44\n",
+                "curiosity: 0.80\n",
+                "frustration: 0.15\n",
+            )
+        );
+    }
+}
@@ -0,0 +1,236 @@
+//! Several agents in one program. Every `agent` declaration is kept by
+//! name; the last one declared is the current agent, which handles input
+//! from outside, and `send <Agent> <expr>` hands the value of the
+//! expression to another agent's `on input` handler:
+//!
+//! ```text
+//! agent Logger {
+//!   on input(msg) {
+//!     print "logged: {msg}"
+//!   }
+//! }
+//! agent Greeter {
+//!   on input(msg) {
+//!     print "Hello, {msg}"
+//!     send Logger "greeted " + msg
+//!   }
+//! }
+//! ```
+//!
+//! What the handler prints appears where `send` is. The handler runs like
+//! a function call: it does not see the sender's variables, and a send
+//! made with [`MAX_DEPTH`] calls and sends already running, such as when
+//! two agents send to each other forever, fails.
+//!
+//! Each agent has memory of its own, and `mem.short` and `mem.long` are
+//! always the running agent's. The current agent's is the context's
+//! memory, which everything outside handlers reads and writes as before;
+//! the others' is in [`AgentContext::memories`] and swapped in while they
+//! handle a send. `mem.shared` is the same for every agent. The
+//! [store](crate::store) and [history](crate::history) only follow the
+//! agent whose memory they were attached to.
+
+use crate::context::{AgentContext, AgentMemory};
+use crate::error::{RuntimeError, RuntimeErrorKind};
+use crate::eval;
+use crate::types::Statement;
+use std::collections::HashMap;
+
+/// How deeply sends, counted with the function calls around them, may nest.
+/// Lower than [`functions::MAX_DEPTH`](crate::functions::MAX_DEPTH), as
+/// running a handler takes more stack than calling a function.
+pub const MAX_DEPTH: usize = 16;
+
+/// Make `agent`, an [`Statement::AgentDeclaration`], the current agent and
+/// keep it in the registry. The agent it replaces is kept as it is now, so
+/// changes `evolve` committed to it are not lost, and its memory is put
+/// aside under its name; `agent` starts with the memory it had when last
+/// current, or none. Memory written before any agent was declared goes to
+/// the first one.
+pub fn declare(ctx: &mut AgentContext, agent: Statement) {
+    if let Some(previous) = ctx.current_agent.take() {
+        let (from, to) = (agent_name(&previous), agent_name(&agent));
+        if from != to {
+            let (from, to) = (from.to_string(), to.to_string());
+            swap(ctx, &from, &to);
+        }
+        register(ctx, previous);
+    }
+    register(ctx, agent.clone());
+    ctx.current_agent = Some(agent);
+}
+
+fn register(ctx: &mut AgentContext, agent: Statement) {
+    if let Statement::AgentDeclaration { name, .. } = &agent {
+        ctx.agents.insert(name.clone(), agent.clone());
+    }
+}
+
+/// Names of the agents declared so far, in order.
+pub fn names(ctx: &AgentContext) -> Vec<&str> {
+    ctx.agents.keys().map(String::as_str).collect()
+}
+
+/// Run the `on input` handler of the agent called `name` with `message`,
+/// returning its output lines.
+pub fn send(
+    ctx: &mut AgentContext,
+    name: &str,
+    message: &str,
+    indent: &str,
+) -> Result<Vec<String>, RuntimeError> {
+    let target =
+        match &ctx.current_agent {
+            Some(
+                current @ Statement::AgentDeclaration {
+                    name: current_name, ..
+                },
+            ) if current_name == name => current.clone(),
+            _ => ctx.agents.get(name).cloned().ok_or_else(|| {
+                RuntimeError::new(RuntimeErrorKind::UnknownAgent(name.to_string()))
+            })?,
+        };
+    if ctx.variables.calls() >= MAX_DEPTH {
+        return Err(RuntimeError::new(RuntimeErrorKind::Expression(format!(
+            "sends to `{}` nest deeper than {}",
+            name, MAX_DEPTH
+        ))));
+    }
+    let sender = std::mem::replace(&mut ctx.current_agent, Some(target));
+    let from = sender
+        .as_ref()
+        .map(agent_name)
+        .unwrap_or_default()
+        .to_string();
+    let switched = from != name;
+    let (store, history) = if switched {
+        swap(ctx, &from, name);
+        (ctx.store.take(), ctx.history.take())
+    } else {
+        (None, None)
+    };
+    ctx.variables.call(HashMap::new());
+    let result = eval::run_block(ctx, "input", message, indent);
+    ctx.variables.leave_call();
+    ctx.returning = None;
+    if switched {
+        swap(ctx, name, &from);
+        *ctx.store = store;
+        ctx.history = history;
+    }
+    ctx.current_agent = sender;
+    result
+}
+
+/// Put the memory of `from`, the running agent, aside and bring in that
+/// of `to`, empty if it never ran.
+fn swap(ctx: &mut AgentContext, from: &str, to: &str) {
+    let incoming = ctx.memories.remove(to).unwrap_or_default();
+    let outgoing = AgentMemory {
+        mem_short: std::mem::replace(&mut ctx.mem_short, incoming.mem_short),
+        mem_long: std::mem::replace(&mut ctx.mem_long, incoming.mem_long),
+    };
+    ctx.memories.insert(from.to_string(), outgoing);
+}
+
+fn agent_name(agent: &Statement) -> &str {
+    match agent {
+        Statement::AgentDeclaration { name, .. } => name,
+        _ => "",
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use crate::context::AgentContext;
+    use crate::replkit::Repl;
+
+    #[test]
+    fn sends_messages_between_declared_agents() {
+        let mut out = Vec::new();
+        let mut repl = Repl::new(&b""[..], &mut out);
+        repl.eval_source(concat!(
+            "lang 0.2\n",
+            "agent Logger {\n",
+            "  on input(msg) {\n",
+            "    print \"logged: {msg}\"\n",
+            "  }\n",
+            "}\n",
+            "agent Echo {\n",
+            "  on input(msg) {\n",
+            "    send Echo msg\n",
+            "  }\n",
+            "}\n",
+            "agent Greeter {\n",
+            "  on input(msg) {\n",
+            "    let name = msg\n",
+            "    print \"Hello, {name}\"\n",
+            "    send Logger \"greeted \" + name\n",
+            "  }\n",
+            "}\n",
+        ))
+        .unwrap();
+        assert_eq!(super::names(repl.context()), ["Echo", "Greeter", "Logger"]);
+        repl.handle_command(".input Ana").unwrap();
+        repl.eval_source("send Nobody \"hi\"\nsend Echo \"hi\"\n")
+            .unwrap();
+        drop(repl);
+        let out = String::from_utf8(out).unwrap();
+        assert!(
+            out.contains("  Hello, Ana\n  logged: greeted Ana\n"),
+            "{}",
+            out
+        );
+        assert!(out.contains("SEN4017"), "{}", out);
+        assert!(out.contains("unknown agent `Nobody`"), "{}", out);
+        assert!(out.contains("nest deeper than 16"), "{}", out);
+    }
+
+    #[test]
+    fn each_agent_has_its_own_memory() {
+        let mut out = Vec::new();
+        let mut repl = Repl::new(&b""[..], &mut out);
+        repl.eval_source(concat!(
+            "lang 0.2\n",
+            "agent Counter {\n",
+            "  on input(msg) {\n",
+            "    print \"before: {mem.short[\\\"seen\\\"]}\"\n",
+            "    seen = msg\n",
+            "    print \"topic: {mem.shared[\\\"topic\\\"]}\"\n",
+            "  }\n",
+            "}\n",
+            "agent Main {\n",
+            "  on input(msg) {\n",
+            "    seen = msg\n",
+            "    send Counter \"one\"\n",
+            "  }\n",
+            "}\n",
+        ))
+        .unwrap();
+        repl.context_mut().set_mem("shared", "topic", "weather");
+        repl.handle_command(".input hello").unwrap();
+        repl.handle_command(".input again").unwrap();
+
+        let ctx = repl.context();
+        assert_eq!(ctx.get_mem("short", "seen"), "again");
+        assert_eq!(
+            ctx.memories["Counter"].mem_short.lookup("seen").unwrap(),
+            "one".into()
+        );
+        let path = std::env::temp_dir().join(format!("agents-{}.ctx", std::process::id()));
+        let path = path.to_str().unwrap();
+        ctx.save_indexed(path).unwrap();
+        let mut loaded = AgentContext::new();
+        loaded.load(path).unwrap();
+        std::fs::remove_file(path).unwrap();
+        assert_eq!(loaded.memories, ctx.memories);
+        assert_eq!(loaded.get_mem("shared", "topic"), "weather");
+        drop(repl);
+        let out = String::from_utf8(out).unwrap();
+        assert!(
+            out.ends_with("  before: \n  topic: weather\n  before: one\n  topic: weather\n"),
+            "{}",
+            out
+        );
+    }
+}
@@ -0,0 +1,479 @@
+//! Checks on a parsed program that the parser cannot make on its own:
+//! memory regions that do not exist, agents declared twice, handlers
+//! outside any agent, embeds of names nothing writes, pipelines through
+//! or sends to agents that are not declared, capabilities an agent uses without
+//! declaring them, `propose` outside `evolve` and imports of modules that
+//! do not exist.
+//!
+//! Diagnostics carry a line when the program was parsed
+//! [with locations](crate::parser::Parser::with_locations).
+
+use crate::eval::statement_name;
+use crate::lang;
+use crate::packages::Packages;
+use crate::sandbox::CAPABILITIES;
+use crate::stdlib;
+use crate::types::{Program, Statement};
+use serde::Serialize;
+use std::collections::HashSet;
+use std::fmt;
+
+/// Memory regions an agent can read and write.
+pub const REGIONS: [&str; 3] = ["short", "long", "shared"];
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq, PartialOrd, Ord, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Severity {
+    /// The program fails when the statement runs.
+    Error,
+    /// The program runs, but probably not as intended.
+    Warning,
+}
+
+impl fmt::Display for Severity {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            Severity::Error => "error",
+            Severity::Warning => "warning",
+        })
+    }
+}
+
+#[derive(Clone, Debug, PartialEq, Eq, Serialize)]
+pub struct Diagnostic {
+    /// Stable code of this kind of diagnostic, e.g. `SEN2001`; see
+    /// [`error`](crate::error).
+    pub code: &'static str,
+    pub severity: Severity,
+    pub line: Option<usize>,
+    /// Column on `line`, for diagnostics about one token.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub column: Option<usize>,
+    pub message: String,
+}
+
+impl fmt::Display for Diagnostic {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match (self.line, self.column) {
+            (Some(line), Some(column)) => write!(f, "{}:{}: ", line, column)?,
+            (Some(line), None) => write!(f, "{}: ", line)?,
+            _ => {}
+        }
+        write!(f, "{}[{}]: {}", self.severity, self.code, self.message)
+    }
+}
+
+/// Everything found in `program`, in source order.
+pub fn analyze(program: &Program) -> Vec<Diagnostic> {
+    let packages = Packages::default();
+    let mut analyzer = Analyzer {
+        declared: program
+            .statements
+            .iter()
+            .flat_map(|stmt| match stmt {
+                Statement::AgentDeclaration { name, .. } => vec![name.clone()],
+                Statement::Import(module) => packages
+                    .load(module)
+                    .map(|module| {
+                        module
+                            .statements
+                            .into_iter()
+                            .filter_map(|stmt| match stmt {
+                                Statement::AgentDeclaration { name, .. } => Some(name),
+                                _ => None,
+                            })
+                            .collect()
+                    })
+                    .unwrap_or_default(),
+                _ => Vec::new(),
+            })
+            .collect(),
+        packages,
+        ..Analyzer::default()
+    };
+    let top = Scope::of(&program.statements);
+    analyzer.body(&program.statements, &top, false);
+    analyzer.diagnostics
+}
+
+#[derive(Default)]
+struct Analyzer {
+    diagnostics: Vec<Diagnostic>,
+    /// Line of the statement being checked.
+    line: Option<usize>,
+    agents: HashSet<String>,
+    /// Every agent the program declares, for pipelines naming later ones.
+    declared: HashSet<String>,
+    /// Whether the statement being checked is in an `evolve` block.
+    evolving: bool,
+    /// Where imported modules are found.
+    packages: Packages,
+    /// Whether a statement other than a location marker has been checked.
+    begun: bool,
+}
+
+/// What an agent, or the top level, declares and writes.
+struct Scope {
+    /// Regions declared with `mem`, if any are.
+    regions: Option<HashSet<String>>,
+    /// Names an `embed` can read: handler parameters and assignments.
+    written: HashSet<String>,
+    /// Capabilities declared with `capabilities:`, if the agent declares them.
+    capabilities: Option<HashSet<String>>,
+}
+
+impl Scope {
+    fn of(body: &[Statement]) -> Self {
+        let mut scope = Scope {
+            regions: None,
+            written: HashSet::from(["input".to_string()]),
+            capabilities: None,
+        };
+        scope.collect(body);
+        scope
+    }
+
+    fn collect(&mut self, body: &[Statement]) {
+        for stmt in body {
+            match stmt {
+                Statement::MemDeclaration { target } => {
+                    self.regions
+                        .get_or_insert_with(HashSet::new)
+                        .insert(target.clone());
+                }
+                Statement::OnInput { param, body } | Statement::OnOutput { param, body } => {
+                    self.written.insert(param.clone());
+                    self.collect(body);
+                }
+                // Both store their input as `msg`.
+                Statement::Train { body, .. } | Statement::Evolve { body } => {
+                    self.written.insert("msg".to_string());
+                    self.collect(body);
+                }
+                Statement::Assignment(name, _) | Statement::Assign { name, .. } => {
+                    self.written.insert(name.clone());
+                }
+                Statement::Capabilities(capabilities) => {
+                    self.capabilities
+                        .get_or_insert_with(HashSet::new)
+                        .extend(capabilities.iter().cloned());
+                }
+                Statement::OnSchedule { body, .. }
+                | Statement::OnStart { body }
+                | Statement::OnStop { body }
+                | Statement::Reflect { body }
+                | Statement::IfContextIncludes { body, .. }
+                | Statement::IfState { body, .. }
+                | Statement::Function { body, .. }
+                | Statement::While { body, .. }
+                | Statement::For { body, .. }
+                | Statement::If { body, .. }
+                | Statement::IfReward { body, .. } => self.collect(body),
+                Statement::IfElse { branch, otherwise } => {
+                    self.collect(std::slice::from_ref(branch));
+                    self.collect(otherwise);
+                }
+                _ => {}
+            }
+        }
+    }
+}
+
+impl Analyzer {
+    fn report(&mut self, code: &'static str, severity: Severity, message: String) {
+        self.diagnostics.push(Diagnostic {
+            code,
+            severity,
+            line: self.line,
+            column: None,
+            message,
+        });
+    }
+
+    fn body(&mut self, body: &[Statement], scope: &Scope, in_agent: bool) {
+        for stmt in body {
+            self.statement(stmt, scope, in_agent);
+        }
+    }
+
+    fn statement(&mut self, stmt: &Statement, scope: &Scope, in_agent: bool) {
+        let begun = self.begun;
+        self.begun |= !matches!(stmt, Statement::Location { .. });
+        match stmt {
+            Statement::Location { line, .. } => self.line = Some(*line),
+            Statement::Lang(version) if begun => self.report(
+                "SEN2011",
+                Severity::Warning,
+                format!(
+                    "`lang {}` comes after other statements, which are still read as {}",
+                    version,
+                    lang::default_version()
+                ),
+            ),
+            Statement::AgentDeclaration { name, body } => {
+                if !self.agents.insert(name.clone()) {
+                    self.report(
+                        "SEN2003",
+                        Severity::Error,
+                        format!("agent `{}` is declared more than once", name),
+                    );
+                }
+                self.body(body, &Scope::of(body), true);
+            }
+            Statement::OnInput { body, .. }
+            | Statement::OnSchedule { body, .. }
+            | Statement::OnStart { body }
+            | Statement::OnStop { body }
+            | Statement::OnOutput { body, .. }
+            | Statement::Train { body, .. }
+            | Statement::Evolve { body } => {
+                if !in_agent {
+                    let handler = match stmt {
+                        Statement::OnInput { .. } => "on input",
+                        Statement::OnSchedule { .. } => "on schedule",
+                        Statement::OnStart { .. } => "on start",
+                        Statement::OnStop { .. } => "on stop",
+                        Statement::OnOutput { .. } => "on output",
+                        Statement::Train { .. } => "train",
+                        _ => "evolve",
+                    };
+                    self.report(
+                        "SEN2004",
+                        Severity::Error,
+                        format!("`{}` is outside an agent and never runs", handler),
+                    );
+                }
+                if let Statement::Train {
+                    dataset: Some(_), ..
+                } = stmt
+                {
+                    self.require("train from", "fs.read", scope);
+                }
+                let evolving = self.evolving;
+                self.evolving = matches!(stmt, Statement::Evolve { .. });
+                self.body(body, scope, in_agent);
+                self.evolving = evolving;
+            }
+            Statement::Propose(_) if !self.evolving => self.report(
+                "SEN2009",
+                Severity::Warning,
+                "`propose` outside an `evolve` block changes the agent from an ordinary handler"
+                    .to_string(),
+            ),
+            Statement::Reflect { body }
+            | Statement::IfContextIncludes { body, .. }
+            | Statement::IfState { body, .. }
+            | Statement::Function { body, .. }
+            | Statement::While { body, .. }
+            | Statement::For { body, .. }
+            | Statement::If { body, .. }
+            | Statement::IfReward { body, .. } => self.body(body, scope, in_agent),
+            Statement::IfElse { branch, otherwise } => {
+                self.body(std::slice::from_ref(branch), scope, in_agent);
+                self.body(otherwise, scope, in_agent);
+            }
+            Statement::MemDeclaration { target } => self.region(target, None),
+            Statement::Pipeline { stages } => {
+                for stage in stages {
+                    if !self.declared.contains(stage) {
+                        self.report(
+                            "SEN2006",
+                            Severity::Error,
+                            format!("pipeline stage `{}` is not a declared agent", stage),
+                        );
+                    }
+                }
+            }
+            Statement::Send { agent, .. } if !self.declared.contains(agent) => {
+                self.report(
+                    "SEN2012",
+                    Severity::Error,
+                    format!("`send` to `{}`, which is not a declared agent", agent),
+                );
+            }
+            Statement::Import(module) => {
+                let Err(e) = self.packages.load(module) else {
+                    return;
+                };
+                let message = if module.starts_with(stdlib::PREFIX) {
+                    let known: Vec<&str> = stdlib::modules().iter().map(|m| m.name()).collect();
+                    format!("{} (expected one of: {})", e, known.join(", "))
+                } else {
+                    e.to_string()
+                };
+                self.report("SEN2010", Severity::Error, message);
+            }
+            Statement::Capabilities(capabilities) => {
+                for capability in capabilities {
+                    if !CAPABILITIES.iter().any(|(name, _)| name == capability) {
+                        let known: Vec<&str> = CAPABILITIES.iter().map(|(name, _)| *name).collect();
+                        self.report(
+                            "SEN2007",
+                            Severity::Error,
+                            format!(
+                                "unknown capability `{}` (expected {})",
+                                capability,
+                                known.join(", ")
+                            ),
+                        );
+                    }
+                }
+            }
+            Statement::Embed { source, target } => {
+                if !scope.written.contains(source) {
+                    self.report(
+                        "SEN2005",
+                        Severity::Warning,
+                        format!("`embed` reads `{}`, which is never written", source),
+                    );
+                }
+                if let Some(region) = target.strip_prefix("mem.") {
+                    self.region(region, Some(scope));
+                }
+            }
+            Statement::ReflectAccess {
+                mem_target: target, ..
+            }
+            | Statement::Ask { target, .. }
+            | Statement::Fetch { target, .. }
+            | Statement::Exec { target, .. }
+            | Statement::ReadFile { target, .. }
+            | Statement::WriteFile { target, .. } => {
+                self.capability(stmt, scope);
+                self.region(target, Some(scope))
+            }
+            Statement::Attention { .. } => self.region("short", Some(scope)),
+            _ => {}
+        }
+    }
+
+    /// Check that the agent of `scope` declares the capability `stmt` needs,
+    /// if it declares any.
+    fn capability(&mut self, stmt: &Statement, scope: &Scope) {
+        let keyword = statement_name(stmt);
+        if let Some((capability, _)) = CAPABILITIES.iter().find(|(_, k)| *k == keyword) {
+            self.require(keyword, capability, scope);
+        }
+    }
+
+    /// Check that the agent of `scope` declares `capability`, which
+    /// `keyword` needs, if it declares any.
+    fn require(&mut self, keyword: &str, capability: &str, scope: &Scope) {
+        if scope
+            .capabilities
+            .as_ref()
+            .is_some_and(|declared| !declared.contains(capability))
+        {
+            self.report(
+                "SEN2008",
+                Severity::Error,
+                format!(
+                    "`{}` needs the `{}` capability, which the agent does not declare",
+                    keyword, capability
+                ),
+            );
+        }
+    }
+
+    /// Check a reference to `region`, which should be declared in `scope`
+    /// if that declares any.
+    fn region(&mut self, region: &str, scope: Option<&Scope>) {
+        if !REGIONS.contains(&region) {
+            self.report(
+                "SEN2001",
+                Severity::Error,
+                format!(
+                    "unknown memory region `{}` (expected short, long or shared)",
+                    region
+                ),
+            );
+            return;
+        }
+        let declared = scope.and_then(|scope| scope.regions.as_ref());
+        if declared.is_some_and(|regions| !regions.contains(region)) {
+            self.report(
+                "SEN2002",
+                Severity::Warning,
+                format!(
+                    "`mem.{}` is used but not declared with `mem {}`",
+                    region, region
+                ),
+            );
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::lexer::Lexer;
+    use crate::parser::Parser;
+
+    fn check(source: &str) -> Vec<String> {
+        let mut lexer = Lexer::new(source);
+        let program = Parser::new(&mut lexer).with_locations().parse_program();
+        analyze(&program).iter().map(|d| d.to_string()).collect()
+    }
+
+    #[test]
+    fn accepts_a_sound_agent() {
+        let source = "agent Echo {\n  mem short\n  on input(msg) {\n    note = msg\n    embed note -> mem.short\n    reflect { mem.short[\"msg\"] }\n  }\n}";
+        assert!(check(source).is_empty(), "{:?}", check(source));
+    }
+
+    #[test]
+    fn reports_each_problem_at_its_line() {
+        let source = concat!(
+            "agent A {\n",
+            "  mem short\n",
+            "  mem medium\n",
+            "  on input(msg) {\n",
+            "    embed thought -> mem.long\n",
+            "    reflect mem.scratch[\"k\"]\n",
+            "  }\n",
+            "}\n",
+            "on input(msg) {\n",
+            "}\n",
+            "agent A {\n",
+            "}\n",
+            "pipeline A -> Speech\n",
+            "agent B {\n",
+            "  capabilities: net, gpu\n",
+            "  on input(msg) {\n",
+            "    fetch \"https://example.com\" -> mem.short[\"page\"]\n",
+            "    exec \"date\" -> mem.short[\"today\"]\n",
+            "    propose goal \"Fetch less\"\n",
+            "  }\n",
+            "  evolve {\n",
+            "    propose goal \"Fetch less\"\n",
+            "  }\n",
+            "  train from \"pairs.jsonl\" {\n",
+            "  }\n",
+            "}\n",
+            "import std/conversation\n",
+            "pipeline Conversation -> B\n",
+            "import std/chat\n",
+            "lang 0.2\n",
+            "send Nobody msg\n",
+        );
+        assert_eq!(
+            check(source),
+            [
+                "3: error[SEN2001]: unknown memory region `medium` (expected short, long or shared)",
+                "5: warning[SEN2005]: `embed` reads `thought`, which is never written",
+                "5: warning[SEN2002]: `mem.long` is used but not declared with `mem long`",
+                "6: error[SEN2001]: unknown memory region `scratch` (expected short, long or shared)",
+                "9: error[SEN2004]: `on input` is outside an agent and never runs",
+                "11: error[SEN2003]: agent `A` is declared more than once",
+                "13: error[SEN2006]: pipeline stage `Speech` is not a declared agent",
+                "15: error[SEN2007]: unknown capability `gpu` (expected net, fs.read, fs.write, exec, llm)",
+                "18: error[SEN2008]: `exec` needs the `exec` capability, which the agent does not declare",
+                "19: warning[SEN2009]: `propose` outside an `evolve` block changes the agent from an ordinary handler",
+                "24: error[SEN2008]: `train from` needs the `fs.read` capability, which the agent does not declare",
+                "29: error[SEN2010]: unknown module `std/chat` (expected one of: std/conversation, std/summarizer, std/text)",
+                "30: warning[SEN2011]: `lang 0.2` comes after other statements, which are still read as 0.1",
+                "31: error[SEN2012]: `send` to `Nobody`, which is not a declared agent",
+            ]
+        );
+    }
+}
@@ -0,0 +1,904 @@
+//! HTTP API for serve mode, with the same operations as [`rpc`](crate::rpc)
+//! plus memory writes and snapshots. [`openapi`] describes it, so clients
+//! can be generated for other languages. `/` serves the
+//! [`dashboard`](crate::dashboard).
+
+use crate::context::Snapshot;
+use crate::dashboard;
+use crate::error::{MemoryError, RuntimeError};
+use crate::events::GOAL_ACHIEVED_KEY;
+use crate::httpd::{Request, Response};
+use crate::supervisor::{self, Supervisor};
+use crate::SentienceAgent;
+use serde_json::{json, Value};
+use std::time::Instant;
+
+/// Entries returned by `/recall` when no limit is given.
+const DEFAULT_RECALL_LIMIT: usize = 10;
+
+/// Answer one API request.
+pub fn handle(agent: &mut SentienceAgent, request: &Request) -> Response {
+    route(agent, request, &mut |result| result)
+}
+
+/// [`handle`] for an agent restarted by `supervisor`: a panic, or a handler
+/// going over a limit, crashes the agent, and requests get a 503 while it is
+/// down.
+pub fn handle_supervised(
+    agent: &mut SentienceAgent,
+    supervisor: &mut Supervisor,
+    request: &Request,
+) -> Response {
+    if !supervisor.is_up() {
+        if request.method == "GET" && request.path.trim_matches('/').is_empty() {
+            return dashboard::page();
+        }
+        return unavailable(supervisor);
+    }
+    let mut over_limit = false;
+    let handled = supervisor.guard(|| {
+        route(agent, request, &mut |result| {
+            over_limit |= result.as_ref().is_err_and(supervisor::over_limit);
+            result
+        })
+    });
+    match handled {
+        Ok(response) => {
+            if over_limit {
+                supervisor.crashed(Instant::now());
+            }
+            response
+        }
+        Err(_) => unavailable(supervisor),
+    }
+}
+
+/// The response to a request for the agent of `supervisor` while it is down.
+pub fn unavailable(supervisor: &Supervisor) -> Response {
+    let message = if supervisor.gave_up() {
+        format!("agent `{}` crashed and is stopped", supervisor.name())
+    } else {
+        format!("agent `{}` crashed and is restarting", supervisor.name())
+    };
+    error(503, &message)
+}
+
+/// Answer `request`, passing handler results through `check`.
+fn route(
+    agent: &mut SentienceAgent,
+    request: &Request,
+    check: &mut dyn FnMut(Result<String, RuntimeError>) -> Result<String, RuntimeError>,
+) -> Response {
+    let segments: Vec<String> = request
+        .path
+        .trim_matches('/')
+        .split('/')
+        .map(|segment| percent_decode(segment, false))
+        .collect();
+    let segments: Vec<&str> = segments.iter().map(String::as_str).collect();
+    match (request.method.as_str(), segments.as_slice()) {
+        ("GET", [""]) => dashboard::page(),
+        ("GET", ["openapi.json"]) => json_response(200, &openapi()),
+        ("GET", ["agents"]) => json_response(200, &json!([describe(agent)])),
+        ("GET", ["turns"]) => json_response(200, &json!(agent.recent_turns())),
+        ("POST", ["input"]) => run(request, |text| check(agent.handle_input(text))),
+        ("POST", ["train"]) => run(request, |text| check(agent.train(text))),
+        ("GET", ["memory", region]) => match *region {
+            "short" => json_response(200, &json!(agent.all_short())),
+            "long" => json_response(200, &json!(agent.all_long())),
+            other => error(404, &format!("unknown memory region `{}`", other)),
+        },
+        ("GET", ["memory", region, key]) => match agent.get_value(region, key) {
+            Ok(value) => json_response(200, &json!({ "value": value })),
+            Err(e) => memory_error(&e),
+        },
+        ("PUT", ["memory", region, key]) => {
+            let body = match body(request) {
+                Ok(body) => body,
+                Err(response) => return response,
+            };
+            let Some(value) = body
+                .get("value")
+                .and_then(|value| serde_json::from_value(value.clone()).ok())
+            else {
+                return error(400, "`value` is required");
+            };
+            match agent.set_value(region, key, value) {
+                Ok(()) => Response::new(204, "application/json", ""),
+                Err(e) => memory_error(&e),
+            }
+        }
+        ("GET", ["recall"]) => {
+            let Some(query) = query_param(&request.query, "query") else {
+                return error(400, "`query` is required");
+            };
+            let limit = match query_param(&request.query, "limit").map(|l| l.parse::<usize>()) {
+                Some(Ok(limit)) => limit,
+                Some(Err(_)) => return error(400, "`limit` must be a number"),
+                None => DEFAULT_RECALL_LIMIT,
+            };
+            let region = query_param(&request.query, "region");
+            match agent.recall(&query, region.as_deref(), limit) {
+                Ok(matches) => json_response(200, &json!(matches)),
+                Err(e) => memory_error(&e),
+            }
+        }
+        ("GET", ["stats"]) => json_response(200, &json!(agent.stats())),
+        ("GET", ["goals"]) => json_response(200, &json!(agent.goal_report())),
+        ("GET", ["rewards"]) => json_response(200, &json!(agent.rewards())),
+        ("POST", ["reward"]) => {
+            let body = match body(request) {
+                Ok(body) => body,
+                Err(response) => return response,
+            };
+            let Some(value) = body.get("value").and_then(Value::as_f64) else {
+                return error(400, "`value` must be a number");
+            };
+            match agent.reward(value) {
+                Some(behavior) => json_response(200, &json!({ "behavior": behavior })),
+                None => error(409, "no handler has run yet"),
+            }
+        }
+        ("GET", ["snapshot"]) => json_response(200, &json!(agent.snapshot())),
+        ("PUT", ["snapshot"]) => match serde_json::from_slice::<Snapshot>(&request.body) {
+            Ok(snapshot) => {
+                agent.restore(snapshot);
+                Response::new(204, "application/json", "")
+            }
+            Err(e) => error(400, &format!("invalid snapshot: {}", e)),
+        },
+        (_, ["" | "openapi.json" | "agents" | "turns" | "input" | "train" | "recall"])
+        | (_, ["stats" | "goals" | "rewards" | "reward" | "snapshot"])
+        | (_, ["memory", _] | ["memory", _, _]) => error(405, "method not allowed"),
+        _ => error(404, "not found"),
+    }
+}
+
+/// The agent's [description](crate::introspect::AgentInfo), with the value
+/// it reported reaching its goal with in `achieved` (`null` until then).
+pub fn describe(agent: &SentienceAgent) -> Value {
+    let Some(info) = agent.describe() else {
+        return Value::Null;
+    };
+    let achieved = ["short", "long"]
+        .iter()
+        .filter_map(|region| agent.get_mem(region, GOAL_ACHIEVED_KEY).ok())
+        .find(|value| !value.is_empty());
+    let mut description = json!(info);
+    description["achieved"] = json!(achieved);
+    description
+}
+
+/// Run a handler with the request's `text` and return its output.
+pub fn run(
+    request: &Request,
+    handler: impl FnOnce(&str) -> Result<String, RuntimeError>,
+) -> Response {
+    let body = match body(request) {
+        Ok(body) => body,
+        Err(response) => return response,
+    };
+    let Some(text) = body.get("text").and_then(Value::as_str) else {
+        return error(400, "`text` is required");
+    };
+    match handler(text) {
+        Ok(output) => json_response(200, &json!({ "output": output })),
+        Err(e) => coded_error(422, e.code(), &e.to_string()),
+    }
+}
+
+fn body(request: &Request) -> Result<Value, Response> {
+    serde_json::from_slice(&request.body)
+        .map_err(|e| error(400, &format!("invalid JSON body: {}", e)))
+}
+
+fn json_response(status: u16, body: &Value) -> Response {
+    Response::new(status, "application/json", body.to_string())
+}
+
+/// A JSON error response.
+pub fn error(status: u16, message: &str) -> Response {
+    json_response(status, &json!({ "error": message }))
+}
+
+/// An error from the agent, with its code (see [`error`](crate::error)).
+fn coded_error(status: u16, code: &str, message: &str) -> Response {
+    json_response(status, &json!({ "error": message, "code": code }))
+}
+
+fn memory_error(e: &MemoryError) -> Response {
+    let status = match e {
+        MemoryError::UnknownRegion(_) => 404,
+        _ => 422,
+    };
+    coded_error(status, e.code(), &e.to_string())
+}
+
+pub fn query_param(query: &str, name: &str) -> Option<String> {
+    query.split('&').find_map(|pair| {
+        let (key, value) = pair.split_once('=').unwrap_or((pair, ""));
+        (percent_decode(key, true) == name).then(|| percent_decode(value, true))
+    })
+}
+
+/// Decode `%XX` escapes, and `+` as a space in query strings, leaving
+/// malformed escapes as they are.
+fn percent_decode(text: &str, plus_as_space: bool) -> String {
+    let bytes = text.as_bytes();
+    let mut decoded = Vec::with_capacity(bytes.len());
+    let mut i = 0;
+    while i < bytes.len() {
+        let hex = |b: u8| (b as char).to_digit(16);
+        match bytes[i] {
+            b'%' if i + 2 < bytes.len() => {
+                if let (Some(high), Some(low)) = (hex(bytes[i + 1]), hex(bytes[i + 2])) {
+                    decoded.push((high * 16 + low) as u8);
+                    i += 3;
+                    continue;
+                }
+                decoded.push(b'%');
+            }
+            b'+' if plus_as_space => decoded.push(b' '),
+            byte => decoded.push(byte),
+        }
+        i += 1;
+    }
+    String::from_utf8_lossy(&decoded).into_owned()
+}
+
+/// OpenAPI 3 document describing [`handle`].
+pub fn openapi() -> Value {
+    let schema = |name: &str| json!({ "$ref": format!("#/components/schemas/{}", name) });
+    let content = |schema: Value| json!({ "application/json": { "schema": schema } });
+    let error = |description: &str| json!({ "description": description, "content": content(schema("Error")) });
+    let region = json!({
+        "name": "region", "in": "path", "required": true,
+        "schema": { "type": "string", "enum": ["short", "long"] },
+    });
+    let key =
+        json!({ "name": "key", "in": "path", "required": true, "schema": { "type": "string" } });
+    let handler = |operation: &str, summary: &str| {
+        json!({
+            "operationId": operation,
+            "summary": summary,
+            "requestBody": { "required": true, "content": content(schema("TextRequest")) },
+            "responses": {
+                "200": { "description": "The handler's output.", "content": content(schema("Output")) },
+                "400": error("The body has no `text`."),
+                "422": error("The agent has no matching handler, or it failed."),
+                "503": error("The agent crashed and is not yet restarted (`serve` only)."),
+            },
+        })
+    };
+
+    json!({
+        "openapi": "3.0.3",
+        "info": {
+            "title": "Sentience agent API",
+            "version": env!("CARGO_PKG_VERSION"),
+            "description": "Drive an agent started with `sentience-repl serve --http`.",
+        },
+        "paths": {
+            "/": {
+                "get": {
+                    "operationId": "dashboard",
+                    "summary": "Web dashboard of the agents, their memory and recent inputs.",
+                    "responses": { "200": { "description": "HTML page." } },
+                },
+            },
+            "/agents": {
+                "get": {
+                    "operationId": "getAgents",
+                    "summary": "The agents being served, with their handlers, goals and memory sizes.",
+                    "responses": {
+                        "200": {
+                            "description": "One description per agent.",
+                            "content": content(json!({ "type": "array", "items": schema("Agent") })),
+                        },
+                    },
+                },
+            },
+            "/turns": {
+                "get": {
+                    "operationId": "getTurns",
+                    "summary": "The agent's latest inputs, oldest first, with answers and memory changes.",
+                    "responses": {
+                        "200": {
+                            "description": "The turns.",
+                            "content": content(json!({ "type": "array", "items": schema("Turn") })),
+                        },
+                    },
+                },
+            },
+            "/input": { "post": handler("input", "Run the `on input` handler.") },
+            "/train": { "post": handler("train", "Run the `train` block.") },
+            "/memory/{region}": {
+                "get": {
+                    "operationId": "getMemory",
+                    "summary": "Every entry in a memory region.",
+                    "parameters": [region],
+                    "responses": {
+                        "200": {
+                            "description": "Keys and values.",
+                            "content": content(json!({
+                                "type": "object",
+                                "additionalProperties": { "type": "string" },
+                            })),
+                        },
+                        "404": error("Unknown region."),
+                    },
+                },
+            },
+            "/memory/{region}/{key}": {
+                "get": {
+                    "operationId": "getMemoryValue",
+                    "summary": "One memory value; missing keys are empty.",
+                    "parameters": [region, key],
+                    "responses": {
+                        "200": { "description": "The value.", "content": content(schema("Value")) },
+                        "404": error("Unknown region."),
+                    },
+                },
+                "put": {
+                    "operationId": "setMemoryValue",
+                    "summary": "Write one memory value.",
+                    "parameters": [region, key],
+                    "requestBody": { "required": true, "content": content(schema("Value")) },
+                    "responses": {
+                        "204": { "description": "Written." },
+                        "400": error("The body has no `value`."),
+                        "404": error("Unknown region."),
+                    },
+                },
+            },
+            "/recall": {
+                "get": {
+                    "operationId": "recall",
+                    "summary": "Memory entries whose key or value contains the query.",
+                    "parameters": [
+                        { "name": "query", "in": "query", "required": true, "schema": { "type": "string" } },
+                        { "name": "region", "in": "query", "schema": { "type": "string", "enum": ["short", "long"] } },
+                        { "name": "limit", "in": "query", "schema": { "type": "integer", "minimum": 0, "default": DEFAULT_RECALL_LIMIT } },
+                    ],
+                    "responses": {
+                        "200": {
+                            "description": "Matching entries.",
+                            "content": content(json!({ "type": "array", "items": schema("MemoryMatch") })),
+                        },
+                        "400": error("Missing query or invalid limit."),
+                        "404": error("Unknown region."),
+                    },
+                },
+            },
+            "/stats": {
+                "get": {
+                    "operationId": "getStats",
+                    "summary": "Entries and approximate size of each memory region, and the link count.",
+                    "responses": {
+                        "200": { "description": "The stats.", "content": content(schema("Stats")) },
+                    },
+                },
+            },
+            "/goals": {
+                "get": {
+                    "operationId": "getGoals",
+                    "summary": "Goal progress now and at the start of the session, and what each kind of handler did to it.",
+                    "responses": {
+                        "200": { "description": "The report.", "content": content(schema("GoalReport")) },
+                    },
+                },
+            },
+            "/rewards": {
+                "get": {
+                    "operationId": "getRewards",
+                    "summary": "Running statistics of the rewards each kind of handler got.",
+                    "responses": {
+                        "200": {
+                            "description": "Statistics by handler kind.",
+                            "content": content(json!({ "type": "object", "additionalProperties": schema("RewardStats") })),
+                        },
+                    },
+                },
+            },
+            "/reward": {
+                "post": {
+                    "operationId": "reward",
+                    "summary": "Credit a reward to the kind of handler that ran last.",
+                    "requestBody": {
+                        "required": true,
+                        "content": content(json!({
+                            "type": "object",
+                            "required": ["value"],
+                            "properties": { "value": { "type": "number" } },
+                        })),
+                    },
+                    "responses": {
+                        "200": {
+                            "description": "The handler kind credited.",
+                            "content": content(json!({
+                                "type": "object",
+                                "properties": { "behavior": { "type": "string" } },
+                            })),
+                        },
+                        "400": error("The body has no numeric `value`."),
+                        "409": error("No handler has run yet."),
+                    },
+                },
+            },
+            "/snapshot": {
+                "get": {
+                    "operationId": "getSnapshot",
+                    "summary": "All of the agent's memory and links.",
+                    "responses": {
+                        "200": { "description": "The snapshot.", "content": content(schema("Snapshot")) },
+                    },
+                },
+                "put": {
+                    "operationId": "restoreSnapshot",
+                    "summary": "Replace all of the agent's memory and links.",
+                    "requestBody": { "required": true, "content": content(schema("Snapshot")) },
+                    "responses": {
+                        "204": { "description": "Restored." },
+                        "400": error("Not a snapshot."),
+                    },
+                },
+            },
+            "/usage": {
+                "get": {
+                    "operationId": "getUsage",
+                    "summary": "What the tenant making the request has used (multi-tenant `serve` only).",
+                    "responses": {
+                        "200": { "description": "The tenant's usage.", "content": content(schema("Usage")) },
+                        "401": error("No token, or one no tenant has."),
+                        "429": error("The tenant is over its rate limit."),
+                    },
+                },
+            },
+            "/openapi.json": {
+                "get": {
+                    "operationId": "openapi",
+                    "summary": "This document.",
+                    "responses": { "200": { "description": "OpenAPI 3 document." } },
+                },
+            },
+        },
+        "components": {
+            "schemas": {
+                "TextRequest": {
+                    "type": "object",
+                    "required": ["text"],
+                    "properties": { "text": { "type": "string" } },
+                },
+                "Output": {
+                    "type": "object",
+                    "required": ["output"],
+                    "properties": { "output": { "type": "string" } },
+                },
+                "Value": {
+                    "type": "object",
+                    "required": ["value"],
+                    "properties": { "value": schema("MemoryValue") },
+                },
+                "MemoryValue": {
+                    "description": "Text, or a number, boolean, list or map kept as one.",
+                    "oneOf": [
+                        { "type": "string" },
+                        { "type": "number" },
+                        { "type": "boolean" },
+                        { "type": "array" },
+                        { "type": "object" },
+                    ],
+                },
+                "MemoryMatch": {
+                    "type": "object",
+                    "required": ["region", "key", "value"],
+                    "properties": {
+                        "region": { "type": "string" },
+                        "key": { "type": "string" },
+                        "value": { "type": "string" },
+                    },
+                },
+                "Stats": {
+                    "type": "object",
+                    "required": ["regions", "links"],
+                    "properties": {
+                        "regions": {
+                            "type": "array",
+                            "items": {
+                                "type": "object",
+                                "required": ["region", "entries", "bytes", "loaded"],
+                                "properties": {
+                                    "region": { "type": "string" },
+                                    "entries": { "type": "integer" },
+                                    "bytes": { "type": "integer", "description": "Approximate size of keys and values." },
+                                    "loaded": { "type": "boolean", "description": "False while the region is still on disk." },
+                                },
+                            },
+                        },
+                        "links": { "type": "integer" },
+                    },
+                },
+                "GoalReading": {
+                    "type": "object",
+                    "properties": {
+                        "progress": {
+                            "type": "number",
+                            "nullable": true,
+                            "description": "From 0 to 1, from `goal.progress`; 1 once achieved.",
+                        },
+                        "achieved": { "type": "string", "nullable": true },
+                    },
+                },
+                "GoalReport": {
+                    "type": "object",
+                    "required": ["since", "start", "current", "handlers", "history"],
+                    "properties": {
+                        "goal": { "type": "string", "nullable": true },
+                        "since": { "type": "integer", "description": "Start of the session, Unix milliseconds." },
+                        "start": schema("GoalReading"),
+                        "current": schema("GoalReading"),
+                        "handlers": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "object",
+                                "properties": {
+                                    "runs": { "type": "integer" },
+                                    "gained": { "type": "number", "description": "Total change in progress." },
+                                    "achieved": { "type": "integer", "description": "Runs that achieved the goal." },
+                                },
+                            },
+                        },
+                        "history": {
+                            "type": "array",
+                            "items": {
+                                "type": "object",
+                                "properties": {
+                                    "at": { "type": "integer" },
+                                    "handler": { "type": "string" },
+                                    "progress": { "type": "number" },
+                                },
+                            },
+                        },
+                    },
+                },
+                "RewardStats": {
+                    "type": "object",
+                    "required": ["count", "total", "mean", "last", "recent"],
+                    "properties": {
+                        "count": { "type": "integer" },
+                        "total": { "type": "number" },
+                        "mean": { "type": "number" },
+                        "last": { "type": "number" },
+                        "recent": { "type": "number", "description": "Moving average favouring the latest rewards." },
+                    },
+                },
+                "Agent": {
+                    "type": "object",
+                    "required": ["name", "handlers", "events", "goals", "memory", "links"],
+                    "properties": {
+                        "name": { "type": "string" },
+                        "handlers": { "type": "array", "items": { "type": "string" } },
+                        "events": { "type": "array", "items": { "type": "string" } },
+                        "goals": { "type": "array", "items": { "type": "string" } },
+                        "declared_memory": { "type": "array", "items": { "type": "string" } },
+                        "memory": {
+                            "type": "array",
+                            "items": {
+                                "type": "object",
+                                "properties": {
+                                    "region": { "type": "string" },
+                                    "entries": { "type": "integer" },
+                                },
+                            },
+                        },
+                        "links": {
+                            "type": "array",
+                            "items": { "type": "array", "items": { "type": "string" } },
+                        },
+                        "achieved": {
+                            "type": "string",
+                            "nullable": true,
+                            "description": "Value of `goal.achieved` once the agent set it.",
+                        },
+                        "status": {
+                            "type": "string",
+                            "enum": ["up", "restarting", "stopped"],
+                            "description": "Whether the agent runs or crashed (programs with several agents only).",
+                        },
+                    },
+                },
+                "Turn": {
+                    "type": "object",
+                    "required": ["timestamp", "agent", "input"],
+                    "properties": {
+                        "timestamp": { "type": "integer", "description": "Unix milliseconds." },
+                        "agent": { "type": "string" },
+                        "input": { "type": "string" },
+                        "metadata": {
+                            "type": "array",
+                            "items": { "type": "array", "items": { "type": "string" } },
+                        },
+                        "output": { "type": "string" },
+                        "error": { "type": "string" },
+                        "changes": {
+                            "type": "array",
+                            "items": {
+                                "type": "object",
+                                "properties": {
+                                    "region": { "type": "string" },
+                                    "key": { "type": "string" },
+                                    "value": { "type": "string" },
+                                },
+                            },
+                        },
+                    },
+                },
+                "Snapshot": {
+                    "type": "object",
+                    "properties": {
+                        "mem_short": { "type": "object", "additionalProperties": schema("MemoryValue") },
+                        "mem_long": { "type": "object", "additionalProperties": schema("MemoryValue") },
+                        "links": { "type": "object", "additionalProperties": { "type": "string" } },
+                        "state": {
+                            "type": "object",
+                            "additionalProperties": { "type": "number" },
+                            "description": "Affect drives, e.g. `frustration`, from 0 to 1.",
+                        },
+                    },
+                },
+                "Usage": {
+                    "type": "object",
+                    "required": ["tenant", "requests", "handled", "errors", "throttled", "handler_ms", "memory"],
+                    "properties": {
+                        "tenant": { "type": "string" },
+                        "requests": { "type": "integer", "description": "Requests answered, throttled ones aside." },
+                        "handled": { "type": "integer", "description": "Inputs and training examples handled." },
+                        "errors": { "type": "integer", "description": "Requests answered with an error." },
+                        "throttled": { "type": "integer", "description": "Requests refused for going over the rate limit." },
+                        "handler_ms": { "type": "integer", "description": "Time spent in handlers." },
+                        "memory": schema("Stats"),
+                    },
+                },
+                "Error": {
+                    "type": "object",
+                    "required": ["error"],
+                    "properties": {
+                        "error": { "type": "string" },
+                        "code": {
+                            "type": "string",
+                            "description": "Stable code of an error from the agent, e.g. `SEN4002`.",
+                        },
+                    },
+                },
+            },
+        },
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn request(method: &str, target: &str, body: &str) -> Request {
+        let (path, query) = target.split_once('?').unwrap_or((target, ""));
+        Request {
+            method: method.to_string(),
+            path: path.to_string(),
+            query: query.to_string(),
+            body: body.as_bytes().to_vec(),
+            ..Default::default()
+        }
+    }
+
+    fn call(agent: &mut SentienceAgent, method: &str, target: &str, body: &str) -> (u16, Value) {
+        let response = handle(agent, &request(method, target, body));
+        let value = serde_json::from_slice(&response.body).unwrap_or(Value::Null);
+        (response.status, value)
+    }
+
+    #[test]
+    fn serves_the_documented_endpoints() {
+        let mut agent = SentienceAgent::new();
+        agent
+            .run_sentience("agent Echo {\n  on input(msg) {\n    print \"ok\"\n  }\n}")
+            .unwrap();
+
+        assert_eq!(
+            call(&mut agent, "POST", "/input", r#"{"text":"hello"}"#),
+            (200, json!({ "output": "ok" }))
+        );
+        assert_eq!(call(&mut agent, "POST", "/input", "{}").0, 400);
+        assert_eq!(
+            call(&mut agent, "GET", "/memory/short/msg", ""),
+            (200, json!({ "value": "hello" }))
+        );
+        assert_eq!(
+            call(
+                &mut agent,
+                "PUT",
+                "/memory/long/home%20city",
+                r#"{"value":"Belgrade"}"#
+            )
+            .0,
+            204
+        );
+        assert_eq!(
+            call(&mut agent, "GET", "/recall?query=belgrade&region=long", ""),
+            (
+                200,
+                json!([{ "region": "long", "key": "home city", "value": "Belgrade" }])
+            )
+        );
+        assert_eq!(
+            call(&mut agent, "GET", "/stats", "").1,
+            json!({
+                "regions": [
+                    { "region": "short", "entries": 1, "bytes": 8, "loaded": true },
+                    { "region": "long", "entries": 1, "bytes": 17, "loaded": true },
+                ],
+                "links": 0,
+            })
+        );
+        assert_eq!(call(&mut agent, "GET", "/memory/mid", "").0, 404);
+        assert_eq!(
+            call(&mut agent, "GET", "/memory/mid/key", ""),
+            (
+                404,
+                json!({ "error": "unknown memory region `mid`", "code": "SEN5001" })
+            )
+        );
+        assert_eq!(
+            call(&mut agent, "PUT", "/memory/long/visits", r#"{"value":3}"#).0,
+            204
+        );
+        assert_eq!(
+            call(&mut agent, "GET", "/memory/long/visits", ""),
+            (200, json!({ "value": 3 }))
+        );
+        assert_eq!(
+            call(&mut agent, "POST", "/train", r#"{"text":"x"}"#).1["code"],
+            "SEN4002"
+        );
+        assert_eq!(call(&mut agent, "DELETE", "/snapshot", "").0, 405);
+
+        let (status, snapshot) = call(&mut agent, "GET", "/snapshot", "");
+        assert_eq!(status, 200);
+        assert_eq!(snapshot["mem_long"]["home city"], "Belgrade");
+        assert_eq!(snapshot["mem_long"]["visits"], 3);
+        assert_eq!(
+            call(&mut agent, "PUT", "/snapshot", r#"{"mem_long":{"a":"b"}}"#).0,
+            204
+        );
+        assert_eq!(agent.all_long().get("a").map(String::as_str), Some("b"));
+        assert!(agent.all_short().is_empty());
+    }
+
+    #[test]
+    fn serves_the_dashboard_and_what_it_shows() {
+        let mut agent = SentienceAgent::new();
+        agent
+            .run_sentience(
+                "agent Echo {\n  goal: \"Greet\"\n  on input(msg) {\n    print \"ok\"\n  }\n}",
+            )
+            .unwrap();
+        agent.keep_recent_turns(1);
+
+        let page = handle(&mut agent, &request("GET", "/", ""));
+        assert_eq!(page.content_type, "text/html; charset=utf-8");
+        assert!(String::from_utf8(page.body).unwrap().contains("fetch("));
+        assert_eq!(call(&mut agent, "POST", "/", "").0, 405);
+
+        let (_, agents) = call(&mut agent, "GET", "/agents", "");
+        assert_eq!(agents[0]["name"], "Echo");
+        assert_eq!(agents[0]["goals"], json!(["Greet"]));
+        assert_eq!(agents[0]["achieved"], Value::Null);
+
+        call(&mut agent, "POST", "/input", r#"{"text":"one"}"#);
+        call(&mut agent, "POST", "/input", r#"{"text":"two"}"#);
+        agent.set_mem("long", GOAL_ACHIEVED_KEY, "yes").unwrap();
+        let (_, turns) = call(&mut agent, "GET", "/turns", "");
+        assert_eq!(turns.as_array().unwrap().len(), 1);
+        assert_eq!(turns[0]["input"], "two");
+        assert_eq!(turns[0]["output"], "ok");
+        assert_eq!(
+            call(&mut agent, "GET", "/agents", "").1[0]["achieved"],
+            "yes"
+        );
+    }
+
+    #[test]
+    fn reports_goal_progress() {
+        let mut agent = SentienceAgent::new();
+        agent
+            .run_sentience(
+                "agent Echo {\n  goal: \"Greet\"\n  on input(msg) {\n    print \"ok\"\n  }\n}",
+            )
+            .unwrap();
+        agent
+            .set_mem("long", crate::events::GOAL_PROGRESS_KEY, "25%")
+            .unwrap();
+        call(&mut agent, "POST", "/input", r#"{"text":"hi"}"#);
+
+        let (status, report) = call(&mut agent, "GET", "/goals", "");
+        assert_eq!(status, 200);
+        assert_eq!(report["goal"], "Greet");
+        assert_eq!(report["current"]["progress"], 0.25);
+        assert_eq!(report["handlers"]["input"]["runs"], 1);
+        assert_eq!(call(&mut agent, "POST", "/goals", "").0, 405);
+    }
+
+    #[test]
+    fn takes_rewards() {
+        let mut agent = SentienceAgent::new();
+        agent
+            .run_sentience("agent Echo {\n  on input(msg) {\n    print \"ok\"\n  }\n}")
+            .unwrap();
+        assert_eq!(call(&mut agent, "POST", "/reward", r#"{"value":1}"#).0, 409);
+        call(&mut agent, "POST", "/input", r#"{"text":"hi"}"#);
+        let (status, credited) = call(&mut agent, "POST", "/reward", r#"{"value":-0.5}"#);
+        assert_eq!(status, 200);
+        assert_eq!(credited["behavior"], "input");
+        assert_eq!(
+            call(&mut agent, "POST", "/reward", r#"{"value":"a"}"#).0,
+            400
+        );
+        let (status, rewards) = call(&mut agent, "GET", "/rewards", "");
+        assert_eq!(status, 200);
+        assert_eq!(rewards["input"]["count"], 1);
+        assert_eq!(rewards["input"]["mean"], -0.5);
+    }
+
+    #[test]
+    fn crashes_a_supervised_agent_over_its_limits() {
+        let mut agent = SentienceAgent::new();
+        agent
+            .run_sentience("agent Echo {\n  on input(msg) {\n    note = \"x\"\n  }\n}")
+            .unwrap();
+        agent.set_limits(crate::limits::Limits {
+            max_entries: Some(1),
+            ..Default::default()
+        });
+        let mut supervisor = Supervisor::new("Echo", Default::default());
+        let input = request("POST", "/input", r#"{"text":"hi"}"#);
+        let response = handle_supervised(&mut agent, &mut supervisor, &input);
+        assert_eq!(response.status, 422);
+        assert!(!supervisor.is_up());
+        let response = handle_supervised(&mut agent, &mut supervisor, &input);
+        assert_eq!(response.status, 503);
+    }
+
+    #[test]
+    fn documents_every_route() {
+        let spec = openapi();
+        let paths = spec["paths"].as_object().unwrap();
+        for path in [
+            "/",
+            "/agents",
+            "/turns",
+            "/input",
+            "/train",
+            "/memory/{region}",
+            "/memory/{region}/{key}",
+            "/recall",
+            "/stats",
+            "/goals",
+            "/rewards",
+            "/reward",
+            "/snapshot",
+            "/usage",
+            "/openapi.json",
+        ] {
+            assert!(paths.contains_key(path), "{} is not documented", path);
+        }
+        // Every schema reference resolves.
+        let text = spec.to_string();
+        for reference in text.split("#/components/schemas/").skip(1) {
+            let name = reference.split('"').next().unwrap();
+            assert!(
+                spec["components"]["schemas"].get(name).is_some(),
+                "{}",
+                name
+            );
+        }
+    }
+}
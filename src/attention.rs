@@ -0,0 +1,182 @@
+//! Which short-term memory matters now, for `attention top <n>` in
+//! `reflect` blocks.
+//!
+//! Each entry is scored by how recently and how often it was written or
+//! reflected on, and by how much its key and value share words with the
+//! input being handled, using the agent's
+//! [embedder](crate::llm::embedding), or the word vectors of
+//! [`sync::embed`] if it fails. Use is
+//! counted on a clock that ticks once per write or read, not in wall time,
+//! so the same inputs give the same focus.
+
+use crate::context::AgentContext;
+use crate::llm::embedding;
+use crate::sync;
+use std::collections::HashMap;
+
+/// Weight of each part of the score; they add up to 1.
+pub const RECENCY_WEIGHT: f64 = 0.4;
+pub const FREQUENCY_WEIGHT: f64 = 0.2;
+pub const SIMILARITY_WEIGHT: f64 = 0.4;
+
+/// Uses after which the recency of an entry has halved.
+const HALF_LIFE: f64 = 8.0;
+
+#[derive(Clone, Copy, Debug, Default, PartialEq)]
+struct Use {
+    /// Clock at the last use.
+    last: u64,
+    count: u64,
+}
+
+/// How short-term memory has been used.
+#[derive(Clone, Debug, Default, PartialEq)]
+pub struct Attention {
+    clock: u64,
+    uses: HashMap<String, Use>,
+}
+
+impl Attention {
+    /// Note a write or read of `key`.
+    pub fn touch(&mut self, key: &str) {
+        self.clock += 1;
+        let entry = self.uses.entry(key.to_string()).or_default();
+        entry.last = self.clock;
+        entry.count += 1;
+    }
+
+    /// Stop counting uses of `key`, e.g. once it is deleted.
+    pub fn forget(&mut self, key: &str) {
+        self.uses.remove(key);
+    }
+
+    /// Uses of `key` so far.
+    pub fn count(&self, key: &str) -> u64 {
+        self.uses.get(key).map_or(0, |seen| seen.count)
+    }
+
+    /// From 1 for the entry used last, halving every [`HALF_LIFE`] uses
+    /// since; 0 if never used.
+    fn recency(&self, key: &str) -> f64 {
+        self.uses.get(key).map_or(0.0, |seen| {
+            0.5f64.powf((self.clock - seen.last) as f64 / HALF_LIFE)
+        })
+    }
+}
+
+/// A short-term entry and how much it deserves attention.
+#[derive(Clone, Debug, PartialEq)]
+pub struct Focus {
+    pub key: String,
+    pub value: String,
+    /// From 0 to 1.
+    pub score: f64,
+    pub recency: f64,
+    /// Uses relative to the most used entry.
+    pub frequency: f64,
+    pub similarity: f64,
+}
+
+/// The `n` short-term entries of `ctx` that matter most while handling
+/// `input`, best first; ties go to the smaller key.
+pub fn top(ctx: &AgentContext, input: &str, n: usize) -> Vec<Focus> {
+    let attention = &ctx.attention;
+    let vector = |text: &str| {
+        ctx.embedder
+            .embed(text)
+            .unwrap_or_else(|_| sync::embed(text))
+    };
+    let query = has_words(input).then(|| vector(input));
+    let most = ctx
+        .mem_short
+        .keys()
+        .map(|key| attention.count(key))
+        .max()
+        .unwrap_or(0);
+    let mut focus: Vec<Focus> = ctx
+        .mem_short
+        .iter()
+        .map(|(key, value)| {
+            let recency = attention.recency(key);
+            let frequency = if most == 0 {
+                0.0
+            } else {
+                (1.0 + attention.count(key) as f64).ln() / (1.0 + most as f64).ln()
+            };
+            let similarity = query.as_ref().map_or(0.0, |query| {
+                let entry = vector(&format!("{} {}", key, value));
+                f64::from(embedding::similarity(query, &entry)).max(0.0)
+            });
+            Focus {
+                key: key.to_string(),
+                value: value.to_string(),
+                score: RECENCY_WEIGHT * recency
+                    + FREQUENCY_WEIGHT * frequency
+                    + SIMILARITY_WEIGHT * similarity,
+                recency,
+                frequency,
+                similarity,
+            }
+        })
+        .collect();
+    focus.sort_by(|a, b| b.score.total_cmp(&a.score).then_with(|| a.key.cmp(&b.key)));
+    focus.truncate(n);
+    focus
+}
+
+fn has_words(text: &str) -> bool {
+    text.chars().any(char::is_alphanumeric)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::replkit::Repl;
+
+    #[test]
+    fn scores_recency_frequency_and_similarity() {
+        let mut ctx = AgentContext::new();
+        ctx.set_mem("short", "weather", "sunny in Belgrade");
+        for _ in 0..3 {
+            ctx.set_mem("short", "mood", "cheerful");
+        }
+        ctx.set_mem("short", "last", "nothing much");
+
+        let keys = |focus: Vec<Focus>| focus.into_iter().map(|f| f.key).collect::<Vec<_>>();
+        assert_eq!(keys(top(&ctx, "", 3)), ["mood", "last", "weather"]);
+        let focus = top(&ctx, "is it sunny in Belgrade today?", 2);
+        assert_eq!(focus[0].key, "weather");
+        assert!(focus[0].similarity > 0.5);
+        assert_eq!(focus[1].key, "mood");
+        assert_eq!(top(&ctx, "", 10).len(), 3);
+        assert_eq!(top(&AgentContext::new(), "hi", 3), []);
+    }
+
+    #[test]
+    fn reflect_blocks_print_the_top_entries() {
+        let mut out = Vec::new();
+        let mut repl = Repl::new(&b""[..], &mut out);
+        repl.eval_source(concat!(
+            "agent Focused {\n",
+            "  on input(msg) {\n",
+            "    reflect {\n",
+            "      attention top 2\n",
+            "    }\n",
+            "  }\n",
+            "}\n",
+        ))
+        .unwrap();
+        let ctx = repl.context_mut();
+        ctx.set_mem("short", "topic", "rust traits");
+        ctx.set_mem("short", "owner", "ana");
+        ctx.set_mem("short", "stale", "old");
+        repl.handle_command(".input tell me about traits").unwrap();
+        drop(repl);
+        let out = String::from_utf8(out).unwrap();
+        assert!(
+            out.ends_with("    msg: tell me about traits\n    topic: rust traits\n"),
+            "{}",
+            out
+        );
+    }
+}
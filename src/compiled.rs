@@ -0,0 +1,958 @@
+use crate::embedded::compile;
+use crate::error::{Error, MemoryError, ParseError, ParseErrorKind};
+use crate::lang::Version;
+use crate::types::{BinaryOp, Expr, Mutation, Program, Statement, Text, UnaryOp};
+use std::fs;
+use std::path::Path;
+
+/// Leading bytes of every compiled program (`.sentc`).
+pub const MAGIC: &[u8; 6] = b"SENTC\0";
+/// Bumped whenever the statement encoding changes.
+pub const FORMAT_VERSION: u8 = 1;
+
+/// Serialize a parsed program into the compact `.sentc` form.
+pub fn encode(program: &Program) -> Vec<u8> {
+    let mut buf = Vec::with_capacity(256);
+    buf.extend_from_slice(MAGIC);
+    buf.push(FORMAT_VERSION);
+    write_statements(&mut buf, &program.statements);
+    buf
+}
+
+/// Load a program previously produced by [`encode`].
+pub fn decode(bytes: &[u8]) -> Result<Program, ParseError> {
+    let rest = bytes
+        .strip_prefix(MAGIC.as_slice())
+        .ok_or_else(|| invalid("missing SENTC header"))?;
+    let (&version, rest) = rest
+        .split_first()
+        .ok_or_else(|| invalid("truncated header"))?;
+    if version != FORMAT_VERSION {
+        return Err(invalid(&format!(
+            "format version {} is not supported (expected {})",
+            version, FORMAT_VERSION
+        )));
+    }
+
+    let mut reader = Reader { buf: rest, pos: 0 };
+    let statements = reader.statements()?;
+    if reader.pos != reader.buf.len() {
+        return Err(invalid("trailing bytes after program"));
+    }
+    Ok(Program { statements })
+}
+
+/// Compile the source file at `src` and write the result to `out`.
+pub fn compile_file(src: &Path, out: &Path) -> Result<Program, Error> {
+    let source = fs::read_to_string(src).map_err(MemoryError::from)?;
+    let program = compile(&src.display().to_string(), &source)?;
+    fs::write(out, encode(&program)).map_err(MemoryError::from)?;
+    Ok(program)
+}
+
+/// Load either a compiled `.sentc` file or a `.sent` source file.
+pub fn load_file(path: &Path) -> Result<Program, Error> {
+    let bytes = fs::read(path).map_err(MemoryError::from)?;
+    if bytes.starts_with(MAGIC) {
+        return decode(&bytes).map_err(|e| e.with_source_name(&path.display().to_string()).into());
+    }
+    let source = String::from_utf8(bytes).map_err(|_| {
+        invalid("source is not valid UTF-8").with_source_name(&path.display().to_string())
+    })?;
+    Ok(compile(&path.display().to_string(), &source)?)
+}
+
+fn invalid(msg: &str) -> ParseError {
+    ParseError::new(ParseErrorKind::InvalidCompiled(msg.to_string()))
+}
+
+mod tag {
+    pub const AGENT: u8 = 1;
+    pub const MEM: u8 = 2;
+    pub const ON_INPUT: u8 = 3;
+    pub const REFLECT: u8 = 4;
+    pub const REFLECT_ACCESS: u8 = 5;
+    pub const TRAIN: u8 = 6;
+    pub const EVOLVE: u8 = 7;
+    pub const GOAL: u8 = 8;
+    pub const EMBED: u8 = 9;
+    pub const IF_CONTEXT_INCLUDES: u8 = 10;
+    pub const PRINT: u8 = 11;
+    pub const ASSIGNMENT: u8 = 12;
+    pub const UNKNOWN: u8 = 13;
+    pub const ASK: u8 = 14;
+    pub const FETCH: u8 = 15;
+    pub const READ_FILE: u8 = 16;
+    pub const WRITE_FILE: u8 = 17;
+    pub const EXEC: u8 = 18;
+    pub const ON_SCHEDULE: u8 = 19;
+    pub const LOCATION: u8 = 20;
+    pub const ON_START: u8 = 21;
+    pub const ON_STOP: u8 = 22;
+    pub const PIPELINE: u8 = 23;
+    pub const CAPABILITIES: u8 = 24;
+    pub const IF_STATE: u8 = 25;
+    pub const ATTENTION: u8 = 26;
+    pub const PROPOSE_GOAL: u8 = 27;
+    pub const PROPOSE_THRESHOLD: u8 = 28;
+    pub const PROPOSE_LINK: u8 = 29;
+    pub const TRAIN_FROM: u8 = 30;
+    pub const REWARD: u8 = 31;
+    pub const IF_REWARD: u8 = 32;
+    pub const TEMPLATE: u8 = 33;
+    pub const PRINT_TEMPLATE: u8 = 34;
+    pub const ASK_TEMPLATE: u8 = 35;
+    pub const IMPORT: u8 = 36;
+    pub const LANG: u8 = 37;
+    pub const IF: u8 = 38;
+    pub const IF_ELSE: u8 = 39;
+    pub const LET: u8 = 40;
+    pub const FUNCTION: u8 = 41;
+    pub const RETURN: u8 = 42;
+    pub const CALL: u8 = 43;
+    pub const WHILE: u8 = 44;
+    pub const FOR: u8 = 45;
+    pub const ASSIGN: u8 = 46;
+    pub const RECALL: u8 = 47;
+    pub const SEND: u8 = 48;
+    pub const EMIT: u8 = 49;
+    pub const ON_OUTPUT: u8 = 50;
+    pub const PRINT_EXPR: u8 = 51;
+    pub const ASK_EXPR: u8 = 52;
+}
+
+/// Tags of the nodes of an [`Expr`].
+mod expr_tag {
+    pub const TEXT: u8 = 1;
+    pub const NUMBER: u8 = 2;
+    pub const BOOL: u8 = 3;
+    pub const IDENT: u8 = 4;
+    pub const FIELD: u8 = 5;
+    pub const INDEX: u8 = 6;
+    pub const UNARY: u8 = 7;
+    pub const BINARY: u8 = 8;
+    pub const CALL: u8 = 9;
+    pub const LIST: u8 = 10;
+    pub const MAP: u8 = 11;
+}
+
+fn write_statements(buf: &mut Vec<u8>, statements: &[Statement]) {
+    write_len(buf, statements.len());
+    for stmt in statements {
+        write_statement(buf, stmt);
+    }
+}
+
+fn write_statement(buf: &mut Vec<u8>, stmt: &Statement) {
+    match stmt {
+        Statement::AgentDeclaration { name, body } => {
+            buf.push(tag::AGENT);
+            write_str(buf, name);
+            write_statements(buf, body);
+        }
+        Statement::MemDeclaration { target } => {
+            buf.push(tag::MEM);
+            write_str(buf, target);
+        }
+        Statement::OnInput { param, body } => {
+            buf.push(tag::ON_INPUT);
+            write_str(buf, param);
+            write_statements(buf, body);
+        }
+        Statement::OnSchedule { spec, body } => {
+            buf.push(tag::ON_SCHEDULE);
+            write_str(buf, spec);
+            write_statements(buf, body);
+        }
+        Statement::OnOutput { param, body } => {
+            buf.push(tag::ON_OUTPUT);
+            write_str(buf, param);
+            write_statements(buf, body);
+        }
+        Statement::Reflect { body } => {
+            buf.push(tag::REFLECT);
+            write_statements(buf, body);
+        }
+        Statement::ReflectAccess { mem_target, key } => {
+            buf.push(tag::REFLECT_ACCESS);
+            write_str(buf, mem_target);
+            write_str(buf, key);
+        }
+        Statement::Attention { top } => {
+            buf.push(tag::ATTENTION);
+            write_len(buf, *top);
+        }
+        Statement::Send { agent, message } => {
+            buf.push(tag::SEND);
+            write_str(buf, agent);
+            write_expr(buf, message);
+        }
+        Statement::Emit(value) => {
+            buf.push(tag::EMIT);
+            write_expr(buf, value);
+        }
+        Statement::Propose(Mutation::Goal(goal)) => {
+            buf.push(tag::PROPOSE_GOAL);
+            write_str(buf, goal);
+        }
+        Statement::Propose(Mutation::Threshold { drive, value }) => {
+            buf.push(tag::PROPOSE_THRESHOLD);
+            write_str(buf, drive);
+            write_str(buf, value);
+        }
+        Statement::Propose(Mutation::Link { from, to }) => {
+            buf.push(tag::PROPOSE_LINK);
+            write_str(buf, from);
+            write_str(buf, to);
+        }
+        Statement::Train {
+            dataset: None,
+            body,
+        } => {
+            buf.push(tag::TRAIN);
+            write_statements(buf, body);
+        }
+        Statement::Train {
+            dataset: Some(path),
+            body,
+        } => {
+            buf.push(tag::TRAIN_FROM);
+            write_str(buf, path);
+            write_statements(buf, body);
+        }
+        Statement::Evolve { body } => {
+            buf.push(tag::EVOLVE);
+            write_statements(buf, body);
+        }
+        Statement::OnStart { body } => {
+            buf.push(tag::ON_START);
+            write_statements(buf, body);
+        }
+        Statement::OnStop { body } => {
+            buf.push(tag::ON_STOP);
+            write_statements(buf, body);
+        }
+        Statement::Pipeline { stages } => {
+            buf.push(tag::PIPELINE);
+            write_len(buf, stages.len());
+            for stage in stages {
+                write_str(buf, stage);
+            }
+        }
+        Statement::Import(module) => {
+            buf.push(tag::IMPORT);
+            write_str(buf, module);
+        }
+        Statement::Lang(version) => {
+            buf.push(tag::LANG);
+            write_str(buf, version.as_str());
+        }
+        Statement::Capabilities(capabilities) => {
+            buf.push(tag::CAPABILITIES);
+            write_len(buf, capabilities.len());
+            for capability in capabilities {
+                write_str(buf, capability);
+            }
+        }
+        Statement::Goal(text) => {
+            buf.push(tag::GOAL);
+            write_str(buf, text);
+        }
+        Statement::Embed { source, target } => {
+            buf.push(tag::EMBED);
+            write_str(buf, source);
+            write_str(buf, target);
+        }
+        Statement::IfContextIncludes { values, body } => {
+            buf.push(tag::IF_CONTEXT_INCLUDES);
+            write_len(buf, values.len());
+            for value in values {
+                write_str(buf, value);
+            }
+            write_statements(buf, body);
+        }
+        Statement::IfElse { branch, otherwise } => {
+            buf.push(tag::IF_ELSE);
+            write_statement(buf, branch);
+            write_statements(buf, otherwise);
+        }
+        Statement::If { condition, body } => {
+            buf.push(tag::IF);
+            write_expr(buf, condition);
+            write_statements(buf, body);
+        }
+        Statement::IfState {
+            drive,
+            op,
+            value,
+            body,
+        } => {
+            buf.push(tag::IF_STATE);
+            write_str(buf, drive);
+            write_str(buf, op);
+            write_str(buf, value);
+            write_statements(buf, body);
+        }
+        Statement::IfReward {
+            behavior,
+            stat,
+            op,
+            value,
+            body,
+        } => {
+            buf.push(tag::IF_REWARD);
+            write_str(buf, behavior);
+            write_str(buf, stat);
+            write_str(buf, op);
+            write_str(buf, value);
+            write_statements(buf, body);
+        }
+        Statement::Reward(value) => {
+            buf.push(tag::REWARD);
+            write_str(buf, value);
+        }
+        Statement::Template { name, text } => {
+            buf.push(tag::TEMPLATE);
+            write_str(buf, name);
+            write_str(buf, text);
+        }
+        Statement::Print(Text::Literal(text)) => {
+            buf.push(tag::PRINT);
+            write_str(buf, text);
+        }
+        Statement::Print(Text::Template { name, args }) => {
+            buf.push(tag::PRINT_TEMPLATE);
+            write_str(buf, name);
+            write_pairs(buf, args);
+        }
+        Statement::Print(Text::Expr(value)) => {
+            buf.push(tag::PRINT_EXPR);
+            write_expr(buf, value);
+        }
+        Statement::Ask {
+            prompt: Text::Literal(prompt),
+            options,
+            target,
+            key,
+        } => {
+            buf.push(tag::ASK);
+            write_request(buf, prompt, options, target, key);
+        }
+        // The expression, then a request without text.
+        Statement::Ask {
+            prompt: Text::Expr(prompt),
+            options,
+            target,
+            key,
+        } => {
+            buf.push(tag::ASK_EXPR);
+            write_expr(buf, prompt);
+            write_request(buf, "", options, target, key);
+        }
+        // The template's arguments, then a request with its name as text.
+        Statement::Ask {
+            prompt: Text::Template { name, args },
+            options,
+            target,
+            key,
+        } => {
+            buf.push(tag::ASK_TEMPLATE);
+            write_pairs(buf, args);
+            write_request(buf, name, options, target, key);
+        }
+        Statement::Fetch {
+            url,
+            options,
+            target,
+            key,
+        } => {
+            buf.push(tag::FETCH);
+            write_request(buf, url, options, target, key);
+        }
+        Statement::Exec {
+            command,
+            options,
+            target,
+            key,
+        } => {
+            buf.push(tag::EXEC);
+            write_request(buf, command, options, target, key);
+        }
+        Statement::ReadFile { path, target, key } => {
+            buf.push(tag::READ_FILE);
+            write_str(buf, path);
+            write_str(buf, target);
+            write_str(buf, key);
+        }
+        Statement::WriteFile { target, key, path } => {
+            buf.push(tag::WRITE_FILE);
+            write_str(buf, target);
+            write_str(buf, key);
+            write_str(buf, path);
+        }
+        Statement::Let { name, value } => {
+            buf.push(tag::LET);
+            write_str(buf, name);
+            write_expr(buf, value);
+        }
+        Statement::Function { name, params, body } => {
+            buf.push(tag::FUNCTION);
+            write_str(buf, name);
+            write_len(buf, params.len());
+            for param in params {
+                write_str(buf, param);
+            }
+            write_statements(buf, body);
+        }
+        Statement::Return(value) => {
+            buf.push(tag::RETURN);
+            buf.push(value.is_some() as u8);
+            if let Some(value) = value {
+                write_expr(buf, value);
+            }
+        }
+        Statement::Call { name, args } => {
+            buf.push(tag::CALL);
+            write_str(buf, name);
+            write_exprs(buf, args);
+        }
+        Statement::While { condition, body } => {
+            buf.push(tag::WHILE);
+            write_expr(buf, condition);
+            write_statements(buf, body);
+        }
+        Statement::For {
+            key,
+            value,
+            region,
+            body,
+        } => {
+            buf.push(tag::FOR);
+            write_str(buf, key);
+            write_str(buf, value);
+            write_str(buf, region);
+            write_statements(buf, body);
+        }
+        Statement::Recall { query, top } => {
+            buf.push(tag::RECALL);
+            write_expr(buf, query);
+            write_len(buf, *top);
+        }
+        Statement::Assign { name, value } => {
+            buf.push(tag::ASSIGN);
+            write_str(buf, name);
+            write_expr(buf, value);
+        }
+        Statement::Assignment(name, expr) => {
+            buf.push(tag::ASSIGNMENT);
+            write_str(buf, name);
+            write_str(buf, expr);
+        }
+        Statement::Unknown(text) => {
+            buf.push(tag::UNKNOWN);
+            write_str(buf, text);
+        }
+        Statement::Location { line, depth } => {
+            buf.push(tag::LOCATION);
+            write_len(buf, *line);
+            write_len(buf, *depth);
+        }
+    }
+}
+
+fn write_expr(buf: &mut Vec<u8>, expr: &Expr) {
+    match expr {
+        Expr::Text(text) => {
+            buf.push(expr_tag::TEXT);
+            write_str(buf, text);
+        }
+        Expr::Number(number) => {
+            buf.push(expr_tag::NUMBER);
+            write_str(buf, number);
+        }
+        Expr::Bool(value) => {
+            buf.push(expr_tag::BOOL);
+            buf.push(*value as u8);
+        }
+        Expr::Ident(name) => {
+            buf.push(expr_tag::IDENT);
+            write_str(buf, name);
+        }
+        Expr::Field(target, name) => {
+            buf.push(expr_tag::FIELD);
+            write_expr(buf, target);
+            write_str(buf, name);
+        }
+        Expr::Index(target, index) => {
+            buf.push(expr_tag::INDEX);
+            write_expr(buf, target);
+            write_expr(buf, index);
+        }
+        Expr::Unary(op, operand) => {
+            buf.push(expr_tag::UNARY);
+            write_str(buf, op.as_str());
+            write_expr(buf, operand);
+        }
+        Expr::Binary(op, left, right) => {
+            buf.push(expr_tag::BINARY);
+            write_str(buf, op.as_str());
+            write_expr(buf, left);
+            write_expr(buf, right);
+        }
+        Expr::Call(name, args) => {
+            buf.push(expr_tag::CALL);
+            write_str(buf, name);
+            write_exprs(buf, args);
+        }
+        Expr::List(items) => {
+            buf.push(expr_tag::LIST);
+            write_exprs(buf, items);
+        }
+        Expr::Map(entries) => {
+            buf.push(expr_tag::MAP);
+            write_len(buf, entries.len());
+            for (key, value) in entries {
+                write_expr(buf, key);
+                write_expr(buf, value);
+            }
+        }
+    }
+}
+
+fn write_exprs(buf: &mut Vec<u8>, exprs: &[Expr]) {
+    write_len(buf, exprs.len());
+    for expr in exprs {
+        write_expr(buf, expr);
+    }
+}
+
+fn write_request(
+    buf: &mut Vec<u8>,
+    text: &str,
+    options: &[(String, String)],
+    target: &str,
+    key: &str,
+) {
+    write_str(buf, text);
+    write_pairs(buf, options);
+    write_str(buf, target);
+    write_str(buf, key);
+}
+
+fn write_pairs(buf: &mut Vec<u8>, pairs: &[(String, String)]) {
+    write_len(buf, pairs.len());
+    for (name, value) in pairs {
+        write_str(buf, name);
+        write_str(buf, value);
+    }
+}
+
+/// LEB128-style unsigned varint.
+fn write_len(buf: &mut Vec<u8>, mut n: usize) {
+    while n >= 0x80 {
+        buf.push((n as u8 & 0x7f) | 0x80);
+        n >>= 7;
+    }
+    buf.push(n as u8);
+}
+
+fn write_str(buf: &mut Vec<u8>, s: &str) {
+    write_len(buf, s.len());
+    buf.extend_from_slice(s.as_bytes());
+}
+
+struct Reader<'a> {
+    buf: &'a [u8],
+    pos: usize,
+}
+
+impl<'a> Reader<'a> {
+    fn byte(&mut self) -> Result<u8, ParseError> {
+        let b = *self
+            .buf
+            .get(self.pos)
+            .ok_or_else(|| invalid("unexpected end of data"))?;
+        self.pos += 1;
+        Ok(b)
+    }
+
+    fn len(&mut self) -> Result<usize, ParseError> {
+        let mut n: usize = 0;
+        let mut shift = 0;
+        loop {
+            let b = self.byte()?;
+            if shift >= usize::BITS {
+                return Err(invalid("length overflows"));
+            }
+            n |= ((b & 0x7f) as usize) << shift;
+            if b & 0x80 == 0 {
+                return Ok(n);
+            }
+            shift += 7;
+        }
+    }
+
+    fn string(&mut self) -> Result<String, ParseError> {
+        let len = self.len()?;
+        let end = self
+            .pos
+            .checked_add(len)
+            .filter(|&end| end <= self.buf.len())
+            .ok_or_else(|| invalid("string runs past end of data"))?;
+        let s = std::str::from_utf8(&self.buf[self.pos..end])
+            .map_err(|_| invalid("string is not valid UTF-8"))?;
+        self.pos = end;
+        Ok(s.to_string())
+    }
+
+    fn statements(&mut self) -> Result<Vec<Statement>, ParseError> {
+        let count = self.len()?;
+        // Every statement takes at least one byte, so a larger count is corrupt.
+        if count > self.buf.len() - self.pos {
+            return Err(invalid("statement count exceeds data"));
+        }
+        let mut statements = Vec::with_capacity(count);
+        for _ in 0..count {
+            statements.push(self.statement()?);
+        }
+        Ok(statements)
+    }
+
+    #[allow(clippy::type_complexity)]
+    fn request(&mut self) -> Result<(String, Vec<(String, String)>, String, String), ParseError> {
+        let text = self.string()?;
+        let options = self.pairs()?;
+        Ok((text, options, self.string()?, self.string()?))
+    }
+
+    fn pairs(&mut self) -> Result<Vec<(String, String)>, ParseError> {
+        let count = self.len()?;
+        let mut pairs = Vec::new();
+        for _ in 0..count {
+            pairs.push((self.string()?, self.string()?));
+        }
+        Ok(pairs)
+    }
+
+    fn expr(&mut self) -> Result<Expr, ParseError> {
+        let expr = match self.byte()? {
+            expr_tag::TEXT => Expr::Text(self.string()?),
+            expr_tag::NUMBER => Expr::Number(self.string()?),
+            expr_tag::BOOL => Expr::Bool(self.byte()? != 0),
+            expr_tag::IDENT => Expr::Ident(self.string()?),
+            expr_tag::FIELD => Expr::Field(Box::new(self.expr()?), self.string()?),
+            expr_tag::INDEX => Expr::Index(Box::new(self.expr()?), Box::new(self.expr()?)),
+            expr_tag::UNARY => {
+                let op = match self.string()?.as_str() {
+                    "!" => UnaryOp::Not,
+                    "-" => UnaryOp::Neg,
+                    _ => return Err(invalid("unknown unary operator")),
+                };
+                Expr::Unary(op, Box::new(self.expr()?))
+            }
+            expr_tag::BINARY => {
+                let op = BinaryOp::parse(&self.string()?)
+                    .ok_or_else(|| invalid("unknown binary operator"))?;
+                Expr::Binary(op, Box::new(self.expr()?), Box::new(self.expr()?))
+            }
+            expr_tag::CALL => Expr::Call(self.string()?, self.exprs()?),
+            expr_tag::LIST => Expr::List(self.exprs()?),
+            expr_tag::MAP => {
+                let count = self.len()?;
+                let mut entries = Vec::new();
+                for _ in 0..count {
+                    entries.push((self.expr()?, self.expr()?));
+                }
+                Expr::Map(entries)
+            }
+            other => return Err(invalid(&format!("unknown expression tag {}", other))),
+        };
+        Ok(expr)
+    }
+
+    fn exprs(&mut self) -> Result<Vec<Expr>, ParseError> {
+        let count = self.len()?;
+        let mut exprs = Vec::new();
+        for _ in 0..count {
+            exprs.push(self.expr()?);
+        }
+        Ok(exprs)
+    }
+
+    fn statement(&mut self) -> Result<Statement, ParseError> {
+        let stmt = match self.byte()? {
+            tag::AGENT => Statement::AgentDeclaration {
+                name: self.string()?,
+                body: self.statements()?,
+            },
+            tag::MEM => Statement::MemDeclaration {
+                target: self.string()?,
+            },
+            tag::ON_INPUT => Statement::OnInput {
+                param: self.string()?,
+                body: self.statements()?,
+            },
+            tag::ON_OUTPUT => Statement::OnOutput {
+                param: self.string()?,
+                body: self.statements()?,
+            },
+            tag::ON_SCHEDULE => Statement::OnSchedule {
+                spec: self.string()?,
+                body: self.statements()?,
+            },
+            tag::REFLECT => Statement::Reflect {
+                body: self.statements()?,
+            },
+            tag::REFLECT_ACCESS => Statement::ReflectAccess {
+                mem_target: self.string()?,
+                key: self.string()?,
+            },
+            tag::ATTENTION => Statement::Attention { top: self.len()? },
+            tag::PROPOSE_GOAL => Statement::Propose(Mutation::Goal(self.string()?)),
+            tag::PROPOSE_THRESHOLD => Statement::Propose(Mutation::Threshold {
+                drive: self.string()?,
+                value: self.string()?,
+            }),
+            tag::PROPOSE_LINK => Statement::Propose(Mutation::Link {
+                from: self.string()?,
+                to: self.string()?,
+            }),
+            tag::TRAIN => Statement::Train {
+                dataset: None,
+                body: self.statements()?,
+            },
+            tag::TRAIN_FROM => Statement::Train {
+                dataset: Some(self.string()?),
+                body: self.statements()?,
+            },
+            tag::EVOLVE => Statement::Evolve {
+                body: self.statements()?,
+            },
+            tag::ON_START => Statement::OnStart {
+                body: self.statements()?,
+            },
+            tag::ON_STOP => Statement::OnStop {
+                body: self.statements()?,
+            },
+            tag::PIPELINE => {
+                let count = self.len()?;
+                let mut stages = Vec::new();
+                for _ in 0..count {
+                    stages.push(self.string()?);
+                }
+                Statement::Pipeline { stages }
+            }
+            tag::IMPORT => Statement::Import(self.string()?),
+            tag::LANG => {
+                let version = self.string()?;
+                Statement::Lang(
+                    Version::parse(&version).ok_or_else(|| invalid("unknown language version"))?,
+                )
+            }
+            tag::CAPABILITIES => {
+                let count = self.len()?;
+                let mut capabilities = Vec::new();
+                for _ in 0..count {
+                    capabilities.push(self.string()?);
+                }
+                Statement::Capabilities(capabilities)
+            }
+            tag::GOAL => Statement::Goal(self.string()?),
+            tag::EMBED => Statement::Embed {
+                source: self.string()?,
+                target: self.string()?,
+            },
+            tag::IF_CONTEXT_INCLUDES => {
+                let count = self.len()?;
+                let mut values = Vec::new();
+                for _ in 0..count {
+                    values.push(self.string()?);
+                }
+                Statement::IfContextIncludes {
+                    values,
+                    body: self.statements()?,
+                }
+            }
+            tag::IF_ELSE => {
+                let branch = self.statement()?;
+                if !matches!(
+                    branch,
+                    Statement::If { .. }
+                        | Statement::IfState { .. }
+                        | Statement::IfReward { .. }
+                        | Statement::IfContextIncludes { .. }
+                ) {
+                    return Err(invalid("else after a statement other than if"));
+                }
+                Statement::IfElse {
+                    branch: Box::new(branch),
+                    otherwise: self.statements()?,
+                }
+            }
+            tag::IF => Statement::If {
+                condition: self.expr()?,
+                body: self.statements()?,
+            },
+            tag::IF_STATE => Statement::IfState {
+                drive: self.string()?,
+                op: self.string()?,
+                value: self.string()?,
+                body: self.statements()?,
+            },
+            tag::IF_REWARD => Statement::IfReward {
+                behavior: self.string()?,
+                stat: self.string()?,
+                op: self.string()?,
+                value: self.string()?,
+                body: self.statements()?,
+            },
+            tag::REWARD => Statement::Reward(self.string()?),
+            tag::TEMPLATE => Statement::Template {
+                name: self.string()?,
+                text: self.string()?,
+            },
+            tag::PRINT => Statement::Print(Text::Literal(self.string()?)),
+            tag::PRINT_TEMPLATE => Statement::Print(Text::Template {
+                name: self.string()?,
+                args: self.pairs()?,
+            }),
+            tag::ASK => {
+                let (prompt, options, target, key) = self.request()?;
+                Statement::Ask {
+                    prompt: Text::Literal(prompt),
+                    options,
+                    target,
+                    key,
+                }
+            }
+            tag::PRINT_EXPR => Statement::Print(Text::Expr(self.expr()?)),
+            tag::ASK_EXPR => {
+                let prompt = self.expr()?;
+                let (_, options, target, key) = self.request()?;
+                Statement::Ask {
+                    prompt: Text::Expr(prompt),
+                    options,
+                    target,
+                    key,
+                }
+            }
+            tag::ASK_TEMPLATE => {
+                let args = self.pairs()?;
+                let (name, options, target, key) = self.request()?;
+                Statement::Ask {
+                    prompt: Text::Template { name, args },
+                    options,
+                    target,
+                    key,
+                }
+            }
+            tag::FETCH => {
+                let (url, options, target, key) = self.request()?;
+                Statement::Fetch {
+                    url,
+                    options,
+                    target,
+                    key,
+                }
+            }
+            tag::EXEC => {
+                let (command, options, target, key) = self.request()?;
+                Statement::Exec {
+                    command,
+                    options,
+                    target,
+                    key,
+                }
+            }
+            tag::READ_FILE => Statement::ReadFile {
+                path: self.string()?,
+                target: self.string()?,
+                key: self.string()?,
+            },
+            tag::WRITE_FILE => Statement::WriteFile {
+                target: self.string()?,
+                key: self.string()?,
+                path: self.string()?,
+            },
+            tag::ASSIGNMENT => Statement::Assignment(self.string()?, self.string()?),
+            tag::ASSIGN => Statement::Assign {
+                name: self.string()?,
+                value: self.expr()?,
+            },
+            tag::RECALL => Statement::Recall {
+                query: self.expr()?,
+                top: self.len()?,
+            },
+            tag::SEND => Statement::Send {
+                agent: self.string()?,
+                message: self.expr()?,
+            },
+            tag::EMIT => Statement::Emit(self.expr()?),
+            tag::LET => Statement::Let {
+                name: self.string()?,
+                value: self.expr()?,
+            },
+            tag::FUNCTION => {
+                let name = self.string()?;
+                let count = self.len()?;
+                let mut params = Vec::new();
+                for _ in 0..count {
+                    params.push(self.string()?);
+                }
+                Statement::Function {
+                    name,
+                    params,
+                    body: self.statements()?,
+                }
+            }
+            tag::RETURN => match self.byte()? {
+                0 => Statement::Return(None),
+                _ => Statement::Return(Some(self.expr()?)),
+            },
+            tag::CALL => Statement::Call {
+                name: self.string()?,
+                args: self.exprs()?,
+            },
+            tag::WHILE => Statement::While {
+                condition: self.expr()?,
+                body: self.statements()?,
+            },
+            tag::FOR => Statement::For {
+                key: self.string()?,
+                value: self.string()?,
+                region: self.string()?,
+                body: self.statements()?,
+            },
+            tag::UNKNOWN => Statement::Unknown(self.string()?),
+            tag::LOCATION => Statement::Location {
+                line: self.len()?,
+                depth: self.len()?,
+            },
+            other => return Err(invalid(&format!("unknown statement tag {}", other))),
+        };
+        Ok(stmt)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn round_trips_example_program() {
+        let program = compile("echo.sent", include_str!("../examples/echo.sent")).unwrap();
+        let bytes = encode(&program);
+        assert!(bytes.starts_with(MAGIC));
+        assert_eq!(decode(&bytes).unwrap(), program);
+    }
+
+    #[test]
+    fn rejects_truncated_and_foreign_data() {
+        let program = compile("echo.sent", include_str!("../examples/echo.sent")).unwrap();
+        let bytes = encode(&program);
+        for cut in [0, MAGIC.len(), bytes.len() / 2, bytes.len() - 1] {
+            assert!(decode(&bytes[..cut]).is_err(), "cut at {}", cut);
+        }
+        assert!(decode(b"agent Echo {}").is_err());
+    }
+}
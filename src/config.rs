@@ -0,0 +1,370 @@
+use serde::Deserialize;
+use std::collections::{BTreeMap, HashMap};
+use std::env;
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+/// File looked up in the working directory when no path is given.
+pub const DEFAULT_CONFIG_FILE: &str = "sentience.json";
+
+/// Runtime configuration, read from a JSON file. Every section is optional
+/// and environment variables override file values where noted.
+#[derive(Clone, Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct Config {
+    pub llm: LlmConfig,
+    pub sandbox: SandboxConfig,
+    pub limits: LimitsConfig,
+    /// URLs notified of agent events.
+    pub webhooks: Vec<WebhookConfig>,
+    pub telemetry: TelemetryConfig,
+    pub slack: SlackConfig,
+    pub discord: DiscordConfig,
+    pub speech: SpeechConfig,
+    pub sync: SyncConfig,
+    /// The index `recall` searches memory with.
+    pub latent: LatentConfig,
+    pub supervisor: SupervisorConfig,
+    /// File every input an agent handles is appended to, for `replay`.
+    pub record: Option<PathBuf>,
+    /// File long-term memory is kept in and written through to; see
+    /// [`store`](crate::store).
+    pub store: Option<PathBuf>,
+    pub affect: AffectConfig,
+    /// Clients of `serve --http`, each with an agent of its own; see
+    /// [`tenants`](crate::tenants).
+    pub tenants: Vec<TenantConfig>,
+}
+
+#[derive(Clone, Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct LlmConfig {
+    /// Provider used by `ask` when the statement does not name one.
+    pub default_provider: Option<String>,
+    pub openai: Option<OpenAiConfig>,
+    pub anthropic: Option<AnthropicConfig>,
+    pub ollama: Option<OllamaConfig>,
+    /// Vectors for `embed` and `similarity`; see
+    /// [`embedding`](crate::llm::embedding).
+    pub embedding: Option<EmbeddingConfig>,
+}
+
+#[derive(Clone, Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct OpenAiConfig {
+    /// Overridden by `OPENAI_API_KEY`.
+    pub api_key: Option<String>,
+    /// Overridden by `OPENAI_BASE_URL`.
+    pub base_url: Option<String>,
+    /// Overridden by `OPENAI_MODEL`.
+    pub model: Option<String>,
+    pub organization: Option<String>,
+    pub max_retries: Option<u32>,
+    pub timeout_secs: Option<u64>,
+}
+
+#[derive(Clone, Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct AnthropicConfig {
+    /// Overridden by `ANTHROPIC_API_KEY`.
+    pub api_key: Option<String>,
+    /// Overridden by `ANTHROPIC_BASE_URL`.
+    pub base_url: Option<String>,
+    /// Overridden by `ANTHROPIC_MODEL`.
+    pub model: Option<String>,
+}
+
+#[derive(Clone, Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct OllamaConfig {
+    /// Overridden by `OLLAMA_HOST`. Defaults to `http://localhost:11434`.
+    pub base_url: Option<String>,
+    /// Overridden by `OLLAMA_MODEL`.
+    pub model: Option<String>,
+    /// Local models can be slow to load, so this defaults to five minutes.
+    pub timeout_secs: Option<u64>,
+}
+
+#[derive(Clone, Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct EmbeddingConfig {
+    /// `hash`, `openai` or `ollama`. Defaults to `hash`, which needs no
+    /// service.
+    pub provider: Option<String>,
+    /// Defaults to `text-embedding-3-small` for OpenAI and
+    /// `nomic-embed-text` for Ollama.
+    pub model: Option<String>,
+    /// Defaults to the provider section's timeout, else one minute.
+    pub timeout_secs: Option<u64>,
+}
+
+/// Access granted to programs beyond their own memory; everything is off
+/// by default.
+#[derive(Clone, Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct SandboxConfig {
+    /// Allow `fetch`. Also enabled by the `--allow-net` flag.
+    pub allow_net: bool,
+    /// Hosts `fetch` may contact (`*.example.com` for subdomains); empty
+    /// allows any host once networking is on.
+    pub allowed_hosts: Vec<String>,
+    /// Directory `read` and `write` are confined to; file access is denied
+    /// when unset. Also set by `--workspace <dir>`.
+    pub workspace: Option<PathBuf>,
+    /// Allow `exec`. Also enabled by the `--allow-exec` flag; commands must
+    /// still appear in `exec_allowlist`.
+    pub allow_exec: bool,
+    /// Programs `exec` may run, e.g. `["date", "git"]`.
+    pub exec_allowlist: Vec<String>,
+    /// Deny everything above to agents that do not declare `capabilities`,
+    /// e.g. when running agent definitions from others.
+    pub require_capabilities: bool,
+}
+
+/// Caps on memory, queued events, time and loops; each but loops is
+/// unlimited when unset. See
+/// [`Limits`](crate::limits::Limits).
+#[derive(Clone, Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct LimitsConfig {
+    /// Entries in each memory region.
+    pub max_entries: Option<usize>,
+    /// Size in bytes of one memory value.
+    pub max_value_bytes: Option<usize>,
+    /// Events queued for webhooks and other listeners during one handler.
+    pub max_events: Option<usize>,
+    /// Vectors kept for similarity search.
+    pub max_latent_vectors: Option<usize>,
+    /// Seconds one `ask`, `fetch` or `exec` may take.
+    pub statement_timeout_secs: Option<f64>,
+    /// Seconds one run of a handler may take. Also set by `--timeout`.
+    pub turn_timeout_secs: Option<f64>,
+    /// Iterations of one `while` or `for` loop; 10 000 when unset.
+    pub max_loop_iterations: Option<usize>,
+}
+
+/// OpenTelemetry trace export; disabled unless an endpoint is set.
+#[derive(Clone, Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct TelemetryConfig {
+    /// OTLP/HTTP collector, e.g. `http://localhost:4318`. Overridden by
+    /// `OTEL_EXPORTER_OTLP_ENDPOINT`.
+    pub otlp_endpoint: Option<String>,
+    /// Overridden by `OTEL_SERVICE_NAME`. Defaults to `sentience`.
+    pub service_name: Option<String>,
+}
+
+/// Credentials for the `slack` command.
+#[derive(Clone, Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct SlackConfig {
+    /// Overridden by `SLACK_BOT_TOKEN`.
+    pub bot_token: Option<String>,
+    /// Overridden by `SLACK_SIGNING_SECRET`.
+    pub signing_secret: Option<String>,
+}
+
+/// Credentials and channels for the `discord` command.
+#[derive(Clone, Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct DiscordConfig {
+    /// Overridden by `DISCORD_BOT_TOKEN`.
+    pub bot_token: Option<String>,
+    /// Channel ids to watch, in addition to any given with `--channel`.
+    pub channels: Vec<String>,
+}
+
+/// Transcription for the `speech` command: the Whisper API unless a local
+/// `command` is given.
+#[derive(Clone, Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct SpeechConfig {
+    /// Overridden by `OPENAI_API_KEY`.
+    pub api_key: Option<String>,
+    /// Overridden by `OPENAI_BASE_URL`.
+    pub base_url: Option<String>,
+    /// Defaults to `whisper-1`.
+    pub model: Option<String>,
+    /// ISO-639-1 code of the spoken language; detected when unset.
+    pub language: Option<String>,
+    /// Local transcriber run once per audio file, e.g.
+    /// `["whisper-cli", "-m", "ggml-base.en.bin", "-nt", "-f", "{file}"]`.
+    /// `{file}` is replaced with the WAV path and stdout is the transcript.
+    pub command: Option<Vec<String>>,
+}
+
+/// An endpoint that receives a JSON POST for each matching agent event.
+#[derive(Clone, Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct WebhookConfig {
+    pub url: String,
+    /// `response_produced`, `memory_changed` or `goal_achieved`; empty
+    /// sends every event.
+    pub events: Vec<String>,
+    /// Memory keys whose changes are sent; empty sends every key.
+    pub keys: Vec<String>,
+    /// Extra request headers, e.g. an `Authorization` token.
+    pub headers: HashMap<String, String>,
+    /// Retries after a failed delivery; defaults to 3.
+    pub max_retries: Option<u32>,
+    pub timeout_secs: Option<u64>,
+}
+
+#[derive(Debug)]
+pub enum ConfigError {
+    Io(PathBuf, std::io::Error),
+    Parse(PathBuf, serde_json::Error),
+}
+
+impl fmt::Display for ConfigError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            ConfigError::Io(path, e) => write!(f, "{}: {}", path.display(), e),
+            ConfigError::Parse(path, e) => write!(f, "{}: invalid config: {}", path.display(), e),
+        }
+    }
+}
+
+impl std::error::Error for ConfigError {}
+
+impl Config {
+    pub fn load(path: &Path) -> Result<Config, ConfigError> {
+        let content =
+            fs::read_to_string(path).map_err(|e| ConfigError::Io(path.to_path_buf(), e))?;
+        serde_json::from_str(&content).map_err(|e| ConfigError::Parse(path.to_path_buf(), e))
+    }
+
+    /// Load `path` if given, else `$SENTIENCE_CONFIG`, else `./sentience.json`
+    /// when it exists, else the defaults.
+    pub fn discover(path: Option<&Path>) -> Result<Config, ConfigError> {
+        if let Some(path) = path {
+            return Config::load(path);
+        }
+        if let Ok(path) = env::var("SENTIENCE_CONFIG") {
+            return Config::load(Path::new(&path));
+        }
+        let default = Path::new(DEFAULT_CONFIG_FILE);
+        if default.exists() {
+            return Config::load(default);
+        }
+        Ok(Config::default())
+    }
+}
+
+/// Mirroring of long-term memory to a shared Qdrant collection.
+#[derive(Clone, Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct SyncConfig {
+    /// Qdrant URL; sync is off when unset. Overridden by `SENTIENCE_SYNC_URL`.
+    pub url: Option<String>,
+    /// Overridden by `QDRANT_API_KEY`.
+    pub api_key: Option<String>,
+    /// Defaults to `sentience`.
+    pub collection: Option<String>,
+    /// Seconds between syncs; defaults to 30.
+    pub interval_secs: Option<u64>,
+    /// Name of this instance, unique among those sharing the collection.
+    /// Defaults to the host name and process id.
+    pub instance: Option<String>,
+}
+
+/// How `recall` compares the vectors of memory entries; see
+/// [`recall`](crate::recall).
+#[derive(Clone, Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct LatentConfig {
+    /// `cosine`, `dot` or `euclidean`. Defaults to `cosine`.
+    pub metric: Option<String>,
+    /// Components every vector must have; any number when unset.
+    pub dimensions: Option<usize>,
+}
+
+/// Restarting agents that crash under `serve`. See
+/// [`RestartPolicy`](crate::supervisor::RestartPolicy).
+#[derive(Clone, Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct SupervisorConfig {
+    /// Restarts in a row before an agent is left stopped; unlimited when
+    /// unset.
+    pub max_restarts: Option<u32>,
+    /// Seconds before the first restart, doubled after each further crash.
+    /// Defaults to 1.
+    pub backoff_secs: Option<f64>,
+    /// Longest wait between restarts, in seconds. Defaults to 60.
+    pub max_backoff_secs: Option<f64>,
+}
+
+/// A client of a multi-tenant `serve`, answered by its own agent.
+#[derive(Clone, Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct TenantConfig {
+    pub name: String,
+    /// Sent by the tenant as `Authorization: Bearer <token>`.
+    pub token: String,
+    /// Caps on the tenant's agent, in place of the top-level `limits`.
+    pub limits: Option<LimitsConfig>,
+    /// Requests the tenant may make in a minute; unlimited when unset.
+    pub requests_per_minute: Option<u32>,
+    /// File the tenant's memory is loaded from at start and saved to; kept
+    /// only in memory when unset.
+    pub memory: Option<PathBuf>,
+    /// Directory the tenant's `read` and `write` are confined to; file
+    /// access is denied when unset.
+    pub workspace: Option<PathBuf>,
+}
+
+/// Drives kept for each agent and what moves them; see
+/// [`affect`](crate::affect).
+#[derive(Clone, Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct AffectConfig {
+    /// Level each drive starts at, from 0 to 1; adds drives beyond
+    /// curiosity, frustration and confidence.
+    pub initial: BTreeMap<String, f64>,
+    /// Replace the default rules.
+    pub rules: Option<Vec<AffectRule>>,
+}
+
+#[derive(Clone, Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct AffectRule {
+    /// `memory_changed`, `goal_achieved`, `reflected`, `handler_succeeded`
+    /// or `handler_failed`.
+    pub on: String,
+    /// For `memory_changed` and `goal_achieved`, the only key that counts.
+    #[serde(default)]
+    pub key: Option<String>,
+    /// Amount added to each drive; negative lowers it.
+    pub adjust: BTreeMap<String, f64>,
+}
+
+/// Value of the environment variable `name` if set and non-empty, else `fallback`.
+pub fn env_or(name: &str, fallback: Option<&String>) -> Option<String> {
+    env::var(name)
+        .ok()
+        .filter(|v| !v.is_empty())
+        .or_else(|| fallback.cloned())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parses_partial_config() {
+        let config: Config = serde_json::from_str(
+            r#"{"llm": {"openai": {"model": "gpt-4o-mini", "max_retries": 5}}}"#,
+        )
+        .unwrap();
+        let openai = config.llm.openai.unwrap();
+        assert_eq!(openai.model.as_deref(), Some("gpt-4o-mini"));
+        assert_eq!(openai.max_retries, Some(5));
+        assert!(config.llm.anthropic.is_none());
+    }
+
+    #[test]
+    fn rejects_unknown_fields() {
+        assert!(serde_json::from_str::<Config>(r#"{"lm": {}}"#).is_err());
+    }
+}
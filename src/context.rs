@@ -1,66 +1,899 @@
+use crate::affect::Affect;
+use crate::attention::Attention;
+use crate::coverage::Coverage;
+use crate::debugger::Debugger;
+use crate::error::MemoryError;
+use crate::events::{AgentEvent, GOAL_ACHIEVED_KEY};
+use crate::expr::{Value, Variables};
+use crate::goals::GoalLog;
+use crate::history::{self, History};
+use crate::intern;
+use crate::lang::{self, Version};
+use crate::limits::{LimitError, Limits};
+use crate::llm::embedding::{self, Embedder};
+use crate::llm::LlmRegistry;
+use crate::packages::Packages;
+use crate::paged::{self, Region};
+use crate::recall::MemoryIndex;
+use crate::reward::Rewards;
+use crate::sandbox::Sandbox;
+use crate::store::{Attached, MemoryStore};
+use crate::transcript::Transcript;
+use crate::types::Mutation;
+use crate::{text, training};
 use serde::{Deserialize, Serialize};
-use std::collections::HashMap;
+use std::collections::{BTreeMap, HashMap};
 use std::fs;
-use std::io;
+use std::sync::Arc;
+use std::time::Instant;
 
-#[derive(Debug, Serialize, Deserialize)]
+/// A memory entry found by [`AgentContext::recall`].
+#[derive(Clone, Debug, PartialEq, Serialize)]
+pub struct MemoryMatch {
+    pub region: String,
+    pub key: String,
+    pub value: String,
+}
+
+/// How much an agent holds, from [`AgentContext::stats`].
+#[derive(Clone, Debug, PartialEq, Serialize)]
+pub struct Stats {
+    pub regions: Vec<RegionStats>,
+    pub links: usize,
+}
+
+#[derive(Clone, Debug, PartialEq, Serialize)]
+pub struct RegionStats {
+    pub region: String,
+    pub entries: usize,
+    /// Approximate size of the keys and values; see [`Region::bytes`].
+    pub bytes: usize,
+    /// Whether the entries are in memory rather than still on disk.
+    pub loaded: bool,
+}
+
+/// An agent's memory, as saved by [`AgentContext::save`] and served by the
+/// HTTP API. Keys are serialized in sorted order.
+#[derive(Clone, Debug, Default, PartialEq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct Snapshot {
+    #[serde(serialize_with = "intern::serialize_sorted")]
+    pub mem_short: HashMap<String, Value>,
+    #[serde(serialize_with = "intern::serialize_sorted")]
+    pub mem_long: HashMap<String, Value>,
+    /// `mem.shared`, seen by every agent.
+    #[serde(
+        serialize_with = "intern::serialize_sorted",
+        skip_serializing_if = "HashMap::is_empty"
+    )]
+    pub mem_shared: HashMap<String, Value>,
+    /// Memory of the agents other than the current one, by name.
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    pub agents: BTreeMap<String, AgentMemory>,
+    #[serde(serialize_with = "intern::serialize_sorted")]
+    pub links: HashMap<String, String>,
+    /// Level of each [affect](crate::affect) drive.
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    pub state: BTreeMap<String, f64>,
+}
+
+/// Short- and long-term memory of one agent, kept aside while another one
+/// runs; see [`agents`](crate::agents).
+#[derive(Clone, Debug, Default, Serialize, Deserialize)]
+#[serde(default)]
+pub struct AgentMemory {
+    pub mem_short: Region,
+    pub mem_long: Region,
+}
+
+impl PartialEq for AgentMemory {
+    fn eq(&self, other: &Self) -> bool {
+        *self.mem_short == *other.mem_short && *self.mem_long == *other.mem_long
+    }
+}
+
+/// Memory as it was at one moment, taken by [`AgentContext::freeze`]
+/// without copying it. Later writes to the context copy the region they
+/// change, so a save from a frozen view never mixes old and new entries and
+/// the context does not have to stay locked while the file is written.
+#[derive(Clone, Debug, Serialize)]
+pub struct Frozen {
+    mem_short: Region,
+    mem_long: Region,
+    #[serde(skip_serializing_if = "Region::is_empty")]
+    mem_shared: Region,
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    agents: BTreeMap<String, AgentMemory>,
+    #[serde(serialize_with = "intern::serialize_sorted")]
+    links: HashMap<String, String>,
+    state: BTreeMap<String, f64>,
+}
+
+impl Frozen {
+    /// Write the memory as one JSON document; see [`AgentContext::save`].
+    pub fn save(&self, path: &str) -> Result<(), MemoryError> {
+        let _span = tracing::debug_span!("memory.save", path).entered();
+        let serialized = serde_json::to_string_pretty(self)?;
+        fs::write(path, serialized)?;
+        Ok(())
+    }
+
+    /// Write the memory in the indexed format (see [`paged`]).
+    pub fn save_indexed(&self, path: &str) -> Result<(), MemoryError> {
+        let _span = tracing::debug_span!("memory.save", path, indexed = true).entered();
+        paged::write(
+            path,
+            &self.mem_short,
+            &self.mem_long,
+            &self.mem_shared,
+            &self.agents,
+            &self.links,
+            &self.state,
+        )
+    }
+}
+
+#[derive(Clone, Debug, Serialize, Deserialize)]
 pub struct AgentContext {
-    pub mem_short: HashMap<String, String>,
-    pub mem_long: HashMap<String, String>,
+    pub mem_short: Region,
+    /// Long-term memory; may still be on disk after loading an indexed save.
+    pub mem_long: Region,
+    /// `mem.shared`, which every agent reads and writes.
+    #[serde(default, skip_serializing_if = "Region::is_empty")]
+    pub mem_shared: Region,
+    /// Memory of the declared agents other than the running one, by name.
+    /// `mem_short` and `mem_long` are always the running agent's.
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub memories: BTreeMap<String, AgentMemory>,
+    #[serde(serialize_with = "intern::serialize_sorted")]
     pub links: HashMap<String, String>,
 
     #[serde(skip)]
     pub current_agent: Option<crate::types::Statement>,
 
+    /// Every agent declared, by name; see [`agents`](crate::agents).
+    #[serde(skip)]
+    pub agents: BTreeMap<String, crate::types::Statement>,
+
     #[serde(skip)]
     pub output: Option<String>,
+
+    /// Values `emit` gave as the agent's responses, until taken with
+    /// [`take_responses`](Self::take_responses).
+    #[serde(skip)]
+    pub responses: Vec<String>,
+
+    /// Providers used by `ask` statements.
+    #[serde(skip)]
+    pub llm: LlmRegistry,
+
+    /// Turns text into vectors for `embed` and `similarity`.
+    #[serde(skip, default = "embedding::fallback")]
+    pub embedder: Arc<dyn Embedder>,
+
+    /// Vectors of memory entries, searched by `recall`.
+    #[serde(skip)]
+    pub latent: MemoryIndex,
+
+    /// Where long-term memory is written through to; clones start without
+    /// one. See [`attach_store`](Self::attach_store).
+    #[serde(skip)]
+    pub store: Attached,
+
+    /// Limits on `fetch` and other statements with outside effects.
+    #[serde(skip)]
+    pub sandbox: Sandbox,
+
+    /// Caps on memory and queued events, checked by
+    /// [`try_set_mem`](Self::try_set_mem), and on time.
+    #[serde(skip)]
+    pub limits: Limits,
+
+    /// When the running handler has to finish by; set for each turn from
+    /// [`Limits::turn_timeout`].
+    #[serde(skip)]
+    pub deadline: Option<Instant>,
+
+    /// Events queued since they were last taken; `None` when nobody is
+    /// listening, so nothing is recorded.
+    #[serde(skip)]
+    pub events: Option<Vec<AgentEvent>>,
+
+    /// Stops evaluation at breakpoints and steps; see [`Debugger`].
+    #[serde(skip)]
+    pub debugger: Option<Arc<Debugger>>,
+
+    /// Statements run so far; `None` unless coverage is being recorded.
+    #[serde(skip)]
+    pub coverage: Option<Coverage>,
+
+    /// Recent memory writes; `None` unless they are being kept. See
+    /// [`memory_at`](Self::memory_at).
+    #[serde(skip)]
+    pub history: Option<History>,
+
+    /// Goal progress of each handler run this session; `None` unless it is
+    /// being logged. See [`goals::report`](crate::goals::report).
+    #[serde(skip)]
+    pub goals: Option<GoalLog>,
+
+    /// Drives such as curiosity, moved by events and saved with memory.
+    #[serde(rename = "state", default)]
+    pub affect: Affect,
+
+    /// How short-term memory has been used, for `attention top <n>`.
+    #[serde(skip)]
+    pub attention: Attention,
+
+    /// Changes `evolve` blocks proposed to the agent, waiting for
+    /// [`evolve::commit`](crate::evolve::commit).
+    #[serde(skip)]
+    pub proposals: Vec<Mutation>,
+
+    /// The last `train from` pass this session, so the next can report
+    /// whether the loss went down.
+    #[serde(skip)]
+    pub training: Option<training::Report>,
+
+    /// Which kind of handler acted last and the rewards each kind got.
+    #[serde(skip)]
+    pub rewards: Rewards,
+
+    /// Templates declared outside the current agent, by name.
+    #[serde(skip)]
+    pub templates: HashMap<String, String>,
+
+    /// The session's turns, while one is kept; see
+    /// [`transcript`](crate::transcript).
+    #[serde(skip)]
+    pub transcript: Option<Transcript>,
+
+    /// Where `import` finds modules fetched with `get`.
+    #[serde(skip)]
+    pub packages: Packages,
+
+    /// Version of the language statements run as, set by `lang`.
+    #[serde(skip)]
+    pub lang: Version,
+
+    /// Variables bound with `let`, by scope.
+    #[serde(skip)]
+    pub variables: Variables,
+
+    /// Functions declared with `fn` outside an agent, by name.
+    #[serde(skip)]
+    pub functions: HashMap<String, crate::types::Statement>,
+
+    /// The value a `return` gave, until the call it ends picks it up.
+    #[serde(skip)]
+    pub returning: Option<Value>,
 }
 
 impl AgentContext {
     pub fn new() -> Self {
         AgentContext {
-            mem_short: HashMap::new(),
-            mem_long: HashMap::new(),
+            mem_short: Region::default(),
+            mem_long: Region::default(),
+            mem_shared: Region::default(),
+            memories: BTreeMap::new(),
             links: HashMap::new(),
             current_agent: None,
+            agents: BTreeMap::new(),
             output: None,
+            responses: Vec::new(),
+            llm: LlmRegistry::default(),
+            embedder: embedding::fallback(),
+            latent: MemoryIndex::default(),
+            store: Attached::default(),
+            sandbox: Sandbox::default(),
+            limits: Limits::default(),
+            deadline: None,
+            events: None,
+            debugger: None,
+            coverage: None,
+            history: None,
+            goals: None,
+            affect: Affect::default(),
+            attention: Attention::default(),
+            proposals: Vec::new(),
+            training: None,
+            rewards: Rewards::default(),
+            templates: HashMap::new(),
+            transcript: None,
+            packages: Packages::default(),
+            lang: lang::default_version(),
+            variables: Variables::default(),
+            functions: HashMap::new(),
+            returning: None,
+        }
+    }
+
+    /// When a statement starting now has to finish by: the earlier of the
+    /// turn's deadline and the end of [`Limits::statement_timeout`].
+    pub fn statement_deadline(&self) -> Option<Instant> {
+        let statement = self
+            .limits
+            .statement_timeout
+            .map(|timeout| Instant::now() + timeout);
+        match (statement, self.deadline) {
+            (Some(a), Some(b)) => Some(a.min(b)),
+            (a, b) => a.or(b),
         }
     }
 
     pub fn set_mem(&mut self, target: &str, key: &str, value: &str) {
-        match target {
+        self.set_value(target, key, Value::Text(value.to_string()));
+    }
+
+    /// Write `value` to `key` of the `short`, `long` or `shared` region,
+    /// keeping its kind: a number written here reads back as a number.
+    pub fn set_value(&mut self, target: &str, key: &str, value: Value) {
+        let region = match target {
             "short" => {
-                self.mem_short.insert(key.to_string(), value.to_string());
+                self.attention.touch(key);
+                &mut *self.mem_short
+            }
+            "long" => &mut *self.mem_long,
+            "shared" => &mut *self.mem_shared,
+            _ => return,
+        };
+        let _span = tracing::trace_span!("memory.write", region = target, key).entered();
+        let mut old = None;
+        let unchanged = match region.get_mut(key) {
+            Some(existing) if *existing == value => true,
+            Some(existing) => {
+                if self.history.is_some() {
+                    old = Some(existing.to_string());
+                }
+                *existing = value.clone();
+                false
+            }
+            None => {
+                region.insert(intern::intern(key), value.clone());
+                false
+            }
+        };
+        if unchanged {
+            return;
+        }
+        if target == "long" {
+            self.write_through(key, Some(&value));
+        }
+        let value = value.to_string();
+        if let Some(history) = &mut self.history {
+            history.record(target, key, old, &value);
+        }
+        let achieved = key == GOAL_ACHIEVED_KEY && !value.is_empty();
+        self.affect.react("memory_changed", Some(key));
+        if achieved {
+            self.affect.react("goal_achieved", Some(key));
+        }
+        if self.events.is_none() && self.transcript.is_none() {
+            return;
+        }
+
+        // A full queue drops the event, not the write.
+        let _ = self.record(AgentEvent::MemoryChanged {
+            region: target.to_string(),
+            key: key.to_string(),
+            value: value.clone(),
+        });
+        if achieved {
+            let goal = crate::introspect::describe(self)
+                .and_then(|info| info.goals.into_iter().next())
+                .unwrap_or_default();
+            let _ = self.record(AgentEvent::GoalAchieved { goal, value });
+        }
+    }
+
+    /// Delete `key` from the `short` or `long` region, returning its value.
+    /// History keeps the deletion as a write of the empty string, which is
+    /// what [`get_mem`](Self::get_mem) now returns, and listeners see it the
+    /// same way.
+    pub fn remove_mem(&mut self, target: &str, key: &str) -> Option<String> {
+        let region = match target {
+            "short" => {
+                self.attention.forget(key);
+                &mut *self.mem_short
+            }
+            "long" => &mut *self.mem_long,
+            "shared" => &mut *self.mem_shared,
+            _ => return None,
+        };
+        let value = region.remove(key)?.to_string();
+        if let Some(history) = &mut self.history {
+            history.record(target, key, Some(value.clone()), "");
+        }
+        if target == "long" {
+            self.write_through(key, None);
+        }
+        let _ = self.record(AgentEvent::MemoryChanged {
+            region: target.to_string(),
+            key: key.to_string(),
+            value: String::new(),
+        });
+        Some(value)
+    }
+
+    /// Fill long-term memory from `store`, over entries already there, and
+    /// write every later change to it.
+    pub fn attach_store(&mut self, store: Arc<dyn MemoryStore>) -> Result<(), MemoryError> {
+        for (key, value) in store.load()? {
+            self.mem_long.insert(intern::intern(&key), value);
+        }
+        store.replace(&intern::values(&self.mem_long))?;
+        *self.store = Some(store);
+        Ok(())
+    }
+
+    /// Store the write (or, for `None`, deletion) of long-term `key`. A
+    /// failed write is logged rather than failing the statement: memory
+    /// still holds the value and the next full replace stores it.
+    fn write_through(&self, key: &str, value: Option<&Value>) {
+        let Some(store) = &*self.store else {
+            return;
+        };
+        let stored = match value {
+            Some(value) => store.put(key, value),
+            None => store.delete(key),
+        };
+        if let Err(e) = stored {
+            tracing::warn!(key, error = %e, "cannot write long-term memory to the store");
+        }
+    }
+
+    /// Make the store, if any, hold exactly the long-term memory.
+    fn replace_stored(&self) {
+        if let Some(store) = &*self.store {
+            if let Err(e) = store.replace(&intern::values(&self.mem_long)) {
+                tracing::warn!(error = %e, "cannot write long-term memory to the store");
             }
-            "long" => {
-                self.mem_long.insert(key.to_string(), value.to_string());
+        }
+    }
+
+    /// Note `event` in the transcript, if one is kept, and queue it if
+    /// events are being recorded. When the queue is at
+    /// [`Limits::max_events`] the event is dropped instead, and the error
+    /// says so; what caused the event, such as a memory write, still
+    /// happened.
+    pub fn record(&mut self, event: AgentEvent) -> Result<(), LimitError> {
+        if let Some(transcript) = &mut self.transcript {
+            transcript.note(&event);
+        }
+        if let Some(events) = &mut self.events {
+            if let Some(limit) = self
+                .limits
+                .max_events
+                .filter(|&limit| events.len() >= limit)
+            {
+                tracing::warn!(event = event.name(), "event queue is full; dropping event");
+                return Err(LimitError::Events { limit });
             }
-            _ => {}
+            events.push(event);
         }
+        Ok(())
+    }
+
+    /// Remove and return the queued events.
+    pub fn take_events(&mut self) -> Vec<AgentEvent> {
+        self.events.as_mut().map(std::mem::take).unwrap_or_default()
     }
 
+    /// Remove and return the responses emitted so far.
+    pub fn take_responses(&mut self) -> Vec<String> {
+        std::mem::take(&mut self.responses)
+    }
+
+    /// The value of `key` as text, empty if it was never written.
     pub fn get_mem(&self, target: &str, key: &str) -> String {
+        self.get_value(target, key)
+            .map(|value| value.to_string())
+            .unwrap_or_default()
+    }
+
+    /// The value of `key`, of whatever kind it was written as.
+    pub fn get_value(&self, target: &str, key: &str) -> Option<Value> {
+        self.region(target).and_then(|region| region.lookup(key))
+    }
+
+    /// The `short`, `long` or `shared` region.
+    fn region(&self, target: &str) -> Option<&Region> {
         match target {
-            "short" => self.mem_short.get(key).cloned().unwrap_or_default(),
-            "long" => self.mem_long.get(key).cloned().unwrap_or_default(),
-            _ => String::new(),
+            "short" => Some(&self.mem_short),
+            "long" => Some(&self.mem_long),
+            "shared" => Some(&self.mem_shared),
+            _ => None,
         }
     }
 
-    #[allow(dead_code)]
-    pub fn save(&self, path: &str) -> io::Result<()> {
-        let serialized = serde_json::to_string_pretty(self)?;
-        fs::write(path, serialized)?;
+    /// Like [`set_mem`](Self::set_mem) but reports unknown regions and
+    /// writes that would go over the [`limits`](Self::limits).
+    pub fn try_set_mem(&mut self, target: &str, key: &str, value: &str) -> Result<(), MemoryError> {
+        self.try_set_value(target, key, Value::Text(value.to_string()))
+    }
+
+    /// Like [`set_value`](Self::set_value) but reports unknown regions and
+    /// writes that would go over the [`limits`](Self::limits).
+    pub fn try_set_value(
+        &mut self,
+        target: &str,
+        key: &str,
+        value: Value,
+    ) -> Result<(), MemoryError> {
+        match target {
+            "short" | "long" | "shared" => {
+                self.check_limits(target, key, &value)?;
+                self.set_value(target, key, value);
+                Ok(())
+            }
+            _ => Err(MemoryError::UnknownRegion(target.to_string())),
+        }
+    }
+
+    fn check_limits(&self, target: &str, key: &str, value: &Value) -> Result<(), LimitError> {
+        if let Some(limit) = self.limits.max_value_bytes {
+            let size = value.size();
+            if size > limit {
+                return Err(LimitError::ValueSize {
+                    key: key.to_string(),
+                    size,
+                    limit,
+                });
+            }
+        }
+        if let Some(limit) = self.limits.max_entries {
+            let region = self.region(target).expect("checked by try_set_mem");
+            if region.len() >= limit && region.lookup(key).is_none() {
+                return Err(LimitError::Entries {
+                    region: target.to_string(),
+                    limit,
+                });
+            }
+        }
         Ok(())
     }
 
+    /// Like [`get_mem`](Self::get_mem) but reports unknown regions.
+    pub fn try_get_mem(&self, target: &str, key: &str) -> Result<String, MemoryError> {
+        self.try_get_value(target, key)
+            .map(|value| value.to_string())
+    }
+
+    /// Like [`get_value`](Self::get_value) but reports unknown regions,
+    /// and gives empty text for a key never written.
+    pub fn try_get_value(&self, target: &str, key: &str) -> Result<Value, MemoryError> {
+        match self.region(target) {
+            Some(region) => Ok(region.lookup(key).unwrap_or_else(|| Value::from(""))),
+            None => Err(MemoryError::UnknownRegion(target.to_string())),
+        }
+    }
+
+    /// The entries of the `short`, `long` or `shared` region, sorted by key.
+    pub fn entries(&self, target: &str) -> Result<Vec<(String, Value)>, MemoryError> {
+        let region = self
+            .region(target)
+            .ok_or_else(|| MemoryError::UnknownRegion(target.to_string()))?;
+        let mut entries: Vec<_> = region
+            .iter()
+            .map(|(key, value)| (key.to_string(), value.clone()))
+            .collect();
+        entries.sort_by(|a, b| a.0.cmp(&b.0));
+        Ok(entries)
+    }
+
+    /// Up to `limit` entries whose key or value contains `query`, ignoring
+    /// case, diacritics and script (see [`text::fold`]), short-term first
+    /// and sorted by key. `region` restricts the search to one region.
+    pub fn recall(
+        &self,
+        query: &str,
+        region: Option<&str>,
+        limit: usize,
+    ) -> Result<Vec<MemoryMatch>, MemoryError> {
+        let regions: &[&str] = match region {
+            Some("short") => &["short"],
+            Some("long") => &["long"],
+            Some("shared") => &["shared"],
+            Some(other) => return Err(MemoryError::UnknownRegion(other.to_string())),
+            None => &["short", "long"],
+        };
+        let _span = tracing::debug_span!("memory.recall", query).entered();
+        let started = std::time::Instant::now();
+        let query = text::fold(query);
+
+        let mut matches = Vec::new();
+        for &region in regions {
+            let map = self.region(region).expect("a known region");
+            let mut entries: Vec<_> = map
+                .iter()
+                .map(|(k, v)| (k, v.to_string()))
+                .filter(|(k, v)| text::fold(k).contains(&query) || text::fold(v).contains(&query))
+                .collect();
+            entries.sort();
+            matches.extend(entries.into_iter().map(|(key, value)| MemoryMatch {
+                region: region.to_string(),
+                key: key.to_string(),
+                value,
+            }));
+        }
+        matches.truncate(limit);
+        crate::metrics::global()
+            .recall_duration
+            .observe(started.elapsed());
+        Ok(matches)
+    }
+
+    /// Replace all memory regions and links with those of `candidate`,
+    /// typically a clone that a what-if evaluation ran against.
+    pub fn commit(&mut self, candidate: AgentContext) {
+        self.mem_short = candidate.mem_short;
+        self.mem_long = candidate.mem_long;
+        self.links = candidate.links;
+        self.affect = candidate.affect;
+        self.attention = candidate.attention;
+        self.proposals = candidate.proposals;
+        self.training = candidate.training;
+        self.rewards = candidate.rewards;
+        self.templates = candidate.templates;
+        self.agents = candidate.agents;
+        self.mem_shared = candidate.mem_shared;
+        self.memories = candidate.memories;
+        self.lang = candidate.lang;
+        self.variables = candidate.variables;
+        self.functions = candidate.functions;
+        if self.history.is_some() {
+            self.history = candidate.history;
+        }
+        if self.transcript.is_some() {
+            self.transcript = candidate.transcript;
+        }
+        self.replace_stored();
+    }
+
+    pub fn snapshot(&self) -> Snapshot {
+        Snapshot {
+            mem_short: intern::values(&self.mem_short),
+            mem_long: intern::values(&self.mem_long),
+            mem_shared: intern::values(&self.mem_shared),
+            agents: self.memories.clone(),
+            links: self.links.clone(),
+            state: self.affect.levels().clone(),
+        }
+    }
+
+    /// Replace all memory with `snapshot`.
+    pub fn restore(&mut self, snapshot: Snapshot) {
+        self.mem_short = intern::memory(snapshot.mem_short).into();
+        self.mem_long = intern::memory(snapshot.mem_long).into();
+        self.mem_shared = intern::memory(snapshot.mem_shared).into();
+        self.memories = snapshot.agents;
+        self.links = snapshot.links;
+        self.affect.restore(snapshot.state);
+        if let Some(history) = &mut self.history {
+            history.reset();
+        }
+        self.replace_stored();
+    }
+
+    /// Entries of `region` as they were at `at` (Unix milliseconds), found
+    /// by undoing the writes [`history`](Self::history) kept since.
+    pub fn memory_at(
+        &self,
+        region: &str,
+        at: u64,
+    ) -> Result<BTreeMap<String, String>, MemoryError> {
+        let entries = self
+            .region(region)
+            .ok_or_else(|| MemoryError::UnknownRegion(region.to_string()))?;
+        let history = self
+            .history
+            .as_ref()
+            .ok_or_else(|| MemoryError::History("memory history is not being kept".to_string()))?;
+        if at < history.since() {
+            return Err(MemoryError::History(format!(
+                "memory history starts at {}",
+                history::format_time(history.since())
+            )));
+        }
+        let entries = intern::strings(entries).into_iter().collect();
+        Ok(history.undo(region, entries, at))
+    }
+
+    /// Entry counts and sizes of each memory region and the number of
+    /// links, without paging in regions still on disk.
+    pub fn stats(&self) -> Stats {
+        let region = |name: &str, region: &Region| RegionStats {
+            region: name.to_string(),
+            entries: region.len(),
+            bytes: region.bytes(),
+            loaded: region.is_loaded(),
+        };
+        let mut regions = vec![
+            region("short", &self.mem_short),
+            region("long", &self.mem_long),
+        ];
+        if !self.mem_shared.is_empty() {
+            regions.push(region("shared", &self.mem_shared));
+        }
+        Stats {
+            regions,
+            links: self.links.len(),
+        }
+    }
+
+    /// Memory and links as they are now, for saving while handlers go on
+    /// writing. Takes no copy of the entries; see [`Frozen`].
+    pub fn freeze(&self) -> Frozen {
+        Frozen {
+            mem_short: self.mem_short.clone(),
+            mem_long: self.mem_long.clone(),
+            mem_shared: self.mem_shared.clone(),
+            agents: self.memories.clone(),
+            links: self.links.clone(),
+            state: self.affect.levels().clone(),
+        }
+    }
+
     #[allow(dead_code)]
-    pub fn load(&mut self, path: &str) -> io::Result<()> {
+    pub fn save(&self, path: &str) -> Result<(), MemoryError> {
+        self.freeze().save(path)
+    }
+
+    /// Save in the indexed format (see [`paged`]), which [`load`](Self::load)
+    /// opens without reading long-term memory until it is used.
+    pub fn save_indexed(&self, path: &str) -> Result<(), MemoryError> {
+        self.freeze().save_indexed(path)
+    }
+
+    /// Replace all memory with that saved at `path` by [`save`](Self::save)
+    /// or [`save_indexed`](Self::save_indexed).
+    pub fn load(&mut self, path: &str) -> Result<(), MemoryError> {
+        let _span = tracing::debug_span!("memory.load", path).entered();
+        if paged::is_indexed(path)? {
+            let loaded = paged::open(path)?;
+            self.mem_short = intern::memory(loaded.mem_short).into();
+            self.mem_long = loaded.mem_long;
+            self.mem_shared = intern::memory(loaded.mem_shared).into();
+            self.memories = loaded.agents;
+            self.links = loaded.links;
+            self.affect.restore(loaded.state);
+            if let Some(history) = &mut self.history {
+                history.reset();
+            }
+            self.replace_stored();
+            return Ok(());
+        }
         let content = fs::read_to_string(path)?;
-        let loaded: AgentContext = serde_json::from_str(&content)?;
-        self.mem_short = loaded.mem_short;
-        self.mem_long = loaded.mem_long;
-        self.links = loaded.links;
+        let loaded: Snapshot = serde_json::from_str(&content)?;
+        self.restore(loaded);
         Ok(())
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn clone_is_independent_until_committed() {
+        let mut ctx = AgentContext::new();
+        ctx.set_mem("long", "fact", "old");
+        ctx.links.insert("a".to_string(), "b".to_string());
+
+        let mut what_if = ctx.clone();
+        what_if.set_mem("long", "fact", "new");
+        what_if.links.insert("b".to_string(), "c".to_string());
+        assert_eq!(ctx.get_mem("long", "fact"), "old");
+        assert_eq!(ctx.links.len(), 1);
+
+        ctx.commit(what_if);
+        assert_eq!(ctx.get_mem("long", "fact"), "new");
+        assert_eq!(ctx.links.len(), 2);
+    }
+
+    #[test]
+    fn records_changes_only_when_enabled() {
+        let mut ctx = AgentContext::new();
+        ctx.set_mem("long", "fact", "a");
+        assert!(ctx.take_events().is_empty());
+
+        ctx.events = Some(Vec::new());
+        ctx.set_mem("long", "fact", "a");
+        ctx.set_mem("long", "fact", "b");
+        ctx.set_mem("short", GOAL_ACHIEVED_KEY, "yes");
+        let names: Vec<_> = ctx.take_events().iter().map(AgentEvent::name).collect();
+        assert_eq!(names, ["memory_changed", "memory_changed", "goal_achieved"]);
+        assert!(ctx.take_events().is_empty());
+    }
+
+    #[test]
+    fn saves_keys_in_sorted_order() {
+        let mut ctx = AgentContext::new();
+        for key in ["pear", "apple", "fig", "banana"] {
+            ctx.set_mem("short", key, "1");
+            ctx.set_mem("long", key, "2");
+            ctx.links.insert(key.to_string(), "x".to_string());
+        }
+        let saved = serde_json::to_string(&ctx).unwrap();
+        let region = r#"{"apple":"N","banana":"N","fig":"N","pear":"N"}"#;
+        assert_eq!(
+            saved,
+            format!(
+                concat!(
+                    r#"{{"mem_short":{},"mem_long":{},"links":{},"#,
+                    r#""state":{{"confidence":0.5,"curiosity":0.5,"frustration":0.0}}}}"#
+                ),
+                region.replace('N', "1"),
+                region.replace('N', "2"),
+                region.replace('N', "x")
+            )
+        );
+        assert_eq!(serde_json::to_string(&ctx.snapshot()).unwrap(), saved);
+    }
+
+    #[test]
+    fn frozen_memory_keeps_its_entries() {
+        let mut ctx = AgentContext::new();
+        ctx.set_mem("short", "a", "1");
+        ctx.set_mem("long", "b", "2");
+        let frozen = ctx.freeze();
+        let saved = serde_json::to_string(&frozen).unwrap();
+
+        ctx.set_mem("short", "a", "changed");
+        ctx.set_mem("long", "c", "3");
+        ctx.links.insert("x".to_string(), "y".to_string());
+        assert_eq!(serde_json::to_string(&frozen).unwrap(), saved);
+        assert_eq!(
+            saved,
+            concat!(
+                r#"{"mem_short":{"a":"1"},"mem_long":{"b":"2"},"links":{},"#,
+                r#""state":{"confidence":0.5,"curiosity":0.5,"frustration":0.0}}"#
+            )
+        );
+        assert_eq!(ctx.get_mem("short", "a"), "changed");
+    }
+
+    #[test]
+    fn enforces_limits_on_writes() {
+        let mut ctx = AgentContext::new();
+        ctx.limits = Limits {
+            max_entries: Some(2),
+            max_value_bytes: Some(5),
+            max_events: Some(1),
+            ..Limits::default()
+        };
+        ctx.try_set_mem("short", "a", "1").unwrap();
+        ctx.try_set_mem("short", "b", "2").unwrap();
+        ctx.try_set_mem("short", "a", "3").unwrap();
+        ctx.try_set_mem("long", "c", "4").unwrap();
+        assert_eq!(
+            ctx.try_set_mem("short", "c", "5").unwrap_err().to_string(),
+            "memory region `short` is full (2 entries; see limits.max_entries)"
+        );
+        assert!(matches!(
+            ctx.try_set_mem("long", "d", "too long"),
+            Err(MemoryError::Limit(LimitError::ValueSize { size: 8, .. }))
+        ));
+    }
+
+    #[test]
+    fn drops_events_past_the_cap_without_failing_writes() {
+        let mut ctx = AgentContext::new();
+        ctx.limits.max_events = Some(1);
+        ctx.events = Some(Vec::new());
+        ctx.try_set_mem("long", "c", "x").unwrap();
+        ctx.try_set_mem("long", "c", "y").unwrap();
+        assert_eq!(ctx.get_mem("long", "c"), "y");
+        let reflected = AgentEvent::Reflected {
+            region: "long".to_string(),
+            key: "c".to_string(),
+            value: "y".to_string(),
+        };
+        assert_eq!(
+            ctx.record(reflected.clone()),
+            Err(LimitError::Events { limit: 1 })
+        );
+        assert_eq!(ctx.take_events().len(), 1);
+        assert_eq!(ctx.record(reflected), Ok(()));
+    }
+}
@@ -0,0 +1,173 @@
+//! Statement coverage. While an agent records coverage, every
+//! [`Statement::Location`] it evaluates counts a run of the statement on
+//! that line, so only programs parsed
+//! [with locations](crate::parser::Parser::with_locations) are covered.
+//!
+//! The report is the source with each line prefixed by how often its
+//! statement ran, `#####` for statements that never ran and `-` for lines
+//! without one:
+//!
+//! ```text
+//!      1 | agent Echo {
+//!      - |   on input(msg) {
+//!      2 |     print "done"
+//!  ##### |     print "never"
+//! ```
+
+use crate::types::{Program, Statement};
+use std::collections::{BTreeMap, BTreeSet};
+use std::fmt::Write;
+
+/// Runs of the statement on each line.
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+pub struct Coverage {
+    hits: BTreeMap<usize, u64>,
+}
+
+impl Coverage {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Count a run of the statement on `line`.
+    pub fn hit(&mut self, line: usize) {
+        *self.hits.entry(line).or_default() += 1;
+    }
+
+    /// How often the statement on `line` ran.
+    pub fn hits(&self, line: usize) -> u64 {
+        self.hits.get(&line).copied().unwrap_or(0)
+    }
+
+    /// `source`, from which `program` was parsed, annotated with the runs
+    /// of each statement and followed by a summary line.
+    pub fn annotate(&self, source: &str, program: &Program) -> String {
+        let statements = statements(program);
+        let mut out = String::new();
+        for (i, text) in source.lines().enumerate() {
+            let line = i + 1;
+            let count = match self.hits(line) {
+                _ if !statements.contains(&line) => "-".to_string(),
+                0 => "#####".to_string(),
+                hits => hits.to_string(),
+            };
+            let _ = writeln!(out, "{:>6} | {}", count, text);
+        }
+        let run = statements
+            .iter()
+            .filter(|&&line| self.hits(line) > 0)
+            .count();
+        let _ = writeln!(out, "{}", summary(run, statements.len()));
+        out
+    }
+}
+
+/// `run of total statements run (percent)`.
+pub fn summary(run: usize, total: usize) -> String {
+    let percent = if total == 0 {
+        100.0
+    } else {
+        run as f64 * 100.0 / total as f64
+    };
+    format!("{} of {} statements run ({:.1}%)", run, total, percent)
+}
+
+/// Lines of the statements in `program` that evaluating it can run. What an
+/// agent declares (`mem`, goals and handler headers) is only read when the
+/// agent is registered, so of an agent's body only its handlers' bodies
+/// count.
+pub fn statements(program: &Program) -> BTreeSet<usize> {
+    let mut lines = BTreeSet::new();
+    collect(&program.statements, &mut lines);
+    lines
+}
+
+fn collect(statements: &[Statement], lines: &mut BTreeSet<usize>) {
+    for statement in statements {
+        match statement {
+            Statement::Location { line, .. } => {
+                lines.insert(*line);
+            }
+            Statement::AgentDeclaration { body, .. } => {
+                for inner in body {
+                    match inner {
+                        Statement::OnInput { body, .. }
+                        | Statement::OnSchedule { body, .. }
+                        | Statement::OnStart { body }
+                        | Statement::OnStop { body }
+                        | Statement::OnOutput { body, .. }
+                        | Statement::Train { body, .. }
+                        | Statement::Evolve { body } => collect(body, lines),
+                        _ => {}
+                    }
+                }
+            }
+            Statement::OnInput { body, .. }
+            | Statement::Reflect { body }
+            | Statement::IfContextIncludes { body, .. }
+            | Statement::IfState { body, .. }
+            | Statement::Function { body, .. }
+            | Statement::While { body, .. }
+            | Statement::For { body, .. }
+            | Statement::If { body, .. }
+            | Statement::IfReward { body, .. } => collect(body, lines),
+            Statement::IfElse { branch, otherwise } => {
+                collect(std::slice::from_ref(branch), lines);
+                collect(otherwise, lines);
+            }
+            _ => {}
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use crate::lexer::Lexer;
+    use crate::parser::Parser;
+    use crate::SentienceAgent;
+
+    #[test]
+    fn counts_the_statements_that_ran() {
+        let source = concat!(
+            "agent Echo {\n",
+            "  mem short\n",
+            "  on input(msg) {\n",
+            "    if context includes [\"hi\"] {\n",
+            "      print \"hello\"\n",
+            "    }\n",
+            "    print \"done\"\n",
+            "  }\n",
+            "  train {\n",
+            "    print \"never\"\n",
+            "  }\n",
+            "}\n",
+        );
+        let mut lexer = Lexer::new(source);
+        let program = Parser::new(&mut lexer).with_locations().parse_program();
+        let mut agent = SentienceAgent::new();
+        agent.record_coverage();
+        agent.run_program(&program).unwrap();
+        agent.handle_input("bye").unwrap();
+        agent.handle_input("hi").unwrap();
+
+        let coverage = agent.coverage().unwrap();
+        assert_eq!(
+            coverage.annotate(source, &program),
+            concat!(
+                "     1 | agent Echo {\n",
+                "     - |   mem short\n",
+                "     - |   on input(msg) {\n",
+                "     2 |     if context includes [\"hi\"] {\n",
+                "     1 |       print \"hello\"\n",
+                "     - |     }\n",
+                "     2 |     print \"done\"\n",
+                "     - |   }\n",
+                "     - |   train {\n",
+                " ##### |     print \"never\"\n",
+                "     - |   }\n",
+                "     - | }\n",
+                "4 of 5 statements run (80.0%)\n",
+            )
+        );
+    }
+}
@@ -0,0 +1,535 @@
+//! Debug Adapter Protocol server, so editors such as VS Code can debug
+//! `.sent` files: breakpoints on statement lines, stepping, and memory
+//! regions shown as variables.
+//!
+//! A launch names the program and the inputs to send its `on input`
+//! handler once it has registered. There is one thread, the agent, and one
+//! stack frame, the statement it is stopped at.
+
+use crate::debugger::{Debugger, Resume, Stop};
+use crate::lexer::Lexer;
+use crate::parser::Parser;
+use crate::types::{Program, Statement};
+use crate::SentienceAgent;
+use serde_json::{json, Value};
+use std::collections::BTreeSet;
+use std::io::{self, BufRead, Write};
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+use std::thread;
+
+const THREAD_ID: i64 = 1;
+const SHORT_REF: i64 = 1;
+const LONG_REF: i64 = 2;
+const LINKS_REF: i64 = 3;
+
+/// Configures the agent before the program runs, e.g. with LLM providers.
+pub type Setup = Box<dyn FnOnce(&mut SentienceAgent) + Send>;
+
+/// Serve one debug session over `reader` and `writer` (stdin and stdout when
+/// the editor starts the adapter) until the client disconnects.
+pub fn serve(
+    mut reader: impl BufRead,
+    writer: impl Write + Send + 'static,
+    setup: Setup,
+) -> io::Result<()> {
+    let mut session = Session {
+        client: Client(Arc::new(Mutex::new((Box::new(writer), 0)))),
+        setup: Some(setup),
+        launch: None,
+        debugger: None,
+        breakpoints: Vec::new(),
+    };
+    while let Some(request) = read_message(&mut reader)? {
+        if !session.handle(&request) {
+            break;
+        }
+    }
+    Ok(())
+}
+
+/// Sends numbered messages to the editor; shared with the agent thread.
+#[derive(Clone)]
+struct Client(Arc<Mutex<(Box<dyn Write + Send>, i64)>>);
+
+impl Client {
+    fn send(&self, mut message: Value) {
+        let Ok(mut guard) = self.0.lock() else {
+            return;
+        };
+        let (writer, seq) = &mut *guard;
+        *seq += 1;
+        message["seq"] = (*seq).into();
+        let body = message.to_string();
+        let _ = write!(writer, "Content-Length: {}\r\n\r\n{}", body.len(), body);
+        let _ = writer.flush();
+    }
+
+    fn event(&self, event: &str, body: Value) {
+        self.send(json!({ "type": "event", "event": event, "body": body }));
+    }
+
+    fn respond(&self, request: &Value, result: Result<Value, String>) {
+        let mut response = json!({
+            "type": "response",
+            "request_seq": request["seq"],
+            "command": request["command"],
+            "success": result.is_ok(),
+        });
+        match result {
+            Ok(body) => response["body"] = body,
+            Err(message) => response["message"] = message.into(),
+        }
+        self.send(response);
+    }
+
+    fn output(&self, category: &str, text: &str) {
+        if !text.is_empty() {
+            self.event(
+                "output",
+                json!({ "category": category, "output": format!("{}\n", text) }),
+            );
+        }
+    }
+}
+
+/// What `launch` asked for.
+struct Launch {
+    path: PathBuf,
+    source: String,
+    program: Option<Program>,
+    /// Lines that start a statement, where breakpoints can stop.
+    lines: BTreeSet<usize>,
+    inputs: Vec<String>,
+}
+
+struct Session {
+    client: Client,
+    setup: Option<Setup>,
+    launch: Option<Launch>,
+    debugger: Option<Arc<Debugger>>,
+    /// Breakpoints set before `launch`.
+    breakpoints: Vec<usize>,
+}
+
+impl Session {
+    /// Answer `request`; returns false once the session is over.
+    fn handle(&mut self, request: &Value) -> bool {
+        let command = request["command"].as_str().unwrap_or_default();
+        let args = &request["arguments"];
+        let result = match command {
+            "initialize" => {
+                self.client.respond(
+                    request,
+                    Ok(json!({
+                        "supportsConfigurationDoneRequest": true,
+                        "supportsTerminateRequest": true,
+                        "supportsEvaluateForHovers": true,
+                    })),
+                );
+                self.client.event("initialized", json!({}));
+                return true;
+            }
+            "launch" => self.launch(args),
+            "setBreakpoints" => Ok(self.set_breakpoints(args)),
+            "configurationDone" => self.start(),
+            "threads" => Ok(json!({ "threads": [{ "id": THREAD_ID, "name": "agent" }] })),
+            "stackTrace" => Ok(self.stack_trace()),
+            "scopes" => Ok(json!({ "scopes": [
+                { "name": "mem.short", "variablesReference": SHORT_REF, "expensive": false },
+                { "name": "mem.long", "variablesReference": LONG_REF, "expensive": false },
+                { "name": "links", "variablesReference": LINKS_REF, "expensive": false },
+            ] })),
+            "variables" => Ok(self.variables(args["variablesReference"].as_i64().unwrap_or(0))),
+            "evaluate" => self.evaluate(args["expression"].as_str().unwrap_or_default()),
+            "continue" | "next" | "stepIn" | "stepOut" => {
+                let how = match command {
+                    "next" => Resume::Next,
+                    "stepIn" => Resume::StepIn,
+                    "stepOut" => Resume::StepOut,
+                    _ => Resume::Continue,
+                };
+                if let Some(debugger) = &self.debugger {
+                    debugger.resume(how);
+                }
+                Ok(json!({ "allThreadsContinued": true }))
+            }
+            "pause" => {
+                if let Some(debugger) = &self.debugger {
+                    debugger.pause();
+                }
+                Ok(json!({}))
+            }
+            "disconnect" | "terminate" => {
+                if let Some(debugger) = &self.debugger {
+                    debugger.detach();
+                }
+                self.client.respond(request, Ok(json!({})));
+                return command != "disconnect";
+            }
+            other => Err(format!("unsupported request `{}`", other)),
+        };
+        self.client.respond(request, result);
+        true
+    }
+
+    fn launch(&mut self, args: &Value) -> Result<Value, String> {
+        let path = PathBuf::from(args["program"].as_str().ok_or("`program` is required")?);
+        if path.extension().is_some_and(|ext| ext == "sentc") {
+            return Err("compiled programs have no line numbers; launch the .sent file".into());
+        }
+        let source =
+            std::fs::read_to_string(&path).map_err(|e| format!("{}: {}", path.display(), e))?;
+        let mut lexer = Lexer::new(&source);
+        let program = Parser::new(&mut lexer).with_locations().parse_program();
+        let mut lines = BTreeSet::new();
+        collect_lines(&program.statements, &mut lines);
+        let inputs = match &args["input"] {
+            Value::String(text) => vec![text.clone()],
+            Value::Array(items) => items
+                .iter()
+                .filter_map(|item| item.as_str().map(str::to_string))
+                .collect(),
+            _ => Vec::new(),
+        };
+
+        let client = self.client.clone();
+        let debugger = Arc::new(Debugger::new(
+            args["stopOnEntry"] == true,
+            move |stop: &Stop| {
+                client.event(
+                    "stopped",
+                    json!({ "reason": stop.reason, "threadId": THREAD_ID, "allThreadsStopped": true }),
+                );
+            },
+        ));
+        debugger.set_breakpoints(self.breakpoints.drain(..));
+        self.debugger = Some(debugger);
+        self.launch = Some(Launch {
+            path,
+            source,
+            program: Some(program),
+            lines,
+            inputs,
+        });
+        Ok(json!({}))
+    }
+
+    fn set_breakpoints(&mut self, args: &Value) -> Value {
+        let requested: Vec<usize> = args["breakpoints"]
+            .as_array()
+            .map(|items| {
+                items
+                    .iter()
+                    .filter_map(|b| b["line"].as_u64().map(|l| l as usize))
+                    .collect()
+            })
+            .unwrap_or_default();
+        let source = args["source"]["path"].as_str().map(Path::new);
+        let (ours, lines) = match &self.launch {
+            Some(launch) => (
+                source.map_or(true, |s| same_file(s, &launch.path)),
+                Some(&launch.lines),
+            ),
+            None => (true, None),
+        };
+        let verified: Vec<usize> = requested
+            .iter()
+            .copied()
+            .filter(|line| ours && lines.map_or(true, |lines| lines.contains(line)))
+            .collect();
+        match &self.debugger {
+            Some(debugger) if ours => debugger.set_breakpoints(verified.iter().copied()),
+            Some(_) => {}
+            None => self.breakpoints = verified.clone(),
+        }
+        let breakpoints: Vec<Value> = requested
+            .iter()
+            .map(|line| json!({ "verified": verified.contains(line), "line": line }))
+            .collect();
+        json!({ "breakpoints": breakpoints })
+    }
+
+    /// Run the program, then each input, on the agent thread.
+    fn start(&mut self) -> Result<Value, String> {
+        let (Some(launch), Some(debugger)) = (self.launch.as_mut(), self.debugger.clone()) else {
+            return Err("launch first".to_string());
+        };
+        let program = launch.program.take().ok_or("already started")?;
+        let inputs = launch.inputs.clone();
+        let setup = self.setup.take();
+        let client = self.client.clone();
+        thread::spawn(move || {
+            let mut agent = SentienceAgent::new();
+            if let Some(setup) = setup {
+                setup(&mut agent);
+            }
+            agent.set_debugger(Arc::clone(&debugger));
+            let mut exit_code = 0;
+            match agent.run_program(&program) {
+                Ok(output) => client.output("stdout", &output),
+                Err(e) => {
+                    client.output("stderr", &format!("error[{}]: {}", e.code(), e));
+                    exit_code = 1;
+                }
+            }
+            for input in inputs {
+                debugger.begin_run();
+                match agent.handle_input(&input) {
+                    Ok(output) => client.output("stdout", &output),
+                    Err(e) => {
+                        client.output("stderr", &format!("error[{}]: {}", e.code(), e));
+                        exit_code = 1;
+                    }
+                }
+            }
+            client.event("exited", json!({ "exitCode": exit_code }));
+            client.event("terminated", json!({}));
+        });
+        Ok(json!({}))
+    }
+
+    fn stack_trace(&self) -> Value {
+        let (Some(launch), Some(stop)) = (
+            &self.launch,
+            self.debugger.as_ref().and_then(|d| d.stopped()),
+        ) else {
+            return json!({ "stackFrames": [], "totalFrames": 0 });
+        };
+        let name = launch
+            .source
+            .lines()
+            .nth(stop.line.saturating_sub(1))
+            .unwrap_or_default()
+            .trim();
+        json!({
+            "stackFrames": [{
+                "id": 1,
+                "name": name,
+                "line": stop.line,
+                "column": 1,
+                "source": {
+                    "name": launch.path.file_name().map(|n| n.to_string_lossy()),
+                    "path": launch.path.to_string_lossy(),
+                },
+            }],
+            "totalFrames": 1,
+        })
+    }
+
+    fn variables(&self, reference: i64) -> Value {
+        let stop = self.debugger.as_ref().and_then(|d| d.stopped());
+        let entries = match (&stop, reference) {
+            (Some(stop), SHORT_REF) => &stop.short,
+            (Some(stop), LONG_REF) => &stop.long,
+            (Some(stop), LINKS_REF) => &stop.links,
+            _ => return json!({ "variables": [] }),
+        };
+        let variables: Vec<Value> = entries
+            .iter()
+            .map(|(name, value)| json!({ "name": name, "value": value, "variablesReference": 0 }))
+            .collect();
+        json!({ "variables": variables })
+    }
+
+    /// Look up `mem.<region>["<key>"]`, or a bare key in short-term then
+    /// long-term memory.
+    fn evaluate(&self, expression: &str) -> Result<Value, String> {
+        let stop = self
+            .debugger
+            .as_ref()
+            .and_then(|d| d.stopped())
+            .ok_or("not stopped")?;
+        let expression = expression.trim();
+        let find = |entries: &[(String, String)], key: &str| {
+            entries
+                .iter()
+                .find(|(name, _)| name == key)
+                .map(|(_, value)| value.clone())
+        };
+        let value = match expression
+            .strip_prefix("mem.")
+            .and_then(|rest| rest.split_once('['))
+        {
+            Some((region, key)) => {
+                let key = key.trim_end_matches(']').trim().trim_matches('"');
+                match region.trim() {
+                    "short" => find(&stop.short, key),
+                    "long" => find(&stop.long, key),
+                    other => return Err(format!("unknown memory region `{}`", other)),
+                }
+            }
+            None => find(&stop.short, expression).or_else(|| find(&stop.long, expression)),
+        };
+        let value = value.ok_or_else(|| format!("`{}` is not in memory", expression))?;
+        Ok(json!({ "result": value, "variablesReference": 0 }))
+    }
+}
+
+fn collect_lines(statements: &[Statement], lines: &mut BTreeSet<usize>) {
+    for statement in statements {
+        match statement {
+            Statement::Location { line, .. } => {
+                lines.insert(*line);
+            }
+            Statement::AgentDeclaration { body, .. }
+            | Statement::OnInput { body, .. }
+            | Statement::OnSchedule { body, .. }
+            | Statement::OnStart { body }
+            | Statement::OnStop { body }
+            | Statement::OnOutput { body, .. }
+            | Statement::Reflect { body }
+            | Statement::Train { body, .. }
+            | Statement::Evolve { body }
+            | Statement::IfContextIncludes { body, .. }
+            | Statement::IfState { body, .. }
+            | Statement::Function { body, .. }
+            | Statement::While { body, .. }
+            | Statement::For { body, .. }
+            | Statement::If { body, .. }
+            | Statement::IfReward { body, .. } => collect_lines(body, lines),
+            Statement::IfElse { branch, otherwise } => {
+                collect_lines(std::slice::from_ref(branch), lines);
+                collect_lines(otherwise, lines);
+            }
+            _ => {}
+        }
+    }
+}
+
+fn same_file(a: &Path, b: &Path) -> bool {
+    match (a.canonicalize(), b.canonicalize()) {
+        (Ok(a), Ok(b)) => a == b,
+        _ => a == b,
+    }
+}
+
+/// Read one `Content-Length` framed message; `None` at end of input.
+fn read_message(reader: &mut impl BufRead) -> io::Result<Option<Value>> {
+    let mut length = None;
+    loop {
+        let mut line = String::new();
+        if reader.read_line(&mut line)? == 0 {
+            return Ok(None);
+        }
+        let line = line.trim();
+        if line.is_empty() {
+            if length.is_some() {
+                break;
+            }
+            continue;
+        }
+        if let Some((name, value)) = line.split_once(':') {
+            if name.trim().eq_ignore_ascii_case("content-length") {
+                length = value.trim().parse::<usize>().ok();
+            }
+        }
+    }
+    let mut body = vec![0; length.unwrap_or(0)];
+    reader.read_exact(&mut body)?;
+    serde_json::from_slice(&body)
+        .map(Some)
+        .map_err(|e| io::Error::new(io::ErrorKind::InvalidData, e))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::io::BufReader;
+    use std::net::{TcpListener, TcpStream};
+
+    fn request(stream: &mut TcpStream, seq: i64, command: &str, arguments: Value) {
+        let body =
+            json!({ "seq": seq, "type": "request", "command": command, "arguments": arguments })
+                .to_string();
+        write!(stream, "Content-Length: {}\r\n\r\n{}", body.len(), body).unwrap();
+    }
+
+    /// Read messages until one satisfies `matches`.
+    fn wait_for(reader: &mut impl BufRead, matches: impl Fn(&Value) -> bool) -> Value {
+        loop {
+            let message = read_message(reader).unwrap().expect("adapter hung up");
+            if matches(&message) {
+                return message;
+            }
+        }
+    }
+
+    #[test]
+    fn stops_at_breakpoints_and_shows_memory() {
+        let path = std::env::temp_dir().join(format!("dap-test-{}.sent", std::process::id()));
+        std::fs::write(
+            &path,
+            "agent Echo {\n  on input(msg) {\n    print \"one\"\n    print \"two\"\n  }\n}\n",
+        )
+        .unwrap();
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let mut client = TcpStream::connect(listener.local_addr().unwrap()).unwrap();
+        let (stream, _) = listener.accept().unwrap();
+        let writer = stream.try_clone().unwrap();
+        let server = thread::spawn(move || serve(BufReader::new(stream), writer, Box::new(|_| {})));
+        let mut reader = BufReader::new(client.try_clone().unwrap());
+        let response = |command: &'static str| move |m: &Value| m["command"] == command;
+
+        request(
+            &mut client,
+            1,
+            "initialize",
+            json!({ "adapterID": "sentience" }),
+        );
+        wait_for(&mut reader, |m| m["event"] == "initialized");
+        request(
+            &mut client,
+            2,
+            "launch",
+            json!({ "program": path, "input": ["hello"] }),
+        );
+        wait_for(&mut reader, response("launch"));
+        request(
+            &mut client,
+            3,
+            "setBreakpoints",
+            json!({ "source": { "path": path }, "breakpoints": [{ "line": 4 }, { "line": 5 }] }),
+        );
+        let set = wait_for(&mut reader, response("setBreakpoints"));
+        assert_eq!(set["body"]["breakpoints"][0]["verified"], true);
+        assert_eq!(set["body"]["breakpoints"][1]["verified"], false);
+        request(&mut client, 4, "configurationDone", json!({}));
+
+        let stopped = wait_for(&mut reader, |m| m["event"] == "stopped");
+        assert_eq!(stopped["body"]["reason"], "breakpoint");
+        request(&mut client, 5, "stackTrace", json!({ "threadId": 1 }));
+        let trace = wait_for(&mut reader, response("stackTrace"));
+        assert_eq!(trace["body"]["stackFrames"][0]["line"], 4);
+        assert_eq!(trace["body"]["stackFrames"][0]["name"], "print \"two\"");
+        request(
+            &mut client,
+            6,
+            "variables",
+            json!({ "variablesReference": SHORT_REF }),
+        );
+        let variables = wait_for(&mut reader, response("variables"));
+        assert_eq!(
+            variables["body"]["variables"][0],
+            json!({ "name": "msg", "value": "hello", "variablesReference": 0 })
+        );
+        request(
+            &mut client,
+            7,
+            "evaluate",
+            json!({ "expression": "mem.short[\"msg\"]" }),
+        );
+        let evaluated = wait_for(&mut reader, response("evaluate"));
+        assert_eq!(evaluated["body"]["result"], "hello");
+
+        request(&mut client, 8, "continue", json!({ "threadId": 1 }));
+        let output = wait_for(&mut reader, |m| {
+            m["event"] == "output" && m["body"]["output"].as_str().unwrap().contains("one")
+        });
+        assert_eq!(output["body"]["output"], "one\ntwo\n");
+        wait_for(&mut reader, |m| m["event"] == "terminated");
+        request(&mut client, 9, "disconnect", json!({}));
+        server.join().unwrap().unwrap();
+        let _ = std::fs::remove_file(path);
+    }
+}
@@ -0,0 +1,16 @@
+//! Web page served at `/` by the HTTP API of `serve`: the agents and their
+//! goals, live memory, the latest inputs with their answers, and recall.
+//! It polls the [`api`](crate::api) endpoints, so it needs nothing else
+//! running.
+
+use crate::httpd::Response;
+
+/// Inputs each agent under `serve` keeps for the page; see
+/// [`SentienceAgent::keep_recent_turns`](crate::SentienceAgent::keep_recent_turns).
+pub const RECENT_TURNS: usize = 20;
+
+const PAGE: &str = include_str!("dashboard.html");
+
+pub fn page() -> Response {
+    Response::new(200, "text/html; charset=utf-8", PAGE)
+}
@@ -0,0 +1,194 @@
+//! Step debugger. Programs parsed with
+//! [`Parser::with_locations`](crate::parser::Parser::with_locations) carry a
+//! [`Statement::Location`](crate::types::Statement::Location) before every
+//! statement; evaluating one calls [`Debugger::pause_at`], which blocks the
+//! agent while it is stopped at a breakpoint or step. Another thread (the
+//! DAP server) inspects the stop and resumes it.
+
+use crate::context::AgentContext;
+use std::collections::HashSet;
+use std::fmt;
+use std::sync::{Condvar, Mutex, MutexGuard};
+
+/// How to continue from a stop.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum Resume {
+    Continue,
+    /// Stop at the next statement at the same or an outer level.
+    Next,
+    /// Stop at the very next statement.
+    StepIn,
+    /// Stop at the next statement outside the current block.
+    StepOut,
+}
+
+/// Where the agent stopped, with a copy of its memory at that point.
+#[derive(Clone, Debug, PartialEq)]
+pub struct Stop {
+    /// `entry`, `breakpoint`, `step` or `pause`.
+    pub reason: &'static str,
+    pub line: usize,
+    pub depth: usize,
+    pub short: Vec<(String, String)>,
+    pub long: Vec<(String, String)>,
+    pub links: Vec<(String, String)>,
+}
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+enum Mode {
+    Run,
+    StepIn,
+    Next(usize),
+    StepOut(usize),
+}
+
+struct State {
+    breakpoints: HashSet<usize>,
+    mode: Mode,
+    /// The next stop is the first.
+    at_entry: bool,
+    pause_requested: bool,
+    stopped: Option<Stop>,
+}
+
+pub struct Debugger {
+    state: Mutex<State>,
+    resumed: Condvar,
+    on_stop: Box<dyn Fn(&Stop) + Send + Sync>,
+}
+
+impl fmt::Debug for Debugger {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("Debugger")
+            .field("stopped", &self.stopped())
+            .finish()
+    }
+}
+
+impl Debugger {
+    /// `on_stop` is called on the agent's thread each time it stops.
+    pub fn new(stop_on_entry: bool, on_stop: impl Fn(&Stop) + Send + Sync + 'static) -> Self {
+        Self {
+            state: Mutex::new(State {
+                breakpoints: HashSet::new(),
+                mode: if stop_on_entry {
+                    Mode::StepIn
+                } else {
+                    Mode::Run
+                },
+                at_entry: stop_on_entry,
+                pause_requested: false,
+                stopped: None,
+            }),
+            resumed: Condvar::new(),
+            on_stop: Box::new(on_stop),
+        }
+    }
+
+    /// Replace the breakpoints with `lines`.
+    pub fn set_breakpoints(&self, lines: impl IntoIterator<Item = usize>) {
+        self.lock().breakpoints = lines.into_iter().collect();
+    }
+
+    /// Stop at the next statement.
+    pub fn pause(&self) {
+        self.lock().pause_requested = true;
+    }
+
+    /// The current stop, if the agent is stopped.
+    pub fn stopped(&self) -> Option<Stop> {
+        self.lock().stopped.clone()
+    }
+
+    pub fn resume(&self, how: Resume) {
+        let mut state = self.lock();
+        let depth = state.stopped.as_ref().map_or(0, |stop| stop.depth);
+        state.mode = match how {
+            Resume::Continue => Mode::Run,
+            Resume::Next => Mode::Next(depth),
+            Resume::StepIn => Mode::StepIn,
+            Resume::StepOut => Mode::StepOut(depth),
+        };
+        state.stopped = None;
+        self.resumed.notify_all();
+    }
+
+    /// Run to completion, ignoring breakpoints, e.g. when the client
+    /// disconnects.
+    pub fn detach(&self) {
+        self.lock().breakpoints.clear();
+        self.resume(Resume::Continue);
+    }
+
+    /// Mark the start of a new handler run. A step that was waiting for its
+    /// block to finish stops at the handler's first statement instead of
+    /// running through it.
+    pub fn begin_run(&self) {
+        let mut state = self.lock();
+        if matches!(state.mode, Mode::Next(_) | Mode::StepOut(_)) {
+            state.mode = Mode::StepIn;
+        }
+    }
+
+    /// Called before the statement at `line` and nesting `depth`; blocks
+    /// while stopped there.
+    pub fn pause_at(&self, line: usize, depth: usize, ctx: &AgentContext) {
+        let mut state = self.lock();
+        let stepped = match state.mode {
+            Mode::Run => false,
+            Mode::StepIn => true,
+            Mode::Next(from) => depth <= from,
+            Mode::StepOut(from) => depth < from,
+        };
+        let reason = if state.pause_requested {
+            "pause"
+        } else if stepped && state.at_entry {
+            "entry"
+        } else if state.breakpoints.contains(&line) {
+            "breakpoint"
+        } else if stepped {
+            "step"
+        } else {
+            return;
+        };
+        state.pause_requested = false;
+        state.at_entry = false;
+
+        let stop = Stop {
+            reason,
+            line,
+            depth,
+            short: sorted(&*ctx.mem_short),
+            long: sorted(&*ctx.mem_long),
+            links: sorted(&ctx.links),
+        };
+        state.stopped = Some(stop.clone());
+        drop(state);
+        (self.on_stop)(&stop);
+
+        let mut state = self.lock();
+        while state.stopped.is_some() {
+            state = self
+                .resumed
+                .wait(state)
+                .unwrap_or_else(|poisoned| poisoned.into_inner());
+        }
+    }
+
+    fn lock(&self) -> MutexGuard<'_, State> {
+        self.state
+            .lock()
+            .unwrap_or_else(|poisoned| poisoned.into_inner())
+    }
+}
+
+fn sorted<K: ToString, V: ToString>(
+    map: &std::collections::HashMap<K, V>,
+) -> Vec<(String, String)> {
+    let mut entries: Vec<_> = map
+        .iter()
+        .map(|(k, v)| (k.to_string(), v.to_string()))
+        .collect();
+    entries.sort();
+    entries
+}
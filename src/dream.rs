@@ -0,0 +1,215 @@
+//! Consolidation while an agent gets no input, like sleep: short-term
+//! memory is replayed, re-embedded and clustered, what lasts moves to
+//! long-term memory and the rest is dropped.
+//!
+//! An entry lasts if it is one of several on the same theme (entries whose
+//! word vectors, from [`sync::embed`], are close), if it was used at least
+//! [`Options::min_uses`] times, or if it reports on the goal (`goal.*`).
+//! Uses come from the session's [`attention`](crate::attention) counts and,
+//! when [`AgentContext::history`] is kept, from replaying its writes.
+
+use crate::context::AgentContext;
+use crate::{intern, sync};
+use serde::Serialize;
+use std::collections::{BTreeMap, HashMap};
+
+/// Similarity from which entries share a cluster.
+pub const DEFAULT_THRESHOLD: f32 = 0.5;
+/// Uses after which an entry lasts on its own.
+pub const DEFAULT_MIN_USES: u64 = 3;
+
+#[derive(Clone, Debug, PartialEq)]
+pub struct Options {
+    /// Cosine similarity, from 0 to 1, an entry needs to join a cluster.
+    pub threshold: f32,
+    pub min_uses: u64,
+}
+
+impl Default for Options {
+    fn default() -> Self {
+        Self {
+            threshold: DEFAULT_THRESHOLD,
+            min_uses: DEFAULT_MIN_USES,
+        }
+    }
+}
+
+/// What one consolidation did, with keys in sorted order.
+#[derive(Clone, Debug, Default, PartialEq, Serialize)]
+pub struct Report {
+    /// Short-term keys grouped by theme, including the lone ones.
+    pub clusters: Vec<Vec<String>>,
+    /// Keys moved to long-term memory.
+    pub promoted: Vec<String>,
+    /// Keys dropped from short-term memory.
+    pub pruned: Vec<String>,
+}
+
+impl Report {
+    /// Lines for `.dream` and the `dream` command.
+    pub fn render(&self) -> Vec<String> {
+        let entries: usize = self.clusters.iter().map(Vec::len).sum();
+        let mut lines = vec![format!(
+            "{} short-term entr{} in {} cluster{}",
+            entries,
+            if entries == 1 { "y" } else { "ies" },
+            self.clusters.len(),
+            if self.clusters.len() == 1 { "" } else { "s" }
+        )];
+        for cluster in self.clusters.iter().filter(|cluster| cluster.len() > 1) {
+            lines.push(format!("  {}", cluster.join(", ")));
+        }
+        lines.push(format!("Promoted: {}", list(&self.promoted)));
+        lines.push(format!("Pruned: {}", list(&self.pruned)));
+        lines
+    }
+}
+
+fn list(keys: &[String]) -> String {
+    if keys.is_empty() {
+        "nothing".to_string()
+    } else {
+        keys.join(", ")
+    }
+}
+
+/// Consolidate the short-term memory of `ctx`, leaving it empty.
+pub fn consolidate(ctx: &mut AgentContext, options: &Options) -> Report {
+    let _span = tracing::info_span!("memory.dream").entered();
+    let episodes: BTreeMap<String, String> = intern::strings(&ctx.mem_short).into_iter().collect();
+
+    let mut written: HashMap<&str, u64> = HashMap::new();
+    if let Some(history) = &ctx.history {
+        for write in history.writes().filter(|write| write.region == "short") {
+            *written.entry(write.key.as_str()).or_default() += 1;
+        }
+    }
+    let uses: HashMap<&str, u64> = episodes
+        .keys()
+        .map(|key| {
+            let replayed = written.get(key.as_str()).copied().unwrap_or(0);
+            (key.as_str(), ctx.attention.count(key).max(replayed))
+        })
+        .collect();
+
+    // Each cluster keeps the sum of its members' unit vectors.
+    let mut clusters: Vec<(Vec<f32>, Vec<&str>)> = Vec::new();
+    for (key, value) in &episodes {
+        let vector = sync::embed(&format!("{} {}", key, value));
+        let nearest = clusters
+            .iter()
+            .enumerate()
+            .map(|(i, (sum, _))| (i, cosine(sum, &vector)))
+            .filter(|(_, similarity)| *similarity >= options.threshold)
+            .max_by(|a, b| a.1.total_cmp(&b.1));
+        match nearest {
+            Some((i, _)) => {
+                let (sum, members) = &mut clusters[i];
+                sum.iter_mut().zip(&vector).for_each(|(s, v)| *s += v);
+                members.push(key);
+            }
+            None => clusters.push((vector, vec![key])),
+        }
+    }
+
+    let mut report = Report::default();
+    for (_, members) in &clusters {
+        for &key in members {
+            let lasts =
+                members.len() > 1 || uses[key] >= options.min_uses || key.starts_with("goal.");
+            if lasts {
+                report.promoted.push(key.to_string());
+            } else {
+                report.pruned.push(key.to_string());
+            }
+        }
+    }
+    report.clusters = clusters
+        .into_iter()
+        .map(|(_, members)| members.into_iter().map(str::to_string).collect())
+        .collect();
+    report.promoted.sort();
+    report.pruned.sort();
+
+    for key in &report.promoted {
+        ctx.set_mem("long", key, &episodes[key]);
+        ctx.remove_mem("short", key);
+    }
+    for key in &report.pruned {
+        ctx.remove_mem("short", key);
+    }
+    tracing::info!(
+        promoted = report.promoted.len(),
+        pruned = report.pruned.len(),
+        "dreamed"
+    );
+    report
+}
+
+/// Similarity of the direction of `sum` and the unit vector `unit`.
+fn cosine(sum: &[f32], unit: &[f32]) -> f32 {
+    let norm = sum.iter().map(|x| x * x).sum::<f32>().sqrt();
+    if norm == 0.0 {
+        return 0.0;
+    }
+    sum.iter().zip(unit).map(|(a, b)| a * b).sum::<f32>() / norm
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::history::History;
+
+    #[test]
+    fn promotes_recurring_themes_and_prunes_the_rest() {
+        let mut ctx = AgentContext::new();
+        ctx.history = Some(History::default());
+        ctx.set_mem("short", "forecast", "rain in Belgrade tomorrow");
+        ctx.set_mem("short", "weather", "rain in Belgrade today");
+        ctx.set_mem("short", "msg", "hello there");
+        ctx.set_mem("short", "goal.progress", "40%");
+        for name in ["Ana", "Ana", "Ana"] {
+            ctx.set_mem("short", "name", name);
+        }
+        ctx.set_mem("long", "weather", "sunny");
+
+        let report = consolidate(&mut ctx, &Options::default());
+        assert_eq!(
+            report.promoted,
+            ["forecast", "goal.progress", "name", "weather"]
+        );
+        assert_eq!(report.pruned, ["msg"]);
+        assert!(report
+            .clusters
+            .contains(&vec!["forecast".to_string(), "weather".to_string()]));
+        assert!(ctx.mem_short.is_empty());
+        assert_eq!(ctx.get_mem("long", "weather"), "rain in Belgrade today");
+        assert_eq!(ctx.get_mem("long", "name"), "Ana");
+        assert_eq!(ctx.get_mem("long", "msg"), "");
+
+        let lines = report.render();
+        assert_eq!(lines[0], "5 short-term entries in 4 clusters");
+        assert_eq!(lines[1], "  forecast, weather");
+        assert_eq!(
+            &lines[2..],
+            [
+                "Promoted: forecast, goal.progress, name, weather",
+                "Pruned: msg"
+            ]
+        );
+
+        // History keeps the deletions, so `.at` can still show the entries.
+        let deleted = ctx
+            .history
+            .as_ref()
+            .unwrap()
+            .writes()
+            .filter(|write| write.region == "short" && write.value.is_empty())
+            .count();
+        assert_eq!(deleted, 5);
+        assert_eq!(
+            consolidate(&mut ctx, &Options::default()),
+            Report::default()
+        );
+    }
+}
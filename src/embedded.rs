@@ -0,0 +1,148 @@
+use crate::error::{ParseError, ParseErrorKind};
+use crate::lexer::{self, Lexer};
+use crate::parser::Parser;
+use crate::types::Program;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::OnceLock;
+
+/// Parse and validate an agent program shipped inside the binary.
+///
+/// `name` is only used for error messages, usually the embedded file name.
+pub fn compile(name: &str, src: &str) -> Result<Program, ParseError> {
+    if let Some(e) = lexer::unterminated(src) {
+        return Err(e.with_source_name(name));
+    }
+    let mut lexer = Lexer::new(src);
+    let mut parser = Parser::new(&mut lexer);
+    let program = parser.parse_program();
+    if let Some(e) = parser.errors().first() {
+        return Err(e.clone().with_source_name(name));
+    }
+
+    if program.statements.is_empty() {
+        return Err(ParseError::new(ParseErrorKind::Empty).with_source_name(name));
+    }
+    if let Some(e) = parser.unknown_statements().first() {
+        return Err(e.clone().with_source_name(name));
+    }
+    Ok(program)
+}
+
+/// A `.sent` source compiled into the binary, parsed once on first use.
+///
+/// ```ignore
+/// static ECHO: EmbeddedProgram = sentience_core::embed_program!("agents/echo.sent");
+/// agent.run_program(ECHO.program())?;
+/// ```
+pub struct EmbeddedProgram {
+    name: &'static str,
+    src: &'static str,
+    program: OnceLock<Program>,
+}
+
+impl EmbeddedProgram {
+    pub const fn new(name: &'static str, src: &'static str) -> Self {
+        Self {
+            name,
+            src,
+            program: OnceLock::new(),
+        }
+    }
+
+    pub fn name(&self) -> &'static str {
+        self.name
+    }
+
+    pub fn source(&self) -> &'static str {
+        self.src
+    }
+
+    /// The parsed program. Panics if the embedded source is invalid; use
+    /// [`validate_dir`] from a build script to catch that at build time.
+    pub fn program(&self) -> &Program {
+        self.program
+            .get_or_init(|| compile(self.name, self.src).unwrap_or_else(|e| panic!("{}", e)))
+    }
+}
+
+/// Embed a `.sent` file (path relative to the calling source file) as an
+/// [`EmbeddedProgram`].
+#[macro_export]
+macro_rules! embed_program {
+    ($path:literal) => {
+        $crate::embedded::EmbeddedProgram::new($path, include_str!($path))
+    };
+}
+
+/// Validate every `.sent` file under `dir`, returning the files checked.
+///
+/// Intended for host crates' `build.rs`, so broken agents fail the build
+/// instead of panicking at startup:
+///
+/// ```ignore
+/// fn main() {
+///     sentience_core::embedded::validate_dir("agents").unwrap();
+/// }
+/// ```
+pub fn validate_dir(dir: impl AsRef<Path>) -> Result<Vec<PathBuf>, String> {
+    let mut files = Vec::new();
+    collect_sources(dir.as_ref(), &mut files).map_err(|e| e.to_string())?;
+    files.sort();
+
+    let mut errors = Vec::new();
+    for path in &files {
+        println!("cargo:rerun-if-changed={}", path.display());
+        let src = fs::read_to_string(path).map_err(|e| format!("{}: {}", path.display(), e))?;
+        if let Err(e) = compile(&path.display().to_string(), &src) {
+            errors.push(e.to_string());
+        }
+    }
+
+    if errors.is_empty() {
+        Ok(files)
+    } else {
+        Err(errors.join("\n"))
+    }
+}
+
+fn collect_sources(dir: &Path, files: &mut Vec<PathBuf>) -> std::io::Result<()> {
+    for entry in fs::read_dir(dir)? {
+        let path = entry?.path();
+        if path.is_dir() {
+            collect_sources(&path, files)?;
+        } else if path.extension().map_or(false, |ext| ext == "sent") {
+            files.push(path);
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::Statement;
+
+    static ECHO: EmbeddedProgram = crate::embed_program!("../examples/echo.sent");
+
+    #[test]
+    fn embedded_program_parses_once() {
+        let first = ECHO.program() as *const Program;
+        let second = ECHO.program() as *const Program;
+        assert_eq!(first, second);
+        assert!(matches!(
+            &ECHO.program().statements[0],
+            Statement::AgentDeclaration { name, .. } if name == "Echo"
+        ));
+    }
+
+    #[test]
+    fn compile_rejects_unknown_statements() {
+        let err = compile("bad.sent", "agent A { bogus }").unwrap_err();
+        assert_eq!(
+            err.kind,
+            ParseErrorKind::UnknownStatement("bogus".to_string())
+        );
+        assert_eq!(err.to_string(), "bad.sent:1:11: unknown statement `bogus`");
+    }
+}
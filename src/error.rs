@@ -0,0 +1,455 @@
+//! Errors of the interpreter. Each kind has a stable code, such as
+//! `SEN1001`, shown with it in text and JSON output so a class of errors can
+//! be searched for or suppressed; the README lists them all.
+
+use crate::lang::Version;
+use crate::limits::LimitError;
+use crate::llm::LlmError;
+use crate::sentience_core::latent::DimensionError;
+use std::error::Error as StdError;
+use std::fmt;
+use std::io;
+
+/// Line and column (both 1-based) of a diagnostic in the source.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub struct Position {
+    pub line: usize,
+    pub col: usize,
+}
+
+impl fmt::Display for Position {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}:{}", self.line, self.col)
+    }
+}
+
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub enum ParseErrorKind {
+    /// The source contained no statements.
+    Empty,
+    /// A token that does not start or continue any statement.
+    UnknownStatement(String),
+    /// A statement stopped making sense at a token: `found` is the token,
+    /// quoted, or `end of input`.
+    UnexpectedToken { expected: String, found: String },
+    /// A compiled `.sentc` program is corrupt or from another format version.
+    InvalidCompiled(String),
+    /// A string literal without its closing quote.
+    UnterminatedString,
+    /// A `{`, `[` or `(` that is never closed.
+    Unclosed(char),
+    /// A `/*` comment without its `*/`.
+    UnterminatedComment,
+    /// Syntax, such as `` `let` ``, that the language only has from
+    /// `version` on, in source read as an older version.
+    NeedsLang { syntax: String, version: Version },
+}
+
+impl ParseErrorKind {
+    pub fn code(&self) -> &'static str {
+        match self {
+            ParseErrorKind::Empty => "SEN1001",
+            ParseErrorKind::UnknownStatement(_) => "SEN1002",
+            ParseErrorKind::UnexpectedToken { .. } => "SEN1003",
+            ParseErrorKind::InvalidCompiled(_) => "SEN1004",
+            ParseErrorKind::UnterminatedString => "SEN1005",
+            ParseErrorKind::Unclosed(_) => "SEN1006",
+            ParseErrorKind::UnterminatedComment => "SEN1007",
+            ParseErrorKind::NeedsLang { .. } => "SEN1008",
+        }
+    }
+}
+
+/// Failure to turn source text into a program.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct ParseError {
+    pub kind: ParseErrorKind,
+    /// File or embedded program name, when known.
+    pub source_name: Option<String>,
+    pub position: Option<Position>,
+}
+
+impl ParseError {
+    pub fn new(kind: ParseErrorKind) -> Self {
+        Self {
+            kind,
+            source_name: None,
+            position: None,
+        }
+    }
+
+    pub fn with_source_name(mut self, name: &str) -> Self {
+        self.source_name = Some(name.to_string());
+        self
+    }
+
+    pub fn at(mut self, position: Position) -> Self {
+        self.position = Some(position);
+        self
+    }
+
+    pub fn code(&self) -> &'static str {
+        self.kind.code()
+    }
+}
+
+impl fmt::Display for ParseError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match (&self.source_name, &self.position) {
+            (Some(name), Some(pos)) => write!(f, "{}:{}: ", name, pos)?,
+            (Some(name), None) => write!(f, "{}: ", name)?,
+            (None, Some(pos)) => write!(f, "{}: ", pos)?,
+            (None, None) => {}
+        }
+        match &self.kind {
+            ParseErrorKind::Empty => write!(f, "no statements found"),
+            ParseErrorKind::UnknownStatement(text) => write!(f, "unknown statement `{}`", text),
+            ParseErrorKind::UnexpectedToken { expected, found } => {
+                write!(f, "expected {}, found {}", expected, found)
+            }
+            ParseErrorKind::InvalidCompiled(msg) => write!(f, "invalid compiled program: {}", msg),
+            ParseErrorKind::UnterminatedString => write!(f, "unterminated string literal"),
+            ParseErrorKind::Unclosed(c) => write!(f, "unclosed `{}`", c),
+            ParseErrorKind::UnterminatedComment => write!(f, "unterminated block comment"),
+            ParseErrorKind::NeedsLang { syntax, version } => {
+                write!(f, "{} requires `lang {}`", syntax, version)
+            }
+        }
+    }
+}
+
+impl StdError for ParseError {}
+
+/// Failure to read or write agent memory.
+#[derive(Debug)]
+pub enum MemoryError {
+    /// A region other than `short` or `long` was addressed.
+    UnknownRegion(String),
+    /// Reading or writing a saved context failed.
+    Io(io::Error),
+    /// A saved context could not be decoded.
+    Format(String),
+    /// A write would go over one of the configured limits.
+    Limit(LimitError),
+    /// Memory at a past moment cannot be reconstructed; see
+    /// [`history`](crate::history).
+    History(String),
+}
+
+impl MemoryError {
+    pub fn code(&self) -> &'static str {
+        match self {
+            MemoryError::UnknownRegion(_) => "SEN5001",
+            MemoryError::Io(_) => "SEN5002",
+            MemoryError::Format(_) => "SEN5003",
+            MemoryError::Limit(e) => e.code(),
+            MemoryError::History(_) => "SEN5004",
+        }
+    }
+}
+
+impl fmt::Display for MemoryError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            MemoryError::UnknownRegion(region) => write!(f, "unknown memory region `{}`", region),
+            MemoryError::Io(e) => write!(f, "memory i/o failed: {}", e),
+            MemoryError::Format(msg) => write!(f, "invalid saved context: {}", msg),
+            MemoryError::Limit(e) => write!(f, "{}", e),
+            MemoryError::History(msg) => write!(f, "{}", msg),
+        }
+    }
+}
+
+impl StdError for MemoryError {
+    fn source(&self) -> Option<&(dyn StdError + 'static)> {
+        match self {
+            MemoryError::Io(e) => Some(e),
+            MemoryError::Limit(e) => Some(e),
+            _ => None,
+        }
+    }
+}
+
+impl From<io::Error> for MemoryError {
+    fn from(e: io::Error) -> Self {
+        MemoryError::Io(e)
+    }
+}
+
+impl From<LimitError> for MemoryError {
+    fn from(e: LimitError) -> Self {
+        MemoryError::Limit(e)
+    }
+}
+
+impl From<serde_json::Error> for MemoryError {
+    fn from(e: serde_json::Error) -> Self {
+        MemoryError::Format(e.to_string())
+    }
+}
+
+#[derive(Debug)]
+pub enum RuntimeErrorKind {
+    /// No agent has been declared yet.
+    NoAgent,
+    /// The agent has no block for the requested event (`input`, `train`, ...).
+    MissingHandler(String),
+    /// The parser could not make sense of a statement.
+    UnknownStatement(String),
+    Memory(MemoryError),
+    /// An `ask` statement's provider failed.
+    Llm(LlmError),
+    /// The sandbox does not allow the operation.
+    Denied(String),
+    /// A `fetch` statement was malformed or its request failed.
+    Fetch(String),
+    /// A `read` or `write` statement could not access its file.
+    File(String),
+    /// An `exec` statement's command could not be run or timed out.
+    Exec(String),
+    /// A statement or handler ran past its deadline; see
+    /// [`Limits`](crate::limits::Limits).
+    Timeout(String),
+    /// An `if state.<drive>` names a drive the agent does not have.
+    UnknownState(String),
+    /// A `propose` statement asked for a change the agent may not make;
+    /// see [`evolve`](crate::evolve).
+    Rejected(String),
+    /// `print` or `ask` rendered a template that was never declared.
+    UnknownTemplate(String),
+    /// An `import` named a module that does not exist.
+    UnknownModule(String),
+    /// A fetched module could not be imported: it is not fetched or
+    /// pinned, does not match its checksum, or imports itself; see
+    /// [`packages`](crate::packages).
+    Import(String),
+    /// An expression could not be evaluated, e.g. it names nothing or
+    /// subtracts a word; see [`expr`](crate::expr).
+    Expression(String),
+    /// A vector did not fit the memory index searched by `recall`; see
+    /// [`recall`](crate::recall).
+    Vector(DimensionError),
+    /// A `send` named an agent that was never declared.
+    UnknownAgent(String),
+    /// A value was used as something it cannot stand for, such as a word
+    /// as a number: `to` is what was needed, and the message gives the
+    /// rule for it. See [`Value`](crate::expr::Value).
+    Coercion {
+        value: String,
+        to: &'static str,
+    },
+    /// A loop ran into [`Limits::loop_iterations`](crate::limits::Limits::loop_iterations).
+    Limit(LimitError),
+}
+
+/// Failure while evaluating a program, with the statement being evaluated.
+#[derive(Debug)]
+pub struct RuntimeError {
+    pub kind: RuntimeErrorKind,
+    /// Short description of the statement that failed, e.g. `reflect`.
+    pub statement: Option<String>,
+}
+
+impl RuntimeError {
+    pub fn new(kind: RuntimeErrorKind) -> Self {
+        Self {
+            kind,
+            statement: None,
+        }
+    }
+
+    pub fn in_statement(mut self, statement: &str) -> Self {
+        if self.statement.is_none() {
+            self.statement = Some(statement.to_string());
+        }
+        self
+    }
+
+    pub fn code(&self) -> &'static str {
+        match &self.kind {
+            RuntimeErrorKind::NoAgent => "SEN4001",
+            RuntimeErrorKind::MissingHandler(_) => "SEN4002",
+            RuntimeErrorKind::UnknownStatement(_) => "SEN4003",
+            RuntimeErrorKind::Memory(e) => e.code(),
+            RuntimeErrorKind::Llm(_) => "SEN4004",
+            RuntimeErrorKind::Denied(_) => "SEN4005",
+            RuntimeErrorKind::Fetch(_) => "SEN4006",
+            RuntimeErrorKind::File(_) => "SEN4007",
+            RuntimeErrorKind::Exec(_) => "SEN4008",
+            RuntimeErrorKind::Timeout(_) => "SEN4009",
+            RuntimeErrorKind::UnknownState(_) => "SEN4010",
+            RuntimeErrorKind::Rejected(_) => "SEN4011",
+            RuntimeErrorKind::UnknownTemplate(_) => "SEN4012",
+            RuntimeErrorKind::UnknownModule(_) => "SEN4013",
+            RuntimeErrorKind::Import(_) => "SEN4014",
+            RuntimeErrorKind::Expression(_) => "SEN4015",
+            RuntimeErrorKind::Vector(_) => "SEN4016",
+            RuntimeErrorKind::UnknownAgent(_) => "SEN4017",
+            RuntimeErrorKind::Coercion { .. } => "SEN4018",
+            RuntimeErrorKind::Limit(e) => e.code(),
+        }
+    }
+}
+
+impl fmt::Display for RuntimeError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        if let Some(stmt) = &self.statement {
+            write!(f, "in {}: ", stmt)?;
+        }
+        match &self.kind {
+            RuntimeErrorKind::NoAgent => write!(f, "no agent registered"),
+            RuntimeErrorKind::MissingHandler(kind) if kind == "input" => {
+                write!(f, "agent has no on input handler")
+            }
+            RuntimeErrorKind::MissingHandler(kind) => write!(f, "agent has no {} block", kind),
+            RuntimeErrorKind::UnknownStatement(text) => write!(f, "unknown statement `{}`", text),
+            RuntimeErrorKind::Memory(e) => write!(f, "{}", e),
+            RuntimeErrorKind::Llm(e) => write!(f, "{}", e),
+            RuntimeErrorKind::Denied(msg) => write!(f, "permission denied: {}", msg),
+            RuntimeErrorKind::Fetch(msg) => write!(f, "fetch failed: {}", msg),
+            RuntimeErrorKind::File(msg) => write!(f, "file access failed: {}", msg),
+            RuntimeErrorKind::Exec(msg) => write!(f, "exec failed: {}", msg),
+            RuntimeErrorKind::Timeout(msg) => write!(f, "timed out: {}", msg),
+            RuntimeErrorKind::UnknownState(drive) => write!(f, "unknown state `{}`", drive),
+            RuntimeErrorKind::Rejected(reason) => write!(f, "proposal rejected: {}", reason),
+            RuntimeErrorKind::UnknownTemplate(name) => write!(f, "unknown template `{}`", name),
+            RuntimeErrorKind::UnknownModule(name) => write!(f, "unknown module `{}`", name),
+            RuntimeErrorKind::Import(msg) => write!(f, "{}", msg),
+            RuntimeErrorKind::Expression(msg) => write!(f, "{}", msg),
+            RuntimeErrorKind::Vector(e) => write!(f, "{}", e),
+            RuntimeErrorKind::UnknownAgent(name) => write!(f, "unknown agent `{}`", name),
+            RuntimeErrorKind::Coercion { value, to } => {
+                write!(f, "cannot use `{}` as {}: {}", value, to, coercion_rule(to))
+            }
+            RuntimeErrorKind::Limit(e) => write!(f, "{}", e),
+        }
+    }
+}
+
+/// How values are taken as `to` when they are not already one, for
+/// [`RuntimeErrorKind::Coercion`].
+fn coercion_rule(to: &str) -> &'static str {
+    match to {
+        "a number" => "only numbers and text that reads as one are numbers",
+        "something to add" => {
+            "`+` adds numbers, joins text with anything, and joins lists with lists and maps with maps"
+        }
+        "something to order" => "`<`, `<=`, `>` and `>=` order numbers, and otherwise text",
+        "a list or map" => "only lists and maps have items to index",
+        "a list index" => {
+            "lists are indexed by whole numbers from 0, and negative ones count from the end"
+        }
+        "a map key" => "map keys are text, and numbers and booleans are taken as their text",
+        "something with a length" => {
+            "`len` counts the characters of text, the items of a list and the entries of a map"
+        }
+        _ => "no value of another kind is taken as one",
+    }
+}
+
+impl StdError for RuntimeError {
+    fn source(&self) -> Option<&(dyn StdError + 'static)> {
+        match &self.kind {
+            RuntimeErrorKind::Memory(e) => Some(e),
+            RuntimeErrorKind::Llm(e) => Some(e),
+            RuntimeErrorKind::Limit(e) => Some(e),
+            RuntimeErrorKind::Vector(e) => Some(e),
+            _ => None,
+        }
+    }
+}
+
+impl From<LlmError> for RuntimeError {
+    fn from(e: LlmError) -> Self {
+        RuntimeError::new(RuntimeErrorKind::Llm(e))
+    }
+}
+
+impl From<MemoryError> for RuntimeError {
+    fn from(e: MemoryError) -> Self {
+        RuntimeError::new(RuntimeErrorKind::Memory(e))
+    }
+}
+
+/// Any error produced by the interpreter.
+#[derive(Debug)]
+pub enum Error {
+    Parse(ParseError),
+    Runtime(RuntimeError),
+    Memory(MemoryError),
+}
+
+impl Error {
+    pub fn code(&self) -> &'static str {
+        match self {
+            Error::Parse(e) => e.code(),
+            Error::Runtime(e) => e.code(),
+            Error::Memory(e) => e.code(),
+        }
+    }
+}
+
+impl fmt::Display for Error {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Error::Parse(e) => write!(f, "parse error: {}", e),
+            Error::Runtime(e) => write!(f, "runtime error: {}", e),
+            Error::Memory(e) => write!(f, "memory error: {}", e),
+        }
+    }
+}
+
+impl StdError for Error {
+    fn source(&self) -> Option<&(dyn StdError + 'static)> {
+        match self {
+            Error::Parse(e) => Some(e),
+            Error::Runtime(e) => Some(e),
+            Error::Memory(e) => Some(e),
+        }
+    }
+}
+
+impl From<ParseError> for Error {
+    fn from(e: ParseError) -> Self {
+        Error::Parse(e)
+    }
+}
+
+impl From<RuntimeError> for Error {
+    fn from(e: RuntimeError) -> Self {
+        Error::Runtime(e)
+    }
+}
+
+impl From<MemoryError> for Error {
+    fn from(e: MemoryError) -> Self {
+        Error::Memory(e)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn memory_error_is_reachable_through_source_chain() {
+        let err: Error = RuntimeError::from(MemoryError::UnknownRegion("mid".to_string()))
+            .in_statement("reflect")
+            .into();
+        assert_eq!(
+            err.to_string(),
+            "runtime error: in reflect: unknown memory region `mid`"
+        );
+
+        let mut source = err.source();
+        let mut found = false;
+        while let Some(e) = source {
+            if let Some(MemoryError::UnknownRegion(region)) = e.downcast_ref::<MemoryError>() {
+                assert_eq!(region, "mid");
+                found = true;
+            }
+            source = e.source();
+        }
+        assert!(found);
+    }
+}
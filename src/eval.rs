@@ -1,5 +1,23 @@
+use crate::affect;
+use crate::agents;
+use crate::attention;
 use crate::context::AgentContext;
-use crate::types::Statement;
+use crate::error::{RuntimeError, RuntimeErrorKind};
+use crate::events::AgentEvent;
+use crate::evolve;
+use crate::exec::{self, ExecRequest};
+use crate::expr;
+use crate::fetch::FetchRequest;
+use crate::functions;
+use crate::goals;
+use crate::lang::Version;
+use crate::limits::LimitError;
+use crate::llm::{self, LlmRequest};
+use crate::printer::print_mutation;
+use crate::recall;
+use crate::types::{Expr, Program, Statement, Text};
+use crate::{template, text, training};
+use std::time::{Duration, Instant};
 
 fn eval_expr(expr: &str, input: &str, _ctx: &AgentContext) -> String {
     match expr.trim() {
@@ -8,6 +26,599 @@ fn eval_expr(expr: &str, input: &str, _ctx: &AgentContext) -> String {
     }
 }
 
+/// Replace `{input}`, `{msg}` and `{mem.<region>["<key>"]}` placeholders in
+/// `template`. Placeholders that cannot be resolved are left as written.
+pub fn interpolate(template: &str, input: &str, ctx: &AgentContext) -> String {
+    fill(template, |expr| resolve_placeholder(expr, input, ctx))
+}
+
+/// Replace each `{...}` in `template` with what `resolve` gives for the
+/// text inside, leaving the ones it gives nothing for as written.
+pub(crate) fn fill(template: &str, mut resolve: impl FnMut(&str) -> Option<String>) -> String {
+    let mut out = String::with_capacity(template.len());
+    let mut rest = template;
+    while let Some(open) = rest.find('{') {
+        out.push_str(&rest[..open]);
+        let after = &rest[open + 1..];
+        let close = match after.find('}') {
+            Some(close) => close,
+            None => {
+                rest = &rest[open..];
+                break;
+            }
+        };
+        match resolve(after[..close].trim()) {
+            Some(value) => out.push_str(&value),
+            None => out.push_str(&rest[open..open + close + 2]),
+        }
+        rest = &after[close + 1..];
+    }
+    out.push_str(rest);
+    out
+}
+
+pub(crate) fn resolve_placeholder(expr: &str, input: &str, ctx: &AgentContext) -> Option<String> {
+    if let Some(value) = ctx.variables.get(expr) {
+        return Some(value.to_string());
+    }
+    if expr == "input" || expr == "msg" {
+        return Some(input.to_string());
+    }
+    if let Some(drive) = expr.strip_prefix("state.") {
+        return ctx.affect.level(drive).map(|level| level.to_string());
+    }
+    let (region, rest) = expr.strip_prefix("mem.")?.split_once('[')?;
+    let key = rest.strip_suffix(']')?.trim().trim_matches('"');
+    ctx.try_get_mem(region.trim(), key).ok()
+}
+
+/// Run the current agent's `on input`, `train` or `evolve` block with `input`,
+/// its `on start` or `on stop` block with kind `start` or `stop`, or with
+/// kind `schedule` the `on schedule` block whose spec is `input`,
+/// returning its output lines. The block stops with a timeout error once
+/// it runs past [`Limits::turn_timeout`](crate::limits::Limits::turn_timeout).
+pub fn run_block(
+    ctx: &mut AgentContext,
+    kind: &str,
+    input: &str,
+    indent: &str,
+) -> Result<Vec<String>, RuntimeError> {
+    let outer = ctx.deadline;
+    if let Some(timeout) = ctx.limits.turn_timeout {
+        let deadline = Instant::now() + timeout;
+        ctx.deadline = Some(outer.map_or(deadline, |outer| outer.min(deadline)));
+    }
+    let before = ctx.goals.is_some().then(|| goals::Reading::of(ctx));
+    let result = run_handler(ctx, kind, input, indent);
+    ctx.deadline = outer;
+    let ran = !matches!(
+        &result,
+        Err(e) if matches!(e.kind, RuntimeErrorKind::NoAgent | RuntimeErrorKind::MissingHandler(_))
+    );
+    if ran {
+        let trigger = if result.is_ok() {
+            "handler_succeeded"
+        } else {
+            "handler_failed"
+        };
+        ctx.affect.react(trigger, None);
+    }
+    if let Some(before) = before.filter(|_| ran) {
+        let after = goals::Reading::of(ctx);
+        if let Some(log) = &mut ctx.goals {
+            log.record(kind, &before, &after);
+        }
+    }
+    result
+}
+
+fn run_handler(
+    ctx: &mut AgentContext,
+    kind: &str,
+    input: &str,
+    indent: &str,
+) -> Result<Vec<String>, RuntimeError> {
+    let body = match ctx.current_agent.clone() {
+        Some(Statement::AgentDeclaration { body, .. }) => body,
+        _ => return Err(RuntimeError::new(RuntimeErrorKind::NoAgent)),
+    };
+
+    for stmt in body {
+        let block = match (kind, stmt) {
+            ("input", Statement::OnInput { param, body })
+            | ("output", Statement::OnOutput { param, body }) => {
+                ctx.try_set_mem("short", &param, input)?;
+                body
+            }
+            ("schedule", Statement::OnSchedule { spec, body }) if spec == input => body,
+            ("start", Statement::OnStart { body }) | ("stop", Statement::OnStop { body }) => body,
+            (
+                "train",
+                Statement::Train {
+                    dataset: Some(path),
+                    body,
+                },
+            ) => {
+                ctx.rewards.acted(kind);
+                return training::run(ctx, &path, &body, indent);
+            }
+            ("train", Statement::Train { body, .. }) | ("evolve", Statement::Evolve { body }) => {
+                ctx.try_set_mem("short", "msg", input)?;
+                body
+            }
+            _ => continue,
+        };
+        // `on output` finishes the turn of the handler that emitted.
+        if kind != "output" {
+            ctx.rewards.acted(kind);
+        }
+
+        let mut output = Vec::new();
+        let emitted = ctx.responses.len();
+        eval_body(&block, indent, input, ctx, &mut output)?;
+        if kind != "output" {
+            on_output(ctx, emitted, indent, &mut output)?;
+        }
+        return Ok(output);
+    }
+    Err(RuntimeError::new(RuntimeErrorKind::MissingHandler(
+        kind.to_string(),
+    )))
+}
+
+/// Run the current agent's `on output` handler, if it has one, with each
+/// response emitted after the first `emitted`. What the handler emits in
+/// turn is collected but not handled again.
+fn on_output(
+    ctx: &mut AgentContext,
+    emitted: usize,
+    indent: &str,
+    output: &mut Vec<String>,
+) -> Result<(), RuntimeError> {
+    let responses = ctx.responses[emitted..].to_vec();
+    for response in responses {
+        match run_handler(ctx, "output", &response, indent) {
+            Ok(lines) => output.extend(lines),
+            Err(e) if matches!(e.kind, RuntimeErrorKind::MissingHandler(_)) => break,
+            Err(e) => return Err(e.in_statement("on output")),
+        }
+    }
+    Ok(())
+}
+
+/// Run the current agent's `on start` or `on stop` block (`kind` `start`
+/// or `stop`) if it has one.
+pub fn run_hook(
+    ctx: &mut AgentContext,
+    kind: &str,
+    indent: &str,
+) -> Result<Vec<String>, RuntimeError> {
+    match run_block(ctx, kind, "", indent) {
+        Err(e)
+            if matches!(
+                e.kind,
+                RuntimeErrorKind::NoAgent | RuntimeErrorKind::MissingHandler(_)
+            ) =>
+        {
+            Ok(Vec::new())
+        }
+        result => result,
+    }
+}
+
+/// Make the last agent declared in `program` the current agent, replacing
+/// its handlers in one step. Memory, links and everything else in `ctx` are
+/// kept, and neither the program's other statements nor the `on stop` and
+/// `on start` hooks run, so the agent carries on with what it learned.
+pub fn reload(ctx: &mut AgentContext, program: &Program) -> Result<String, RuntimeError> {
+    let (agent, name) = program
+        .statements
+        .iter()
+        .rev()
+        .find_map(|stmt| match stmt {
+            Statement::AgentDeclaration { name, .. } => Some((stmt, name)),
+            _ => None,
+        })
+        .ok_or_else(|| RuntimeError::new(RuntimeErrorKind::NoAgent))?;
+    agents::declare(ctx, agent.clone());
+    Ok(format!("Agent: {} [reloaded]", name))
+}
+
+/// Fail unless the current agent may use `capability`; see
+/// [`Sandbox::check_capability`](crate::sandbox::Sandbox::check_capability).
+pub(crate) fn require(ctx: &AgentContext, capability: &str) -> Result<(), RuntimeError> {
+    let (name, body) = match &ctx.current_agent {
+        Some(Statement::AgentDeclaration { name, body }) => (name.as_str(), body.as_slice()),
+        _ => ("", [].as_slice()),
+    };
+    let declared = body.iter().find_map(|stmt| match stmt {
+        Statement::Capabilities(capabilities) => Some(capabilities.as_slice()),
+        _ => None,
+    });
+    ctx.sandbox.check_capability(name, declared, capability)
+}
+
+/// `timeout`, or less if `deadline` comes sooner.
+fn cap(timeout: Duration, deadline: Option<Instant>) -> Duration {
+    deadline.map_or(timeout, |deadline| {
+        timeout.min(deadline.saturating_duration_since(Instant::now()))
+    })
+}
+
+/// `error`, or a timeout error if it came from giving up at `deadline`.
+fn timed_out(error: RuntimeError, deadline: Option<Instant>) -> RuntimeError {
+    match deadline {
+        Some(deadline) if Instant::now() >= deadline => RuntimeError::new(
+            RuntimeErrorKind::Timeout("no result before the deadline".to_string()),
+        ),
+        _ => error,
+    }
+}
+
+/// The body of `stmt`, one of the `if` statements, if its condition holds.
+fn taken<'a>(
+    stmt: &'a Statement,
+    indent: &str,
+    input: &str,
+    ctx: &mut AgentContext,
+    output: &mut Vec<String>,
+) -> Result<Option<&'a [Statement]>, RuntimeError> {
+    let (holds, body) = match stmt {
+        Statement::IfContextIncludes { values, body } => {
+            let current_val = ctx.get_mem("short", "msg");
+            let holds = values.iter().any(|v| text::contains(&current_val, v));
+            (holds, body)
+        }
+        Statement::If { condition, body } => {
+            let value = expr::evaluate(condition, indent, input, ctx, output)
+                .map_err(|e| e.in_statement("if"))?;
+            (value.truthy(), body)
+        }
+        Statement::IfState {
+            drive,
+            op,
+            value,
+            body,
+        } => {
+            let level = ctx.affect.level(drive).ok_or_else(|| {
+                RuntimeError::new(RuntimeErrorKind::UnknownState(drive.clone())).in_statement("if")
+            })?;
+            let holds = affect::compare(level, op, value.parse().unwrap_or(f64::NAN));
+            (holds, body)
+        }
+        Statement::IfReward {
+            behavior,
+            stat,
+            op,
+            value,
+            body,
+        } => {
+            let level = ctx.rewards.of(behavior).get(stat).unwrap_or(f64::NAN);
+            let holds = affect::compare(level, op, value.parse().unwrap_or(f64::NAN));
+            (holds, body)
+        }
+        _ => return Ok(None),
+    };
+    Ok(holds.then_some(body.as_slice()))
+}
+
+/// Store `value` as `name = ...` does when no variable `name` is bound:
+/// as the agent's output for `output`, and in short-term memory, keeping
+/// its kind, otherwise.
+fn assign(
+    name: &str,
+    value: expr::Value,
+    ctx: &mut AgentContext,
+    output: &mut Vec<String>,
+) -> Result<(), RuntimeError> {
+    if name == "output" {
+        let value = value.to_string();
+        ctx.output = Some(value.clone());
+        output.push(value);
+        return Ok(());
+    }
+    ctx.try_set_value("short", name, value)
+        .map_err(|e| RuntimeError::from(e).in_statement("assignment"))
+}
+
+/// Run `while <condition> { <body> }`.
+fn run_while(
+    condition: &Expr,
+    body: &[Statement],
+    indent: &str,
+    input: &str,
+    ctx: &mut AgentContext,
+    output: &mut Vec<String>,
+) -> Result<(), RuntimeError> {
+    let limit = ctx.limits.loop_iterations();
+    let mut iterations = 0;
+    loop {
+        let holds = expr::evaluate(condition, indent, input, ctx, output)
+            .map_err(|e| e.in_statement("while"))?;
+        if !holds.truthy() {
+            return Ok(());
+        }
+        iterations += 1;
+        if iterations > limit {
+            return Err(loop_limit(limit).in_statement("while"));
+        }
+        eval_body(body, indent, input, ctx, output)?;
+        if ctx.returning.is_some() {
+            return Ok(());
+        }
+    }
+}
+
+/// Run `for <key>, <value> in mem.<region> { <body> }` over the entries
+/// the region had when the loop started.
+#[allow(clippy::too_many_arguments)]
+fn run_for(
+    key: &str,
+    value: &str,
+    region: &str,
+    body: &[Statement],
+    indent: &str,
+    input: &str,
+    ctx: &mut AgentContext,
+    output: &mut Vec<String>,
+) -> Result<(), RuntimeError> {
+    let entries = ctx
+        .entries(region)
+        .map_err(|e| RuntimeError::from(e).in_statement("for"))?;
+    let limit = ctx.limits.loop_iterations();
+    if entries.len() > limit {
+        return Err(loop_limit(limit).in_statement("for"));
+    }
+    for (k, v) in entries {
+        ctx.variables.enter();
+        ctx.variables.bind(key, expr::Value::Text(k));
+        ctx.variables.bind(value, v);
+        let result = eval_body(body, indent, input, ctx, output);
+        ctx.variables.leave();
+        result?;
+        if ctx.returning.is_some() {
+            break;
+        }
+    }
+    Ok(())
+}
+
+/// Run `embed <source> -> <target>` from `lang 0.3`: store the vector of
+/// `source`, a variable, `input` or `msg`, or else the text itself, as a
+/// JSON array. `mem.<region>` targets keep it under `<source>.embedding`;
+/// any other target, such as `percept.text`, is the key in short-term
+/// memory.
+fn embed(
+    source: &str,
+    target: &str,
+    input: &str,
+    ctx: &mut AgentContext,
+) -> Result<(), RuntimeError> {
+    let text = match ctx.variables.get(source) {
+        Some(value) => value.to_string(),
+        None if source == "input" || source == "msg" => input.to_string(),
+        None => source.to_string(),
+    };
+    let vector = ctx
+        .embedder
+        .embed(&text)
+        .map_err(|e| RuntimeError::from(e).in_statement("embed"))?;
+    crate::metrics::global().embedding_computed();
+    let (region, key) = match target.strip_prefix("mem.") {
+        Some(region) => (region, format!("{}.embedding", source)),
+        None => ("short", target.to_string()),
+    };
+    let value = serde_json::to_string(&vector).expect("vectors serialize");
+    ctx.try_set_mem(region, &key, &value)
+        .map_err(|e| RuntimeError::from(e).in_statement("embed"))
+}
+
+/// Run `recall <query> top <n>`, printing the entries found as `output`
+/// lines and keeping them in `ctx.output`.
+fn recall(
+    query: &Expr,
+    top: usize,
+    indent: &str,
+    input: &str,
+    ctx: &mut AgentContext,
+    output: &mut Vec<String>,
+) -> Result<(), RuntimeError> {
+    let query =
+        expr::evaluate(query, indent, input, ctx, output).map_err(|e| e.in_statement("recall"))?;
+    let lines: Vec<String> = recall::nearest(ctx, &query.to_string(), top)
+        .map_err(|e| e.in_statement("recall"))?
+        .into_iter()
+        .map(|hit| format!("{} {:.3}", hit.entry, hit.score))
+        .collect();
+    ctx.output = Some(lines.join("\n"));
+    output.extend(lines.iter().map(|line| format!("{}{}", indent, line)));
+    Ok(())
+}
+
+/// Run `ask <prompt> -> mem.<target>["<key>"]`, storing the answer.
+#[allow(clippy::too_many_arguments)]
+fn ask(
+    prompt: &Text,
+    options: &[(String, String)],
+    target: &str,
+    key: &str,
+    indent: &str,
+    input: &str,
+    ctx: &mut AgentContext,
+    output: &mut Vec<String>,
+) -> Result<(), RuntimeError> {
+    require(ctx, "llm").map_err(|e| e.in_statement("ask"))?;
+    let prompt = match prompt {
+        Text::Literal(text) => interpolate(text, input, ctx),
+        Text::Expr(value) => text_of(value, true, "ask", indent, input, ctx, output)?,
+        Text::Template { name, args } => {
+            template::render(ctx, name, args, input).map_err(|e| e.in_statement("ask"))?
+        }
+    };
+    let deadline = ctx.statement_deadline();
+    let answer = LlmRequest::from_options(prompt, options)
+        .and_then(|(provider, mut request)| {
+            let provider = ctx.llm.get(provider.as_deref())?;
+            request.deadline = deadline;
+            llm::tools::complete(&*provider, request, ctx)
+        })
+        .map_err(|e| timed_out(RuntimeError::from(e), deadline).in_statement("ask"))?;
+    llm::record_usage(ctx, &answer);
+    ctx.try_set_mem(target, key, &answer.text)
+        .map_err(|e| RuntimeError::from(e).in_statement("ask"))
+}
+
+/// The text of `value`, the expression a `print`, `emit` or `ask` gives,
+/// with the placeholders of its strings filled in if `fill`.
+fn text_of(
+    value: &Expr,
+    fill: bool,
+    statement: &str,
+    indent: &str,
+    input: &str,
+    ctx: &mut AgentContext,
+    output: &mut Vec<String>,
+) -> Result<String, RuntimeError> {
+    let filled;
+    let value = if fill {
+        filled = expr::interpolate(value, input, ctx);
+        &filled
+    } else {
+        value
+    };
+    expr::evaluate(value, indent, input, ctx, output)
+        .map(|value| value.to_string())
+        .map_err(|e| e.in_statement(statement))
+}
+
+/// Run `print <value>` for an expression other than a lone string.
+fn print(
+    value: &Expr,
+    indent: &str,
+    input: &str,
+    ctx: &mut AgentContext,
+    output: &mut Vec<String>,
+) -> Result<(), RuntimeError> {
+    let fill = ctx.lang >= Version::V0_2;
+    let text = text_of(value, fill, "print", indent, input, ctx, output)?;
+    output.push(format!("{}{}", indent, text));
+    Ok(())
+}
+
+/// Run `emit <value>`, printing the value and keeping it as a response.
+fn emit(
+    value: &Expr,
+    indent: &str,
+    input: &str,
+    ctx: &mut AgentContext,
+    output: &mut Vec<String>,
+) -> Result<(), RuntimeError> {
+    let fill = ctx.lang >= Version::V0_2;
+    let value = text_of(value, fill, "emit", indent, input, ctx, output)?;
+    output.push(format!("{}{}", indent, value));
+    ctx.responses.push(value);
+    Ok(())
+}
+
+/// Run `send <agent> <message>`, adding what the agent's handler prints to
+/// `output`; see [`agents::send`].
+fn send(
+    agent: &str,
+    message: &Expr,
+    indent: &str,
+    input: &str,
+    ctx: &mut AgentContext,
+    output: &mut Vec<String>,
+) -> Result<(), RuntimeError> {
+    let message =
+        expr::evaluate(message, indent, input, ctx, output).map_err(|e| e.in_statement("send"))?;
+    let lines = agents::send(ctx, agent, &message.to_string(), indent)
+        .map_err(|e| e.in_statement("send"))?;
+    output.extend(lines);
+    Ok(())
+}
+
+/// The error of a loop that ran into [`Limits::loop_iterations`].
+///
+/// [`Limits::loop_iterations`]: crate::limits::Limits::loop_iterations
+fn loop_limit(limit: usize) -> RuntimeError {
+    RuntimeError::new(RuntimeErrorKind::Limit(LimitError::LoopIterations {
+        limit,
+    }))
+}
+
+/// Evaluate the statements of a block in a scope of its own, so the
+/// variables they bind end with it.
+pub(crate) fn eval_body(
+    body: &[Statement],
+    indent: &str,
+    input: &str,
+    ctx: &mut AgentContext,
+    output: &mut Vec<String>,
+) -> Result<(), RuntimeError> {
+    ctx.variables.enter();
+    let mut result = Ok(());
+    for stmt in body {
+        result = eval(stmt, indent, input, ctx, output);
+        // A `return` ends every block up to the function it returns from.
+        if result.is_err() || ctx.returning.is_some() {
+            break;
+        }
+    }
+    ctx.variables.leave();
+    result
+}
+
+/// Short keyword naming a statement, used as error context.
+pub fn statement_name(stmt: &Statement) -> &'static str {
+    match stmt {
+        Statement::AgentDeclaration { .. } => "agent",
+        Statement::MemDeclaration { .. } => "mem",
+        Statement::OnInput { .. } => "on input",
+        Statement::OnSchedule { .. } => "on schedule",
+        Statement::OnStart { .. } => "on start",
+        Statement::OnStop { .. } => "on stop",
+        Statement::OnOutput { .. } => "on output",
+        Statement::Pipeline { .. } => "pipeline",
+        Statement::Import(_) => "import",
+        Statement::Lang(_) => "lang",
+        Statement::Reflect { .. }
+        | Statement::ReflectAccess { .. }
+        | Statement::Attention { .. } => "reflect",
+        Statement::Train { .. } => "train",
+        Statement::Evolve { .. } => "evolve",
+        Statement::Propose(_) => "propose",
+        Statement::Goal(_) => "goal",
+        Statement::Capabilities(_) => "capabilities",
+        Statement::Embed { .. } => "embed",
+        Statement::IfContextIncludes { .. }
+        | Statement::If { .. }
+        | Statement::IfElse { .. }
+        | Statement::IfState { .. }
+        | Statement::IfReward { .. } => "if",
+        Statement::Reward(_) => "reward",
+        Statement::Template { .. } => "template",
+        Statement::Print(_) => "print",
+        Statement::Ask { .. } => "ask",
+        Statement::Fetch { .. } => "fetch",
+        Statement::Exec { .. } => "exec",
+        Statement::ReadFile { .. } => "read",
+        Statement::WriteFile { .. } => "write",
+        Statement::Assignment(..) | Statement::Assign { .. } => "assignment",
+        Statement::Function { .. } => "fn",
+        Statement::Return(_) => "return",
+        Statement::Recall { .. } => "recall",
+        Statement::Send { .. } => "send",
+        Statement::Emit(_) => "emit",
+        Statement::Call { .. } => "call",
+        Statement::While { .. } => "while",
+        Statement::For { .. } => "for",
+        Statement::Let { .. } => "let",
+        Statement::Unknown(_) => "unknown",
+        Statement::Location { .. } => "location",
+    }
+}
+
 /// Evaluate a single AST statement in the given context.
 pub fn eval(
     stmt: &Statement,
@@ -15,9 +626,46 @@ pub fn eval(
     input: &str,
     ctx: &mut AgentContext,
     output: &mut Vec<String>,
-) {
+) -> Result<(), RuntimeError> {
+    if let Statement::Location { line, depth } = stmt {
+        if let Some(coverage) = &mut ctx.coverage {
+            coverage.hit(*line);
+        }
+        if let Some(debugger) = ctx.debugger.clone() {
+            debugger.pause_at(*line, *depth, ctx);
+        }
+        return Ok(());
+    }
+    if ctx
+        .deadline
+        .is_some_and(|deadline| Instant::now() >= deadline)
+    {
+        return Err(RuntimeError::new(RuntimeErrorKind::Timeout(
+            "the handler ran past its deadline".to_string(),
+        )));
+    }
+    let _span = tracing::debug_span!("eval", statement = statement_name(stmt)).entered();
+    let started = std::time::Instant::now();
+    let result = eval_statement(stmt, indent, input, ctx, output);
+    tracing::debug!(
+        duration_us = started.elapsed().as_micros() as u64,
+        "statement evaluated"
+    );
+    result
+}
+
+fn eval_statement(
+    stmt: &Statement,
+    indent: &str,
+    input: &str,
+    ctx: &mut AgentContext,
+    output: &mut Vec<String>,
+) -> Result<(), RuntimeError> {
     match stmt {
         Statement::AgentDeclaration { name, body } => {
+            // The agent this one replaces stops first.
+            let stopped = run_hook(ctx, "stop", indent).map_err(|e| e.in_statement("on stop"))?;
+            output.extend(stopped);
             output.push(format!("Agent: {}", name));
             for inner in body.iter() {
                 match inner {
@@ -27,65 +675,558 @@ pub fn eval(
                     Statement::Goal(text) => {
                         output.push(format!("  Goal: \"{}\"", text));
                     }
+                    Statement::Capabilities(capabilities) if capabilities.is_empty() => {
+                        output.push("  Capabilities: none".to_string());
+                    }
+                    Statement::Capabilities(capabilities) => {
+                        output.push(format!("  Capabilities: {}", capabilities.join(", ")));
+                    }
                     _ => {}
                 }
             }
-            ctx.current_agent = Some(stmt.clone());
+            agents::declare(ctx, stmt.clone());
             output.push(format!("Agent: {} [registered]", name));
+            let started = run_hook(ctx, "start", indent).map_err(|e| e.in_statement("on start"))?;
+            output.extend(started);
         }
         Statement::MemDeclaration { .. } => {}
         Statement::OnInput { param, body } => {
-            ctx.set_mem("short", param, input);
-            for inner in body.iter() {
-                eval(inner, indent, input, ctx, output);
-            }
+            ctx.try_set_mem("short", param, input)
+                .map_err(|e| RuntimeError::from(e).in_statement("on input"))?;
+            eval_body(body, indent, input, ctx, output)?;
         }
+        // Only the scheduler runs these, via `run_block`.
+        Statement::OnSchedule { .. } => {}
+        // Run when an agent is registered or stopped, via `run_hook`.
+        Statement::OnStart { .. } | Statement::OnStop { .. } => {}
+        // Run by `run_handler` after the handler that emitted.
+        Statement::OnOutput { .. } => {}
+        // Each agent runs in its own `SentienceAgent`; an `AgentSet` passes
+        // input along the stages.
+        Statement::Pipeline { .. } => {}
+        Statement::Lang(version) => ctx.lang = *version,
+        Statement::Import(module) => {
+            let program = ctx
+                .packages
+                .load(module)
+                .map_err(|e| e.in_statement("import"))?;
+            // A module's pragma applies to the module, not the importer.
+            let lang = std::mem::replace(&mut ctx.lang, crate::lang::default_version());
+            let result = program
+                .statements
+                .iter()
+                .try_for_each(|inner| eval(inner, indent, input, ctx, output));
+            ctx.lang = lang;
+            result?;
+        }
+        // Read from the current agent by `require`.
+        Statement::Capabilities(_) => {}
         Statement::Reflect { body } => {
             let nested_indent = format!("{}  ", indent);
             for inner in body.iter() {
-                eval(inner, &nested_indent, input, ctx, output);
+                eval(inner, &nested_indent, input, ctx, output)?;
             }
         }
         Statement::ReflectAccess { mem_target, key } => {
-            let val = match mem_target.as_str() {
-                "short" => ctx.get_mem("short", key),
-                "long" => ctx.get_mem("long", key),
-                _ => String::new(),
-            };
+            let val = ctx
+                .try_get_mem(mem_target, key)
+                .map_err(|e| RuntimeError::from(e).in_statement(statement_name(stmt)))?;
+            if mem_target == "short" {
+                ctx.attention.touch(key);
+            }
+            ctx.affect.react("reflected", Some(key));
+            let _ = ctx.record(AgentEvent::Reflected {
+                region: mem_target.clone(),
+                key: key.clone(),
+                value: val.clone(),
+            });
             ctx.output = Some(val.clone());
             output.push(format!("{}{}", indent, val));
         }
+        Statement::Attention { top } => {
+            let lines: Vec<String> = attention::top(ctx, input, *top)
+                .into_iter()
+                .map(|focus| format!("{}: {}", focus.key, focus.value))
+                .collect();
+            ctx.output = Some(lines.join("\n"));
+            output.extend(lines.iter().map(|line| format!("{}{}", indent, line)));
+        }
+        Statement::Recall { query, top } => recall(query, *top, indent, input, ctx, output)?,
+        Statement::Send { agent, message } => send(agent, message, indent, input, ctx, output)?,
+        Statement::Emit(value) => emit(value, indent, input, ctx, output)?,
         Statement::Train { .. } => {}
         Statement::Evolve { .. } => {}
+        Statement::Propose(mutation) => {
+            evolve::propose(ctx, mutation).map_err(|e| e.in_statement(statement_name(stmt)))?;
+            output.push(format!("{}proposed {}", indent, print_mutation(mutation)));
+        }
         Statement::Goal(_) => {}
-        Statement::Embed { .. } => {}
-        Statement::IfContextIncludes { values, body } => {
-            let current_val = ctx.get_mem("short", "msg");
-            for v in values.iter() {
-                if current_val.contains(v) {
-                    for inner in body.iter() {
-                        eval(inner, indent, input, ctx, output);
-                    }
-                    break;
-                }
+        Statement::Embed { source, target } if ctx.lang >= Version::V0_3 => {
+            embed(source, target, input, ctx)?
+        }
+        Statement::Embed { .. } => crate::metrics::global().embedding_computed(),
+        Statement::IfContextIncludes { .. }
+        | Statement::If { .. }
+        | Statement::IfState { .. }
+        | Statement::IfReward { .. } => {
+            if let Some(body) = taken(stmt, indent, input, ctx, output)? {
+                eval_body(body, indent, input, ctx, output)?;
             }
         }
-        Statement::Print(text) => {
+        Statement::IfElse { branch, otherwise } => {
+            let body = taken(branch, indent, input, ctx, output)?.unwrap_or(otherwise);
+            eval_body(body, indent, input, ctx, output)?;
+        }
+        Statement::Reward(value) => {
+            let value = value.parse().unwrap_or(f64::NAN);
+            match ctx.rewards.reward(value) {
+                Some(behavior) => tracing::debug!(behavior, value, "rewarded"),
+                None => tracing::debug!(value, "nothing to reward"),
+            }
+        }
+        Statement::Template { name, text } => {
+            ctx.templates.insert(name.clone(), text.clone());
+        }
+        Statement::Print(Text::Literal(text)) if ctx.lang >= Version::V0_2 => {
+            output.push(format!("{}{}", indent, interpolate(text, input, ctx)));
+        }
+        Statement::Print(Text::Literal(text)) => {
             output.push(format!("{}{}", indent, text));
         }
-        Statement::Assignment(name, expr) => {
-            if name == "output" {
-                let val = eval_expr(expr, input, ctx);
-                ctx.output = Some(val.clone());
-                output.push(val);
-                return;
+        Statement::Print(Text::Template { name, args }) => {
+            let text =
+                template::render(ctx, name, args, input).map_err(|e| e.in_statement("print"))?;
+            output.push(format!("{}{}", indent, text));
+        }
+        Statement::Print(Text::Expr(value)) => print(value, indent, input, ctx, output)?,
+        Statement::Ask {
+            prompt,
+            options,
+            target,
+            key,
+        } => ask(prompt, options, target, key, indent, input, ctx, output)?,
+        Statement::Fetch {
+            url,
+            options,
+            target,
+            key,
+        } => {
+            require(ctx, "net").map_err(|e| e.in_statement("fetch"))?;
+            let url = interpolate(url, input, ctx);
+            let mut options = options.clone();
+            for (_, value) in options.iter_mut() {
+                *value = interpolate(value, input, ctx);
             }
-
+            let deadline = ctx.statement_deadline();
+            let response = FetchRequest::from_options(url, &options)
+                .and_then(|mut request| {
+                    request.timeout = cap(request.timeout, deadline);
+                    request.send(&ctx.sandbox)
+                })
+                .map_err(|e| timed_out(e, deadline).in_statement("fetch"))?;
+            ctx.try_set_mem(target, key, &response.body)
+                .and_then(|_| {
+                    ctx.try_set_mem(
+                        target,
+                        &format!("{}.status", key),
+                        &response.status.to_string(),
+                    )
+                })
+                .map_err(|e| RuntimeError::from(e).in_statement("fetch"))?;
+        }
+        Statement::Exec {
+            command,
+            options,
+            target,
+            key,
+        } => {
+            require(ctx, "exec").map_err(|e| e.in_statement("exec"))?;
+            // Split before interpolating so input cannot add arguments.
+            let words: Vec<String> = exec::split_command(command)
+                .map_err(|e| e.in_statement("exec"))?
+                .iter()
+                .map(|word| interpolate(word, input, ctx))
+                .collect();
+            let deadline = ctx.statement_deadline();
+            let result = ExecRequest::from_options(&words, options)
+                .and_then(|mut request| {
+                    request.timeout = cap(request.timeout, deadline);
+                    request.run(&ctx.sandbox)
+                })
+                .map_err(|e| timed_out(e, deadline).in_statement("exec"))?;
+            let stored = [
+                (key.clone(), result.stdout),
+                (format!("{}.stderr", key), result.stderr),
+                (format!("{}.exit", key), result.exit_code.to_string()),
+            ];
+            for (name, value) in stored {
+                ctx.try_set_mem(target, &name, &value)
+                    .map_err(|e| RuntimeError::from(e).in_statement("exec"))?;
+            }
+        }
+        Statement::ReadFile { path, target, key } => {
+            require(ctx, "fs.read").map_err(|e| e.in_statement("read"))?;
+            let path = interpolate(path, input, ctx);
+            let content = ctx
+                .sandbox
+                .read_file(&path)
+                .map_err(|e| e.in_statement("read"))?;
+            ctx.try_set_mem(target, key, &content)
+                .map_err(|e| RuntimeError::from(e).in_statement("read"))?;
+        }
+        Statement::WriteFile { target, key, path } => {
+            require(ctx, "fs.write").map_err(|e| e.in_statement("write"))?;
+            let path = interpolate(path, input, ctx);
+            let content = ctx
+                .try_get_mem(target, key)
+                .map_err(|e| RuntimeError::from(e).in_statement("write"))?;
+            ctx.sandbox
+                .write_file(&path, &content)
+                .map_err(|e| e.in_statement("write"))?;
+        }
+        Statement::Let { name, value } => {
+            let value = expr::evaluate(value, indent, input, ctx, output)
+                .map_err(|e| e.in_statement("let"))?;
+            ctx.variables.bind(name, value);
+        }
+        // An agent's functions are found in its body when called.
+        Statement::Function { name, .. } => {
+            ctx.functions.insert(name.clone(), stmt.clone());
+        }
+        Statement::Return(value) => {
+            if ctx.variables.calls() == 0 {
+                return Err(RuntimeError::new(RuntimeErrorKind::Expression(
+                    "`return` outside a function".to_string(),
+                ))
+                .in_statement("return"));
+            }
+            let value = match value {
+                Some(value) => expr::evaluate(value, indent, input, ctx, output)
+                    .map_err(|e| e.in_statement("return"))?,
+                None => expr::Value::Text(String::new()),
+            };
+            ctx.returning = Some(value);
+        }
+        Statement::While { condition, body } => {
+            run_while(condition, body, indent, input, ctx, output)?;
+        }
+        Statement::For {
+            key,
+            value,
+            region,
+            body,
+        } => run_for(key, value, region, body, indent, input, ctx, output)?,
+        Statement::Call { name, args } => {
+            let args = args
+                .iter()
+                .map(|arg| expr::evaluate(arg, indent, input, ctx, output))
+                .collect::<Result<Vec<_>, _>>()
+                .map_err(|e| e.in_statement("call"))?;
+            functions::call(name, args, indent, input, ctx, output)
+                .map_err(|e| e.in_statement("call"))?;
+        }
+        Statement::Assign { name, value } => {
+            let value = expr::evaluate(value, indent, input, ctx, output)
+                .map_err(|e| e.in_statement("assignment"))?;
+            if let Err(value) = ctx.variables.set(name, value) {
+                assign(name, value, ctx, output)?;
+            }
+        }
+        Statement::Assignment(name, expr) => {
             let val = eval_expr(expr, input, ctx);
-            ctx.set_mem("short", name, &val);
+            if let Err(val) = ctx.variables.set(name, expr::Value::Text(val)) {
+                assign(name, val, ctx, output)?;
+            }
         }
         Statement::Unknown(text) => {
-            output.push(format!("{}Unknown statement: {}", indent, text));
+            return Err(RuntimeError::new(RuntimeErrorKind::UnknownStatement(
+                text.clone(),
+            )));
         }
+        Statement::Location { .. } => {}
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use crate::expr::Value;
+    use crate::limits::Limits;
+    use crate::sandbox::Sandbox;
+    use crate::SentienceAgent;
+    use std::time::{Duration, Instant};
+
+    #[cfg(unix)]
+    #[test]
+    fn stops_statements_and_handlers_at_their_deadline() {
+        let mut agent = SentienceAgent::new();
+        agent.set_sandbox(Sandbox {
+            allow_exec: true,
+            exec_allowlist: vec!["sh".to_string()],
+            ..Default::default()
+        });
+        agent
+            .run_sentience(concat!(
+                "agent Slow {\n",
+                "  on input(msg) {\n",
+                "    exec \"sh -c 'sleep 0.1'\" -> mem.short[\"first\"]\n",
+                "    exec \"sh -c 'sleep 5'\" -> mem.short[\"second\"]\n",
+                "  }\n",
+                "}\n",
+            ))
+            .unwrap();
+
+        agent.set_limits(Limits {
+            statement_timeout: Some(Duration::from_millis(300)),
+            ..Limits::default()
+        });
+        let started = Instant::now();
+        let error = agent.handle_input("go").unwrap_err();
+        assert!(started.elapsed() < Duration::from_secs(2));
+        assert_eq!(error.code(), "SEN4009");
+        assert_eq!(
+            error.to_string(),
+            "in exec: timed out: no result before the deadline"
+        );
+
+        agent.set_limits(Limits {
+            turn_timeout: Some(Duration::from_millis(50)),
+            ..Limits::default()
+        });
+        let error = agent.handle_input("go").unwrap_err();
+        assert_eq!(error.code(), "SEN4009");
+    }
+
+    #[test]
+    fn runs_lifecycle_hooks() {
+        let mut agent = SentienceAgent::new();
+        let output = agent
+            .run_sentience(concat!(
+                "agent First {\n",
+                "  on start {\n",
+                "    print \"first up\"\n",
+                "  }\n",
+                "  on stop {\n",
+                "    state = \"saved\"\n",
+                "    print \"first down\"\n",
+                "  }\n",
+                "}\n",
+                "agent Second {\n",
+                "}\n",
+            ))
+            .unwrap();
+        assert_eq!(
+            output,
+            concat!(
+                "Agent: First\n",
+                "Agent: First [registered]\n",
+                "first up\n",
+                "first down\n",
+                "Agent: Second\n",
+                "Agent: Second [registered]",
+            )
+        );
+        assert_eq!(agent.get_short("state"), "");
+        let first = &agent.ctx.memories["First"];
+        assert_eq!(first.mem_short.lookup("state"), Some("saved".into()));
+        assert_eq!(agent.stop().unwrap(), "");
+    }
+
+    #[test]
+    fn collects_emitted_responses() {
+        let mut agent = SentienceAgent::new();
+        agent
+            .run_sentience(concat!(
+                "lang 0.2\n",
+                "agent Echo {\n",
+                "  on input(msg) {\n",
+                "    print \"thinking\"\n",
+                "    emit \"Hello, \" + msg\n",
+                "  }\n",
+                "  on output(reply) {\n",
+                "    print \"sent {msg}\"\n",
+                "    emit reply + \"!\"\n",
+                "  }\n",
+                "}\n",
+            ))
+            .unwrap();
+        let output = agent.handle_input("Ana").unwrap();
+        assert_eq!(output, "thinking\nHello, Ana\nsent Hello, Ana\nHello, Ana!");
+        assert_eq!(agent.take_responses(), ["Hello, Ana", "Hello, Ana!"]);
+        assert_eq!(agent.get_short("reply"), "Hello, Ana");
+        assert!(agent.take_responses().is_empty());
+    }
+
+    #[test]
+    fn prints_expressions() {
+        let program = concat!(
+            "agent Greeter {\n",
+            "  on input(msg) {\n",
+            "    let name = msg + \"!\"\n",
+            "    print \"hello \" + mem.short[\"msg\"]\n",
+            "    print name\n",
+            "    print \"{msg} has \" + count(msg) + \" letters\"\n",
+            "    emit \"Hi {name}\" + \"?\"\n",
+            "  }\n",
+            "}\n",
+            "fn count(text) {\n",
+            "  return 3\n",
+            "}\n",
+        );
+        let mut agent = SentienceAgent::new();
+        agent
+            .run_sentience(concat!(
+                "agent Greeter {\n",
+                "  on input(msg) {\n",
+                "    print \"hello \" + mem.short[\"msg\"]\n",
+                "    print \"{msg} has \" + len(msg) + \" letters\"\n",
+                "  }\n",
+                "}\n",
+            ))
+            .unwrap();
+        assert_eq!(
+            agent.handle_input("Ana").unwrap(),
+            "hello Ana\n{msg} has 3 letters"
+        );
+
+        let mut agent = SentienceAgent::new();
+        agent
+            .run_sentience(&format!("lang 0.2\n{}", program))
+            .unwrap();
+        assert_eq!(
+            agent.handle_input("Ana").unwrap(),
+            "hello Ana\nAna!\nAna has 3 letters\nHi Ana!?"
+        );
+    }
+
+    #[test]
+    fn stores_the_value_of_every_assignment() {
+        let program = concat!(
+            "agent Keeper {\n",
+            "  on input(msg) {\n",
+            "    x = 5\n",
+            "    flag = false\n",
+            "    if flag {\n",
+            "      print \"ran\"\n",
+            "    }\n",
+            "    y = msg\n",
+            "    z = y\n",
+            "  }\n",
+            "}\n",
+        );
+        let mut agent = SentienceAgent::new();
+        agent
+            .run_sentience(&format!("lang 0.2\n{}", program))
+            .unwrap();
+        assert_eq!(agent.handle_input("Ana").unwrap(), "");
+        let short = &agent.ctx.mem_short;
+        assert_eq!(short.lookup("x"), Some(Value::Int(5)));
+        assert_eq!(short.lookup("flag"), Some(Value::Bool(false)));
+        assert_eq!(short.lookup("z"), Some("Ana".into()));
+
+        let mut agent = SentienceAgent::new();
+        agent.run_sentience(program).unwrap();
+        assert_eq!(agent.handle_input("Ana").unwrap(), "ran");
+        assert_eq!(agent.get_short("x"), "5");
+        assert_eq!(agent.get_short("z"), "y");
+    }
+
+    #[test]
+    fn tells_calls_from_template_calls() {
+        let mut agent = SentienceAgent::new();
+        agent
+            .run_sentience(concat!(
+                "lang 0.2\n",
+                "template shout = \"{text}!\"\n",
+                "agent Caller {\n",
+                "  on input(msg) {\n",
+                "    m = [1, 2, 3]\n",
+                "    print len(m)\n",
+                "    print count(msg)\n",
+                "    print shout(text: msg)\n",
+                "    emit count(msg) + len(m)\n",
+                "  }\n",
+                "}\n",
+                "fn count(text) {\n",
+                "  return len(text)\n",
+                "}\n",
+            ))
+            .unwrap();
+        assert_eq!(agent.handle_input("Ana").unwrap(), "3\n3\nAna!\n6");
+    }
+
+    #[test]
+    fn runs_loops_up_to_their_limit() {
+        let mut agent = SentienceAgent::new();
+        agent
+            .run_sentience(concat!(
+                "lang 0.2\n",
+                "agent Counter {\n",
+                "  on input(msg) {\n",
+                "    let n = 0\n",
+                "    while n < msg {\n",
+                "      n = n + 1\n",
+                "    }\n",
+                "    print \"counted {n}\"\n",
+                "    for key, value in mem.short {\n",
+                "      print \"{key}={value}\"\n",
+                "    }\n",
+                "  }\n",
+                "}\n",
+            ))
+            .unwrap();
+        agent.set_limits(Limits {
+            max_loop_iterations: Some(100),
+            ..Limits::default()
+        });
+        let output = agent.handle_input("3").unwrap();
+        assert_eq!(output, "counted 3\nmsg=3");
+        assert_eq!(agent.run_sentience("print \"{n}\"").unwrap(), "{n}");
+        let error = agent.run_sentience("while true {\n}").unwrap_err();
+        assert_eq!(error.code(), "SEN5105");
+        assert_eq!(
+            error.to_string(),
+            "runtime error: in while: loop ran 100 iterations without ending (see limits.max_loop_iterations)"
+        );
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn enforces_declared_capabilities() {
+        let mut agent = SentienceAgent::new();
+        agent.set_sandbox(Sandbox {
+            allow_exec: true,
+            exec_allowlist: vec!["echo".to_string()],
+            ..Default::default()
+        });
+        let output = agent
+            .run_sentience(concat!(
+                "agent Shell {\n",
+                "  capabilities: exec\n",
+                "  on input(msg) {\n",
+                "    exec \"echo hi\" -> mem.short[\"out\"]\n",
+                "  }\n",
+                "}\n",
+            ))
+            .unwrap();
+        assert!(output.contains("  Capabilities: exec"), "{}", output);
+        agent.handle_input("go").unwrap();
+        assert_eq!(agent.get_short("out").trim(), "hi");
+
+        agent
+            .run_sentience(concat!(
+                "agent Web {\n",
+                "  capabilities: net\n",
+                "  on input(msg) {\n",
+                "    exec \"echo hi\" -> mem.short[\"out\"]\n",
+                "  }\n",
+                "}\n",
+            ))
+            .unwrap();
+        let error = agent.handle_input("go").unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            "in exec: permission denied: agent `Web` does not declare the `exec` capability"
+        );
     }
 }
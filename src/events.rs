@@ -0,0 +1,64 @@
+use serde::Serialize;
+use serde_json::Value;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+/// Memory key an agent writes (in either region) to report that its goal
+/// has been reached, e.g. `mem.long["goal.achieved"] = "yes"`.
+pub const GOAL_ACHIEVED_KEY: &str = "goal.achieved";
+
+/// Memory key an agent writes (in either region) to report how far it is
+/// toward its goal, as a fraction (`0.4`) or a percentage (`40%`); see
+/// [`goals`](crate::goals).
+pub const GOAL_PROGRESS_KEY: &str = "goal.progress";
+
+/// Something observable an agent did, queued on the context while
+/// [`AgentContext::events`](crate::context::AgentContext::events) is enabled.
+#[derive(Clone, Debug, PartialEq, Serialize)]
+#[serde(tag = "event", rename_all = "snake_case")]
+pub enum AgentEvent {
+    /// A handler finished with non-empty output.
+    ResponseProduced {
+        handler: String,
+        input: String,
+        output: String,
+    },
+    /// A memory value was written with a different value than before.
+    MemoryChanged {
+        region: String,
+        key: String,
+        value: String,
+    },
+    /// [`GOAL_ACHIEVED_KEY`] was set; `goal` is the agent's first goal.
+    GoalAchieved { goal: String, value: String },
+    /// A `reflect` block read a memory value.
+    Reflected {
+        region: String,
+        key: String,
+        value: String,
+    },
+}
+
+impl AgentEvent {
+    /// Name used in payloads and webhook `events` filters.
+    pub fn name(&self) -> &'static str {
+        match self {
+            AgentEvent::ResponseProduced { .. } => "response_produced",
+            AgentEvent::MemoryChanged { .. } => "memory_changed",
+            AgentEvent::GoalAchieved { .. } => "goal_achieved",
+            AgentEvent::Reflected { .. } => "reflected",
+        }
+    }
+
+    /// JSON sent to webhooks and event streams: the event's fields plus
+    /// `agent` and `timestamp` (Unix seconds).
+    pub fn payload(&self, agent: &str) -> Value {
+        let mut payload = serde_json::to_value(self).unwrap_or_default();
+        payload["agent"] = agent.into();
+        payload["timestamp"] = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map(|d| d.as_secs())
+            .unwrap_or(0)
+            .into();
+        payload
+    }
+}
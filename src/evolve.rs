@@ -0,0 +1,411 @@
+//! Guarded changes an agent makes to its own definition.
+//!
+//! A `propose` statement in an `evolve` block changes nothing when it runs.
+//! The proposal is checked against the agent and held in
+//! [`AgentContext::proposals`]; [`diff`] shows what committing would change,
+//! [`commit`] applies the proposals to the running agent and [`discard`]
+//! drops them. Only the changes a [`Mutation`] describes can be proposed: a
+//! new goal, a new value for the `if state.<drive>` thresholds, and a link.
+
+use crate::context::AgentContext;
+use crate::error::{RuntimeError, RuntimeErrorKind};
+use crate::printer::{self, print_mutation, quote};
+use crate::types::{Mutation, Program, Statement};
+
+/// Goals an agent can have after its proposals are committed.
+pub const MAX_GOALS: usize = 8;
+/// Proposals held at once.
+pub const MAX_PROPOSALS: usize = 32;
+
+/// Check `mutation` against the running agent and hold it for [`commit`].
+pub fn propose(ctx: &mut AgentContext, mutation: &Mutation) -> Result<(), RuntimeError> {
+    let agent = ctx
+        .current_agent
+        .as_ref()
+        .ok_or_else(|| RuntimeError::new(RuntimeErrorKind::NoAgent))?;
+    check(agent, ctx, mutation)
+        .map_err(|reason| RuntimeError::new(RuntimeErrorKind::Rejected(reason)))?;
+    ctx.proposals.push(mutation.clone());
+    Ok(())
+}
+
+/// Why `mutation` may not be made to `agent`, given the proposals already
+/// held in `ctx`.
+fn check(agent: &Statement, ctx: &AgentContext, mutation: &Mutation) -> Result<(), String> {
+    if ctx.proposals.len() >= MAX_PROPOSALS {
+        return Err(format!("{} proposals are already waiting", MAX_PROPOSALS));
+    }
+    if ctx.proposals.contains(mutation) {
+        return Err(format!(
+            "`{}` is already proposed",
+            print_mutation(mutation)
+        ));
+    }
+    let body = match agent {
+        Statement::AgentDeclaration { body, .. } => body.as_slice(),
+        _ => &[],
+    };
+    match mutation {
+        Mutation::Goal(goal) => {
+            if goal.trim().is_empty() {
+                return Err("a goal needs some text".to_string());
+            }
+            let goals: Vec<&String> = body
+                .iter()
+                .filter_map(|stmt| match stmt {
+                    Statement::Goal(goal) => Some(goal),
+                    _ => None,
+                })
+                .chain(ctx.proposals.iter().filter_map(|proposed| match proposed {
+                    Mutation::Goal(goal) => Some(goal),
+                    _ => None,
+                }))
+                .collect();
+            if goals.contains(&goal) {
+                return Err(format!("the agent already has the goal {}", quote(goal)));
+            }
+            if goals.len() >= MAX_GOALS {
+                return Err(format!("the agent already has {} goals", MAX_GOALS));
+            }
+        }
+        Mutation::Threshold { drive, value } => {
+            if !value
+                .parse::<f64>()
+                .is_ok_and(|value| (0.0..=1.0).contains(&value))
+            {
+                return Err(format!("threshold {} is not between 0 and 1", value));
+            }
+            if !compares(body, drive) {
+                return Err(format!("no `if state.{}` condition to adjust", drive));
+            }
+        }
+        Mutation::Link { from, to } => {
+            if from.is_empty() || to.is_empty() || from == to {
+                return Err("a link needs two different ends".to_string());
+            }
+            if ctx.links.get(from) == Some(to) {
+                return Err(format!(
+                    "{} is already linked to {}",
+                    quote(from),
+                    quote(to)
+                ));
+            }
+        }
+    }
+    Ok(())
+}
+
+/// Whether `body` has an `if state.<drive>` condition at any depth.
+fn compares(body: &[Statement], drive: &str) -> bool {
+    body.iter().any(|stmt| match stmt {
+        Statement::IfState {
+            drive: compared,
+            body,
+            ..
+        } => compared == drive || compares(body, drive),
+        Statement::IfElse { branch, otherwise } => {
+            compares(std::slice::from_ref(branch), drive) || compares(otherwise, drive)
+        }
+        _ => children(stmt).is_some_and(|body| compares(body, drive)),
+    })
+}
+
+fn children(stmt: &Statement) -> Option<&[Statement]> {
+    match stmt {
+        Statement::AgentDeclaration { body, .. }
+        | Statement::OnInput { body, .. }
+        | Statement::OnSchedule { body, .. }
+        | Statement::OnStart { body }
+        | Statement::OnStop { body }
+        | Statement::OnOutput { body, .. }
+        | Statement::Reflect { body }
+        | Statement::Train { body, .. }
+        | Statement::Evolve { body }
+        | Statement::IfContextIncludes { body, .. }
+        | Statement::IfState { body, .. }
+        | Statement::Function { body, .. }
+        | Statement::While { body, .. }
+        | Statement::For { body, .. }
+        | Statement::If { body, .. }
+        | Statement::IfReward { body, .. } => Some(body),
+        _ => None,
+    }
+}
+
+fn children_mut(stmt: &mut Statement) -> Option<&mut Vec<Statement>> {
+    match stmt {
+        Statement::AgentDeclaration { body, .. }
+        | Statement::OnInput { body, .. }
+        | Statement::OnSchedule { body, .. }
+        | Statement::OnStart { body }
+        | Statement::OnStop { body }
+        | Statement::OnOutput { body, .. }
+        | Statement::Reflect { body }
+        | Statement::Train { body, .. }
+        | Statement::Evolve { body }
+        | Statement::IfContextIncludes { body, .. }
+        | Statement::IfState { body, .. }
+        | Statement::Function { body, .. }
+        | Statement::While { body, .. }
+        | Statement::For { body, .. }
+        | Statement::If { body, .. }
+        | Statement::IfReward { body, .. } => Some(body),
+        _ => None,
+    }
+}
+
+/// `agent` with `mutations` made to it. Links are memory, not part of the
+/// definition, so they leave it as it is.
+fn apply(agent: &Statement, mutations: &[Mutation]) -> Statement {
+    let mut agent = agent.clone();
+    let Statement::AgentDeclaration { body, .. } = &mut agent else {
+        return agent;
+    };
+    for mutation in mutations {
+        match mutation {
+            Mutation::Goal(goal) => {
+                let at = body
+                    .iter()
+                    .rposition(|stmt| matches!(stmt, Statement::Goal(_)))
+                    .map_or(0, |last| last + 1);
+                body.insert(at, Statement::Goal(goal.clone()));
+            }
+            Mutation::Threshold { drive, value } => set_threshold(body, drive, value),
+            Mutation::Link { .. } => {}
+        }
+    }
+    agent
+}
+
+fn set_threshold(body: &mut [Statement], drive: &str, value: &str) {
+    for stmt in body {
+        if let Statement::IfState {
+            drive: compared,
+            value: threshold,
+            ..
+        } = stmt
+        {
+            if compared == drive {
+                *threshold = value.to_string();
+            }
+        }
+        if let Some(body) = children_mut(stmt) {
+            set_threshold(body, drive, value);
+        }
+        if let Statement::IfElse { branch, otherwise } = stmt {
+            set_threshold(std::slice::from_mut(branch.as_mut()), drive, value);
+            set_threshold(otherwise, drive, value);
+        }
+    }
+}
+
+/// What committing the held proposals would change: the agent's source,
+/// with `-` before removed lines and `+` before added ones, followed by
+/// the links to add. Empty when nothing is proposed.
+pub fn diff(ctx: &AgentContext) -> Vec<String> {
+    let Some(agent) = ctx
+        .current_agent
+        .as_ref()
+        .filter(|_| !ctx.proposals.is_empty())
+    else {
+        return Vec::new();
+    };
+    let source = |agent: &Statement| {
+        printer::print(&Program {
+            statements: vec![agent.clone()],
+        })
+    };
+    let before = source(agent);
+    let after = source(&apply(agent, &ctx.proposals));
+    let mut lines = diff_lines(
+        &before.lines().collect::<Vec<_>>(),
+        &after.lines().collect::<Vec<_>>(),
+    );
+    for mutation in &ctx.proposals {
+        if let Mutation::Link { from, to } = mutation {
+            lines.push(format!("+ link {} -> {}", quote(from), quote(to)));
+        }
+    }
+    lines
+}
+
+/// Line diff of `old` and `new` by their longest common subsequence.
+fn diff_lines(old: &[&str], new: &[&str]) -> Vec<String> {
+    let mut common = vec![vec![0usize; new.len() + 1]; old.len() + 1];
+    for i in (0..old.len()).rev() {
+        for j in (0..new.len()).rev() {
+            common[i][j] = if old[i] == new[j] {
+                common[i + 1][j + 1] + 1
+            } else {
+                common[i + 1][j].max(common[i][j + 1])
+            };
+        }
+    }
+    let (mut i, mut j) = (0, 0);
+    let mut lines = Vec::new();
+    while i < old.len() || j < new.len() {
+        if i < old.len() && j < new.len() && old[i] == new[j] {
+            lines.push(format!("  {}", old[i]));
+            i += 1;
+            j += 1;
+        } else if i < old.len() && (j == new.len() || common[i + 1][j] >= common[i][j + 1]) {
+            lines.push(format!("- {}", old[i]));
+            i += 1;
+        } else {
+            lines.push(format!("+ {}", new[j]));
+            j += 1;
+        }
+    }
+    lines
+}
+
+/// Apply the held proposals to the running agent and its links, checking
+/// each again against the agent as it is now. Returns what was applied.
+pub fn commit(ctx: &mut AgentContext) -> Result<Vec<String>, RuntimeError> {
+    let proposals = std::mem::take(&mut ctx.proposals);
+    let agent = ctx
+        .current_agent
+        .clone()
+        .ok_or_else(|| RuntimeError::new(RuntimeErrorKind::NoAgent))?;
+    for mutation in &proposals {
+        if let Err(reason) = check(&agent, ctx, mutation) {
+            ctx.proposals = proposals;
+            return Err(RuntimeError::new(RuntimeErrorKind::Rejected(reason)));
+        }
+        ctx.proposals.push(mutation.clone());
+    }
+    ctx.proposals.clear();
+    ctx.current_agent = Some(apply(&agent, &proposals));
+    for mutation in &proposals {
+        if let Mutation::Link { from, to } = mutation {
+            ctx.links.insert(from.clone(), to.clone());
+        }
+    }
+    Ok(proposals.iter().map(print_mutation).collect())
+}
+
+/// Drop the held proposals, returning how many there were.
+pub fn discard(ctx: &mut AgentContext) -> usize {
+    std::mem::take(&mut ctx.proposals).len()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::eval::run_block;
+    use crate::replkit::Repl;
+
+    const PROGRAM: &str = concat!(
+        "agent Tuner {\n",
+        "  goal: \"Stay calm\"\n",
+        "  on input(msg) {\n",
+        "    if state.frustration > 0.7 {\n",
+        "      print \"slow down\"\n",
+        "    }\n",
+        "  }\n",
+        "  evolve {\n",
+        "    propose goal \"Ask before acting\"\n",
+        "    propose threshold frustration 0.5\n",
+        "    propose link \"Tuner\" -> \"Mentor\"\n",
+        "  }\n",
+        "}\n",
+    );
+
+    #[test]
+    fn proposals_wait_for_an_explicit_commit() {
+        let mut repl = Repl::new(&b""[..], Vec::new());
+        repl.eval_source(PROGRAM).unwrap();
+        let ctx = repl.context_mut();
+        run_block(ctx, "evolve", "", "").unwrap();
+        assert_eq!(ctx.proposals.len(), 3);
+        let before = ctx.current_agent.clone();
+
+        assert_eq!(
+            diff(ctx),
+            [
+                "  agent Tuner {",
+                "    goal: \"Stay calm\"",
+                "+   goal: \"Ask before acting\"",
+                "    on input(msg) {",
+                "-     if state.frustration > 0.7 {",
+                "+     if state.frustration > 0.5 {",
+                "        print \"slow down\"",
+                "      }",
+                "    }",
+                "    evolve {",
+                "      propose goal \"Ask before acting\"",
+                "      propose threshold frustration 0.5",
+                "      propose link \"Tuner\" -> \"Mentor\"",
+                "    }",
+                "  }",
+                "+ link \"Tuner\" -> \"Mentor\"",
+            ]
+        );
+        assert_eq!(ctx.current_agent, before);
+
+        let applied = commit(ctx).unwrap();
+        assert_eq!(applied.len(), 3);
+        assert!(ctx.proposals.is_empty());
+        assert_eq!(ctx.links.get("Tuner").map(String::as_str), Some("Mentor"));
+        let info = crate::introspect::describe(ctx).unwrap();
+        assert_eq!(info.goals, ["Stay calm", "Ask before acting"]);
+
+        // The same proposals are now rejected, and rejected ones are not held.
+        let err = run_block(ctx, "evolve", "", "").unwrap_err();
+        assert_eq!(err.code(), "SEN4011");
+        assert_eq!(
+            err.to_string(),
+            "in propose: proposal rejected: the agent already has the goal \"Ask before acting\""
+        );
+        assert!(ctx.proposals.is_empty());
+    }
+
+    #[test]
+    fn rejects_changes_outside_the_rules() {
+        let mut repl = Repl::new(&b""[..], Vec::new());
+        repl.eval_source(PROGRAM).unwrap();
+        let ctx = repl.context_mut();
+        let rejected = |ctx: &mut AgentContext, mutation: Mutation| {
+            propose(ctx, &mutation).unwrap_err().to_string()
+        };
+        assert_eq!(
+            rejected(
+                ctx,
+                Mutation::Threshold {
+                    drive: "curiosity".to_string(),
+                    value: "0.5".to_string(),
+                }
+            ),
+            "proposal rejected: no `if state.curiosity` condition to adjust"
+        );
+        assert_eq!(
+            rejected(
+                ctx,
+                Mutation::Threshold {
+                    drive: "frustration".to_string(),
+                    value: "7".to_string(),
+                }
+            ),
+            "proposal rejected: threshold 7 is not between 0 and 1"
+        );
+        assert_eq!(
+            rejected(
+                ctx,
+                Mutation::Link {
+                    from: "a".to_string(),
+                    to: "a".to_string(),
+                }
+            ),
+            "proposal rejected: a link needs two different ends"
+        );
+        for n in 0..MAX_GOALS - 1 {
+            propose(ctx, &Mutation::Goal(format!("goal {}", n))).unwrap();
+        }
+        assert_eq!(
+            rejected(ctx, Mutation::Goal("one more".to_string())),
+            "proposal rejected: the agent already has 8 goals"
+        );
+        assert_eq!(discard(ctx), MAX_GOALS - 1);
+        assert!(diff(ctx).is_empty());
+    }
+}
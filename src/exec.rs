@@ -0,0 +1,204 @@
+use crate::error::{RuntimeError, RuntimeErrorKind};
+use crate::sandbox::Sandbox;
+use std::io::Read;
+use std::process::{Command, Stdio};
+use std::thread;
+use std::time::{Duration, Instant};
+
+/// Timeout used when an `exec` statement does not set one.
+pub const DEFAULT_TIMEOUT: Duration = Duration::from_secs(30);
+
+/// A command run by an `exec` statement. It is started directly, without a
+/// shell, so pipes, globs and variable expansion are not available.
+#[derive(Clone, Debug, PartialEq)]
+pub struct ExecRequest {
+    pub program: String,
+    pub args: Vec<String>,
+    pub timeout: Duration,
+}
+
+#[derive(Clone, Debug, PartialEq)]
+pub struct ExecOutput {
+    pub stdout: String,
+    pub stderr: String,
+    /// Exit status, or -1 if the process was killed by a signal.
+    pub exit_code: i32,
+}
+
+impl ExecRequest {
+    /// Build a request from a command line and `exec` options (`timeout`
+    /// in seconds).
+    pub fn from_options(
+        command: &[String],
+        options: &[(String, String)],
+    ) -> Result<Self, RuntimeError> {
+        let (program, args) = command
+            .split_first()
+            .ok_or_else(|| exec_error("empty command"))?;
+        let mut request = ExecRequest {
+            program: program.clone(),
+            args: args.to_vec(),
+            timeout: DEFAULT_TIMEOUT,
+        };
+
+        for (name, value) in options {
+            let invalid = || exec_error(&format!("invalid exec option {}: `{}`", name, value));
+            match name.as_str() {
+                "timeout" => {
+                    let secs: f64 = value.parse().map_err(|_| invalid())?;
+                    request.timeout = Duration::try_from_secs_f64(secs).map_err(|_| invalid())?;
+                }
+                _ => return Err(invalid()),
+            }
+        }
+        Ok(request)
+    }
+
+    /// Run the command if `sandbox` allows it, in the workspace directory
+    /// when one is set. A non-zero exit is reported in the output, not as
+    /// an error.
+    pub fn run(&self, sandbox: &Sandbox) -> Result<ExecOutput, RuntimeError> {
+        sandbox.check_command(&self.program)?;
+
+        let mut command = Command::new(&self.program);
+        command
+            .args(&self.args)
+            .stdin(Stdio::null())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped());
+        if let Some(dir) = &sandbox.workspace {
+            command.current_dir(dir);
+        }
+        let mut child = command
+            .spawn()
+            .map_err(|e| exec_error(&format!("{}: {}", self.program, e)))?;
+
+        // Drain both pipes concurrently so a chatty child cannot block.
+        let mut stdout = child.stdout.take().expect("stdout is piped");
+        let mut stderr = child.stderr.take().expect("stderr is piped");
+        let out = thread::spawn(move || {
+            let mut buf = Vec::new();
+            let _ = stdout.read_to_end(&mut buf);
+            buf
+        });
+        let err = thread::spawn(move || {
+            let mut buf = Vec::new();
+            let _ = stderr.read_to_end(&mut buf);
+            buf
+        });
+
+        let deadline = Instant::now() + self.timeout;
+        let status = loop {
+            match child.try_wait() {
+                Ok(Some(status)) => break status,
+                Ok(None) if Instant::now() >= deadline => {
+                    let _ = child.kill();
+                    let _ = child.wait();
+                    return Err(exec_error(&format!(
+                        "{} timed out after {:?}",
+                        self.program, self.timeout
+                    )));
+                }
+                Ok(None) => thread::sleep(Duration::from_millis(10)),
+                Err(e) => return Err(exec_error(&e.to_string())),
+            }
+        };
+
+        Ok(ExecOutput {
+            stdout: String::from_utf8_lossy(&out.join().unwrap_or_default()).into_owned(),
+            stderr: String::from_utf8_lossy(&err.join().unwrap_or_default()).into_owned(),
+            exit_code: status.code().unwrap_or(-1),
+        })
+    }
+}
+
+/// Split a command line into words on whitespace, honouring single and
+/// double quotes and backslash escapes.
+pub fn split_command(line: &str) -> Result<Vec<String>, RuntimeError> {
+    let mut words = Vec::new();
+    let mut word = String::new();
+    let mut in_word = false;
+    let mut quote = None;
+    let mut chars = line.chars();
+
+    while let Some(c) = chars.next() {
+        match (quote, c) {
+            (Some(q), c) if c == q => quote = None,
+            (Some('"'), '\\') | (None, '\\') => {
+                word.extend(chars.next());
+                in_word = true;
+            }
+            (Some(_), c) => word.push(c),
+            (None, '"') | (None, '\'') => {
+                quote = Some(c);
+                in_word = true;
+            }
+            (None, c) if c.is_whitespace() => {
+                if in_word {
+                    words.push(std::mem::take(&mut word));
+                    in_word = false;
+                }
+            }
+            (None, c) => {
+                word.push(c);
+                in_word = true;
+            }
+        }
+    }
+    if quote.is_some() {
+        return Err(exec_error("unterminated quote in command"));
+    }
+    if in_word {
+        words.push(word);
+    }
+    Ok(words)
+}
+
+fn exec_error(msg: &str) -> RuntimeError {
+    RuntimeError::new(RuntimeErrorKind::Exec(msg.to_string()))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn splits_quoted_words() {
+        assert_eq!(
+            split_command(r#"grep -c "two words" 'it''s' a\ b"#).unwrap(),
+            ["grep", "-c", "two words", "its", "a b"]
+        );
+        assert!(split_command("echo \"open").is_err());
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn runs_allowed_commands_only() {
+        let request =
+            |line: &str| ExecRequest::from_options(&split_command(line).unwrap(), &[]).unwrap();
+        let sandbox = Sandbox {
+            allow_exec: true,
+            exec_allowlist: vec!["sh".to_string()],
+            ..Default::default()
+        };
+
+        let output = request("sh -c 'echo out; echo err >&2; exit 3'")
+            .run(&sandbox)
+            .unwrap();
+        assert_eq!(output.stdout, "out\n");
+        assert_eq!(output.stderr, "err\n");
+        assert_eq!(output.exit_code, 3);
+
+        let denied = request("ls").run(&sandbox).unwrap_err();
+        assert!(matches!(denied.kind, RuntimeErrorKind::Denied(_)));
+        let disabled = request("sh -c true").run(&Sandbox::default()).unwrap_err();
+        assert!(matches!(disabled.kind, RuntimeErrorKind::Denied(_)));
+
+        let mut slow = request("sh -c 'sleep 5'");
+        slow.timeout = Duration::from_millis(100);
+        assert!(matches!(
+            slow.run(&sandbox).unwrap_err().kind,
+            RuntimeErrorKind::Exec(_)
+        ));
+    }
+}
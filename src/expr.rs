@@ -0,0 +1,824 @@
+//! Evaluating expressions, such as the condition of an `if`, against an
+//! agent's context.
+//!
+//! ```text
+//! if loss > 0.1 && mem.short["mood"] == "calm" { ... }
+//! ```
+//!
+//! Names read a variable bound with `let`, the input (`input` and `msg`)
+//! or short-term memory, where a handler's parameter is kept.
+//! `state.<drive>` reads a drive, `reward.<behavior>.<stat>` a reward
+//! statistic and `mem.<region>[key]` a memory value, which is empty when
+//! the key was never written.
+//! `name(args)` calls a function declared with `fn`; see
+//! [`functions`](crate::functions).
+//!
+//! A [`Value`] is text, a whole or fractional number, a boolean, a list or
+//! a map, and from `lang 0.2` memory keeps the kind it was written as:
+//! `n = 1 + 1` stores the number 2. Text that reads as a number is taken as one where a number
+//! is needed, so `mem.short["count"] > 3` compares numbers even when the
+//! count was stored as text. `<`, `<=`, `>` and `>=` compare numbers
+//! whenever both sides read as one and strings otherwise; `==` and `!=`
+//! compare numbers only when either side is one, so `mem.short["v"] ==
+//! "1.0"` compares strings, and lists and maps by their contents. `+` adds
+//! numbers under the same rule, joins anything else with text, and joins
+//! lists with lists and maps with maps. Arithmetic on whole numbers stays
+//! whole unless `/` leaves a fraction. `&&`, `||` and `!` take `false`, `0`
+//! and empty text, lists and maps as false and anything else as true, and
+//! `&&` and `||` only evaluate their right side when they need it. A value
+//! that cannot be taken as what an operator needs, such as `-` on a word,
+//! fails with the rule it broke; anything else, such as dividing by zero,
+//! is an error too.
+
+use crate::affect;
+use crate::context::AgentContext;
+use crate::error::{RuntimeError, RuntimeErrorKind};
+use crate::eval;
+use crate::functions;
+use crate::printer::print_expr;
+use crate::types::{BinaryOp, Expr, UnaryOp};
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashMap};
+use std::fmt;
+
+/// What an expression evaluates to, and what memory holds.
+///
+/// Values are saved as the JSON they read as, so text is a JSON string and
+/// a list a JSON array; memory saved when it could only hold text loads as
+/// text.
+#[derive(Clone, Debug, PartialEq, Serialize, Deserialize)]
+#[serde(untagged)]
+pub enum Value {
+    Text(String),
+    Int(i64),
+    Float(f64),
+    Bool(bool),
+    List(Vec<Value>),
+    Map(BTreeMap<String, Value>),
+}
+
+impl Value {
+    /// Whether the value counts as true in a condition.
+    pub fn truthy(&self) -> bool {
+        match self {
+            Value::Text(text) => !text.is_empty(),
+            Value::Int(number) => *number != 0,
+            Value::Float(number) => *number != 0.0 && !number.is_nan(),
+            Value::Bool(value) => *value,
+            Value::List(items) => !items.is_empty(),
+            Value::Map(entries) => !entries.is_empty(),
+        }
+    }
+
+    /// The value as a number, if it is one or is text that reads as one: a
+    /// decimal such as `"-2.5"`, but not `"inf"`, `"nan"` or `"1e400"`.
+    pub fn as_number(&self) -> Option<f64> {
+        match self {
+            Value::Int(number) => Some(*number as f64),
+            Value::Float(number) => Some(*number),
+            Value::Text(text) => decimal(text.trim()),
+            _ => None,
+        }
+    }
+
+    /// The value as a whole number, if it is one or is text that reads as
+    /// one, such as `"3"` but not `"3.0"`.
+    pub fn as_int(&self) -> Option<i64> {
+        match self {
+            Value::Int(number) => Some(*number),
+            Value::Text(text) => {
+                let text = text.trim();
+                if is_decimal(text) && !text.contains('.') {
+                    text.parse().ok()
+                } else {
+                    None
+                }
+            }
+            _ => None,
+        }
+    }
+
+    /// Whether the value is a number rather than text that may read as one.
+    pub fn is_number(&self) -> bool {
+        matches!(self, Value::Int(_) | Value::Float(_))
+    }
+
+    /// Bytes the value takes: the length of text, and of the JSON of
+    /// anything else.
+    pub fn size(&self) -> usize {
+        match self {
+            Value::Text(text) => text.len(),
+            other => other.to_string().len(),
+        }
+    }
+
+    /// What kind of value this is, as errors name it.
+    pub fn kind(&self) -> &'static str {
+        match self {
+            Value::Text(_) => "text",
+            Value::Int(_) => "integer",
+            Value::Float(_) => "number",
+            Value::Bool(_) => "boolean",
+            Value::List(_) => "list",
+            Value::Map(_) => "map",
+        }
+    }
+}
+
+impl fmt::Display for Value {
+    /// Text as it is, and other values as the JSON they are saved as.
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Value::Text(text) => f.write_str(text),
+            Value::Int(number) => write!(f, "{}", number),
+            Value::Float(number) => write!(f, "{}", number),
+            Value::Bool(value) => write!(f, "{}", value),
+            Value::List(_) | Value::Map(_) => {
+                f.write_str(&serde_json::to_string(self).map_err(|_| fmt::Error)?)
+            }
+        }
+    }
+}
+
+impl From<&str> for Value {
+    fn from(text: &str) -> Self {
+        Value::Text(text.to_string())
+    }
+}
+
+impl From<String> for Value {
+    fn from(text: String) -> Self {
+        Value::Text(text)
+    }
+}
+
+/// Variables bound with `let`. Each handler run and each block of an `if`
+/// has a scope of its own, whose variables end with it; names are looked
+/// up from the innermost scope out, so an inner `let` hides an outer one
+/// until its block ends. Statements run outside any handler, such as at
+/// the REPL prompt, bind in an outermost scope that lasts the session.
+///
+/// A function call starts a frame: its body sees its parameters, its own
+/// variables and the session's, but not those of its caller.
+#[derive(Clone, Debug)]
+pub struct Variables {
+    scopes: Vec<HashMap<String, Value>>,
+    /// Index in `scopes` of the first scope of each call, outermost first.
+    frames: Vec<usize>,
+}
+
+impl Default for Variables {
+    fn default() -> Self {
+        Self {
+            scopes: vec![HashMap::new()],
+            frames: Vec::new(),
+        }
+    }
+}
+
+impl Variables {
+    /// The value of the innermost variable called `name` visible from the
+    /// current call.
+    pub fn get(&self, name: &str) -> Option<&Value> {
+        let start = self.frames.last().copied().unwrap_or(0);
+        self.scopes[start..]
+            .iter()
+            .rev()
+            .chain(self.scopes[..start.min(1)].iter())
+            .find_map(|scope| scope.get(name))
+    }
+
+    /// Bind `name` to `value` in the innermost scope.
+    pub fn bind(&mut self, name: &str, value: Value) {
+        if let Some(scope) = self.scopes.last_mut() {
+            scope.insert(name.to_string(), value);
+        }
+    }
+
+    /// Give the innermost variable called `name` visible from the current
+    /// call the value `value`, or hand `value` back if there is none.
+    pub fn set(&mut self, name: &str, value: Value) -> Result<(), Value> {
+        let start = self.frames.last().copied().unwrap_or(0);
+        let (globals, current) = self.scopes.split_at_mut(start);
+        let found = current
+            .iter_mut()
+            .rev()
+            .chain(globals[..start.min(1)].iter_mut())
+            .find_map(|scope| scope.get_mut(name));
+        match found {
+            Some(slot) => {
+                *slot = value;
+                Ok(())
+            }
+            None => Err(value),
+        }
+    }
+
+    /// Start a scope, ended by [`leave`](Self::leave).
+    pub fn enter(&mut self) {
+        self.scopes.push(HashMap::new());
+    }
+
+    /// End the innermost scope and its variables. The outermost one stays.
+    pub fn leave(&mut self) {
+        if self.scopes.len() > 1 {
+            self.scopes.pop();
+        }
+    }
+
+    /// Start the frame of a call with `bound`, its parameters, in scope.
+    /// [`leave_call`](Self::leave_call) ends it.
+    pub fn call(&mut self, bound: HashMap<String, Value>) {
+        self.frames.push(self.scopes.len());
+        self.scopes.push(bound);
+    }
+
+    /// End the innermost call and every scope started in it.
+    pub fn leave_call(&mut self) {
+        if let Some(start) = self.frames.pop() {
+            self.scopes.truncate(start.max(1));
+        }
+    }
+
+    /// How many calls are running.
+    pub fn calls(&self) -> usize {
+        self.frames.len()
+    }
+}
+
+/// The value of `expr` for `input`. Functions it calls run at `indent` and
+/// write what they print to `output`.
+pub fn evaluate(
+    expr: &Expr,
+    indent: &str,
+    input: &str,
+    ctx: &mut AgentContext,
+    output: &mut Vec<String>,
+) -> Result<Value, RuntimeError> {
+    match expr {
+        Expr::Text(text) => Ok(Value::Text(text.clone())),
+        Expr::Number(number) => number
+            .parse()
+            .map(Value::Int)
+            .or_else(|_| number.parse().map(Value::Float))
+            .map_err(|_| error(format!("`{}` is not a number", number))),
+        Expr::Bool(value) => Ok(Value::Bool(*value)),
+        Expr::Ident(name) => {
+            if let Some(value) = ctx.variables.get(name) {
+                return Ok(value.clone());
+            }
+            if name == "input" || name == "msg" {
+                return Ok(Value::Text(input.to_string()));
+            }
+            ctx.mem_short
+                .get(name.as_str())
+                .cloned()
+                .ok_or_else(|| error(format!("unknown name `{}`", name)))
+        }
+        Expr::Field(target, drive) if is_ident(target, "state") => ctx
+            .affect
+            .level(drive)
+            .map(Value::Float)
+            .ok_or_else(|| RuntimeError::new(RuntimeErrorKind::UnknownState(drive.clone()))),
+        Expr::Field(target, stat) => match target.as_ref() {
+            Expr::Field(reward, behavior) if is_ident(reward, "reward") => ctx
+                .rewards
+                .of(behavior)
+                .get(stat)
+                .map(Value::Float)
+                .ok_or_else(|| error(format!("rewards have no `{}`", stat))),
+            _ => Err(error(format!("cannot read `{}`", print_expr(expr)))),
+        },
+        Expr::Index(target, key) => match target.as_ref() {
+            Expr::Field(mem, region) if is_ident(mem, "mem") => {
+                let key = evaluate(key, indent, input, ctx, output)?.to_string();
+                Ok(ctx.try_get_value(region, &key)?)
+            }
+            _ => {
+                let target = evaluate(target, indent, input, ctx, output)?;
+                index(target, evaluate(key, indent, input, ctx, output)?)
+            }
+        },
+        Expr::Unary(UnaryOp::Not, operand) => Ok(Value::Bool(
+            !evaluate(operand, indent, input, ctx, output)?.truthy(),
+        )),
+        Expr::Unary(UnaryOp::Neg, operand) => {
+            let operand = evaluate(operand, indent, input, ctx, output)?;
+            match operand.as_int().and_then(i64::checked_neg) {
+                Some(negated) => Ok(Value::Int(negated)),
+                None => Ok(Value::Float(-number(operand)?)),
+            }
+        }
+        Expr::Binary(BinaryOp::And, left, right) => Ok(Value::Bool(
+            evaluate(left, indent, input, ctx, output)?.truthy()
+                && evaluate(right, indent, input, ctx, output)?.truthy(),
+        )),
+        Expr::Binary(BinaryOp::Or, left, right) => Ok(Value::Bool(
+            evaluate(left, indent, input, ctx, output)?.truthy()
+                || evaluate(right, indent, input, ctx, output)?.truthy(),
+        )),
+        Expr::Binary(op, left, right) => {
+            let left = evaluate(left, indent, input, ctx, output)?;
+            binary(*op, left, evaluate(right, indent, input, ctx, output)?)
+        }
+        Expr::Call(name, args) => {
+            let args = args
+                .iter()
+                .map(|arg| evaluate(arg, indent, input, ctx, output))
+                .collect::<Result<Vec<_>, _>>()?;
+            functions::call(name, args, indent, input, ctx, output)
+        }
+        Expr::List(items) => items
+            .iter()
+            .map(|item| evaluate(item, indent, input, ctx, output))
+            .collect::<Result<_, _>>()
+            .map(Value::List),
+        Expr::Map(entries) => entries
+            .iter()
+            .map(|(key, value)| {
+                let key = map_key(evaluate(key, indent, input, ctx, output)?)?;
+                Ok((key, evaluate(value, indent, input, ctx, output)?))
+            })
+            .collect::<Result<_, _>>()
+            .map(Value::Map),
+    }
+}
+
+/// `expr` with the `{...}` placeholders of its strings filled in, as the
+/// text `print` and `emit` give is from `lang 0.2`.
+pub fn interpolate(expr: &Expr, input: &str, ctx: &AgentContext) -> Expr {
+    let fill = |expr: &Expr| Box::new(interpolate(expr, input, ctx));
+    match expr {
+        Expr::Text(text) => Expr::Text(eval::interpolate(text, input, ctx)),
+        Expr::Field(target, name) => Expr::Field(fill(target), name.clone()),
+        Expr::Index(target, index) => Expr::Index(fill(target), fill(index)),
+        Expr::Unary(op, operand) => Expr::Unary(*op, fill(operand)),
+        Expr::Binary(op, left, right) => Expr::Binary(*op, fill(left), fill(right)),
+        Expr::Call(name, args) => Expr::Call(
+            name.clone(),
+            args.iter()
+                .map(|arg| interpolate(arg, input, ctx))
+                .collect(),
+        ),
+        Expr::List(items) => Expr::List(
+            items
+                .iter()
+                .map(|item| interpolate(item, input, ctx))
+                .collect(),
+        ),
+        Expr::Map(entries) => Expr::Map(
+            entries
+                .iter()
+                .map(|(key, value)| (interpolate(key, input, ctx), interpolate(value, input, ctx)))
+                .collect(),
+        ),
+        Expr::Number(_) | Expr::Bool(_) | Expr::Ident(_) => expr.clone(),
+    }
+}
+
+/// Whether `expr` is the name `name`.
+fn is_ident(expr: &Expr, name: &str) -> bool {
+    matches!(expr, Expr::Ident(ident) if ident == name)
+}
+
+fn error(message: String) -> RuntimeError {
+    RuntimeError::new(RuntimeErrorKind::Expression(message))
+}
+
+/// `text` as a finite number, if it is digits with at most one `.` and an
+/// optional leading `-`.
+fn decimal(text: &str) -> Option<f64> {
+    if !is_decimal(text) {
+        return None;
+    }
+    text.parse().ok().filter(|number: &f64| number.is_finite())
+}
+
+/// Whether `text` is digits with at most one `.` and an optional leading
+/// `-`, the only text [`Value::as_number`] and [`Value::as_int`] read.
+fn is_decimal(text: &str) -> bool {
+    let digits = text.strip_prefix('-').unwrap_or(text);
+    let (whole, fraction) = digits.split_once('.').unwrap_or((digits, ""));
+    let all_digits = |part: &str| part.bytes().all(|b| b.is_ascii_digit());
+    whole.len() + fraction.len() > 0 && all_digits(whole) && all_digits(fraction)
+}
+
+/// `number` as a value, or an error for `expr` if it overflowed to an
+/// infinity, which memory could not save.
+fn finite(number: f64, expr: impl FnOnce() -> String) -> Result<Value, RuntimeError> {
+    if number.is_finite() {
+        Ok(Value::Float(number))
+    } else {
+        Err(error(format!("`{}` is too large a number", expr())))
+    }
+}
+
+fn number(value: Value) -> Result<f64, RuntimeError> {
+    value
+        .as_number()
+        .ok_or_else(|| coercion(&value, "a number"))
+}
+
+/// The item of the list or entry of the map `target` at `key`: a
+/// negative list index counts from the end, and a key the map does not have
+/// gives empty text, as one memory never had does.
+fn index(target: Value, key: Value) -> Result<Value, RuntimeError> {
+    match target {
+        Value::List(items) => {
+            let position = key.as_int().ok_or_else(|| coercion(&key, "a list index"))?;
+            let len = items.len();
+            let at = if position < 0 {
+                position.checked_add(len as i64)
+            } else {
+                Some(position)
+            };
+            at.and_then(|at| usize::try_from(at).ok())
+                .and_then(|at| items.into_iter().nth(at))
+                .ok_or_else(|| {
+                    error(format!(
+                        "index {} is out of range for a list of {} item(s)",
+                        position, len
+                    ))
+                })
+        }
+        Value::Map(mut entries) => Ok(entries
+            .remove(&map_key(key)?)
+            .unwrap_or_else(|| Value::from(""))),
+        other => Err(coercion(&other, "a list or map")),
+    }
+}
+
+/// `key` as the text a map keeps it under.
+fn map_key(key: Value) -> Result<String, RuntimeError> {
+    match key {
+        Value::List(_) | Value::Map(_) => Err(coercion(&key, "a map key")),
+        Value::Text(text) => Ok(text),
+        other => Ok(other.to_string()),
+    }
+}
+
+pub(crate) fn coercion(value: &Value, to: &'static str) -> RuntimeError {
+    RuntimeError::new(RuntimeErrorKind::Coercion {
+        value: value.to_string(),
+        to,
+    })
+}
+
+/// Whether `left` and `right` are equal under `==`: numbers when either
+/// side is a number and both read as one, and otherwise values of the same
+/// kind with equal contents.
+fn equal(left: &Value, right: &Value) -> bool {
+    match (left, right) {
+        (Value::List(a), Value::List(b)) => {
+            a.len() == b.len() && a.iter().zip(b).all(|(a, b)| equal(a, b))
+        }
+        (Value::Map(a), Value::Map(b)) => {
+            a.len() == b.len()
+                && a.iter()
+                    .zip(b)
+                    .all(|((ka, a), (kb, b))| ka == kb && equal(a, b))
+        }
+        (Value::Text(a), Value::Text(b)) => a == b,
+        (Value::Bool(a), Value::Bool(b)) => a == b,
+        _ if left.is_number() || right.is_number() => match (left.as_number(), right.as_number()) {
+            (Some(a), Some(b)) => affect::compare(a, "==", b),
+            _ => false,
+        },
+        _ => false,
+    }
+}
+
+/// `left <op> right` on whole numbers, or `None` if either is not one or
+/// the result does not fit.
+fn integer(op: BinaryOp, left: &Value, right: &Value) -> Option<i64> {
+    let (a, b) = (left.as_int()?, right.as_int()?);
+    match op {
+        BinaryOp::Add => a.checked_add(b),
+        BinaryOp::Sub => a.checked_sub(b),
+        BinaryOp::Mul => a.checked_mul(b),
+        BinaryOp::Div if b != 0 && a % b == 0 => a.checked_div(b),
+        _ => None,
+    }
+}
+
+/// `left <op> right` for operators other than `&&` and `||`. Arithmetic on
+/// whole numbers stays whole unless it overflows or `/` leaves a fraction.
+fn binary(op: BinaryOp, left: Value, right: Value) -> Result<Value, RuntimeError> {
+    let numeric = left.is_number() || right.is_number();
+    match op {
+        BinaryOp::Eq | BinaryOp::Ne => {
+            Ok(Value::Bool(equal(&left, &right) == (op == BinaryOp::Eq)))
+        }
+        BinaryOp::Lt | BinaryOp::Le | BinaryOp::Gt | BinaryOp::Ge => {
+            let ordering = match (&left, &right, left.as_number().zip(right.as_number())) {
+                (_, _, Some((a, b))) => return Ok(Value::Bool(affect::compare(a, op.as_str(), b))),
+                (Value::Text(a), Value::Text(b), _) => a.cmp(b),
+                // Text that does not read as a number, with a number.
+                (Value::Text(_), Value::Int(_) | Value::Float(_), _) => {
+                    return Err(coercion(&left, "something to order"))
+                }
+                (Value::Text(_) | Value::Int(_) | Value::Float(_), _, _) => {
+                    return Err(coercion(&right, "something to order"))
+                }
+                _ => return Err(coercion(&left, "something to order")),
+            };
+            Ok(Value::Bool(match op {
+                BinaryOp::Lt => ordering.is_lt(),
+                BinaryOp::Le => ordering.is_le(),
+                BinaryOp::Gt => ordering.is_gt(),
+                _ => ordering.is_ge(),
+            }))
+        }
+        BinaryOp::Add => match (left, right) {
+            (Value::List(mut a), Value::List(b)) => {
+                a.extend(b);
+                Ok(Value::List(a))
+            }
+            (Value::Map(mut a), Value::Map(b)) => {
+                a.extend(b);
+                Ok(Value::Map(a))
+            }
+            (left, right)
+                if numeric && left.as_number().is_some() && right.as_number().is_some() =>
+            {
+                if let Some(sum) = integer(op, &left, &right) {
+                    return Ok(Value::Int(sum));
+                }
+                let (a, b) = (number(left)?, number(right)?);
+                finite(a + b, || format!("{} + {}", a, b))
+            }
+            (left @ Value::Text(_), right) | (left, right @ Value::Text(_)) => {
+                Ok(Value::Text(format!("{}{}", left, right)))
+            }
+            (left, right) => Err(coercion(
+                if left.is_number() { &right } else { &left },
+                "something to add",
+            )),
+        },
+        BinaryOp::Sub | BinaryOp::Mul | BinaryOp::Div => {
+            if let Some(result) = integer(op, &left, &right) {
+                return Ok(Value::Int(result));
+            }
+            let (a, b) = (number(left)?, number(right)?);
+            let result = match op {
+                BinaryOp::Sub => a - b,
+                BinaryOp::Mul => a * b,
+                _ if b == 0.0 => return Err(error(format!("`{}` divided by zero", a))),
+                _ => a / b,
+            };
+            finite(result, || format!("{} {} {}", a, op.as_str(), b))
+        }
+        BinaryOp::And | BinaryOp::Or => Ok(Value::Bool(left.truthy() && right.truthy())),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::lexer::Lexer;
+    use crate::parser::Parser;
+    use crate::replkit::Repl;
+    use crate::types::Statement;
+
+    fn eval(source: &str, ctx: &mut AgentContext) -> Result<Value, RuntimeError> {
+        let source = format!("if {} {{}}", source);
+        let mut lexer = Lexer::new(&source);
+        let program = Parser::new(&mut lexer).parse_program();
+        let Some(Statement::If { condition, .. }) = program.statements.first() else {
+            panic!("`{}` did not parse", source);
+        };
+        evaluate(condition, "", "hi", ctx, &mut Vec::new())
+    }
+
+    #[test]
+    fn evaluates_conditions() {
+        let mut ctx = AgentContext::new();
+        ctx.set_mem("short", "x", "hi");
+        ctx.set_mem("short", "count", "4");
+        ctx.set_mem("short", "loss", "0.25");
+        for (source, expected) in [
+            (
+                "loss > 0.1 && mem.short[\"x\"] == \"hi\"",
+                Value::Bool(true),
+            ),
+            ("mem.short[\"count\"] == 4.0", Value::Bool(true)),
+            ("mem.short[\"count\"] == \"4.0\"", Value::Bool(false)),
+            ("mem.short[\"count\"] + 1", Value::Int(5)),
+            ("\"n=\" + count", Value::Text("n=4".to_string())),
+            ("-(2 + 1) * 2 - 1", Value::Int(-7)),
+            ("\"apple\" < \"banana\"", Value::Bool(true)),
+            ("!mem.short[\"missing\"]", Value::Bool(true)),
+            ("input == \"hi\" || nothing", Value::Bool(true)),
+            ("false && nothing", Value::Bool(false)),
+        ] {
+            assert_eq!(eval(source, &mut ctx).unwrap(), expected, "{}", source);
+        }
+        for (source, message, code) in [
+            ("nothing", "unknown name `nothing`", "SEN4015"),
+            ("1 / 0", "`1` divided by zero", "SEN4015"),
+            ("x.y", "cannot read `x.y`", "SEN4015"),
+            (
+                "-x",
+                "cannot use `hi` as a number: only numbers and text that reads as one are numbers",
+                "SEN4018",
+            ),
+            (
+                "true < 1",
+                "cannot use `true` as something to order: `<`, `<=`, `>` and `>=` order numbers, and otherwise text",
+                "SEN4018",
+            ),
+        ] {
+            let err = eval(source, &mut ctx).unwrap_err();
+            assert_eq!(err.to_string(), message, "{}", source);
+            assert_eq!(err.code(), code, "{}", source);
+        }
+    }
+
+    #[test]
+    fn keeps_numbers_finite_so_memory_saves_and_loads() {
+        let mut ctx = AgentContext::new();
+        ctx.set_mem("short", "big", &"9".repeat(300));
+        ctx.set_mem("short", "word", "inf");
+        let err = eval("big * big", &mut ctx).unwrap_err();
+        assert_eq!(err.code(), "SEN4015");
+        assert!(
+            err.to_string().ends_with("is too large a number"),
+            "{}",
+            err
+        );
+        assert_eq!(eval("word * 2", &mut ctx).unwrap_err().code(), "SEN4018");
+        assert_eq!(eval("word + 1", &mut ctx).unwrap(), Value::from("inf1"));
+        for text in ["nan", "infinity", "1e400", "-", "."] {
+            assert_eq!(Value::from(text).as_number(), None, "{}", text);
+        }
+        assert_eq!(Value::from(" -.5 ").as_number(), Some(-0.5));
+
+        let half = eval("big / big / 2", &mut ctx).unwrap();
+        ctx.set_value("short", "half", half);
+        let path = std::env::temp_dir().join(format!("finite-{}.json", std::process::id()));
+        let path = path.to_str().unwrap();
+        ctx.save(path).unwrap();
+        let mut loaded = AgentContext::new();
+        let result = loaded.load(path);
+        std::fs::remove_file(path).unwrap();
+        result.unwrap();
+        assert_eq!(loaded.get_value("short", "half"), Some(Value::Float(0.5)));
+        assert_eq!(*loaded.mem_short, *ctx.mem_short);
+    }
+
+    #[test]
+    fn reads_the_same_text_as_a_number_everywhere() {
+        let mut ctx = AgentContext::new();
+        ctx.set_value("short", "xs", Value::List(vec!["a".into(), "b".into()]));
+        for (text, int) in [
+            ("+1", None),
+            (" 1 ", Some(1)),
+            ("-1", Some(-1)),
+            ("1.0", None),
+        ] {
+            let value = Value::from(text);
+            assert_eq!(value.as_int(), int, "{}", text);
+            assert_eq!(value.as_number().is_some(), text != "+1", "{}", text);
+        }
+        ctx.set_mem("short", "i", "+1");
+        assert_eq!(eval("xs[i]", &mut ctx).unwrap_err().code(), "SEN4018");
+        assert_eq!(eval("i * 2", &mut ctx).unwrap_err().code(), "SEN4018");
+        ctx.set_mem("short", "i", "1");
+        assert_eq!(eval("xs[i]", &mut ctx).unwrap(), Value::from("b"));
+    }
+
+    #[test]
+    fn subtracts_however_minus_is_spaced() {
+        let mut out = Vec::new();
+        let mut repl = Repl::new(&b""[..], &mut out);
+        repl.eval_source(concat!(
+            "lang 0.2\n",
+            "n = 5\n",
+            "let m = n-1\n",
+            "a = (m)\n",
+            "b = n - 1\n",
+            "c = n -1\n",
+            "d = -n\n",
+            "reward -1\n",
+        ))
+        .unwrap();
+        let ctx = repl.context();
+        for name in ["a", "b", "c"] {
+            assert_eq!(
+                ctx.get_value("short", name),
+                Some(Value::Int(4)),
+                "{}",
+                name
+            );
+        }
+        assert_eq!(ctx.get_value("short", "d"), Some(Value::Int(-5)));
+        drop(repl);
+        let out = String::from_utf8(out).unwrap();
+        assert!(!out.contains("Error"), "{}", out);
+    }
+
+    #[test]
+    fn keeps_kinds_of_values_in_memory() {
+        let mut out = Vec::new();
+        let mut repl = Repl::new(&b""[..], &mut out);
+        repl.eval_source(concat!(
+            "lang 0.2\n",
+            "visits = 1 + 1\n",
+            "total = visits + visits\n",
+            "ratio = total / 8\n",
+            "done = !false\n",
+            "label = \"n\" + total\n",
+        ))
+        .unwrap();
+        let ctx = repl.context();
+        assert_eq!(ctx.get_value("short", "total"), Some(Value::Int(4)));
+        assert_eq!(ctx.get_value("short", "ratio"), Some(Value::Float(0.5)));
+        assert_eq!(ctx.get_value("short", "done"), Some(Value::Bool(true)));
+        assert_eq!(ctx.get_mem("short", "label"), "n4");
+
+        let path = std::env::temp_dir().join(format!("expr-{}.json", std::process::id()));
+        let path = path.to_str().unwrap();
+        ctx.save(path).unwrap();
+        let saved = std::fs::read_to_string(path).unwrap();
+        assert!(saved.contains("\"total\": 4"), "{}", saved);
+        let mut loaded = AgentContext::new();
+        loaded.load(path).unwrap();
+        std::fs::remove_file(path).unwrap();
+        assert_eq!(*loaded.mem_short, *ctx.mem_short);
+
+        repl.eval_source("wrong = done + 1\n").unwrap();
+        drop(repl);
+        let out = String::from_utf8(out).unwrap();
+        assert!(out.contains("SEN4018"), "{}", out);
+        assert!(
+            out.contains("cannot use `true` as something to add: `+` adds numbers"),
+            "{}",
+            out
+        );
+    }
+
+    #[test]
+    fn builds_and_indexes_lists_and_maps() {
+        let mut out = Vec::new();
+        let mut repl = Repl::new(&b""[..], &mut out);
+        repl.eval_source(concat!(
+            "lang 0.2\n",
+            "tags = [\"a\", \"b\", 1 + 2]\n",
+            "user = {\"name\": \"Ada\", \"tags\": tags}\n",
+            "last = tags[-1]\n",
+            "name = mem.short[\"user\"][\"name\"]\n",
+            "count = len(tags) + len(user) + len(\"héllo\")\n",
+            "missing = user[\"age\"]\n",
+            "if ({\"k\": 1})[\"k\"] == 1 {\n",
+            "    print name + \" has \" + len(user[\"tags\"]) + \" tags\"\n",
+            "}\n",
+        ))
+        .unwrap();
+        let ctx = repl.context();
+        assert_eq!(ctx.get_value("short", "last"), Some(Value::Int(3)));
+        assert_eq!(ctx.get_mem("short", "name"), "Ada");
+        assert_eq!(ctx.get_value("short", "count"), Some(Value::Int(10)));
+        assert_eq!(ctx.get_mem("short", "missing"), "");
+        assert_eq!(
+            ctx.get_value("short", "tags"),
+            Some(Value::List(vec!["a".into(), "b".into(), Value::Int(3)]))
+        );
+
+        repl.eval_source("wrong = tags[3]\n").unwrap();
+        drop(repl);
+        let out = String::from_utf8(out).unwrap();
+        assert!(out.contains("Ada has 3 tags"), "{}", out);
+        assert!(
+            out.contains("index 3 is out of range for a list of 3 item(s)"),
+            "{}",
+            out
+        );
+    }
+
+    #[test]
+    fn binds_variables_in_scopes() {
+        let mut out = Vec::new();
+        let mut repl = Repl::new(&b""[..], &mut out);
+        repl.eval_source(concat!(
+            "lang 0.2\n",
+            "let greeting = \"Hi\"\n",
+            "agent Echo {\n",
+            "  on input(msg) {\n",
+            "    let n = 2 * 3\n",
+            "    if n > 5 {\n",
+            "      let n = n + 1\n",
+            "      print \"{greeting} {n}\"\n",
+            "    }\n",
+            "    print \"{n}\"\n",
+            "  }\n",
+            "}\n",
+        ))
+        .unwrap();
+        repl.handle_command(".input hi").unwrap();
+        repl.eval_source("print \"{greeting} {n}\"").unwrap();
+        drop(repl);
+        let out = String::from_utf8(out).unwrap();
+        assert!(out.contains("  Hi 7\n  6\n"), "{}", out);
+        assert!(out.ends_with("Hi {n}\n"), "{}", out);
+    }
+}
@@ -0,0 +1,216 @@
+use crate::error::{RuntimeError, RuntimeErrorKind};
+use crate::sandbox::Sandbox;
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+
+/// Timeout used when a `fetch` statement does not set one.
+pub const DEFAULT_TIMEOUT: Duration = Duration::from_secs(30);
+
+/// Redirects followed before a request fails, as browsers allow.
+const MAX_REDIRECTS: usize = 10;
+
+/// An HTTP request issued by a `fetch` statement.
+#[derive(Clone, Debug, PartialEq)]
+pub struct FetchRequest {
+    pub method: String,
+    pub url: String,
+    pub headers: Vec<(String, String)>,
+    pub body: Option<String>,
+    pub timeout: Duration,
+}
+
+#[derive(Clone, Debug, PartialEq)]
+pub struct FetchResponse {
+    pub status: u16,
+    pub body: String,
+}
+
+impl FetchRequest {
+    /// Build a request from `fetch` options: `method`, `body`, `timeout`
+    /// (seconds) and any number of `header: "Name: value"`.
+    pub fn from_options(url: String, options: &[(String, String)]) -> Result<Self, RuntimeError> {
+        let mut request = FetchRequest {
+            method: "GET".to_string(),
+            url,
+            headers: Vec::new(),
+            body: None,
+            timeout: DEFAULT_TIMEOUT,
+        };
+
+        for (name, value) in options {
+            let invalid = || fetch_error(&format!("invalid fetch option {}: `{}`", name, value));
+            match name.as_str() {
+                "method" => request.method = value.to_ascii_uppercase(),
+                "body" => request.body = Some(value.clone()),
+                "timeout" => {
+                    let secs: f64 = value.parse().map_err(|_| invalid())?;
+                    request.timeout = Duration::try_from_secs_f64(secs).map_err(|_| invalid())?;
+                }
+                "header" => {
+                    let (key, val) = value.split_once(':').ok_or_else(invalid)?;
+                    request
+                        .headers
+                        .push((key.trim().to_string(), val.trim().to_string()));
+                }
+                _ => return Err(invalid()),
+            }
+        }
+        Ok(request)
+    }
+
+    /// Send the request if `sandbox` allows its host and that of every
+    /// redirect. Error statuses are returned as responses so programs can
+    /// inspect them.
+    pub fn send(&self, sandbox: &Sandbox) -> Result<FetchResponse, RuntimeError> {
+        let url = reqwest::Url::parse(&self.url)
+            .map_err(|e| fetch_error(&format!("invalid URL `{}`: {}", self.url, e)))?;
+        if url.scheme() != "http" && url.scheme() != "https" {
+            return Err(fetch_error(&format!(
+                "unsupported URL scheme `{}`",
+                url.scheme()
+            )));
+        }
+        sandbox.check_host(url.host_str().unwrap_or_default())?;
+
+        let method = reqwest::Method::from_bytes(self.method.as_bytes())
+            .map_err(|_| fetch_error(&format!("invalid HTTP method `{}`", self.method)))?;
+        // Each redirect is checked like the first URL, so an allowed host
+        // cannot send the request on to one the sandbox denies.
+        let denied = Arc::new(Mutex::new(None));
+        let policy = {
+            let (sandbox, denied) = (sandbox.clone(), Arc::clone(&denied));
+            reqwest::redirect::Policy::custom(move |attempt| {
+                if attempt.previous().len() > MAX_REDIRECTS {
+                    return attempt.error("too many redirects");
+                }
+                match sandbox.check_host(attempt.url().host_str().unwrap_or_default()) {
+                    Ok(()) => attempt.follow(),
+                    Err(err) => {
+                        *denied.lock().unwrap() = Some(err);
+                        attempt.stop()
+                    }
+                }
+            })
+        };
+        let client = reqwest::blocking::Client::builder()
+            .timeout(self.timeout)
+            .redirect(policy)
+            .build()
+            .map_err(|e| fetch_error(&e.to_string()))?;
+
+        let mut builder = client.request(method, url);
+        for (key, value) in &self.headers {
+            builder = builder.header(key, value);
+        }
+        if let Some(body) = &self.body {
+            builder = builder.body(body.clone());
+        }
+
+        let response = builder.send().map_err(|e| {
+            if e.is_timeout() {
+                fetch_error(&format!("{} timed out after {:?}", self.url, self.timeout))
+            } else {
+                fetch_error(&e.to_string())
+            }
+        })?;
+        if let Some(err) = denied.lock().unwrap().take() {
+            return Err(err);
+        }
+        let status = response.status().as_u16();
+        let body = response.text().map_err(|e| fetch_error(&e.to_string()))?;
+        Ok(FetchResponse { status, body })
+    }
+}
+
+fn fetch_error(msg: &str) -> RuntimeError {
+    RuntimeError::new(RuntimeErrorKind::Fetch(msg.to_string()))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::io::{Read, Write};
+    use std::net::TcpListener;
+    use std::thread;
+
+    #[test]
+    fn parses_options() {
+        let options = [
+            ("method".to_string(), "post".to_string()),
+            (
+                "header".to_string(),
+                "Content-Type: application/json".to_string(),
+            ),
+            ("body".to_string(), "{}".to_string()),
+            ("timeout".to_string(), "2.5".to_string()),
+        ];
+        let request = FetchRequest::from_options("http://x".to_string(), &options).unwrap();
+        assert_eq!(request.method, "POST");
+        assert_eq!(
+            request.headers,
+            [("Content-Type".to_string(), "application/json".to_string())]
+        );
+        assert_eq!(request.timeout, Duration::from_millis(2500));
+
+        let bad = [("timeout".to_string(), "-1".to_string())];
+        assert!(FetchRequest::from_options("http://x".to_string(), &bad).is_err());
+    }
+
+    #[test]
+    fn sends_request_when_sandbox_allows_it() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let url = format!("http://{}/data", listener.local_addr().unwrap());
+        let server = thread::spawn(move || {
+            let (mut stream, _) = listener.accept().unwrap();
+            let mut buf = [0u8; 4096];
+            let n = stream.read(&mut buf).unwrap();
+            stream
+                .write_all(
+                    b"HTTP/1.1 200 OK\r\nContent-Length: 5\r\nConnection: close\r\n\r\nhello",
+                )
+                .unwrap();
+            String::from_utf8_lossy(&buf[..n]).to_string()
+        });
+
+        let request = FetchRequest::from_options(url.clone(), &[]).unwrap();
+        let err = request.send(&Sandbox::default()).unwrap_err();
+        assert!(matches!(err.kind, RuntimeErrorKind::Denied(_)));
+
+        let response = request.send(&Sandbox::permissive()).unwrap();
+        assert_eq!(response.status, 200);
+        assert_eq!(response.body, "hello");
+        assert!(server.join().unwrap().starts_with("GET /data"));
+    }
+
+    #[test]
+    fn checks_the_host_of_every_redirect() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let port = listener.local_addr().unwrap().port();
+        let server = thread::spawn(move || {
+            let (mut stream, _) = listener.accept().unwrap();
+            let mut buf = [0u8; 4096];
+            let _ = stream.read(&mut buf).unwrap();
+            let redirect = format!(
+                "HTTP/1.1 302 Found\r\nLocation: http://localhost:{}/secret\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+                port
+            );
+            stream.write_all(redirect.as_bytes()).unwrap();
+        });
+
+        let sandbox = Sandbox {
+            allowed_hosts: vec!["127.0.0.1".to_string()],
+            ..Sandbox::permissive()
+        };
+        let url = format!("http://127.0.0.1:{}/data", port);
+        let request = FetchRequest::from_options(url, &[]).unwrap();
+        let err = request.send(&sandbox).unwrap_err();
+        server.join().unwrap();
+        assert!(matches!(err.kind, RuntimeErrorKind::Denied(_)));
+        assert!(
+            err.to_string()
+                .contains("host `localhost` is not in sandbox.allowed_hosts"),
+            "{}",
+            err
+        );
+    }
+}
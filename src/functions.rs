@@ -0,0 +1,174 @@
+//! Functions declared with `fn`, inside an agent or at the top level.
+//!
+//! ```text
+//! fn greet(name) {
+//!   return "Hello, " + name
+//! }
+//! ```
+//!
+//! A call such as `greet(msg)` binds the arguments to the parameters in a
+//! frame of its own (see [`Variables`](crate::expr::Variables)), runs the
+//! body and evaluates to what `return` gave, or to the empty string if the
+//! body ended without one. A call can stand alone as a statement, in which
+//! case its value is dropped. The current agent's functions hide top-level
+//! ones of the same name, and both hide the built-ins:
+//! `similarity(a, b)`, the cosine similarity, from -1 to 1, of the vectors
+//! of two texts (see [`embedding`](crate::llm::embedding)), or of vectors
+//! `embed` stored; and `len(value)`, the number of characters of text,
+//! items of a list or entries of a map. A name that is none of these but a
+//! [template](crate::template) renders it.
+
+use crate::context::AgentContext;
+use crate::error::{RuntimeError, RuntimeErrorKind};
+use crate::eval::eval_body;
+use crate::expr::{self, Value};
+use crate::llm::embedding;
+use crate::template;
+use crate::types::Statement;
+
+/// How deeply calls may nest before a call fails, so unbounded recursion
+/// ends with an error rather than a stack overflow.
+pub const MAX_DEPTH: usize = 64;
+
+/// The declaration of the function `name`: the current agent's if it has
+/// one, else one declared at the top level.
+fn find(ctx: &AgentContext, name: &str) -> Option<Statement> {
+    let agent = match &ctx.current_agent {
+        Some(Statement::AgentDeclaration { body, .. }) => body.as_slice(),
+        _ => &[],
+    };
+    agent
+        .iter()
+        .find(|stmt| matches!(stmt, Statement::Function { name: declared, .. } if declared == name))
+        .or_else(|| ctx.functions.get(name))
+        .cloned()
+}
+
+/// Call the function `name` with `args` and return its value.
+pub fn call(
+    name: &str,
+    args: Vec<Value>,
+    indent: &str,
+    input: &str,
+    ctx: &mut AgentContext,
+    output: &mut Vec<String>,
+) -> Result<Value, RuntimeError> {
+    let Some(Statement::Function { params, body, .. }) = find(ctx, name) else {
+        return match name {
+            "similarity" => similarity(&args, ctx),
+            "len" => len(&args),
+            _ => template::render_values(ctx, name, &args, input)
+                .map(|text| text.map(Value::Text))
+                .unwrap_or_else(|| Err(error(format!("unknown function `{}`", name)))),
+        };
+    };
+    if args.len() != params.len() {
+        return Err(error(format!(
+            "`{}` takes {} argument(s), not {}",
+            name,
+            params.len(),
+            args.len()
+        )));
+    }
+    if ctx.variables.calls() >= MAX_DEPTH {
+        return Err(error(format!(
+            "calls to `{}` nest deeper than {}",
+            name, MAX_DEPTH
+        )));
+    }
+    ctx.variables.call(params.into_iter().zip(args).collect());
+    let result = eval_body(&body, indent, input, ctx, output);
+    ctx.variables.leave_call();
+    let value = ctx.returning.take();
+    result?;
+    Ok(value.unwrap_or_else(|| Value::Text(String::new())))
+}
+
+/// The built-in `similarity(a, b)`.
+fn similarity(args: &[Value], ctx: &AgentContext) -> Result<Value, RuntimeError> {
+    let [a, b] = args else {
+        return Err(error(format!(
+            "`similarity` takes 2 argument(s), not {}",
+            args.len()
+        )));
+    };
+    let vector = |value: &Value| {
+        let text = value.to_string();
+        match serde_json::from_str::<Vec<f32>>(&text) {
+            Ok(vector) => Ok(vector),
+            Err(_) => ctx.embedder.embed(&text).map_err(RuntimeError::from),
+        }
+    };
+    let score = embedding::similarity(&vector(a)?, &vector(b)?);
+    Ok(Value::Float(f64::from(score)))
+}
+
+/// The built-in `len(value)`.
+fn len(args: &[Value]) -> Result<Value, RuntimeError> {
+    let [value] = args else {
+        return Err(error(format!(
+            "`len` takes 1 argument(s), not {}",
+            args.len()
+        )));
+    };
+    let len = match value {
+        Value::Text(text) => text.chars().count(),
+        Value::List(items) => items.len(),
+        Value::Map(entries) => entries.len(),
+        other => return Err(expr::coercion(other, "something with a length")),
+    };
+    Ok(Value::Int(len as i64))
+}
+
+fn error(message: String) -> RuntimeError {
+    RuntimeError::new(RuntimeErrorKind::Expression(message))
+}
+
+#[cfg(test)]
+mod tests {
+    use crate::replkit::Repl;
+
+    #[test]
+    fn calls_functions_with_their_own_variables() {
+        let mut out = Vec::new();
+        let mut repl = Repl::new(&b""[..], &mut out);
+        repl.eval_source(concat!(
+            "lang 0.2\n",
+            "fn twice(n) {\n",
+            "  return n * 2\n",
+            "}\n",
+            "agent Echo {\n",
+            "  fn greet(name) {\n",
+            "    if name == 6 {\n",
+            "      return \"Hello, six\"\n",
+            "    }\n",
+            "    return \"Hello, \" + name\n",
+            "  }\n",
+            "  fn loop(n) {\n",
+            "    return loop(n)\n",
+            "  }\n",
+            "  on input(msg) {\n",
+            "    let greeting = greet(msg)\n",
+            "    print \"{greeting}\"\n",
+            "    if twice(msg) > 10 {\n",
+            "      print \"big\"\n",
+            "    }\n",
+            "  }\n",
+            "}\n",
+        ))
+        .unwrap();
+        repl.handle_command(".input 6").unwrap();
+        repl.handle_command(".input 4").unwrap();
+        repl.eval_source("loop(1)").unwrap();
+        repl.eval_source("return 1").unwrap();
+        drop(repl);
+        let out = String::from_utf8(out).unwrap();
+        assert!(
+            out.contains("  Hello, six\n  big\n  Hello, 4\nError"),
+            "{}",
+            out
+        );
+        assert!(out.contains("`loop` nest deeper than 64"), "{}", out);
+        assert!(out.contains("`return` outside a function"), "{}", out);
+    }
+}
@@ -0,0 +1,313 @@
+//! How far agents get toward their goals, to tell whether `train` and
+//! `evolve` actually help.
+//!
+//! An agent reports on its goal through two memory keys, in either region:
+//! [`GOAL_PROGRESS_KEY`], a fraction such as `0.4` or a percentage such as
+//! `40%`, and [`GOAL_ACHIEVED_KEY`] once it is done. While
+//! [`AgentContext::goals`](crate::context::AgentContext::goals) is set, every
+//! handler run is logged with the progress before and after it, so a
+//! [`Report`] can say how much each kind of handler moved the agent.
+//! [`read_snapshot`] reads the same keys from saved memory.
+
+use crate::context::AgentContext;
+use crate::error::MemoryError;
+use crate::events::{GOAL_ACHIEVED_KEY, GOAL_PROGRESS_KEY};
+use crate::{history, introspect, logging};
+use serde::Serialize;
+use std::collections::{BTreeMap, VecDeque};
+
+/// Changes in progress kept for [`Report::history`].
+const MAX_POINTS: usize = 1_000;
+
+/// An agent's goal keys at one moment.
+#[derive(Clone, Debug, Default, PartialEq, Serialize)]
+pub struct Reading {
+    /// From 0 to 1; 1 once the goal is achieved, `None` if the agent has
+    /// reported neither.
+    pub progress: Option<f64>,
+    /// Value of [`GOAL_ACHIEVED_KEY`] once set.
+    pub achieved: Option<String>,
+}
+
+impl Reading {
+    pub fn of(ctx: &AgentContext) -> Self {
+        let get = |key: &str| {
+            ["short", "long"]
+                .into_iter()
+                .map(|region| ctx.get_mem(region, key))
+                .find(|value| !value.is_empty())
+        };
+        let achieved = get(GOAL_ACHIEVED_KEY);
+        let progress = match &achieved {
+            Some(_) => Some(1.0),
+            None => get(GOAL_PROGRESS_KEY).and_then(|value| parse_progress(&value)),
+        };
+        Self { progress, achieved }
+    }
+
+    fn describe(&self) -> String {
+        match (&self.progress, &self.achieved) {
+            (_, Some(value)) => format!("achieved ({:?})", value),
+            (Some(progress), None) => percent(*progress),
+            (None, None) => "not reported".to_string(),
+        }
+    }
+}
+
+/// `0.4` or `40%` as a fraction from 0 to 1.
+pub fn parse_progress(value: &str) -> Option<f64> {
+    let value = value.trim();
+    let fraction = match value.strip_suffix('%') {
+        Some(percent) => percent.trim().parse::<f64>().ok()? / 100.0,
+        None => value.parse::<f64>().ok()?,
+    };
+    fraction.is_finite().then(|| fraction.clamp(0.0, 1.0))
+}
+
+/// Runs of one kind of handler and what they did to the goal.
+#[derive(Clone, Debug, Default, PartialEq, Serialize)]
+pub struct HandlerProgress {
+    pub runs: u64,
+    /// Total change in progress over those runs.
+    pub gained: f64,
+    /// Runs after which the goal was newly achieved.
+    pub achieved: u64,
+}
+
+/// A handler run that changed progress.
+#[derive(Clone, Debug, PartialEq, Serialize)]
+pub struct Point {
+    /// Unix milliseconds.
+    pub at: u64,
+    pub handler: String,
+    pub progress: f64,
+}
+
+/// Goal progress over one session, from handler runs.
+#[derive(Clone, Debug)]
+pub struct GoalLog {
+    since: u64,
+    /// The reading before the first run.
+    start: Option<Reading>,
+    handlers: BTreeMap<String, HandlerProgress>,
+    points: VecDeque<Point>,
+}
+
+impl Default for GoalLog {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl GoalLog {
+    pub fn new() -> Self {
+        Self {
+            since: logging::unix_millis(),
+            start: None,
+            handlers: BTreeMap::new(),
+            points: VecDeque::new(),
+        }
+    }
+
+    /// Log one run of `handler` (`input`, `train`, `evolve`, ...).
+    pub fn record(&mut self, handler: &str, before: &Reading, after: &Reading) {
+        self.start.get_or_insert_with(|| before.clone());
+        let entry = self.handlers.entry(handler.to_string()).or_default();
+        entry.runs += 1;
+        entry.gained += after.progress.unwrap_or(0.0) - before.progress.unwrap_or(0.0);
+        if before.achieved.is_none() && after.achieved.is_some() {
+            entry.achieved += 1;
+        }
+        if let Some(progress) = after.progress.filter(|_| after.progress != before.progress) {
+            if self.points.len() >= MAX_POINTS {
+                self.points.pop_front();
+            }
+            self.points.push_back(Point {
+                at: logging::unix_millis(),
+                handler: handler.to_string(),
+                progress,
+            });
+        }
+    }
+
+    pub fn handlers(&self) -> &BTreeMap<String, HandlerProgress> {
+        &self.handlers
+    }
+}
+
+/// Where an agent stands on its goal and how it got there this session.
+#[derive(Clone, Debug, PartialEq, Serialize)]
+pub struct Report {
+    /// The agent's first goal, if it declares one.
+    pub goal: Option<String>,
+    /// When the session started, in Unix milliseconds.
+    pub since: u64,
+    /// Before the first handler run of the session.
+    pub start: Reading,
+    pub current: Reading,
+    /// Runs by kind of handler.
+    pub handlers: BTreeMap<String, HandlerProgress>,
+    /// The latest changes in progress, oldest first.
+    pub history: Vec<Point>,
+}
+
+/// The goal report of the agent registered in `ctx`, with an empty session
+/// if [`AgentContext::goals`] is not set.
+pub fn report(ctx: &AgentContext) -> Report {
+    let current = Reading::of(ctx);
+    let log = ctx.goals.clone().unwrap_or_default();
+    Report {
+        goal: introspect::describe(ctx).and_then(|info| info.goals.into_iter().next()),
+        since: log.since,
+        start: log.start.unwrap_or_else(|| current.clone()),
+        current,
+        handlers: log.handlers,
+        history: log.points.into(),
+    }
+}
+
+impl Report {
+    /// Lines for `.goals`.
+    pub fn render(&self) -> Vec<String> {
+        let mut lines = vec![match &self.goal {
+            Some(goal) => format!("Goal: {:?}", goal),
+            None => "Goal: none declared".to_string(),
+        }];
+        lines.push(format!(
+            "Now: {}, since {}: {}",
+            self.current.describe(),
+            history::format_time(self.since),
+            self.start.describe()
+        ));
+        for (handler, progress) in &self.handlers {
+            let mut line = format!(
+                "  {}: {} run{}, {}",
+                handler,
+                progress.runs,
+                if progress.runs == 1 { "" } else { "s" },
+                change(progress.gained)
+            );
+            if progress.achieved > 0 {
+                line.push_str(&format!(", achieved it {}x", progress.achieved));
+            }
+            lines.push(line);
+        }
+        lines
+    }
+}
+
+/// The goal reading of the memory saved at `path`.
+pub fn read_snapshot(path: &str) -> Result<Reading, MemoryError> {
+    let mut ctx = AgentContext::new();
+    ctx.load(path)?;
+    Ok(Reading::of(&ctx))
+}
+
+/// One line per saved snapshot, in the order given, and the change in
+/// progress from the first to the last.
+pub fn compare(snapshots: &[(&str, Reading)]) -> Vec<String> {
+    let mut lines: Vec<String> = snapshots
+        .iter()
+        .map(|(name, reading)| format!("{}: {}", name, reading.describe()))
+        .collect();
+    if let [(_, first), .., (_, last)] = snapshots {
+        if let (Some(first), Some(last)) = (first.progress, last.progress) {
+            lines.push(format!("Change: {}", change(last - first)));
+        }
+    }
+    lines
+}
+
+fn percent(fraction: f64) -> String {
+    format!("{:.0}%", fraction * 100.0)
+}
+
+fn change(delta: f64) -> String {
+    format!("{:+.0}%", delta * 100.0)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::eval::run_block;
+    use crate::replkit::Repl;
+
+    #[test]
+    fn parses_fractions_and_percentages() {
+        assert_eq!(parse_progress("0.25"), Some(0.25));
+        assert_eq!(parse_progress(" 40 % "), Some(0.4));
+        assert_eq!(parse_progress("150%"), Some(1.0));
+        assert_eq!(parse_progress("halfway"), None);
+        assert_eq!(parse_progress("NaN"), None);
+    }
+
+    #[test]
+    fn compares_saved_snapshots() {
+        let dir = std::env::temp_dir().join(format!("sentience-goals-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let mut snapshots = Vec::new();
+        for (name, progress) in [("monday.json", "0.2"), ("friday.json", "65%")] {
+            let path = dir.join(name);
+            let mut ctx = AgentContext::new();
+            ctx.set_mem("long", GOAL_PROGRESS_KEY, progress);
+            ctx.save(path.to_str().unwrap()).unwrap();
+            snapshots.push((name, read_snapshot(path.to_str().unwrap()).unwrap()));
+        }
+        std::fs::remove_dir_all(&dir).unwrap();
+        assert_eq!(
+            compare(&snapshots),
+            ["monday.json: 20%", "friday.json: 65%", "Change: +45%"]
+        );
+        assert_eq!(compare(&snapshots[..1]), ["monday.json: 20%"]);
+    }
+
+    #[test]
+    fn reports_progress_by_handler() {
+        let mut repl = Repl::new(&b""[..], Vec::new());
+        repl.eval_source(concat!(
+            "agent Learner {\n",
+            "  goal: \"Learn\"\n",
+            "  on input(msg) {\n",
+            "    print \"ok\"\n",
+            "  }\n",
+            "}\n",
+        ))
+        .unwrap();
+        let ctx = repl.context_mut();
+        ctx.set_mem("long", GOAL_PROGRESS_KEY, "10%");
+        run_block(ctx, "input", "hi", "").unwrap();
+
+        let reading = |progress: f64, achieved: Option<&str>| Reading {
+            progress: Some(progress),
+            achieved: achieved.map(str::to_string),
+        };
+        let log = ctx.goals.as_mut().unwrap();
+        log.record("train", &reading(0.1, None), &reading(0.5, None));
+        log.record("train", &reading(0.5, None), &reading(1.0, Some("yes")));
+        log.record(
+            "evolve",
+            &reading(1.0, Some("yes")),
+            &reading(1.0, Some("yes")),
+        );
+        ctx.set_mem("short", GOAL_ACHIEVED_KEY, "yes");
+
+        let report = report(ctx);
+        assert_eq!(report.goal.as_deref(), Some("Learn"));
+        assert_eq!(report.start.progress, Some(0.1));
+        assert_eq!(report.current.progress, Some(1.0));
+        assert_eq!(report.history.len(), 2);
+        assert_eq!(report.history[1].handler, "train");
+        let lines = report.render();
+        assert_eq!(lines[0], "Goal: \"Learn\"");
+        assert!(lines[1].starts_with("Now: achieved (\"yes\"), since "));
+        assert!(lines[1].ends_with(": 10%"));
+        assert_eq!(
+            &lines[2..],
+            [
+                "  evolve: 1 run, +0%",
+                "  input: 1 run, +0%",
+                "  train: 2 runs, +90%, achieved it 1x",
+            ]
+        );
+    }
+}
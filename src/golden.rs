@@ -0,0 +1,53 @@
+//! Golden-file tests for the programs in `examples/`.
+//!
+//! Each `examples/<name>.sent` with a `<name>.golden` beside it is loaded
+//! into a fresh agent, which is then given the prompts in the golden file.
+//! The golden file is the expected [transcript](crate::testing). Run the
+//! tests with `SENTIENCE_UPDATE_GOLDEN=1` to rewrite the golden files from
+//! the current output.
+//!
+//! Nothing the interpreter prints depends on the clock or on random state,
+//! so the transcripts are the same on every run.
+
+use crate::testing;
+use crate::SentienceAgent;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+fn examples() -> Vec<(PathBuf, PathBuf)> {
+    let dir = Path::new(env!("CARGO_MANIFEST_DIR")).join("examples");
+    let mut found: Vec<_> = fs::read_dir(&dir)
+        .expect("examples directory")
+        .filter_map(|entry| {
+            let source = entry.ok()?.path();
+            let golden = source.with_extension("golden");
+            (source.extension()? == "sent" && golden.exists()).then_some((source, golden))
+        })
+        .collect();
+    found.sort();
+    found
+}
+
+#[test]
+fn examples_match_their_golden_files() {
+    let update = std::env::var_os("SENTIENCE_UPDATE_GOLDEN").is_some();
+    let examples = examples();
+    assert!(!examples.is_empty(), "no golden files in examples/");
+    let mut failed = Vec::new();
+    for (source, golden) in examples {
+        let expected = fs::read_to_string(&golden).unwrap();
+        let source = fs::read_to_string(&source).unwrap();
+        let outcome = testing::run(&mut SentienceAgent::new(), &source, &expected);
+        if update {
+            fs::write(&golden, &outcome.transcript).unwrap();
+        } else if !outcome.passed(&expected) {
+            failed.push(format!(
+                "{}:\n--- expected\n{}--- actual\n{}",
+                golden.display(),
+                expected,
+                outcome.transcript
+            ));
+        }
+    }
+    assert!(failed.is_empty(), "{}", failed.join("\n"));
+}
@@ -0,0 +1,267 @@
+//! Graphviz (DOT) rendering of what an agent knows: its memory entries by
+//! region, the links between them and, given the program, the agents and
+//! their goals. The strongest similarities between entries, by the same
+//! bag-of-words vectors [`sync`](crate::sync) stores, can be drawn as dashed
+//! edges.
+
+use crate::context::Snapshot;
+use crate::introspect::AgentInfo;
+use crate::sentience_core::latent::LatentIndex;
+use crate::sync;
+use std::collections::{BTreeMap, HashMap};
+use std::fmt::Write;
+
+/// Longest value shown in an entry's label.
+const MAX_LABEL_CHARS: usize = 40;
+
+/// Render `memory` and `agents` as a DOT graph, with up to `similar`
+/// similarity edges between memory entries.
+pub fn dot(memory: &Snapshot, agents: &[AgentInfo], similar: usize) -> String {
+    let regions = [
+        ("short", sorted(&memory.mem_short)),
+        ("long", sorted(&memory.mem_long)),
+    ];
+    let mut out = String::from("graph sentience {\n  node [fontname=\"Helvetica\"];\n");
+
+    for agent in agents {
+        let id = format!("agent:{}", agent.name);
+        let _ = writeln!(
+            out,
+            "  {} [label={}, shape=box, style=bold];",
+            quote(&id),
+            quote(&agent.name)
+        );
+        for (n, goal) in agent.goals.iter().enumerate() {
+            let goal_id = format!("{}:goal:{}", id, n);
+            let _ = writeln!(
+                out,
+                "  {} [label={}, shape=note];",
+                quote(&goal_id),
+                quote(goal)
+            );
+            let _ = writeln!(
+                out,
+                "  {} -- {} [label=\"goal\"];",
+                quote(&id),
+                quote(&goal_id)
+            );
+        }
+        for (region, _) in &regions {
+            let _ = writeln!(
+                out,
+                "  {} -- {};",
+                quote(&id),
+                quote(&format!("mem.{}", region))
+            );
+        }
+    }
+
+    for (region, entries) in &regions {
+        let region_id = format!("mem.{}", region);
+        let _ = writeln!(
+            out,
+            "  subgraph {} {{",
+            quote(&format!("cluster_{}", region))
+        );
+        let _ = writeln!(out, "    label={};", quote(&region_id));
+        let _ = writeln!(out, "    {} [shape=folder];", quote(&region_id));
+        for (key, value) in entries {
+            let _ = writeln!(
+                out,
+                "    {} [label={}];",
+                quote(&entry_id(region, key)),
+                quote(&format!("{} = {}", key, shorten(value)))
+            );
+        }
+        let _ = writeln!(out, "  }}");
+        for key in entries.keys() {
+            let _ = writeln!(
+                out,
+                "  {} -- {};",
+                quote(&region_id),
+                quote(&entry_id(region, key))
+            );
+        }
+    }
+
+    // A link end that names a memory key joins that entry; others become
+    // nodes of their own.
+    let node = |name: &str| {
+        regions
+            .iter()
+            .find(|(_, entries)| entries.contains_key(name))
+            .map(|(region, _)| entry_id(region, name))
+            .unwrap_or_else(|| name.to_string())
+    };
+    for (from, to) in sorted(&memory.links) {
+        let _ = writeln!(
+            out,
+            "  {} -- {} [label=\"link\"];",
+            quote(&node(from)),
+            quote(&node(&to))
+        );
+    }
+
+    for (a, b, score) in similarities(&regions, similar) {
+        let _ = writeln!(
+            out,
+            "  {} -- {} [style=dashed, label=\"{:.2}\"];",
+            quote(&a),
+            quote(&b),
+            score
+        );
+    }
+    out.push_str("}\n");
+    out
+}
+
+/// The `limit` most similar pairs of entries, most similar first, by the
+/// vector of each entry's key and value.
+fn similarities(
+    regions: &[(&str, BTreeMap<&str, String>)],
+    limit: usize,
+) -> Vec<(String, String, f32)> {
+    if limit == 0 {
+        return Vec::new();
+    }
+    let mut index = LatentIndex::new();
+    let mut vectors = Vec::new();
+    for (region, entries) in regions {
+        for (key, value) in entries {
+            let id = entry_id(region, key);
+            let vector = sync::embed(&format!("{} {}", key, value));
+            index
+                .insert(&id, &vector)
+                .expect("the index has no fixed dimension");
+            vectors.push((id, vector));
+        }
+    }
+    let mut scores = BTreeMap::new();
+    for (id, vector) in &vectors {
+        for (other, score) in index.nearest(vector, limit + 1) {
+            if other == id.as_str() || score <= 0.0 {
+                continue;
+            }
+            let pair = if id.as_str() < other {
+                (id.clone(), other.to_string())
+            } else {
+                (other.to_string(), id.clone())
+            };
+            scores.insert(pair, score);
+        }
+    }
+    let mut pairs: Vec<(String, String, f32)> = scores
+        .into_iter()
+        .map(|((a, b), score)| (a, b, score))
+        .collect();
+    pairs.sort_by(|a, b| {
+        b.2.total_cmp(&a.2)
+            .then_with(|| (&a.0, &a.1).cmp(&(&b.0, &b.1)))
+    });
+    pairs.truncate(limit);
+    pairs
+}
+
+fn sorted(map: &HashMap<String, impl ToString>) -> BTreeMap<&str, String> {
+    map.iter()
+        .map(|(k, v)| (k.as_str(), v.to_string()))
+        .collect()
+}
+
+fn entry_id(region: &str, key: &str) -> String {
+    format!("{}:{}", region, key)
+}
+
+fn shorten(value: &str) -> String {
+    match value.char_indices().nth(MAX_LABEL_CHARS) {
+        Some((end, _)) => format!("{}…", &value[..end]),
+        None => value.to_string(),
+    }
+}
+
+/// `text` as a DOT quoted string.
+fn quote(text: &str) -> String {
+    let mut quoted = String::with_capacity(text.len() + 2);
+    quoted.push('"');
+    for c in text.chars() {
+        match c {
+            '"' | '\\' => {
+                quoted.push('\\');
+                quoted.push(c);
+            }
+            '\n' => quoted.push_str("\\n"),
+            _ => quoted.push(c),
+        }
+    }
+    quoted.push('"');
+    quoted
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::introspect::AgentInfo;
+
+    fn memory() -> Snapshot {
+        let mut memory = Snapshot::default();
+        memory.mem_short.insert("msg".into(), "say \"hi\"".into());
+        memory
+            .mem_long
+            .insert("cat".into(), "the cat sat on the mat".into());
+        memory
+            .mem_long
+            .insert("kitten".into(), "a cat on a mat".into());
+        memory.links.insert("cat".into(), "pets".into());
+        memory
+    }
+
+    #[test]
+    fn renders_agents_memory_and_links() {
+        let agent = AgentInfo {
+            name: "Echo".into(),
+            handlers: Vec::new(),
+            events: Vec::new(),
+            goals: vec!["Remember".into()],
+            declared_memory: Vec::new(),
+            memory: Vec::new(),
+            links: Vec::new(),
+        };
+        assert_eq!(
+            dot(&memory(), &[agent], 0),
+            concat!(
+                "graph sentience {\n",
+                "  node [fontname=\"Helvetica\"];\n",
+                "  \"agent:Echo\" [label=\"Echo\", shape=box, style=bold];\n",
+                "  \"agent:Echo:goal:0\" [label=\"Remember\", shape=note];\n",
+                "  \"agent:Echo\" -- \"agent:Echo:goal:0\" [label=\"goal\"];\n",
+                "  \"agent:Echo\" -- \"mem.short\";\n",
+                "  \"agent:Echo\" -- \"mem.long\";\n",
+                "  subgraph \"cluster_short\" {\n",
+                "    label=\"mem.short\";\n",
+                "    \"mem.short\" [shape=folder];\n",
+                "    \"short:msg\" [label=\"msg = say \\\"hi\\\"\"];\n",
+                "  }\n",
+                "  \"mem.short\" -- \"short:msg\";\n",
+                "  subgraph \"cluster_long\" {\n",
+                "    label=\"mem.long\";\n",
+                "    \"mem.long\" [shape=folder];\n",
+                "    \"long:cat\" [label=\"cat = the cat sat on the mat\"];\n",
+                "    \"long:kitten\" [label=\"kitten = a cat on a mat\"];\n",
+                "  }\n",
+                "  \"mem.long\" -- \"long:cat\";\n",
+                "  \"mem.long\" -- \"long:kitten\";\n",
+                "  \"long:cat\" -- \"pets\" [label=\"link\"];\n",
+                "}\n",
+            )
+        );
+    }
+
+    #[test]
+    fn draws_the_strongest_similarities() {
+        let graph = dot(&memory(), &[], 1);
+        let dashed: Vec<&str> = graph.lines().filter(|l| l.contains("dashed")).collect();
+        assert_eq!(dashed.len(), 1, "{}", graph);
+        assert!(dashed[0].starts_with("  \"long:cat\" -- \"long:kitten\" [style=dashed"));
+        assert_eq!(shorten(&"x".repeat(41)), format!("{}…", "x".repeat(40)));
+    }
+}
@@ -0,0 +1,231 @@
+//! What an agent's memory looked like at a past moment, for finding out how
+//! a value came to be.
+//!
+//! While [`AgentContext::history`](crate::context::AgentContext::history) is
+//! set, every write that changes a memory value is kept with its time and
+//! the value it replaced. [`AgentContext::memory_at`] undoes the writes made
+//! after a moment, starting from the memory as it is now.
+
+use crate::logging;
+use std::collections::{BTreeMap, VecDeque};
+
+/// Writes kept by [`History::default`].
+pub const DEFAULT_CAPACITY: usize = 10_000;
+
+/// One memory write that changed a value.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct Write {
+    /// Unix milliseconds.
+    pub at: u64,
+    pub region: String,
+    pub key: String,
+    /// Value before the write; `None` if the key was new.
+    pub old: Option<String>,
+    pub value: String,
+}
+
+/// The latest memory writes, oldest first.
+#[derive(Clone, Debug)]
+pub struct History {
+    writes: VecDeque<Write>,
+    capacity: usize,
+    /// Earliest moment the writes cover: when recording started, or the
+    /// time of the last write dropped to stay within `capacity`.
+    since: u64,
+}
+
+impl Default for History {
+    fn default() -> Self {
+        Self::new(DEFAULT_CAPACITY)
+    }
+}
+
+impl History {
+    /// Keep up to `capacity` writes from now on.
+    pub fn new(capacity: usize) -> Self {
+        Self {
+            writes: VecDeque::new(),
+            capacity,
+            since: logging::unix_millis(),
+        }
+    }
+
+    /// Earliest moment [`AgentContext::memory_at`] can reconstruct, in Unix
+    /// milliseconds.
+    pub fn since(&self) -> u64 {
+        self.since
+    }
+
+    pub fn writes(&self) -> impl Iterator<Item = &Write> {
+        self.writes.iter()
+    }
+
+    pub fn record(&mut self, region: &str, key: &str, old: Option<String>, value: &str) {
+        self.push(Write {
+            at: logging::unix_millis(),
+            region: region.to_string(),
+            key: key.to_string(),
+            old,
+            value: value.to_string(),
+        });
+    }
+
+    fn push(&mut self, write: Write) {
+        if self.writes.len() >= self.capacity {
+            match self.writes.pop_front() {
+                Some(dropped) => self.since = dropped.at,
+                None => return,
+            }
+        }
+        self.writes.push_back(write);
+    }
+
+    /// Forget every write, e.g. after all memory was replaced.
+    pub fn reset(&mut self) {
+        self.writes.clear();
+        self.since = logging::unix_millis();
+    }
+
+    /// `entries`, the region as it is now, as it was at `at`.
+    pub(crate) fn undo(
+        &self,
+        region: &str,
+        mut entries: BTreeMap<String, String>,
+        at: u64,
+    ) -> BTreeMap<String, String> {
+        for write in self.writes.iter().rev() {
+            if write.at <= at {
+                break;
+            }
+            if write.region != region {
+                continue;
+            }
+            match &write.old {
+                Some(old) => entries.insert(write.key.clone(), old.clone()),
+                None => entries.remove(&write.key),
+            };
+        }
+        entries
+    }
+
+    /// The last write to `key` at or before `at`.
+    pub fn last_write(&self, region: &str, key: &str, at: u64) -> Option<&Write> {
+        self.writes
+            .iter()
+            .rev()
+            .skip_while(|write| write.at > at)
+            .find(|write| write.region == region && write.key == key)
+    }
+}
+
+/// Parse a UTC time such as `2024-05-01T10:00`, `2024-05-01 10:00:30` or
+/// `2024-05-01T10:00:30.250Z` into Unix milliseconds. A date alone means
+/// its midnight.
+pub fn parse_time(text: &str) -> Option<u64> {
+    let text = text.trim().trim_end_matches('Z');
+    let (date, time) = match text.split_once(['T', ' ']) {
+        Some((date, time)) => (date, time),
+        None => (text, "00:00"),
+    };
+    let mut date = date.splitn(3, '-').map(str::parse::<u32>);
+    let (year, month, day) = (date.next()?.ok()?, date.next()?.ok()?, date.next()?.ok()?);
+    if !(1..=12).contains(&month) || !(1..=31).contains(&day) {
+        return None;
+    }
+    let (time, millis) = match time.split_once('.') {
+        Some((time, fraction)) => {
+            let digits = format!("{:0<3}", fraction);
+            (time, digits.get(..3)?.parse::<u64>().ok()?)
+        }
+        None => (time, 0),
+    };
+    let mut time = time.splitn(3, ':').map(str::parse::<u64>);
+    let hour = time.next()?.ok()?;
+    let minute = time.next()?.ok()?;
+    let second = time.next().transpose().ok()?.unwrap_or(0);
+    if hour > 23 || minute > 59 || second > 59 {
+        return None;
+    }
+    let days = crate::schedule::days_from_civil(year as i64, month, day);
+    let secs = u64::try_from(days).ok()? * 86_400 + hour * 3600 + minute * 60 + second;
+    Some(secs * 1000 + millis)
+}
+
+/// `millis` as RFC 3339 in UTC, like log timestamps.
+pub fn format_time(millis: u64) -> String {
+    logging::format_timestamp(millis)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::context::AgentContext;
+
+    #[test]
+    fn parses_times_in_utc() {
+        assert_eq!(parse_time("1970-01-02"), Some(86_400_000));
+        assert_eq!(parse_time("2024-05-01T10:00"), Some(1_714_557_600_000));
+        assert_eq!(
+            parse_time("2024-05-01 10:00:30.25Z"),
+            Some(1_714_557_630_250)
+        );
+        assert_eq!(format_time(1_714_557_630_250), "2024-05-01T10:00:30.250Z");
+        assert_eq!(parse_time("2024-13-01"), None);
+        assert_eq!(parse_time("yesterday"), None);
+    }
+
+    #[test]
+    fn reconstructs_memory_at_a_past_moment() {
+        let mut ctx = AgentContext::new();
+        ctx.set_mem("short", "before", "kept");
+        let mut history = History::new(10);
+        let mut write = |at: u64, key: &str, old: Option<&str>, value: &str| {
+            history.push(Write {
+                at,
+                region: "short".to_string(),
+                key: key.to_string(),
+                old: old.map(str::to_string),
+                value: value.to_string(),
+            });
+        };
+        write(1_000, "msg", None, "hello");
+        write(2_000, "msg", Some("hello"), "hi there");
+        write(3_000, "mood", None, "curious");
+        history.since = 500;
+        ctx.set_mem("short", "msg", "hi there");
+        ctx.set_mem("short", "mood", "curious");
+        ctx.history = Some(history);
+
+        let at = |ms| ctx.memory_at("short", ms).unwrap();
+        assert_eq!(at(500).get("msg"), None);
+        assert_eq!(at(1_500)["msg"], "hello");
+        assert_eq!(at(1_500).get("mood"), None);
+        assert_eq!(at(2_500)["msg"], "hi there");
+        assert_eq!(at(2_500)["before"], "kept");
+        assert_eq!(at(5_000)["mood"], "curious");
+
+        let history = ctx.history.as_ref().unwrap();
+        assert_eq!(
+            history.last_write("short", "msg", 1_500).unwrap().value,
+            "hello"
+        );
+        assert!(history.last_write("short", "mood", 2_999).is_none());
+        assert_eq!(
+            ctx.memory_at("short", 100).unwrap_err().to_string(),
+            "memory history starts at 1970-01-01T00:00:00.500Z"
+        );
+    }
+
+    #[test]
+    fn keeps_only_the_latest_writes() {
+        let mut ctx = AgentContext::new();
+        ctx.history = Some(History::new(2));
+        for value in ["a", "b", "c"] {
+            ctx.set_mem("long", "k", value);
+        }
+        let history = ctx.history.as_ref().unwrap();
+        let values: Vec<&str> = history.writes().map(|w| w.value.as_str()).collect();
+        assert_eq!(values, ["b", "c"]);
+        assert_eq!(history.writes().next().unwrap().old.as_deref(), Some("a"));
+    }
+}
@@ -0,0 +1,358 @@
+//! A small blocking HTTP/1.1 server for the operational endpoints of
+//! long-running commands. Each connection gets its own thread, up to
+//! [`MAX_CONNECTIONS`] at once, and is closed after one response.
+
+use std::fmt;
+use std::io::{self, BufRead, BufReader, Read, Write};
+use std::net::{SocketAddr, TcpListener, TcpStream};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::mpsc::{Receiver, RecvTimeoutError};
+use std::sync::{Arc, Mutex};
+use std::thread;
+use std::time::Duration;
+
+/// Largest request body accepted.
+const MAX_BODY: usize = 1 << 20;
+
+/// Longest request line or header line accepted, in bytes.
+const MAX_LINE: usize = 8 << 10;
+
+/// Most headers accepted in one request.
+const MAX_HEADERS: usize = 100;
+
+/// How long a client may take to send each part of its request.
+const READ_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Connections served at once; more are answered 503 and closed.
+const MAX_CONNECTIONS: usize = 256;
+
+/// How long a stream may be idle before its heartbeat is written.
+const HEARTBEAT_INTERVAL: Duration = Duration::from_secs(15);
+
+#[derive(Clone, Debug, Default, PartialEq)]
+pub struct Request {
+    pub method: String,
+    /// Path without the query string.
+    pub path: String,
+    pub query: String,
+    /// Header names are lower-cased.
+    pub headers: Vec<(String, String)>,
+    pub body: Vec<u8>,
+}
+
+impl Request {
+    pub fn header(&self, name: &str) -> Option<&str> {
+        self.headers
+            .iter()
+            .find(|(n, _)| n.eq_ignore_ascii_case(name))
+            .map(|(_, v)| v.as_str())
+    }
+}
+
+#[derive(Clone, Debug, PartialEq)]
+pub struct Response {
+    pub status: u16,
+    pub content_type: String,
+    pub body: Vec<u8>,
+    /// Written after `body` as chunks arrive, for responses that stay open.
+    pub stream: Option<Stream>,
+}
+
+/// Chunks written to the client as they arrive, until every sender is
+/// dropped or the client goes away. `heartbeat` is written whenever the
+/// stream has been idle for a while, which also notices closed clients.
+#[derive(Clone)]
+pub struct Stream {
+    chunks: Arc<Mutex<Receiver<Vec<u8>>>>,
+    heartbeat: Vec<u8>,
+}
+
+impl fmt::Debug for Stream {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("Stream")
+    }
+}
+
+impl PartialEq for Stream {
+    fn eq(&self, other: &Self) -> bool {
+        Arc::ptr_eq(&self.chunks, &other.chunks)
+    }
+}
+
+impl Response {
+    pub fn new(status: u16, content_type: &str, body: impl Into<Vec<u8>>) -> Self {
+        Self {
+            status,
+            content_type: content_type.to_string(),
+            body: body.into(),
+            stream: None,
+        }
+    }
+
+    /// A 200 response that writes `body`, then each chunk from `chunks`.
+    pub fn stream(
+        content_type: &str,
+        body: impl Into<Vec<u8>>,
+        chunks: Receiver<Vec<u8>>,
+        heartbeat: &[u8],
+    ) -> Self {
+        Self {
+            stream: Some(Stream {
+                chunks: Arc::new(Mutex::new(chunks)),
+                heartbeat: heartbeat.to_vec(),
+            }),
+            ..Self::new(200, content_type, body)
+        }
+    }
+
+    pub fn text(status: u16, body: &str) -> Self {
+        Self::new(status, "text/plain; charset=utf-8", body)
+    }
+
+    pub fn not_found() -> Self {
+        Self::text(404, "not found\n")
+    }
+}
+
+pub type Handler = dyn Fn(&Request) -> Response + Send + Sync;
+
+/// Listen on `addr` and answer requests with `handler` from a background
+/// thread. Returns the bound address, which is useful with port 0.
+pub fn spawn(addr: &str, handler: Arc<Handler>) -> io::Result<SocketAddr> {
+    let listener = TcpListener::bind(addr)?;
+    let local = listener.local_addr()?;
+    let open = Arc::new(AtomicUsize::new(0));
+    thread::spawn(move || {
+        for mut stream in listener.incoming().flatten() {
+            if open.fetch_add(1, Ordering::SeqCst) >= MAX_CONNECTIONS {
+                open.fetch_sub(1, Ordering::SeqCst);
+                let _ = stream.set_write_timeout(Some(READ_TIMEOUT));
+                let _ = write_response(&mut stream, &Response::text(503, "too many connections\n"));
+                continue;
+            }
+            let (handler, open) = (Arc::clone(&handler), Arc::clone(&open));
+            thread::spawn(move || {
+                if let Err(e) = serve_connection(stream, &*handler) {
+                    tracing::debug!("http connection failed: {}", e);
+                }
+                open.fetch_sub(1, Ordering::SeqCst);
+            });
+        }
+    });
+    Ok(local)
+}
+
+fn serve_connection(stream: TcpStream, handler: &Handler) -> io::Result<()> {
+    stream.set_read_timeout(Some(READ_TIMEOUT))?;
+    let mut reader = BufReader::new(stream);
+    let response = match read_request(&mut reader) {
+        Ok(request) => handler(&request),
+        Err(e) if e.get_ref().is_some_and(|e| e.is::<HeadersTooLarge>()) => {
+            Response::text(431, "request headers too large\n")
+        }
+        Err(e) if e.kind() == io::ErrorKind::InvalidData => Response::text(400, "bad request\n"),
+        Err(e) => return Err(e),
+    };
+    write_response(reader.get_mut(), &response)
+}
+
+/// The headers of a request were longer or more numerous than accepted.
+#[derive(Debug)]
+struct HeadersTooLarge;
+
+impl fmt::Display for HeadersTooLarge {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("request headers too large")
+    }
+}
+
+impl std::error::Error for HeadersTooLarge {}
+
+/// Read one line of at most [`MAX_LINE`] bytes, or `None` if it is longer.
+fn read_line(reader: &mut impl BufRead) -> io::Result<Option<String>> {
+    let mut line = String::new();
+    reader.take(MAX_LINE as u64 + 1).read_line(&mut line)?;
+    Ok((line.len() <= MAX_LINE).then_some(line))
+}
+
+fn read_request(reader: &mut impl BufRead) -> io::Result<Request> {
+    let bad = |msg: &str| io::Error::new(io::ErrorKind::InvalidData, msg.to_string());
+    let too_large = || io::Error::new(io::ErrorKind::InvalidData, HeadersTooLarge);
+    let line = read_line(reader)?.ok_or_else(|| bad("request line too long"))?;
+    let mut parts = line.split_whitespace();
+    let (method, target) = match (parts.next(), parts.next()) {
+        (Some(method), Some(target)) => (method.to_string(), target),
+        _ => return Err(bad("malformed request line")),
+    };
+    let (path, query) = target.split_once('?').unwrap_or((target, ""));
+    let mut request = Request {
+        method,
+        path: path.to_string(),
+        query: query.to_string(),
+        ..Default::default()
+    };
+
+    loop {
+        let line = read_line(reader)?.ok_or_else(too_large)?;
+        let line = line.trim_end();
+        if line.is_empty() {
+            break;
+        }
+        if request.headers.len() == MAX_HEADERS {
+            return Err(too_large());
+        }
+        let (name, value) = line
+            .split_once(':')
+            .ok_or_else(|| bad("malformed header"))?;
+        request
+            .headers
+            .push((name.trim().to_ascii_lowercase(), value.trim().to_string()));
+    }
+
+    let length = match request.header("content-length") {
+        Some(v) => v.parse().map_err(|_| bad("invalid content-length"))?,
+        None => 0,
+    };
+    if length > MAX_BODY {
+        return Err(bad("body too large"));
+    }
+    request.body = vec![0; length];
+    reader.read_exact(&mut request.body)?;
+    Ok(request)
+}
+
+fn write_response(stream: &mut impl Write, response: &Response) -> io::Result<()> {
+    if let Some(chunks) = &response.stream {
+        return write_stream(stream, response, chunks);
+    }
+    write!(
+        stream,
+        "HTTP/1.1 {} {}\r\nContent-Type: {}\r\nContent-Length: {}\r\nConnection: close\r\n\r\n",
+        response.status,
+        reason(response.status),
+        response.content_type,
+        response.body.len()
+    )?;
+    stream.write_all(&response.body)?;
+    stream.flush()
+}
+
+/// Write a response without a length, so the client reads until it closes.
+fn write_stream(stream: &mut impl Write, response: &Response, chunks: &Stream) -> io::Result<()> {
+    write!(
+        stream,
+        "HTTP/1.1 {} {}\r\nContent-Type: {}\r\nCache-Control: no-cache\r\n\
+         Access-Control-Allow-Origin: *\r\nConnection: close\r\n\r\n",
+        response.status,
+        reason(response.status),
+        response.content_type,
+    )?;
+    stream.write_all(&response.body)?;
+    stream.flush()?;
+    let receiver = chunks
+        .chunks
+        .lock()
+        .map_err(|_| io::Error::other("stream lock poisoned"))?;
+    loop {
+        let chunk = match receiver.recv_timeout(HEARTBEAT_INTERVAL) {
+            Ok(chunk) => chunk,
+            Err(RecvTimeoutError::Timeout) => chunks.heartbeat.clone(),
+            Err(RecvTimeoutError::Disconnected) => return Ok(()),
+        };
+        stream.write_all(&chunk)?;
+        stream.flush()?;
+    }
+}
+
+fn reason(status: u16) -> &'static str {
+    match status {
+        200 => "OK",
+        201 => "Created",
+        204 => "No Content",
+        400 => "Bad Request",
+        401 => "Unauthorized",
+        404 => "Not Found",
+        405 => "Method Not Allowed",
+        422 => "Unprocessable Entity",
+        429 => "Too Many Requests",
+        431 => "Request Header Fields Too Large",
+        500 => "Internal Server Error",
+        503 => "Service Unavailable",
+        _ => "",
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn answers_requests() {
+        let addr = spawn(
+            "127.0.0.1:0",
+            Arc::new(|request: &Request| match request.path.as_str() {
+                "/echo" => Response::text(200, &String::from_utf8_lossy(&request.body)),
+                _ => Response::not_found(),
+            }),
+        )
+        .unwrap();
+
+        let client = reqwest::blocking::Client::new();
+        let echoed = client
+            .post(format!("http://{}/echo?x=1", addr))
+            .body("ping")
+            .send()
+            .unwrap();
+        assert_eq!(echoed.status().as_u16(), 200);
+        assert_eq!(echoed.text().unwrap(), "ping");
+
+        let missing = client.get(format!("http://{}/nope", addr)).send().unwrap();
+        assert_eq!(missing.status().as_u16(), 404);
+    }
+
+    #[test]
+    fn writes_the_reason_for_each_status() {
+        let mut written = Vec::new();
+        write_response(&mut written, &Response::text(429, "slow down\n")).unwrap();
+        let written = String::from_utf8(written).unwrap();
+        assert!(
+            written.starts_with("HTTP/1.1 429 Too Many Requests\r\n"),
+            "{}",
+            written
+        );
+    }
+
+    #[test]
+    fn refuses_oversized_requests() {
+        let read = |request: String| read_request(&mut request.as_bytes());
+        let header = format!("x-long: {}\r\n", "a".repeat(MAX_LINE));
+        let err = read(format!("GET / HTTP/1.1\r\n{}\r\n", header)).unwrap_err();
+        assert!(err.get_ref().unwrap().is::<HeadersTooLarge>());
+
+        let headers = "x: 1\r\n".repeat(MAX_HEADERS + 1);
+        let err = read(format!("GET / HTTP/1.1\r\n{}\r\n", headers)).unwrap_err();
+        assert!(err.get_ref().unwrap().is::<HeadersTooLarge>());
+
+        let err = read(format!("GET /{} HTTP/1.1\r\n\r\n", "a".repeat(MAX_LINE))).unwrap_err();
+        assert_eq!(err.to_string(), "request line too long");
+
+        let headers = "x: 1\r\n".repeat(MAX_HEADERS);
+        let request = read(format!("GET / HTTP/1.1\r\n{}\r\n", headers)).unwrap();
+        assert_eq!(request.headers.len(), MAX_HEADERS);
+    }
+
+    #[test]
+    fn answers_431_for_too_many_headers() {
+        let addr = spawn(
+            "127.0.0.1:0",
+            Arc::new(|_: &Request| Response::text(200, "ok")),
+        )
+        .unwrap();
+        let mut stream = TcpStream::connect(addr).unwrap();
+        let headers = "x: 1\r\n".repeat(MAX_HEADERS + 1);
+        write!(stream, "GET / HTTP/1.1\r\n{}\r\n", headers).unwrap();
+        let mut response = String::new();
+        stream.read_to_string(&mut response).unwrap();
+        assert!(response.starts_with("HTTP/1.1 431 "), "{}", response);
+    }
+}
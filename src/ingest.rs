@@ -0,0 +1,360 @@
+//! Loading documents into long-term memory, so an agent starts out knowing
+//! what they say: `sentience-repl ingest docs/ --into memory.json`.
+//!
+//! Text and Markdown files are read as they are and PDFs through
+//! `pdftotext` from poppler-utils. Each document is cut into chunks of whole
+//! paragraphs, stored under `<collection>/<path>#<n>`, with a JSON summary of
+//! the document under `<collection>/<path>`. Chunks are embedded with
+//! [`sync::embed`], the vectors memory sync stores, and a chunk nearly the
+//! same as one already ingested in the run, such as a repeated footer, is
+//! left out.
+
+use crate::context::AgentContext;
+use crate::sync;
+use serde::Serialize;
+use serde_json::json;
+use std::fs;
+use std::path::Path;
+use std::process::Command;
+
+pub const DEFAULT_COLLECTION: &str = "docs";
+/// Most characters in a chunk, unless one word is longer.
+pub const DEFAULT_CHUNK_SIZE: usize = 1000;
+/// Similarity from which a chunk counts as a duplicate.
+const DUPLICATE_SIMILARITY: f32 = 0.98;
+
+#[derive(Clone, Debug, PartialEq)]
+pub struct Options {
+    /// Prefix of the keys chunks are stored under.
+    pub collection: String,
+    pub chunk_size: usize,
+}
+
+impl Default for Options {
+    fn default() -> Self {
+        Self {
+            collection: DEFAULT_COLLECTION.to_string(),
+            chunk_size: DEFAULT_CHUNK_SIZE,
+        }
+    }
+}
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Format {
+    Text,
+    Markdown,
+    Pdf,
+}
+
+impl Format {
+    /// The format of files named like `path`, if it is one that is read.
+    pub fn of(path: &Path) -> Option<Self> {
+        let extension = path.extension()?.to_str()?.to_ascii_lowercase();
+        match extension.as_str() {
+            "txt" | "text" => Some(Format::Text),
+            "md" | "markdown" => Some(Format::Markdown),
+            "pdf" => Some(Format::Pdf),
+            _ => None,
+        }
+    }
+}
+
+/// A document's text and where it came from.
+#[derive(Clone, Debug, PartialEq)]
+pub struct Document {
+    /// Path relative to the directory given, with `/` separators; the file
+    /// name for a file given directly.
+    pub name: String,
+    pub format: Format,
+    pub text: String,
+}
+
+/// What one ingestion stored.
+#[derive(Clone, Debug, Default, PartialEq, Serialize)]
+pub struct Report {
+    pub documents: usize,
+    pub chunks: usize,
+    pub duplicates: usize,
+}
+
+impl Report {
+    pub fn summary(&self, collection: &str) -> String {
+        let mut line = format!(
+            "Ingested {} document{} as {} chunk{} into `{}`",
+            self.documents,
+            if self.documents == 1 { "" } else { "s" },
+            self.chunks,
+            if self.chunks == 1 { "" } else { "s" },
+            collection
+        );
+        if self.duplicates > 0 {
+            line.push_str(&format!(", leaving out {} duplicate(s)", self.duplicates));
+        }
+        line
+    }
+}
+
+/// Read the document at `path` or, for a directory, every document under
+/// it in path order. Files of other formats are skipped.
+pub fn read(path: &Path) -> Result<Vec<Document>, String> {
+    let mut documents = Vec::new();
+    if path.is_dir() {
+        let mut files = Vec::new();
+        walk(path, &mut files).map_err(|e| format!("{}: {}", path.display(), e))?;
+        files.sort();
+        for file in files {
+            let name = file
+                .strip_prefix(path)
+                .unwrap_or(&file)
+                .components()
+                .map(|part| part.as_os_str().to_string_lossy())
+                .collect::<Vec<_>>()
+                .join("/");
+            documents.extend(read_file(&file, name)?);
+        }
+    } else {
+        let name = path.file_name().map_or_else(
+            || path.display().to_string(),
+            |n| n.to_string_lossy().into(),
+        );
+        match read_file(path, name)? {
+            Some(document) => documents.push(document),
+            None => {
+                return Err(format!(
+                    "{}: not a text, Markdown or PDF file",
+                    path.display()
+                ))
+            }
+        }
+    }
+    Ok(documents)
+}
+
+fn walk(dir: &Path, files: &mut Vec<std::path::PathBuf>) -> std::io::Result<()> {
+    for entry in fs::read_dir(dir)? {
+        let path = entry?.path();
+        if path.is_dir() {
+            walk(&path, files)?;
+        } else if Format::of(&path).is_some() {
+            files.push(path);
+        }
+    }
+    Ok(())
+}
+
+fn read_file(path: &Path, name: String) -> Result<Option<Document>, String> {
+    let Some(format) = Format::of(path) else {
+        return Ok(None);
+    };
+    let text = match format {
+        Format::Pdf => pdf_text(path),
+        _ => fs::read_to_string(path).map_err(|e| e.to_string()),
+    }
+    .map_err(|e| format!("{}: {}", path.display(), e))?;
+    Ok(Some(Document { name, format, text }))
+}
+
+fn pdf_text(path: &Path) -> Result<String, String> {
+    let output = Command::new("pdftotext")
+        .args(["-layout", "-enc", "UTF-8"])
+        .arg(path)
+        .arg("-")
+        .output()
+        .map_err(|e| format!("reading PDFs needs `pdftotext` (poppler-utils): {}", e))?;
+    if !output.status.success() {
+        return Err(format!(
+            "pdftotext failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        ));
+    }
+    Ok(String::from_utf8_lossy(&output.stdout).into_owned())
+}
+
+/// Cut `text` into chunks of at most `size` characters, keeping paragraphs
+/// whole where they fit and otherwise splitting them between words.
+pub fn chunk(text: &str, size: usize) -> Vec<String> {
+    let size = size.max(1);
+    let mut chunks = Vec::new();
+    let mut current = String::new();
+    for paragraph in text
+        .replace("\r\n", "\n")
+        .split("\n\n")
+        .map(str::trim)
+        .filter(|p| !p.is_empty())
+    {
+        if paragraph.chars().count() <= size {
+            append(&mut chunks, &mut current, "\n\n", paragraph, size);
+            continue;
+        }
+        // A paragraph too long for one chunk starts a new one.
+        if !current.is_empty() {
+            chunks.push(std::mem::take(&mut current));
+        }
+        for word in paragraph.split_whitespace() {
+            append(&mut chunks, &mut current, " ", word, size);
+        }
+    }
+    if !current.is_empty() {
+        chunks.push(current);
+    }
+    chunks
+}
+
+/// Add `piece` to `current` after `separator`, first moving `current` to
+/// `chunks` if `piece` would not fit.
+fn append(
+    chunks: &mut Vec<String>,
+    current: &mut String,
+    separator: &str,
+    piece: &str,
+    size: usize,
+) {
+    if current.is_empty() {
+        current.push_str(piece);
+    } else if current.chars().count() + separator.len() + piece.chars().count() > size {
+        chunks.push(std::mem::replace(current, piece.to_string()));
+    } else {
+        current.push_str(separator);
+        current.push_str(piece);
+    }
+}
+
+/// The first Markdown heading of `text`, if any.
+fn title(text: &str) -> Option<&str> {
+    text.lines()
+        .find_map(|line| line.strip_prefix('#'))
+        .map(|heading| heading.trim_start_matches('#').trim())
+        .filter(|heading| !heading.is_empty())
+}
+
+/// Store `documents` in the long-term memory of `ctx`, replacing the
+/// chunks of any document ingested before under the same name.
+pub fn ingest(ctx: &mut AgentContext, documents: &[Document], options: &Options) -> Report {
+    let _span = tracing::info_span!("ingest", collection = %options.collection).entered();
+    let mut report = Report::default();
+    let mut seen: Vec<Vec<f32>> = Vec::new();
+    for document in documents {
+        let key = format!("{}/{}", options.collection, document.name);
+        let stale: Vec<String> = ctx
+            .mem_long
+            .keys()
+            .filter(|k| {
+                k.strip_prefix(key.as_str())
+                    .and_then(|rest| rest.strip_prefix('#'))
+                    .is_some_and(|n| n.parse::<usize>().is_ok())
+            })
+            .map(|k| k.to_string())
+            .collect();
+        for old in stale {
+            ctx.remove_mem("long", &old);
+        }
+
+        let mut stored = 0;
+        for text in chunk(&document.text, options.chunk_size) {
+            let vector = sync::embed(&text);
+            let duplicate = seen.iter().any(|other| {
+                other.iter().zip(&vector).map(|(a, b)| a * b).sum::<f32>() >= DUPLICATE_SIMILARITY
+            });
+            if duplicate {
+                report.duplicates += 1;
+                continue;
+            }
+            seen.push(vector);
+            stored += 1;
+            ctx.set_mem("long", &format!("{}#{}", key, stored), &text);
+        }
+        let title = match document.format {
+            Format::Markdown => title(&document.text),
+            _ => None,
+        };
+        let summary = json!({
+            "source": document.name,
+            "format": document.format,
+            "title": title,
+            "chunks": stored,
+            "characters": document.text.chars().count(),
+        });
+        ctx.set_mem("long", &key, &summary.to_string());
+        tracing::debug!(document = %document.name, chunks = stored, "ingested");
+        report.documents += 1;
+        report.chunks += stored;
+    }
+    report
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn chunks_keep_paragraphs_whole() {
+        let text = "First paragraph.\r\n\r\nSecond one,\nover two lines.\n\n\n\nThird.";
+        assert_eq!(
+            chunk(text, 50),
+            ["First paragraph.\n\nSecond one,\nover two lines.", "Third."]
+        );
+        assert_eq!(
+            chunk("short\n\none two three four five six", 10),
+            ["short", "one two", "three four", "five six"]
+        );
+        assert_eq!(chunk("supercalifragilistic", 5), ["supercalifragilistic"]);
+        assert!(chunk(" \n\n ", 10).is_empty());
+    }
+
+    #[test]
+    fn stores_chunks_and_a_summary_per_document() {
+        let dir = std::env::temp_dir().join(format!("sentience-ingest-{}", std::process::id()));
+        fs::create_dir_all(dir.join("guide")).unwrap();
+        fs::write(
+            dir.join("guide/setup.md"),
+            "# Setup\n\nInstall with cargo.\n\nCopyright Example Inc.",
+        )
+        .unwrap();
+        fs::write(
+            dir.join("notes.txt"),
+            "Belgrade is on the Danube.\n\nCopyright Example Inc.",
+        )
+        .unwrap();
+        fs::write(dir.join("image.png"), "not text").unwrap();
+        let documents = read(&dir).unwrap();
+        fs::remove_dir_all(&dir).unwrap();
+        let names: Vec<&str> = documents.iter().map(|d| d.name.as_str()).collect();
+        assert_eq!(names, ["guide/setup.md", "notes.txt"]);
+
+        let mut ctx = AgentContext::new();
+        ctx.set_mem("long", "docs/notes.txt#3", "stale");
+        let options = Options {
+            chunk_size: 26,
+            ..Options::default()
+        };
+        let report = ingest(&mut ctx, &documents, &options);
+        assert_eq!(
+            report,
+            Report {
+                documents: 2,
+                chunks: 4,
+                duplicates: 1,
+            }
+        );
+        assert_eq!(
+            report.summary("docs"),
+            "Ingested 2 documents as 4 chunks into `docs`, leaving out 1 duplicate(s)"
+        );
+        assert_eq!(
+            ctx.get_mem("long", "docs/guide/setup.md#2"),
+            "Install with cargo."
+        );
+        assert_eq!(
+            ctx.get_mem("long", "docs/notes.txt#1"),
+            "Belgrade is on the Danube."
+        );
+        assert_eq!(ctx.get_mem("long", "docs/notes.txt#2"), "");
+        assert_eq!(ctx.get_mem("long", "docs/notes.txt#3"), "");
+        let summary: serde_json::Value =
+            serde_json::from_str(&ctx.get_mem("long", "docs/guide/setup.md")).unwrap();
+        assert_eq!(summary["title"], "Setup");
+        assert_eq!(summary["format"], "markdown");
+        assert_eq!(summary["chunks"], 3);
+    }
+}
@@ -0,0 +1,99 @@
+//! Interned strings for memory keys. A long-running agent writes the same
+//! few keys over and over; interning them stores each key once and lets a
+//! write to an existing key allocate nothing.
+
+use crate::expr::Value;
+use serde::{Serialize, Serializer};
+use std::collections::{BTreeMap, HashMap, HashSet};
+use std::sync::{Arc, Mutex, OnceLock};
+
+/// An interned string. Clones share one allocation.
+pub type Symbol = Arc<str>;
+
+/// A memory region: interned keys to values.
+pub type Memory = HashMap<Symbol, Value>;
+
+/// Symbols kept before the first sweep for unused ones.
+const MIN_SWEEP: usize = 1024;
+
+struct Interner {
+    symbols: HashSet<Symbol>,
+    /// Size at which symbols no longer referenced elsewhere are dropped.
+    sweep_at: usize,
+}
+
+fn interner() -> &'static Mutex<Interner> {
+    static INTERNER: OnceLock<Mutex<Interner>> = OnceLock::new();
+    INTERNER.get_or_init(|| {
+        Mutex::new(Interner {
+            symbols: HashSet::new(),
+            sweep_at: MIN_SWEEP,
+        })
+    })
+}
+
+/// The symbol for `text`, shared with every other use of the same text.
+pub fn intern(text: &str) -> Symbol {
+    let mut interner = interner().lock().unwrap_or_else(|e| e.into_inner());
+    if let Some(symbol) = interner.symbols.get(text) {
+        return Arc::clone(symbol);
+    }
+    if interner.symbols.len() >= interner.sweep_at {
+        // Keys deleted from every map are only referenced from here.
+        interner
+            .symbols
+            .retain(|symbol| Arc::strong_count(symbol) > 1);
+        interner.sweep_at = (interner.symbols.len() * 2).max(MIN_SWEEP);
+    }
+    let symbol: Symbol = Arc::from(text);
+    interner.symbols.insert(Arc::clone(&symbol));
+    symbol
+}
+
+/// Intern the keys of a map read from outside, such as a saved snapshot.
+pub fn memory(entries: HashMap<String, impl Into<Value>>) -> Memory {
+    entries
+        .into_iter()
+        .map(|(key, value)| (intern(&key), value.into()))
+        .collect()
+}
+
+/// `memory` with plain keys, for callers outside the runtime.
+pub fn values(memory: &Memory) -> HashMap<String, Value> {
+    memory
+        .iter()
+        .map(|(key, value)| (key.to_string(), value.clone()))
+        .collect()
+}
+
+/// The plain-string form of `memory`, with each value as text.
+pub fn strings(memory: &Memory) -> HashMap<String, String> {
+    memory
+        .iter()
+        .map(|(key, value)| (key.to_string(), value.to_string()))
+        .collect()
+}
+
+/// Serialize `map` with its keys in sorted order, so saving the same memory
+/// twice gives the same output. Use with `#[serde(serialize_with)]`.
+pub fn serialize_sorted<K, V, S>(map: &HashMap<K, V>, serializer: S) -> Result<S::Ok, S::Error>
+where
+    K: Ord + Serialize,
+    V: Serialize,
+    S: Serializer,
+{
+    map.iter().collect::<BTreeMap<_, _>>().serialize(serializer)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn shares_one_allocation_per_string() {
+        let a = intern("intern-test-key");
+        let b = intern(&String::from("intern-test-key"));
+        assert!(Arc::ptr_eq(&a, &b));
+        assert!(!Arc::ptr_eq(&a, &intern("intern-test-other")));
+    }
+}
@@ -0,0 +1,123 @@
+use crate::context::AgentContext;
+use crate::types::Statement;
+use serde::Serialize;
+
+/// Structured description of the registered agent.
+#[derive(Clone, Debug, PartialEq, Serialize)]
+pub struct AgentInfo {
+    pub name: String,
+    /// Handler blocks the agent defines: `input`, `train`, `evolve`.
+    pub handlers: Vec<String>,
+    /// Events the agent reacts to, with their parameter, e.g. `input(msg)`.
+    pub events: Vec<String>,
+    pub goals: Vec<String>,
+    /// Regions named in `mem` declarations.
+    pub declared_memory: Vec<String>,
+    pub memory: Vec<MemoryRegionInfo>,
+    pub links: Vec<(String, String)>,
+}
+
+#[derive(Clone, Debug, PartialEq, Serialize)]
+pub struct MemoryRegionInfo {
+    pub region: String,
+    pub entries: usize,
+}
+
+/// Describe the context's current agent, or `None` if none is registered.
+pub fn describe(ctx: &AgentContext) -> Option<AgentInfo> {
+    let (name, body) = match &ctx.current_agent {
+        Some(Statement::AgentDeclaration { name, body }) => (name, body),
+        _ => return None,
+    };
+
+    let mut info = AgentInfo {
+        name: name.clone(),
+        handlers: Vec::new(),
+        events: Vec::new(),
+        goals: Vec::new(),
+        declared_memory: Vec::new(),
+        memory: memory_regions(ctx),
+        links: links(ctx),
+    };
+
+    for stmt in body {
+        match stmt {
+            Statement::OnInput { param, .. } => {
+                info.handlers.push("input".to_string());
+                info.events.push(format!("input({})", param));
+            }
+            Statement::OnSchedule { spec, .. } => {
+                info.handlers.push("schedule".to_string());
+                info.events.push(format!("schedule(\"{}\")", spec));
+            }
+            Statement::OnOutput { param, .. } => {
+                info.handlers.push("output".to_string());
+                info.events.push(format!("output({})", param));
+            }
+            Statement::OnStart { .. } => info.handlers.push("start".to_string()),
+            Statement::OnStop { .. } => info.handlers.push("stop".to_string()),
+            Statement::Train { .. } => info.handlers.push("train".to_string()),
+            Statement::Evolve { .. } => info.handlers.push("evolve".to_string()),
+            Statement::Goal(text) => info.goals.push(text.clone()),
+            Statement::MemDeclaration { target } => info.declared_memory.push(target.clone()),
+            _ => {}
+        }
+    }
+
+    Some(info)
+}
+
+/// Entry counts for every memory region.
+pub fn memory_regions(ctx: &AgentContext) -> Vec<MemoryRegionInfo> {
+    vec![
+        MemoryRegionInfo {
+            region: "short".to_string(),
+            entries: ctx.mem_short.len(),
+        },
+        MemoryRegionInfo {
+            region: "long".to_string(),
+            entries: ctx.mem_long.len(),
+        },
+    ]
+}
+
+/// Links sorted by source, so listings are stable.
+pub fn links(ctx: &AgentContext) -> Vec<(String, String)> {
+    let mut links: Vec<(String, String)> = ctx
+        .links
+        .iter()
+        .map(|(from, to)| (from.clone(), to.clone()))
+        .collect();
+    links.sort();
+    links
+}
+
+impl AgentInfo {
+    /// Human-readable multi-line summary, as printed by `.agents`.
+    pub fn render(&self) -> Vec<String> {
+        let mut lines = vec![format!("Agent: {}", self.name)];
+        lines.push(format!("  Handlers: {}", list_or_none(&self.handlers)));
+        lines.push(format!("  Events: {}", list_or_none(&self.events)));
+        for goal in &self.goals {
+            lines.push(format!("  Goal: \"{}\"", goal));
+        }
+        for region in &self.memory {
+            lines.push(format!(
+                "  mem.{}: {} entries",
+                region.region, region.entries
+            ));
+        }
+        for (from, to) in &self.links {
+            lines.push(format!("  Link: {} <-> {}", from, to));
+        }
+        lines
+    }
+}
+
+fn list_or_none(items: &[String]) -> String {
+    if items.is_empty() {
+        "none".to_string()
+    } else {
+        items.join(", ")
+    }
+}
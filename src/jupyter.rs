@@ -0,0 +1,626 @@
+//! Jupyter kernel: runs notebook cells as Sentience source against one
+//! agent context that lives as long as the kernel, i.e. the notebook
+//! session. Cells are evaluated like REPL input, so dot-commands such as
+//! `.input hello` work too.
+
+use crate::hmac::{constant_time_eq, hmac_sha256};
+use crate::replkit::Repl;
+use crate::zmtp::{Peer, PeerWriter};
+use serde::Deserialize;
+use serde_json::{json, Value};
+use sha2::{Digest, Sha256};
+use std::io::{self, Write};
+use std::net::TcpListener;
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::mpsc::{self, Receiver, Sender};
+use std::sync::{Arc, Mutex};
+use std::thread;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+pub const PROTOCOL_VERSION: &str = "5.3";
+const DELIMITER: &[u8] = b"<IDS|MSG>";
+
+/// The connection file Jupyter passes to a kernel it starts.
+#[derive(Clone, Debug, Deserialize)]
+pub struct ConnectionInfo {
+    pub transport: String,
+    pub ip: String,
+    pub shell_port: u16,
+    pub iopub_port: u16,
+    pub stdin_port: u16,
+    pub control_port: u16,
+    pub hb_port: u16,
+    /// Messages are signed with this key; unsigned when empty.
+    #[serde(default)]
+    pub key: String,
+    #[serde(default)]
+    pub signature_scheme: String,
+}
+
+impl ConnectionInfo {
+    pub fn load(path: &Path) -> Result<Self, String> {
+        let text =
+            std::fs::read_to_string(path).map_err(|e| format!("{}: {}", path.display(), e))?;
+        serde_json::from_str(&text).map_err(|e| format!("{}: {}", path.display(), e))
+    }
+}
+
+/// A message in the Jupyter wire format.
+#[derive(Clone, Debug, Default, PartialEq)]
+pub struct Message {
+    /// Routing prefix, returned unchanged with replies.
+    pub identities: Vec<Vec<u8>>,
+    pub header: Value,
+    pub parent_header: Value,
+    pub metadata: Value,
+    pub content: Value,
+}
+
+impl Message {
+    pub fn msg_type(&self) -> &str {
+        self.header["msg_type"].as_str().unwrap_or_default()
+    }
+}
+
+/// Signs and checks messages with the connection key.
+#[derive(Clone)]
+pub struct Signer {
+    key: Vec<u8>,
+}
+
+impl Signer {
+    pub fn new(key: &str) -> Self {
+        Self {
+            key: key.as_bytes().to_vec(),
+        }
+    }
+
+    fn sign(&self, parts: &[Vec<u8>]) -> Vec<u8> {
+        if self.key.is_empty() {
+            return Vec::new();
+        }
+        hex::encode(hmac_sha256(&self.key, &parts.concat())).into_bytes()
+    }
+
+    pub fn encode(&self, message: &Message) -> Vec<Vec<u8>> {
+        let parts: Vec<Vec<u8>> = [
+            &message.header,
+            &message.parent_header,
+            &message.metadata,
+            &message.content,
+        ]
+        .iter()
+        .map(|part| part.to_string().into_bytes())
+        .collect();
+        let mut frames = message.identities.clone();
+        frames.push(DELIMITER.to_vec());
+        frames.push(self.sign(&parts));
+        frames.extend(parts);
+        frames
+    }
+
+    pub fn decode(&self, mut frames: Vec<Vec<u8>>) -> Result<Message, String> {
+        let at = frames
+            .iter()
+            .position(|f| f == DELIMITER)
+            .ok_or("missing <IDS|MSG> delimiter")?;
+        let mut rest = frames.split_off(at + 1);
+        frames.pop();
+        if rest.len() < 5 {
+            return Err("truncated message".to_string());
+        }
+        let parts = rest.split_off(1);
+        let parts = &parts[..4];
+        if !self.key.is_empty() && !constant_time_eq(&self.sign(parts), &rest[0]) {
+            return Err("invalid signature".to_string());
+        }
+        let json = |bytes: &[u8]| serde_json::from_slice(bytes).map_err(|e| e.to_string());
+        Ok(Message {
+            identities: frames,
+            header: json(&parts[0])?,
+            parent_header: json(&parts[1])?,
+            metadata: json(&parts[2])?,
+            content: json(&parts[3])?,
+        })
+    }
+}
+
+/// What a cell wrote, collected between requests.
+#[derive(Clone, Default)]
+pub struct Output(Arc<Mutex<Vec<u8>>>);
+
+impl Output {
+    pub(crate) fn take(&self) -> String {
+        let bytes = self.0.lock().map(|mut b| std::mem::take(&mut *b));
+        String::from_utf8_lossy(&bytes.unwrap_or_default()).into_owned()
+    }
+}
+
+impl Write for Output {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        if let Ok(mut bytes) = self.0.lock() {
+            bytes.extend_from_slice(buf);
+        }
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        Ok(())
+    }
+}
+
+/// Which socket a request arrived on.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+enum Channel {
+    Shell,
+    Control,
+}
+
+/// Kernel whose sockets are bound and accepting connections.
+pub struct Kernel {
+    repl: Repl<io::Empty, Output>,
+    output: Output,
+    signer: Signer,
+    session: String,
+    execution_count: u64,
+    requests: Receiver<(Channel, PeerWriter, Vec<Vec<u8>>)>,
+    subscribers: Arc<Mutex<Vec<PeerWriter>>>,
+    ports: ConnectionInfo,
+}
+
+impl Kernel {
+    /// Bind every socket named in `info` (port 0 picks a free port; see
+    /// [`ports`](Self::ports)) and start accepting connections.
+    pub fn bind(info: &ConnectionInfo) -> Result<Self, String> {
+        if info.transport != "tcp" {
+            return Err(format!("unsupported transport `{}`", info.transport));
+        }
+        if !info.key.is_empty() && info.signature_scheme != "hmac-sha256" {
+            return Err(format!(
+                "unsupported signature scheme `{}`",
+                info.signature_scheme
+            ));
+        }
+        let bind = |port: u16| {
+            TcpListener::bind((info.ip.as_str(), port))
+                .map_err(|e| format!("{}:{}: {}", info.ip, port, e))
+        };
+        let port = |listener: &TcpListener| listener.local_addr().map(|a| a.port()).unwrap_or(0);
+        let (shell, control, iopub, stdin, hb) = (
+            bind(info.shell_port)?,
+            bind(info.control_port)?,
+            bind(info.iopub_port)?,
+            bind(info.stdin_port)?,
+            bind(info.hb_port)?,
+        );
+        let ports = ConnectionInfo {
+            shell_port: port(&shell),
+            control_port: port(&control),
+            iopub_port: port(&iopub),
+            stdin_port: port(&stdin),
+            hb_port: port(&hb),
+            ..info.clone()
+        };
+
+        let (sender, requests) = mpsc::channel();
+        accept_requests(shell, Channel::Shell, sender.clone());
+        accept_requests(control, Channel::Control, sender);
+        let subscribers = Arc::new(Mutex::new(Vec::new()));
+        accept_subscribers(iopub, Arc::clone(&subscribers));
+        // Input requests are never sent, so stdin only needs to accept.
+        accept(stdin, "ROUTER", |_peer| {});
+        accept(hb, "REP", |mut peer| {
+            while let Ok(message) = peer.recv() {
+                if peer.send(&message).is_err() {
+                    break;
+                }
+            }
+        });
+
+        let output = Output::default();
+        let mut repl = Repl::new(io::empty(), output.clone());
+        repl.set_prompt("");
+        Ok(Self {
+            repl,
+            output,
+            signer: Signer::new(&info.key),
+            session: new_id(),
+            execution_count: 0,
+            requests,
+            subscribers,
+            ports,
+        })
+    }
+
+    /// The connection info with the ports actually bound.
+    pub fn ports(&self) -> &ConnectionInfo {
+        &self.ports
+    }
+
+    /// The REPL cells run in, e.g. to configure its context.
+    pub fn repl_mut(&mut self) -> &mut Repl<io::Empty, Output> {
+        &mut self.repl
+    }
+
+    /// Answer requests until a `shutdown_request`.
+    pub fn run(mut self) -> Result<(), String> {
+        self.publish(
+            &Message::default(),
+            "status",
+            json!({ "execution_state": "starting" }),
+        );
+        while let Ok((channel, peer, frames)) = self.requests.recv() {
+            let request = match self.signer.decode(frames) {
+                Ok(request) => request,
+                Err(e) => {
+                    tracing::warn!("dropped {:?} message: {}", channel, e);
+                    continue;
+                }
+            };
+            self.publish(&request, "status", json!({ "execution_state": "busy" }));
+            let (reply_type, content) = self.handle(&request);
+            let reply = self.reply(&request, &reply_type, content);
+            if let Err(e) = peer.send(&self.signer.encode(&reply)) {
+                tracing::warn!("could not send {}: {}", reply_type, e);
+            }
+            self.publish(&request, "status", json!({ "execution_state": "idle" }));
+            if reply_type == "shutdown_reply" {
+                return Ok(());
+            }
+        }
+        Ok(())
+    }
+
+    fn handle(&mut self, request: &Message) -> (String, Value) {
+        let msg_type = request.msg_type();
+        let reply_type = msg_type.replace("_request", "_reply");
+        let content = match msg_type {
+            "kernel_info_request" => kernel_info(),
+            "execute_request" => self.execute(request),
+            "is_complete_request" => {
+                let code = request.content["code"].as_str().unwrap_or_default();
+                if open_braces(code) > 0 {
+                    json!({ "status": "incomplete", "indent": "  " })
+                } else {
+                    json!({ "status": "complete" })
+                }
+            }
+            "complete_request" => {
+                let cursor = request.content["cursor_pos"].as_u64().unwrap_or(0) as usize;
+                complete(request.content["code"].as_str().unwrap_or_default(), cursor)
+            }
+            "inspect_request" => {
+                json!({ "status": "ok", "found": false, "data": {}, "metadata": {} })
+            }
+            "history_request" => json!({ "status": "ok", "history": [] }),
+            "comm_info_request" => json!({ "status": "ok", "comms": {} }),
+            // Cells cannot be stopped midway; they are short-lived anyway.
+            "interrupt_request" => json!({ "status": "ok" }),
+            "shutdown_request" => {
+                json!({ "status": "ok", "restart": request.content["restart"] == true })
+            }
+            other => {
+                tracing::debug!("unhandled {}", other);
+                json!({ "status": "error", "ename": "NotImplemented", "evalue": other, "traceback": [] })
+            }
+        };
+        (reply_type, content)
+    }
+
+    fn execute(&mut self, request: &Message) -> Value {
+        let code = request.content["code"].as_str().unwrap_or_default();
+        let silent = request.content["silent"] == true;
+        if !silent && request.content["store_history"] != false {
+            self.execution_count += 1;
+        }
+        let count = self.execution_count;
+        if !silent {
+            self.publish(
+                request,
+                "execute_input",
+                json!({ "code": code, "execution_count": count }),
+            );
+        }
+
+        let result = self.repl.eval_lines(code);
+        let text = self.output.take();
+        if let Err(e) = result {
+            let error = json!({ "ename": "IOError", "evalue": e.to_string(), "traceback": [e.to_string()] });
+            self.publish(request, "error", error.clone());
+            let mut reply = error;
+            reply["status"] = "error".into();
+            reply["execution_count"] = count.into();
+            return reply;
+        }
+        if !silent && !text.is_empty() {
+            self.publish(request, "stream", json!({ "name": "stdout", "text": text }));
+        }
+        json!({
+            "status": "ok",
+            "execution_count": count,
+            "user_expressions": {},
+            "payload": [],
+        })
+    }
+
+    fn reply(&self, parent: &Message, msg_type: &str, content: Value) -> Message {
+        Message {
+            identities: parent.identities.clone(),
+            header: self.header(msg_type),
+            parent_header: parent.header.clone(),
+            metadata: json!({}),
+            content,
+        }
+    }
+
+    fn header(&self, msg_type: &str) -> Value {
+        json!({
+            "msg_id": new_id(),
+            "session": self.session,
+            "username": "kernel",
+            "date": crate::logging::timestamp(),
+            "msg_type": msg_type,
+            "version": PROTOCOL_VERSION,
+        })
+    }
+
+    /// Send a message on IOPub to every subscriber, dropping those that
+    /// have gone away.
+    fn publish(&self, parent: &Message, msg_type: &str, content: Value) {
+        let mut message = self.reply(parent, msg_type, content);
+        message.identities = vec![format!("kernel.{}.{}", self.session, msg_type).into_bytes()];
+        let frames = self.signer.encode(&message);
+        if let Ok(mut subscribers) = self.subscribers.lock() {
+            subscribers.retain(|peer| peer.send(&frames).is_ok());
+        }
+    }
+}
+
+fn kernel_info() -> Value {
+    json!({
+        "status": "ok",
+        "protocol_version": PROTOCOL_VERSION,
+        "implementation": "sentience",
+        "implementation_version": env!("CARGO_PKG_VERSION"),
+        "language_info": {
+            "name": "sentience",
+            "version": env!("CARGO_PKG_VERSION"),
+            "mimetype": "text/x-sentience",
+            "file_extension": ".sent",
+        },
+        "banner": format!("Sentience {}", env!("CARGO_PKG_VERSION")),
+        "help_links": [],
+    })
+}
+
+/// Keywords and dot-commands starting with the word before `cursor`.
+fn complete(code: &str, cursor: usize) -> Value {
+    const WORDS: &[&str] = &[
+        "agent", "mem", "goal", "on", "input", "train", "evolve", "schedule", "reflect", "embed",
+        "print", "ask", "fetch", "exec", "read", "write", "if", "context", "includes", ".input",
+        ".train", ".evolve", ".agents",
+    ];
+    // The cursor counts Unicode code points.
+    let end = code
+        .char_indices()
+        .nth(cursor)
+        .map_or(code.len(), |(i, _)| i);
+    let start = code[..end]
+        .rfind(|c: char| !(c.is_alphanumeric() || c == '_' || c == '.'))
+        .map_or(0, |i| i + 1);
+    let prefix = &code[start..end];
+    let matches: Vec<&str> = WORDS
+        .iter()
+        .copied()
+        .filter(|w| !prefix.is_empty() && w.starts_with(prefix))
+        .collect();
+    json!({
+        "status": "ok",
+        "matches": matches,
+        "cursor_start": code[..start].chars().count(),
+        "cursor_end": cursor,
+        "metadata": {},
+    })
+}
+
+/// Braces opened in `code` and not yet closed.
+fn open_braces(code: &str) -> usize {
+    code.lines().fold(0, |depth: usize, line| {
+        (depth + line.matches('{').count()).saturating_sub(line.matches('}').count())
+    })
+}
+
+fn accept(
+    listener: TcpListener,
+    socket_type: &'static str,
+    serve: impl Fn(Peer) + Send + Sync + 'static,
+) {
+    let serve = Arc::new(serve);
+    thread::spawn(move || {
+        for stream in listener.incoming().flatten() {
+            let serve = Arc::clone(&serve);
+            thread::spawn(move || match Peer::handshake(stream, socket_type) {
+                Ok(peer) => serve(peer),
+                Err(e) => tracing::warn!("{} handshake failed: {}", socket_type, e),
+            });
+        }
+    });
+}
+
+fn accept_requests(
+    listener: TcpListener,
+    channel: Channel,
+    sender: Sender<(Channel, PeerWriter, Vec<Vec<u8>>)>,
+) {
+    let sender = Mutex::new(sender);
+    accept(listener, "ROUTER", move |mut peer| {
+        let Ok(sender) = sender.lock().map(|s| s.clone()) else {
+            return;
+        };
+        while let Ok(frames) = peer.recv() {
+            if sender.send((channel, peer.writer(), frames)).is_err() {
+                break;
+            }
+        }
+    });
+}
+
+fn accept_subscribers(listener: TcpListener, subscribers: Arc<Mutex<Vec<PeerWriter>>>) {
+    accept(listener, "PUB", move |mut peer| {
+        if let Ok(mut subscribers) = subscribers.lock() {
+            subscribers.push(peer.writer());
+        }
+        // Every message goes to every subscriber, so subscriptions are
+        // read only to keep the connection open.
+        while peer.recv().is_ok() {}
+    });
+}
+
+/// A random-looking id in UUID format.
+fn new_id() -> String {
+    static COUNTER: AtomicU64 = AtomicU64::new(0);
+    let mut hasher = Sha256::new();
+    hasher.update(std::process::id().to_le_bytes());
+    hasher.update(COUNTER.fetch_add(1, Ordering::Relaxed).to_le_bytes());
+    hasher.update(
+        SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map(|d| d.as_nanos())
+            .unwrap_or(0)
+            .to_le_bytes(),
+    );
+    let hex = hex::encode(&hasher.finalize()[..16]);
+    format!(
+        "{}-{}-{}-{}-{}",
+        &hex[..8],
+        &hex[8..12],
+        &hex[12..16],
+        &hex[16..20],
+        &hex[20..]
+    )
+}
+
+/// Write a kernel spec running `exe jupyter {connection_file}` to the
+/// user's Jupyter data directory, returning the spec's directory.
+pub fn install_kernelspec(exe: &Path) -> io::Result<PathBuf> {
+    let dir = data_dir()
+        .ok_or_else(|| io::Error::new(io::ErrorKind::NotFound, "no home directory"))?
+        .join("kernels")
+        .join("sentience");
+    std::fs::create_dir_all(&dir)?;
+    let spec = json!({
+        "argv": [exe.to_string_lossy(), "jupyter", "{connection_file}"],
+        "display_name": "Sentience",
+        "language": "sentience",
+        "interrupt_mode": "message",
+    });
+    std::fs::write(dir.join("kernel.json"), format!("{:#}\n", spec))?;
+    Ok(dir)
+}
+
+fn data_dir() -> Option<PathBuf> {
+    if let Some(dir) = std::env::var_os("JUPYTER_DATA_DIR") {
+        return Some(dir.into());
+    }
+    if cfg!(windows) {
+        return std::env::var_os("APPDATA").map(|d| PathBuf::from(d).join("jupyter"));
+    }
+    let home = PathBuf::from(std::env::var_os("HOME")?);
+    Some(if cfg!(target_os = "macos") {
+        home.join("Library").join("Jupyter")
+    } else {
+        std::env::var_os("XDG_DATA_HOME")
+            .map(PathBuf::from)
+            .unwrap_or_else(|| home.join(".local").join("share"))
+            .join("jupyter")
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::net::TcpStream;
+
+    fn request(signer: &Signer, msg_type: &str, content: Value) -> Vec<Vec<u8>> {
+        signer.encode(&Message {
+            identities: Vec::new(),
+            header: json!({ "msg_id": new_id(), "msg_type": msg_type, "session": "s", "username": "u", "version": PROTOCOL_VERSION }),
+            parent_header: json!({}),
+            metadata: json!({}),
+            content,
+        })
+    }
+
+    #[test]
+    fn runs_cells_with_persistent_context() {
+        let info = ConnectionInfo {
+            transport: "tcp".to_string(),
+            ip: "127.0.0.1".to_string(),
+            shell_port: 0,
+            iopub_port: 0,
+            stdin_port: 0,
+            control_port: 0,
+            hb_port: 0,
+            key: "secret".to_string(),
+            signature_scheme: "hmac-sha256".to_string(),
+        };
+        let kernel = Kernel::bind(&info).unwrap();
+        let ports = kernel.ports().clone();
+        let server = thread::spawn(move || kernel.run());
+        let connect = |port: u16, socket_type| {
+            Peer::handshake(
+                TcpStream::connect(("127.0.0.1", port)).unwrap(),
+                socket_type,
+            )
+            .unwrap()
+        };
+        let signer = Signer::new("secret");
+        let mut iopub = connect(ports.iopub_port, "SUB");
+        iopub.send(&[vec![1]]).unwrap();
+        let mut shell = connect(ports.shell_port, "DEALER");
+        let mut call = |msg_type, content| {
+            shell.send(&request(&signer, msg_type, content)).unwrap();
+            signer.decode(shell.recv().unwrap()).unwrap()
+        };
+
+        let info = call("kernel_info_request", json!({}));
+        assert_eq!(info.msg_type(), "kernel_info_reply");
+        assert_eq!(info.content["language_info"]["name"], "sentience");
+        call(
+            "execute_request",
+            json!({ "code": "agent Echo {\n  on input(msg) {\n    print \"got it\"\n  }\n}" }),
+        );
+        let reply = call("execute_request", json!({ "code": ".input hello" }));
+        assert_eq!(reply.content["status"], "ok");
+        assert_eq!(reply.content["execution_count"], 2);
+        let complete = call("is_complete_request", json!({ "code": "agent A {" }));
+        assert_eq!(complete.content["status"], "incomplete");
+        call("shutdown_request", json!({ "restart": false }));
+        server.join().unwrap().unwrap();
+
+        let mut streams = Vec::new();
+        while streams.len() < 2 {
+            let message = signer.decode(iopub.recv().unwrap()).unwrap();
+            if message.msg_type() == "stream" {
+                assert_eq!(message.parent_header["msg_type"], "execute_request");
+                streams.push(message.content["text"].as_str().unwrap().to_string());
+            }
+        }
+        assert_eq!(
+            streams,
+            ["Agent: Echo\nAgent: Echo [registered]\n", "  got it\n"]
+        );
+    }
+
+    #[test]
+    fn rejects_bad_signatures() {
+        let frames = request(&Signer::new("a"), "kernel_info_request", json!({}));
+        assert!(Signer::new("a").decode(frames.clone()).is_ok());
+        assert!(Signer::new("b").decode(frames).is_err());
+        assert_eq!(open_braces("a {\n b { }"), 1);
+        let completion = complete("agent A { pri", 13);
+        assert_eq!(completion["matches"], json!(["print"]));
+        assert_eq!(completion["cursor_start"], 10);
+    }
+}
@@ -0,0 +1,96 @@
+//! Versions of the language. A program says which one it is written in
+//! with a `lang 0.2` pragma before its other statements; `--lang 0.2` sets
+//! the version of programs without one, which is otherwise 0.1. Syntax and
+//! semantics that would change what an existing program means only apply
+//! from the version that introduced them, so programs keep their meaning
+//! until they ask for a newer one, and newer syntax in an older program is
+//! a parse error (`SEN1008`).
+//!
+//! | Version | Changes |
+//! |---------|---------|
+//! | 0.1 | the language as first released |
+//! | 0.2 | `print "..."` fills in `{...}` placeholders, as `ask` does, and so do the strings in `print` and `emit` expressions; `<name> = <expr>` stores the expression's value; `let`, `fn`, `return`, `while`, `for`, `recall`, `send`, `emit`, `on output`, `every`, `on tick`, calls as statements, and list and map literals |
+//! | 0.3 | `embed` stores the vector of its source in memory |
+
+use std::fmt;
+use std::sync::atomic::{AtomicUsize, Ordering};
+
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq, PartialOrd, Ord, Hash)]
+pub enum Version {
+    #[default]
+    V0_1,
+    V0_2,
+    V0_3,
+}
+
+impl Version {
+    /// Every version, oldest first.
+    pub const ALL: [Version; 3] = [Version::V0_1, Version::V0_2, Version::V0_3];
+    pub const LATEST: Version = Version::V0_3;
+
+    /// The version written as `text`, such as `0.2`.
+    pub fn parse(text: &str) -> Option<Self> {
+        Self::ALL
+            .into_iter()
+            .find(|version| version.as_str() == text)
+    }
+
+    pub fn as_str(self) -> &'static str {
+        match self {
+            Version::V0_1 => "0.1",
+            Version::V0_2 => "0.2",
+            Version::V0_3 => "0.3",
+        }
+    }
+}
+
+impl fmt::Display for Version {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
+
+/// Index in [`Version::ALL`] of the version of programs without a pragma.
+static DEFAULT: AtomicUsize = AtomicUsize::new(0);
+
+/// The version of programs without a `lang` pragma: 0.1 unless
+/// [`set_default`] changed it.
+pub fn default_version() -> Version {
+    Version::ALL[DEFAULT.load(Ordering::Relaxed)]
+}
+
+/// Read programs without a `lang` pragma as `version` from now on, as
+/// `--lang` does. Parsers and contexts created before keep theirs.
+pub fn set_default(version: Version) {
+    let index = Version::ALL.iter().position(|v| *v == version).unwrap_or(0);
+    DEFAULT.store(index, Ordering::Relaxed);
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::replkit::Repl;
+
+    #[test]
+    fn print_interpolates_from_0_2() {
+        let mut out = Vec::new();
+        let mut repl = Repl::new(&b""[..], &mut out);
+        let agent = concat!(
+            "agent Echo {\n",
+            "  on input(msg) {\n",
+            "    print \"You said {msg}\"\n",
+            "  }\n",
+            "}\n",
+        );
+        repl.eval_source(agent).unwrap();
+        repl.handle_command(".input hi").unwrap();
+        repl.eval_source(&format!("lang 0.2\n{}", agent)).unwrap();
+        repl.handle_command(".input hi").unwrap();
+        drop(repl);
+        let out = String::from_utf8(out).unwrap();
+        assert!(out.contains("  You said {msg}\n"), "{}", out);
+        assert!(out.ends_with("  You said hi\n"), "{}", out);
+        assert_eq!(Version::parse("0.2"), Some(Version::V0_2));
+        assert_eq!(Version::parse("1.0"), None);
+    }
+}
@@ -1,3 +1,6 @@
+use crate::error::{ParseError, ParseErrorKind, Position};
+use std::borrow::Cow;
+
 #[derive(Debug, Clone, PartialEq, Eq)]
 pub enum TokenType {
     Illegal,
@@ -20,6 +23,7 @@ pub enum TokenType {
     Reflect,
     Train,
     If,
+    Else,
     Enter,
     Embed,
     Link,
@@ -28,176 +32,425 @@ pub enum TokenType {
     Evolve,
     LinkArrow,
     Equal,
+    Comma,
+    Ask,
+    Fetch,
+    Read,
+    Write,
+    Exec,
+    /// `<`, `<=`, `>`, `>=`, `==` or `!=`.
+    Compare,
+    /// `&&`, `||`, `!`, `+`, `-`, `*` or `/`.
+    Operator,
 }
 
+/// A token. Literals borrow from the source unless they had to be
+/// rewritten, as strings with escapes are.
 #[derive(Clone, Debug)]
-pub struct Token {
+pub struct Token<'a> {
     pub token_type: TokenType,
-    pub literal: String,
+    pub literal: Cow<'a, str>,
+    /// 1-based line the token starts on.
+    pub line: usize,
+    /// 1-based column, in characters, the token starts at.
+    pub column: usize,
+    /// Byte offset of the token in the source.
+    pub offset: usize,
 }
 
-impl Token {
-    pub fn new(token_type: TokenType, literal: &str) -> Self {
+impl<'a> Token<'a> {
+    pub fn new(token_type: TokenType, literal: impl Into<Cow<'a, str>>) -> Self {
         Token {
             token_type,
-            literal: literal.to_string(),
+            literal: literal.into(),
+            line: 0,
+            column: 0,
+            offset: 0,
+        }
+    }
+
+    /// Where the token starts, for diagnostics.
+    pub fn position(&self) -> Position {
+        Position {
+            line: self.line,
+            col: self.column,
         }
     }
 }
 
+/// A comment: `#` or `//` to the end of its line, or `/* */` over any
+/// number of lines.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct Comment<'a> {
+    /// The line the comment starts on.
+    pub line: usize,
+    /// The text after the `#` or `//`, or between `/*` and `*/`.
+    pub text: &'a str,
+}
+
 pub struct Lexer<'a> {
     input: &'a str,
     position: usize,
     read_position: usize,
     ch: Option<char>,
+    line: usize,
+    column: usize,
+    comments: Vec<Comment<'a>>,
+    /// Line and column just past the last token read, where the end of
+    /// input is reported.
+    end: (usize, usize),
 }
 
 impl<'a> Lexer<'a> {
     pub fn new(input: &'a str) -> Self {
+        Self::resume(input, 0, 1, 1)
+    }
+
+    /// Start lexing at byte `offset`, which is at `line` and `column`.
+    pub fn resume(input: &'a str, offset: usize, line: usize, column: usize) -> Self {
         let mut l = Lexer {
             input,
-            position: 0,
-            read_position: 0,
+            position: offset,
+            read_position: offset,
             ch: None,
+            line,
+            column: column - 1,
+            comments: Vec::new(),
+            end: (line, column),
         };
         l.read_char();
         l
     }
 
+    /// Comments skipped so far, in order.
+    pub fn comments(&self) -> &[Comment<'a>] {
+        &self.comments
+    }
+
+    /// The whole source being read.
+    pub fn source(&self) -> &'a str {
+        self.input
+    }
+
+    /// Bytes of the source examined so far; tokens read until now depend on
+    /// nothing after this.
+    pub fn scanned(&self) -> usize {
+        self.read_position
+    }
+
     fn read_char(&mut self) {
-        if self.read_position >= self.input.len() {
-            self.ch = None;
-        } else {
-            self.ch = self.input[self.read_position..].chars().next();
+        if self.ch == Some('\n') {
+            self.line += 1;
+            self.column = 0;
         }
+        self.ch = self.input[self.read_position..].chars().next();
         self.position = self.read_position;
         if let Some(c) = self.ch {
             self.read_position += c.len_utf8();
+            self.column += 1;
         }
     }
 
     fn peek_char(&self) -> Option<char> {
-        if self.read_position >= self.input.len() {
-            None
+        self.input[self.read_position..].chars().next()
+    }
+
+    /// The source text from `start` up to the current character.
+    fn slice(&self, start: usize) -> &'a str {
+        &self.input[start..self.position]
+    }
+
+    pub fn next_token(&mut self) -> Token<'a> {
+        self.skip_whitespace();
+        let (line, column, offset) = (self.line, self.column, self.position);
+        let mut tok = self.read_token();
+        if tok.token_type == TokenType::Eof {
+            // Not the column after a trailing newline, which is 0.
+            (tok.line, tok.column) = self.end;
         } else {
-            self.input[self.read_position..].chars().next()
+            let text = &self.input[offset..self.position];
+            self.end = match text.rsplit_once('\n') {
+                Some((before, last)) => (
+                    line + before.matches('\n').count() + 1,
+                    last.chars().count() + 1,
+                ),
+                None => (line, column + text.chars().count()),
+            };
+            tok.line = line;
+            tok.column = column;
         }
+        tok.offset = offset;
+        tok
     }
 
-    pub fn next_token(&mut self) -> Token {
-        self.skip_whitespace();
-        let tok = match self.ch {
-            // Some('=') => Token::new(TokenType::Assign, "="),
-            Some('=') => Token::new(TokenType::Equal, "="),
-            Some('(') => Token::new(TokenType::LParen, "("),
-            Some(')') => Token::new(TokenType::RParen, ")"),
-            Some('{') => Token::new(TokenType::LBrace, "{"),
-            Some('}') => Token::new(TokenType::RBrace, "}"),
-            Some('.') => Token::new(TokenType::Dot, "."),
-            Some(':') => Token::new(TokenType::Colon, ":"),
-            Some('[') => Token::new(TokenType::LBracket, "["),
-            Some(']') => Token::new(TokenType::RBracket, "]"),
-            Some('-') => {
-                if let Some('>') = self.peek_char() {
-                    self.read_char();
-                    Token::new(TokenType::Arrow, "->")
-                } else {
-                    Token::new(TokenType::Illegal, &self.ch.unwrap().to_string())
-                }
+    fn read_token(&mut self) -> Token<'a> {
+        let start = self.position;
+        let Some(c) = self.ch else {
+            return Token::new(TokenType::Eof, "");
+        };
+        if let Some(op) = comparison(&self.input[start..]) {
+            for _ in 0..op.len() {
+                self.read_char();
             }
-            Some('<') => {
-                if let Some('-') = self.peek_char() {
-                    let second = self.peek_char();
-                    if let Some('-') = second {
-                        let ahead = self.input[self.read_position + 1..].chars().next();
-                        if let Some('>') = ahead {
-                            self.read_char();
-                            self.read_char();
-                            self.read_char();
-                            Token::new(TokenType::LinkArrow, "<->")
-                        } else {
-                            Token::new(TokenType::Illegal, &self.ch.unwrap().to_string())
-                        }
-                    } else {
-                        Token::new(TokenType::Illegal, &self.ch.unwrap().to_string())
-                    }
-                } else {
-                    Token::new(TokenType::Illegal, &self.ch.unwrap().to_string())
-                }
+            return Token::new(TokenType::Compare, op);
+        }
+        if self.input[start..].starts_with("/*") {
+            // A block comment without its `*/`; see [`unterminated`].
+            while self.ch.is_some() {
+                self.read_char();
+            }
+            return Token::new(TokenType::Illegal, self.slice(start));
+        }
+        if let Some(op) = operator(&self.input[start..]) {
+            for _ in 0..op.len() {
+                self.read_char();
+            }
+            return Token::new(TokenType::Operator, op);
+        }
+        if let Some(token_type) = punctuation(c) {
+            self.read_char();
+            return Token::new(token_type, self.slice(start));
+        }
+        let tok = match c {
+            '-' if self.peek_char() == Some('>') => {
+                self.read_char();
+                Token::new(TokenType::Arrow, "->")
+            }
+            '<' if self.input[self.read_position..].starts_with("->") => {
+                self.read_char();
+                self.read_char();
+                Token::new(TokenType::LinkArrow, "<->")
             }
-            Some('"') => {
-                let literal = self.read_string();
-                Token::new(TokenType::String, &literal)
-            }
-            None => Token::new(TokenType::Eof, ""),
-            Some(c) => {
-                if is_letter(c) {
-                    let literal = self.read_identifier();
-                    let token_type = lookup_ident(&literal);
-                    return Token::new(token_type, &literal);
-                } else if c.is_ascii_digit() {
-                    let literal = self.read_number();
-                    return Token::new(TokenType::String, &literal);
+            '"' => {
+                let (literal, closed) = self.read_string();
+                // An unterminated string is `Illegal`; see [`unterminated`].
+                let token_type = if closed {
+                    TokenType::String
                 } else {
-                    Token::new(TokenType::Illegal, &c.to_string())
-                }
+                    TokenType::Illegal
+                };
+                return Token::new(token_type, literal);
+            }
+            c if is_letter(c) => {
+                let literal = self.read_identifier();
+                return Token::new(lookup_ident(literal), literal);
             }
+            c if c.is_ascii_digit() => return Token::new(TokenType::String, self.read_number()),
+            '-' => Token::new(TokenType::Operator, "-"),
+            _ => Token::new(TokenType::Illegal, &self.input[start..self.read_position]),
         };
         self.read_char();
         tok
     }
 
+    /// Skip whitespace and comments.
     fn skip_whitespace(&mut self) {
         while let Some(c) = self.ch {
-            if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+            if c.is_whitespace() || c == BYTE_ORDER_MARK {
                 self.read_char();
+            } else if c == '#' {
+                self.skip_line_comment(1);
+            } else if c == '/' && self.peek_char() == Some('/') {
+                self.skip_line_comment(2);
+            } else if c == '/' && self.peek_char() == Some('*') {
+                // One never closed is left to `read_token`, which reads the
+                // rest of the input as one token at the `/*`.
+                match self.input[self.read_position + 1..].find("*/") {
+                    Some(len) => self.skip_block_comment(len),
+                    None => break,
+                }
             } else {
                 break;
             }
         }
     }
 
-    fn read_identifier(&mut self) -> String {
+    /// Skip a comment whose opening marker is `open` bytes long, up to the
+    /// end of the line.
+    fn skip_line_comment(&mut self, open: usize) {
+        let line = self.line;
+        for _ in 0..open {
+            self.read_char();
+        }
+        let start = self.position;
+        while self.ch.is_some_and(|c| c != '\n') {
+            self.read_char();
+        }
+        self.comments.push(Comment {
+            line,
+            text: self.slice(start),
+        });
+    }
+
+    /// Skip a block comment whose text, between the `/*` that is current
+    /// and its `*/`, is `len` bytes long.
+    fn skip_block_comment(&mut self, len: usize) {
+        let line = self.line;
+        self.read_char();
+        self.read_char();
+        let start = self.position;
+        while self.position < start + len {
+            self.read_char();
+        }
+        self.comments.push(Comment {
+            line,
+            text: self.slice(start),
+        });
+        self.read_char();
+        self.read_char();
+    }
+
+    fn read_identifier(&mut self) -> &'a str {
         let position = self.position;
         while let Some(c) = self.ch {
-            if is_letter(c) || c.is_ascii_digit() || c == '_' {
+            if is_letter(c) || c.is_numeric() {
                 self.read_char();
             } else {
                 break;
             }
         }
-        self.input[position..self.position].to_string()
+        self.slice(position)
     }
 
-    fn read_number(&mut self) -> String {
+    fn read_number(&mut self) -> &'a str {
         let position = self.position;
+        let mut seen_dot = false;
         while let Some(c) = self.ch {
             if c.is_ascii_digit() {
                 self.read_char();
+            } else if c == '.'
+                && !seen_dot
+                && self.peek_char().map_or(false, |n| n.is_ascii_digit())
+            {
+                seen_dot = true;
+                self.read_char();
             } else {
                 break;
             }
         }
-        self.input[position..self.position].to_string()
+        self.slice(position)
     }
 
-    fn read_string(&mut self) -> String {
+    /// Read a string literal, borrowing it unless it contains escapes, and
+    /// move past the closing quote. Returns the literal and whether the
+    /// quote was there before the end of the input.
+    fn read_string(&mut self) -> (Cow<'a, str>, bool) {
         self.read_char();
-        let start = self.position;
+        let position = self.position;
+        let mut owned: Option<String> = None;
         while let Some(c) = self.ch {
-            if c == '"' {
-                break;
+            match c {
+                '"' => break,
+                '\\' => {
+                    let literal = owned.get_or_insert_with(|| self.slice(position).to_string());
+                    self.read_char();
+                    match self.ch {
+                        Some('n') => literal.push('\n'),
+                        Some('t') => literal.push('\t'),
+                        Some(other) => literal.push(other),
+                        None => break,
+                    }
+                }
+                _ => {
+                    if let Some(literal) = owned.as_mut() {
+                        literal.push(c);
+                    }
+                }
             }
             self.read_char();
         }
-        let literal = self.input[start..self.position].to_string();
+        let closed = self.ch == Some('"');
+        let literal = match owned {
+            Some(literal) => Cow::Owned(literal),
+            None => Cow::Borrowed(self.slice(position)),
+        };
         self.read_char();
-        literal
+        (literal, closed)
+    }
+}
+
+/// The construct `source` leaves open at its end, if any: a string without
+/// its closing quote, a block comment without its `*/`, or the innermost
+/// `{`, `[` or `(` never closed. A closer that does not match the innermost
+/// opener is skipped, so that a missing `]` is reported at its `[` rather
+/// than at the enclosing `{`.
+pub fn unterminated(source: &str) -> Option<ParseError> {
+    let mut lexer = Lexer::new(source);
+    let mut open: Vec<(char, Position)> = Vec::new();
+    loop {
+        let token = lexer.next_token();
+        let opener = match token.token_type {
+            TokenType::Eof => break,
+            TokenType::Illegal if source[token.offset..].starts_with('"') => {
+                return Some(
+                    ParseError::new(ParseErrorKind::UnterminatedString).at(token.position()),
+                );
+            }
+            TokenType::Illegal if source[token.offset..].starts_with("/*") => {
+                return Some(
+                    ParseError::new(ParseErrorKind::UnterminatedComment).at(token.position()),
+                );
+            }
+            TokenType::LBrace | TokenType::LBracket | TokenType::LParen => {
+                let c = source[token.offset..].chars().next().unwrap_or_default();
+                open.push((c, token.position()));
+                continue;
+            }
+            TokenType::RBrace => '{',
+            TokenType::RBracket => '[',
+            TokenType::RParen => '(',
+            _ => continue,
+        };
+        if open.last().map(|(c, _)| *c) == Some(opener) {
+            open.pop();
+        }
+    }
+    open.pop()
+        .map(|(c, position)| ParseError::new(ParseErrorKind::Unclosed(c)).at(position))
+}
+
+/// Tokens made of one character that cannot start anything longer.
+fn punctuation(c: char) -> Option<TokenType> {
+    Some(match c {
+        '=' => TokenType::Equal,
+        '(' => TokenType::LParen,
+        ')' => TokenType::RParen,
+        '{' => TokenType::LBrace,
+        '}' => TokenType::RBrace,
+        '.' => TokenType::Dot,
+        ':' => TokenType::Colon,
+        ',' => TokenType::Comma,
+        '[' => TokenType::LBracket,
+        ']' => TokenType::RBracket,
+        _ => return None,
+    })
+}
+
+/// The comparison operator `rest` starts with, if any; `<->` is a link.
+fn comparison(rest: &str) -> Option<&'static str> {
+    if rest.starts_with("<->") {
+        return None;
     }
+    ["<=", ">=", "==", "!=", "<", ">"]
+        .into_iter()
+        .find(|op| rest.starts_with(op))
+}
+
+/// The operator other than a comparison or `-` that `rest` starts with, if
+/// any. A `-` can also start `->`, so it is read last; a negative number is
+/// a `-` and the number, put together by the parser.
+fn operator(rest: &str) -> Option<&'static str> {
+    ["&&", "||", "!", "+", "*", "/"]
+        .into_iter()
+        .find(|op| rest.starts_with(op))
 }
 
+/// Written at the start of a file by some editors; skipped like a space.
+const BYTE_ORDER_MARK: char = '\u{feff}';
+
+/// Whether `c` can start an identifier: a letter in any script, or `_`.
 fn is_letter(c: char) -> bool {
-    c.is_ascii_alphabetic() || c == '_'
+    c.is_alphabetic() || c == '_'
 }
 
 fn lookup_ident(ident: &str) -> TokenType {
@@ -209,12 +462,186 @@ fn lookup_ident(ident: &str) -> TokenType {
         "reflect" => TokenType::Reflect,
         "train" => TokenType::Train,
         "if" => TokenType::If,
+        "else" => TokenType::Else,
         "enter" => TokenType::Enter,
         "embed" => TokenType::Embed,
         "link" => TokenType::Link,
         "input" => TokenType::Input,
         "print" => TokenType::Print,
         "evolve" => TokenType::Evolve,
+        "ask" => TokenType::Ask,
+        "fetch" => TokenType::Fetch,
+        "read" => TokenType::Read,
+        "write" => TokenType::Write,
+        "exec" => TokenType::Exec,
         _ => TokenType::Ident,
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn tokens(input: &str) -> Vec<Token<'_>> {
+        let mut lexer = Lexer::new(input);
+        let mut tokens = Vec::new();
+        loop {
+            let tok = lexer.next_token();
+            if tok.token_type == TokenType::Eof {
+                return tokens;
+            }
+            tokens.push(tok);
+        }
+    }
+
+    #[test]
+    fn finds_unterminated_constructs() {
+        let report = |source| unterminated(source).map(|e| e.to_string());
+        assert_eq!(report("agent A {\n  print \"}\"\n}"), None);
+        assert_eq!(
+            report("agent A {\n  print \"hi\n}"),
+            Some("2:9: unterminated string literal".to_string())
+        );
+        assert_eq!(
+            report("agent A {\n  on input(m) {\n}"),
+            Some("1:9: unclosed `{`".to_string())
+        );
+        assert_eq!(
+            report("if context includes [\"a\" {\n}"),
+            Some("1:21: unclosed `[`".to_string())
+        );
+        assert_eq!(report("agent A {\n  /* { */\n}"), None);
+        assert_eq!(
+            report("agent A {\n  /* note\n}"),
+            Some("2:3: unterminated block comment".to_string())
+        );
+        let many = format!("{}/* open {}", "/**/ ".repeat(50_000), "/* ".repeat(50_000));
+        assert_eq!(
+            report(&many),
+            Some("1:250001: unterminated block comment".to_string())
+        );
+        assert_eq!(tokens("\"open")[0].token_type, TokenType::Illegal);
+    }
+
+    #[test]
+    fn reads_identifiers_and_strings_in_any_script() {
+        let toks =
+            tokens("\u{feff}agent Vodič {\n  поздрав = \"Ćao, свете\"\n\u{a0}print \"đ\"\n}");
+        let seen: Vec<_> = toks
+            .iter()
+            .map(|t| (t.token_type.clone(), t.literal.as_ref(), t.line, t.column))
+            .collect();
+        assert_eq!(
+            seen,
+            [
+                (TokenType::Agent, "agent", 1, 2),
+                (TokenType::Ident, "Vodič", 1, 8),
+                (TokenType::LBrace, "{", 1, 14),
+                (TokenType::Ident, "поздрав", 2, 3),
+                (TokenType::Equal, "=", 2, 11),
+                (TokenType::String, "Ćao, свете", 2, 13),
+                (TokenType::Print, "print", 3, 2),
+                (TokenType::String, "đ", 3, 8),
+                (TokenType::RBrace, "}", 4, 1),
+            ]
+        );
+    }
+
+    #[test]
+    fn skips_and_keeps_comments() {
+        let mut lexer = Lexer::new(concat!(
+            "# about\n",
+            "print \"# not a comment\" # trailing\n",
+            "a / b // slashes\n",
+            "/* two\nlines */ c /**/\n",
+        ));
+        let mut literals = Vec::new();
+        loop {
+            let tok = lexer.next_token();
+            if tok.token_type == TokenType::Eof {
+                break;
+            }
+            literals.push(tok.literal.into_owned());
+        }
+        assert_eq!(literals, ["print", "# not a comment", "a", "/", "b", "c"]);
+        assert_eq!(
+            lexer.comments(),
+            [
+                Comment {
+                    line: 1,
+                    text: " about"
+                },
+                Comment {
+                    line: 2,
+                    text: " trailing"
+                },
+                Comment {
+                    line: 3,
+                    text: " slashes"
+                },
+                Comment {
+                    line: 4,
+                    text: " two\nlines "
+                },
+                Comment { line: 5, text: "" }
+            ]
+        );
+    }
+
+    #[test]
+    fn tracks_lines_and_columns() {
+        let toks = tokens("agent Guide {\n  print \"héllo\" -> x\n}");
+        let positions: Vec<_> = toks.iter().map(|t| (t.line, t.column)).collect();
+        assert_eq!(
+            positions,
+            [
+                (1, 1),
+                (1, 7),
+                (1, 13),
+                (2, 3),
+                (2, 9),
+                (2, 17),
+                (2, 20),
+                (3, 1)
+            ]
+        );
+        assert_eq!(toks[3].position().to_string(), "2:3");
+    }
+
+    #[test]
+    fn borrows_literals_without_escapes() {
+        let toks = tokens(r#"print "plain" "tab\there" 3.5 <-> ~"#);
+        assert!(matches!(toks[0].literal, Cow::Borrowed("print")));
+        assert!(matches!(toks[1].literal, Cow::Borrowed("plain")));
+        assert!(matches!(&toks[2].literal, Cow::Owned(s) if s == "tab\there"));
+        assert_eq!(toks[3].literal, "3.5");
+        assert_eq!(toks[4].token_type, TokenType::LinkArrow);
+        assert_eq!(toks[5].token_type, TokenType::Illegal);
+    }
+
+    #[test]
+    fn reads_comparisons() {
+        let toks = tokens("a >= 0.7 < b == c != d > e <-> f");
+        let ops: Vec<&str> = toks
+            .iter()
+            .filter(|t| t.token_type == TokenType::Compare)
+            .map(|t| t.literal.as_ref())
+            .collect();
+        assert_eq!(ops, [">=", "<", "==", "!=", ">"]);
+        assert_eq!(toks[2].literal, "0.7");
+    }
+
+    #[test]
+    fn reads_operators() {
+        let toks = tokens("!a && b || c + d - e * f / g -> -1");
+        let ops: Vec<&str> = toks
+            .iter()
+            .filter(|t| t.token_type == TokenType::Operator)
+            .map(|t| t.literal.as_ref())
+            .collect();
+        assert_eq!(ops, ["!", "&&", "||", "+", "-", "*", "/", "-"]);
+        assert_eq!(toks[toks.len() - 3].token_type, TokenType::Arrow);
+        assert_eq!(toks[toks.len() - 2].literal, "-");
+        assert_eq!(toks[toks.len() - 1].literal, "1");
+    }
+}
@@ -1,8 +1,76 @@
+pub mod adapters;
+pub mod affect;
+pub mod agents;
+pub mod analyze;
+pub mod api;
+pub mod attention;
+pub mod compiled;
+pub mod config;
 pub mod context;
+pub mod coverage;
+pub mod dap;
+pub mod dashboard;
+pub mod debugger;
+pub mod dream;
+pub mod embedded;
+pub mod error;
 pub mod eval;
+pub mod events;
+pub mod evolve;
+pub mod exec;
+pub mod expr;
+pub mod fetch;
+pub mod functions;
+pub mod goals;
+#[cfg(test)]
+mod golden;
+pub mod graph;
+pub mod history;
+pub mod hmac;
+pub mod httpd;
+pub mod ingest;
+pub mod intern;
+pub mod introspect;
+pub mod jupyter;
+pub mod lang;
 pub mod lexer;
+pub mod limits;
+pub mod lint;
+pub mod llm;
+pub mod logging;
+pub mod mcp;
+pub mod metrics;
+pub mod notebook;
+pub mod packages;
+pub mod paged;
+pub mod parallel;
 pub mod parser;
+pub mod pool;
+pub mod printer;
+pub mod profile;
+pub mod recall;
+pub mod recording;
+pub mod replkit;
+pub mod reward;
+pub mod rpc;
+pub mod sandbox;
+pub mod schedule;
+pub mod sse;
+pub mod stdlib;
+pub mod store;
+pub mod supervisor;
+pub mod sync;
+pub mod telemetry;
+pub mod template;
+pub mod tenants;
+pub mod testing;
+pub mod text;
+pub mod training;
+pub mod transcript;
+pub mod typecheck;
 pub mod types;
+pub mod webhooks;
+pub mod zmtp;
 
 pub mod sentience_core;
 
@@ -10,11 +78,13 @@ pub mod sentience_core;
 pub mod python_bridge;
 
 use context::AgentContext;
-use eval::eval;
+use error::{Error, RuntimeError};
+use eval::{eval, run_block};
 use lexer::Lexer;
 use parser::Parser;
 use std::collections::HashMap;
-use types::Statement;
+use std::time::Instant;
+use types::Program;
 
 pub use sentience_core::{
     ast::{Edge, EdgeType, Field, SentienceToken, SentienceTokenAst, Span, ThoughtType, Value},
@@ -27,49 +97,463 @@ pub use sentience_core::{
 
 pub struct SentienceAgent {
     ctx: AgentContext,
+    webhooks: Option<webhooks::Webhooks>,
+    memory_sync: Option<sync::MemorySync>,
+    /// Callbacks given each event with the agent's name.
+    event_sinks: Vec<Box<dyn FnMut(&str, &events::AgentEvent) + Send>>,
+    /// Memory (short, long) of each session other than the current one.
+    sessions: HashMap<String, (paged::Region, paged::Region)>,
+    recorder: Option<recording::Recorder>,
+    /// The last few turns, for the dashboard; see
+    /// [`keep_recent_turns`](Self::keep_recent_turns).
+    recent: Option<recording::Recorder>,
+    /// Memory changes since the current input arrived, while recording.
+    changes: Vec<recording::Change>,
 }
 
 impl SentienceAgent {
     pub fn new() -> Self {
+        let mut ctx = AgentContext::new();
+        ctx.goals = Some(goals::GoalLog::new());
         SentienceAgent {
-            ctx: AgentContext::new(),
+            ctx,
+            webhooks: None,
+            memory_sync: None,
+            event_sinks: Vec::new(),
+            sessions: HashMap::new(),
+            recorder: None,
+            recent: None,
+            changes: Vec::new(),
         }
     }
 
-    pub fn run_sentience(&mut self, code: &str) -> Result<String, String> {
-        let full_input = code.trim();
-        let mut lexer = Lexer::new(full_input);
-        let mut parser = Parser::new(&mut lexer);
+    pub fn run_sentience(&mut self, code: &str) -> Result<String, Error> {
+        if let Some(e) = lexer::unterminated(code) {
+            return Err(e.into());
+        }
+        let mut lexer = Lexer::new(code);
+        // Code run earlier may have set the version with a `lang` pragma.
+        let mut parser = Parser::new(&mut lexer).with_lang(self.ctx.lang);
         let program = parser.parse_program();
+        if let Some(e) = parser.errors().first() {
+            return Err(e.clone().into());
+        }
+        self.run_program(&program)
+    }
+
+    /// Evaluate an already parsed program, e.g. one from `embed_program!`.
+    pub fn run_program(&mut self, program: &Program) -> Result<String, Error> {
         let mut output = Vec::new();
-        for stmt in program.statements {
-            eval(&stmt, "", "", &mut self.ctx, &mut output);
+        for stmt in &program.statements {
+            eval(stmt, "", "", &mut self.ctx, &mut output)?;
         }
+        self.dispatch_events();
         Ok(output.join("\n"))
     }
 
-    pub fn handle_input(&mut self, input: &str) -> Option<String> {
-        tracing::info!("handle_input triggered with: {:?}", input);
+    /// Remove and return the responses `emit` gave since they were last
+    /// taken.
+    pub fn take_responses(&mut self) -> Vec<String> {
+        self.ctx.take_responses()
+    }
 
-        let current_agent = self.ctx.current_agent.clone();
-        let mut output = Vec::new();
+    pub fn handle_input(&mut self, input: &str) -> Result<String, RuntimeError> {
+        self.handle_message(&adapters::InputMessage::new(input))
+    }
 
-        if let Some(Statement::AgentDeclaration { body, .. }) = current_agent {
-            for stmt in body {
-                if let Statement::OnInput { body, .. } = stmt {
-                    for inner in body {
-                        eval(&inner, "", input, &mut self.ctx, &mut output);
-                    }
-                    tracing::info!("Output after eval: {:?}", self.ctx.output);
+    /// Run the `on input` handler for a message from an adapter, storing its
+    /// metadata in `mem.short` (e.g. `input.topic`) first.
+    pub fn handle_message(
+        &mut self,
+        message: &adapters::InputMessage,
+    ) -> Result<String, RuntimeError> {
+        tracing::info!("handle_input triggered with: {:?}", message.payload);
+        self.changes.clear();
+        for (name, value) in &message.metadata {
+            let key = format!("{}{}", adapters::METADATA_PREFIX, name);
+            self.ctx.set_mem("short", &key, value);
+        }
 
-                    return Some(output.join("\n"));
+        let result = self.run_handler("input", &message.payload);
+        match &result {
+            Ok(_) => tracing::info!("Output after eval: {:?}", self.ctx.output),
+            Err(e) => tracing::warn!("No agent or on input block matched: {}", e),
+        }
+        if self.recording() {
+            let changes = std::mem::take(&mut self.changes);
+            let turn = recording::Turn::new(self.agent_name(), message, &result, changes);
+            if let Some(recent) = &self.recent {
+                let _ = recent.record(turn.clone());
+            }
+            if let Some(recorder) = &self.recorder {
+                if let Err(e) = recorder.record(turn) {
+                    tracing::warn!("recording input failed: {}", e);
                 }
             }
         }
+        result
+    }
+
+    /// Like [`handle_message`](Self::handle_message), but against the
+    /// memory of `session` (e.g. one chat user) so sessions cannot see each
+    /// other's data. A new session starts from a copy of the agent's own
+    /// memory.
+    pub fn handle_session(
+        &mut self,
+        session: &str,
+        message: &adapters::InputMessage,
+    ) -> Result<String, RuntimeError> {
+        let (short, long) = self
+            .sessions
+            .remove(session)
+            .unwrap_or_else(|| (self.ctx.mem_short.clone(), self.ctx.mem_long.clone()));
+        let shared_short = std::mem::replace(&mut self.ctx.mem_short, short);
+        let shared_long = std::mem::replace(&mut self.ctx.mem_long, long);
+        // The store holds the agent's own long-term memory, not a session's.
+        let store = self.ctx.store.take();
+
+        let result = self.handle_message(message);
+
+        *self.ctx.store = store;
+        let short = std::mem::replace(&mut self.ctx.mem_short, shared_short);
+        let long = std::mem::replace(&mut self.ctx.mem_long, shared_long);
+        self.sessions.insert(session.to_string(), (short, long));
+        result
+    }
+
+    /// Run the agent's `train` block with `input`.
+    pub fn train(&mut self, input: &str) -> Result<String, RuntimeError> {
+        self.run_handler("train", input)
+    }
+
+    /// Run the agent's `evolve` block with `input`. The changes it proposes
+    /// wait for [`commit_proposals`](Self::commit_proposals).
+    pub fn evolve(&mut self, input: &str) -> Result<String, RuntimeError> {
+        self.run_handler("evolve", input)
+    }
+
+    /// Run the `on schedule` handler declared with `spec`.
+    pub fn run_schedule(&mut self, spec: &str) -> Result<String, RuntimeError> {
+        self.run_handler("schedule", spec)
+    }
+
+    /// Swap in the handlers of the last agent `program` declares, keeping
+    /// all memory; see [`eval::reload`].
+    pub fn reload(&mut self, program: &Program) -> Result<String, RuntimeError> {
+        eval::reload(&mut self.ctx, program)
+    }
+
+    /// Run the agent's `on stop` block, if it has one, before shutting down.
+    pub fn stop(&mut self) -> Result<String, RuntimeError> {
+        let output = eval::run_hook(&mut self.ctx, "stop", "").map(|lines| lines.join("\n"));
+        self.dispatch_events();
+        output
+    }
+
+    /// Run a handler block, recording metrics and sending the events it
+    /// caused to the webhooks.
+    fn run_handler(&mut self, kind: &str, input: &str) -> Result<String, RuntimeError> {
+        let _span = tracing::info_span!("handler", kind, agent = self.agent_name()).entered();
+        let before = goals::Reading::of(&self.ctx);
+        let started = Instant::now();
+        let output = run_block(&mut self.ctx, kind, input, "").map(|lines| lines.join("\n"));
+        let elapsed = started.elapsed();
+        tracing::info!(
+            duration_ms = elapsed.as_millis() as u64,
+            ok = output.is_ok(),
+            "handler finished"
+        );
+        let m = metrics::global();
+        m.handler_finished(kind, elapsed, output.is_err());
+        m.set_memory_entries("short", self.ctx.mem_short.len());
+        m.set_memory_entries("long", self.ctx.mem_long.len());
+        let after = goals::Reading::of(&self.ctx);
+        m.goal_progressed(self.agent_name(), kind, &before, &after);
+
+        if let Ok(text) = &output {
+            if !text.is_empty() {
+                let _ = self.ctx.record(events::AgentEvent::ResponseProduced {
+                    handler: kind.to_string(),
+                    input: input.to_string(),
+                    output: text.clone(),
+                });
+            }
+        }
+        self.dispatch_events();
+        if let Err(e) = self.sync_memory() {
+            tracing::warn!("memory sync failed: {}", e);
+        }
+        output
+    }
+
+    fn dispatch_events(&mut self) {
+        let events = self.ctx.take_events();
+        if events.is_empty() {
+            return;
+        }
+        let agent = match &self.ctx.current_agent {
+            Some(types::Statement::AgentDeclaration { name, .. }) => name.as_str(),
+            _ => "",
+        };
+        for event in &events {
+            if self.recording() {
+                self.changes.extend(recording::Change::from_event(event));
+            }
+            if let Some(webhooks) = &self.webhooks {
+                webhooks.dispatch(agent, event);
+            }
+            for sink in &mut self.event_sinks {
+                sink(agent, event);
+            }
+        }
+    }
+
+    fn recording(&self) -> bool {
+        self.recorder.is_some() || self.recent.is_some()
+    }
+
+    fn agent_name(&self) -> &str {
+        match &self.ctx.current_agent {
+            Some(types::Statement::AgentDeclaration { name, .. }) => name,
+            _ => "",
+        }
+    }
+
+    /// Count the statements run from now on, in programs parsed with
+    /// locations; see [`coverage`].
+    pub fn record_coverage(&mut self) {
+        self.ctx
+            .coverage
+            .get_or_insert_with(coverage::Coverage::new);
+    }
+
+    /// Statements run since [`record_coverage`](Self::record_coverage).
+    pub fn coverage(&self) -> Option<&coverage::Coverage> {
+        self.ctx.coverage.as_ref()
+    }
+
+    /// Send agent events to `webhooks` from now on.
+    pub fn set_webhooks(&mut self, webhooks: webhooks::Webhooks) {
+        self.ctx.events.get_or_insert_with(Vec::new);
+        self.webhooks = Some(webhooks);
+    }
+
+    /// Record each input the agent handles from now on to `recorder`; see
+    /// [`recording`].
+    pub fn set_recorder(&mut self, recorder: recording::Recorder) {
+        self.ctx.events.get_or_insert_with(Vec::new);
+        self.recorder = Some(recorder);
+    }
+
+    /// Keep the last `capacity` inputs the agent handles, with their answers
+    /// and memory changes, for [`recent_turns`](Self::recent_turns).
+    pub fn keep_recent_turns(&mut self, capacity: usize) {
+        self.ctx.events.get_or_insert_with(Vec::new);
+        self.recent = Some(recording::Recorder::recent(capacity));
+    }
+
+    /// The turns kept since [`keep_recent_turns`](Self::keep_recent_turns),
+    /// oldest first.
+    pub fn recent_turns(&self) -> Vec<recording::Turn> {
+        self.recent.as_ref().map(|r| r.turns()).unwrap_or_default()
+    }
+
+    /// Call `sink` with the agent's name and each event it causes from now
+    /// on, e.g. to publish them to other processes.
+    pub fn on_event(&mut self, sink: impl FnMut(&str, &events::AgentEvent) + Send + 'static) {
+        self.ctx.events.get_or_insert_with(Vec::new);
+        self.event_sinks.push(Box::new(sink));
+    }
 
-        tracing::warn!("No agent or on input block matched.");
+    /// Stop at breakpoints and steps while evaluating programs parsed with
+    /// locations.
+    pub fn set_debugger(&mut self, debugger: std::sync::Arc<debugger::Debugger>) {
+        self.ctx.debugger = Some(debugger);
+    }
+
+    /// Share long-term memory through `sync` from now on.
+    pub fn set_memory_sync(&mut self, sync: sync::MemorySync) {
+        self.memory_sync = Some(sync);
+    }
+
+    /// Sync long-term memory if a sync is set and its interval has passed.
+    /// Handlers call this when they finish; idle long-running commands
+    /// should call it periodically.
+    pub fn sync_memory(&mut self) -> Result<Option<sync::SyncReport>, sync::SyncError> {
+        let Some(memory_sync) = self.memory_sync.as_mut().filter(|s| s.is_due()) else {
+            return Ok(None);
+        };
+        let report = memory_sync.sync(&mut self.ctx)?;
+        self.dispatch_events();
+        Ok(Some(report))
+    }
+
+    /// Scheduler for the registered agent's `on schedule` handlers.
+    pub fn scheduler(&self) -> Result<schedule::Scheduler, schedule::CronError> {
+        schedule::Scheduler::for_context(&self.ctx)
+    }
+
+    /// Register a provider for `ask` statements; the first one becomes the default.
+    pub fn register_llm(&mut self, provider: std::sync::Arc<dyn llm::LlmProvider>) {
+        self.ctx.llm.register(provider);
+    }
+
+    pub fn set_llm_registry(&mut self, registry: llm::LlmRegistry) {
+        self.ctx.llm = registry;
+    }
+
+    /// Replace the index `recall` searches memory with.
+    pub fn set_memory_index(&mut self, index: recall::MemoryIndex) {
+        self.ctx.latent = index;
+    }
+
+    /// Fill long-term memory from `store` and write every change to it; see
+    /// [`store`].
+    pub fn set_store(
+        &mut self,
+        store: std::sync::Arc<dyn store::MemoryStore>,
+    ) -> Result<(), error::MemoryError> {
+        self.ctx.attach_store(store)
+    }
+
+    /// Replace the embedder used by `embed` and `similarity`.
+    pub fn set_embedder(&mut self, embedder: std::sync::Arc<dyn llm::embedding::Embedder>) {
+        self.ctx.embedder = embedder;
+    }
+
+    /// Replace the agent's drives and the rules that move them.
+    pub fn set_affect(&mut self, affect: affect::Affect) {
+        self.ctx.affect = affect;
+    }
+
+    /// Replace the caps on memory and queued events.
+    pub fn set_limits(&mut self, limits: limits::Limits) {
+        self.ctx.limits = limits;
+    }
+
+    /// Replace the sandbox limiting `fetch` and similar statements.
+    pub fn set_sandbox(&mut self, sandbox: sandbox::Sandbox) {
+        self.ctx.sandbox = sandbox;
+    }
+
+    /// Structured description of the registered agent, if any.
+    pub fn describe(&self) -> Option<introspect::AgentInfo> {
+        introspect::describe(&self.ctx)
+    }
+
+    /// Read `key` from the named memory region.
+    pub fn get_mem(&self, region: &str, key: &str) -> Result<String, error::MemoryError> {
+        self.ctx.try_get_mem(region, key)
+    }
+
+    /// Read `key` from the named memory region as the kind of value it was
+    /// written as; see [`expr::Value`].
+    pub fn get_value(&self, region: &str, key: &str) -> Result<expr::Value, error::MemoryError> {
+        self.ctx.try_get_value(region, key)
+    }
+
+    /// Search memory; see [`AgentContext::recall`].
+    pub fn recall(
+        &self,
+        query: &str,
+        region: Option<&str>,
+        limit: usize,
+    ) -> Result<Vec<context::MemoryMatch>, error::MemoryError> {
+        self.ctx.recall(query, region, limit)
+    }
+
+    /// Write one memory value, as a handler would.
+    pub fn set_mem(
+        &mut self,
+        region: &str,
+        key: &str,
+        value: &str,
+    ) -> Result<(), error::MemoryError> {
+        self.ctx.try_set_mem(region, key, value)?;
+        self.dispatch_events();
+        Ok(())
+    }
+
+    /// Write one memory value of any kind, as a handler would.
+    pub fn set_value(
+        &mut self,
+        region: &str,
+        key: &str,
+        value: expr::Value,
+    ) -> Result<(), error::MemoryError> {
+        self.ctx.try_set_value(region, key, value)?;
+        self.dispatch_events();
+        Ok(())
+    }
+
+    /// Where the agent stands on its goal and what this session's handler
+    /// runs did to it; see [`goals::report`].
+    pub fn goal_report(&self) -> goals::Report {
+        goals::report(&self.ctx)
+    }
+
+    /// Changes `evolve` blocks proposed and that wait for
+    /// [`commit_proposals`](Self::commit_proposals), as a diff of the
+    /// agent's source; see [`evolve::diff`].
+    pub fn proposals(&self) -> Vec<String> {
+        evolve::diff(&self.ctx)
+    }
+
+    /// Apply the proposed changes to the agent; see [`evolve::commit`].
+    pub fn commit_proposals(&mut self) -> Result<Vec<String>, RuntimeError> {
+        evolve::commit(&mut self.ctx)
+    }
+
+    pub fn discard_proposals(&mut self) -> usize {
+        evolve::discard(&mut self.ctx)
+    }
+
+    /// Credit `value` to the kind of handler that ran last, for learning
+    /// from outcomes known only after the agent answered; see [`reward`].
+    /// Returns that kind, or `None` if no handler has run or `value` is not
+    /// finite.
+    pub fn reward(&mut self, value: f64) -> Option<String> {
+        self.ctx.rewards.reward(value).map(str::to_string)
+    }
+
+    /// Rewards each kind of handler got this session.
+    pub fn rewards(&self) -> &std::collections::BTreeMap<String, reward::Stats> {
+        self.ctx.rewards.stats()
+    }
+
+    /// Consolidate short-term memory into long-term memory, as between
+    /// sessions; see [`dream::consolidate`].
+    pub fn dream(&mut self, options: &dream::Options) -> dream::Report {
+        let report = dream::consolidate(&mut self.ctx, options);
+        self.dispatch_events();
+        report
+    }
+
+    /// Sizes of the agent's memory; see [`AgentContext::stats`].
+    pub fn stats(&self) -> context::Stats {
+        self.ctx.stats()
+    }
+
+    /// Copy of the agent's memory and links.
+    pub fn snapshot(&self) -> context::Snapshot {
+        self.ctx.snapshot()
+    }
+
+    /// The agent's memory and links as they are now, to save without
+    /// copying them first; see [`context::Frozen`].
+    pub fn freeze(&self) -> context::Frozen {
+        self.ctx.freeze()
+    }
+
+    /// Replace the agent's memory and links with the file at `path`; see
+    /// [`AgentContext::load`].
+    pub fn load_memory(&mut self, path: &str) -> Result<(), error::MemoryError> {
+        self.ctx.load(path)
+    }
 
-        None
+    /// Replace the agent's memory and links with `snapshot`.
+    pub fn restore(&mut self, snapshot: context::Snapshot) {
+        self.ctx.restore(snapshot);
     }
 
     pub fn get_short(&self, key: &str) -> String {
@@ -89,11 +573,11 @@ impl SentienceAgent {
     }
 
     pub fn all_short(&self) -> HashMap<String, String> {
-        self.ctx.mem_short.clone()
+        intern::strings(&self.ctx.mem_short)
     }
 
     pub fn all_long(&self) -> HashMap<String, String> {
-        self.ctx.mem_long.clone()
+        intern::strings(&self.ctx.mem_long)
     }
 }
 
@@ -0,0 +1,125 @@
+//! Caps on what a running agent may hold, so one program cannot grow without
+//! bound in a long-running or multi-tenant deployment. Every cap is off
+//! unless the embedding application or the config file sets it, except
+//! that a loop stops after [`DEFAULT_LOOP_ITERATIONS`] iterations unless
+//! told otherwise.
+
+use crate::config::LimitsConfig;
+use std::fmt;
+use std::time::Duration;
+
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub struct Limits {
+    /// Entries in each memory region; writing a new key to a full region
+    /// fails, while overwriting an existing key still works.
+    pub max_entries: Option<usize>,
+    /// Size in bytes of one memory value.
+    pub max_value_bytes: Option<usize>,
+    /// Events queued for listeners while a handler runs. Further events are
+    /// dropped, with [`LimitError::Events`] from
+    /// [`AgentContext::record`](crate::context::AgentContext::record).
+    pub max_events: Option<usize>,
+    /// Vectors in a [`LatentIndex`](crate::sentience_core::latent::LatentIndex)
+    /// kept by an in-memory cortex.
+    pub max_latent_vectors: Option<usize>,
+    /// Time one `ask`, `fetch` or `exec` may take.
+    pub statement_timeout: Option<Duration>,
+    /// Time one run of a handler may take, statements included.
+    pub turn_timeout: Option<Duration>,
+    /// Iterations of one `while` or `for` loop; see
+    /// [`loop_iterations`](Self::loop_iterations).
+    pub max_loop_iterations: Option<usize>,
+}
+
+/// Iterations a loop may run when [`Limits::max_loop_iterations`] is unset,
+/// so a loop whose condition never turns false cannot hang the REPL.
+pub const DEFAULT_LOOP_ITERATIONS: usize = 10_000;
+
+impl Limits {
+    pub fn from_config(config: &LimitsConfig) -> Self {
+        Self {
+            max_entries: config.max_entries,
+            max_value_bytes: config.max_value_bytes,
+            max_events: config.max_events,
+            max_latent_vectors: config.max_latent_vectors,
+            statement_timeout: config.statement_timeout_secs.and_then(seconds),
+            turn_timeout: config.turn_timeout_secs.and_then(seconds),
+            max_loop_iterations: config.max_loop_iterations,
+        }
+    }
+
+    /// Iterations one loop may run.
+    pub fn loop_iterations(&self) -> usize {
+        self.max_loop_iterations.unwrap_or(DEFAULT_LOOP_ITERATIONS)
+    }
+}
+
+/// `secs` as a duration, if it is one.
+pub fn seconds(secs: f64) -> Option<Duration> {
+    Duration::try_from_secs_f64(secs).ok()
+}
+
+/// An operation that would go over one of the [`Limits`].
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub enum LimitError {
+    /// The region already holds `limit` entries.
+    Entries { region: String, limit: usize },
+    /// The value of `key` is `size` bytes.
+    ValueSize {
+        key: String,
+        size: usize,
+        limit: usize,
+    },
+    /// `limit` events are queued and not yet taken.
+    Events { limit: usize },
+    /// The latent index already holds `limit` vectors.
+    LatentVectors { limit: usize },
+    /// A loop was about to run a further iteration after `limit`.
+    LoopIterations { limit: usize },
+}
+
+impl LimitError {
+    pub fn code(&self) -> &'static str {
+        match self {
+            LimitError::Entries { .. } => "SEN5101",
+            LimitError::ValueSize { .. } => "SEN5102",
+            LimitError::Events { .. } => "SEN5103",
+            LimitError::LatentVectors { .. } => "SEN5104",
+            LimitError::LoopIterations { .. } => "SEN5105",
+        }
+    }
+}
+
+impl fmt::Display for LimitError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            LimitError::Entries { region, limit } => write!(
+                f,
+                "memory region `{}` is full ({} entries; see limits.max_entries)",
+                region, limit
+            ),
+            LimitError::ValueSize { key, size, limit } => write!(
+                f,
+                "value of `{}` is {} bytes, over the limit of {} (see limits.max_value_bytes)",
+                key, size, limit
+            ),
+            LimitError::Events { limit } => write!(
+                f,
+                "{} events are queued and not taken (see limits.max_events)",
+                limit
+            ),
+            LimitError::LatentVectors { limit } => write!(
+                f,
+                "latent index is full ({} vectors; see limits.max_latent_vectors)",
+                limit
+            ),
+            LimitError::LoopIterations { limit } => write!(
+                f,
+                "loop ran {} iterations without ending (see limits.max_loop_iterations)",
+                limit
+            ),
+        }
+    }
+}
+
+impl std::error::Error for LimitError {}
@@ -0,0 +1,307 @@
+//! Warnings about code that runs but probably does not do what was meant:
+//! handlers that never run, empty blocks, conditions that are always or
+//! never true, and assignments that overwrite a handler's input.
+//!
+//! A rule is turned off for one statement with a comment naming it or its
+//! code, either at the end of the statement's line or on the line before:
+//!
+//! ```text
+//! # lint: allow empty-block
+//! train {
+//! }
+//! ```
+
+use crate::analyze::{Diagnostic, Severity};
+use crate::lexer::{Lexer, TokenType};
+use crate::parser::Parser;
+use crate::types::Statement;
+use std::collections::{HashMap, HashSet};
+
+/// The lint rules, by the name used to allow them, with their codes.
+pub const RULES: [(&str, &str); 5] = [
+    ("unreachable-handler", "SEN3001"),
+    ("empty-block", "SEN3002"),
+    ("constant-condition", "SEN3003"),
+    ("shadowed-input", "SEN3004"),
+    ("stale-condition", "SEN3005"),
+];
+
+/// Lint `source`, leaving out what its comments allow.
+pub fn lint(source: &str) -> Vec<Diagnostic> {
+    let allowed = allowed(source);
+    let mut lexer = Lexer::new(source);
+    let program = Parser::new(&mut lexer).with_locations().parse_program();
+    let mut linter = Linter::default();
+    linter.body(&program.statements, None);
+    linter
+        .found
+        .into_iter()
+        .filter(|(rule, line, _)| !allowed.get(line).is_some_and(|rules| rules.contains(rule)))
+        .map(|(rule, line, message)| Diagnostic {
+            code: code(rule),
+            severity: Severity::Warning,
+            line: Some(line),
+            column: None,
+            message: format!("{} [{}]", message, rule),
+        })
+        .collect()
+}
+
+fn code(rule: &str) -> &'static str {
+    RULES
+        .iter()
+        .find(|(name, _)| *name == rule)
+        .map_or("", |(_, code)| code)
+}
+
+/// Rules allowed on each line by `# lint: allow <rule>, ...` comments. A
+/// comment alone on its line applies to the next line too.
+fn allowed(source: &str) -> HashMap<usize, HashSet<&'static str>> {
+    let mut lexer = Lexer::new(source);
+    let mut lines_with_code = HashSet::new();
+    loop {
+        let token = lexer.next_token();
+        if token.token_type == TokenType::Eof {
+            break;
+        }
+        lines_with_code.insert(token.line);
+    }
+    let mut allowed: HashMap<usize, HashSet<&'static str>> = HashMap::new();
+    for comment in lexer.comments() {
+        let Some(names) = comment.text.trim().strip_prefix("lint: allow") else {
+            continue;
+        };
+        let rules = names.split(',').filter_map(|name| {
+            let name = name.trim();
+            RULES
+                .iter()
+                .find(|(rule, code)| *rule == name || *code == name)
+                .map(|(rule, _)| rule)
+        });
+        for rule in rules {
+            allowed.entry(comment.line).or_default().insert(rule);
+            if !lines_with_code.contains(&comment.line) {
+                allowed.entry(comment.line + 1).or_default().insert(rule);
+            }
+        }
+    }
+    allowed
+}
+
+#[derive(Default)]
+struct Linter {
+    found: Vec<(&'static str, usize, String)>,
+    line: usize,
+}
+
+impl Linter {
+    fn warn(&mut self, rule: &'static str, message: String) {
+        self.found.push((rule, self.line, message));
+    }
+
+    /// Lint `body`, where handlers store their input under `param`.
+    fn body(&mut self, body: &[Statement], param: Option<&str>) {
+        for stmt in body {
+            self.statement(stmt, param);
+        }
+    }
+
+    fn statement(&mut self, stmt: &Statement, param: Option<&str>) {
+        match stmt {
+            Statement::Location { line, .. } => self.line = *line,
+            Statement::AgentDeclaration { body, .. } => {
+                self.handlers(body);
+                self.body(body, None);
+            }
+            Statement::OnInput { param, body } => {
+                self.empty(body, "`on input` handler");
+                self.body(body, Some(param));
+            }
+            Statement::OnSchedule { body, .. } => {
+                self.empty(body, "`on schedule` handler");
+                self.body(body, None);
+            }
+            Statement::OnOutput { param, body } => {
+                self.empty(body, "`on output` handler");
+                self.body(body, Some(param));
+            }
+            Statement::OnStart { body } | Statement::OnStop { body } => {
+                let name = match stmt {
+                    Statement::OnStart { .. } => "`on start` handler",
+                    _ => "`on stop` handler",
+                };
+                self.empty(body, name);
+                self.body(body, None);
+            }
+            Statement::Train { body, .. } | Statement::Evolve { body } => {
+                let name = match stmt {
+                    Statement::Train { .. } => "`train` block",
+                    _ => "`evolve` block",
+                };
+                self.empty(body, name);
+                self.body(body, Some("msg"));
+            }
+            Statement::IfContextIncludes { values, body } => {
+                self.condition(values, param);
+                self.empty(body, "`if` block");
+                self.body(body, param);
+            }
+            Statement::IfElse { branch, otherwise } => {
+                self.statement(branch, param);
+                self.empty(otherwise, "`else` block");
+                self.body(otherwise, param);
+            }
+            Statement::If { body, .. }
+            | Statement::IfState { body, .. }
+            | Statement::IfReward { body, .. } => {
+                self.empty(body, "`if` block");
+                self.body(body, param);
+            }
+            Statement::Reflect { body } => self.body(body, param),
+            Statement::Function { body, .. } => self.body(body, None),
+            Statement::While { body, .. } | Statement::For { body, .. } => {
+                self.empty(body, "loop body");
+                self.body(body, param);
+            }
+            Statement::Assignment(name, _) | Statement::Assign { name, .. }
+                if Some(name.as_str()) == param =>
+            {
+                self.warn(
+                    "shadowed-input",
+                    format!(
+                        "assigning to `{}` overwrites the input the handler was given",
+                        name
+                    ),
+                )
+            }
+            Statement::Let { name, .. } if Some(name.as_str()) == param => self.warn(
+                "shadowed-input",
+                format!("`let {}` hides the input the handler was given", name),
+            ),
+            _ => {}
+        }
+    }
+
+    /// Warn about handlers of an agent that are never run because an
+    /// earlier one of the same kind is run instead.
+    fn handlers(&mut self, body: &[Statement]) {
+        let mut seen = HashSet::new();
+        let mut line = self.line;
+        for stmt in body {
+            let handler = match stmt {
+                Statement::Location { line: at, .. } => {
+                    line = *at;
+                    continue;
+                }
+                Statement::OnInput { .. } => "`on input`".to_string(),
+                Statement::OnSchedule { spec, .. } if spec.starts_with("every ") => {
+                    format!("`{}`", spec)
+                }
+                Statement::OnSchedule { spec, .. } => format!("`on schedule(\"{}\")`", spec),
+                Statement::OnStart { .. } => "`on start`".to_string(),
+                Statement::OnStop { .. } => "`on stop`".to_string(),
+                Statement::OnOutput { .. } => "`on output`".to_string(),
+                Statement::Train { .. } => "`train`".to_string(),
+                Statement::Evolve { .. } => "`evolve`".to_string(),
+                _ => continue,
+            };
+            if !seen.insert(handler.clone()) {
+                self.found.push((
+                    "unreachable-handler",
+                    line,
+                    format!("{} never runs; an earlier one always handles it", handler),
+                ));
+            }
+        }
+    }
+
+    fn empty(&mut self, body: &[Statement], what: &str) {
+        if body
+            .iter()
+            .all(|stmt| matches!(stmt, Statement::Location { .. }))
+        {
+            self.warn("empty-block", format!("{} is empty", what));
+        }
+    }
+
+    /// `if context includes [...]` tests whether `mem.short["msg"]`
+    /// contains any of the values.
+    fn condition(&mut self, values: &[String], param: Option<&str>) {
+        if values.is_empty() {
+            self.warn(
+                "constant-condition",
+                "`if context includes []` is never true".to_string(),
+            );
+        } else if values.iter().any(String::is_empty) {
+            self.warn(
+                "constant-condition",
+                "`if context includes` with \"\" is always true".to_string(),
+            );
+        }
+        if let Some(param) = param.filter(|param| *param != "msg") {
+            self.warn(
+                "stale-condition",
+                format!(
+                    "`if context includes` tests `msg`, but this handler's input is `{}`",
+                    param
+                ),
+            );
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn warnings(source: &str) -> Vec<String> {
+        lint(source).iter().map(|d| d.to_string()).collect()
+    }
+
+    #[test]
+    fn finds_each_rule() {
+        let source = concat!(
+            "agent A {\n",
+            "  on input(msg) {\n",
+            "    if context includes [] {\n",
+            "      print \"never\"\n",
+            "    }\n",
+            "    msg = \"changed\"\n",
+            "  }\n",
+            "  on input(text) {\n",
+            "    if context includes [\"\", \"a\"] {\n",
+            "    }\n",
+            "  }\n",
+            "}\n",
+        );
+        assert_eq!(
+            warnings(source),
+            [
+                "8: warning[SEN3001]: `on input` never runs; an earlier one always handles it [unreachable-handler]",
+                "3: warning[SEN3003]: `if context includes []` is never true [constant-condition]",
+                "6: warning[SEN3004]: assigning to `msg` overwrites the input the handler was given [shadowed-input]",
+                "9: warning[SEN3003]: `if context includes` with \"\" is always true [constant-condition]",
+                "9: warning[SEN3005]: `if context includes` tests `msg`, but this handler's input is `text` [stale-condition]",
+                "9: warning[SEN3002]: `if` block is empty [empty-block]",
+            ]
+        );
+    }
+
+    #[test]
+    fn comments_allow_rules() {
+        let source = concat!(
+            "agent A {\n",
+            "  # lint: allow empty-block\n",
+            "  train {\n",
+            "  }\n",
+            "  evolve { } # lint: allow SEN3002, stale-condition\n",
+            "  on schedule(\"* * * * *\") {\n",
+            "  }\n",
+            "}\n",
+        );
+        assert_eq!(
+            warnings(source),
+            ["6: warning[SEN3002]: `on schedule` handler is empty [empty-block]"]
+        );
+    }
+}
@@ -0,0 +1,189 @@
+use crate::config::{env_or, AnthropicConfig};
+use crate::llm::tools::ToolCall;
+use crate::llm::{LlmError, LlmProvider, LlmRequest, LlmResponse};
+use serde::Deserialize;
+use serde_json::json;
+use std::time::Duration;
+
+const DEFAULT_BASE_URL: &str = "https://api.anthropic.com";
+const DEFAULT_MODEL: &str = "claude-3-5-haiku-latest";
+const API_VERSION: &str = "2023-06-01";
+
+/// Anthropic Messages API provider.
+pub struct AnthropicProvider {
+    api_key: String,
+    base_url: String,
+    model: String,
+    max_tokens: u32,
+    client: reqwest::blocking::Client,
+}
+
+#[derive(Deserialize)]
+struct MessagesResponse {
+    model: String,
+    content: Vec<ContentBlock>,
+    usage: Option<Usage>,
+}
+
+#[derive(Deserialize)]
+struct ContentBlock {
+    #[serde(rename = "type")]
+    kind: String,
+    #[serde(default)]
+    text: String,
+    #[serde(default)]
+    id: String,
+    #[serde(default)]
+    name: String,
+    #[serde(default)]
+    input: serde_json::Value,
+}
+
+#[derive(Deserialize)]
+struct Usage {
+    input_tokens: u64,
+    output_tokens: u64,
+}
+
+impl AnthropicProvider {
+    pub fn new(api_key: &str) -> Self {
+        Self {
+            api_key: api_key.to_string(),
+            base_url: DEFAULT_BASE_URL.to_string(),
+            model: DEFAULT_MODEL.to_string(),
+            max_tokens: 1024,
+            client: reqwest::blocking::Client::builder()
+                .timeout(Duration::from_secs(120))
+                .build()
+                .expect("failed to build HTTP client"),
+        }
+    }
+
+    /// Provider from the `llm.anthropic` config section and `ANTHROPIC_*`
+    /// environment variables, or `None` when no API key is available.
+    pub fn configured(config: &AnthropicConfig) -> Option<Self> {
+        let key = env_or("ANTHROPIC_API_KEY", config.api_key.as_ref())?;
+        let mut provider = Self::new(&key);
+        if let Some(model) = env_or("ANTHROPIC_MODEL", config.model.as_ref()) {
+            provider.model = model;
+        }
+        if let Some(url) = env_or("ANTHROPIC_BASE_URL", config.base_url.as_ref()) {
+            provider = provider.with_base_url(&url);
+        }
+        Some(provider)
+    }
+
+    pub fn with_model(mut self, model: &str) -> Self {
+        self.model = model.to_string();
+        self
+    }
+
+    pub fn with_base_url(mut self, url: &str) -> Self {
+        self.base_url = url.trim_end_matches('/').to_string();
+        self
+    }
+}
+
+/// The prompt followed by each earlier tool round as `tool_use` blocks from
+/// the assistant and `tool_result` blocks from the user.
+fn messages(request: &LlmRequest) -> Vec<serde_json::Value> {
+    let mut messages = vec![json!({ "role": "user", "content": request.prompt })];
+    for round in &request.rounds {
+        let uses: Vec<_> = round
+            .calls
+            .iter()
+            .map(|call| {
+                json!({ "type": "tool_use", "id": call.id, "name": call.name, "input": call.arguments })
+            })
+            .collect();
+        let results: Vec<_> = round
+            .calls
+            .iter()
+            .zip(&round.results)
+            .map(|(call, result)| {
+                json!({ "type": "tool_result", "tool_use_id": call.id, "content": result })
+            })
+            .collect();
+        messages.push(json!({ "role": "assistant", "content": uses }));
+        messages.push(json!({ "role": "user", "content": results }));
+    }
+    messages
+}
+
+impl LlmProvider for AnthropicProvider {
+    fn name(&self) -> &str {
+        "anthropic"
+    }
+
+    fn complete(&self, request: &LlmRequest) -> Result<LlmResponse, LlmError> {
+        let mut body = json!({
+            "model": request.model.as_deref().unwrap_or(&self.model),
+            "max_tokens": request.max_tokens.unwrap_or(self.max_tokens),
+            "messages": messages(request),
+        });
+        if let Some(temperature) = request.temperature {
+            body["temperature"] = json!(temperature);
+        }
+        if !request.tools.is_empty() {
+            body["tools"] = request
+                .tools
+                .iter()
+                .map(|tool| {
+                    json!({
+                        "name": tool.name,
+                        "description": tool.description,
+                        "input_schema": tool.parameters,
+                    })
+                })
+                .collect();
+        }
+
+        let mut builder = self
+            .client
+            .post(format!("{}/v1/messages", self.base_url))
+            .header("x-api-key", &self.api_key)
+            .header("anthropic-version", API_VERSION)
+            .json(&body);
+        if let Some(timeout) = request.remaining() {
+            builder = builder.timeout(timeout);
+        }
+        let response = builder.send().map_err(|e| LlmError::Http(e.to_string()))?;
+
+        let status = response.status();
+        if !status.is_success() {
+            return Err(LlmError::Api {
+                status: status.as_u16(),
+                message: response.text().unwrap_or_default(),
+            });
+        }
+
+        let parsed: MessagesResponse = response
+            .json()
+            .map_err(|e| LlmError::Decode(e.to_string()))?;
+        let text = parsed
+            .content
+            .iter()
+            .filter(|block| block.kind == "text")
+            .map(|block| block.text.as_str())
+            .collect::<Vec<_>>()
+            .join("");
+        let tool_calls = parsed
+            .content
+            .into_iter()
+            .filter(|block| block.kind == "tool_use")
+            .map(|block| ToolCall {
+                id: block.id,
+                name: block.name,
+                arguments: block.input,
+            })
+            .collect();
+
+        Ok(LlmResponse {
+            text,
+            model: parsed.model,
+            input_tokens: parsed.usage.as_ref().map(|u| u.input_tokens),
+            output_tokens: parsed.usage.as_ref().map(|u| u.output_tokens),
+            tool_calls,
+        })
+    }
+}
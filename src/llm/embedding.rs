@@ -0,0 +1,335 @@
+//! Text embeddings for `embed` statements (from `lang 0.3`), `similarity(a, b)`
+//! and attention scores. The [`HashEmbedder`] (the bag-of-words vectors of
+//! [`sync::embed`]) needs no service and is used unless `llm.embedding`
+//! picks OpenAI or Ollama, whose vectors place texts by meaning rather than
+//! shared words:
+//!
+//! ```json
+//! { "llm": { "embedding": { "provider": "ollama", "model": "nomic-embed-text" } } }
+//! ```
+//!
+//! The providers take their URL, key and timeout from the `llm.openai` and
+//! `llm.ollama` sections.
+
+use crate::config::{env_or, EmbeddingConfig, LlmConfig};
+use crate::llm::LlmError;
+use crate::sentience_core::latent;
+use crate::sync;
+use serde::Deserialize;
+use serde_json::json;
+use std::fmt;
+use std::sync::Arc;
+use std::time::Duration;
+
+const DEFAULT_OPENAI_BASE_URL: &str = "https://api.openai.com/v1";
+const DEFAULT_OPENAI_MODEL: &str = "text-embedding-3-small";
+const DEFAULT_OLLAMA_BASE_URL: &str = "http://localhost:11434";
+const DEFAULT_OLLAMA_MODEL: &str = "nomic-embed-text";
+const DEFAULT_TIMEOUT_SECS: u64 = 60;
+
+/// Turns text into a vector; texts alike in meaning get vectors pointing
+/// the same way.
+pub trait Embedder: Send + Sync {
+    /// Name used to select the embedder in `llm.embedding.provider`.
+    fn name(&self) -> &str;
+    fn embed(&self, text: &str) -> Result<Vec<f32>, LlmError>;
+}
+
+impl fmt::Debug for dyn Embedder {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "Embedder({})", self.name())
+    }
+}
+
+/// Hashed bag-of-words vectors; see [`sync::embed`].
+#[derive(Clone, Copy, Debug, Default)]
+pub struct HashEmbedder;
+
+impl Embedder for HashEmbedder {
+    fn name(&self) -> &str {
+        "hash"
+    }
+
+    fn embed(&self, text: &str) -> Result<Vec<f32>, LlmError> {
+        Ok(sync::embed(text))
+    }
+}
+
+/// OpenAI's `/embeddings` endpoint, or that of any server implementing the
+/// same API.
+pub struct OpenAiEmbedder {
+    api_key: String,
+    base_url: String,
+    model: String,
+    client: reqwest::blocking::Client,
+}
+
+#[derive(Deserialize)]
+struct OpenAiResponse {
+    data: Vec<OpenAiEmbedding>,
+}
+
+#[derive(Deserialize)]
+struct OpenAiEmbedding {
+    embedding: Vec<f32>,
+}
+
+impl OpenAiEmbedder {
+    pub fn new(api_key: &str, base_url: &str, model: &str, timeout: Duration) -> Self {
+        Self {
+            api_key: api_key.to_string(),
+            base_url: base_url.trim_end_matches('/').to_string(),
+            model: model.to_string(),
+            client: client(timeout),
+        }
+    }
+}
+
+impl Embedder for OpenAiEmbedder {
+    fn name(&self) -> &str {
+        "openai"
+    }
+
+    fn embed(&self, text: &str) -> Result<Vec<f32>, LlmError> {
+        let response = self
+            .client
+            .post(format!("{}/embeddings", self.base_url))
+            .bearer_auth(&self.api_key)
+            .json(&json!({ "model": self.model, "input": text }))
+            .send()
+            .map_err(|e| LlmError::Http(e.to_string()))?;
+        let parsed: OpenAiResponse = decode(response)?;
+        let embedding = parsed.data.into_iter().next().map(|data| data.embedding);
+        embedding.ok_or_else(|| LlmError::Decode("no embedding in response".to_string()))
+    }
+}
+
+/// Embedding models served by a local Ollama.
+pub struct OllamaEmbedder {
+    base_url: String,
+    model: String,
+    client: reqwest::blocking::Client,
+}
+
+#[derive(Deserialize)]
+struct OllamaResponse {
+    embeddings: Vec<Vec<f32>>,
+}
+
+impl OllamaEmbedder {
+    pub fn new(base_url: &str, model: &str, timeout: Duration) -> Self {
+        Self {
+            base_url: base_url.trim_end_matches('/').to_string(),
+            model: model.to_string(),
+            client: client(timeout),
+        }
+    }
+}
+
+impl Embedder for OllamaEmbedder {
+    fn name(&self) -> &str {
+        "ollama"
+    }
+
+    fn embed(&self, text: &str) -> Result<Vec<f32>, LlmError> {
+        let response = self
+            .client
+            .post(format!("{}/api/embed", self.base_url))
+            .json(&json!({ "model": self.model, "input": text }))
+            .send()
+            .map_err(|e| {
+                LlmError::Unavailable(format!(
+                    "cannot reach Ollama at {} ({}); start it with `ollama serve` or set OLLAMA_HOST",
+                    self.base_url, e
+                ))
+            })?;
+        if response.status().as_u16() == 404 {
+            return Err(LlmError::Unavailable(format!(
+                "Ollama model `{}` is not installed; download it with `ollama pull {}`",
+                self.model, self.model
+            )));
+        }
+        let parsed: OllamaResponse = decode(response)?;
+        let embedding = parsed.embeddings.into_iter().next();
+        embedding.ok_or_else(|| LlmError::Decode("no embedding in response".to_string()))
+    }
+}
+
+/// The [`HashEmbedder`], used until another is configured.
+pub fn fallback() -> Arc<dyn Embedder> {
+    Arc::new(HashEmbedder)
+}
+
+/// The embedder `config` names, set up from the provider sections of `llm`;
+/// the [`HashEmbedder`] when it names none. Fails if the provider is
+/// unknown or OpenAI has no API key.
+pub fn from_config(config: &LlmConfig) -> Result<Arc<dyn Embedder>, LlmError> {
+    let embedding = config.embedding.clone().unwrap_or_default();
+    let provider = embedding.provider.as_deref().unwrap_or("hash");
+    match provider {
+        "hash" => Ok(fallback()),
+        "openai" => {
+            let openai = config.openai.clone().unwrap_or_default();
+            let key = env_or("OPENAI_API_KEY", openai.api_key.as_ref()).ok_or_else(|| {
+                LlmError::NotConfigured("embedding with openai needs OPENAI_API_KEY".to_string())
+            })?;
+            let base_url = env_or("OPENAI_BASE_URL", openai.base_url.as_ref())
+                .unwrap_or_else(|| DEFAULT_OPENAI_BASE_URL.to_string());
+            let model = model(&embedding, DEFAULT_OPENAI_MODEL);
+            let timeout = timeout(&embedding, openai.timeout_secs);
+            Ok(Arc::new(OpenAiEmbedder::new(
+                &key, &base_url, &model, timeout,
+            )))
+        }
+        "ollama" => {
+            let ollama = config.ollama.clone().unwrap_or_default();
+            let mut base_url = env_or("OLLAMA_HOST", ollama.base_url.as_ref())
+                .unwrap_or_else(|| DEFAULT_OLLAMA_BASE_URL.to_string());
+            if !base_url.starts_with("http://") && !base_url.starts_with("https://") {
+                base_url = format!("http://{}", base_url);
+            }
+            let model = model(&embedding, DEFAULT_OLLAMA_MODEL);
+            let timeout = timeout(&embedding, ollama.timeout_secs);
+            Ok(Arc::new(OllamaEmbedder::new(&base_url, &model, timeout)))
+        }
+        other => Err(LlmError::NotConfigured(format!(
+            "no embedding provider named `{}` (expected hash, openai or ollama)",
+            other
+        ))),
+    }
+}
+
+/// Cosine similarity of `a` and `b`, from -1 to 1; 0 if either is the zero
+/// vector or their lengths differ.
+pub fn similarity(a: &[f32], b: &[f32]) -> f32 {
+    if a.len() != b.len() {
+        return 0.0;
+    }
+    let (mut a, mut b) = (a.to_vec(), b.to_vec());
+    if !latent::normalize(&mut a) || !latent::normalize(&mut b) {
+        return 0.0;
+    }
+    a.iter().zip(&b).map(|(x, y)| x * y).sum()
+}
+
+fn model(config: &EmbeddingConfig, default: &str) -> String {
+    config.model.clone().unwrap_or_else(|| default.to_string())
+}
+
+fn timeout(config: &EmbeddingConfig, provider: Option<u64>) -> Duration {
+    Duration::from_secs(
+        config
+            .timeout_secs
+            .or(provider)
+            .unwrap_or(DEFAULT_TIMEOUT_SECS),
+    )
+}
+
+fn client(timeout: Duration) -> reqwest::blocking::Client {
+    reqwest::blocking::Client::builder()
+        .timeout(timeout)
+        .build()
+        .expect("failed to build HTTP client")
+}
+
+fn decode<T: for<'de> Deserialize<'de>>(
+    response: reqwest::blocking::Response,
+) -> Result<T, LlmError> {
+    let status = response.status();
+    if !status.is_success() {
+        return Err(LlmError::Api {
+            status: status.as_u16(),
+            message: response.text().unwrap_or_default(),
+        });
+    }
+    response.json().map_err(|e| LlmError::Decode(e.to_string()))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::replkit::Repl;
+    use std::io::{Read, Write};
+    use std::net::TcpListener;
+    use std::thread;
+
+    /// Serve one HTTP response on a local port and return its base URL.
+    fn serve_once(body: &'static str) -> String {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let url = format!("http://{}", listener.local_addr().unwrap());
+        thread::spawn(move || {
+            let (mut stream, _) = listener.accept().unwrap();
+            let mut buf = [0u8; 4096];
+            let _ = stream.read(&mut buf);
+            let response = format!(
+                "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+                body.len(),
+                body
+            );
+            stream.write_all(response.as_bytes()).unwrap();
+        });
+        url
+    }
+
+    #[test]
+    fn embeds_with_the_configured_provider() {
+        let hash = from_config(&LlmConfig::default()).unwrap();
+        assert_eq!(hash.name(), "hash");
+        let near = similarity(
+            &hash.embed("the cat sat").unwrap(),
+            &hash.embed("the cat ran").unwrap(),
+        );
+        let far = similarity(
+            &hash.embed("the cat sat").unwrap(),
+            &hash.embed("stock prices fell").unwrap(),
+        );
+        assert!(near > far, "{} <= {}", near, far);
+
+        let url = serve_once(r#"{"model":"nomic-embed-text","embeddings":[[0.6,0.8]]}"#);
+        let ollama = OllamaEmbedder::new(&url, "nomic-embed-text", Duration::from_secs(5));
+        assert_eq!(ollama.embed("hi").unwrap(), vec![0.6, 0.8]);
+
+        let url = serve_once(r#"{"object":"list","data":[{"index":0,"embedding":[1.0,0.0]}]}"#);
+        let openai = OpenAiEmbedder::new("key", &url, "small", Duration::from_secs(5));
+        assert_eq!(openai.embed("hi").unwrap(), vec![1.0, 0.0]);
+
+        let config: LlmConfig =
+            serde_json::from_str(r#"{"embedding": {"provider": "word2vec"}}"#).unwrap();
+        assert!(matches!(
+            from_config(&config),
+            Err(LlmError::NotConfigured(_))
+        ));
+    }
+
+    #[test]
+    fn embed_stores_vectors_that_similarity_compares() {
+        let mut out = Vec::new();
+        let mut repl = Repl::new(&b""[..], &mut out);
+        repl.eval_source(concat!(
+            "lang 0.3\n",
+            "agent Compare {\n",
+            "  on input(msg) {\n",
+            "    embed msg -> percept.text\n",
+            "    let near = similarity(mem.short[\"percept.text\"], \"the cat ran\")\n",
+            "    let far = similarity(msg, \"stock prices fell\")\n",
+            "    if near > far {\n",
+            "      print \"closer\"\n",
+            "    }\n",
+            "  }\n",
+            "}\n",
+        ))
+        .unwrap();
+        repl.handle_command(".input the cat sat").unwrap();
+        repl.eval_source("embed msg -> mem.long").unwrap();
+        assert!(repl
+            .context()
+            .get_mem("long", "msg.embedding")
+            .starts_with('['));
+        let stored = repl.context().get_mem("short", "percept.text");
+        let vector: Vec<f32> = serde_json::from_str(&stored).unwrap();
+        assert_eq!(vector, sync::embed("the cat sat"));
+        drop(repl);
+        let out = String::from_utf8(out).unwrap();
+        assert!(out.ends_with("  closer\n"), "{}", out);
+    }
+}
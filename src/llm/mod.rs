@@ -0,0 +1,311 @@
+pub mod anthropic;
+pub mod embedding;
+pub mod ollama;
+pub mod openai;
+pub mod tools;
+
+use crate::config::LlmConfig;
+use crate::context::AgentContext;
+use std::collections::HashMap;
+use std::error::Error as StdError;
+use std::fmt;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+use tools::{ToolCall, ToolDefinition, ToolRound};
+
+/// A single completion request issued by an `ask` statement.
+#[derive(Clone, Debug, Default, PartialEq)]
+pub struct LlmRequest {
+    pub prompt: String,
+    /// Provider-specific model name; `None` uses the provider default.
+    pub model: Option<String>,
+    pub temperature: Option<f32>,
+    pub max_tokens: Option<u32>,
+    /// Functions the model may call instead of answering directly.
+    pub tools: Vec<ToolDefinition>,
+    /// Earlier tool calls and their results, oldest first.
+    pub rounds: Vec<ToolRound>,
+    /// When the answer is needed by; providers give up at this time rather
+    /// than at their own timeout.
+    pub deadline: Option<Instant>,
+}
+
+#[derive(Clone, Debug, Default, PartialEq)]
+pub struct LlmResponse {
+    pub text: String,
+    pub model: String,
+    pub input_tokens: Option<u64>,
+    pub output_tokens: Option<u64>,
+    /// Tools the model wants run before it answers.
+    pub tool_calls: Vec<ToolCall>,
+}
+
+#[derive(Debug)]
+pub enum LlmError {
+    /// No provider registered, or the named one is missing.
+    NotConfigured(String),
+    InvalidOption {
+        name: String,
+        value: String,
+    },
+    /// The request could not be sent or the connection failed.
+    Http(String),
+    /// A local backend is not running or lacks the model; the message says
+    /// how to fix it.
+    Unavailable(String),
+    /// The provider answered with an error status.
+    Api {
+        status: u16,
+        message: String,
+    },
+    /// The provider's response could not be understood.
+    Decode(String),
+}
+
+impl fmt::Display for LlmError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            LlmError::NotConfigured(msg) => write!(f, "LLM provider not configured: {}", msg),
+            LlmError::InvalidOption { name, value } => {
+                write!(f, "invalid ask option {}: `{}`", name, value)
+            }
+            LlmError::Http(msg) => write!(f, "LLM request failed: {}", msg),
+            LlmError::Unavailable(msg) => write!(f, "LLM provider unavailable: {}", msg),
+            LlmError::Api { status, message } => {
+                write!(f, "LLM provider returned {}: {}", status, message)
+            }
+            LlmError::Decode(msg) => write!(f, "unexpected LLM response: {}", msg),
+        }
+    }
+}
+
+impl StdError for LlmError {}
+
+/// A text generation backend (OpenAI, Anthropic, Ollama, ...).
+pub trait LlmProvider: Send + Sync {
+    /// Name used to select the provider with `ask "..." (provider: "name")`.
+    fn name(&self) -> &str;
+    fn complete(&self, request: &LlmRequest) -> Result<LlmResponse, LlmError>;
+
+    /// Like [`complete`](Self::complete) but reports text as it is
+    /// generated. Providers without streaming deliver it in one piece.
+    fn stream(
+        &self,
+        request: &LlmRequest,
+        on_delta: &mut dyn FnMut(&str),
+    ) -> Result<LlmResponse, LlmError> {
+        let response = self.complete(request)?;
+        on_delta(&response.text);
+        Ok(response)
+    }
+}
+
+/// Memory keys (in `mem.long`) holding cumulative token usage.
+pub const USAGE_REQUESTS_KEY: &str = "llm.requests";
+pub const USAGE_INPUT_TOKENS_KEY: &str = "llm.input_tokens";
+pub const USAGE_OUTPUT_TOKENS_KEY: &str = "llm.output_tokens";
+
+/// Add a response's token counts to the running totals kept in `mem.long`,
+/// so usage is saved and restored along with the rest of the context.
+pub fn record_usage(ctx: &mut AgentContext, response: &LlmResponse) {
+    let mut add = |key: &str, amount: u64| {
+        let total = ctx.get_mem("long", key).parse::<u64>().unwrap_or(0) + amount;
+        ctx.set_mem("long", key, &total.to_string());
+    };
+    add(USAGE_REQUESTS_KEY, 1);
+    add(USAGE_INPUT_TOKENS_KEY, response.input_tokens.unwrap_or(0));
+    add(USAGE_OUTPUT_TOKENS_KEY, response.output_tokens.unwrap_or(0));
+}
+
+impl LlmRequest {
+    /// Time left until the [`deadline`](Self::deadline), if there is one.
+    pub fn remaining(&self) -> Option<Duration> {
+        self.deadline
+            .map(|deadline| deadline.saturating_duration_since(Instant::now()))
+    }
+
+    /// Build a request from `ask` options, returning the requested provider
+    /// name (if any) alongside it.
+    pub fn from_options(
+        prompt: String,
+        options: &[(String, String)],
+    ) -> Result<(Option<String>, LlmRequest), LlmError> {
+        let mut provider = None;
+        let mut request = LlmRequest {
+            prompt,
+            ..Default::default()
+        };
+
+        for (name, value) in options {
+            let invalid = || LlmError::InvalidOption {
+                name: name.clone(),
+                value: value.clone(),
+            };
+            match name.as_str() {
+                "provider" => provider = Some(value.clone()),
+                "model" => request.model = Some(value.clone()),
+                "temperature" => request.temperature = Some(value.parse().map_err(|_| invalid())?),
+                "max_tokens" => request.max_tokens = Some(value.parse().map_err(|_| invalid())?),
+                "tools" => request.tools = tools::definitions(value).ok_or_else(invalid)?,
+                _ => return Err(invalid()),
+            }
+        }
+        Ok((provider, request))
+    }
+}
+
+/// Providers available to `ask`, keyed by name. The first registered
+/// provider is the default unless another is chosen.
+#[derive(Clone, Default)]
+pub struct LlmRegistry {
+    providers: HashMap<String, Arc<dyn LlmProvider>>,
+    default: Option<String>,
+}
+
+impl fmt::Debug for LlmRegistry {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("LlmRegistry")
+            .field("providers", &self.names())
+            .field("default", &self.default)
+            .finish()
+    }
+}
+
+impl LlmRegistry {
+    /// Registry with every provider configured through the environment.
+    pub fn from_env() -> Self {
+        Self::from_config(&LlmConfig::default()).unwrap_or_default()
+    }
+
+    /// Registry with every provider that has credentials in `config` or the
+    /// environment, plus the local Ollama provider, which needs none and is
+    /// the default only when nothing else is configured. Fails only if
+    /// `default_provider` names a missing provider.
+    pub fn from_config(config: &LlmConfig) -> Result<Self, LlmError> {
+        let mut registry = Self::default();
+        let openai = config.openai.clone().unwrap_or_default();
+        if let Some(provider) = openai::OpenAiProvider::configured(&openai) {
+            registry.register(Arc::new(provider));
+        }
+        let anthropic = config.anthropic.clone().unwrap_or_default();
+        if let Some(provider) = anthropic::AnthropicProvider::configured(&anthropic) {
+            registry.register(Arc::new(provider));
+        }
+        let ollama = config.ollama.clone().unwrap_or_default();
+        registry.register(Arc::new(ollama::OllamaProvider::configured(&ollama)));
+        if let Some(name) = &config.default_provider {
+            registry.set_default(name)?;
+        }
+        Ok(registry)
+    }
+
+    pub fn register(&mut self, provider: Arc<dyn LlmProvider>) {
+        let name = provider.name().to_string();
+        if self.default.is_none() {
+            self.default = Some(name.clone());
+        }
+        self.providers.insert(name, provider);
+    }
+
+    pub fn set_default(&mut self, name: &str) -> Result<(), LlmError> {
+        if !self.providers.contains_key(name) {
+            return Err(LlmError::NotConfigured(format!(
+                "no provider named `{}`",
+                name
+            )));
+        }
+        self.default = Some(name.to_string());
+        Ok(())
+    }
+
+    /// The named provider, or the default one when `name` is `None`.
+    pub fn get(&self, name: Option<&str>) -> Result<Arc<dyn LlmProvider>, LlmError> {
+        let name = match name.or(self.default.as_deref()) {
+            Some(name) => name,
+            None => {
+                return Err(LlmError::NotConfigured(
+                    "register one or set OPENAI_API_KEY / ANTHROPIC_API_KEY".to_string(),
+                ))
+            }
+        };
+        self.providers
+            .get(name)
+            .cloned()
+            .ok_or_else(|| LlmError::NotConfigured(format!("no provider named `{}`", name)))
+    }
+
+    pub fn names(&self) -> Vec<String> {
+        let mut names: Vec<String> = self.providers.keys().cloned().collect();
+        names.sort();
+        names
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::context::AgentContext;
+    use crate::eval::eval;
+    use crate::lexer::Lexer;
+    use crate::parser::Parser;
+    use std::sync::Mutex;
+
+    struct Recorder {
+        seen: Mutex<Vec<LlmRequest>>,
+    }
+
+    impl LlmProvider for Recorder {
+        fn name(&self) -> &str {
+            "recorder"
+        }
+
+        fn complete(&self, request: &LlmRequest) -> Result<LlmResponse, LlmError> {
+            self.seen.lock().unwrap().push(request.clone());
+            Ok(LlmResponse {
+                text: format!("summary of [{}]", request.prompt),
+                model: "test".to_string(),
+                ..Default::default()
+            })
+        }
+    }
+
+    #[test]
+    fn ask_interpolates_prompt_and_stores_answer() {
+        let src = r#"ask "Summarize: {mem.short[\"msg\"]}" (model: "small", temperature: 0.2) -> mem.long["summary"]"#;
+        let mut lexer = Lexer::new(src);
+        let mut parser = Parser::new(&mut lexer);
+        let program = parser.parse_program();
+        assert_eq!(program.statements.len(), 1);
+
+        let recorder = Arc::new(Recorder {
+            seen: Mutex::new(Vec::new()),
+        });
+        let mut ctx = AgentContext::new();
+        ctx.llm.register(recorder.clone());
+        ctx.set_mem("short", "msg", "hello there");
+
+        let mut output = Vec::new();
+        eval(&program.statements[0], "", "", &mut ctx, &mut output).unwrap();
+
+        assert_eq!(
+            ctx.get_mem("long", "summary"),
+            "summary of [Summarize: hello there]"
+        );
+        assert_eq!(ctx.get_mem("long", USAGE_REQUESTS_KEY), "1");
+        let seen = recorder.seen.lock().unwrap();
+        assert_eq!(seen[0].model.as_deref(), Some("small"));
+        assert_eq!(seen[0].temperature, Some(0.2));
+    }
+
+    #[test]
+    fn ask_without_provider_is_an_error() {
+        let (provider, request) = LlmRequest::from_options("hi".to_string(), &[]).unwrap();
+        let registry = LlmRegistry::default();
+        assert!(provider.is_none());
+        assert!(matches!(
+            registry.get(None),
+            Err(LlmError::NotConfigured(_))
+        ));
+        assert_eq!(request.prompt, "hi");
+    }
+}
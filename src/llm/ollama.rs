@@ -0,0 +1,358 @@
+use crate::config::{env_or, OllamaConfig};
+use crate::llm::tools::ToolCall;
+use crate::llm::{LlmError, LlmProvider, LlmRequest, LlmResponse};
+use serde::Deserialize;
+use serde_json::json;
+use std::io::{BufRead, BufReader};
+use std::time::Duration;
+
+const DEFAULT_BASE_URL: &str = "http://localhost:11434";
+const DEFAULT_MODEL: &str = "llama3.2";
+const DEFAULT_TIMEOUT_SECS: u64 = 300;
+
+/// Local models served by Ollama, so `ask` works without network access.
+pub struct OllamaProvider {
+    base_url: String,
+    model: String,
+    client: reqwest::blocking::Client,
+}
+
+#[derive(Deserialize)]
+struct ChatChunk {
+    #[serde(default)]
+    model: String,
+    message: Option<ChatMessage>,
+    #[serde(default)]
+    done: bool,
+    prompt_eval_count: Option<u64>,
+    eval_count: Option<u64>,
+}
+
+#[derive(Deserialize)]
+struct ChatMessage {
+    #[serde(default)]
+    content: String,
+    #[serde(default)]
+    tool_calls: Vec<WireToolCall>,
+}
+
+#[derive(Deserialize)]
+struct WireToolCall {
+    function: WireFunction,
+}
+
+#[derive(Deserialize)]
+struct WireFunction {
+    name: String,
+    #[serde(default)]
+    arguments: serde_json::Value,
+}
+
+#[derive(Deserialize)]
+struct TagsResponse {
+    models: Vec<ModelTag>,
+}
+
+#[derive(Deserialize)]
+struct ModelTag {
+    name: String,
+}
+
+impl OllamaProvider {
+    pub fn new() -> Self {
+        Self::configured(&OllamaConfig::default())
+    }
+
+    /// Provider from the `llm.ollama` config section, `OLLAMA_HOST` and
+    /// `OLLAMA_MODEL`.
+    pub fn configured(config: &OllamaConfig) -> Self {
+        let mut base_url = env_or("OLLAMA_HOST", config.base_url.as_ref())
+            .unwrap_or_else(|| DEFAULT_BASE_URL.to_string());
+        if !base_url.starts_with("http://") && !base_url.starts_with("https://") {
+            base_url = format!("http://{}", base_url);
+        }
+        let timeout = config.timeout_secs.unwrap_or(DEFAULT_TIMEOUT_SECS);
+        Self {
+            base_url: base_url.trim_end_matches('/').to_string(),
+            model: env_or("OLLAMA_MODEL", config.model.as_ref())
+                .unwrap_or_else(|| DEFAULT_MODEL.to_string()),
+            client: reqwest::blocking::Client::builder()
+                .timeout(Duration::from_secs(timeout))
+                .build()
+                .expect("failed to build HTTP client"),
+        }
+    }
+
+    pub fn with_model(mut self, model: &str) -> Self {
+        self.model = model.to_string();
+        self
+    }
+
+    pub fn with_base_url(mut self, url: &str) -> Self {
+        self.base_url = url.trim_end_matches('/').to_string();
+        self
+    }
+
+    /// Check that the server is reachable and `model` (or the default) has
+    /// been pulled, with instructions for fixing either problem.
+    pub fn health(&self, model: Option<&str>) -> Result<(), LlmError> {
+        let model = model.unwrap_or(&self.model);
+        let response = self
+            .client
+            .get(format!("{}/api/tags", self.base_url))
+            .send()
+            .map_err(|e| self.unreachable(e))?;
+        let tags: TagsResponse = response
+            .json()
+            .map_err(|e| LlmError::Decode(e.to_string()))?;
+
+        let installed = tags
+            .models
+            .iter()
+            .any(|tag| tag.name == model || tag.name == format!("{}:latest", model));
+        if installed {
+            Ok(())
+        } else {
+            Err(missing_model(model))
+        }
+    }
+
+    fn unreachable(&self, e: reqwest::Error) -> LlmError {
+        LlmError::Unavailable(format!(
+            "cannot reach Ollama at {} ({}); start it with `ollama serve` or set OLLAMA_HOST",
+            self.base_url, e
+        ))
+    }
+
+    fn chat(
+        &self,
+        request: &LlmRequest,
+        stream: bool,
+    ) -> Result<(String, reqwest::blocking::Response), LlmError> {
+        let model = request.model.as_deref().unwrap_or(&self.model).to_string();
+        let mut options = json!({});
+        if let Some(temperature) = request.temperature {
+            options["temperature"] = json!(temperature);
+        }
+        if let Some(max_tokens) = request.max_tokens {
+            options["num_predict"] = json!(max_tokens);
+        }
+        let mut body = json!({
+            "model": model,
+            "messages": messages(request),
+            "stream": stream,
+            "options": options,
+        });
+        if !request.tools.is_empty() {
+            body["tools"] = request
+                .tools
+                .iter()
+                .map(|tool| {
+                    json!({
+                        "type": "function",
+                        "function": {
+                            "name": tool.name,
+                            "description": tool.description,
+                            "parameters": tool.parameters,
+                        },
+                    })
+                })
+                .collect();
+        }
+
+        let mut builder = self
+            .client
+            .post(format!("{}/api/chat", self.base_url))
+            .json(&body);
+        if let Some(timeout) = request.remaining() {
+            builder = builder.timeout(timeout);
+        }
+        let response = builder.send().map_err(|e| self.unreachable(e))?;
+
+        let status = response.status();
+        if status.as_u16() == 404 {
+            return Err(missing_model(&model));
+        }
+        if !status.is_success() {
+            return Err(LlmError::Api {
+                status: status.as_u16(),
+                message: response.text().unwrap_or_default(),
+            });
+        }
+        Ok((model, response))
+    }
+}
+
+impl Default for OllamaProvider {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+/// The prompt followed by each earlier tool round. Ollama has no call ids,
+/// so results are matched to calls by order.
+fn messages(request: &LlmRequest) -> Vec<serde_json::Value> {
+    let mut messages = vec![json!({ "role": "user", "content": request.prompt })];
+    for round in &request.rounds {
+        let calls: Vec<_> = round
+            .calls
+            .iter()
+            .map(|call| json!({ "function": { "name": call.name, "arguments": call.arguments } }))
+            .collect();
+        messages.push(json!({ "role": "assistant", "content": "", "tool_calls": calls }));
+        for result in &round.results {
+            messages.push(json!({ "role": "tool", "content": result }));
+        }
+    }
+    messages
+}
+
+fn missing_model(model: &str) -> LlmError {
+    LlmError::Unavailable(format!(
+        "Ollama model `{}` is not installed; download it with `ollama pull {}`",
+        model, model
+    ))
+}
+
+impl LlmProvider for OllamaProvider {
+    fn name(&self) -> &str {
+        "ollama"
+    }
+
+    fn complete(&self, request: &LlmRequest) -> Result<LlmResponse, LlmError> {
+        let (model, response) = self.chat(request, false)?;
+        let chunk: ChatChunk = response
+            .json()
+            .map_err(|e| LlmError::Decode(e.to_string()))?;
+        let (text, tool_calls) = match chunk.message {
+            Some(message) => (
+                message.content,
+                message
+                    .tool_calls
+                    .into_iter()
+                    .map(|call| ToolCall {
+                        id: String::new(),
+                        name: call.function.name,
+                        arguments: call.function.arguments,
+                    })
+                    .collect(),
+            ),
+            None => (String::new(), Vec::new()),
+        };
+        Ok(LlmResponse {
+            text,
+            model: if chunk.model.is_empty() {
+                model
+            } else {
+                chunk.model
+            },
+            input_tokens: chunk.prompt_eval_count,
+            output_tokens: chunk.eval_count,
+            tool_calls,
+        })
+    }
+
+    fn stream(
+        &self,
+        request: &LlmRequest,
+        on_delta: &mut dyn FnMut(&str),
+    ) -> Result<LlmResponse, LlmError> {
+        let (model, response) = self.chat(request, true)?;
+        let mut result = LlmResponse {
+            model,
+            ..Default::default()
+        };
+
+        // Ollama streams one JSON object per line.
+        for line in BufReader::new(response).lines() {
+            let line = line.map_err(|e| LlmError::Http(e.to_string()))?;
+            if line.trim().is_empty() {
+                continue;
+            }
+            let chunk: ChatChunk =
+                serde_json::from_str(&line).map_err(|e| LlmError::Decode(e.to_string()))?;
+            if let Some(message) = chunk.message {
+                if !message.content.is_empty() {
+                    on_delta(&message.content);
+                    result.text.push_str(&message.content);
+                }
+            }
+            if chunk.done {
+                result.input_tokens = chunk.prompt_eval_count;
+                result.output_tokens = chunk.eval_count;
+                break;
+            }
+        }
+        Ok(result)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::io::{Read, Write};
+    use std::net::TcpListener;
+    use std::thread;
+
+    /// Serve one HTTP response on a local port and return its base URL.
+    fn serve_once(status: &str, body: &'static str) -> String {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let url = format!("http://{}", listener.local_addr().unwrap());
+        let status = status.to_string();
+        thread::spawn(move || {
+            let (mut stream, _) = listener.accept().unwrap();
+            let mut buf = [0u8; 4096];
+            let _ = stream.read(&mut buf);
+            let response = format!(
+                "HTTP/1.1 {}\r\nContent-Type: application/json\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+                status,
+                body.len(),
+                body
+            );
+            stream.write_all(response.as_bytes()).unwrap();
+        });
+        url
+    }
+
+    fn request(model: Option<&str>) -> LlmRequest {
+        LlmRequest {
+            prompt: "hi".to_string(),
+            model: model.map(str::to_string),
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn completes_chat() {
+        let url = serve_once(
+            "200 OK",
+            r#"{"model":"llama3.2","message":{"role":"assistant","content":"hello"},"done":true,"prompt_eval_count":3,"eval_count":1}"#,
+        );
+        let provider = OllamaProvider::new().with_base_url(&url);
+        let response = provider.complete(&request(None)).unwrap();
+        assert_eq!(response.text, "hello");
+        assert_eq!(response.input_tokens, Some(3));
+        assert_eq!(response.output_tokens, Some(1));
+    }
+
+    #[test]
+    fn missing_model_suggests_pull() {
+        let url = serve_once("404 Not Found", r#"{"error":"model 'tiny' not found"}"#);
+        let provider = OllamaProvider::new().with_base_url(&url);
+        let err = provider.complete(&request(Some("tiny"))).unwrap_err();
+        assert!(err.to_string().contains("ollama pull tiny"), "{}", err);
+    }
+
+    #[test]
+    fn unreachable_server_suggests_serve() {
+        // Bind and drop to get a port nothing is listening on.
+        let port = TcpListener::bind("127.0.0.1:0")
+            .unwrap()
+            .local_addr()
+            .unwrap()
+            .port();
+        let provider = OllamaProvider::new().with_base_url(&format!("http://127.0.0.1:{}", port));
+        let err = provider.health(None).unwrap_err();
+        assert!(err.to_string().contains("ollama serve"), "{}", err);
+    }
+}
@@ -0,0 +1,315 @@
+use crate::config::{env_or, OpenAiConfig};
+use crate::llm::tools::ToolCall;
+use crate::llm::{LlmError, LlmProvider, LlmRequest, LlmResponse};
+use serde::Deserialize;
+use serde_json::json;
+use std::io::{BufRead, BufReader};
+use std::thread;
+use std::time::Duration;
+
+const DEFAULT_BASE_URL: &str = "https://api.openai.com/v1";
+const DEFAULT_MODEL: &str = "gpt-4o-mini";
+const DEFAULT_MAX_RETRIES: u32 = 3;
+const DEFAULT_TIMEOUT_SECS: u64 = 120;
+
+/// OpenAI chat completions provider with streaming and retries.
+///
+/// Also works with any server implementing the same API (vLLM, LiteLLM,
+/// Azure-compatible gateways) by pointing `base_url` at it.
+pub struct OpenAiProvider {
+    api_key: String,
+    base_url: String,
+    model: String,
+    organization: Option<String>,
+    max_retries: u32,
+    client: reqwest::blocking::Client,
+}
+
+#[derive(Deserialize)]
+struct ChatResponse {
+    model: String,
+    choices: Vec<Choice>,
+    usage: Option<Usage>,
+}
+
+#[derive(Deserialize)]
+struct Choice {
+    message: Option<Message>,
+    delta: Option<Message>,
+}
+
+#[derive(Deserialize)]
+struct Message {
+    content: Option<String>,
+    #[serde(default)]
+    tool_calls: Vec<WireToolCall>,
+}
+
+#[derive(Deserialize)]
+struct WireToolCall {
+    id: String,
+    function: WireFunction,
+}
+
+#[derive(Deserialize)]
+struct WireFunction {
+    name: String,
+    /// JSON-encoded argument object.
+    arguments: String,
+}
+
+#[derive(Deserialize)]
+struct Usage {
+    prompt_tokens: u64,
+    completion_tokens: u64,
+}
+
+#[derive(Deserialize)]
+struct StreamChunk {
+    #[serde(default)]
+    model: String,
+    #[serde(default)]
+    choices: Vec<Choice>,
+    usage: Option<Usage>,
+}
+
+impl OpenAiProvider {
+    pub fn new(api_key: &str) -> Self {
+        Self::from_config(api_key, &OpenAiConfig::default())
+    }
+
+    /// Provider from the `llm.openai` config section and `OPENAI_*`
+    /// environment variables, or `None` when no API key is available.
+    pub fn configured(config: &OpenAiConfig) -> Option<Self> {
+        let key = env_or("OPENAI_API_KEY", config.api_key.as_ref())?;
+        Some(Self::from_config(&key, config))
+    }
+
+    fn from_config(api_key: &str, config: &OpenAiConfig) -> Self {
+        let timeout = config.timeout_secs.unwrap_or(DEFAULT_TIMEOUT_SECS);
+        Self {
+            api_key: api_key.to_string(),
+            base_url: env_or("OPENAI_BASE_URL", config.base_url.as_ref())
+                .unwrap_or_else(|| DEFAULT_BASE_URL.to_string())
+                .trim_end_matches('/')
+                .to_string(),
+            model: env_or("OPENAI_MODEL", config.model.as_ref())
+                .unwrap_or_else(|| DEFAULT_MODEL.to_string()),
+            organization: config.organization.clone(),
+            max_retries: config.max_retries.unwrap_or(DEFAULT_MAX_RETRIES),
+            client: reqwest::blocking::Client::builder()
+                .timeout(Duration::from_secs(timeout))
+                .build()
+                .expect("failed to build HTTP client"),
+        }
+    }
+
+    pub fn with_model(mut self, model: &str) -> Self {
+        self.model = model.to_string();
+        self
+    }
+
+    pub fn with_base_url(mut self, url: &str) -> Self {
+        self.base_url = url.trim_end_matches('/').to_string();
+        self
+    }
+
+    fn body(&self, request: &LlmRequest, stream: bool) -> serde_json::Value {
+        let mut body = json!({
+            "model": request.model.as_deref().unwrap_or(&self.model),
+            "messages": messages(request),
+        });
+        if !request.tools.is_empty() {
+            body["tools"] = request
+                .tools
+                .iter()
+                .map(|tool| {
+                    json!({
+                        "type": "function",
+                        "function": {
+                            "name": tool.name,
+                            "description": tool.description,
+                            "parameters": tool.parameters,
+                        },
+                    })
+                })
+                .collect();
+        }
+        if let Some(temperature) = request.temperature {
+            body["temperature"] = json!(temperature);
+        }
+        if let Some(max_tokens) = request.max_tokens {
+            body["max_tokens"] = json!(max_tokens);
+        }
+        if stream {
+            body["stream"] = json!(true);
+            body["stream_options"] = json!({ "include_usage": true });
+        }
+        body
+    }
+
+    /// POST the request, retrying connection failures, rate limits and
+    /// server errors with exponential backoff.
+    fn send(
+        &self,
+        request: &LlmRequest,
+        body: &serde_json::Value,
+    ) -> Result<reqwest::blocking::Response, LlmError> {
+        let mut attempt = 0;
+        loop {
+            let mut builder = self
+                .client
+                .post(format!("{}/chat/completions", self.base_url))
+                .bearer_auth(&self.api_key)
+                .json(body);
+            if let Some(org) = &self.organization {
+                builder = builder.header("OpenAI-Organization", org);
+            }
+            if let Some(timeout) = request.remaining() {
+                builder = builder.timeout(timeout);
+            }
+
+            let (retry_after, error) = match builder.send() {
+                Ok(response) if response.status().is_success() => return Ok(response),
+                Ok(response) => {
+                    let status = response.status();
+                    let retry_after = response
+                        .headers()
+                        .get("retry-after")
+                        .and_then(|v| v.to_str().ok())
+                        .and_then(|v| v.parse::<u64>().ok())
+                        .map(Duration::from_secs);
+                    let error = LlmError::Api {
+                        status: status.as_u16(),
+                        message: response.text().unwrap_or_default(),
+                    };
+                    if status.as_u16() != 429 && !status.is_server_error() {
+                        return Err(error);
+                    }
+                    (retry_after, error)
+                }
+                Err(e) => (None, LlmError::Http(e.to_string())),
+            };
+
+            let backoff = Duration::from_millis(500 * 2u64.pow(attempt));
+            let wait = retry_after.unwrap_or(backoff);
+            let past_deadline = request.remaining().is_some_and(|left| left <= wait);
+            if attempt >= self.max_retries || past_deadline {
+                return Err(error);
+            }
+            thread::sleep(wait);
+            attempt += 1;
+        }
+    }
+}
+
+/// The prompt followed by each earlier tool round as an assistant
+/// `tool_calls` message and one `tool` message per result.
+fn messages(request: &LlmRequest) -> Vec<serde_json::Value> {
+    let mut messages = vec![json!({ "role": "user", "content": request.prompt })];
+    for round in &request.rounds {
+        let calls: Vec<_> = round
+            .calls
+            .iter()
+            .map(|call| {
+                json!({
+                    "id": call.id,
+                    "type": "function",
+                    "function": { "name": call.name, "arguments": call.arguments.to_string() },
+                })
+            })
+            .collect();
+        messages.push(json!({ "role": "assistant", "content": null, "tool_calls": calls }));
+        for (call, result) in round.calls.iter().zip(&round.results) {
+            messages.push(json!({ "role": "tool", "tool_call_id": call.id, "content": result }));
+        }
+    }
+    messages
+}
+
+impl LlmProvider for OpenAiProvider {
+    fn name(&self) -> &str {
+        "openai"
+    }
+
+    fn complete(&self, request: &LlmRequest) -> Result<LlmResponse, LlmError> {
+        let response = self.send(request, &self.body(request, false))?;
+        let parsed: ChatResponse = response
+            .json()
+            .map_err(|e| LlmError::Decode(e.to_string()))?;
+
+        let message = parsed
+            .choices
+            .into_iter()
+            .next()
+            .and_then(|choice| choice.message)
+            .ok_or_else(|| LlmError::Decode("response has no message".to_string()))?;
+        let tool_calls = message
+            .tool_calls
+            .into_iter()
+            .map(|call| {
+                let arguments = serde_json::from_str(&call.function.arguments)
+                    .map_err(|e| LlmError::Decode(format!("tool arguments: {}", e)))?;
+                Ok(ToolCall {
+                    id: call.id,
+                    name: call.function.name,
+                    arguments,
+                })
+            })
+            .collect::<Result<Vec<_>, LlmError>>()?;
+        let text = match message.content {
+            Some(text) => text,
+            None if !tool_calls.is_empty() => String::new(),
+            None => {
+                return Err(LlmError::Decode(
+                    "response has no message content".to_string(),
+                ))
+            }
+        };
+
+        Ok(LlmResponse {
+            text,
+            model: parsed.model,
+            input_tokens: parsed.usage.as_ref().map(|u| u.prompt_tokens),
+            output_tokens: parsed.usage.as_ref().map(|u| u.completion_tokens),
+            tool_calls,
+        })
+    }
+
+    fn stream(
+        &self,
+        request: &LlmRequest,
+        on_delta: &mut dyn FnMut(&str),
+    ) -> Result<LlmResponse, LlmError> {
+        let response = self.send(request, &self.body(request, true))?;
+        let mut result = LlmResponse::default();
+
+        for line in BufReader::new(response).lines() {
+            let line = line.map_err(|e| LlmError::Http(e.to_string()))?;
+            let data = match line.strip_prefix("data:") {
+                Some(data) => data.trim(),
+                None => continue,
+            };
+            if data == "[DONE]" {
+                break;
+            }
+
+            let chunk: StreamChunk =
+                serde_json::from_str(data).map_err(|e| LlmError::Decode(e.to_string()))?;
+            if !chunk.model.is_empty() {
+                result.model = chunk.model;
+            }
+            if let Some(usage) = chunk.usage {
+                result.input_tokens = Some(usage.prompt_tokens);
+                result.output_tokens = Some(usage.completion_tokens);
+            }
+            for choice in chunk.choices {
+                if let Some(delta) = choice.delta.and_then(|d| d.content) {
+                    on_delta(&delta);
+                    result.text.push_str(&delta);
+                }
+            }
+        }
+        Ok(result)
+    }
+}
@@ -0,0 +1,281 @@
+use crate::context::AgentContext;
+use crate::llm::{LlmError, LlmProvider, LlmRequest, LlmResponse};
+use serde_json::{json, Value};
+
+/// Upper bound on tool-call round trips within a single `ask`, so a model
+/// that keeps calling tools cannot loop forever.
+pub const MAX_TOOL_ROUNDS: usize = 8;
+
+/// Entries returned by `memory_recall` when the model gives no limit.
+const DEFAULT_RECALL_LIMIT: usize = 5;
+
+/// A function the model may call, described by a JSON Schema.
+#[derive(Clone, Debug, PartialEq)]
+pub struct ToolDefinition {
+    pub name: String,
+    pub description: String,
+    pub parameters: Value,
+}
+
+/// A call requested by the model. `id` is empty for providers that do not
+/// assign call ids.
+#[derive(Clone, Debug, Default, PartialEq)]
+pub struct ToolCall {
+    pub id: String,
+    pub name: String,
+    pub arguments: Value,
+}
+
+/// One round trip: the calls the model made and the result of each, in the
+/// same order. Providers replay these so the model sees its own calls.
+#[derive(Clone, Debug, PartialEq)]
+pub struct ToolRound {
+    pub calls: Vec<ToolCall>,
+    pub results: Vec<String>,
+}
+
+/// Tool set selected by the `tools` option of `ask`: `"memory"` allows
+/// reading, recalling and writing; `"memory.read"` only the first two.
+pub fn definitions(selection: &str) -> Option<Vec<ToolDefinition>> {
+    let mut tools = vec![memory_read(), memory_recall()];
+    match selection {
+        "memory" => tools.push(memory_write()),
+        "memory.read" => {}
+        _ => return None,
+    }
+    Some(tools)
+}
+
+fn region_schema() -> Value {
+    json!({ "type": "string", "enum": ["short", "long"] })
+}
+
+fn memory_read() -> ToolDefinition {
+    ToolDefinition {
+        name: "memory_read".to_string(),
+        description: "Read one value from the agent's memory.".to_string(),
+        parameters: json!({
+            "type": "object",
+            "properties": { "region": region_schema(), "key": { "type": "string" } },
+            "required": ["region", "key"],
+        }),
+    }
+}
+
+fn memory_recall() -> ToolDefinition {
+    ToolDefinition {
+        name: "memory_recall".to_string(),
+        description: "Search the agent's memory for entries whose key or value contains the \
+                      query (case-insensitive)."
+            .to_string(),
+        parameters: json!({
+            "type": "object",
+            "properties": {
+                "query": { "type": "string" },
+                "region": region_schema(),
+                "limit": { "type": "integer", "minimum": 1 },
+            },
+            "required": ["query"],
+        }),
+    }
+}
+
+fn memory_write() -> ToolDefinition {
+    ToolDefinition {
+        name: "memory_write".to_string(),
+        description: "Store a value in the agent's memory.".to_string(),
+        parameters: json!({
+            "type": "object",
+            "properties": {
+                "region": region_schema(),
+                "key": { "type": "string" },
+                "value": { "type": "string" },
+            },
+            "required": ["region", "key", "value"],
+        }),
+    }
+}
+
+/// Run a tool call against `ctx`. Failures are reported back to the model
+/// as text rather than aborting the `ask`, so it can correct itself.
+pub fn execute(ctx: &mut AgentContext, call: &ToolCall) -> String {
+    let arg = |name: &str| call.arguments.get(name).and_then(Value::as_str);
+
+    match call.name.as_str() {
+        "memory_read" => match (arg("region"), arg("key")) {
+            (Some(region), Some(key)) => match ctx.try_get_mem(region, key) {
+                Ok(value) if value.is_empty() => format!("{} is not set", key),
+                Ok(value) => value,
+                Err(e) => format!("error: {}", e),
+            },
+            _ => "error: region and key are required".to_string(),
+        },
+        "memory_recall" => {
+            let Some(query) = arg("query") else {
+                return "error: query is required".to_string();
+            };
+            let limit = call
+                .arguments
+                .get("limit")
+                .and_then(Value::as_u64)
+                .map(|n| n as usize)
+                .unwrap_or(DEFAULT_RECALL_LIMIT);
+            match ctx.recall(query, arg("region"), limit) {
+                Ok(matches) => Value::Array(
+                    matches
+                        .into_iter()
+                        .map(|m| json!({ "region": m.region, "key": m.key, "value": m.value }))
+                        .collect(),
+                )
+                .to_string(),
+                Err(e) => format!("error: {}", e),
+            }
+        }
+        "memory_write" => match (arg("region"), arg("key"), arg("value")) {
+            (Some(region), Some(key), Some(value)) => match ctx.try_set_mem(region, key, value) {
+                Ok(()) => "ok".to_string(),
+                Err(e) => format!("error: {}", e),
+            },
+            _ => "error: region, key and value are required".to_string(),
+        },
+        other => format!("error: unknown tool `{}`", other),
+    }
+}
+
+/// Complete `request`, executing any tool calls against `ctx` and feeding
+/// the results back until the model answers with text. Token counts in the
+/// returned response cover every round.
+pub fn complete(
+    provider: &dyn LlmProvider,
+    mut request: LlmRequest,
+    ctx: &mut AgentContext,
+) -> Result<LlmResponse, LlmError> {
+    let mut input_tokens = None;
+    let mut output_tokens = None;
+    let add = |total: &mut Option<u64>, n: Option<u64>| {
+        if let Some(n) = n {
+            *total = Some(total.unwrap_or(0) + n);
+        }
+    };
+
+    for _ in 0..=MAX_TOOL_ROUNDS {
+        let mut response = {
+            let _span = tracing::info_span!("llm.complete", provider = provider.name()).entered();
+            provider.complete(&request)?
+        };
+        add(&mut input_tokens, response.input_tokens);
+        add(&mut output_tokens, response.output_tokens);
+
+        if response.tool_calls.is_empty() || request.tools.is_empty() {
+            response.input_tokens = input_tokens;
+            response.output_tokens = output_tokens;
+            return Ok(response);
+        }
+
+        let calls = std::mem::take(&mut response.tool_calls);
+        let results = calls
+            .iter()
+            .map(|call| {
+                if request.tools.iter().any(|tool| tool.name == call.name) {
+                    execute(ctx, call)
+                } else {
+                    format!("error: tool `{}` is not available", call.name)
+                }
+            })
+            .collect();
+        request.rounds.push(ToolRound { calls, results });
+    }
+
+    Err(LlmError::Decode(format!(
+        "model still calling tools after {} rounds",
+        MAX_TOOL_ROUNDS
+    )))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::Mutex;
+
+    /// Calls `memory_recall` on the first request, then answers with the
+    /// tool result it was given.
+    struct Grounded {
+        seen: Mutex<Vec<LlmRequest>>,
+    }
+
+    impl LlmProvider for Grounded {
+        fn name(&self) -> &str {
+            "grounded"
+        }
+
+        fn complete(&self, request: &LlmRequest) -> Result<LlmResponse, LlmError> {
+            self.seen.lock().unwrap().push(request.clone());
+            let response = match request.rounds.last() {
+                None => LlmResponse {
+                    tool_calls: vec![ToolCall {
+                        id: "call_1".to_string(),
+                        name: "memory_recall".to_string(),
+                        arguments: json!({ "query": "COLOR" }),
+                    }],
+                    input_tokens: Some(10),
+                    ..Default::default()
+                },
+                Some(round) => LlmResponse {
+                    text: format!("from memory: {}", round.results[0]),
+                    input_tokens: Some(20),
+                    ..Default::default()
+                },
+            };
+            Ok(response)
+        }
+    }
+
+    #[test]
+    fn answers_with_recalled_memory() {
+        let mut ctx = AgentContext::new();
+        ctx.set_mem("long", "favorite_color", "teal");
+        ctx.set_mem("short", "mood", "calm");
+
+        let provider = Grounded {
+            seen: Mutex::new(Vec::new()),
+        };
+        let request = LlmRequest {
+            prompt: "What color do I like?".to_string(),
+            tools: definitions("memory.read").unwrap(),
+            ..Default::default()
+        };
+        let response = complete(&provider, request, &mut ctx).unwrap();
+
+        assert_eq!(
+            response.text,
+            r#"from memory: [{"key":"favorite_color","region":"long","value":"teal"}]"#
+        );
+        assert_eq!(response.input_tokens, Some(30));
+        assert_eq!(provider.seen.lock().unwrap().len(), 2);
+    }
+
+    #[test]
+    fn selects_tools_and_reports_bad_calls() {
+        let names: Vec<_> = definitions("memory.read")
+            .unwrap()
+            .into_iter()
+            .map(|t| t.name)
+            .collect();
+        assert_eq!(names, ["memory_read", "memory_recall"]);
+        assert!(definitions("everything").is_none());
+
+        let mut ctx = AgentContext::new();
+        let write = ToolCall {
+            name: "memory_write".to_string(),
+            arguments: json!({ "region": "short", "key": "k", "value": "v" }),
+            ..Default::default()
+        };
+        assert_eq!(execute(&mut ctx, &write), "ok");
+        let bad = ToolCall {
+            name: "memory_read".to_string(),
+            arguments: json!({ "region": "mid", "key": "k" }),
+            ..Default::default()
+        };
+        assert!(execute(&mut ctx, &bad).starts_with("error:"));
+    }
+}
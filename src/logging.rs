@@ -0,0 +1,379 @@
+//! Log output for the CLI: one line per `tracing` event on stderr, either
+//! human-readable or as JSON for Loki, ELK and similar collectors. The
+//! level can be changed while running, e.g. with the REPL's `.log debug`.
+
+use crate::config::TelemetryConfig;
+use crate::profile::ProfileLayer;
+use crate::telemetry::{self, TelemetryGuard};
+use serde_json::{Map, Value};
+use std::io::Write;
+use std::str::FromStr;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::{Arc, Mutex, OnceLock};
+use std::time::{SystemTime, UNIX_EPOCH};
+use tracing::field::{Field, Visit};
+use tracing::span::{Attributes, Id, Record};
+use tracing::{Event, Level, Subscriber};
+use tracing_subscriber::layer::{Context, Layer};
+use tracing_subscriber::prelude::*;
+use tracing_subscriber::registry::LookupSpan;
+
+/// Variable selecting the most verbose level logged (`error` to `trace`).
+pub const LEVEL_ENV: &str = "SENTIENCE_LOG";
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum LogFormat {
+    Text,
+    Json,
+}
+
+impl FromStr for LogFormat {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, String> {
+        match s {
+            "text" => Ok(LogFormat::Text),
+            "json" => Ok(LogFormat::Json),
+            other => Err(format!(
+                "unknown log format `{}` (expected text or json)",
+                other
+            )),
+        }
+    }
+}
+
+/// Install the global subscriber: a log layer when `format` is given, the
+/// OTLP exporter when telemetry is configured, and `profile` if given.
+/// Returns the exporter's guard, if any.
+pub fn init(
+    format: Option<LogFormat>,
+    level: Level,
+    telemetry: &TelemetryConfig,
+    profile: Option<ProfileLayer>,
+) -> Result<Option<TelemetryGuard>, String> {
+    let (otlp, guard) = match telemetry::layer(telemetry) {
+        Some((layer, guard)) => (Some(layer), Some(guard)),
+        None => (None, None),
+    };
+    if otlp.is_none() && format.is_none() && profile.is_none() {
+        return Ok(None);
+    }
+    let log = format.map(|format| LogLayer::new(format, level, std::io::stderr()));
+    if let Some(log) = &log {
+        let _ = ACTIVE.set(log.level());
+    }
+    tracing_subscriber::registry()
+        .with(otlp)
+        .with(log)
+        .with(profile)
+        .try_init()
+        .map_err(|e| e.to_string())?;
+    Ok(guard)
+}
+
+/// Parse a level name as accepted in [`LEVEL_ENV`].
+pub fn parse_level(name: &str) -> Result<Level, String> {
+    Level::from_str(name).map_err(|_| format!("unknown log level `{}`", name))
+}
+
+/// Levels from least to most verbose, indexed by [`LevelHandle`].
+const LEVELS: [Level; 5] = [
+    Level::ERROR,
+    Level::WARN,
+    Level::INFO,
+    Level::DEBUG,
+    Level::TRACE,
+];
+
+/// The most verbose level a [`LogLayer`] writes, shared so it can be
+/// changed after the layer is installed.
+#[derive(Clone, Debug)]
+pub struct LevelHandle(Arc<AtomicUsize>);
+
+impl LevelHandle {
+    fn new(level: Level) -> Self {
+        let handle = Self(Arc::new(AtomicUsize::new(0)));
+        handle.set(level);
+        handle
+    }
+
+    pub fn get(&self) -> Level {
+        LEVELS[self.0.load(Ordering::Relaxed)]
+    }
+
+    pub fn set(&self, level: Level) {
+        let index = LEVELS.iter().position(|l| *l == level).unwrap_or(2);
+        self.0.store(index, Ordering::Relaxed);
+    }
+}
+
+/// The level of the layer [`init`] installed, if it installed one.
+static ACTIVE: OnceLock<LevelHandle> = OnceLock::new();
+
+/// The level log output is written at, or `None` if there is no log
+/// output.
+pub fn level() -> Option<Level> {
+    ACTIVE.get().map(LevelHandle::get)
+}
+
+/// Write log output at `level` from now on. Fails if there is no log output
+/// to change, as when neither `--log-level` nor `--log-format` was given.
+pub fn set_level(level: Level) -> Result<(), String> {
+    let active = ACTIVE
+        .get()
+        .ok_or("logging is off; start with --log-level to turn it on")?;
+    active.set(level);
+    Ok(())
+}
+
+/// Writes each event with the fields of its enclosing spans, so a line
+/// logged while evaluating a statement carries `agent` and `statement`.
+pub struct LogLayer<W> {
+    format: LogFormat,
+    level: LevelHandle,
+    writer: Mutex<W>,
+}
+
+impl<W: Write> LogLayer<W> {
+    pub fn new(format: LogFormat, level: Level, writer: W) -> Self {
+        Self {
+            format,
+            level: LevelHandle::new(level),
+            writer: Mutex::new(writer),
+        }
+    }
+
+    /// Handle to change the level of this layer once it is installed.
+    pub fn level(&self) -> LevelHandle {
+        self.level.clone()
+    }
+}
+
+/// Span fields, kept in the registry's extensions for events inside it.
+struct SpanFields(Vec<(String, Value)>);
+
+impl<S, W> Layer<S> for LogLayer<W>
+where
+    S: Subscriber + for<'a> LookupSpan<'a>,
+    W: Write + 'static,
+{
+    fn on_new_span(&self, attrs: &Attributes<'_>, id: &Id, ctx: Context<'_, S>) {
+        if let Some(span) = ctx.span(id) {
+            let mut fields = Vec::new();
+            attrs.record(&mut JsonVisitor(&mut fields));
+            span.extensions_mut().insert(SpanFields(fields));
+        }
+    }
+
+    fn on_record(&self, id: &Id, values: &Record<'_>, ctx: Context<'_, S>) {
+        if let Some(span) = ctx.span(id) {
+            let mut extensions = span.extensions_mut();
+            if let Some(SpanFields(fields)) = extensions.get_mut::<SpanFields>() {
+                values.record(&mut JsonVisitor(fields));
+            }
+        }
+    }
+
+    fn on_event(&self, event: &Event<'_>, ctx: Context<'_, S>) {
+        let metadata = event.metadata();
+        if *metadata.level() > self.level.get() {
+            return;
+        }
+
+        // Outer spans first, so inner spans and the event itself win.
+        let mut fields = Map::new();
+        if let Some(scope) = ctx.event_scope(event) {
+            for span in scope.from_root() {
+                if let Some(SpanFields(span_fields)) = span.extensions().get::<SpanFields>() {
+                    for (name, value) in span_fields {
+                        fields.insert(name.clone(), value.clone());
+                    }
+                }
+            }
+        }
+        let mut event_fields = Vec::new();
+        event.record(&mut JsonVisitor(&mut event_fields));
+        fields.extend(event_fields);
+        let message = match fields.remove("message") {
+            Some(Value::String(s)) => s,
+            Some(other) => other.to_string(),
+            None => String::new(),
+        };
+        let component = metadata
+            .target()
+            .rsplit("::")
+            .next()
+            .unwrap_or_default()
+            .to_string();
+
+        let line = match self.format {
+            LogFormat::Json => {
+                let mut record = Map::new();
+                record.insert("timestamp".to_string(), timestamp().into());
+                record.insert("level".to_string(), metadata.level().as_str().into());
+                record.insert("component".to_string(), component.into());
+                record.insert("message".to_string(), message.into());
+                record.extend(fields);
+                Value::Object(record).to_string()
+            }
+            LogFormat::Text => {
+                let mut line = format!(
+                    "{} {:>5} {}: {}",
+                    timestamp(),
+                    metadata.level(),
+                    component,
+                    message
+                );
+                for (name, value) in fields {
+                    match value {
+                        Value::String(s) => line.push_str(&format!(" {}={}", name, s)),
+                        other => line.push_str(&format!(" {}={}", name, other)),
+                    }
+                }
+                line
+            }
+        };
+        if let Ok(mut writer) = self.writer.lock() {
+            let _ = writeln!(writer, "{}", line);
+        }
+    }
+}
+
+struct JsonVisitor<'a>(&'a mut Vec<(String, Value)>);
+
+impl Visit for JsonVisitor<'_> {
+    fn record_str(&mut self, field: &Field, value: &str) {
+        self.0.push((field.name().to_string(), value.into()));
+    }
+
+    fn record_u64(&mut self, field: &Field, value: u64) {
+        self.0.push((field.name().to_string(), value.into()));
+    }
+
+    fn record_i64(&mut self, field: &Field, value: i64) {
+        self.0.push((field.name().to_string(), value.into()));
+    }
+
+    fn record_f64(&mut self, field: &Field, value: f64) {
+        self.0.push((field.name().to_string(), value.into()));
+    }
+
+    fn record_bool(&mut self, field: &Field, value: bool) {
+        self.0.push((field.name().to_string(), value.into()));
+    }
+
+    fn record_debug(&mut self, field: &Field, value: &dyn std::fmt::Debug) {
+        self.0
+            .push((field.name().to_string(), format!("{:?}", value).into()));
+    }
+}
+
+/// The current time as RFC 3339 in UTC with millisecond precision.
+pub(crate) fn timestamp() -> String {
+    format_timestamp(unix_millis())
+}
+
+/// Milliseconds since the Unix epoch now, or 0 if the clock is before it.
+pub(crate) fn unix_millis() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_millis() as u64)
+        .unwrap_or(0)
+}
+
+/// `millis` since the Unix epoch as RFC 3339 in UTC.
+pub(crate) fn format_timestamp(millis: u64) -> String {
+    let secs = millis / 1000;
+    let (year, month, day) = crate::schedule::civil_from_days((secs / 86_400) as i64);
+    let rem = secs % 86_400;
+    format!(
+        "{:04}-{:02}-{:02}T{:02}:{:02}:{:02}.{:03}Z",
+        year,
+        month,
+        day,
+        rem / 3600,
+        rem % 3600 / 60,
+        rem % 60,
+        millis % 1000
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::Arc;
+
+    /// A writer tests can read back after the layer is dropped.
+    #[derive(Clone, Default)]
+    struct Buffer(Arc<Mutex<Vec<u8>>>);
+
+    impl Write for Buffer {
+        fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+            self.0.lock().unwrap().extend_from_slice(buf);
+            Ok(buf.len())
+        }
+
+        fn flush(&mut self) -> std::io::Result<()> {
+            Ok(())
+        }
+    }
+
+    #[test]
+    fn writes_json_lines_with_span_fields() {
+        let buffer = Buffer::default();
+        let layer = LogLayer::new(LogFormat::Json, Level::DEBUG, buffer.clone());
+        tracing::subscriber::with_default(tracing_subscriber::registry().with(layer), || {
+            let mut agent = crate::SentienceAgent::new();
+            agent
+                .run_sentience(r#"agent Greeter { on input(msg) { print "hi" } }"#)
+                .unwrap();
+            agent.handle_input("hello").unwrap();
+        });
+
+        let output = String::from_utf8(buffer.0.lock().unwrap().clone()).unwrap();
+        let lines: Vec<Value> = output
+            .lines()
+            .map(|line| serde_json::from_str(line).unwrap())
+            .collect();
+        let print = lines
+            .iter()
+            .find(|l| l["statement"] == "print" && l["agent"] == "Greeter")
+            .expect("statement line");
+        assert_eq!(print["level"], "DEBUG");
+        assert_eq!(print["component"], "eval");
+        assert!(print["duration_us"].is_u64());
+        let finished = lines
+            .iter()
+            .find(|l| l["message"] == "handler finished")
+            .expect("handler line");
+        assert_eq!(finished["kind"], "input");
+        assert!(finished["duration_ms"].is_u64());
+        assert!(finished["timestamp"].as_str().unwrap().ends_with('Z'));
+    }
+
+    #[test]
+    fn follows_level_changes() {
+        let buffer = Buffer::default();
+        let layer = LogLayer::new(LogFormat::Text, Level::INFO, buffer.clone());
+        let level = layer.level();
+        tracing::subscriber::with_default(tracing_subscriber::registry().with(layer), || {
+            tracing::debug!("hidden");
+            level.set(Level::DEBUG);
+            tracing::debug!("shown");
+            level.set(Level::ERROR);
+            tracing::info!("hidden");
+        });
+
+        let output = String::from_utf8(buffer.0.lock().unwrap().clone()).unwrap();
+        assert_eq!(output.lines().count(), 1, "{}", output);
+        assert!(output.contains("DEBUG tests: shown"), "{}", output);
+        assert_eq!(level.get(), Level::ERROR);
+    }
+
+    #[test]
+    fn parses_formats_and_levels() {
+        assert_eq!("json".parse::<LogFormat>(), Ok(LogFormat::Json));
+        assert!("xml".parse::<LogFormat>().is_err());
+        assert_eq!(parse_level("warn"), Ok(Level::WARN));
+    }
+}
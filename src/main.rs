@@ -1,127 +1,1992 @@
-mod context;
-mod eval;
-mod lexer;
-mod parser;
-mod types;
+use sentience_core::adapters::chat::ChatMessage;
+use sentience_core::adapters::discord::{DiscordAdapter, DiscordOptions};
+use sentience_core::adapters::kafka::{KafkaAdapter, KafkaOptions};
+use sentience_core::adapters::mqtt::{MqttOptions, MqttSource};
+use sentience_core::adapters::nats::{self, NatsOptions, NatsTransport};
+use sentience_core::adapters::slack::{self, SlackAdapter, SlackEvent, SlackOptions};
+use sentience_core::adapters::speech::{self, PcmFormat};
+use sentience_core::adapters::InputMessage;
+use sentience_core::affect::Affect;
+use sentience_core::analyze::{self, Diagnostic, Severity};
+use sentience_core::compiled::{compile_file, load_file};
+use sentience_core::config::{Config, TenantConfig};
+use sentience_core::context::AgentContext;
+use sentience_core::dap;
+use sentience_core::dream;
+use sentience_core::embedded;
+use sentience_core::error::{ParseError, ParseErrorKind};
+use sentience_core::ingest;
+use sentience_core::jupyter::{self, ConnectionInfo, Kernel};
+use sentience_core::lang::{self, Version};
+use sentience_core::lexer::Lexer;
+use sentience_core::limits::{self, Limits};
+use sentience_core::llm::embedding::{self, Embedder};
+use sentience_core::llm::LlmRegistry;
+use sentience_core::logging::{self, LogFormat};
+use sentience_core::notebook::Notebook;
+use sentience_core::packages::{GitHub, Packages};
+use sentience_core::paged;
+use sentience_core::parallel::{self, AgentSet};
+use sentience_core::parser::Parser;
+use sentience_core::profile::{ProfileGuard, ProfileLayer};
+use sentience_core::recall::MemoryIndex;
+use sentience_core::recording::{self, Recorder, Replayed, Turn};
+use sentience_core::replkit::Repl;
+use sentience_core::sandbox::Sandbox;
+use sentience_core::sse::EventHub;
+use sentience_core::store::{FileStore, MemoryStore};
+use sentience_core::supervisor::{self, RestartPolicy, Supervisor};
+use sentience_core::sync::MemorySync;
+use sentience_core::telemetry::TelemetryGuard;
+use sentience_core::tenants::{self, Tenant, Tenants};
+use sentience_core::types::{Program, Statement};
+use sentience_core::webhooks::Webhooks;
+use sentience_core::SentienceAgent;
+use sentience_core::{
+    api, dashboard, goals, graph, httpd, introspect, lint, metrics, testing, typecheck,
+};
+use std::env;
+use std::fmt;
+use std::io;
+use std::net::TcpListener;
+use std::panic::{self, AssertUnwindSafe};
+use std::path::{Path, PathBuf};
+use std::process;
+use std::sync::atomic::AtomicBool;
+use std::sync::atomic::Ordering;
+use std::sync::{mpsc, Arc, Mutex};
+use std::thread;
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+use tracing::Level;
 
-use context::AgentContext;
-use eval::eval;
-use lexer::Lexer;
-use parser::Parser;
-use std::io::{self, BufRead, Write};
-use types::Statement;
+const USAGE: &str = "usage:
+  sentience-repl [options]    start the interactive REPL
+  sentience-repl compile <file.sent> [-o <file.sentc>]
+  sentience-repl run <file.sent|file.sentc> [--input <text>]
+                 run the program; with --input, pass <text> to the agent's
+                 `on input` and print only what it emits
+  sentience-repl check <file.sent> [--types] [--lint] [--json] [--allow <codes>]
+                 report errors and likely mistakes without running; --types also
+                 checks option values and `{...}` placeholders, --lint adds style warnings,
+                 --json prints them as JSON and --allow SEN2005,... leaves those codes out
+  sentience-repl test <file.sent>... [--coverage]
+                 compare each program's answers with the transcript in <file>.golden;
+                 --coverage prints the source annotated with how often each statement ran
+  sentience-repl serve <file> [--http <addr>] [--events <addr>] [--watch]
+                 run `on schedule` and `every` handlers until stopped, answering the
+                 HTTP API at --http and streaming agent activity as server-sent events
+                 at --events; reloads the agents' handlers, keeping memory, on SIGHUP
+                 or, with --watch, when <file> changes
+  sentience-repl replay <log.jsonl> --against <file> [--agent <name>]
+                 send the inputs recorded with --record to the agent of <file> and
+                 report each turn it answers or changes memory differently; --agent
+                 picks the recorded agent to replay (default: the one <file> declares)
+  sentience-repl graph <memory.json> [--program <file>] [--similar <n>] [-o <file.dot>]
+                 render saved memory and its links as a Graphviz graph, with the agents
+                 and goals of <file> and the <n> most similar pairs of entries
+  sentience-repl goals <memory.json>...
+                 show the goal progress saved in each memory file, oldest first,
+                 and how much it changed
+  sentience-repl dream <memory.json> [--threshold <0-1>] [--min-uses <n>] [-o <file>]
+                 consolidate saved short-term memory: move entries on a recurring theme
+                 to long-term memory and drop the rest, saving in place unless -o is given
+  sentience-repl ingest <dir|file>... --into <memory.json> [--collection <name>] [--chunk-size <n>]
+                 chunk the text, Markdown and PDF files given into long-term memory under
+                 <name>/<path>#<n> (default collection: docs), creating <memory.json> if
+                 needed and pushing the chunks to the vector store when sync is configured
+  sentience-repl notebook <doc.md> [-o <file.md>]
+                 run the ```sentience blocks of a Markdown document in order in one
+                 context and write it with each block's output after it (default:
+                 <doc>.out.md); fails if a block reports an error
+  sentience-repl get [github.com/<owner>/<repo>[/<path>][@<version>]]...
+                 fetch modules for `import` into the module cache and pin them in
+                 sentience.lock; without modules, fetch what sentience.lock pins
+  sentience-repl openapi    print the OpenAPI document for the HTTP API
+  sentience-repl rpc <file>      answer JSON-RPC requests on stdin/stdout
+  sentience-repl mcp <file>      serve the agent's memory to MCP clients on stdin/stdout
+  sentience-repl jupyter <connection-file>    run as a Jupyter kernel
+  sentience-repl jupyter --install    register the kernel with Jupyter
+  sentience-repl dap [--port <n>]    debug adapter on stdin/stdout, or one client on 127.0.0.1:<n>
+  sentience-repl mqtt <file> --broker <host[:port]> --topic <filter>... [--qos 0|1]
+                 [--client-id <id>] [--username <user> --password <pass>]
+  sentience-repl kafka <file> --rest-proxy <url> --group <id> --topic <name>...
+                 [--output-topic <name>] [--from-beginning]
+  sentience-repl nats <file> [--server <host[:port]>] [--prefix <p>] [--follow <agent>]...
+                 [--user <user> --password <pass> | --token <token>]
+                 exchange messages and events with agents in other processes
+  sentience-repl slack <file> --listen <addr>    answer Slack Events API messages
+  sentience-repl discord <file> [--channel <id>]...    answer messages in Discord channels
+  sentience-repl speech <file> --audio <path>...    transcribe audio files as input
+  sentience-repl speech <file> --stdin [--sample-rate <hz>] [--chunk-secs <n>]
+                 transcribe raw 16-bit PCM from stdin, e.g. `arecord -f S16_LE -r 16000 -t raw`
 
-fn print_prompt() {
-    print!(">>> ");
-    io::stdout().flush().unwrap();
-}
+options:
+  --config <file.json>   configuration file (default: ./sentience.json)
+  --metrics <addr>       serve Prometheus metrics at /metrics (serve, mqtt, kafka)
+  --log-format <fmt>     log to stderr as `text` or `json` (default text)
+  --log-level <level>    most verbose level logged: `error` to `trace` (or SENTIENCE_LOG)
+  --profile <file.json>  write a Chrome trace of parsing, handlers and statements on exit
+  --record <file.jsonl>  append each input agents handle, their answers and memory changes
+  --store <file.jsonl>   keep long-term memory in <file>, written as it changes
+  --allow-net            let `fetch` make network requests
+  --allow-exec           let `exec` run commands listed in sandbox.exec_allowlist
+  --workspace <dir>      let `read` and `write` access files under <dir>
+  --timeout <secs>       stop a handler that runs longer than <secs>
+  --lang <version>       read programs without a `lang` pragma as <version> (default: 0.1)";
 
 fn main() {
+    let mut args: Vec<String> = env::args().skip(1).collect();
+    let config = match load_config(&mut args) {
+        Ok(config) => config,
+        Err(e) => {
+            eprintln!("error: {}", e);
+            process::exit(1);
+        }
+    };
+    let guards = match init_logging(&mut args, &config) {
+        Ok(guards) => guards,
+        Err(e) => {
+            eprintln!("error: {}", e);
+            process::exit(1);
+        }
+    };
+
+    let result = match args.first().map(String::as_str) {
+        None => repl(&config),
+        Some("compile") => compile(&args[1..]),
+        Some("run") => run(args.split_off(1), &config),
+        Some("check") => check(args.split_off(1)),
+        Some("test") => test(args.split_off(1), &config),
+        Some("serve") => serve(args.split_off(1), &config),
+        Some("replay") => replay(args.split_off(1), &config),
+        Some("graph") => graph(args.split_off(1)),
+        Some("goals") => goals(args.split_off(1)),
+        Some("dream") => dream(args.split_off(1)),
+        Some("ingest") => ingest(args.split_off(1), &config),
+        Some("notebook") => notebook(args.split_off(1), &config),
+        Some("get") => get(&args[1..]),
+        Some("openapi") => {
+            println!("{:#}", api::openapi());
+            Ok(())
+        }
+        Some("rpc") => rpc(&args[1..], &config),
+        Some("mcp") => mcp(&args[1..], &config),
+        Some("jupyter") => jupyter_kernel(&args[1..], &config),
+        Some("dap") => dap(args.split_off(1), &config),
+        Some("mqtt") => mqtt(args.split_off(1), &config),
+        Some("kafka") => kafka(args.split_off(1), &config),
+        Some("nats") => nats(args.split_off(1), &config),
+        Some("slack") => slack(args.split_off(1), &config),
+        Some("discord") => discord(args.split_off(1), &config),
+        Some("speech") => speech(args.split_off(1), &config),
+        Some("help") | Some("-h") | Some("--help") => {
+            println!("{}", USAGE);
+            Ok(())
+        }
+        Some(other) => Err(format!("unknown command `{}`\n{}", other, USAGE)),
+    };
+
+    // Flush buffered spans and write the profile before a possible
+    // `process::exit`.
+    drop(guards);
+    if let Err(e) = result {
+        eprintln!("error: {}", e);
+        process::exit(1);
+    }
+}
+
+/// Remove a boolean flag from `args`, returning whether it was present.
+fn take_flag(args: &mut Vec<String>, flag: &str) -> bool {
+    let before = args.len();
+    args.retain(|a| a != flag);
+    args.len() != before
+}
+
+/// Remove `flag <value>` or `flag=<value>` from `args`, returning the value
+/// if present.
+fn take_option(args: &mut Vec<String>, flag: &str) -> Result<Option<String>, String> {
+    let prefix = format!("{}=", flag);
+    if let Some(i) = args.iter().position(|a| a.starts_with(&prefix)) {
+        return Ok(Some(args.remove(i)[prefix.len()..].to_string()));
+    }
+    match args.iter().position(|a| a == flag) {
+        Some(i) if i + 1 < args.len() => {
+            let value = args.remove(i + 1);
+            args.remove(i);
+            Ok(Some(value))
+        }
+        Some(_) => Err(format!("{} needs a value", flag)),
+        None => Ok(None),
+    }
+}
+
+/// Remove global flags (`--config <path>`, `--allow-net`, `--allow-exec`,
+/// `--workspace <dir>`, `--timeout <secs>`, `--record <file>`, `--store
+/// <file>`, `--lang <version>`) from `args` and load the config they describe.
+fn load_config(args: &mut Vec<String>) -> Result<Config, String> {
+    let allow_net = take_flag(args, "--allow-net");
+    let allow_exec = take_flag(args, "--allow-exec");
+    let workspace = take_option(args, "--workspace")?;
+    let timeout = take_option(args, "--timeout")?;
+    let record = take_option(args, "--record")?;
+    let store = take_option(args, "--store")?;
+    if let Some(version) = take_option(args, "--lang")? {
+        let version = Version::parse(&version).ok_or_else(|| {
+            let known: Vec<&str> = Version::ALL.iter().map(|v| v.as_str()).collect();
+            format!("--lang takes {}, not `{}`", known.join(" or "), version)
+        })?;
+        lang::set_default(version);
+    }
+    let path = take_option(args, "--config")?;
+    let mut config = Config::discover(path.as_deref().map(Path::new)).map_err(|e| e.to_string())?;
+    config.sandbox.allow_net |= allow_net;
+    config.sandbox.allow_exec |= allow_exec;
+    if let Some(dir) = workspace {
+        config.sandbox.workspace = Some(dir.into());
+    }
+    if let Some(path) = record {
+        config.record = Some(path.into());
+    }
+    if let Some(path) = store {
+        config.store = Some(path.into());
+    }
+    if let Some(secs) = timeout {
+        let secs = secs
+            .parse()
+            .ok()
+            .filter(|secs| limits::seconds(*secs).is_some())
+            .ok_or_else(|| format!("--timeout takes a number of seconds, not `{}`", secs))?;
+        config.limits.turn_timeout_secs = Some(secs);
+    }
+    Ok(config)
+}
+
+/// Set up log output from `--log-format` and `--log-level` or
+/// `$SENTIENCE_LOG` (default `info`), trace export when configured, and
+/// `--profile`.
+fn init_logging(
+    args: &mut Vec<String>,
+    config: &Config,
+) -> Result<(Option<TelemetryGuard>, Option<ProfileGuard>), String> {
+    let (profile, profile_guard) = match take_option(args, "--profile")? {
+        Some(path) => {
+            let (layer, guard) = ProfileLayer::new(path);
+            (Some(layer), Some(guard))
+        }
+        None => (None, None),
+    };
+    let level = match take_option(args, "--log-level")? {
+        Some(level) => Some(level),
+        None => env::var(logging::LEVEL_ENV).ok().filter(|v| !v.is_empty()),
+    };
+    let format = match take_option(args, "--log-format")? {
+        Some(format) => Some(format.parse()?),
+        None if level.is_some() => Some(LogFormat::Text),
+        None => None,
+    };
+    let level = match level {
+        Some(level) => logging::parse_level(&level)?,
+        None => Level::INFO,
+    };
+    let telemetry = logging::init(format, level, &config.telemetry, profile)?;
+    Ok((telemetry, profile_guard))
+}
+
+fn llm_registry(config: &Config) -> Result<LlmRegistry, String> {
+    LlmRegistry::from_config(&config.llm).map_err(|e| e.to_string())
+}
+
+fn embedder(config: &Config) -> Result<Arc<dyn Embedder>, String> {
+    embedding::from_config(&config.llm).map_err(|e| e.to_string())
+}
+
+/// The store `--store` names, opened.
+fn store(config: &Config) -> Result<Option<Arc<dyn MemoryStore>>, String> {
+    let Some(path) = &config.store else {
+        return Ok(None);
+    };
+    let store = FileStore::open(path).map_err(|e| format!("{}: {}", path.display(), e))?;
+    Ok(Some(Arc::new(store)))
+}
+
+fn repl(config: &Config) -> Result<(), String> {
     println!("Sentience REPL v0.1.1 (Rust)");
 
-    let stdin = io::stdin();
-    let mut lines = stdin.lock().lines();
-    let mut ctx = AgentContext::new();
+    let stdout = io::stdout();
+    let mut repl = Repl::new(io::empty(), stdout.lock());
+    repl.context_mut().llm = llm_registry(config)?;
+    repl.context_mut().embedder = embedder(config)?;
+    repl.context_mut().latent = MemoryIndex::from_config(&config.latent)?;
+    if let Some(store) = store(config)? {
+        repl.context_mut()
+            .attach_store(store)
+            .map_err(|e| e.to_string())?;
+    }
+    repl.context_mut().sandbox = Sandbox::from_config(&config.sandbox);
+    repl.context_mut().limits = Limits::from_config(&config.limits);
+    repl.context_mut().affect = Affect::from_config(&config.affect)?;
+    // Lines are read on their own thread so that handlers started with
+    // `.start` run while the prompt waits, and Ctrl-C ends the session
+    // through `on stop`.
+    let shutdown = shutdown_flag()?;
+    let (sender, lines) = mpsc::channel();
+    thread::spawn(move || {
+        for line in io::stdin().lines().map_while(Result::ok) {
+            if sender.send(line).is_err() {
+                break;
+            }
+        }
+    });
+    repl.run_until(lines, &shutdown)
+        .map_err(|e| format!("REPL error: {}", e))
+}
+
+/// Run as the Jupyter kernel started for one notebook, or register this
+/// executable as a kernel with `--install`.
+fn jupyter_kernel(args: &[String], config: &Config) -> Result<(), String> {
+    let path = match args {
+        [flag] if flag == "--install" => {
+            let exe = env::current_exe().map_err(|e| e.to_string())?;
+            let dir = jupyter::install_kernelspec(&exe).map_err(|e| e.to_string())?;
+            println!("Installed kernel spec in {}", dir.display());
+            return Ok(());
+        }
+        [path] => path,
+        _ => return Err(USAGE.to_string()),
+    };
+    // Jupyter may still signal SIGINT to interrupt; keep running.
+    let interrupted = Arc::new(AtomicBool::new(false));
+    signal_hook::flag::register(signal_hook::consts::SIGINT, interrupted)
+        .map_err(|e| e.to_string())?;
 
-    let mut buffer: Vec<String> = Vec::new();
-    let mut depth = 0;
+    let info = ConnectionInfo::load(Path::new(path))?;
+    let mut kernel = Kernel::bind(&info)?;
+    let context = kernel.repl_mut().context_mut();
+    context.llm = llm_registry(config)?;
+    context.embedder = embedder(config)?;
+    context.latent = MemoryIndex::from_config(&config.latent)?;
+    if let Some(store) = store(config)? {
+        context.attach_store(store).map_err(|e| e.to_string())?;
+    }
+    context.sandbox = Sandbox::from_config(&config.sandbox);
+    context.limits = Limits::from_config(&config.limits);
+    context.affect = Affect::from_config(&config.affect)?;
+    kernel.run()
+}
 
-    print_prompt();
+/// Run the Debug Adapter Protocol server for an editor.
+fn dap(mut args: Vec<String>, config: &Config) -> Result<(), String> {
+    let port = take_option(&mut args, "--port")?;
+    if !args.is_empty() {
+        return Err(USAGE.to_string());
+    }
+    let llm = llm_registry(config)?;
+    let embedder = embedder(config)?;
+    let latent = MemoryIndex::from_config(&config.latent)?;
+    let sandbox = Sandbox::from_config(&config.sandbox);
+    let limits = Limits::from_config(&config.limits);
+    let affect = Affect::from_config(&config.affect)?;
+    let setup: dap::Setup = Box::new(move |agent| {
+        agent.set_llm_registry(llm);
+        agent.set_embedder(embedder);
+        agent.set_memory_index(latent);
+        agent.set_sandbox(sandbox);
+        agent.set_limits(limits);
+        agent.set_affect(affect);
+    });
+    let served = match port {
+        None => dap::serve(io::stdin().lock(), io::stdout(), setup),
+        Some(port) => {
+            let listener = TcpListener::bind(format!("127.0.0.1:{}", port))
+                .map_err(|e| format!("cannot listen on port {}: {}", port, e))?;
+            eprintln!(
+                "Debug adapter listening on {}",
+                listener.local_addr().unwrap()
+            );
+            let (stream, _) = listener.accept().map_err(|e| e.to_string())?;
+            let writer = stream.try_clone().map_err(|e| e.to_string())?;
+            dap::serve(io::BufReader::new(stream), writer, setup)
+        }
+    };
+    served.map_err(|e| format!("debug adapter: {}", e))
+}
 
-    while let Some(Ok(line)) = lines.next() {
-        let trimmed = line.trim();
+fn compile(args: &[String]) -> Result<(), String> {
+    let (src, out) = match args {
+        [src] => (src.clone(), Path::new(src).with_extension("sentc")),
+        [src, flag, out] if flag == "-o" => (src.clone(), out.into()),
+        _ => return Err(USAGE.to_string()),
+    };
 
-        if trimmed.is_empty() && depth == 0 {
-            print_prompt();
-            continue;
+    let program = compile_file(Path::new(&src), &out).map_err(|e| e.to_string())?;
+    println!(
+        "Compiled {} statement(s) from {} to {}",
+        program.statements.len(),
+        src,
+        out.display()
+    );
+    Ok(())
+}
+
+/// Load the program at `path` into a new agent configured from `config`,
+/// printing anything it outputs while registering.
+fn load_agent(path: &str, config: &Config) -> Result<SentienceAgent, String> {
+    let (agent, output) = build_agent(path, config)?;
+    if !output.is_empty() {
+        println!("{}", output);
+    }
+    Ok(agent)
+}
+
+/// Run the agent's `on stop` block, printing its output or error.
+fn stop(agent: &mut SentienceAgent) {
+    match agent.stop() {
+        Ok(output) if !output.is_empty() => println!("{}", output),
+        Ok(_) => {}
+        Err(e) => eprintln!("error: on stop: {}", e),
+    }
+}
+
+/// Load and run the program at `path`, returning the agent and the
+/// program's output.
+fn build_agent(path: &str, config: &Config) -> Result<(SentienceAgent, String), String> {
+    let program = load_file(Path::new(path)).map_err(|e| e.to_string())?;
+    build_program(&program, config)
+}
+
+/// Run `program` in a new agent configured from `config`.
+fn build_program(program: &Program, config: &Config) -> Result<(SentienceAgent, String), String> {
+    let mut agent = SentienceAgent::new();
+    agent.set_llm_registry(llm_registry(config)?);
+    agent.set_embedder(embedder(config)?);
+    agent.set_memory_index(MemoryIndex::from_config(&config.latent)?);
+    agent.set_sandbox(Sandbox::from_config(&config.sandbox));
+    agent.set_limits(Limits::from_config(&config.limits));
+    agent.set_affect(Affect::from_config(&config.affect)?);
+    if !config.webhooks.is_empty() {
+        agent.set_webhooks(Webhooks::new(config.webhooks.clone())?);
+    }
+    if let Some(path) = &config.record {
+        let recorder = Recorder::open(path).map_err(|e| format!("{}: {}", path.display(), e))?;
+        agent.set_recorder(recorder);
+    }
+    if let Some(store) = store(config)? {
+        agent.set_store(store).map_err(|e| e.to_string())?;
+    }
+    agent.keep_recent_turns(dashboard::RECENT_TURNS);
+    let output = agent.run_program(program).map_err(|e| e.to_string())?;
+    if let Some(sync) = MemorySync::configured(&config.sync)? {
+        agent.set_memory_sync(sync);
+        agent.sync_memory().map_err(|e| e.to_string())?;
+    }
+    Ok((agent, output))
+}
+
+/// Run programs against the transcripts in the `.golden` files beside
+/// them, failing if any answer differs.
+fn test(mut args: Vec<String>, config: &Config) -> Result<(), String> {
+    let coverage = take_flag(&mut args, "--coverage");
+    if args.is_empty() {
+        return Err(USAGE.to_string());
+    }
+    let mut failed = 0;
+    for path in &args {
+        let golden = Path::new(path).with_extension("golden");
+        let read = |path: &Path| {
+            std::fs::read_to_string(path).map_err(|e| format!("{}: {}", path.display(), e))
+        };
+        let source = read(Path::new(path))?;
+        let expected = read(&golden)?;
+        let mut agent = SentienceAgent::new();
+        agent.set_llm_registry(llm_registry(config)?);
+        agent.set_embedder(embedder(config)?);
+        agent.set_memory_index(MemoryIndex::from_config(&config.latent)?);
+        agent.set_sandbox(Sandbox::from_config(&config.sandbox));
+        agent.set_limits(Limits::from_config(&config.limits));
+        agent.set_affect(Affect::from_config(&config.affect)?);
+        let outcome = testing::run(&mut agent, &source, &expected);
+        if outcome.passed(&expected) {
+            println!("ok      {}", path);
+        } else {
+            failed += 1;
+            println!(
+                "FAILED  {}
+--- expected
+{}--- actual
+{}",
+                path, expected, outcome.transcript
+            );
         }
+        if coverage {
+            print!("{}", outcome.coverage.annotate(&source, &outcome.program));
+        }
+    }
+    match failed {
+        0 => Ok(()),
+        n => Err(format!("{} of {} programs failed", n, args.len())),
+    }
+}
+
+/// Send the inputs of a recording to the agent of another program and
+/// print where it did something other than the recorded agent.
+fn replay(mut args: Vec<String>, config: &Config) -> Result<(), String> {
+    let against = take_option(&mut args, "--against")?.ok_or("--against is required")?;
+    let name = take_option(&mut args, "--agent")?;
+    let log = match args.as_slice() {
+        [log] => log,
+        _ => return Err(USAGE.to_string()),
+    };
+    let text = std::fs::read_to_string(log).map_err(|e| format!("{}: {}", log, e))?;
+    let turns = recording::parse(&text).map_err(|e| format!("{}: {}", log, e))?;
+
+    // Replaying must not notify anyone, mirror or store memory, or add to a
+    // recording.
+    let config = Config {
+        webhooks: Vec::new(),
+        sync: Default::default(),
+        record: None,
+        store: None,
+        ..config.clone()
+    };
+    let (mut agent, _) = build_agent(&against, &config)?;
+    let name = name
+        .or_else(|| agent.describe().map(|info| info.name))
+        .ok_or_else(|| format!("{} declares no agent", against))?;
+    let turns: Vec<Turn> = turns.into_iter().filter(|t| t.agent == name).collect();
+    if turns.is_empty() {
+        return Err(format!("{} has no turns of agent `{}`", log, name));
+    }
 
-        if depth == 0 && trimmed.starts_with('.') {
-            handle_command(trimmed, &mut ctx);
-            print_prompt();
+    let replayed = recording::replay(&mut agent, &turns);
+    let mut differing = 0;
+    for (n, turn) in replayed.iter().enumerate() {
+        if !turn.differs() {
+            println!("same     turn {}: {:?}", n + 1, turn.recorded.input);
             continue;
         }
+        differing += 1;
+        println!("differs  turn {}: {:?}", n + 1, turn.recorded.input);
+        print_differences(turn);
+    }
+    println!("{} of {} turns differ", differing, replayed.len());
+    Ok(())
+}
 
-        depth += trimmed.matches('{').count();
-        depth -= trimmed.matches('}').count();
-        buffer.push(trimmed.to_string());
+/// Print the answer and memory changes of a recorded turn (`-`) and its
+/// replay (`+`) where they differ.
+fn print_differences(turn: &Replayed) {
+    let outcome = |turn: &Turn| match (&turn.output, &turn.error) {
+        (_, Some(error)) => format!("error: {}", error),
+        (output, None) => format!("output: {}", output.as_deref().unwrap_or("")),
+    };
+    let (recorded, replayed) = (&turn.recorded, &turn.replayed);
+    if outcome(recorded) != outcome(replayed) {
+        println!("  - {}", outcome(recorded));
+        println!("  + {}", outcome(replayed));
+    }
+    if recorded.changes != replayed.changes {
+        for change in &recorded.changes {
+            println!("  - {}", change);
+        }
+        for change in &replayed.changes {
+            println!("  + {}", change);
+        }
+    }
+}
 
-        if depth == 0 {
-            let full_input = buffer.join(" ");
-            let mut lexer = Lexer::new(&full_input);
+/// Write saved memory, and optionally the agents of a program, as DOT.
+fn graph(mut args: Vec<String>) -> Result<(), String> {
+    let program = take_option(&mut args, "--program")?;
+    let similar = match take_option(&mut args, "--similar")? {
+        Some(n) => n
+            .parse()
+            .map_err(|_| format!("--similar takes a number of edges, not `{}`", n))?,
+        None => 0,
+    };
+    let output = take_option(&mut args, "-o")?;
+    let path = match args.as_slice() {
+        [path] => path,
+        _ => return Err(USAGE.to_string()),
+    };
+    let mut ctx = AgentContext::new();
+    ctx.load(path).map_err(|e| format!("{}: {}", path, e))?;
+    let mut agents = Vec::new();
+    if let Some(program) = program {
+        let program = load_file(Path::new(&program)).map_err(|e| e.to_string())?;
+        for stmt in &program.statements {
+            if let Statement::AgentDeclaration { .. } = stmt {
+                ctx.current_agent = Some(stmt.clone());
+                agents.extend(introspect::describe(&ctx));
+            }
+        }
+    }
+    let dot = graph::dot(&ctx.snapshot(), &agents, similar);
+    match output {
+        Some(output) => std::fs::write(&output, dot).map_err(|e| format!("{}: {}", output, e)),
+        None => {
+            print!("{}", dot);
+            Ok(())
+        }
+    }
+}
+
+/// Print the goal progress saved in each memory file and the change from
+/// the first to the last.
+fn goals(args: Vec<String>) -> Result<(), String> {
+    if args.is_empty() {
+        return Err(USAGE.to_string());
+    }
+    let mut snapshots = Vec::new();
+    for path in &args {
+        let reading = goals::read_snapshot(path).map_err(|e| format!("{}: {}", path, e))?;
+        snapshots.push((path.as_str(), reading));
+    }
+    for line in goals::compare(&snapshots) {
+        println!("{}", line);
+    }
+    Ok(())
+}
+
+/// Consolidate the short-term memory saved at a path and save the result in
+/// the same format.
+fn dream(mut args: Vec<String>) -> Result<(), String> {
+    let mut options = dream::Options::default();
+    if let Some(threshold) = take_option(&mut args, "--threshold")? {
+        options.threshold = threshold
+            .parse()
+            .ok()
+            .filter(|t| (0.0..=1.0).contains(t))
+            .ok_or_else(|| {
+                format!(
+                    "--threshold takes a number from 0 to 1, not `{}`",
+                    threshold
+                )
+            })?;
+    }
+    if let Some(uses) = take_option(&mut args, "--min-uses")? {
+        options.min_uses = uses
+            .parse()
+            .map_err(|_| format!("--min-uses takes a number of uses, not `{}`", uses))?;
+    }
+    let output = take_option(&mut args, "-o")?;
+    let path = match args.as_slice() {
+        [path] => path,
+        _ => return Err(USAGE.to_string()),
+    };
+    let mut ctx = AgentContext::new();
+    ctx.load(path).map_err(|e| format!("{}: {}", path, e))?;
+    let indexed = paged::is_indexed(path).map_err(|e| format!("{}: {}", path, e))?;
+    for line in dream::consolidate(&mut ctx, &options).render() {
+        println!("{}", line);
+    }
+    let output = output.as_deref().unwrap_or(path);
+    let saved = if indexed {
+        ctx.save_indexed(output)
+    } else {
+        ctx.save(output)
+    };
+    saved.map_err(|e| format!("{}: {}", output, e))
+}
+
+/// Run the blocks of a literate document and write it with their output.
+fn notebook(mut args: Vec<String>, config: &Config) -> Result<(), String> {
+    let output = take_option(&mut args, "-o")?;
+    let path = match args.as_slice() {
+        [path] => Path::new(path),
+        _ => return Err(USAGE.to_string()),
+    };
+    let output = output
+        .map(PathBuf::from)
+        .unwrap_or_else(|| path.with_extension("out.md"));
+    let document =
+        std::fs::read_to_string(path).map_err(|e| format!("{}: {}", path.display(), e))?;
+    let mut notebook = Notebook::default();
+    let context = notebook.context_mut();
+    context.llm = llm_registry(config)?;
+    context.embedder = embedder(config)?;
+    context.latent = MemoryIndex::from_config(&config.latent)?;
+    context.sandbox = Sandbox::from_config(&config.sandbox);
+    context.limits = Limits::from_config(&config.limits);
+    context.affect = Affect::from_config(&config.affect)?;
+    let rendered = notebook.render(&document).map_err(|e| e.to_string())?;
+    std::fs::write(&output, &rendered.text).map_err(|e| format!("{}: {}", output.display(), e))?;
+    println!(
+        "Ran {} block{} of {} into {}",
+        rendered.blocks,
+        if rendered.blocks == 1 { "" } else { "s" },
+        path.display(),
+        output.display()
+    );
+    if rendered.errors > 0 {
+        return Err(format!(
+            "{} block{} reported an error",
+            rendered.errors,
+            if rendered.errors == 1 { "" } else { "s" }
+        ));
+    }
+    Ok(())
+}
+
+/// Fetch modules into the cache, or restore the ones the lockfile pins.
+fn get(args: &[String]) -> Result<(), String> {
+    let packages = Packages::default();
+    let github = GitHub::new()?;
+    let fetched = if args.is_empty() {
+        packages.restore(&github)?
+    } else {
+        let mut fetched = Vec::new();
+        for module in args {
+            fetched.extend(packages.get(module, &github)?);
+        }
+        fetched
+    };
+    let lock = packages.read_lock()?;
+    for path in &fetched {
+        if let Some(locked) = lock.modules.get(path) {
+            println!("{} {} ({})", path, locked.version, locked.commit);
+        }
+    }
+    if fetched.is_empty() {
+        println!("All modules in {} are fetched", packages.lockfile.display());
+    }
+    Ok(())
+}
+
+/// Chunk documents into the long-term memory saved at `--into`, and into
+/// the vector store if memory sync is configured.
+fn ingest(mut args: Vec<String>, config: &Config) -> Result<(), String> {
+    let mut options = ingest::Options::default();
+    if let Some(collection) = take_option(&mut args, "--collection")? {
+        options.collection = collection;
+    }
+    if let Some(size) = take_option(&mut args, "--chunk-size")? {
+        options.chunk_size =
+            size.parse().ok().filter(|size| *size > 0).ok_or_else(|| {
+                format!("--chunk-size takes a number of characters, not `{}`", size)
+            })?;
+    }
+    let into = take_option(&mut args, "--into")?.ok_or_else(|| USAGE.to_string())?;
+    if args.is_empty() {
+        return Err(USAGE.to_string());
+    }
+    let mut documents = Vec::new();
+    for path in &args {
+        documents.extend(ingest::read(Path::new(path))?);
+    }
+
+    let mut ctx = AgentContext::new();
+    let indexed = Path::new(&into).exists() && {
+        ctx.load(&into).map_err(|e| format!("{}: {}", into, e))?;
+        paged::is_indexed(&into).map_err(|e| format!("{}: {}", into, e))?
+    };
+    let report = ingest::ingest(&mut ctx, &documents, &options);
+    println!("{}", report.summary(&options.collection));
+    if let Some(mut sync) = MemorySync::configured(&config.sync)? {
+        let synced = sync.sync(&mut ctx).map_err(|e| e.to_string())?;
+        println!("Pushed {} entries to the vector store", synced.pushed);
+    }
+    let saved = if indexed {
+        ctx.save_indexed(&into)
+    } else {
+        ctx.save(&into)
+    };
+    saved.map_err(|e| format!("{}: {}", into, e))
+}
+
+/// Parse a source file and print what the analyzer finds, failing if any of
+/// it is an error.
+fn check(mut args: Vec<String>) -> Result<(), String> {
+    let types = take_flag(&mut args, "--types");
+    let lints = take_flag(&mut args, "--lint");
+    let json = take_flag(&mut args, "--json");
+    let allowed = take_option(&mut args, "--allow")?.unwrap_or_default();
+    let allowed: Vec<&str> = allowed.split(',').map(str::trim).collect();
+    let path = match args.as_slice() {
+        [path] => path,
+        _ => return Err(USAGE.to_string()),
+    };
+    let source = std::fs::read_to_string(path).map_err(|e| format!("{}: {}", path, e))?;
+    let mut diagnostics = match embedded::compile(path, &source) {
+        Ok(_) => {
+            let mut lexer = Lexer::new(&source);
+            let program = Parser::new(&mut lexer).with_locations().parse_program();
+            let mut diagnostics = analyze::analyze(&program);
+            if types {
+                diagnostics.extend(typecheck::check(&program));
+            }
+            if lints {
+                diagnostics.extend(lint::lint(&source));
+            }
+            diagnostics
+        }
+        Err(e) => {
+            // Report every statement the parser gave up on, not just the
+            // first.
+            let mut lexer = Lexer::new(&source);
             let mut parser = Parser::new(&mut lexer);
-            let program = parser.parse_program();
-            for stmt in program.statements {
-                let mut output = Vec::new();
-                eval(&stmt, "", "", &mut ctx, &mut output);
-                if !output.is_empty() {
-                    for line in output {
-                        println!("{}", line);
-                    }
-                }
+            parser.parse_program();
+            let reported = match e.kind {
+                ParseErrorKind::UnknownStatement(_) => parser.unknown_statements(),
+                _ => parser.errors(),
+            };
+            let errors = match reported {
+                errors if !errors.is_empty() && e.code() == errors[0].code() => errors.to_vec(),
+                _ => vec![e],
+            };
+            errors
+                .into_iter()
+                .map(|e| Diagnostic {
+                    code: e.code(),
+                    severity: Severity::Error,
+                    line: e.position.map(|position| position.line),
+                    column: e.position.map(|position| position.col),
+                    message: ParseError::new(e.kind).to_string(),
+                })
+                .collect()
+        }
+    };
+    diagnostics.retain(|d| !allowed.contains(&d.code));
+    diagnostics.sort_by_key(|d| d.line);
+    if json {
+        let diagnostics: Vec<serde_json::Value> = diagnostics
+            .iter()
+            .map(|d| {
+                let mut value = serde_json::json!(d);
+                value["file"] = path.as_str().into();
+                value
+            })
+            .collect();
+        println!("{}", serde_json::Value::from(diagnostics));
+    } else {
+        for diagnostic in &diagnostics {
+            match diagnostic.line {
+                Some(_) => println!("{}:{}", path, diagnostic),
+                None => println!("{}: {}", path, diagnostic),
             }
-            buffer.clear();
-            print_prompt();
         }
     }
+    let errors = diagnostics
+        .iter()
+        .filter(|d| d.severity == Severity::Error)
+        .count();
+    match errors {
+        0 => Ok(()),
+        1 => Err("1 error".to_string()),
+        n => Err(format!("{} errors", n)),
+    }
+}
+
+fn run(mut args: Vec<String>, config: &Config) -> Result<(), String> {
+    let input = take_option(&mut args, "--input")?;
+    match (args.as_slice(), input) {
+        ([path], None) => {
+            let mut agent = load_agent(path, config)?;
+            stop(&mut agent);
+            Ok(())
+        }
+        // Only the responses are printed, so they can be piped on.
+        ([path], Some(input)) => {
+            let (mut agent, _) = build_agent(path, config)?;
+            let handled = agent.handle_input(&input);
+            if let Err(e) = agent.stop() {
+                eprintln!("error: on stop: {}", e);
+            }
+            for response in agent.take_responses() {
+                println!("{}", response);
+            }
+            handled.map(drop).map_err(|e| e.to_string())
+        }
+        _ => Err(USAGE.to_string()),
+    }
 }
 
-fn handle_command(line: &str, ctx: &mut AgentContext) {
-    let after_dot = &line[1..];
-    let (cmd, rest) = after_dot.split_once(' ').unwrap_or((after_dot, ""));
-    let input_value = rest.trim();
+/// Serve JSON-RPC requests on stdin/stdout. Stdout carries only responses,
+/// so the program's own output goes to stderr.
+fn rpc(args: &[String], config: &Config) -> Result<(), String> {
+    let path = match args {
+        [path] => path,
+        _ => return Err(USAGE.to_string()),
+    };
+    let (mut agent, output) = build_agent(path, config)?;
+    if !output.is_empty() {
+        eprintln!("{}", output);
+    }
+    let stdin = io::stdin();
+    let stdout = io::stdout();
+    let served = sentience_core::rpc::serve(&mut agent, stdin.lock(), stdout.lock());
+    match agent.stop() {
+        Ok(output) if !output.is_empty() => eprintln!("{}", output),
+        Ok(_) => {}
+        Err(e) => eprintln!("error: on stop: {}", e),
+    }
+    served.map_err(|e| e.to_string())
+}
 
-    if ctx.current_agent.is_none() {
-        println!("No agent registered.");
-        return;
+/// Serve the agent's memory over the Model Context Protocol on
+/// stdin/stdout; like `rpc`, the program's output goes to stderr.
+fn mcp(args: &[String], config: &Config) -> Result<(), String> {
+    let path = match args {
+        [path] => path,
+        _ => return Err(USAGE.to_string()),
+    };
+    let (mut agent, output) = build_agent(path, config)?;
+    if !output.is_empty() {
+        eprintln!("{}", output);
     }
+    let stdin = io::stdin();
+    let stdout = io::stdout();
+    let served = sentience_core::mcp::serve(&mut agent, stdin.lock(), stdout.lock());
+    match agent.stop() {
+        Ok(output) if !output.is_empty() => eprintln!("{}", output),
+        Ok(_) => {}
+        Err(e) => eprintln!("error: on stop: {}", e),
+    }
+    served.map_err(|e| e.to_string())
+}
 
-    if let Some(Statement::AgentDeclaration { body, .. }) = ctx.current_agent.clone() {
-        for stmt in body {
-            match (cmd, &stmt) {
-                ("input", Statement::OnInput { param, body }) => {
-                    ctx.set_mem("short", param, input_value);
-                    let mut output = Vec::new();
-                    for s in body {
-                        eval(s, "  ", input_value, ctx, &mut output);
-                    }
-                    for line in output {
-                        println!("{}", line);
+/// Run the agent's `on schedule` handlers as they come due (UTC) until
+/// interrupted. An agent that crashes is restarted from the program; see
+/// `supervisor`.
+fn serve(mut args: Vec<String>, config: &Config) -> Result<(), String> {
+    start_metrics(&mut args)?;
+    let events = take_option(&mut args, "--events")?;
+    let http = take_option(&mut args, "--http")?;
+    let watch = take_flag(&mut args, "--watch");
+    let path = match args.as_slice() {
+        [path] => path.clone(),
+        _ => return Err(USAGE.to_string()),
+    };
+    let mut program = load_file(Path::new(&path)).map_err(|e| e.to_string())?;
+    let mut reload = Reload::new(&path, watch)?;
+    if !config.tenants.is_empty() {
+        return serve_tenants(&path, program, reload, events, http, config);
+    }
+    let programs = parallel::split(&program);
+    if programs.len() > 1 {
+        let pipeline = parallel::pipeline(&program);
+        return serve_agents(&path, programs, pipeline, reload, events, http, config);
+    }
+    let (mut agent, output) = build_program(&program, config)?;
+    if !output.is_empty() {
+        println!("{}", output);
+    }
+    let hub = events.map(|addr| start_events(&addr)).transpose()?;
+    if let Some(hub) = &hub {
+        agent.on_event(hub.sink());
+    }
+    let mut scheduler = agent.scheduler().map_err(|e| e.to_string())?;
+    if scheduler.is_empty() && http.is_none() {
+        return Err(format!(
+            "{} declares no `on schedule` or `every` handlers",
+            path
+        ));
+    }
+    let name = agent.describe().map(|info| info.name).unwrap_or_default();
+    let mut supervisor = Supervisor::new(&name, RestartPolicy::from_config(&config.supervisor));
+    let requests = http.as_deref().map(start_api).transpose()?;
+    let shutdown = shutdown_flag()?;
+    let now = || {
+        SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map(|d| d.as_secs())
+            .unwrap_or(0)
+    };
+
+    println!("Serving {} (Ctrl-C to stop)", path);
+    let mut next = scheduler.next_after(now());
+    while next.is_some() || requests.is_some() {
+        if let Some(fresh) = restart(&mut supervisor, &program, hub.as_ref(), config) {
+            agent = fresh;
+        }
+        if let Some(new) = reload.requested() {
+            match parallel::split(&new).len() {
+                0 | 1 => match reload_agent(&mut agent, &program, &new) {
+                    Ok(reloaded) => {
+                        println!("{}", reloaded);
+                        program = new;
+                        scheduler = agent.scheduler().map_err(|e| e.to_string())?;
+                        next = scheduler.next_after(now());
                     }
-                    return;
+                    Err(e) => eprintln!("error: reload: {}", e),
+                },
+                _ => eprintln!(
+                    "error: reload: {} now declares several agents; restart serve to run them",
+                    path
+                ),
+            }
+        }
+        if let Some((at, specs)) = next.take_if(|(at, _)| now() >= *at) {
+            for spec in &specs {
+                // A crashed agent misses the handlers due while it is down.
+                if !supervisor.is_up() {
+                    break;
+                }
+                match supervisor.run(|| agent.run_schedule(spec)) {
+                    Ok(output) if !output.is_empty() => println!("{}", output),
+                    Ok(_) => {}
+                    Err(e) => failed(&supervisor, &format!("schedule(\"{}\")", spec), &e),
+                }
+            }
+            next = scheduler.next_after(at);
+            continue;
+        }
+        if shutdown.load(Ordering::SeqCst) {
+            break;
+        }
+        if supervisor.is_up() {
+            if let Err(e) = agent.sync_memory() {
+                eprintln!("error: memory sync: {}", e);
+            }
+        }
+        match &requests {
+            Some(requests) => {
+                if let Ok((request, reply)) = requests.recv_timeout(Duration::from_secs(1)) {
+                    let _ = reply.send(handle_supervised(&mut agent, &mut supervisor, &request));
                 }
+            }
+            None => thread::sleep(Duration::from_secs(1)),
+        }
+    }
+    if supervisor.is_up() {
+        stop(&mut agent);
+    }
+    Ok(())
+}
+
+/// `serve` for a program declaring several agents. Each gets its own memory;
+/// handlers due at the same time run in parallel unless the agents are
+/// linked, and an agent that crashes is restarted while the others keep
+/// running. The HTTP API answers for the agent named by the `agent` query
+/// parameter, or else for the first agent, except that input goes through
+/// the `pipeline` if the program declares one.
+fn serve_agents(
+    path: &str,
+    mut programs: Vec<Program>,
+    pipeline: Option<Vec<String>>,
+    mut reload: Reload,
+    events: Option<String>,
+    http: Option<String>,
+    config: &Config,
+) -> Result<(), String> {
+    let mut agents = Vec::new();
+    for program in &programs {
+        let (agent, output) = build_program(program, config)?;
+        if !output.is_empty() {
+            println!("{}", output);
+        }
+        agents.push(agent);
+    }
+    let hub = events.map(|addr| start_events(&addr)).transpose()?;
+    if let Some(hub) = &hub {
+        for agent in &mut agents {
+            agent.on_event(hub.sink());
+        }
+    }
+    let mut schedulers = agents
+        .iter()
+        .map(|agent| agent.scheduler())
+        .collect::<Result<Vec<_>, _>>()
+        .map_err(|e| e.to_string())?;
+    if schedulers.iter().all(|s| s.is_empty()) && http.is_none() {
+        return Err(format!(
+            "{} declares no `on schedule` or `every` handlers",
+            path
+        ));
+    }
+    let set = AgentSet::new(agents);
+    let mut stages = pipeline_stages(&set, pipeline)?;
+    let policy = RestartPolicy::from_config(&config.supervisor);
+    let supervisors: Vec<Mutex<Supervisor>> = set
+        .names()
+        .iter()
+        .map(|name| Mutex::new(Supervisor::new(name, policy)))
+        .collect();
+    let supervisor = |index: usize| supervisors[index].lock().unwrap_or_else(|e| e.into_inner());
+    let requests = http.as_deref().map(start_api).transpose()?;
+    let shutdown = shutdown_flag()?;
+    let now = || {
+        SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map(|d| d.as_secs())
+            .unwrap_or(0)
+    };
 
-                ("train", Statement::Train { body }) => {
-                    ctx.set_mem("short", "msg", input_value);
-                    let mut output = Vec::new();
-                    for s in body {
-                        eval(s, "  ", input_value, ctx, &mut output);
+    let workers = match set.workers() {
+        1 => "1 worker".to_string(),
+        n => format!("{} workers", n),
+    };
+    println!(
+        "Serving {} agents from {} on {} (Ctrl-C to stop)",
+        set.len(),
+        path,
+        workers
+    );
+    let mut next: Vec<_> = schedulers.iter().map(|s| s.next_after(now())).collect();
+    while next.iter().any(Option::is_some) || requests.is_some() {
+        for (index, program) in programs.iter().enumerate() {
+            if let Some(fresh) = restart(&mut supervisor(index), program, hub.as_ref(), config) {
+                *set.lock(index) = fresh;
+            }
+        }
+        if let Some(new) = reload.requested() {
+            match pipeline_stages(&set, parallel::pipeline(&new)) {
+                Ok(reloaded) => stages = reloaded,
+                Err(e) => eprintln!("error: reload: {}", e),
+            }
+            let names = set.names();
+            for program in parallel::split(&new) {
+                let name = parallel::agent_name(&program).unwrap_or_default();
+                let Some(index) = set.position(name) else {
+                    eprintln!(
+                        "error: reload: agent `{}` is new; restart serve to run it",
+                        name
+                    );
+                    continue;
+                };
+                let mut agent = set.lock(index);
+                match reload_agent(&mut agent, &programs[index], &program) {
+                    Ok(reloaded) => {
+                        println!("{}", reloaded);
+                        schedulers[index] = agent.scheduler().map_err(|e| e.to_string())?;
+                        next[index] = schedulers[index].next_after(now());
+                        programs[index] = program;
                     }
-                    for line in output {
-                        println!("{}", line);
+                    Err(e) => eprintln!("error: reload: {}: {}", names[index], e),
+                }
+            }
+        }
+        let time = now();
+        let due: Vec<(usize, (usize, u64, Vec<String>))> = next
+            .iter_mut()
+            .enumerate()
+            .filter_map(|(index, next)| {
+                let (at, specs) = next.take_if(|(at, _)| time >= *at)?;
+                Some((index, (index, at, specs)))
+            })
+            .collect();
+        if !due.is_empty() {
+            let names = set.names();
+            let ran = set.run(due, |agent, (index, at, specs)| {
+                let mut supervisor = supervisor(index);
+                let mut results = Vec::new();
+                for spec in specs {
+                    if !supervisor.is_up() {
+                        break;
                     }
-                    return;
+                    let result = supervisor.run(|| agent.run_schedule(&spec));
+                    results.push((spec, result));
                 }
-
-                ("evolve", Statement::Evolve { body }) => {
-                    ctx.set_mem("short", "msg", input_value);
-                    let mut output = Vec::new();
-                    for s in body {
-                        eval(s, "  ", input_value, ctx, &mut output);
+                (at, results)
+            });
+            for (index, (at, results)) in ran {
+                for (spec, result) in results {
+                    match result {
+                        Ok(output) if !output.is_empty() => println!("{}", output),
+                        Ok(_) => {}
+                        Err(e) => failed(
+                            &supervisor(index),
+                            &format!("{}: schedule(\"{}\")", names[index], spec),
+                            &e,
+                        ),
                     }
-                    for line in output {
-                        println!("{}", line);
+                }
+                next[index] = schedulers[index].next_after(at);
+            }
+            continue;
+        }
+        if shutdown.load(Ordering::SeqCst) {
+            break;
+        }
+        for index in 0..set.len() {
+            if !supervisor(index).is_up() {
+                continue;
+            }
+            if let Err(e) = set.lock(index).sync_memory() {
+                eprintln!("error: memory sync: {}", e);
+            }
+        }
+        match &requests {
+            Some(requests) => {
+                if let Ok((request, reply)) = requests.recv_timeout(Duration::from_secs(1)) {
+                    let path = request.path.trim_matches('/');
+                    let named = api::query_param(&request.query, "agent");
+                    let response = if request.method == "GET" && path == "agents" {
+                        describe_agents(&set, &supervisors)
+                    } else if let Some(name) = named {
+                        match set.position(&name) {
+                            Some(index) => handle_supervised(
+                                &mut set.lock(index),
+                                &mut supervisor(index),
+                                &request,
+                            ),
+                            None => api::error(404, &format!("no agent `{}`", name)),
+                        }
+                    } else if !stages.is_empty() && request.method == "POST" && path == "input" {
+                        match stages.iter().find(|&&index| !supervisor(index).is_up()) {
+                            Some(&index) => api::unavailable(&supervisor(index)),
+                            None => run_pipeline(&set, &stages, &supervisors, &request),
+                        }
+                    } else {
+                        handle_supervised(&mut set.lock(0), &mut supervisor(0), &request)
+                    };
+                    let _ = reply.send(response);
+                }
+            }
+            None => thread::sleep(Duration::from_secs(1)),
+        }
+    }
+    for index in 0..set.len() {
+        if supervisor(index).is_up() {
+            stop(&mut set.lock(index));
+        }
+    }
+    Ok(())
+}
+
+/// `serve` for the tenants of the config. Each gets an agent of its own
+/// built from `program`, which answers the HTTP API for requests carrying
+/// the tenant's token and runs its `on schedule` handlers. Memory that
+/// changed is saved every few seconds and on exit.
+fn serve_tenants(
+    path: &str,
+    mut program: Program,
+    mut reload: Reload,
+    events: Option<String>,
+    http: Option<String>,
+    config: &Config,
+) -> Result<(), String> {
+    let Some(http) = http else {
+        return Err("tenants are only served over HTTP; pass --http <addr>".to_string());
+    };
+    if events.is_some() {
+        return Err("--events would stream every tenant's activity to one place".to_string());
+    }
+    let policy = RestartPolicy::from_config(&config.supervisor);
+    let mut tenants = Tenants::default();
+    let mut schedulers = Vec::new();
+    for tenant in &config.tenants {
+        let agent = build_tenant(&program, tenant, config)?;
+        schedulers.push(agent.scheduler().map_err(|e| e.to_string())?);
+        tenants.add(Tenant::new(tenant, agent, policy))?;
+    }
+    let requests = start_api(&http)?;
+    let shutdown = shutdown_flag()?;
+    let now = || {
+        SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map(|d| d.as_secs())
+            .unwrap_or(0)
+    };
+
+    println!(
+        "Serving {} to {} tenants (Ctrl-C to stop)",
+        path,
+        tenants.len()
+    );
+    let mut next: Vec<_> = schedulers.iter().map(|s| s.next_after(now())).collect();
+    let mut saved = Instant::now();
+    while !shutdown.load(Ordering::SeqCst) {
+        for (tenant, settings) in tenants.iter_mut().zip(&config.tenants) {
+            if !tenant.supervisor().due(Instant::now()) {
+                continue;
+            }
+            match build_tenant(&program, settings, config) {
+                Ok(agent) => {
+                    tenant.replace_agent(agent);
+                    tenant.supervisor_mut().restarted();
+                    println!(
+                        "Restarted {} (restart {})",
+                        tenant.name(),
+                        tenant.supervisor().restarts()
+                    );
+                }
+                Err(e) => {
+                    eprintln!("error: restarting {}: {}", tenant.name(), e);
+                    tenant.supervisor_mut().crashed(Instant::now());
+                }
+            }
+        }
+        if let Some(new) = reload.requested() {
+            let mut reloaded = None;
+            for (index, tenant) in tenants.iter_mut().enumerate() {
+                match reload_agent(tenant.agent_mut(), &program, &new) {
+                    Ok(output) => {
+                        schedulers[index] =
+                            tenant.agent_mut().scheduler().map_err(|e| e.to_string())?;
+                        next[index] = schedulers[index].next_after(now());
+                        reloaded = Some(output);
                     }
-                    return;
+                    Err(e) => eprintln!("error: reload: {}: {}", tenant.name(), e),
+                }
+            }
+            if let Some(output) = reloaded {
+                println!("{}", output);
+                program = new;
+            }
+        }
+        let time = now();
+        for (index, tenant) in tenants.iter_mut().enumerate() {
+            let Some((at, specs)) = next[index].take_if(|(at, _)| time >= *at) else {
+                continue;
+            };
+            for spec in &specs {
+                if !tenant.supervisor().is_up() {
+                    break;
+                }
+                match tenant.run(|agent| agent.run_schedule(spec)) {
+                    Ok(output) if !output.is_empty() => println!("{}: {}", tenant.name(), output),
+                    Ok(_) => {}
+                    Err(e) => failed(
+                        tenant.supervisor(),
+                        &format!("{}: schedule(\"{}\")", tenant.name(), spec),
+                        &e,
+                    ),
+                }
+            }
+            next[index] = schedulers[index].next_after(at);
+        }
+        if saved.elapsed() >= tenants::SAVE_INTERVAL {
+            save_tenants(&mut tenants);
+            saved = Instant::now();
+        }
+        if let Ok((request, reply)) = requests.recv_timeout(Duration::from_secs(1)) {
+            let up: Vec<bool> = tenants.iter().map(|t| t.supervisor().is_up()).collect();
+            let _ = reply.send(tenants.handle(&request, Instant::now()));
+            for (tenant, was_up) in tenants.iter().zip(up) {
+                if was_up && !tenant.supervisor().is_up() {
+                    failed(
+                        tenant.supervisor(),
+                        "api",
+                        &format!("{} crashed", tenant.name()),
+                    );
                 }
+            }
+        }
+    }
+    for tenant in tenants.iter_mut() {
+        if tenant.supervisor().is_up() {
+            match tenant.run(SentienceAgent::stop) {
+                Ok(output) if !output.is_empty() => println!("{}: {}", tenant.name(), output),
+                Ok(_) => {}
+                Err(e) => eprintln!("error: {}: on stop: {}", tenant.name(), e),
+            }
+        }
+        let usage = tenant.usage();
+        println!(
+            "{}: {} requests, {} handled in {} ms, {} errors, {} throttled",
+            tenant.name(),
+            usage.requests,
+            usage.handled,
+            usage.handler_ms,
+            usage.errors,
+            usage.throttled
+        );
+    }
+    save_tenants(&mut tenants);
+    Ok(())
+}
 
-                _ => {}
+/// Build `tenant`'s agent from `program`, configured from `config` with the
+/// tenant's `limits` and `workspace` in place of the config's, and holding
+/// the memory the tenant saved last. Memory sync, `--record` and `--store`
+/// are left off, since each would put tenants' memory in one place.
+fn build_tenant(
+    program: &Program,
+    tenant: &TenantConfig,
+    config: &Config,
+) -> Result<SentienceAgent, String> {
+    let mut config = config.clone();
+    if let Some(limits) = &tenant.limits {
+        config.limits = limits.clone();
+    }
+    config.sandbox.workspace = tenant.workspace.clone();
+    config.sync = Default::default();
+    config.record = None;
+    config.store = None;
+    let (mut agent, output) = build_program(program, &config)?;
+    if !output.is_empty() {
+        println!("{}: {}", tenant.name, output);
+    }
+    if let Some(path) = tenant.memory.as_ref().filter(|path| path.exists()) {
+        agent
+            .load_memory(&path.to_string_lossy())
+            .map_err(|e| format!("{}: {}", path.display(), e))?;
+    }
+    Ok(agent)
+}
+
+/// Save the memory of tenants whose memory changed, reporting failures.
+fn save_tenants(tenants: &mut Tenants) {
+    for (name, e) in tenants.save() {
+        eprintln!("error: saving memory of {}: {}", name, e);
+    }
+}
+
+/// Answer `GET /agents` with every agent of `set` and whether it is up.
+fn describe_agents(set: &AgentSet, supervisors: &[Mutex<Supervisor>]) -> httpd::Response {
+    let agents: Vec<serde_json::Value> = (0..set.len())
+        .map(|index| {
+            let mut description = api::describe(&set.lock(index));
+            let supervisor = supervisors[index].lock().unwrap_or_else(|e| e.into_inner());
+            description["status"] = supervisor.status().into();
+            description
+        })
+        .collect();
+    httpd::Response::new(
+        200,
+        "application/json",
+        serde_json::Value::from(agents).to_string(),
+    )
+}
+
+/// Answer `POST /input` with the output of the pipeline through `stages`.
+/// A stage that panics or goes over a limit crashes.
+fn run_pipeline(
+    set: &AgentSet,
+    stages: &[usize],
+    supervisors: &[Mutex<Supervisor>],
+    request: &httpd::Request,
+) -> httpd::Response {
+    let supervisor = |index: usize| supervisors[index].lock().unwrap_or_else(|e| e.into_inner());
+    let crash = |index: usize, cause: &dyn fmt::Display| {
+        let mut supervisor = supervisor(index);
+        supervisor.crashed(Instant::now());
+        failed(
+            &supervisor,
+            set.names()[index],
+            &format!("crashed: {}", cause),
+        );
+    };
+    let ran = panic::catch_unwind(AssertUnwindSafe(|| {
+        api::run(request, |text| {
+            set.pipeline(stages, text).map_err(|(index, e)| {
+                if supervisor::over_limit(&e) {
+                    crash(index, &e);
+                }
+                e
+            })
+        })
+    }));
+    ran.unwrap_or_else(|_| {
+        let panicked = set.panicked();
+        for &index in &panicked {
+            crash(index, &"panicked");
+        }
+        api::unavailable(&supervisor(panicked.first().copied().unwrap_or(stages[0])))
+    })
+}
+
+/// Indexes into `set` of the agents of `pipeline`.
+fn pipeline_stages(set: &AgentSet, pipeline: Option<Vec<String>>) -> Result<Vec<usize>, String> {
+    pipeline
+        .unwrap_or_default()
+        .iter()
+        .map(|name| {
+            set.position(name)
+                .ok_or_else(|| format!("pipeline stage `{}` is not a declared agent", name))
+        })
+        .collect()
+}
+
+/// When `serve` should reload its program: on SIGHUP, or with `--watch`
+/// whenever the file's modification time changes.
+struct Reload {
+    path: PathBuf,
+    hangup: Arc<AtomicBool>,
+    /// Modification time last seen, when watching.
+    modified: Option<Option<SystemTime>>,
+}
+
+impl Reload {
+    fn new(path: &str, watch: bool) -> Result<Self, String> {
+        let hangup = Arc::new(AtomicBool::new(false));
+        signal_hook::flag::register(signal_hook::consts::SIGHUP, Arc::clone(&hangup))
+            .map_err(|e| e.to_string())?;
+        let path = PathBuf::from(path);
+        let modified = watch.then(|| modified(&path));
+        Ok(Self {
+            path,
+            hangup,
+            modified,
+        })
+    }
+
+    /// The program to reload, if a reload was asked for since the last
+    /// call. A program that fails to load is reported and skipped.
+    fn requested(&mut self) -> Option<Program> {
+        let mut due = self.hangup.swap(false, Ordering::SeqCst);
+        if let Some(seen) = &mut self.modified {
+            let now = modified(&self.path);
+            due |= now != *seen;
+            *seen = now;
+        }
+        if !due {
+            return None;
+        }
+        load_file(&self.path)
+            .map_err(|e| eprintln!("error: reload: {}", e))
+            .ok()
+    }
+}
+
+fn modified(path: &Path) -> Option<SystemTime> {
+    std::fs::metadata(path).and_then(|m| m.modified()).ok()
+}
+
+/// Swap in the handlers `new` declares, keeping memory. If its schedules do
+/// not parse, the handlers of `old` are put back.
+fn reload_agent(
+    agent: &mut SentienceAgent,
+    old: &Program,
+    new: &Program,
+) -> Result<String, String> {
+    let reloaded = agent.reload(new).map_err(|e| e.to_string())?;
+    if let Err(e) = agent.scheduler() {
+        agent.reload(old).map_err(|e| e.to_string())?;
+        return Err(e.to_string());
+    }
+    Ok(reloaded)
+}
+
+/// Stream agent events on `addr`.
+fn start_events(addr: &str) -> Result<EventHub, String> {
+    let hub = EventHub::new();
+    let bound = httpd::spawn(addr, hub.handler()).map_err(|e| format!("{}: {}", addr, e))?;
+    println!("Streaming events on http://{}/events", bound);
+    Ok(hub)
+}
+
+/// A fresh agent built from `program` to replace the crashed one, once the
+/// supervisor's backoff has passed.
+fn restart(
+    supervisor: &mut Supervisor,
+    program: &Program,
+    hub: Option<&EventHub>,
+    config: &Config,
+) -> Option<SentienceAgent> {
+    if !supervisor.due(Instant::now()) {
+        return None;
+    }
+    match build_program(program, config) {
+        Ok((mut agent, output)) => {
+            if !output.is_empty() {
+                println!("{}", output);
+            }
+            if let Some(hub) = hub {
+                agent.on_event(hub.sink());
             }
+            supervisor.restarted();
+            println!(
+                "Restarted {} (restart {})",
+                supervisor.name(),
+                supervisor.restarts()
+            );
+            Some(agent)
         }
-        if cmd == "input" {
-            println!("Agent has no on input handler.");
-        } else {
-            println!("Agent has no {} block.", cmd);
+        Err(e) => {
+            eprintln!("error: restarting {}: {}", supervisor.name(), e);
+            supervisor.crashed(Instant::now());
+            None
+        }
+    }
+}
+
+/// [`api::handle_supervised`], reporting a crash.
+fn handle_supervised(
+    agent: &mut SentienceAgent,
+    supervisor: &mut Supervisor,
+    request: &httpd::Request,
+) -> httpd::Response {
+    let was_up = supervisor.is_up();
+    let response = api::handle_supervised(agent, supervisor, request);
+    if was_up && !supervisor.is_up() {
+        failed(supervisor, "api", &format!("{} crashed", supervisor.name()));
+    }
+    response
+}
+
+/// Report a supervised handler that failed.
+fn failed(supervisor: &Supervisor, what: &str, failure: &impl fmt::Display) {
+    eprintln!("error: {}: {}", what, failure);
+    if supervisor.gave_up() {
+        eprintln!(
+            "error: {} crashed too often and is not restarted",
+            supervisor.name()
+        );
+    }
+}
+
+/// An API request and where to send its response.
+type ApiRequest = (httpd::Request, mpsc::Sender<httpd::Response>);
+
+/// Serve the HTTP API at `addr`. Requests are answered by whoever owns the
+/// agent and reads the returned receiver.
+fn start_api(addr: &str) -> Result<mpsc::Receiver<ApiRequest>, String> {
+    let (sender, receiver) = mpsc::channel::<ApiRequest>();
+    let sender = Mutex::new(sender);
+    let bound = httpd::spawn(
+        addr,
+        Arc::new(move |request: &httpd::Request| {
+            let (reply, response) = mpsc::channel();
+            let queued = sender
+                .lock()
+                .map(|s| s.send((request.clone(), reply)).is_ok())
+                .unwrap_or(false);
+            match response.recv() {
+                Ok(response) if queued => response,
+                _ => httpd::Response::text(503, "agent is shutting down\n"),
+            }
+        }),
+    )
+    .map_err(|e| format!("{}: {}", addr, e))?;
+    println!(
+        "Dashboard on http://{}/ (API description at /openapi.json)",
+        bound
+    );
+    Ok(receiver)
+}
+
+/// Serve `/metrics` in the Prometheus format if `--metrics <addr>` is given.
+fn start_metrics(args: &mut Vec<String>) -> Result<(), String> {
+    let Some(addr) = take_option(args, "--metrics")? else {
+        return Ok(());
+    };
+    let bound = httpd::spawn(
+        &addr,
+        Arc::new(|request: &httpd::Request| match request.path.as_str() {
+            "/metrics" => {
+                httpd::Response::new(200, "text/plain; version=0.0.4", metrics::global().render())
+            }
+            _ => httpd::Response::not_found(),
+        }),
+    )
+    .map_err(|e| format!("{}: {}", addr, e))?;
+    println!("Metrics on http://{}/metrics", bound);
+    Ok(())
+}
+
+/// Feed messages from MQTT topics into the agent's `on input` handler.
+fn mqtt(mut args: Vec<String>, config: &Config) -> Result<(), String> {
+    start_metrics(&mut args)?;
+    let broker = take_option(&mut args, "--broker")?.ok_or("--broker is required")?;
+    let mut topics = Vec::new();
+    while let Some(topic) = take_option(&mut args, "--topic")? {
+        topics.push(topic);
+    }
+    let mut options = MqttOptions::new(&broker, &[]);
+    options.topics = topics;
+    if let Some(qos) = take_option(&mut args, "--qos")? {
+        options.qos = qos
+            .parse()
+            .map_err(|_| format!("invalid --qos `{}`", qos))?;
+    }
+    if let Some(id) = take_option(&mut args, "--client-id")? {
+        options.client_id = id;
+    }
+    options.username = take_option(&mut args, "--username")?;
+    options.password = take_option(&mut args, "--password")?;
+
+    let path = match args.as_slice() {
+        [path] => path.clone(),
+        _ => return Err(USAGE.to_string()),
+    };
+    let mut agent = load_agent(&path, config)?;
+
+    let mut source = MqttSource::connect(&options).map_err(|e| format!("{}: {}", broker, e))?;
+    println!("Subscribed to {} on {}", options.topics.join(", "), broker);
+    source
+        .run(|message| match agent.handle_message(&message) {
+            Ok(output) if !output.is_empty() => println!("{}", output),
+            Ok(_) => {}
+            Err(e) => eprintln!("error: {}", e),
+        })
+        .map_err(|e| format!("{}: {}", broker, e))
+}
+
+/// Connect the agent to others over NATS: answer messages on its inbox and
+/// events of the agents it follows, and publish its own events.
+fn nats(mut args: Vec<String>, config: &Config) -> Result<(), String> {
+    start_metrics(&mut args)?;
+    let server = take_option(&mut args, "--server")?.unwrap_or_else(|| "127.0.0.1".to_string());
+    let prefix =
+        take_option(&mut args, "--prefix")?.unwrap_or_else(|| nats::DEFAULT_PREFIX.to_string());
+    let mut follow = Vec::new();
+    while let Some(agent) = take_option(&mut args, "--follow")? {
+        follow.push(agent);
+    }
+    let mut options = NatsOptions::new(&server);
+    options.user = take_option(&mut args, "--user")?;
+    options.password = take_option(&mut args, "--password")?;
+    options.token = take_option(&mut args, "--token")?;
+
+    let path = match args.as_slice() {
+        [path] => path.clone(),
+        _ => return Err(USAGE.to_string()),
+    };
+    let mut agent = load_agent(&path, config)?;
+    let name = agent
+        .describe()
+        .map(|info| info.name)
+        .ok_or("the program does not declare an agent")?;
+    let shutdown = shutdown_flag()?;
+
+    let mut transport = NatsTransport::connect(&options, &prefix, &name)
+        .map_err(|e| format!("{}: {}", server, e))?;
+    for other in &follow {
+        transport.follow(other).map_err(|e| e.to_string())?;
+    }
+    agent.on_event(transport.event_sink());
+    println!(
+        "{} listening on {} at {} (Ctrl-C to stop)",
+        name,
+        nats::inbox(&prefix, &name),
+        server
+    );
+
+    while !shutdown.load(Ordering::SeqCst) {
+        let delivery = match transport.next_delivery(Duration::from_secs(1)) {
+            Ok(Some(delivery)) => delivery,
+            Ok(None) => {
+                if let Err(e) = agent.sync_memory() {
+                    eprintln!("error: memory sync: {}", e);
+                }
+                continue;
+            }
+            Err(e) => return Err(format!("{}: {}", server, e)),
+        };
+        match agent.handle_message(&delivery.message) {
+            Ok(output) => {
+                if !output.is_empty() {
+                    println!("{}", output);
+                }
+                if let Some(reply) = &delivery.reply {
+                    transport.reply(reply, &output).map_err(|e| e.to_string())?;
+                }
+            }
+            Err(e) => eprintln!("error: {}", e),
+        }
+    }
+    Ok(())
+}
+
+/// Flag set by Ctrl-C or a termination signal, so long-running commands can
+/// finish their current batch and clean up.
+fn shutdown_flag() -> Result<Arc<AtomicBool>, String> {
+    let flag = Arc::new(AtomicBool::new(false));
+    for &signal in signal_hook::consts::TERM_SIGNALS {
+        signal_hook::flag::register(signal, Arc::clone(&flag)).map_err(|e| e.to_string())?;
+    }
+    Ok(flag)
+}
+
+/// Consume Kafka topics through the REST Proxy as agent input, optionally
+/// publishing each response to an output topic.
+fn kafka(mut args: Vec<String>, config: &Config) -> Result<(), String> {
+    start_metrics(&mut args)?;
+    let rest_url = take_option(&mut args, "--rest-proxy")?.ok_or("--rest-proxy is required")?;
+    let group = take_option(&mut args, "--group")?.ok_or("--group is required")?;
+    let mut options = KafkaOptions::new(&rest_url, &group, &[]);
+    while let Some(topic) = take_option(&mut args, "--topic")? {
+        options.topics.push(topic);
+    }
+    if options.topics.is_empty() {
+        return Err("at least one --topic is required".to_string());
+    }
+    options.output_topic = take_option(&mut args, "--output-topic")?;
+    options.from_beginning = take_flag(&mut args, "--from-beginning");
+
+    let path = match args.as_slice() {
+        [path] => path.clone(),
+        _ => return Err(USAGE.to_string()),
+    };
+    let mut agent = load_agent(&path, config)?;
+    let shutdown = shutdown_flag()?;
+
+    let adapter = KafkaAdapter::connect(&options).map_err(|e| e.to_string())?;
+    println!(
+        "Consuming {} as group {} (Ctrl-C to stop)",
+        options.topics.join(", "),
+        group
+    );
+    adapter
+        .run(&shutdown, |message| match agent.handle_message(&message) {
+            Ok(output) if output.is_empty() => None,
+            Ok(output) => {
+                println!("{}", output);
+                Some(output)
+            }
+            Err(e) => {
+                eprintln!("error: {}", e);
+                None
+            }
+        })
+        .map_err(|e| e.to_string())
+}
+
+/// Run a chat message through the agent in the sender's session, returning
+/// the response to post, if any.
+fn answer_chat(agent: &mut SentienceAgent, message: &ChatMessage) -> Option<String> {
+    match agent.handle_session(&message.session_key(), &message.to_message()) {
+        Ok(output) if output.is_empty() => None,
+        Ok(output) => Some(output),
+        Err(e) => {
+            eprintln!("error: {}: {}", message.session_key(), e);
+            None
+        }
+    }
+}
+
+/// Receive Slack Events API requests on `--listen` and answer each channel
+/// message in its thread. Events are acknowledged immediately and handled
+/// in order on this thread.
+fn slack(mut args: Vec<String>, config: &Config) -> Result<(), String> {
+    start_metrics(&mut args)?;
+    let listen = take_option(&mut args, "--listen")?.ok_or("--listen is required")?;
+    let path = match args.as_slice() {
+        [path] => path.clone(),
+        _ => return Err(USAGE.to_string()),
+    };
+    let adapter = Arc::new(SlackAdapter::new(SlackOptions::configured(&config.slack)?));
+    let mut agent = load_agent(&path, config)?;
+    let shutdown = shutdown_flag()?;
+
+    let (sender, receiver) = mpsc::channel::<ChatMessage>();
+    let sender = Mutex::new(sender);
+    let verifier = Arc::clone(&adapter);
+    let bound = httpd::spawn(
+        &listen,
+        Arc::new(move |request: &httpd::Request| {
+            if request.method != "POST" {
+                return httpd::Response::text(405, "method not allowed\n");
+            }
+            let signed = match (
+                request.header("x-slack-request-timestamp"),
+                request.header("x-slack-signature"),
+            ) {
+                (Some(timestamp), Some(signature)) => {
+                    verifier.verify(timestamp, signature, &request.body)
+                }
+                _ => false,
+            };
+            if !signed {
+                return httpd::Response::text(401, "invalid signature\n");
+            }
+            // Slack redelivers events it thinks we were slow to acknowledge.
+            if request.header("x-slack-retry-num").is_some() {
+                return httpd::Response::text(200, "");
+            }
+            match slack::parse_event(&request.body) {
+                Ok(SlackEvent::Challenge(challenge)) => httpd::Response::text(200, &challenge),
+                Ok(SlackEvent::Message(message)) => {
+                    let _ = sender.lock().map(|s| s.send(message));
+                    httpd::Response::text(200, "")
+                }
+                Ok(SlackEvent::Ignored) => httpd::Response::text(200, ""),
+                Err(e) => httpd::Response::text(400, &format!("{}\n", e)),
+            }
+        }),
+    )
+    .map_err(|e| format!("{}: {}", listen, e))?;
+    println!(
+        "Listening for Slack events on http://{} (Ctrl-C to stop)",
+        bound
+    );
+
+    while !shutdown.load(Ordering::SeqCst) {
+        let message = match receiver.recv_timeout(Duration::from_secs(1)) {
+            Ok(message) => message,
+            Err(_) => {
+                if let Err(e) = agent.sync_memory() {
+                    eprintln!("error: memory sync: {}", e);
+                }
+                continue;
+            }
+        };
+        if let Some(response) = answer_chat(&mut agent, &message) {
+            if let Err(e) =
+                adapter.post_message(&message.channel, &response, message.reply_to.as_deref())
+            {
+                eprintln!("error: {}", e);
+            }
+        }
+    }
+    Ok(())
+}
+
+/// Poll Discord channels and reply to each new message.
+fn discord(mut args: Vec<String>, config: &Config) -> Result<(), String> {
+    start_metrics(&mut args)?;
+    let mut options = DiscordOptions::configured(&config.discord)?;
+    while let Some(channel) = take_option(&mut args, "--channel")? {
+        options.channels.push(channel);
+    }
+    let path = match args.as_slice() {
+        [path] => path.clone(),
+        _ => return Err(USAGE.to_string()),
+    };
+    let mut agent = load_agent(&path, config)?;
+    let shutdown = shutdown_flag()?;
+
+    let mut adapter = DiscordAdapter::connect(&options).map_err(|e| e.to_string())?;
+    println!(
+        "Watching Discord channels {} (Ctrl-C to stop)",
+        options.channels.join(", ")
+    );
+    adapter
+        .run(&shutdown, |message| answer_chat(&mut agent, message))
+        .map_err(|e| e.to_string())
+}
+
+/// Transcribe audio files, or PCM chunks read from stdin, and feed each
+/// transcript to `on input`.
+fn speech(mut args: Vec<String>, config: &Config) -> Result<(), String> {
+    let stream = take_flag(&mut args, "--stdin");
+    let mut format = PcmFormat::default();
+    if let Some(rate) = take_option(&mut args, "--sample-rate")? {
+        format.sample_rate = rate
+            .parse()
+            .map_err(|_| format!("invalid --sample-rate `{}`", rate))?;
+    }
+    let chunk_secs = match take_option(&mut args, "--chunk-secs")? {
+        Some(secs) => secs
+            .parse::<f64>()
+            .ok()
+            .filter(|s| *s > 0.0)
+            .ok_or_else(|| format!("invalid --chunk-secs `{}`", secs))?,
+        None => 5.0,
+    };
+    let mut files = Vec::new();
+    while let Some(file) = take_option(&mut args, "--audio")? {
+        files.push(file);
+    }
+    let path = match args.as_slice() {
+        [path] if stream != !files.is_empty() => path.clone(),
+        _ => return Err(USAGE.to_string()),
+    };
+    let transcriber = speech::configured(&config.speech)?;
+    let mut agent = load_agent(&path, config)?;
+    let mut answer = |message: InputMessage| match agent.handle_message(&message) {
+        Ok(output) if !output.is_empty() => println!("{}", output),
+        Ok(_) => {}
+        Err(e) => eprintln!("error: {}", e),
+    };
+
+    if stream {
+        return speech::transcribe_stream(
+            transcriber.as_ref(),
+            io::stdin().lock(),
+            format,
+            Duration::from_secs_f64(chunk_secs),
+            answer,
+        )
+        .map_err(|e| e.to_string());
+    }
+    for file in files {
+        let message = speech::transcribe_file(transcriber.as_ref(), Path::new(&file))
+            .map_err(|e| format!("{}: {}", file, e))?;
+        if !message.payload.is_empty() {
+            answer(message);
         }
     }
+    Ok(())
 }
@@ -0,0 +1,287 @@
+//! Model Context Protocol server over stdio, so LLM clients such as Claude
+//! Desktop or an IDE assistant can read an agent's memory.
+//!
+//! Memory regions are resources (`sentience://memory/short` and
+//! `sentience://memory/long`). Tools: `get_memory`, `recall`, `embed`, and
+//! `input`, which runs the agent's `on input` handler.
+
+use crate::sync;
+use crate::SentienceAgent;
+use serde_json::{json, Value};
+use std::io::{self, BufRead, Write};
+
+/// Protocol revision answered when the client asks for one we do not know.
+pub const PROTOCOL_VERSION: &str = "2024-11-05";
+const SUPPORTED_VERSIONS: &[&str] = &["2024-11-05", "2025-03-26", "2025-06-18"];
+
+const RESOURCE_PREFIX: &str = "sentience://memory/";
+
+/// Entries returned by `recall` when no limit is given.
+const DEFAULT_RECALL_LIMIT: usize = 10;
+
+const METHOD_NOT_FOUND: i64 = -32601;
+const INVALID_PARAMS: i64 = -32602;
+const PARSE_ERROR: i64 = -32700;
+
+/// Answer one message per line of `reader` until it is exhausted.
+pub fn serve(
+    agent: &mut SentienceAgent,
+    reader: impl BufRead,
+    mut writer: impl Write,
+) -> io::Result<()> {
+    for line in reader.lines() {
+        let line = line?;
+        if line.trim().is_empty() {
+            continue;
+        }
+        let response = match serde_json::from_str::<Value>(&line) {
+            Ok(message) => handle(agent, &message),
+            Err(e) => Some(error_response(Value::Null, PARSE_ERROR, &e.to_string())),
+        };
+        if let Some(response) = response {
+            writeln!(writer, "{}", response)?;
+            writer.flush()?;
+        }
+    }
+    Ok(())
+}
+
+/// Handle one message; notifications get no response.
+pub fn handle(agent: &mut SentienceAgent, message: &Value) -> Option<Value> {
+    let id = message.get("id").cloned()?;
+    let method = message["method"].as_str().unwrap_or_default();
+    let params = &message["params"];
+    let result = match method {
+        "initialize" => Ok(initialize(agent, params)),
+        "ping" => Ok(json!({})),
+        "resources/list" => {
+            let resources: Vec<Value> = ["short", "long"]
+                .iter()
+                .map(|region| {
+                    json!({
+                        "uri": format!("{}{}", RESOURCE_PREFIX, region),
+                        "name": format!("mem.{}", region),
+                        "description": format!("The agent's {}-term memory as a JSON object.", region),
+                        "mimeType": "application/json",
+                    })
+                })
+                .collect();
+            Ok(json!({ "resources": resources }))
+        }
+        "resources/read" => read_resource(agent, params["uri"].as_str().unwrap_or_default()),
+        "tools/list" => Ok(json!({ "tools": tools() })),
+        "tools/call" => call_tool(agent, params),
+        other => Err((METHOD_NOT_FOUND, format!("unknown method `{}`", other))),
+    };
+    Some(match result {
+        Ok(result) => json!({ "jsonrpc": "2.0", "id": id, "result": result }),
+        Err((code, message)) => error_response(id, code, &message),
+    })
+}
+
+fn initialize(agent: &SentienceAgent, params: &Value) -> Value {
+    let requested = params["protocolVersion"].as_str().unwrap_or_default();
+    let version = if SUPPORTED_VERSIONS.contains(&requested) {
+        requested
+    } else {
+        PROTOCOL_VERSION
+    };
+    let name = agent
+        .describe()
+        .map(|info| info.name)
+        .unwrap_or_else(|| "agent".to_string());
+    json!({
+        "protocolVersion": version,
+        "capabilities": { "resources": {}, "tools": {} },
+        "serverInfo": { "name": "sentience", "version": env!("CARGO_PKG_VERSION") },
+        "instructions": format!(
+            "Memory of the Sentience agent `{}`. Use `recall` to search it and `get_memory` to read one key.",
+            name
+        ),
+    })
+}
+
+fn read_resource(agent: &SentienceAgent, uri: &str) -> Result<Value, (i64, String)> {
+    let memory = match uri.strip_prefix(RESOURCE_PREFIX) {
+        Some("short") => agent.all_short(),
+        Some("long") => agent.all_long(),
+        _ => return Err((INVALID_PARAMS, format!("unknown resource `{}`", uri))),
+    };
+    let sorted: std::collections::BTreeMap<_, _> = memory.into_iter().collect();
+    Ok(json!({
+        "contents": [{
+            "uri": uri,
+            "mimeType": "application/json",
+            "text": serde_json::to_string_pretty(&sorted).unwrap_or_default(),
+        }],
+    }))
+}
+
+fn tools() -> Value {
+    let region = json!({ "type": "string", "enum": ["short", "long"] });
+    json!([
+        {
+            "name": "get_memory",
+            "description": "Read one value from the agent's memory. Missing keys are empty.",
+            "inputSchema": {
+                "type": "object",
+                "properties": { "region": region, "key": { "type": "string" } },
+                "required": ["region", "key"],
+            },
+        },
+        {
+            "name": "recall",
+            "description": "Find memory entries whose key or value contains the query.",
+            "inputSchema": {
+                "type": "object",
+                "properties": {
+                    "query": { "type": "string" },
+                    "region": region,
+                    "limit": { "type": "integer", "minimum": 1 },
+                },
+                "required": ["query"],
+            },
+        },
+        {
+            "name": "embed",
+            "description": "Embed text into the vector space used for shared memory.",
+            "inputSchema": {
+                "type": "object",
+                "properties": { "text": { "type": "string" } },
+                "required": ["text"],
+            },
+        },
+        {
+            "name": "input",
+            "description": "Send text to the agent's `on input` handler and return its output.",
+            "inputSchema": {
+                "type": "object",
+                "properties": { "text": { "type": "string" } },
+                "required": ["text"],
+            },
+        },
+    ])
+}
+
+/// Run a tool. Failures the model can act on are tool results with
+/// `isError`; unknown tools and missing arguments are protocol errors.
+fn call_tool(agent: &mut SentienceAgent, params: &Value) -> Result<Value, (i64, String)> {
+    let args = &params["arguments"];
+    let string = |name: &str| args.get(name).and_then(Value::as_str);
+    let required = |name: &str| {
+        string(name).ok_or_else(|| (INVALID_PARAMS, format!("`{}` is required", name)))
+    };
+    let outcome: Result<String, String> = match params["name"].as_str().unwrap_or_default() {
+        "get_memory" => agent
+            .get_mem(required("region")?, required("key")?)
+            .map_err(|e| e.to_string()),
+        "recall" => {
+            let limit = args
+                .get("limit")
+                .and_then(Value::as_u64)
+                .map_or(DEFAULT_RECALL_LIMIT, |n| n as usize);
+            agent
+                .recall(required("query")?, string("region"), limit)
+                .map(|matches| json!(matches).to_string())
+                .map_err(|e| e.to_string())
+        }
+        "embed" => Ok(json!(sync::embed(required("text")?)).to_string()),
+        "input" => agent
+            .handle_input(required("text")?)
+            .map_err(|e| e.to_string()),
+        other => return Err((INVALID_PARAMS, format!("unknown tool `{}`", other))),
+    };
+    let (text, is_error) = match outcome {
+        Ok(text) => (text, false),
+        Err(message) => (message, true),
+    };
+    Ok(json!({ "content": [{ "type": "text", "text": text }], "isError": is_error }))
+}
+
+fn error_response(id: Value, code: i64, message: &str) -> Value {
+    json!({ "jsonrpc": "2.0", "id": id, "error": { "code": code, "message": message } })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn exchange(agent: &mut SentienceAgent, messages: &[Value]) -> Vec<Value> {
+        let input: Vec<String> = messages.iter().map(Value::to_string).collect();
+        let mut out = Vec::new();
+        serve(agent, input.join("\n").as_bytes(), &mut out).unwrap();
+        String::from_utf8(out)
+            .unwrap()
+            .lines()
+            .map(|line| serde_json::from_str(line).unwrap())
+            .collect()
+    }
+
+    fn request(id: i64, method: &str, params: Value) -> Value {
+        json!({ "jsonrpc": "2.0", "id": id, "method": method, "params": params })
+    }
+
+    #[test]
+    fn exposes_memory_as_resources_and_tools() {
+        let mut agent = SentienceAgent::new();
+        agent
+            .run_sentience("agent Guide {\n  on input(msg) {\n    print \"ok\"\n  }\n}")
+            .unwrap();
+        agent.set_long("city", "Belgrade");
+
+        let responses = exchange(
+            &mut agent,
+            &[
+                request(1, "initialize", json!({ "protocolVersion": "2025-03-26" })),
+                json!({ "jsonrpc": "2.0", "method": "notifications/initialized" }),
+                request(2, "resources/list", json!({})),
+                request(
+                    3,
+                    "resources/read",
+                    json!({ "uri": "sentience://memory/long" }),
+                ),
+                request(4, "tools/list", json!({})),
+                request(
+                    5,
+                    "tools/call",
+                    json!({ "name": "recall", "arguments": { "query": "belgrade" } }),
+                ),
+                request(
+                    6,
+                    "tools/call",
+                    json!({ "name": "get_memory", "arguments": { "region": "mid", "key": "x" } }),
+                ),
+                request(7, "tools/call", json!({ "name": "embed", "arguments": {} })),
+                request(8, "resources/subscribe", json!({})),
+            ],
+        );
+
+        assert_eq!(responses.len(), 8);
+        assert_eq!(responses[0]["result"]["protocolVersion"], "2025-03-26");
+        assert_eq!(
+            responses[1]["result"]["resources"][1]["uri"],
+            "sentience://memory/long"
+        );
+        let text = responses[2]["result"]["contents"][0]["text"]
+            .as_str()
+            .unwrap();
+        assert_eq!(
+            serde_json::from_str::<Value>(text).unwrap(),
+            json!({ "city": "Belgrade" })
+        );
+        let names: Vec<_> = responses[3]["result"]["tools"]
+            .as_array()
+            .unwrap()
+            .iter()
+            .map(|tool| tool["name"].as_str().unwrap())
+            .collect();
+        assert_eq!(names, ["get_memory", "recall", "embed", "input"]);
+        assert_eq!(
+            responses[4]["result"]["content"][0]["text"],
+            r#"[{"key":"city","region":"long","value":"Belgrade"}]"#
+        );
+        assert_eq!(responses[5]["result"]["isError"], true);
+        assert_eq!(responses[6]["error"]["code"], INVALID_PARAMS);
+        assert_eq!(responses[7]["error"]["code"], METHOD_NOT_FOUND);
+    }
+}
@@ -0,0 +1,322 @@
+//! Process-wide counters and histograms, rendered in the Prometheus text
+//! exposition format by `serve --metrics`.
+
+use crate::goals::Reading;
+use crate::training;
+use std::collections::BTreeMap;
+use std::fmt::Write;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Mutex, OnceLock};
+use std::time::Duration;
+
+/// Upper bounds, in seconds, of the histogram buckets.
+const BUCKETS: [f64; 11] = [
+    0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 5.0, 30.0,
+];
+
+#[derive(Default)]
+pub struct Histogram {
+    counts: [AtomicU64; BUCKETS.len()],
+    count: AtomicU64,
+    sum_micros: AtomicU64,
+}
+
+impl Histogram {
+    pub fn observe(&self, elapsed: Duration) {
+        let secs = elapsed.as_secs_f64();
+        if let Some(i) = BUCKETS.iter().position(|&bound| secs <= bound) {
+            self.counts[i].fetch_add(1, Ordering::Relaxed);
+        }
+        self.count.fetch_add(1, Ordering::Relaxed);
+        self.sum_micros
+            .fetch_add(elapsed.as_micros() as u64, Ordering::Relaxed);
+    }
+
+    pub fn count(&self) -> u64 {
+        self.count.load(Ordering::Relaxed)
+    }
+
+    fn render(&self, out: &mut String, name: &str, help: &str) {
+        let _ = writeln!(out, "# HELP {} {}", name, help);
+        let _ = writeln!(out, "# TYPE {} histogram", name);
+        let mut cumulative = 0;
+        for (bound, count) in BUCKETS.iter().zip(&self.counts) {
+            cumulative += count.load(Ordering::Relaxed);
+            let _ = writeln!(out, "{}_bucket{{le=\"{}\"}} {}", name, bound, cumulative);
+        }
+        let count = self.count();
+        let _ = writeln!(out, "{}_bucket{{le=\"+Inf\"}} {}", name, count);
+        let sum = self.sum_micros.load(Ordering::Relaxed) as f64 / 1e6;
+        let _ = writeln!(out, "{}_sum {}", name, sum);
+        let _ = writeln!(out, "{}_count {}", name, count);
+    }
+}
+
+#[derive(Default)]
+pub struct Metrics {
+    /// Handler runs by kind (`input`, `schedule`, `train`).
+    inputs: Mutex<BTreeMap<String, u64>>,
+    errors: AtomicU64,
+    pub eval_duration: Histogram,
+    pub recall_duration: Histogram,
+    embeddings: AtomicU64,
+    /// Entries per memory region as of the last handler run.
+    memory_entries: Mutex<BTreeMap<String, usize>>,
+    /// Restarts of each crashed agent by `serve`.
+    restarts: Mutex<BTreeMap<String, u64>>,
+    /// Latest goal progress of each agent that reports it.
+    goal_progress: Mutex<BTreeMap<String, f64>>,
+    /// Change in goal progress by agent and kind of handler.
+    goal_change: Mutex<BTreeMap<(String, String), f64>>,
+    /// Handler runs after which an agent's goal was newly achieved.
+    goals_achieved: Mutex<BTreeMap<String, u64>>,
+    /// Mean loss of each agent's last `train from` pass.
+    train_loss: Mutex<BTreeMap<String, f64>>,
+    /// Examples each agent was trained on.
+    train_examples: Mutex<BTreeMap<String, u64>>,
+}
+
+/// The process-wide metrics.
+pub fn global() -> &'static Metrics {
+    static METRICS: OnceLock<Metrics> = OnceLock::new();
+    METRICS.get_or_init(Metrics::default)
+}
+
+impl Metrics {
+    /// Record one handler run of `kind` that took `elapsed`.
+    pub fn handler_finished(&self, kind: &str, elapsed: Duration, failed: bool) {
+        *self
+            .inputs
+            .lock()
+            .unwrap()
+            .entry(kind.to_string())
+            .or_default() += 1;
+        if failed {
+            self.errors.fetch_add(1, Ordering::Relaxed);
+        }
+        self.eval_duration.observe(elapsed);
+    }
+
+    pub fn embedding_computed(&self) {
+        self.embeddings.fetch_add(1, Ordering::Relaxed);
+    }
+
+    pub fn set_memory_entries(&self, region: &str, entries: usize) {
+        self.memory_entries
+            .lock()
+            .unwrap()
+            .insert(region.to_string(), entries);
+    }
+
+    pub fn agent_restarted(&self, agent: &str) {
+        *self
+            .restarts
+            .lock()
+            .unwrap()
+            .entry(agent.to_string())
+            .or_default() += 1;
+    }
+
+    /// Record what one `handler` run of `agent` did to its goal; nothing
+    /// for agents that report no progress.
+    pub fn goal_progressed(&self, agent: &str, handler: &str, before: &Reading, after: &Reading) {
+        let Some(progress) = after.progress.or(before.progress) else {
+            return;
+        };
+        self.goal_progress
+            .lock()
+            .unwrap()
+            .insert(agent.to_string(), progress);
+        *self
+            .goal_change
+            .lock()
+            .unwrap()
+            .entry((agent.to_string(), handler.to_string()))
+            .or_default() += progress - before.progress.unwrap_or(0.0);
+        if before.achieved.is_none() && after.achieved.is_some() {
+            *self
+                .goals_achieved
+                .lock()
+                .unwrap()
+                .entry(agent.to_string())
+                .or_default() += 1;
+        }
+    }
+
+    /// Record one `train from` pass of `agent`.
+    pub fn trained(&self, agent: &str, report: &training::Report) {
+        self.train_loss
+            .lock()
+            .unwrap()
+            .insert(agent.to_string(), report.loss);
+        *self
+            .train_examples
+            .lock()
+            .unwrap()
+            .entry(agent.to_string())
+            .or_default() += report.examples as u64;
+    }
+
+    pub fn inputs_processed(&self, kind: &str) -> u64 {
+        self.inputs.lock().unwrap().get(kind).copied().unwrap_or(0)
+    }
+
+    /// All metrics in the Prometheus text format.
+    pub fn render(&self) -> String {
+        let mut out = String::new();
+        out.push_str("# HELP sentience_inputs_processed_total Handler runs by kind.\n");
+        out.push_str("# TYPE sentience_inputs_processed_total counter\n");
+        for (kind, n) in self.inputs.lock().unwrap().iter() {
+            let _ = writeln!(
+                out,
+                "sentience_inputs_processed_total{{handler=\"{}\"}} {}",
+                kind, n
+            );
+        }
+        out.push_str("# HELP sentience_handler_errors_total Handler runs that failed.\n");
+        out.push_str("# TYPE sentience_handler_errors_total counter\n");
+        let _ = writeln!(
+            out,
+            "sentience_handler_errors_total {}",
+            self.errors.load(Ordering::Relaxed)
+        );
+        self.eval_duration.render(
+            &mut out,
+            "sentience_eval_duration_seconds",
+            "Time spent evaluating a handler.",
+        );
+        self.recall_duration.render(
+            &mut out,
+            "sentience_recall_duration_seconds",
+            "Time spent searching memory.",
+        );
+        out.push_str("# HELP sentience_embeddings_computed_total Embed statements evaluated.\n");
+        out.push_str("# TYPE sentience_embeddings_computed_total counter\n");
+        let _ = writeln!(
+            out,
+            "sentience_embeddings_computed_total {}",
+            self.embeddings.load(Ordering::Relaxed)
+        );
+        out.push_str("# HELP sentience_memory_entries Entries per memory region.\n");
+        out.push_str("# TYPE sentience_memory_entries gauge\n");
+        for (region, n) in self.memory_entries.lock().unwrap().iter() {
+            let _ = writeln!(
+                out,
+                "sentience_memory_entries{{region=\"{}\"}} {}",
+                region, n
+            );
+        }
+        out.push_str("# HELP sentience_agent_restarts_total Restarts of crashed agents.\n");
+        out.push_str("# TYPE sentience_agent_restarts_total counter\n");
+        for (agent, n) in self.restarts.lock().unwrap().iter() {
+            let _ = writeln!(
+                out,
+                "sentience_agent_restarts_total{{agent=\"{}\"}} {}",
+                agent, n
+            );
+        }
+        out.push_str(
+            "# HELP sentience_goal_progress Latest goal progress of each agent, from 0 to 1.\n",
+        );
+        out.push_str("# TYPE sentience_goal_progress gauge\n");
+        for (agent, progress) in self.goal_progress.lock().unwrap().iter() {
+            let _ = writeln!(
+                out,
+                "sentience_goal_progress{{agent=\"{}\"}} {}",
+                agent, progress
+            );
+        }
+        out.push_str(
+            "# HELP sentience_goal_progress_change Change in goal progress by agent and handler.\n",
+        );
+        out.push_str("# TYPE sentience_goal_progress_change gauge\n");
+        for ((agent, handler), change) in self.goal_change.lock().unwrap().iter() {
+            let _ = writeln!(
+                out,
+                "sentience_goal_progress_change{{agent=\"{}\",handler=\"{}\"}} {}",
+                agent, handler, change
+            );
+        }
+        out.push_str(
+            "# HELP sentience_goals_achieved_total Handler runs after which a goal was achieved.\n",
+        );
+        out.push_str("# TYPE sentience_goals_achieved_total counter\n");
+        for (agent, n) in self.goals_achieved.lock().unwrap().iter() {
+            let _ = writeln!(
+                out,
+                "sentience_goals_achieved_total{{agent=\"{}\"}} {}",
+                agent, n
+            );
+        }
+        out.push_str("# HELP sentience_train_loss Mean loss of each agent's last training pass.\n");
+        out.push_str("# TYPE sentience_train_loss gauge\n");
+        for (agent, loss) in self.train_loss.lock().unwrap().iter() {
+            let _ = writeln!(out, "sentience_train_loss{{agent=\"{}\"}} {}", agent, loss);
+        }
+        out.push_str("# HELP sentience_train_examples_total Examples agents were trained on.\n");
+        out.push_str("# TYPE sentience_train_examples_total counter\n");
+        for (agent, n) in self.train_examples.lock().unwrap().iter() {
+            let _ = writeln!(
+                out,
+                "sentience_train_examples_total{{agent=\"{}\"}} {}",
+                agent, n
+            );
+        }
+        out
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn renders_prometheus_text() {
+        let metrics = Metrics::default();
+        metrics.handler_finished("input", Duration::from_millis(3), false);
+        metrics.handler_finished("input", Duration::from_secs(2), true);
+        metrics.set_memory_entries("short", 4);
+        metrics.agent_restarted("Echo");
+        let reading = |progress: f64, achieved: Option<&str>| Reading {
+            progress: Some(progress),
+            achieved: achieved.map(str::to_string),
+        };
+        metrics.goal_progressed("Echo", "train", &reading(0.25, None), &reading(0.75, None));
+        metrics.goal_progressed(
+            "Echo",
+            "train",
+            &reading(0.75, None),
+            &reading(1.0, Some("yes")),
+        );
+        metrics.goal_progressed("Quiet", "input", &Reading::default(), &Reading::default());
+        for loss in [0.5, 0.25] {
+            metrics.trained(
+                "Echo",
+                &training::Report {
+                    dataset: "pairs.jsonl".to_string(),
+                    examples: 4,
+                    loss,
+                    exact: 2,
+                    previous_loss: None,
+                },
+            );
+        }
+
+        let text = metrics.render();
+        assert!(text.contains("sentience_inputs_processed_total{handler=\"input\"} 2\n"));
+        assert!(text.contains("sentience_handler_errors_total 1\n"));
+        assert!(text.contains("sentience_eval_duration_seconds_bucket{le=\"0.001\"} 0\n"));
+        assert!(text.contains("sentience_eval_duration_seconds_bucket{le=\"0.005\"} 1\n"));
+        assert!(text.contains("sentience_eval_duration_seconds_bucket{le=\"+Inf\"} 2\n"));
+        assert!(text.contains("sentience_eval_duration_seconds_sum 2.003\n"));
+        assert!(text.contains("sentience_memory_entries{region=\"short\"} 4\n"));
+        assert!(text.contains("sentience_agent_restarts_total{agent=\"Echo\"} 1\n"));
+        assert!(text.contains("sentience_goal_progress{agent=\"Echo\"} 1\n"));
+        assert!(text
+            .contains("sentience_goal_progress_change{agent=\"Echo\",handler=\"train\"} 0.75\n"));
+        assert!(text.contains("sentience_goals_achieved_total{agent=\"Echo\"} 1\n"));
+        assert!(text.contains("sentience_train_loss{agent=\"Echo\"} 0.25\n"));
+        assert!(text.contains("sentience_train_examples_total{agent=\"Echo\"} 8\n"));
+        assert!(!text.contains("Quiet"));
+    }
+}
@@ -0,0 +1,251 @@
+//! Literate programs: a Markdown document whose ```` ```sentience ```` blocks
+//! run in order against one agent context, like the cells of a notebook,
+//! with what each printed written after it. `sentience-repl notebook
+//! guide.md` writes `guide.out.md`.
+//!
+//! A block holds what could be typed at the REPL prompt, dot-commands such
+//! as `.input hello` included. Its output goes in an ```` ```output ````
+//! block right after it. Output blocks already there, from an earlier run,
+//! are replaced, so a rendered document can be run again. Other fenced
+//! blocks are left as they are.
+
+use crate::context::AgentContext;
+use crate::jupyter::Output;
+use crate::replkit::Repl;
+use crate::transcript::fence;
+use std::io;
+
+/// Info string of the blocks that run.
+pub const LANGUAGE: &str = "sentience";
+/// Info string of the blocks holding their output.
+pub const OUTPUT: &str = "output";
+
+/// A document after running it.
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+pub struct Rendered {
+    pub text: String,
+    /// Blocks that ran.
+    pub blocks: usize,
+    /// Blocks whose output reports an error.
+    pub errors: usize,
+}
+
+/// Runs the blocks of documents in one REPL, so later blocks, and later
+/// documents, see the agents and memory of earlier ones.
+pub struct Notebook {
+    repl: Repl<io::Empty, Output>,
+    output: Output,
+}
+
+impl Default for Notebook {
+    fn default() -> Self {
+        let output = Output::default();
+        let mut repl = Repl::new(io::empty(), output.clone());
+        repl.set_prompt("");
+        Self { repl, output }
+    }
+}
+
+impl Notebook {
+    /// The context blocks run in, e.g. to configure its sandbox.
+    pub fn context_mut(&mut self) -> &mut AgentContext {
+        self.repl.context_mut()
+    }
+
+    /// Run the blocks of `document` and return it with their output.
+    pub fn render(&mut self, document: &str) -> io::Result<Rendered> {
+        let mut rendered = Rendered::default();
+        let mut lines = document.split_inclusive('\n').peekable();
+        while let Some(line) = lines.next() {
+            let Some(open) = Fence::open(line) else {
+                rendered.text.push_str(line);
+                continue;
+            };
+            rendered.text.push_str(line);
+            let mut code = String::new();
+            for line in lines.by_ref() {
+                rendered.text.push_str(line);
+                if open.closes(line) {
+                    break;
+                }
+                code.push_str(line);
+            }
+            if open.language != LANGUAGE {
+                continue;
+            }
+
+            self.repl.eval_lines(&code)?;
+            let output = self.output.take();
+            rendered.blocks += 1;
+            if output.lines().any(|line| line.starts_with("Error")) {
+                rendered.errors += 1;
+            }
+
+            // Drop the output of an earlier run, with the blank lines before it.
+            let mut blank = Vec::new();
+            while let Some(line) = lines.next_if(|line| line.trim().is_empty()) {
+                blank.push(line);
+            }
+            if lines
+                .peek()
+                .and_then(|line| Fence::open(line))
+                .is_some_and(|next| next.language == OUTPUT)
+            {
+                let old = Fence::open(lines.next().unwrap_or_default());
+                for line in lines.by_ref() {
+                    if old.as_ref().is_some_and(|old| old.closes(line)) {
+                        break;
+                    }
+                }
+                blank.clear();
+                blank.extend(lines.next_if(|line| line.trim().is_empty()));
+            }
+
+            if !rendered.text.ends_with('\n') {
+                rendered.text.push('\n');
+            }
+            if !output.is_empty() {
+                let fence = fence(&output);
+                rendered.text.push_str(&format!(
+                    "\n{}{}\n{}\n{}\n",
+                    fence,
+                    OUTPUT,
+                    output.trim_end_matches('\n'),
+                    fence
+                ));
+                if blank.is_empty() && lines.peek().is_some() {
+                    blank.push("\n");
+                }
+            }
+            rendered.text.extend(blank);
+        }
+        Ok(rendered)
+    }
+}
+
+/// The opening line of a fenced code block.
+struct Fence {
+    marker: char,
+    len: usize,
+    /// First word of the info string.
+    language: String,
+}
+
+impl Fence {
+    fn open(line: &str) -> Option<Self> {
+        let trimmed = line.trim_start();
+        let marker = trimmed.chars().next().filter(|c| *c == '`' || *c == '~')?;
+        let len = trimmed.chars().take_while(|c| *c == marker).count();
+        let info = &trimmed[len..];
+        if len < 3 || (marker == '`' && info.contains('`')) {
+            return None;
+        }
+        Some(Self {
+            marker,
+            len,
+            language: info
+                .split_whitespace()
+                .next()
+                .unwrap_or_default()
+                .to_string(),
+        })
+    }
+
+    fn closes(&self, line: &str) -> bool {
+        let trimmed = line.trim();
+        trimmed.len() >= self.len && trimmed.chars().all(|c| c == self.marker)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn runs_blocks_in_order_and_replaces_old_output() {
+        let document = concat!(
+            "# Echo\n",
+            "\n",
+            "```sentience\n",
+            "agent Echo {\n",
+            "  on input(msg) {\n",
+            "    reflect { mem.short[\"msg\"] }\n",
+            "  }\n",
+            "}\n",
+            "```\n",
+            "\n",
+            "```output\n",
+            "stale\n",
+            "```\n",
+            "\n",
+            "It repeats what it hears:\n",
+            "\n",
+            "````markdown\n",
+            "```sentience\n",
+            ".input not run\n",
+            "```\n",
+            "````\n",
+            "\n",
+            "```sentience\n",
+            ".input hello\n",
+            ".nope\n",
+            "```\n",
+            "```sentience\n",
+            "mem short\n",
+            "```",
+        );
+        let rendered = Notebook::default().render(document).unwrap();
+        assert_eq!(rendered.blocks, 3);
+        assert_eq!(rendered.errors, 0);
+        let expected = concat!(
+            "# Echo\n",
+            "\n",
+            "```sentience\n",
+            "agent Echo {\n",
+            "  on input(msg) {\n",
+            "    reflect { mem.short[\"msg\"] }\n",
+            "  }\n",
+            "}\n",
+            "```\n",
+            "\n",
+            "```output\n",
+            "Agent: Echo\n",
+            "Agent: Echo [registered]\n",
+            "```\n",
+            "\n",
+            "It repeats what it hears:\n",
+            "\n",
+            "````markdown\n",
+            "```sentience\n",
+            ".input not run\n",
+            "```\n",
+            "````\n",
+            "\n",
+            "```sentience\n",
+            ".input hello\n",
+            ".nope\n",
+            "```\n",
+            "\n",
+            "```output\n",
+            "    hello\n",
+            "Unknown command: .nope\n",
+            "```\n",
+            "\n",
+            "```sentience\n",
+            "mem short\n",
+            "```\n",
+        );
+        assert_eq!(rendered.text, expected);
+
+        let again = Notebook::default().render(&rendered.text).unwrap();
+        assert_eq!(again.text, expected);
+
+        let failed = Notebook::default()
+            .render("```sentience\n.input hi\n```\n")
+            .unwrap();
+        assert_eq!(failed.errors, 1);
+        assert!(failed
+            .text
+            .ends_with("```output\nError[SEN4001]: no agent registered\n```\n"));
+    }
+}
@@ -0,0 +1,520 @@
+//! Modules shared between programs. `sentience-repl get
+//! github.com/ana/greeter` fetches a module into a local cache and pins it
+//! in `sentience.lock`; `import github.com/ana/greeter` then runs it like a
+//! module of the [standard library](crate::stdlib).
+//!
+//! A module is a `.sent` file in a GitHub repository:
+//! `github.com/<owner>/<repo>` is `<repo>.sent` at the root of the
+//! repository, and `github.com/<owner>/<repo>/<path>` is `<path>.sent`. A
+//! version, as in `github.com/ana/greeter@v1.2.0`, is a tag or branch;
+//! without one the default branch is fetched. The lockfile records the
+//! commit it resolved to and the SHA-256 of the source, so everyone with
+//! the lockfile imports the same code, and `get` without a module fetches
+//! what it records. Modules a fetched module imports are fetched with it.
+
+use crate::embedded::compile;
+use crate::error::{RuntimeError, RuntimeErrorKind};
+use crate::stdlib;
+use crate::types::{Program, Statement};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::PathBuf;
+use std::time::Duration;
+
+/// Name of the lockfile, looked for in the working directory.
+pub const LOCKFILE: &str = "sentience.lock";
+/// Host of the modules that can be fetched.
+pub const HOST: &str = "github.com";
+/// Version recorded for a module fetched without one.
+const DEFAULT_VERSION: &str = "HEAD";
+
+/// What the lockfile pins: each module by path, without a version.
+#[derive(Clone, Debug, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Lock {
+    pub modules: BTreeMap<String, Locked>,
+}
+
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Locked {
+    /// The tag or branch asked for, or `HEAD`.
+    pub version: String,
+    pub commit: String,
+    /// SHA-256 of the source, in hex.
+    pub sha256: String,
+}
+
+/// Where fetched modules are cached and pinned.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct Packages {
+    /// Directory fetched sources are kept in, by path and commit. Defaults
+    /// to `$SENTIENCE_MODULES`, or `sentience/modules` in the user's cache
+    /// directory.
+    pub cache: PathBuf,
+    pub lockfile: PathBuf,
+}
+
+impl Default for Packages {
+    fn default() -> Self {
+        Self {
+            cache: cache_dir(),
+            lockfile: PathBuf::from(LOCKFILE),
+        }
+    }
+}
+
+fn cache_dir() -> PathBuf {
+    if let Some(dir) = std::env::var_os("SENTIENCE_MODULES") {
+        return dir.into();
+    }
+    let cache = if cfg!(windows) {
+        std::env::var_os("LOCALAPPDATA").map(PathBuf::from)
+    } else {
+        std::env::var_os("XDG_CACHE_HOME")
+            .map(PathBuf::from)
+            .or_else(|| std::env::var_os("HOME").map(|home| PathBuf::from(home).join(".cache")))
+    };
+    cache
+        .unwrap_or_else(|| PathBuf::from(".sentience"))
+        .join("sentience")
+        .join("modules")
+}
+
+/// A module path split into its parts.
+struct Module<'a> {
+    /// `github.com/<owner>/<repo>[/<path>]`, the key in the lockfile.
+    path: &'a str,
+    version: Option<&'a str>,
+    owner: &'a str,
+    repo: &'a str,
+    /// The source file in the repository.
+    file: String,
+}
+
+impl<'a> Module<'a> {
+    fn parse(module: &'a str) -> Option<Self> {
+        let (path, version) = match module.split_once('@') {
+            Some((path, version)) => (path, Some(version).filter(|v| !v.is_empty())),
+            None => (module, None),
+        };
+        let mut parts = path.split('/');
+        if parts.next() != Some(HOST) {
+            return None;
+        }
+        let owner = parts.next().filter(|owner| !owner.is_empty())?;
+        let repo = parts.next().filter(|repo| !repo.is_empty())?;
+        let rest: Vec<&str> = parts.collect();
+        if rest.iter().any(|part| part.is_empty() || *part == "..") {
+            return None;
+        }
+        let file = if rest.is_empty() {
+            format!("{}.sent", repo)
+        } else {
+            format!("{}.sent", rest.join("/"))
+        };
+        Some(Self {
+            path,
+            version,
+            owner,
+            repo,
+            file,
+        })
+    }
+}
+
+/// Where `get` downloads modules from.
+pub trait Source {
+    /// The commit `reference`, a tag, branch or `HEAD`, points to.
+    fn commit(&self, owner: &str, repo: &str, reference: &str) -> Result<String, String>;
+
+    /// The contents of `file` at `commit`.
+    fn file(&self, owner: &str, repo: &str, commit: &str, file: &str) -> Result<String, String>;
+}
+
+/// Modules on GitHub, read through its API and raw file host.
+pub struct GitHub {
+    client: reqwest::blocking::Client,
+}
+
+impl GitHub {
+    pub fn new() -> Result<Self, String> {
+        let client = reqwest::blocking::Client::builder()
+            .timeout(Duration::from_secs(30))
+            .user_agent(concat!("sentience/", env!("CARGO_PKG_VERSION")))
+            .build()
+            .map_err(|e| e.to_string())?;
+        Ok(Self { client })
+    }
+
+    fn text(&self, url: &str, accept: &str) -> Result<String, String> {
+        let response = self
+            .client
+            .get(url)
+            .header("Accept", accept)
+            .send()
+            .map_err(|e| e.to_string())?;
+        let status = response.status();
+        if !status.is_success() {
+            return Err(format!("{} answered {}", url, status));
+        }
+        response.text().map_err(|e| e.to_string())
+    }
+}
+
+impl Source for GitHub {
+    fn commit(&self, owner: &str, repo: &str, reference: &str) -> Result<String, String> {
+        let url = format!(
+            "https://api.github.com/repos/{}/{}/commits/{}",
+            owner, repo, reference
+        );
+        Ok(self
+            .text(&url, "application/vnd.github.sha")?
+            .trim()
+            .to_string())
+    }
+
+    fn file(&self, owner: &str, repo: &str, commit: &str, file: &str) -> Result<String, String> {
+        let url = format!(
+            "https://raw.githubusercontent.com/{}/{}/{}/{}",
+            owner, repo, commit, file
+        );
+        self.text(&url, "text/plain")
+    }
+}
+
+impl Packages {
+    pub fn read_lock(&self) -> Result<Lock, String> {
+        match fs::read_to_string(&self.lockfile) {
+            Ok(text) => serde_json::from_str(&text)
+                .map_err(|e| format!("{}: {}", self.lockfile.display(), e)),
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(Lock::default()),
+            Err(e) => Err(format!("{}: {}", self.lockfile.display(), e)),
+        }
+    }
+
+    pub fn write_lock(&self, lock: &Lock) -> Result<(), String> {
+        let text = serde_json::to_string_pretty(lock).map_err(|e| e.to_string())? + "\n";
+        fs::write(&self.lockfile, text).map_err(|e| format!("{}: {}", self.lockfile.display(), e))
+    }
+
+    fn cached(&self, path: &str, commit: &str) -> PathBuf {
+        self.cache.join(path).join(format!("{}.sent", commit))
+    }
+
+    /// The program of `module`: one of the standard library, or one
+    /// fetched with [`get`](Self::get), as the lockfile pins it.
+    pub fn load(&self, module: &str) -> Result<Program, RuntimeError> {
+        self.load_from(module, &mut Vec::new())
+    }
+
+    /// [`load`](Self::load) `module`, checking that nothing it imports
+    /// imports a module in `importing` again.
+    fn load_from(
+        &self,
+        module: &str,
+        importing: &mut Vec<String>,
+    ) -> Result<Program, RuntimeError> {
+        if module.starts_with(stdlib::PREFIX) {
+            return stdlib::get(module)
+                .map(|module| module.program().clone())
+                .ok_or_else(|| unknown(module));
+        }
+        let parsed = Module::parse(module).ok_or_else(|| unknown(module))?;
+        if importing.iter().any(|path| path == parsed.path) {
+            return Err(import_error(format!(
+                "import cycle: {} -> {}",
+                importing.join(" -> "),
+                parsed.path
+            )));
+        }
+        let lock = self.read_lock().map_err(import_error)?;
+        let locked = lock.modules.get(parsed.path).ok_or_else(|| {
+            import_error(format!(
+                "`{}` is not in {}; run `sentience-repl get {}`",
+                parsed.path,
+                self.lockfile.display(),
+                module
+            ))
+        })?;
+        if parsed
+            .version
+            .is_some_and(|version| version != locked.version)
+        {
+            return Err(import_error(format!(
+                "`{}` is locked at {}; run `sentience-repl get {}` to change it",
+                parsed.path, locked.version, module
+            )));
+        }
+        let source =
+            fs::read_to_string(self.cached(parsed.path, &locked.commit)).map_err(|_| {
+                import_error(format!(
+                    "`{}` is not in the module cache; run `sentience-repl get`",
+                    parsed.path
+                ))
+            })?;
+        if checksum(&source) != locked.sha256 {
+            return Err(import_error(format!(
+                "`{}` does not match its checksum in {}; run `sentience-repl get`",
+                parsed.path,
+                self.lockfile.display()
+            )));
+        }
+        let program = compile(parsed.path, &source).map_err(|e| import_error(e.to_string()))?;
+        importing.push(parsed.path.to_string());
+        for nested in imports(&program.statements) {
+            self.load_from(nested, importing)?;
+        }
+        importing.pop();
+        Ok(program)
+    }
+
+    /// Fetch `module`, and the modules it imports that are not fetched
+    /// yet, from `source` into the cache, and pin them in the lockfile.
+    /// Returns the paths fetched.
+    pub fn get(&self, module: &str, source: &dyn Source) -> Result<Vec<String>, String> {
+        let mut lock = self.read_lock()?;
+        let mut fetched: Vec<String> = Vec::new();
+        let mut queue = vec![module.to_string()];
+        while let Some(next) = queue.pop() {
+            if next.starts_with(stdlib::PREFIX) {
+                continue;
+            }
+            let parsed = Module::parse(&next).ok_or_else(|| {
+                format!(
+                    "`{}` is not a module path; expected {}/<owner>/<repo>[/<path>][@<version>]",
+                    next, HOST
+                )
+            })?;
+            if fetched.iter().any(|path| path == parsed.path) {
+                continue;
+            }
+            let dependency = !fetched.is_empty();
+            if dependency {
+                if let Some(locked) = lock.modules.get(parsed.path) {
+                    if self.cached(parsed.path, &locked.commit).exists() {
+                        continue;
+                    }
+                }
+            }
+            let version = parsed.version.unwrap_or(DEFAULT_VERSION);
+            let commit = source.commit(parsed.owner, parsed.repo, version)?;
+            if commit.is_empty() || !commit.chars().all(|c| c.is_ascii_alphanumeric()) {
+                return Err(format!("{} resolved to `{}`, not a commit", next, commit));
+            }
+            let text = source.file(parsed.owner, parsed.repo, &commit, &parsed.file)?;
+            let program = compile(parsed.path, &text).map_err(|e| e.to_string())?;
+            self.store(parsed.path, &commit, &text)?;
+            lock.modules.insert(
+                parsed.path.to_string(),
+                Locked {
+                    version: version.to_string(),
+                    commit,
+                    sha256: checksum(&text),
+                },
+            );
+            fetched.push(parsed.path.to_string());
+            queue.extend(imports(&program.statements).map(str::to_string));
+        }
+        self.write_lock(&lock)?;
+        Ok(fetched)
+    }
+
+    /// Fetch each module the lockfile pins that is missing from the cache,
+    /// at its pinned commit. Returns the paths fetched.
+    pub fn restore(&self, source: &dyn Source) -> Result<Vec<String>, String> {
+        let lock = self.read_lock()?;
+        let mut fetched = Vec::new();
+        for (path, locked) in &lock.modules {
+            let cached = fs::read_to_string(self.cached(path, &locked.commit));
+            if cached.is_ok_and(|text| checksum(&text) == locked.sha256) {
+                continue;
+            }
+            let parsed = Module::parse(path)
+                .ok_or_else(|| format!("{}: `{}` is not a module path", LOCKFILE, path))?;
+            let text = source.file(parsed.owner, parsed.repo, &locked.commit, &parsed.file)?;
+            if checksum(&text) != locked.sha256 {
+                return Err(format!(
+                    "`{}` at {} does not match its checksum in {}",
+                    path,
+                    locked.commit,
+                    self.lockfile.display()
+                ));
+            }
+            self.store(path, &locked.commit, &text)?;
+            fetched.push(path.clone());
+        }
+        Ok(fetched)
+    }
+
+    fn store(&self, path: &str, commit: &str, text: &str) -> Result<(), String> {
+        let file = self.cached(path, commit);
+        if let Some(dir) = file.parent() {
+            fs::create_dir_all(dir).map_err(|e| format!("{}: {}", dir.display(), e))?;
+        }
+        fs::write(&file, text).map_err(|e| format!("{}: {}", file.display(), e))
+    }
+}
+
+/// The modules `statements` import, at any depth.
+pub fn imports(statements: &[Statement]) -> impl Iterator<Item = &str> {
+    let mut found = Vec::new();
+    collect_imports(statements, &mut found);
+    found.into_iter()
+}
+
+fn collect_imports<'a>(statements: &'a [Statement], found: &mut Vec<&'a str>) {
+    for stmt in statements {
+        match stmt {
+            Statement::Import(module) => found.push(module),
+            Statement::AgentDeclaration { body, .. }
+            | Statement::OnInput { body, .. }
+            | Statement::OnSchedule { body, .. }
+            | Statement::OnStart { body }
+            | Statement::OnStop { body }
+            | Statement::OnOutput { body, .. }
+            | Statement::Reflect { body }
+            | Statement::Train { body, .. }
+            | Statement::Evolve { body }
+            | Statement::IfContextIncludes { body, .. }
+            | Statement::IfState { body, .. }
+            | Statement::Function { body, .. }
+            | Statement::While { body, .. }
+            | Statement::For { body, .. }
+            | Statement::If { body, .. }
+            | Statement::IfReward { body, .. } => collect_imports(body, found),
+            Statement::IfElse { branch, otherwise } => {
+                collect_imports(std::slice::from_ref(branch), found);
+                collect_imports(otherwise, found);
+            }
+            _ => {}
+        }
+    }
+}
+
+fn checksum(text: &str) -> String {
+    hex::encode(Sha256::digest(text.as_bytes()))
+}
+
+fn unknown(module: &str) -> RuntimeError {
+    RuntimeError::new(RuntimeErrorKind::UnknownModule(module.to_string()))
+}
+
+fn import_error(message: String) -> RuntimeError {
+    RuntimeError::new(RuntimeErrorKind::Import(message))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::cell::RefCell;
+    use std::collections::HashMap;
+
+    /// Repositories by `owner/repo`, each with its commits by reference and
+    /// files by `commit/file`.
+    #[derive(Default)]
+    struct Fake {
+        refs: HashMap<String, String>,
+        files: HashMap<String, String>,
+        requests: RefCell<Vec<String>>,
+    }
+
+    impl Source for Fake {
+        fn commit(&self, owner: &str, repo: &str, reference: &str) -> Result<String, String> {
+            let key = format!("{}/{}@{}", owner, repo, reference);
+            self.requests.borrow_mut().push(key.clone());
+            self.refs.get(&key).cloned().ok_or(format!("no {}", key))
+        }
+
+        fn file(
+            &self,
+            owner: &str,
+            repo: &str,
+            commit: &str,
+            file: &str,
+        ) -> Result<String, String> {
+            let key = format!("{}/{}/{}/{}", owner, repo, commit, file);
+            self.requests.borrow_mut().push(key.clone());
+            self.files.get(&key).cloned().ok_or(format!("no {}", key))
+        }
+    }
+
+    #[test]
+    fn parses_module_paths() {
+        let module = Module::parse("github.com/ana/agents/chat/greeter@v1.2.0").unwrap();
+        assert_eq!(module.path, "github.com/ana/agents/chat/greeter");
+        assert_eq!(module.version, Some("v1.2.0"));
+        assert_eq!((module.owner, module.repo), ("ana", "agents"));
+        assert_eq!(module.file, "chat/greeter.sent");
+        assert_eq!(
+            Module::parse("github.com/ana/greeter").unwrap().file,
+            "greeter.sent"
+        );
+        assert!(Module::parse("gitlab.com/ana/greeter").is_none());
+        assert!(Module::parse("github.com/ana").is_none());
+        assert!(Module::parse("github.com/ana/agents/../secrets").is_none());
+    }
+
+    #[test]
+    fn fetches_pins_and_loads_modules() {
+        let dir = std::env::temp_dir().join(format!("sentience-packages-{}", std::process::id()));
+        let packages = Packages {
+            cache: dir.join("cache"),
+            lockfile: dir.join(LOCKFILE),
+        };
+        let mut source = Fake::default();
+        source
+            .refs
+            .insert("ana/greeter@v1".to_string(), "c1".to_string());
+        source
+            .refs
+            .insert("ana/words@HEAD".to_string(), "c2".to_string());
+        source.files.insert(
+            "ana/greeter/c1/greeter.sent".to_string(),
+            "import std/text\nimport github.com/ana/words\nagent Greeter {\n}\n".to_string(),
+        );
+        source.files.insert(
+            "ana/words/c2/words.sent".to_string(),
+            "template hello = \"Hello {name}\"\n".to_string(),
+        );
+
+        let err = packages.load("github.com/ana/greeter").unwrap_err();
+        assert_eq!(err.code(), "SEN4014");
+        assert_eq!(
+            packages.get("github.com/ana/greeter@v1", &source).unwrap(),
+            ["github.com/ana/greeter", "github.com/ana/words"]
+        );
+        let lock = packages.read_lock().unwrap();
+        assert_eq!(lock.modules["github.com/ana/greeter"].version, "v1");
+        assert_eq!(lock.modules["github.com/ana/words"].commit, "c2");
+        let program = packages.load("github.com/ana/greeter@v1").unwrap();
+        assert_eq!(program.statements.len(), 3);
+        assert!(packages.load("github.com/ana/greeter@v2").is_err());
+        assert_eq!(
+            packages.load("github.com/ana/nothing").unwrap_err().code(),
+            "SEN4014"
+        );
+        assert_eq!(packages.load("std/nothing").unwrap_err().code(), "SEN4013");
+
+        // A clone with the lockfile but no cache fetches the pinned commits.
+        fs::remove_dir_all(&packages.cache).unwrap();
+        source.requests.borrow_mut().clear();
+        assert_eq!(packages.restore(&source).unwrap().len(), 2);
+        assert!(source.requests.borrow().iter().all(|r| !r.contains('@')));
+        assert!(packages.restore(&source).unwrap().is_empty());
+
+        let cyclic = "import github.com/ana/greeter\n";
+        fs::write(packages.cached("github.com/ana/words", "c2"), cyclic).unwrap();
+        let err = packages.load("github.com/ana/greeter").unwrap_err();
+        assert!(err.to_string().contains("checksum"), "{}", err);
+        let mut lock = packages.read_lock().unwrap();
+        lock.modules.get_mut("github.com/ana/words").unwrap().sha256 = checksum(cyclic);
+        packages.write_lock(&lock).unwrap();
+        let err = packages.load("github.com/ana/greeter").unwrap_err();
+        fs::remove_dir_all(&dir).unwrap();
+        assert_eq!(
+            err.to_string(),
+            "import cycle: github.com/ana/greeter -> github.com/ana/words -> github.com/ana/greeter"
+        );
+    }
+}
@@ -0,0 +1,349 @@
+//! Indexed save format, letting a large saved context start without reading
+//! its long-term memory.
+//!
+//! The file starts with a [`MAGIC`] line, then one line of JSON holding
+//! short-term memory, links, and an index from each long-term key to where
+//! its value is stored. The values follow, each as JSON. Loading reads
+//! only the first two lines; long-term memory is a [`Region`] that reads a
+//! single value when one key is asked for and pages the whole region in on
+//! the first access that needs all of it.
+
+use crate::context::AgentMemory;
+use crate::error::MemoryError;
+use crate::expr::Value;
+use crate::intern::{self, Memory};
+use serde::{Deserialize, Deserializer, Serialize, Serializer};
+use std::collections::{BTreeMap, HashMap};
+use std::fmt;
+use std::fs::{self, File};
+use std::io::{self, BufRead, BufReader, BufWriter, Read, Seek, SeekFrom, Write};
+use std::ops::{Deref, DerefMut};
+use std::path::PathBuf;
+use std::sync::{Arc, OnceLock};
+
+/// First line of an indexed save.
+pub const MAGIC: &str = "SENTIENCE-INDEXED 1";
+
+#[derive(Serialize, Deserialize)]
+struct Header {
+    #[serde(serialize_with = "intern::serialize_sorted")]
+    mem_short: HashMap<String, Value>,
+    #[serde(serialize_with = "intern::serialize_sorted")]
+    links: HashMap<String, String>,
+    /// Offset and length of each long-term value, from the end of the header.
+    #[serde(serialize_with = "intern::serialize_sorted")]
+    mem_long: HashMap<String, (u64, u64)>,
+    /// Affect drives; absent from saves made before they existed.
+    #[serde(default)]
+    state: BTreeMap<String, f64>,
+    /// `mem.shared` and the memory of agents other than the current one,
+    /// read in full with the header.
+    #[serde(
+        default,
+        serialize_with = "intern::serialize_sorted",
+        skip_serializing_if = "HashMap::is_empty"
+    )]
+    mem_shared: HashMap<String, Value>,
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    agents: BTreeMap<String, AgentMemory>,
+}
+
+/// A context read from an indexed save.
+pub struct Loaded {
+    pub mem_short: HashMap<String, Value>,
+    pub links: HashMap<String, String>,
+    pub mem_long: Region,
+    pub state: BTreeMap<String, f64>,
+    pub mem_shared: HashMap<String, Value>,
+    pub agents: BTreeMap<String, AgentMemory>,
+}
+
+/// Write memory in the indexed format. Keys are written in sorted order so
+/// that saving the same memory twice gives the same file.
+pub fn write(
+    path: &str,
+    mem_short: &Memory,
+    mem_long: &Memory,
+    mem_shared: &Memory,
+    agents: &BTreeMap<String, AgentMemory>,
+    links: &HashMap<String, String>,
+    state: &BTreeMap<String, f64>,
+) -> Result<(), MemoryError> {
+    let mut body = Vec::new();
+    let mut index = HashMap::with_capacity(mem_long.len());
+    let sorted: BTreeMap<_, _> = mem_long.iter().collect();
+    for (key, value) in sorted {
+        let start = body.len() as u64;
+        serde_json::to_writer(&mut body, value)?;
+        index.insert(key.to_string(), (start, body.len() as u64 - start));
+    }
+    let header = Header {
+        mem_short: intern::values(mem_short),
+        links: links.clone(),
+        mem_long: index,
+        state: state.clone(),
+        mem_shared: intern::values(mem_shared),
+        agents: agents.clone(),
+    };
+    let mut out = BufWriter::new(File::create(path)?);
+    writeln!(out, "{}", MAGIC)?;
+    serde_json::to_writer(&mut out, &header)?;
+    out.write_all(b"\n")?;
+    out.write_all(&body)?;
+    out.flush()?;
+    Ok(())
+}
+
+/// Whether the file at `path` is an indexed save.
+pub fn is_indexed(path: &str) -> io::Result<bool> {
+    let mut first = vec![0; MAGIC.len() + 1];
+    let mut file = File::open(path)?;
+    match file.read_exact(&mut first) {
+        Ok(()) => Ok(first.starts_with(MAGIC.as_bytes()) && first.ends_with(b"\n")),
+        Err(e) if e.kind() == io::ErrorKind::UnexpectedEof => Ok(false),
+        Err(e) => Err(e),
+    }
+}
+
+/// Read the header of the indexed save at `path`.
+pub fn open(path: &str) -> Result<Loaded, MemoryError> {
+    let mut reader = BufReader::new(File::open(path)?);
+    let mut magic = String::new();
+    reader.read_line(&mut magic)?;
+    if magic.trim_end() != MAGIC {
+        return Err(MemoryError::Format("not an indexed save".to_string()));
+    }
+    let mut line = Vec::new();
+    reader.read_until(b'\n', &mut line)?;
+    let header: Header = serde_json::from_slice(&line)?;
+    let paged = Paged {
+        path: fs::canonicalize(path)?,
+        body_start: (magic.len() + line.len()) as u64,
+        index: header.mem_long,
+    };
+    Ok(Loaded {
+        mem_short: header.mem_short,
+        links: header.links,
+        state: header.state,
+        mem_shared: header.mem_shared,
+        agents: header.agents,
+        mem_long: Region {
+            loaded: OnceLock::new(),
+            paged: Some(Arc::new(paged)),
+        },
+    })
+}
+
+/// Where the values of a region not yet read are in the file.
+struct Paged {
+    path: PathBuf,
+    body_start: u64,
+    index: HashMap<String, (u64, u64)>,
+}
+
+impl Paged {
+    fn value(&self, file: &mut File, (offset, len): (u64, u64)) -> Result<Value, MemoryError> {
+        file.seek(SeekFrom::Start(self.body_start + offset))?;
+        let mut raw = vec![0; len as usize];
+        file.read_exact(&mut raw)?;
+        Ok(serde_json::from_slice(&raw)?)
+    }
+
+    fn get(&self, key: &str) -> Result<Option<Value>, MemoryError> {
+        let Some(&entry) = self.index.get(key) else {
+            return Ok(None);
+        };
+        self.value(&mut File::open(&self.path)?, entry).map(Some)
+    }
+
+    fn load(&self) -> Result<Memory, MemoryError> {
+        let _span = tracing::debug_span!("memory.page_in", entries = self.index.len()).entered();
+        let mut file = File::open(&self.path)?;
+        let mut body = Vec::new();
+        file.seek(SeekFrom::Start(self.body_start))?;
+        file.read_to_end(&mut body)?;
+        let mut memory = Memory::with_capacity(self.index.len());
+        for (key, &(offset, len)) in &self.index {
+            let raw = usize::try_from(offset)
+                .ok()
+                .zip(usize::try_from(offset + len).ok())
+                .and_then(|(start, end)| body.get(start..end))
+                .ok_or_else(|| MemoryError::Format(format!("value of `{}` is truncated", key)))?;
+            memory.insert(intern::intern(key), serde_json::from_slice(raw)?);
+        }
+        Ok(memory)
+    }
+}
+
+/// A memory region that may still be on disk. It dereferences to its
+/// [`Memory`], reading the whole region the first time that happens.
+///
+/// Clones share their entries until one of them is written, which copies
+/// them first, so cloning a region to save it costs nothing and the clone
+/// keeps the entries as they were.
+#[derive(Default)]
+pub struct Region {
+    loaded: OnceLock<Arc<Memory>>,
+    paged: Option<Arc<Paged>>,
+}
+
+impl Region {
+    pub fn new(memory: Memory) -> Self {
+        Region {
+            loaded: OnceLock::from(Arc::new(memory)),
+            paged: None,
+        }
+    }
+
+    /// Whether the entries are in memory.
+    pub fn is_loaded(&self) -> bool {
+        self.loaded.get().is_some()
+    }
+
+    /// The value of `key`, read on its own if the region is still on disk.
+    pub fn lookup(&self, key: &str) -> Option<Value> {
+        match (self.loaded.get(), &self.paged) {
+            (None, Some(paged)) => paged.get(key).unwrap_or_else(|e| {
+                tracing::error!(key, error = %e, "reading paged memory failed");
+                None
+            }),
+            _ => self.get(key).cloned(),
+        }
+    }
+
+    /// Number of entries, without paging the region in.
+    pub fn len(&self) -> usize {
+        match (self.loaded.get(), &self.paged) {
+            (None, Some(paged)) => paged.index.len(),
+            _ => Memory::len(self),
+        }
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.len() == 0
+    }
+
+    /// Approximate size of the keys and values in bytes, without paging the
+    /// region in; values still on disk count as their saved JSON.
+    pub fn bytes(&self) -> usize {
+        match (self.loaded.get(), &self.paged) {
+            (None, Some(paged)) => paged
+                .index
+                .iter()
+                .map(|(key, &(_, len))| key.len() + len as usize)
+                .sum(),
+            _ => self
+                .iter()
+                .map(|(key, value)| key.len() + value.size())
+                .sum(),
+        }
+    }
+
+    fn memory(&self) -> &Memory {
+        self.loaded.get_or_init(|| {
+            Arc::new(match &self.paged {
+                Some(paged) => paged.load().unwrap_or_else(|e| {
+                    tracing::error!(path = %paged.path.display(), error = %e, "paging in memory failed");
+                    Memory::new()
+                }),
+                None => Memory::new(),
+            })
+        })
+    }
+}
+
+impl Deref for Region {
+    type Target = Memory;
+
+    fn deref(&self) -> &Memory {
+        self.memory()
+    }
+}
+
+impl DerefMut for Region {
+    fn deref_mut(&mut self) -> &mut Memory {
+        self.memory();
+        Arc::make_mut(self.loaded.get_mut().expect("region was just loaded"))
+    }
+}
+
+impl From<Memory> for Region {
+    fn from(memory: Memory) -> Self {
+        Region::new(memory)
+    }
+}
+
+impl Clone for Region {
+    fn clone(&self) -> Self {
+        Region {
+            loaded: self.loaded.clone(),
+            paged: self.paged.clone(),
+        }
+    }
+}
+
+impl fmt::Debug for Region {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self.loaded.get() {
+            Some(memory) => memory.fmt(f),
+            None => write!(f, "Region {{ paged: {} entries }}", self.len()),
+        }
+    }
+}
+
+impl Serialize for Region {
+    fn serialize<S: Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+        intern::serialize_sorted(self.memory(), serializer)
+    }
+}
+
+impl<'de> Deserialize<'de> for Region {
+    fn deserialize<D: Deserializer<'de>>(deserializer: D) -> Result<Self, D::Error> {
+        Memory::deserialize(deserializer).map(Region::new)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn reads_single_values_before_paging_in() {
+        let path = std::env::temp_dir().join(format!("paged-{}.ctx", std::process::id()));
+        let path = path.to_str().unwrap();
+        let mut long = Memory::new();
+        long.insert(intern::intern("city"), "Belgrade".into());
+        long.insert(intern::intern("quote"), "say \"hi\"\nbye".into());
+        long.insert(intern::intern("visits"), Value::Int(12));
+        let mut short = Memory::new();
+        short.insert(intern::intern("msg"), "hello".into());
+        let none = Memory::new();
+        write(
+            path,
+            &short,
+            &long,
+            &none,
+            &BTreeMap::new(),
+            &HashMap::new(),
+            &BTreeMap::new(),
+        )
+        .unwrap();
+        assert!(is_indexed(path).unwrap());
+
+        let loaded = open(path).unwrap();
+        assert_eq!(loaded.mem_short["msg"], "hello".into());
+        let region = loaded.mem_long;
+        assert_eq!(region.len(), 3);
+        assert_eq!(region.lookup("quote"), Some("say \"hi\"\nbye".into()));
+        assert_eq!(region.lookup("visits"), Some(Value::Int(12)));
+        assert_eq!(region.lookup("missing"), None);
+        assert!(!region.is_loaded());
+        // Values on disk count with their JSON quotes and escapes.
+        assert_eq!(region.bytes(), 44);
+
+        assert_eq!(*region, long);
+        assert!(region.is_loaded());
+        assert_eq!(region.bytes(), 37);
+        let _ = fs::remove_file(path);
+    }
+}
@@ -0,0 +1,307 @@
+//! Running the agents of one program side by side.
+//!
+//! A program declaring several agents is [`split`] into one program per
+//! agent, each loaded into its own [`SentienceAgent`] with its own memory.
+//! An [`AgentSet`] then runs their handlers on a pool of worker threads.
+//! Each agent is locked on its own, so one agent's work never waits for
+//! another's, while two jobs for the same agent still run one at a time.
+//! Agents that are linked to each other are run one at a time; see
+//! [`AgentSet::independent`].
+//!
+//! A `pipeline A -> B -> C` statement chains agents instead: see
+//! [`AgentSet::pipeline`].
+
+use crate::adapters::InputMessage;
+use crate::error::RuntimeError;
+use crate::types::{Program, Statement};
+use crate::SentienceAgent;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::{Mutex, MutexGuard};
+use std::thread;
+
+/// One program per agent declared in `program`. Statements outside any
+/// agent are kept in each, in their original order.
+pub fn split(program: &Program) -> Vec<Program> {
+    let agents = program
+        .statements
+        .iter()
+        .enumerate()
+        .filter(|(_, stmt)| matches!(stmt, Statement::AgentDeclaration { .. }))
+        .map(|(index, _)| index);
+    agents
+        .map(|agent| Program {
+            statements: program
+                .statements
+                .iter()
+                .enumerate()
+                .filter(|(index, stmt)| {
+                    *index == agent || !matches!(stmt, Statement::AgentDeclaration { .. })
+                })
+                .map(|(_, stmt)| stmt.clone())
+                .collect(),
+        })
+        .collect()
+}
+
+/// Name of the last agent declared in `program`, e.g. one from [`split`].
+pub fn agent_name(program: &Program) -> Option<&str> {
+    program.statements.iter().rev().find_map(|stmt| match stmt {
+        Statement::AgentDeclaration { name, .. } => Some(name.as_str()),
+        _ => None,
+    })
+}
+
+/// Agent names of the last `pipeline` declared outside any agent.
+pub fn pipeline(program: &Program) -> Option<Vec<String>> {
+    program.statements.iter().rev().find_map(|stmt| match stmt {
+        Statement::Pipeline { stages } => Some(stages.clone()),
+        _ => None,
+    })
+}
+
+/// Agents run by a pool of worker threads.
+pub struct AgentSet {
+    agents: Vec<Member>,
+    workers: usize,
+}
+
+struct Member {
+    name: String,
+    agent: Mutex<SentienceAgent>,
+}
+
+impl AgentSet {
+    /// Run `agents` on as many workers as the machine has cores, or on one
+    /// if they are not [independent](Self::independent).
+    pub fn new(agents: Vec<SentienceAgent>) -> Self {
+        let agents: Vec<Member> = agents
+            .into_iter()
+            .map(|agent| Member {
+                name: agent.describe().map(|info| info.name).unwrap_or_default(),
+                agent: Mutex::new(agent),
+            })
+            .collect();
+        let mut set = AgentSet { agents, workers: 1 };
+        if set.independent() {
+            set.workers = thread::available_parallelism().map_or(1, |n| n.get());
+        }
+        set
+    }
+
+    /// Use at most `workers` threads; 1 runs everything on the caller's.
+    pub fn with_workers(mut self, workers: usize) -> Self {
+        self.workers = workers.max(1);
+        self
+    }
+
+    pub fn len(&self) -> usize {
+        self.agents.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.agents.is_empty()
+    }
+
+    pub fn workers(&self) -> usize {
+        self.workers
+    }
+
+    /// Agent names, in declaration order; indexes into the set.
+    pub fn names(&self) -> Vec<&str> {
+        self.agents.iter().map(|m| m.name.as_str()).collect()
+    }
+
+    /// Index of the agent named `name`.
+    pub fn position(&self, name: &str) -> Option<usize> {
+        self.agents.iter().position(|m| m.name == name)
+    }
+
+    /// Whether no agent is linked to another, so they can run at once.
+    pub fn independent(&self) -> bool {
+        let names = self.names();
+        self.agents.iter().all(|member| {
+            let links = member
+                .agent
+                .lock()
+                .unwrap_or_else(|e| e.into_inner())
+                .describe()
+                .map(|info| info.links)
+                .unwrap_or_default();
+            links.iter().all(|(from, to)| {
+                !names
+                    .iter()
+                    .any(|name| *name != member.name && (name == from || name == to))
+            })
+        })
+    }
+
+    /// Lock the agent at `index`, waiting for any job running on it.
+    pub fn lock(&self, index: usize) -> MutexGuard<'_, SentienceAgent> {
+        self.agents[index]
+            .agent
+            .lock()
+            .unwrap_or_else(|e| e.into_inner())
+    }
+
+    /// Indexes of the agents that panicked while locked since the last call,
+    /// e.g. in a [`pipeline`](Self::pipeline) whose panic was caught. Their
+    /// locks work again afterwards.
+    pub fn panicked(&self) -> Vec<usize> {
+        self.agents
+            .iter()
+            .enumerate()
+            .filter(|(_, member)| member.agent.is_poisoned())
+            .map(|(index, member)| {
+                member.agent.clear_poison();
+                index
+            })
+            .collect()
+    }
+
+    /// Run `f` for each job on the agent it names, and return the results
+    /// in the order of `jobs`.
+    pub fn run<J, T, F>(&self, jobs: Vec<(usize, J)>, f: F) -> Vec<(usize, T)>
+    where
+        J: Send,
+        T: Send,
+        F: Fn(&mut SentienceAgent, J) -> T + Sync,
+    {
+        let jobs: Vec<Mutex<Option<(usize, J)>>> =
+            jobs.into_iter().map(|job| Mutex::new(Some(job))).collect();
+        let results: Vec<Mutex<Option<(usize, T)>>> =
+            jobs.iter().map(|_| Mutex::new(None)).collect();
+        let next = AtomicUsize::new(0);
+        let work = || loop {
+            let i = next.fetch_add(1, Ordering::Relaxed);
+            let Some(job) = jobs.get(i) else {
+                return;
+            };
+            let Some((index, job)) = job.lock().unwrap_or_else(|e| e.into_inner()).take() else {
+                continue;
+            };
+            let result = f(&mut self.lock(index), job);
+            *results[i].lock().unwrap_or_else(|e| e.into_inner()) = Some((index, result));
+        };
+        let workers = self.workers.min(jobs.len());
+        if workers <= 1 {
+            work();
+        } else {
+            thread::scope(|scope| {
+                for _ in 0..workers {
+                    scope.spawn(work);
+                }
+            });
+        }
+        results
+            .into_iter()
+            .filter_map(|result| result.into_inner().unwrap_or_else(|e| e.into_inner()))
+            .collect()
+    }
+
+    /// Give `input` to every agent's `on input` handler.
+    pub fn input(&self, input: &str) -> Vec<(usize, Result<String, RuntimeError>)> {
+        let jobs = (0..self.len()).map(|index| (index, input)).collect();
+        self.run(jobs, |agent, input| agent.handle_input(input))
+    }
+
+    /// Give `input` to the `on input` handler of the first of `stages`, and
+    /// each agent's output to the next one, with the name of the agent it
+    /// came from in `mem.short["input.from"]`. Returns what the last agent
+    /// answered, or the index of the agent that failed and its error.
+    pub fn pipeline(&self, stages: &[usize], input: &str) -> Result<String, (usize, RuntimeError)> {
+        let mut output = input.to_string();
+        let mut from: Option<usize> = None;
+        for &index in stages {
+            let message = match from {
+                Some(from) => {
+                    InputMessage::new(&output).with_metadata("from", &self.agents[from].name)
+                }
+                None => InputMessage::new(&output),
+            };
+            output = self
+                .lock(index)
+                .handle_message(&message)
+                .map_err(|e| (index, e))?;
+            from = Some(index);
+        }
+        Ok(output)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::lexer::Lexer;
+    use crate::parser::Parser;
+
+    fn agents(source: &str) -> Vec<SentienceAgent> {
+        let mut lexer = Lexer::new(source);
+        let program = Parser::new(&mut lexer).parse_program();
+        split(&program)
+            .iter()
+            .map(|program| {
+                let mut agent = SentienceAgent::new();
+                agent.run_program(program).unwrap();
+                agent
+            })
+            .collect()
+    }
+
+    #[test]
+    fn runs_each_agent_with_its_own_memory() {
+        let set = AgentSet::new(agents(
+            "agent A {\n  on input(msg) {\n    print \"a\"\n  }\n}\nagent B {\n  on input(msg) {\n    print \"b\"\n  }\n}",
+        ))
+        .with_workers(2);
+        assert_eq!(set.names(), ["A", "B"]);
+        assert!(set.independent());
+
+        let outputs: Vec<_> = set
+            .input("hi")
+            .into_iter()
+            .map(|(index, output)| (index, output.unwrap()))
+            .collect();
+        assert_eq!(outputs, [(0, "a".to_string()), (1, "b".to_string())]);
+
+        set.lock(0).set_long("k", "v");
+        assert_eq!(set.lock(1).get_mem("long", "k").unwrap(), "");
+    }
+
+    #[test]
+    fn pipes_each_agent_output_to_the_next() {
+        let source = concat!(
+            "agent Perception {\n  on input(msg) {\n    print \"seen\"\n  }\n}\n",
+            "agent Reasoning {\n  on input(msg) {\n    print \"thought\"\n  }\n}\n",
+            "agent Speech {\n  on input(msg) {\n    if context includes [\"thought\"] {\n      print \"said\"\n    }\n  }\n}\n",
+            "pipeline Perception -> Reasoning -> Speech\n",
+        );
+        let mut lexer = Lexer::new(source);
+        let program = Parser::new(&mut lexer).parse_program();
+        let set = AgentSet::new(agents(source));
+        let stages: Vec<usize> = pipeline(&program)
+            .unwrap()
+            .iter()
+            .map(|name| set.position(name).unwrap())
+            .collect();
+        assert_eq!(stages, [0, 1, 2]);
+
+        assert_eq!(set.pipeline(&stages, "hi").unwrap(), "said");
+        assert_eq!(set.lock(1).get_mem("short", "msg").unwrap(), "seen");
+        assert_eq!(
+            set.lock(2).get_mem("short", "input.from").unwrap(),
+            "Reasoning"
+        );
+        assert_eq!(set.lock(0).get_mem("short", "input.from").unwrap(), "");
+    }
+
+    #[test]
+    fn linked_agents_run_one_at_a_time() {
+        let mut set = agents("agent A {\n}\nagent B {\n}");
+        let mut snapshot = set[0].snapshot();
+        snapshot.links.insert("A".to_string(), "B".to_string());
+        set[0].restore(snapshot);
+        let set = AgentSet::new(set);
+        assert!(!set.independent());
+        assert_eq!(set.workers(), 1);
+    }
+}
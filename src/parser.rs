@@ -1,10 +1,36 @@
+use crate::error::{ParseError, ParseErrorKind};
+use crate::lang::{self, Version};
 use crate::lexer::{Lexer, Token, TokenType};
-use crate::types::{Program, Statement};
+use crate::reward;
+use crate::schedule;
+use crate::types::{BinaryOp, Expr, Mutation, Program, Statement, Text, UnaryOp, UNARY_PRECEDENCE};
+use std::collections::HashSet;
+
+/// Deepest nesting of blocks parsed. A statement nested deeper becomes
+/// `Statement::Unknown`, so hostile input cannot overflow the stack.
+pub const MAX_DEPTH: usize = 128;
 
 pub struct Parser<'a> {
     lexer: &'a mut Lexer<'a>,
-    cur_token: Token,
-    peek_token: Token,
+    cur_token: Token<'a>,
+    peek_token: Token<'a>,
+    /// Whether to emit `Statement::Location` markers.
+    locations: bool,
+    /// Nesting of the statement being parsed; top-level statements are 1.
+    depth: usize,
+    /// Buffers from earlier programs to build this one from.
+    pool: StatementPool,
+    /// Version of the language being read, changed by a `lang` pragma.
+    lang: Version,
+    /// Whether a `{` ends the expression being read instead of opening a
+    /// map, as it does in the condition of an `if` or `while`.
+    condition: bool,
+    /// Names of the templates declared so far.
+    templates: HashSet<String>,
+    /// Statements that could not be parsed, in source order.
+    errors: Vec<ParseError>,
+    /// Where each [`Statement::Unknown`] was read, in source order.
+    unknown: Vec<ParseError>,
 }
 
 impl<'a> Parser<'a> {
@@ -15,7 +41,114 @@ impl<'a> Parser<'a> {
             lexer,
             cur_token: first,
             peek_token: second,
+            locations: false,
+            depth: 0,
+            pool: StatementPool::default(),
+            lang: lang::default_version(),
+            condition: false,
+            templates: HashSet::new(),
+            errors: Vec::new(),
+            unknown: Vec::new(),
+        }
+    }
+
+    /// Read the source as `version` of the language until a `lang` pragma
+    /// says otherwise.
+    pub fn with_lang(mut self, version: Version) -> Self {
+        self.lang = version;
+        self
+    }
+
+    /// The version of the language read so far.
+    pub fn lang(&self) -> Version {
+        self.lang
+    }
+
+    /// Build statements from the buffers in `pool`; get it back, with
+    /// whatever was not used, from [`take_pool`](Self::take_pool).
+    pub fn with_pool(mut self, pool: StatementPool) -> Self {
+        self.pool = pool;
+        self
+    }
+
+    pub fn take_pool(&mut self) -> StatementPool {
+        std::mem::take(&mut self.pool)
+    }
+
+    /// Why the statements left out of the last parsed program were left
+    /// out, each at the token where parsing it failed. A program is only
+    /// complete when this is empty.
+    pub fn errors(&self) -> &[ParseError] {
+        &self.errors
+    }
+
+    /// The statements of the last parsed program that were kept as
+    /// [`Statement::Unknown`], each at the token it starts with. They fail
+    /// when run rather than stopping the program from parsing.
+    pub fn unknown_statements(&self) -> &[ParseError] {
+        &self.unknown
+    }
+
+    /// Keep `text`, read from the current token on, as a statement that is
+    /// not understood.
+    fn unknown(&mut self, text: String) -> Option<Statement> {
+        self.unknown.push(
+            ParseError::new(ParseErrorKind::UnknownStatement(text.clone()))
+                .at(self.cur_token.position()),
+        );
+        Some(Statement::Unknown(text))
+    }
+
+    /// Note that `expected` was expected at the current token, and give up
+    /// on the statement.
+    fn unexpected<T>(&mut self, expected: &str) -> Option<T> {
+        let found = match self.cur_token.token_type {
+            TokenType::Eof => "end of input".to_string(),
+            _ => format!("`{}`", self.cur_token.literal),
+        };
+        self.errors.push(
+            ParseError::new(ParseErrorKind::UnexpectedToken {
+                expected: expected.to_string(),
+                found,
+            })
+            .at(self.cur_token.position()),
+        );
+        None
+    }
+
+    /// Parse with `parse` from the current token, noting that `syntax` is
+    /// only part of the language from `version` on if the source is read as
+    /// an older one. The statement is kept either way, so what follows is
+    /// not misread, but a program with the error does not run.
+    fn since<T>(
+        &mut self,
+        version: Version,
+        syntax: &str,
+        parse: impl FnOnce(&mut Self) -> Option<T>,
+    ) -> Option<T> {
+        let position = self.cur_token.position();
+        let index = self.errors.len();
+        let parsed = parse(self);
+        if self.lang < version {
+            let error = ParseError::new(ParseErrorKind::NeedsLang {
+                syntax: syntax.to_string(),
+                version,
+            });
+            self.errors.insert(index, error.at(position));
         }
+        parsed
+    }
+
+    /// The current token's literal, in a pooled string if there is one.
+    fn literal(&mut self) -> String {
+        self.pool.string(&self.cur_token.literal)
+    }
+
+    /// Precede every statement with a [`Statement::Location`] giving its
+    /// line, for debuggers.
+    pub fn with_locations(mut self) -> Self {
+        self.locations = true;
+        self
     }
 
     fn next_token(&mut self) {
@@ -23,128 +156,483 @@ impl<'a> Parser<'a> {
     }
 
     pub fn parse_program(&mut self) -> Program {
+        let _span = tracing::info_span!("parse").entered();
         let mut program = Program {
-            statements: Vec::new(),
+            statements: self.pool.body(),
         };
+        self.errors.clear();
+        self.unknown.clear();
         while self.cur_token.token_type != TokenType::Eof {
-            if let Some(stmt) = self.parse_statement() {
-                program.statements.push(stmt);
-            }
+            self.parse_into(&mut program.statements);
             self.next_token();
         }
         program
     }
 
+    /// Parse the statement at the current token and append it to `body`.
+    fn parse_into(&mut self, body: &mut Vec<Statement>) {
+        let line = self.cur_token.line;
+        let keyword = self.cur_token.literal.to_string();
+        let errors = self.errors.len();
+        self.depth += 1;
+        let depth = self.depth;
+        let stmt = self.parse_statement();
+        self.depth -= 1;
+        if stmt.is_none() && self.errors.len() == errors {
+            self.unexpected::<()>(&format!("the rest of the `{}` statement", keyword));
+        }
+        if let Some(stmt) = stmt {
+            if self.locations {
+                body.push(Statement::Location { line, depth });
+            }
+            body.push(stmt);
+        }
+    }
+
     fn parse_statement(&mut self) -> Option<Statement> {
+        if self.depth > MAX_DEPTH {
+            let text = self.literal();
+            return self.unknown(text);
+        }
         match self.cur_token.token_type {
             TokenType::Agent => self.parse_agent(),
             TokenType::Mem => self.parse_mem(),
-            TokenType::On => self.parse_on_input(),
+            TokenType::On => self.parse_on(),
             TokenType::Reflect => self.parse_reflect(),
             TokenType::Train => self.parse_train(),
             TokenType::Evolve => self.parse_evolve(),
             TokenType::Goal => self.parse_goal(),
             TokenType::Embed => self.parse_embed(),
-            TokenType::If => self.parse_if_context_includes(),
+            TokenType::If => self.parse_if(),
             TokenType::Print => self.parse_print(),
+            TokenType::Ask => self.parse_ask(),
+            TokenType::Fetch => self.parse_fetch(),
+            TokenType::Exec => self.parse_exec(),
+            TokenType::Read => self.parse_read(),
+            TokenType::Write => self.parse_write(),
+            TokenType::Ident
+                if self.cur_token.literal == "capabilities"
+                    && self.peek_token.token_type == TokenType::Colon =>
+            {
+                self.parse_capabilities()
+            }
+            TokenType::Ident
+                if self.cur_token.literal == "pipeline"
+                    && self.peek_token.token_type == TokenType::Ident =>
+            {
+                self.parse_pipeline()
+            }
+            TokenType::Ident
+                if self.cur_token.literal == "lang"
+                    && self.peek_token.token_type == TokenType::String
+                    && self.depth == 1 =>
+            {
+                self.parse_lang()
+            }
+            TokenType::Ident if self.cur_token.literal == "import" && is_word(&self.peek_token) => {
+                self.parse_import()
+            }
+            TokenType::Ident if self.cur_token.literal == "let" && is_word(&self.peek_token) => {
+                self.since(Version::V0_2, "`let`", Self::parse_let)
+            }
+            TokenType::Ident if self.cur_token.literal == "fn" && is_word(&self.peek_token) => {
+                self.since(Version::V0_2, "`fn`", Self::parse_function)
+            }
+            TokenType::Ident
+                if self.cur_token.literal == "return"
+                    && self.peek_token.token_type != TokenType::Equal =>
+            {
+                self.since(Version::V0_2, "`return`", Self::parse_return)
+            }
+            TokenType::Ident
+                if self.cur_token.literal == "while"
+                    && self.peek_token.token_type != TokenType::Equal =>
+            {
+                self.since(Version::V0_2, "`while`", Self::parse_while)
+            }
+            TokenType::Ident if self.cur_token.literal == "for" && is_word(&self.peek_token) => {
+                self.since(Version::V0_2, "`for`", Self::parse_for)
+            }
+            TokenType::Ident
+                if self.cur_token.literal == "recall"
+                    && self.peek_token.token_type != TokenType::Equal =>
+            {
+                self.since(Version::V0_2, "`recall`", Self::parse_recall)
+            }
+            TokenType::Ident if self.cur_token.literal == "send" && is_word(&self.peek_token) => {
+                self.since(Version::V0_2, "`send`", Self::parse_send)
+            }
+            TokenType::Ident
+                if self.cur_token.literal == "emit"
+                    && self.peek_token.token_type != TokenType::Equal =>
+            {
+                self.since(Version::V0_2, "`emit`", Self::parse_emit)
+            }
+            TokenType::Ident
+                if self.cur_token.literal == "every"
+                    && self.peek_token.token_type == TokenType::String =>
+            {
+                self.since(Version::V0_2, "`every`", Self::parse_every)
+            }
+            TokenType::Ident if self.peek_token.token_type == TokenType::LParen => {
+                self.since(Version::V0_2, "a function call", |parser| {
+                    let name = parser.literal();
+                    parser.next_token();
+                    let args = parser.parse_arguments()?;
+                    Some(Statement::Call { name, args })
+                })
+            }
+            TokenType::Ident
+                if self.cur_token.literal == "template"
+                    && self.peek_token.token_type == TokenType::Ident =>
+            {
+                self.parse_template()
+            }
+            TokenType::Ident
+                if self.cur_token.literal == "reward"
+                    && (self.peek_token.token_type == TokenType::String
+                        || self.peek_token.literal == "-") =>
+            {
+                self.parse_reward()
+            }
+            TokenType::Ident
+                if self.cur_token.literal == "propose"
+                    && matches!(
+                        self.peek_token.token_type,
+                        TokenType::Goal | TokenType::Link | TokenType::Ident
+                    ) =>
+            {
+                self.parse_propose()
+            }
             _ => {
                 if self.cur_token.token_type == TokenType::Ident
                     && self.peek_token.token_type == TokenType::Equal
                 {
-                    let key = self.cur_token.literal.clone();
+                    let key = self.literal();
                     self.next_token();
                     self.next_token();
-                    let value = self.cur_token.literal.clone();
+                    if self.lang >= Version::V0_2 {
+                        let value = self.parse_expression(0)?;
+                        return Some(Statement::Assign { name: key, value });
+                    }
+                    let value = self.legacy_value();
                     return Some(Statement::Assignment(key, value));
                 }
 
-                Some(Statement::Unknown(self.cur_token.literal.clone()))
+                let text = self.literal();
+                self.unknown(text)
             }
         }
     }
 
     fn parse_agent(&mut self) -> Option<Statement> {
         self.next_token();
-        let name = self.cur_token.literal.clone();
+        let name = self.literal();
         if self.peek_token.token_type != TokenType::LBrace {
             return None;
         }
         self.next_token();
-        let mut body = Vec::new();
+        let mut body = self.pool.body();
         self.next_token();
         while self.cur_token.token_type != TokenType::RBrace
             && self.cur_token.token_type != TokenType::Eof
         {
-            if let Some(inner) = self.parse_statement() {
-                body.push(inner);
-            }
+            self.parse_into(&mut body);
             self.next_token();
         }
         Some(Statement::AgentDeclaration { name, body })
     }
 
+    /// Parse `capabilities: net, fs.read`. An empty list must end its line.
+    fn parse_capabilities(&mut self) -> Option<Statement> {
+        let line = self.cur_token.line;
+        self.next_token();
+        let mut capabilities = Vec::new();
+        if self.peek_token.line != line || !is_word(&self.peek_token) {
+            return Some(Statement::Capabilities(capabilities));
+        }
+        loop {
+            self.next_token();
+            if !is_word(&self.cur_token) {
+                return self.unexpected("a name");
+            }
+            let mut capability = self.literal();
+            while self.peek_token.token_type == TokenType::Dot {
+                self.next_token();
+                self.next_token();
+                if !is_word(&self.cur_token) {
+                    return self.unexpected("a name");
+                }
+                capability.push('.');
+                capability.push_str(&self.cur_token.literal);
+            }
+            capabilities.push(capability);
+            if self.peek_token.token_type != TokenType::Comma {
+                return Some(Statement::Capabilities(capabilities));
+            }
+            self.next_token();
+        }
+    }
+
+    /// Parse `pipeline A -> B -> ...`, which names at least two agents.
+    fn parse_pipeline(&mut self) -> Option<Statement> {
+        self.next_token();
+        let mut stages = Vec::new();
+        stages.push(self.literal());
+        while self.peek_token.token_type == TokenType::Arrow {
+            self.next_token();
+            self.next_token();
+            if self.cur_token.token_type != TokenType::Ident {
+                return self.unexpected("a name");
+            }
+            stages.push(self.literal());
+        }
+        (stages.len() > 1).then_some(Statement::Pipeline { stages })
+    }
+
+    /// Parse `lang <version>`, the version the statements after it are read
+    /// in.
+    fn parse_lang(&mut self) -> Option<Statement> {
+        self.next_token();
+        match Version::parse(&self.cur_token.literal) {
+            Some(version) => {
+                self.lang = version;
+                Some(Statement::Lang(version))
+            }
+            None => {
+                let text = format!("lang {}", self.cur_token.literal);
+                self.unknown(text)
+            }
+        }
+    }
+
+    /// Parse `import <module>`. The path is written without spaces, so it
+    /// is every token that follows the one before it directly.
+    fn parse_import(&mut self) -> Option<Statement> {
+        self.next_token();
+        let mut module = self.literal();
+        let mut end = self.cur_token.offset + self.cur_token.literal.len();
+        while self.peek_token.offset == end && self.peek_token.token_type != TokenType::Eof {
+            self.next_token();
+            module.push_str(&self.cur_token.literal);
+            end = self.cur_token.offset + self.cur_token.literal.len();
+        }
+        let path = module
+            .chars()
+            .all(|c| c.is_alphanumeric() || "_-./@".contains(c));
+        path.then_some(Statement::Import(module))
+    }
+
     fn parse_mem(&mut self) -> Option<Statement> {
         self.next_token();
-        let target = self.cur_token.literal.clone();
+        let target = self.literal();
         Some(Statement::MemDeclaration { target })
     }
 
+    fn parse_on(&mut self) -> Option<Statement> {
+        if self.peek_token.token_type == TokenType::Ident {
+            match &*self.peek_token.literal {
+                "schedule" => return self.parse_on_schedule(),
+                "tick" => return self.since(Version::V0_2, "`on tick`", Self::parse_every),
+                "output" => return self.since(Version::V0_2, "`on output`", Self::parse_on_output),
+                "start" | "stop" => return self.parse_on_lifecycle(),
+                _ => {}
+            }
+        }
+        self.parse_on_input()
+    }
+
+    /// Parse `on start { ... }` or `on stop { ... }`.
+    fn parse_on_lifecycle(&mut self) -> Option<Statement> {
+        self.next_token();
+        let start = self.cur_token.literal == "start";
+        self.next_token();
+        if self.cur_token.token_type != TokenType::LBrace {
+            return self.unexpected("`{`");
+        }
+        let mut body = self.pool.body();
+        self.next_token();
+        while self.cur_token.token_type != TokenType::RBrace
+            && self.cur_token.token_type != TokenType::Eof
+        {
+            self.parse_into(&mut body);
+            self.next_token();
+        }
+        Some(if start {
+            Statement::OnStart { body }
+        } else {
+            Statement::OnStop { body }
+        })
+    }
+
+    /// Parse `on schedule("<cron>") { ... }`.
+    fn parse_on_schedule(&mut self) -> Option<Statement> {
+        self.next_token();
+        self.next_token();
+        if self.cur_token.token_type != TokenType::LParen {
+            return self.unexpected("`(`");
+        }
+        self.next_token();
+        if self.cur_token.token_type != TokenType::String {
+            return self.unexpected("a string");
+        }
+        let spec = self.literal();
+        self.next_token();
+        if self.cur_token.token_type != TokenType::RParen {
+            return self.unexpected("`)`");
+        }
+        self.next_token();
+        if self.cur_token.token_type != TokenType::LBrace {
+            return self.unexpected("`{`");
+        }
+        let mut body = self.pool.body();
+        self.next_token();
+        while self.cur_token.token_type != TokenType::RBrace
+            && self.cur_token.token_type != TokenType::Eof
+        {
+            self.parse_into(&mut body);
+            self.next_token();
+        }
+        Some(Statement::OnSchedule { spec, body })
+    }
+
+    /// Parse `every 5s { ... }` or `on tick(5s) { ... }` into the
+    /// `on schedule("every 5s")` handler they mean.
+    fn parse_every(&mut self) -> Option<Statement> {
+        let tick = self.cur_token.token_type == TokenType::On;
+        if tick {
+            self.next_token();
+            self.next_token();
+            if self.cur_token.token_type != TokenType::LParen {
+                return self.unexpected("`(`");
+            }
+        }
+        self.next_token();
+        let count = self.cur_token.literal.to_string();
+        self.next_token();
+        let interval = format!("{}{}", count, self.cur_token.literal);
+        if schedule::parse_interval(&interval).is_err() {
+            return self.unexpected("an interval such as `5s`, `10m` or `1h`");
+        }
+        if tick {
+            self.next_token();
+            if self.cur_token.token_type != TokenType::RParen {
+                return self.unexpected("`)`");
+            }
+        }
+        self.next_token();
+        if self.cur_token.token_type != TokenType::LBrace {
+            return self.unexpected("`{`");
+        }
+        let spec = self.pool.string(&format!("every {}", interval));
+        let mut body = self.pool.body();
+        self.next_token();
+        while self.cur_token.token_type != TokenType::RBrace
+            && self.cur_token.token_type != TokenType::Eof
+        {
+            self.parse_into(&mut body);
+            self.next_token();
+        }
+        Some(Statement::OnSchedule { spec, body })
+    }
+
+    /// Parse `on output(<param>) { ... }`.
+    fn parse_on_output(&mut self) -> Option<Statement> {
+        self.next_token();
+        self.next_token();
+        if self.cur_token.token_type != TokenType::LParen {
+            return self.unexpected("`(`");
+        }
+        self.next_token();
+        if !is_word(&self.cur_token) {
+            return self.unexpected("a parameter name");
+        }
+        let param = self.literal();
+        self.next_token();
+        if self.cur_token.token_type != TokenType::RParen {
+            return self.unexpected("`)`");
+        }
+        self.next_token();
+        if self.cur_token.token_type != TokenType::LBrace {
+            return self.unexpected("`{`");
+        }
+        let mut body = self.pool.body();
+        self.next_token();
+        while self.cur_token.token_type != TokenType::RBrace
+            && self.cur_token.token_type != TokenType::Eof
+        {
+            self.parse_into(&mut body);
+            self.next_token();
+        }
+        Some(Statement::OnOutput { param, body })
+    }
+
     fn parse_on_input(&mut self) -> Option<Statement> {
         self.next_token();
         if self.cur_token.token_type != TokenType::Input {
-            return None;
+            return self.unexpected("`input`");
         }
         self.next_token();
         if self.cur_token.token_type != TokenType::LParen {
-            return None;
+            return self.unexpected("`(`");
         }
         self.next_token();
-        let param = self.cur_token.literal.clone();
+        let param = self.literal();
         self.next_token();
         if self.cur_token.token_type != TokenType::RParen {
-            return None;
+            return self.unexpected("`)`");
         }
         self.next_token();
         if self.cur_token.token_type != TokenType::LBrace {
-            return None;
+            return self.unexpected("`{`");
         }
-        let mut body = Vec::new();
+        let mut body = self.pool.body();
         self.next_token();
         while self.cur_token.token_type != TokenType::RBrace
             && self.cur_token.token_type != TokenType::Eof
         {
-            if let Some(s) = self.parse_statement() {
-                body.push(s);
-            }
+            self.parse_into(&mut body);
             self.next_token();
         }
         Some(Statement::OnInput { param, body })
     }
 
-    /// Parse either a full `reflect { ... }` block or a single-line `reflect mem.<target>["<key>"]`.
+    /// Parse either a full `reflect { ... }` block of `mem.<target>["<key>"]`
+    /// and `attention top <n>` lines, or a single-line
+    /// `reflect mem.<target>["<key>"]`.
     fn parse_reflect(&mut self) -> Option<Statement> {
         if self.peek_token.token_type == TokenType::LBrace {
             self.next_token(); // cur_token == LBrace
-            self.next_token(); // cur_token == Mem
-
-            if self.cur_token.token_type != TokenType::Mem {
-                return None;
-            }
+            self.next_token();
 
-            let (mem_target, key) = self.expect_dot_and_bracket()?;
+            let mut body = Vec::new();
             while self.cur_token.token_type != TokenType::RBrace
                 && self.cur_token.token_type != TokenType::Eof
             {
+                match self.cur_token.token_type {
+                    TokenType::Mem => {
+                        let (mem_target, key) = self.expect_dot_and_bracket()?;
+                        body.push(Statement::ReflectAccess { mem_target, key });
+                        if self.cur_token.token_type == TokenType::RBrace {
+                            break;
+                        }
+                    }
+                    TokenType::Ident if self.cur_token.literal == "attention" => {
+                        body.push(self.parse_attention()?)
+                    }
+                    _ => return None,
+                }
                 self.next_token();
             }
-            return Some(Statement::Reflect {
-                body: vec![Statement::ReflectAccess { mem_target, key }],
-            });
+            if body.is_empty() {
+                return None;
+            }
+            return Some(Statement::Reflect { body });
         }
 
         self.next_token();
         if self.cur_token.token_type != TokenType::Mem {
-            return None;
+            return self.unexpected("`mem`");
         }
         if let Some((mem_target, key)) = self.expect_dot_and_bracket() {
             return Some(Statement::ReflectAccess { mem_target, key });
@@ -152,28 +640,42 @@ impl<'a> Parser<'a> {
         None
     }
 
+    /// `attention top <n>`, leaving the count as the current token.
+    fn parse_attention(&mut self) -> Option<Statement> {
+        self.next_token();
+        if self.cur_token.token_type != TokenType::Ident || self.cur_token.literal != "top" {
+            return None;
+        }
+        self.next_token();
+        if self.cur_token.token_type != TokenType::String {
+            return self.unexpected("a string");
+        }
+        let top = self.cur_token.literal.parse().ok()?;
+        Some(Statement::Attention { top })
+    }
+
     fn expect_dot_and_bracket(&mut self) -> Option<(String, String)> {
         self.next_token();
         if self.cur_token.token_type != TokenType::Dot {
-            return None;
+            return self.unexpected("`.`");
         }
 
         self.next_token();
         if self.cur_token.token_type != TokenType::Ident {
-            return None;
+            return self.unexpected("a name");
         }
-        let mem_target = self.cur_token.literal.clone();
+        let mem_target = self.literal();
 
         self.next_token();
         if self.cur_token.token_type != TokenType::LBracket {
-            return None;
+            return self.unexpected("`[`");
         }
 
         self.next_token();
         if self.cur_token.token_type != TokenType::String {
-            return None;
+            return self.unexpected("a string");
         }
-        let key = self.cur_token.literal.clone();
+        let key = self.literal();
 
         self.next_token();
         if self.cur_token.token_type != TokenType::RBracket
@@ -185,37 +687,90 @@ impl<'a> Parser<'a> {
         Some((mem_target, key))
     }
 
+    /// `propose goal "<text>"`, `propose threshold <drive> <value>` or
+    /// `propose link "<from>" -> "<to>"`.
+    fn parse_propose(&mut self) -> Option<Statement> {
+        self.next_token();
+        let mutation = match self.cur_token.token_type {
+            TokenType::Goal => {
+                self.next_token();
+                if self.cur_token.token_type != TokenType::String {
+                    return self.unexpected("a string");
+                }
+                Mutation::Goal(self.literal())
+            }
+            TokenType::Ident if self.cur_token.literal == "threshold" => {
+                self.next_token();
+                if self.cur_token.token_type != TokenType::Ident {
+                    return self.unexpected("a name");
+                }
+                let drive = self.literal();
+                self.next_token();
+                Mutation::Threshold {
+                    drive,
+                    value: self.signed_number()?,
+                }
+            }
+            TokenType::Link => {
+                self.next_token();
+                if self.cur_token.token_type != TokenType::String {
+                    return self.unexpected("a string");
+                }
+                let from = self.literal();
+                self.next_token();
+                if self.cur_token.token_type != TokenType::Arrow {
+                    return self.unexpected("`->`");
+                }
+                self.next_token();
+                if self.cur_token.token_type != TokenType::String {
+                    return self.unexpected("a string");
+                }
+                Mutation::Link {
+                    from,
+                    to: self.literal(),
+                }
+            }
+            _ => return None,
+        };
+        Some(Statement::Propose(mutation))
+    }
+
     fn parse_train(&mut self) -> Option<Statement> {
         self.next_token();
+        let mut dataset = None;
+        if self.cur_token.token_type == TokenType::Ident && self.cur_token.literal == "from" {
+            self.next_token();
+            if self.cur_token.token_type != TokenType::String {
+                return self.unexpected("a string");
+            }
+            dataset = Some(self.literal());
+            self.next_token();
+        }
         if self.cur_token.token_type != TokenType::LBrace {
-            return None;
+            return self.unexpected("`{`");
         }
-        let mut body = Vec::new();
+        let mut body = self.pool.body();
         self.next_token();
         while self.cur_token.token_type != TokenType::RBrace
             && self.cur_token.token_type != TokenType::Eof
         {
-            if let Some(s) = self.parse_statement() {
-                body.push(s);
-            }
+            self.parse_into(&mut body);
             self.next_token();
         }
-        Some(Statement::Train { body })
+        Some(Statement::Train { dataset, body })
     }
 
     fn parse_evolve(&mut self) -> Option<Statement> {
         self.next_token();
         if self.cur_token.token_type != TokenType::LBrace {
-            return None;
+            return self.unexpected("`{`");
         }
-        let mut body = Vec::new();
+        let mut body = self.pool.body();
         self.next_token();
         while self.cur_token.token_type != TokenType::RBrace
             && self.cur_token.token_type != TokenType::Eof
         {
-            if let Some(s) = self.parse_statement() {
-                body.push(s);
-            }
+            self.parse_into(&mut body);
             self.next_token();
         }
         Some(Statement::Evolve { body })
@@ -224,52 +779,514 @@ impl<'a> Parser<'a> {
     fn parse_goal(&mut self) -> Option<Statement> {
         self.next_token();
         if self.cur_token.token_type != TokenType::Colon {
-            return None;
+            return self.unexpected("`:`");
         }
         self.next_token();
         if self.cur_token.token_type != TokenType::String {
-            return None;
+            return self.unexpected("a string");
         }
-        let value = self.cur_token.literal.clone();
+        let value = self.literal();
         Some(Statement::Goal(value))
     }
 
     fn parse_embed(&mut self) -> Option<Statement> {
         self.next_token();
-        let source = self.cur_token.literal.clone();
+        let source = self.literal();
         self.next_token();
         if self.cur_token.token_type != TokenType::Arrow {
-            return None;
+            return self.unexpected("`->`");
         }
         self.next_token();
-        let mut parts = vec![self.cur_token.literal.clone()];
+        let mut target = self.literal();
         self.next_token();
         if self.cur_token.token_type == TokenType::Dot {
             self.next_token();
-            parts.push(self.cur_token.literal.clone());
+            target.push('.');
+            target.push_str(&self.cur_token.literal);
         }
-        let target = parts.join(".");
         Some(Statement::Embed { source, target })
     }
 
-    fn parse_if_context_includes(&mut self) -> Option<Statement> {
+    fn parse_if(&mut self) -> Option<Statement> {
+        let branch = self.parse_if_branch()?;
+        if self.peek_token.token_type != TokenType::Else {
+            return Some(branch);
+        }
         self.next_token();
-        if self.cur_token.token_type != TokenType::Ident || self.cur_token.literal != "context" {
-            return None;
+        self.next_token();
+        let mut otherwise = self.pool.body();
+        match self.cur_token.token_type {
+            TokenType::If => {
+                self.parse_into(&mut otherwise);
+                if otherwise.is_empty() {
+                    return None;
+                }
+            }
+            TokenType::LBrace => {
+                self.next_token();
+                while self.cur_token.token_type != TokenType::RBrace
+                    && self.cur_token.token_type != TokenType::Eof
+                {
+                    self.parse_into(&mut otherwise);
+                    self.next_token();
+                }
+            }
+            _ => return self.unexpected("`{` or `if` after `else`"),
+        }
+        Some(Statement::IfElse {
+            branch: Box::new(branch),
+            otherwise,
+        })
+    }
+
+    /// Parse an `if` up to the end of its body.
+    fn parse_if_branch(&mut self) -> Option<Statement> {
+        if self.peek_token.token_type == TokenType::Ident && self.peek_token.literal == "context" {
+            return self.parse_if_context_includes();
         }
         self.next_token();
-        if self.cur_token.token_type != TokenType::Ident || self.cur_token.literal != "includes" {
-            return None;
+        let condition = self.parse_condition()?;
+        self.next_token();
+        if self.cur_token.token_type != TokenType::LBrace {
+            return self.unexpected("`{`");
         }
+        let mut body = self.pool.body();
         self.next_token();
-        if self.cur_token.token_type != TokenType::LBracket {
-            return None;
+        while self.cur_token.token_type != TokenType::RBrace
+            && self.cur_token.token_type != TokenType::Eof
+        {
+            self.parse_into(&mut body);
+            self.next_token();
+        }
+        Some(narrow_if(condition, body))
+    }
+
+    /// Parse the expression starting at the current token, stopping before
+    /// a binary operator that binds no tighter than `min` (see
+    /// [`BinaryOp::precedence`]), and leave its last token current.
+    fn parse_expression(&mut self, min: u8) -> Option<Expr> {
+        self.depth += 1;
+        let expr = if self.depth > MAX_DEPTH {
+            None
+        } else {
+            self.parse_operand()
+                .and_then(|left| self.parse_operators(left, min))
+        };
+        self.depth -= 1;
+        expr
+    }
+
+    /// Parse the condition of an `if` or `while`, where a map literal needs
+    /// parentheses so the `{` of the body is not read as one.
+    fn parse_condition(&mut self) -> Option<Expr> {
+        self.condition = true;
+        let expr = self.parse_expression(0);
+        self.condition = false;
+        expr
+    }
+
+    /// Parse an expression between brackets, where a `{` opens a map again.
+    fn parse_nested(&mut self) -> Option<Expr> {
+        let condition = std::mem::replace(&mut self.condition, false);
+        let expr = self.parse_expression(0);
+        self.condition = condition;
+        expr
+    }
+
+    /// Parse a literal, name, parenthesized expression or prefix operator.
+    fn parse_operand(&mut self) -> Option<Expr> {
+        let token = &self.cur_token;
+        match token.token_type {
+            TokenType::String => {
+                let quoted = self.lexer.source()[token.offset..].starts_with('"');
+                let literal = self.literal();
+                Some(if quoted {
+                    Expr::Text(literal)
+                } else {
+                    Expr::Number(literal)
+                })
+            }
+            TokenType::LParen => {
+                self.next_token();
+                let expr = self.parse_nested()?;
+                self.next_token();
+                if self.cur_token.token_type != TokenType::RParen {
+                    return self.unexpected("`)`");
+                }
+                Some(expr)
+            }
+            TokenType::LBracket => self.since(Version::V0_2, "a list", Self::parse_list),
+            TokenType::LBrace if !self.condition => {
+                self.since(Version::V0_2, "a map", Self::parse_map)
+            }
+            TokenType::Operator if token.literal == "!" || token.literal == "-" => {
+                let op = if token.literal == "!" {
+                    UnaryOp::Not
+                } else {
+                    UnaryOp::Neg
+                };
+                self.next_token();
+                let operand = self.parse_expression(UNARY_PRECEDENCE)?;
+                Some(Expr::Unary(op, Box::new(operand)))
+            }
+            _ if token.literal == "true" || token.literal == "false" => {
+                Some(Expr::Bool(token.literal == "true"))
+            }
+            _ if is_word(token) => {
+                let name = self.literal();
+                if self.peek_token.token_type != TokenType::LParen {
+                    return Some(Expr::Ident(name));
+                }
+                self.next_token();
+                Some(Expr::Call(name, self.parse_arguments()?))
+            }
+            _ => self.unexpected("an expression"),
+        }
+    }
+
+    /// Parse `[<expr>, ...]`, from the `[` that is the current token to the
+    /// `]` it leaves current.
+    fn parse_list(&mut self) -> Option<Expr> {
+        let mut items = Vec::new();
+        if self.peek_token.token_type == TokenType::RBracket {
+            self.next_token();
+            return Some(Expr::List(items));
+        }
+        loop {
+            self.next_token();
+            items.push(self.parse_nested()?);
+            self.next_token();
+            match self.cur_token.token_type {
+                TokenType::Comma => {}
+                TokenType::RBracket => return Some(Expr::List(items)),
+                _ => return self.unexpected("`,` or `]`"),
+            }
+        }
+    }
+
+    /// Parse `{<expr>: <expr>, ...}`, from the `{` that is the current
+    /// token to the `}` it leaves current.
+    fn parse_map(&mut self) -> Option<Expr> {
+        let mut entries = Vec::new();
+        if self.peek_token.token_type == TokenType::RBrace {
+            self.next_token();
+            return Some(Expr::Map(entries));
+        }
+        loop {
+            self.next_token();
+            let key = self.parse_expression(0)?;
+            self.next_token();
+            if self.cur_token.token_type != TokenType::Colon {
+                return self.unexpected("`:`");
+            }
+            self.next_token();
+            entries.push((key, self.parse_expression(0)?));
+            self.next_token();
+            match self.cur_token.token_type {
+                TokenType::Comma => {}
+                TokenType::RBrace => return Some(Expr::Map(entries)),
+                _ => return self.unexpected("`,` or `}`"),
+            }
+        }
+    }
+
+    /// Apply the field accesses, indexes and binary operators after `left`.
+    fn parse_operators(&mut self, mut left: Expr, min: u8) -> Option<Expr> {
+        loop {
+            left = match self.peek_token.token_type {
+                TokenType::Dot => Expr::Field(Box::new(left), self.field()?),
+                TokenType::LBracket => {
+                    self.next_token();
+                    self.next_token();
+                    let index = self.parse_nested()?;
+                    self.next_token();
+                    if self.cur_token.token_type != TokenType::RBracket {
+                        return self.unexpected("`]`");
+                    }
+                    Expr::Index(Box::new(left), Box::new(index))
+                }
+                TokenType::Compare | TokenType::Operator => {
+                    let Some(op) = BinaryOp::parse(&self.peek_token.literal) else {
+                        return Some(left);
+                    };
+                    if op.precedence() <= min {
+                        return Some(left);
+                    }
+                    self.next_token();
+                    self.next_token();
+                    let right = self.parse_expression(op.precedence())?;
+                    Expr::Binary(op, Box::new(left), Box::new(right))
+                }
+                _ => return Some(left),
+            };
+        }
+    }
+
+    /// Move past `.<name>` and return the name, which may be a keyword such
+    /// as the `input` of `reward.input.mean`.
+    fn field(&mut self) -> Option<String> {
+        self.next_token();
+        if self.cur_token.token_type != TokenType::Dot {
+            return self.unexpected("`.`");
+        }
+        self.next_token();
+        let word = self.cur_token.token_type != TokenType::String
+            && self
+                .cur_token
+                .literal
+                .starts_with(|c: char| c.is_alphabetic() || c == '_');
+        if !word {
+            return None;
+        }
+        Some(self.literal())
+    }
+
+    /// Parse `let <name> = <expr>`.
+    fn parse_let(&mut self) -> Option<Statement> {
+        self.next_token();
+        let name = self.literal();
+        self.next_token();
+        if self.cur_token.token_type != TokenType::Equal {
+            return self.unexpected("`=`");
+        }
+        self.next_token();
+        let value = self.parse_expression(0)?;
+        Some(Statement::Let { name, value })
+    }
+
+    /// Parse `fn <name>(<param>, ...) { ... }`.
+    fn parse_function(&mut self) -> Option<Statement> {
+        self.next_token();
+        let name = self.literal();
+        self.next_token();
+        if self.cur_token.token_type != TokenType::LParen {
+            return self.unexpected("`(`");
+        }
+        let mut params = Vec::new();
+        self.next_token();
+        while self.cur_token.token_type != TokenType::RParen {
+            if !is_word(&self.cur_token) {
+                return self.unexpected("a name");
+            }
+            params.push(self.literal());
+            self.next_token();
+            match self.cur_token.token_type {
+                TokenType::Comma => self.next_token(),
+                TokenType::RParen => {}
+                _ => return self.unexpected("`,` or `)`"),
+            }
+        }
+        self.next_token();
+        let body = self.parse_block()?;
+        Some(Statement::Function { name, params, body })
+    }
+
+    /// Parse `while <expr> { ... }`.
+    fn parse_while(&mut self) -> Option<Statement> {
+        self.next_token();
+        let condition = self.parse_condition()?;
+        self.next_token();
+        let body = self.parse_block()?;
+        Some(Statement::While { condition, body })
+    }
+
+    /// Parse `emit <expr>`.
+    fn parse_emit(&mut self) -> Option<Statement> {
+        self.next_token();
+        Some(Statement::Emit(self.parse_expression(0)?))
+    }
+
+    /// Parse `send <Agent> <expr>`.
+    fn parse_send(&mut self) -> Option<Statement> {
+        self.next_token();
+        let agent = self.literal();
+        self.next_token();
+        let message = self.parse_expression(0)?;
+        Some(Statement::Send { agent, message })
+    }
+
+    /// Parse `recall <expr> top <n>`, leaving the count as the current token.
+    fn parse_recall(&mut self) -> Option<Statement> {
+        self.next_token();
+        let query = self.parse_expression(0)?;
+        self.next_token();
+        if self.cur_token.token_type != TokenType::Ident || self.cur_token.literal != "top" {
+            return self.unexpected("`top` and a number of entries");
+        }
+        self.next_token();
+        let Some(top) = self.cur_token.literal.parse().ok() else {
+            return self.unexpected("a number of entries");
+        };
+        Some(Statement::Recall { query, top })
+    }
+
+    /// Parse `for <key>, <value> in mem.<region> { ... }`.
+    fn parse_for(&mut self) -> Option<Statement> {
+        self.next_token();
+        let key = self.literal();
+        self.next_token();
+        if self.cur_token.token_type != TokenType::Comma {
+            return self.unexpected("`,` and a name for the value");
+        }
+        self.next_token();
+        if !is_word(&self.cur_token) {
+            return self.unexpected("a name");
+        }
+        let value = self.literal();
+        self.next_token();
+        if self.cur_token.literal != "in" {
+            return self.unexpected("`in`");
+        }
+        self.next_token();
+        if self.cur_token.token_type != TokenType::Mem {
+            return self.unexpected("`mem`");
+        }
+        self.next_token();
+        if self.cur_token.token_type != TokenType::Dot {
+            return self.unexpected("`.`");
+        }
+        self.next_token();
+        if !is_word(&self.cur_token) {
+            return self.unexpected("a memory region");
+        }
+        let region = self.literal();
+        self.next_token();
+        let body = self.parse_block()?;
+        Some(Statement::For {
+            key,
+            value,
+            region,
+            body,
+        })
+    }
+
+    /// Parse the statements of a `{ ... }` block, from the `{` that is the
+    /// current token to the `}` it leaves current.
+    fn parse_block(&mut self) -> Option<Vec<Statement>> {
+        if self.cur_token.token_type != TokenType::LBrace {
+            return self.unexpected("`{`");
+        }
+        let mut body = self.pool.body();
+        self.next_token();
+        while self.cur_token.token_type != TokenType::RBrace
+            && self.cur_token.token_type != TokenType::Eof
+        {
+            self.parse_into(&mut body);
+            self.next_token();
+        }
+        Some(body)
+    }
+
+    /// Parse `return`, with the value after it on the same line if any.
+    fn parse_return(&mut self) -> Option<Statement> {
+        if self.peek_token.line != self.cur_token.line
+            || matches!(
+                self.peek_token.token_type,
+                TokenType::RBrace | TokenType::Eof
+            )
+        {
+            return Some(Statement::Return(None));
+        }
+        self.next_token();
+        Some(Statement::Return(Some(self.parse_expression(0)?)))
+    }
+
+    /// Parse the arguments of a call, from the `(` that is the current
+    /// token to the `)` it leaves current.
+    fn parse_arguments(&mut self) -> Option<Vec<Expr>> {
+        let mut args = Vec::new();
+        if self.peek_token.token_type == TokenType::RParen {
+            self.next_token();
+            return Some(args);
+        }
+        loop {
+            self.next_token();
+            args.push(self.parse_nested()?);
+            self.next_token();
+            match self.cur_token.token_type {
+                TokenType::Comma => {}
+                TokenType::RParen => return Some(args),
+                _ => return self.unexpected("`,` or `)`"),
+            }
+        }
+    }
+
+    /// Parse `reward <number>`.
+    fn parse_reward(&mut self) -> Option<Statement> {
+        self.next_token();
+        Some(Statement::Reward(self.signed_number()?))
+    }
+
+    /// The value of a `lang 0.1` assignment: the current token as written,
+    /// or a number with the `-` right before it, such as `-1`.
+    fn legacy_value(&mut self) -> String {
+        let negative = self.cur_token.token_type == TokenType::Operator
+            && self.cur_token.literal == "-"
+            && self.peek_token.offset == self.cur_token.offset + 1
+            && self.peek_token.literal.parse::<f64>().is_ok();
+        if negative {
+            self.signed_number().unwrap_or_default()
+        } else {
+            self.literal()
+        }
+    }
+
+    /// Read a number that may follow a `-`, leaving its digits current.
+    fn signed_number(&mut self) -> Option<String> {
+        let sign =
+            if self.cur_token.token_type == TokenType::Operator && self.cur_token.literal == "-" {
+                self.next_token();
+                "-"
+            } else {
+                ""
+            };
+        if self.cur_token.token_type != TokenType::String
+            || self.cur_token.literal.parse::<f64>().is_err()
+        {
+            return None;
+        }
+        Some(format!("{}{}", sign, self.literal()))
+    }
+
+    /// Parse `template <name> = "<text>"`.
+    fn parse_template(&mut self) -> Option<Statement> {
+        self.next_token();
+        let name = self.literal();
+        self.next_token();
+        if self.cur_token.token_type != TokenType::Equal {
+            return self.unexpected("`=`");
+        }
+        self.next_token();
+        if self.cur_token.token_type != TokenType::String {
+            return self.unexpected("a string");
+        }
+        self.templates.insert(name.clone());
+        Some(Statement::Template {
+            name,
+            text: self.literal(),
+        })
+    }
+
+    fn parse_if_context_includes(&mut self) -> Option<Statement> {
+        self.next_token();
+        if self.cur_token.token_type != TokenType::Ident || self.cur_token.literal != "context" {
+            return None;
+        }
+        self.next_token();
+        if self.cur_token.token_type != TokenType::Ident || self.cur_token.literal != "includes" {
+            return None;
+        }
+        self.next_token();
+        if self.cur_token.token_type != TokenType::LBracket {
+            return self.unexpected("`[`");
         }
         let mut values = Vec::new();
         loop {
             self.next_token();
             if self.cur_token.token_type == TokenType::String {
-                values.push(self.cur_token.literal.clone());
+                values.push(self.literal());
+            } else if self.cur_token.token_type == TokenType::Comma {
+                continue;
             } else if self.cur_token.token_type == TokenType::RBracket {
                 break;
             } else {
@@ -278,28 +1295,608 @@ impl<'a> Parser<'a> {
         }
         self.next_token();
         if self.cur_token.token_type != TokenType::LBrace {
-            return None;
+            return self.unexpected("`{`");
         }
-        let mut body = Vec::new();
+        let mut body = self.pool.body();
         self.next_token();
         while self.cur_token.token_type != TokenType::RBrace
             && self.cur_token.token_type != TokenType::Eof
         {
-            if let Some(s) = self.parse_statement() {
-                body.push(s);
-            }
+            self.parse_into(&mut body);
             self.next_token();
         }
         Some(Statement::IfContextIncludes { values, body })
     }
 
-    fn parse_print(&mut self) -> Option<Statement> {
+    /// Parse `ask "<prompt>" [(key: value, ...)] -> mem.<target>["<key>"]`,
+    /// where the prompt may also be a template call.
+    fn parse_ask(&mut self) -> Option<Statement> {
+        self.next_token();
+        let prompt = self.parse_text()?;
+        let (options, target, key) = self.parse_request_tail()?;
+        Some(Statement::Ask {
+            prompt,
+            options,
+            target,
+            key,
+        })
+    }
+
+    /// Parse `fetch "<url>" [(key: value, ...)] -> mem.<target>["<key>"]`.
+    fn parse_fetch(&mut self) -> Option<Statement> {
+        let (url, options, target, key) = self.parse_request()?;
+        Some(Statement::Fetch {
+            url,
+            options,
+            target,
+            key,
+        })
+    }
+
+    /// Parse `exec "<command>" [(key: value, ...)] -> mem.<target>["<key>"]`.
+    fn parse_exec(&mut self) -> Option<Statement> {
+        let (command, options, target, key) = self.parse_request()?;
+        Some(Statement::Exec {
+            command,
+            options,
+            target,
+            key,
+        })
+    }
+
+    /// Parse `read "<path>" -> mem.<target>["<key>"]`.
+    fn parse_read(&mut self) -> Option<Statement> {
         self.next_token();
         if self.cur_token.token_type != TokenType::String {
-            return None;
+            return self.unexpected("a string");
+        }
+        let path = self.literal();
+        self.next_token();
+        if self.cur_token.token_type != TokenType::Arrow {
+            return self.unexpected("`->`");
+        }
+        self.next_token();
+        if self.cur_token.token_type != TokenType::Mem {
+            return self.unexpected("`mem`");
+        }
+        let (target, key) = self.expect_dot_and_bracket()?;
+        Some(Statement::ReadFile { path, target, key })
+    }
+
+    /// Parse `write mem.<target>["<key>"] -> "<path>"`.
+    fn parse_write(&mut self) -> Option<Statement> {
+        self.next_token();
+        if self.cur_token.token_type != TokenType::Mem {
+            return self.unexpected("`mem`");
+        }
+        let (target, key) = self.expect_dot_and_bracket()?;
+        self.next_token();
+        if self.cur_token.token_type != TokenType::Arrow {
+            return self.unexpected("`->`");
+        }
+        self.next_token();
+        if self.cur_token.token_type != TokenType::String {
+            return self.unexpected("a string");
+        }
+        let path = self.literal();
+        Some(Statement::WriteFile { target, key, path })
+    }
+
+    /// Shared tail of `ask`, `fetch` and `exec`: a string, optional options and a
+    /// memory destination.
+    #[allow(clippy::type_complexity)]
+    fn parse_request(&mut self) -> Option<(String, Vec<(String, String)>, String, String)> {
+        self.next_token();
+        if self.cur_token.token_type != TokenType::String {
+            return self.unexpected("a string");
+        }
+        let text = self.literal();
+        let (options, target, key) = self.parse_request_tail()?;
+        Some((text, options, target, key))
+    }
+
+    /// Optional options and the memory destination after the text of a
+    /// request.
+    #[allow(clippy::type_complexity)]
+    fn parse_request_tail(&mut self) -> Option<(Vec<(String, String)>, String, String)> {
+        let mut options = Vec::new();
+        if self.peek_token.token_type == TokenType::LParen {
+            self.next_token();
+            loop {
+                self.next_token();
+                match self.cur_token.token_type {
+                    TokenType::RParen => break,
+                    TokenType::Comma => continue,
+                    TokenType::Ident => {
+                        let name = self.literal();
+                        self.next_token();
+                        if self.cur_token.token_type != TokenType::Colon {
+                            return self.unexpected("`:`");
+                        }
+                        self.next_token();
+                        if !matches!(
+                            self.cur_token.token_type,
+                            TokenType::String | TokenType::Ident
+                        ) {
+                            return None;
+                        }
+                        options.push((name, self.literal()));
+                    }
+                    _ => return None,
+                }
+            }
+        }
+
+        self.next_token();
+        if self.cur_token.token_type != TokenType::Arrow {
+            return self.unexpected("`->`");
+        }
+        self.next_token();
+        if self.cur_token.token_type != TokenType::Mem {
+            return self.unexpected("`mem`");
+        }
+        let (target, key) = self.expect_dot_and_bracket()?;
+        Some((options, target, key))
+    }
+
+    fn parse_print(&mut self) -> Option<Statement> {
+        self.next_token();
+        Some(Statement::Print(self.parse_text()?))
+    }
+
+    /// Parse a template call such as `greet(name: msg)` or an expression,
+    /// which is a [`Text::Literal`] if it is just a string or number.
+    fn parse_text(&mut self) -> Option<Text> {
+        if !self.at_template_call() {
+            return Some(match self.parse_expression(0)? {
+                Expr::Text(text) | Expr::Number(text) => Text::Literal(text),
+                value => Text::Expr(value),
+            });
+        }
+        let name = self.literal();
+        self.next_token();
+        let mut args = Vec::new();
+        loop {
+            self.next_token();
+            match self.cur_token.token_type {
+                TokenType::RParen => break,
+                TokenType::Comma => continue,
+                _ if is_word(&self.cur_token) => {
+                    let param = self.literal();
+                    self.next_token();
+                    if self.cur_token.token_type != TokenType::Colon {
+                        return self.unexpected("`:`");
+                    }
+                    self.next_token();
+                    let value = self.parse_argument()?;
+                    args.push((param, value));
+                }
+                _ => return None,
+            }
+        }
+        Some(Text::Template { name, args })
+    }
+
+    /// Whether the current token starts a template call: a name followed by
+    /// `(` that is a declared template or whose first argument is `param:`,
+    /// rather than a function call such as `len(xs)`.
+    fn at_template_call(&self) -> bool {
+        if self.cur_token.token_type != TokenType::Ident
+            || self.peek_token.token_type != TokenType::LParen
+        {
+            return false;
+        }
+        if self.templates.contains(self.cur_token.literal.as_ref()) {
+            return true;
+        }
+        let paren = &self.peek_token;
+        let mut lexer = Lexer::resume(
+            self.lexer.source(),
+            paren.offset + 1,
+            paren.line,
+            paren.column + 1,
+        );
+        let param = lexer.next_token();
+        is_word(&param) && lexer.next_token().token_type == TokenType::Colon
+    }
+
+    /// Parse a template argument: a string, or a reference such as `msg`,
+    /// `state.curiosity` or `mem.short["key"]`, kept as its placeholder.
+    fn parse_argument(&mut self) -> Option<String> {
+        match self.cur_token.token_type {
+            TokenType::String => Some(self.literal()),
+            TokenType::Mem => {
+                let (target, key) = self.expect_dot_and_bracket()?;
+                Some(format!("{{mem.{}[\"{}\"]}}", target, key))
+            }
+            _ if is_word(&self.cur_token) => {
+                let name = self.literal();
+                if self.peek_token.token_type != TokenType::Dot {
+                    return Some(format!("{{{}}}", name));
+                }
+                let field = self.field()?;
+                Some(format!("{{{}.{}}}", name, field))
+            }
+            _ => None,
+        }
+    }
+}
+
+/// The statement for `if <condition> { <body> }`: `if state.<drive>` and
+/// `if reward.<behavior>.<stat>` compared with a number keep the statements
+/// they had before conditions could be any expression.
+fn narrow_if(condition: Expr, body: Vec<Statement>) -> Statement {
+    let Expr::Binary(op, left, right) = &condition else {
+        return Statement::If { condition, body };
+    };
+    let value = match right.as_ref() {
+        Expr::Number(value) | Expr::Text(value) if value.parse::<f64>().is_ok() => value.clone(),
+        Expr::Unary(UnaryOp::Neg, operand) => match operand.as_ref() {
+            Expr::Number(value) => format!("-{}", value),
+            _ => return Statement::If { condition, body },
+        },
+        _ => return Statement::If { condition, body },
+    };
+    if op.precedence() != BinaryOp::Eq.precedence() {
+        return Statement::If { condition, body };
+    }
+    let op = op.as_str().to_string();
+    match left.as_ref() {
+        Expr::Field(target, drive) if **target == Expr::Ident("state".to_string()) => {
+            Statement::IfState {
+                drive: drive.clone(),
+                op,
+                value,
+                body,
+            }
+        }
+        Expr::Field(target, stat) if reward::STATS.contains(&stat.as_str()) => {
+            match target.as_ref() {
+                Expr::Field(reward, behavior) if **reward == Expr::Ident("reward".to_string()) => {
+                    Statement::IfReward {
+                        behavior: behavior.clone(),
+                        stat: stat.clone(),
+                        op,
+                        value,
+                        body,
+                    }
+                }
+                _ => Statement::If { condition, body },
+            }
+        }
+        _ => Statement::If { condition, body },
+    }
+}
+
+/// Whether `token` is a bare word such as `net` or `read`, keywords included.
+fn is_word(token: &Token) -> bool {
+    token.token_type != TokenType::String
+        && !token.literal.is_empty()
+        && token
+            .literal
+            .chars()
+            .all(|c| c.is_alphanumeric() || c == '_')
+}
+
+/// Statement bodies and strings taken from programs that are no longer
+/// needed, so that parsing their replacement reuses the allocations instead
+/// of making new ones. This pays off for the small chunks a REPL parses one
+/// after another; for large programs plain allocation is faster (see the
+/// `reparse_pooled` benchmarks).
+#[derive(Default)]
+pub struct StatementPool {
+    bodies: Vec<Vec<Statement>>,
+    strings: Vec<String>,
+}
+
+impl StatementPool {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Take `program` apart, keeping its buffers.
+    pub fn recycle(&mut self, program: Program) {
+        let (bodies, strings) = (self.bodies.len(), self.strings.len());
+        self.recycle_body(program.statements);
+        // Hand buffers out in the order the program used them, which keeps
+        // the next program's nodes close together in memory.
+        self.bodies[bodies..].reverse();
+        self.strings[strings..].reverse();
+    }
+
+    /// Buffers held, for benchmarks and tests.
+    pub fn len(&self) -> usize {
+        self.bodies.len() + self.strings.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.len() == 0
+    }
+
+    fn recycle_body(&mut self, mut body: Vec<Statement>) {
+        for statement in body.drain(..) {
+            self.recycle_statement(statement);
+        }
+        self.bodies.push(body);
+    }
+
+    fn recycle_statement(&mut self, statement: Statement) {
+        match statement {
+            Statement::AgentDeclaration { name: text, body }
+            | Statement::OnInput { param: text, body }
+            | Statement::OnOutput { param: text, body }
+            | Statement::OnSchedule { spec: text, body } => {
+                self.strings.push(text);
+                self.recycle_body(body);
+            }
+            Statement::OnStart { body }
+            | Statement::OnStop { body }
+            | Statement::Reflect { body }
+            | Statement::Evolve { body } => self.recycle_body(body),
+            Statement::Train { dataset, body } => {
+                self.strings.extend(dataset);
+                self.recycle_body(body);
+            }
+            Statement::IfContextIncludes { values, body } => {
+                self.strings.extend(values);
+                self.recycle_body(body);
+            }
+            Statement::If { body, .. } | Statement::While { body, .. } => self.recycle_body(body),
+            Statement::For {
+                key,
+                value,
+                region,
+                body,
+            } => {
+                self.strings.extend([key, value, region]);
+                self.recycle_body(body);
+            }
+            Statement::Let { name, .. }
+            | Statement::Assign { name, .. }
+            | Statement::Call { name, .. }
+            | Statement::Send { agent: name, .. } => self.strings.push(name),
+            Statement::Function { name, params, body } => {
+                self.strings.push(name);
+                self.strings.extend(params);
+                self.recycle_body(body);
+            }
+            Statement::IfElse { branch, otherwise } => {
+                self.recycle_statement(*branch);
+                self.recycle_body(otherwise);
+            }
+            Statement::IfState {
+                drive,
+                op,
+                value,
+                body,
+            } => {
+                self.strings.extend([drive, op, value]);
+                self.recycle_body(body);
+            }
+            Statement::IfReward {
+                behavior,
+                stat,
+                op,
+                value,
+                body,
+            } => {
+                self.strings.extend([behavior, stat, op, value]);
+                self.recycle_body(body);
+            }
+            Statement::Pipeline { stages: texts } | Statement::Capabilities(texts) => {
+                self.strings.extend(texts)
+            }
+            Statement::MemDeclaration { target: text }
+            | Statement::Goal(text)
+            | Statement::Import(text)
+            | Statement::Print(Text::Literal(text))
+            | Statement::Unknown(text) => self.strings.push(text),
+            Statement::Print(Text::Template { name, args }) => {
+                self.strings.push(name);
+                self.recycle_pairs(args);
+            }
+            Statement::ReflectAccess {
+                mem_target: a,
+                key: b,
+            }
+            | Statement::Embed {
+                source: a,
+                target: b,
+            }
+            | Statement::Template { name: a, text: b }
+            | Statement::Assignment(a, b) => self.strings.extend([a, b]),
+            Statement::Ask {
+                prompt,
+                options,
+                target,
+                key,
+            } => {
+                match prompt {
+                    Text::Literal(text) => self.strings.push(text),
+                    Text::Expr(_) => {}
+                    Text::Template { name, args } => {
+                        self.strings.push(name);
+                        self.recycle_pairs(args);
+                    }
+                }
+                self.strings.extend([target, key]);
+                self.recycle_pairs(options);
+            }
+            Statement::Fetch {
+                url: text,
+                options,
+                target,
+                key,
+            }
+            | Statement::Exec {
+                command: text,
+                options,
+                target,
+                key,
+            } => {
+                self.strings.extend([text, target, key]);
+                self.recycle_pairs(options);
+            }
+            Statement::ReadFile { path, target, key }
+            | Statement::WriteFile { target, key, path } => {
+                self.strings.extend([path, target, key])
+            }
+            Statement::Propose(Mutation::Goal(text)) | Statement::Reward(text) => {
+                self.strings.push(text)
+            }
+            Statement::Propose(Mutation::Threshold { drive: a, value: b })
+            | Statement::Propose(Mutation::Link { from: a, to: b }) => self.strings.extend([a, b]),
+            Statement::Location { .. }
+            | Statement::Attention { .. }
+            | Statement::Recall { .. }
+            | Statement::Emit(_)
+            | Statement::Print(Text::Expr(_))
+            | Statement::Lang(_)
+            | Statement::Return(_) => {}
+        }
+    }
+
+    fn recycle_pairs(&mut self, pairs: Vec<(String, String)>) {
+        for (name, value) in pairs {
+            self.strings.extend([name, value]);
+        }
+    }
+
+    fn body(&mut self) -> Vec<Statement> {
+        self.bodies.pop().unwrap_or_default()
+    }
+
+    fn string(&mut self, text: &str) -> String {
+        let mut string = self.strings.pop().unwrap_or_default();
+        string.clear();
+        string.push_str(text);
+        string
+    }
+}
+
+/// Re-parses a source that changes a little at a time, such as a REPL
+/// session or a file open in an editor. Top-level statements that end before
+/// the first changed byte are reused rather than parsed again.
+#[derive(Default)]
+pub struct IncrementalParser {
+    source: String,
+    parsed: Vec<Parsed>,
+    locations: bool,
+    reused: usize,
+}
+
+/// A parsed top-level statement and the part of the source it came from.
+struct Parsed {
+    /// The statement, preceded by its location marker if those are on.
+    statements: Vec<Statement>,
+    /// Bytes the lexer had examined when the statement was complete.
+    extent: usize,
+    /// Where the statement after this one starts.
+    next: Resume,
+}
+
+#[derive(Clone, Copy)]
+struct Resume {
+    offset: usize,
+    line: usize,
+    column: usize,
+}
+
+impl Resume {
+    const START: Resume = Resume {
+        offset: 0,
+        line: 1,
+        column: 1,
+    };
+
+    fn at(token: &Token) -> Self {
+        Resume {
+            offset: token.offset,
+            line: token.line,
+            column: token.column,
+        }
+    }
+}
+
+impl IncrementalParser {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Emit [`Statement::Location`] markers, as [`Parser::with_locations`].
+    pub fn with_locations(mut self) -> Self {
+        self.locations = true;
+        self
+    }
+
+    /// Parse `source`, reusing what is unchanged since the previous call.
+    pub fn parse(&mut self, source: &str) -> Program {
+        let changed = self
+            .source
+            .bytes()
+            .zip(source.bytes())
+            .take_while(|(old, new)| old == new)
+            .count();
+        if changed < self.source.len() || changed < source.len() {
+            let keep = self
+                .parsed
+                .iter()
+                .take_while(|parsed| parsed.extent < changed)
+                .count();
+            self.parsed.truncate(keep);
+            self.reused = keep;
+            self.parse_from(source);
+            self.source = source.to_string();
+        } else {
+            self.reused = self.parsed.len();
+        }
+        Program {
+            statements: self
+                .parsed
+                .iter()
+                .flat_map(|parsed| parsed.statements.iter().cloned())
+                .collect(),
+        }
+    }
+
+    /// Top-level statements the last [`parse`](Self::parse) reused.
+    pub fn reused(&self) -> usize {
+        self.reused
+    }
+
+    fn parse_from(&mut self, source: &str) {
+        let _span = tracing::info_span!("parse", reused = self.reused).entered();
+        let start = self
+            .parsed
+            .last()
+            .map_or(Resume::START, |parsed| parsed.next);
+        let mut lexer = Lexer::resume(source, start.offset, start.line, start.column);
+        let mut parser = Parser::new(&mut lexer);
+        parser.locations = self.locations;
+        // A pragma in the statements kept applies to the ones parsed again.
+        if let Some(version) = self
+            .parsed
+            .iter()
+            .flat_map(|parsed| &parsed.statements)
+            .filter_map(|stmt| match stmt {
+                Statement::Lang(version) => Some(*version),
+                _ => None,
+            })
+            .last()
+        {
+            parser.lang = version;
+        }
+        while parser.cur_token.token_type != TokenType::Eof {
+            let mut statements = Vec::new();
+            parser.parse_into(&mut statements);
+            let extent = parser.lexer.scanned();
+            parser.next_token();
+            self.parsed.push(Parsed {
+                statements,
+                extent,
+                next: Resume::at(&parser.cur_token),
+            });
         }
-        let val = self.cur_token.literal.clone();
-        Some(Statement::Print(val))
     }
 }
 
@@ -357,11 +1954,408 @@ mod tests {
                 );
                 assert!(
                     body.iter()
-                        .any(|s| matches!(s, Statement::Train { body: _ })),
+                        .any(|s| matches!(s, Statement::Train { dataset: None, .. })),
                     "expected Train {{ body }}"
                 );
             }
             _ => panic!("Expected AgentDeclaration"),
         }
     }
+
+    #[test]
+    fn marks_statement_locations() {
+        let input = "agent Echo {\n  on input(msg) {\n\n    print \"hi\"\n  }\n}";
+        let mut lexer = Lexer::new(input);
+        let program = Parser::new(&mut lexer).with_locations().parse_program();
+
+        assert_eq!(
+            program.statements[0],
+            Statement::Location { line: 1, depth: 1 }
+        );
+        let Statement::AgentDeclaration { body, .. } = &program.statements[1] else {
+            panic!("Expected AgentDeclaration");
+        };
+        assert_eq!(body[0], Statement::Location { line: 2, depth: 2 });
+        let Statement::OnInput { body, .. } = &body[1] else {
+            panic!("Expected OnInput");
+        };
+        assert_eq!(body[0], Statement::Location { line: 4, depth: 3 });
+    }
+
+    fn parse_fresh(input: &str) -> Program {
+        let mut lexer = Lexer::new(input);
+        Parser::new(&mut lexer).with_locations().parse_program()
+    }
+
+    #[test]
+    fn incremental_parse_reuses_unchanged_statements() {
+        let mut parser = IncrementalParser::new().with_locations();
+        let mut source = String::from("mem short\ngoal: \"one\"\nprint \"a\"\n");
+        assert_eq!(parser.parse(&source), parse_fresh(&source));
+        assert_eq!(parser.reused(), 0);
+
+        source.push_str("agent Echo {\n  print \"b\"\n}\n");
+        assert_eq!(parser.parse(&source), parse_fresh(&source));
+        assert_eq!(parser.reused(), 2);
+
+        let edited = source.replace("\"one\"", "\"two\"");
+        assert_eq!(parser.parse(&edited), parse_fresh(&edited));
+        assert_eq!(parser.reused(), 1);
+
+        assert_eq!(parser.parse(&edited), parse_fresh(&edited));
+        assert_eq!(parser.reused(), 4);
+    }
+
+    #[test]
+    fn incremental_parse_rereads_statements_touching_the_change() {
+        let mut parser = IncrementalParser::new();
+        parser.parse("x");
+        let program = parser.parse("x = 1");
+        assert_eq!(
+            program.statements,
+            [Statement::Assignment("x".to_string(), "1".to_string())]
+        );
+        assert_eq!(parser.reused(), 0);
+    }
+
+    #[test]
+    fn pooled_parse_matches_fresh_parse() {
+        let input = "agent Echo {\n  on input(msg) {\n    embed msg -> mem.short\n    ask \"hi\" (model: \"m\") -> mem.long[\"a\"]\n  }\n}";
+        let mut pool = StatementPool::new();
+        for _ in 0..2 {
+            let mut lexer = Lexer::new(input);
+            let mut parser = Parser::new(&mut lexer).with_pool(pool);
+            let program = parser.parse_program();
+            pool = parser.take_pool();
+            assert!(pool.is_empty());
+            assert_eq!(program, parse_fresh_plain(input));
+            pool.recycle(program);
+            assert!(!pool.is_empty());
+        }
+    }
+
+    #[test]
+    fn deep_nesting_does_not_overflow() {
+        for open in [
+            "agent A {",
+            "reflect {",
+            "on input(m) {",
+            "if context includes [\"a\"] {",
+        ] {
+            parse_fresh_plain(&open.repeat(100_000));
+        }
+        for prefix in ["(", "!", "- "] {
+            parse_fresh_plain(&format!("if {}x {{}}", prefix.repeat(100_000)));
+        }
+    }
+
+    #[test]
+    fn parses_else_if_chains() {
+        let program = parse_fresh_plain(concat!(
+            "if state.focus > 0.5 { print \"a\" }\n",
+            "else if x { print \"b\" } else { print \"c\" }\n",
+            "if x {} else\n",
+        ));
+        let print = |text: &str| vec![Statement::Print(Text::Literal(text.to_string()))];
+        let Statement::IfElse { branch, otherwise } = &program.statements[0] else {
+            panic!("expected IfElse, got {:?}", program.statements);
+        };
+        assert!(matches!(**branch, Statement::IfState { ref body, .. } if *body == print("a")));
+        assert_eq!(
+            otherwise,
+            &[Statement::IfElse {
+                branch: Box::new(Statement::If {
+                    condition: Expr::Ident("x".to_string()),
+                    body: print("b"),
+                }),
+                otherwise: print("c"),
+            }]
+        );
+        assert_eq!(program.statements.len(), 1);
+    }
+
+    #[test]
+    fn reports_where_statements_fail() {
+        let mut lexer = Lexer::new(concat!(
+            "print \"ok\"\n",
+            "for key in mem.short {\n",
+            "}\n",
+            "if x > {\n",
+            "}\n",
+            "let y 3\n",
+        ));
+        let mut parser = Parser::new(&mut lexer).with_lang(Version::V0_2);
+        let program = parser.parse_program();
+        let errors: Vec<String> = parser.errors().iter().map(|e| e.to_string()).collect();
+        assert_eq!(
+            errors,
+            [
+                "2:9: expected `,` and a name for the value, found `in`",
+                "4:8: expected an expression, found `{`",
+                "6:7: expected `=`, found `3`",
+            ]
+        );
+        assert!(parser.errors().iter().all(|e| e.code() == "SEN1003"));
+        assert!(matches!(program.statements[0], Statement::Print(_)));
+    }
+
+    #[test]
+    fn reports_unknown_statements_and_the_end_of_input_where_they_are() {
+        let mut lexer = Lexer::new("agent A {\n  garbage\n}\nprint 1 +\n\n");
+        let mut parser = Parser::new(&mut lexer);
+        parser.parse_program();
+        let unknown: Vec<String> = parser
+            .unknown_statements()
+            .iter()
+            .map(|e| e.to_string())
+            .collect();
+        assert_eq!(unknown, ["2:3: unknown statement `garbage`"]);
+        let errors: Vec<String> = parser.errors().iter().map(|e| e.to_string()).collect();
+        assert_eq!(errors, ["4:10: expected an expression, found end of input"]);
+
+        let mut lexer = Lexer::new("if x");
+        let mut parser = Parser::new(&mut lexer);
+        parser.parse_program();
+        assert_eq!(
+            parser.errors()[0].to_string(),
+            "1:5: expected `{`, found end of input"
+        );
+    }
+
+    #[test]
+    fn reads_minus_before_numbers_as_an_operator() {
+        let source = "reward -1\nif state.focus > -0.5 {}\nx = n-1\ny = -2";
+        let (program, errors) = parse_as(Version::V0_2, source);
+        assert!(errors.is_empty(), "{:?}", errors);
+        let n = Box::new(Expr::Ident("n".to_string()));
+        let number = |text: &str| Box::new(Expr::Number(text.to_string()));
+        let lasting = [
+            Statement::Reward("-1".to_string()),
+            Statement::IfState {
+                drive: "focus".to_string(),
+                op: ">".to_string(),
+                value: "-0.5".to_string(),
+                body: Vec::new(),
+            },
+        ];
+        assert_eq!(program.statements[..2], lasting);
+        assert_eq!(
+            program.statements[2..],
+            [
+                Statement::Assign {
+                    name: "x".to_string(),
+                    value: Expr::Binary(BinaryOp::Sub, n, number("1")),
+                },
+                Statement::Assign {
+                    name: "y".to_string(),
+                    value: Expr::Unary(UnaryOp::Neg, number("2")),
+                },
+            ]
+        );
+
+        // `lang 0.1` assignments keep the text they had.
+        let (program, _) = parse_as(Version::V0_1, source);
+        assert_eq!(program.statements[..2], lasting);
+        assert_eq!(
+            program.statements[2],
+            Statement::Assignment("x".to_string(), "n".to_string())
+        );
+        assert_eq!(
+            program.statements.last(),
+            Some(&Statement::Assignment("y".to_string(), "-2".to_string()))
+        );
+    }
+
+    #[test]
+    fn reads_newer_syntax_only_from_its_version() {
+        let source = concat!(
+            "let a = [1]\n",
+            "fn f(x) {\n",
+            "  return {\"k\": x}\n",
+            "}\n",
+            "while a {\n",
+            "}\n",
+            "for key, value in mem.short {\n",
+            "}\n",
+            "recall \"q\" top 1 -> mem.short[\"r\"]\n",
+            "send Other \"hi\"\n",
+            "emit a\n",
+            "f(1)\n",
+            "flag = false\n",
+        );
+        let (program, errors) = parse_as(Version::V0_1, source);
+        assert_eq!(
+            errors,
+            [
+                "1:1: `let` requires `lang 0.2`",
+                "1:9: a list requires `lang 0.2`",
+                "2:1: `fn` requires `lang 0.2`",
+                "3:3: `return` requires `lang 0.2`",
+                "3:10: a map requires `lang 0.2`",
+                "5:1: `while` requires `lang 0.2`",
+                "7:1: `for` requires `lang 0.2`",
+                "9:1: `recall` requires `lang 0.2`",
+                "10:1: `send` requires `lang 0.2`",
+                "11:1: `emit` requires `lang 0.2`",
+                "12:1: a function call requires `lang 0.2`",
+            ]
+        );
+        assert_eq!(
+            program.statements.last(),
+            Some(&Statement::Assignment(
+                "flag".to_string(),
+                "false".to_string()
+            ))
+        );
+
+        for version in [Version::V0_2, Version::V0_3] {
+            let (program, errors) = parse_as(version, source);
+            assert!(errors.is_empty(), "{}: {:?}", version, errors);
+            assert_eq!(
+                program.statements.last(),
+                Some(&Statement::Assign {
+                    name: "flag".to_string(),
+                    value: Expr::Bool(false),
+                })
+            );
+        }
+        let (_, errors) = parse_as(Version::V0_1, &format!("lang 0.2\n{}", source));
+        assert!(errors.is_empty(), "{:?}", errors);
+    }
+
+    #[test]
+    fn parses_conditions_by_precedence() {
+        let program = parse_fresh_plain(
+            "if loss > 0.1 && mem.short[\"x\"] == \"hi\" || !(a - -1) * 2 {}\nif state.focus >= 0.5 {}",
+        );
+        let ident = |name: &str| Box::new(Expr::Ident(name.to_string()));
+        let number = |value: &str| Box::new(Expr::Number(value.to_string()));
+        let binary = |op, left, right| Box::new(Expr::Binary(op, left, right));
+        let loss = binary(BinaryOp::Gt, ident("loss"), number("0.1"));
+        let short = Box::new(Expr::Field(ident("mem"), "short".to_string()));
+        let lookup = Box::new(Expr::Index(short, Box::new(Expr::Text("x".to_string()))));
+        let hi = binary(BinaryOp::Eq, lookup, Box::new(Expr::Text("hi".to_string())));
+        let not = Box::new(Expr::Unary(
+            UnaryOp::Not,
+            binary(
+                BinaryOp::Sub,
+                ident("a"),
+                Box::new(Expr::Unary(UnaryOp::Neg, number("1"))),
+            ),
+        ));
+        assert_eq!(
+            program.statements,
+            [
+                Statement::If {
+                    condition: *binary(
+                        BinaryOp::Or,
+                        binary(BinaryOp::And, loss, hi),
+                        binary(BinaryOp::Mul, not, number("2")),
+                    ),
+                    body: Vec::new(),
+                },
+                Statement::IfState {
+                    drive: "focus".to_string(),
+                    op: ">=".to_string(),
+                    value: "0.5".to_string(),
+                    body: Vec::new(),
+                },
+            ]
+        );
+        assert!(matches!(
+            parse_fresh_plain("if a && {}").statements[0],
+            Statement::Unknown(_)
+        ));
+    }
+
+    /// Lex and parse random mixes of DSL fragments, including unterminated
+    /// strings and dangling arrows. See `fuzz/` for the coverage-guided
+    /// version of this test.
+    #[test]
+    fn arbitrary_input_never_panics() {
+        const FRAGMENTS: &[&str] = &[
+            "agent",
+            "on",
+            "input",
+            "(",
+            ")",
+            "{",
+            "}",
+            "[",
+            "]",
+            "mem.short",
+            "mem.long",
+            "\"",
+            "\"text\"",
+            "\\",
+            "\\\"",
+            "<-",
+            "<->",
+            "->",
+            "-",
+            "&&",
+            "!",
+            "==",
+            ":",
+            ",",
+            "=",
+            ".",
+            "embed",
+            "reflect",
+            "train",
+            "if",
+            "context",
+            "includes",
+            "print",
+            "ask",
+            "fetch",
+            "goal",
+            "evolve",
+            "link",
+            "msg",
+            "42",
+            "é",
+            "🙂",
+            "\n",
+            " ",
+            "\t",
+            "#",
+            "\0",
+        ];
+        let mut state: u64 = 0x9E37_79B9_7F4A_7C15;
+        let mut next = move || {
+            state ^= state << 13;
+            state ^= state >> 7;
+            state ^= state << 17;
+            state
+        };
+        for _ in 0..5_000 {
+            let len = next() % 40;
+            let input: String = (0..len)
+                .map(|_| FRAGMENTS[(next() % FRAGMENTS.len() as u64) as usize])
+                .collect();
+
+            let mut lexer = Lexer::new(&input);
+            let mut tokens = 0;
+            while lexer.next_token().token_type != TokenType::Eof {
+                tokens += 1;
+                assert!(tokens <= input.len(), "lexer stuck on {:?}", input);
+            }
+            parse_fresh_plain(&input);
+        }
+    }
+
+    fn parse_fresh_plain(input: &str) -> Program {
+        let mut lexer = Lexer::new(input);
+        Parser::new(&mut lexer).parse_program()
+    }
+
+    /// `input` parsed as `version`, and the errors found.
+    fn parse_as(version: Version, input: &str) -> (Program, Vec<String>) {
+        let mut lexer = Lexer::new(input);
+        let mut parser = Parser::new(&mut lexer).with_lang(version);
+        let program = parser.parse_program();
+        let errors = parser.errors().iter().map(|e| e.to_string()).collect();
+        (program, errors)
+    }
 }
@@ -0,0 +1,197 @@
+use crate::context::AgentContext;
+use crate::error::{MemoryError, RuntimeError};
+use crate::eval::{eval, run_block};
+use crate::limits::Limits;
+use crate::types::Program;
+use std::collections::HashMap;
+use std::sync::{Arc, Condvar, Mutex};
+
+/// Concurrency-safe manager running one parsed program for many sessions.
+///
+/// Every session gets its own [`AgentContext`], cloned on first use from a
+/// template built by evaluating the shared program once. Sessions are locked
+/// individually, so different sessions run in parallel while inputs to the
+/// same session are serialized. At most `max_concurrency` evaluations run at
+/// once.
+pub struct InterpreterPool {
+    program: Arc<Program>,
+    template: AgentContext,
+    sessions: Mutex<HashMap<String, Arc<Mutex<AgentContext>>>>,
+    permits: Mutex<usize>,
+    available: Condvar,
+}
+
+/// Held while an evaluation runs; returns its permit to the pool on drop.
+struct Permit<'a> {
+    pool: &'a InterpreterPool,
+}
+
+impl Drop for Permit<'_> {
+    fn drop(&mut self) {
+        *self.pool.permits.lock().unwrap() += 1;
+        self.pool.available.notify_one();
+    }
+}
+
+impl InterpreterPool {
+    pub fn new(program: Program, max_concurrency: usize) -> Self {
+        let mut template = AgentContext::new();
+        let mut output = Vec::new();
+        for stmt in &program.statements {
+            // Programs are validated by `embedded::compile`; a failing
+            // top-level statement leaves the template without that agent.
+            let _ = eval(stmt, "", "", &mut template, &mut output);
+        }
+
+        Self {
+            program: Arc::new(program),
+            template,
+            sessions: Mutex::new(HashMap::new()),
+            permits: Mutex::new(max_concurrency.max(1)),
+            available: Condvar::new(),
+        }
+    }
+
+    /// Apply `limits` to each session, so no one session can use more than
+    /// its share.
+    pub fn with_limits(mut self, limits: Limits) -> Self {
+        self.template.limits = limits;
+        self
+    }
+
+    pub fn program(&self) -> &Program {
+        &self.program
+    }
+
+    /// Context for `session_id`, cloned from the template if needed.
+    pub fn session(&self, session_id: &str) -> Arc<Mutex<AgentContext>> {
+        let mut sessions = self.sessions.lock().unwrap();
+        sessions
+            .entry(session_id.to_string())
+            .or_insert_with(|| Arc::new(Mutex::new(self.template.clone())))
+            .clone()
+    }
+
+    pub fn remove_session(&self, session_id: &str) -> Option<Arc<Mutex<AgentContext>>> {
+        self.sessions.lock().unwrap().remove(session_id)
+    }
+
+    pub fn session_count(&self) -> usize {
+        self.sessions.lock().unwrap().len()
+    }
+
+    pub fn session_ids(&self) -> Vec<String> {
+        self.sessions.lock().unwrap().keys().cloned().collect()
+    }
+
+    /// Deliver `input` to the session's `on input` handler.
+    pub fn handle_input(&self, session_id: &str, input: &str) -> Result<String, RuntimeError> {
+        self.run(session_id, "input", input)
+    }
+
+    /// Run the session's `on input`, `train` or `evolve` block, blocking while
+    /// the pool is at its concurrency limit.
+    pub fn run(&self, session_id: &str, kind: &str, input: &str) -> Result<String, RuntimeError> {
+        let session = self.session(session_id);
+        let _permit = self.acquire();
+        let mut ctx = session.lock().unwrap();
+        run_block(&mut ctx, kind, input, "").map(|output| output.join("\n"))
+    }
+
+    /// Save the session's memory to `path` as
+    /// [`AgentContext::save`](crate::context::AgentContext::save) does. The
+    /// session is locked only while its memory is frozen, so its inputs go on
+    /// running while the file is written and do not show up in it.
+    pub fn save_session(&self, session_id: &str, path: &str) -> Result<(), MemoryError> {
+        let frozen = self.session(session_id).lock().unwrap().freeze();
+        frozen.save(path)
+    }
+
+    fn acquire(&self) -> Permit<'_> {
+        let mut permits = self.permits.lock().unwrap();
+        while *permits == 0 {
+            permits = self.available.wait(permits).unwrap();
+        }
+        *permits -= 1;
+        Permit { pool: self }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::embedded::compile;
+    use std::thread;
+
+    const ECHO: &str = r#"
+        agent Echo {
+          on input(msg) {
+            reflect { mem.short["msg"] }
+          }
+        }
+    "#;
+
+    #[test]
+    fn sessions_are_isolated() {
+        let pool = InterpreterPool::new(compile("echo", ECHO).unwrap(), 2);
+        assert_eq!(pool.handle_input("a", "hello").unwrap(), "  hello");
+        assert_eq!(pool.handle_input("b", "world").unwrap(), "  world");
+
+        let a = pool.session("a");
+        assert_eq!(a.lock().unwrap().get_mem("short", "msg"), "hello");
+        assert_eq!(pool.session_count(), 2);
+    }
+
+    #[test]
+    fn concurrent_sessions() {
+        let pool = Arc::new(InterpreterPool::new(compile("echo", ECHO).unwrap(), 4));
+        let handles: Vec<_> = (0..32)
+            .map(|i| {
+                let pool = pool.clone();
+                thread::spawn(move || {
+                    let id = format!("s{}", i % 8);
+                    pool.handle_input(&id, &format!("m{}", i)).unwrap()
+                })
+            })
+            .collect();
+        for handle in handles {
+            assert!(handle.join().unwrap().trim().starts_with('m'));
+        }
+        assert_eq!(pool.session_count(), 8);
+    }
+
+    #[test]
+    fn saves_are_consistent_while_inputs_run() {
+        const PAIR: &str = r#"
+            agent Pair {
+              on input(msg) {
+                first = msg
+                second = msg
+              }
+            }
+        "#;
+        let pool = Arc::new(InterpreterPool::new(compile("pair", PAIR).unwrap(), 2));
+        pool.handle_input("s", "m0").unwrap();
+        let writer = {
+            let pool = pool.clone();
+            thread::spawn(move || {
+                for i in 1..500 {
+                    pool.handle_input("s", &format!("m{}", i)).unwrap();
+                }
+            })
+        };
+        let path = std::env::temp_dir().join(format!("pool-save-{}.json", std::process::id()));
+        let path = path.to_str().unwrap();
+        for _ in 0..50 {
+            pool.save_session("s", path).unwrap();
+            let mut saved = AgentContext::new();
+            saved.load(path).unwrap();
+            let first = saved.get_mem("short", "first");
+            assert!(first.starts_with('m'));
+            assert_eq!(saved.get_mem("short", "second"), first);
+            assert_eq!(saved.get_mem("short", "msg"), first);
+        }
+        writer.join().unwrap();
+        let _ = std::fs::remove_file(path);
+    }
+}
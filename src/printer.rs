@@ -0,0 +1,808 @@
+//! Turning a parsed program back into source. Parsing the printed source
+//! gives the same program, apart from `Statement::Location` markers, which
+//! are not printed.
+
+use crate::schedule;
+use crate::types::{Expr, Mutation, Program, Statement, Text, UNARY_PRECEDENCE};
+use std::fmt::Write;
+
+/// Indentation of each nesting level.
+const INDENT: &str = "  ";
+
+/// Source for `program`, one statement per line.
+pub fn print(program: &Program) -> String {
+    let mut out = String::new();
+    print_body(&mut out, &program.statements, 0);
+    out
+}
+
+fn print_body(out: &mut String, body: &[Statement], depth: usize) {
+    for statement in body {
+        print_statement(out, statement, depth);
+    }
+}
+
+fn print_block(out: &mut String, header: &str, body: &[Statement], depth: usize) {
+    let _ = writeln!(out, "{}{} {{", INDENT.repeat(depth), header);
+    print_body(out, body, depth + 1);
+    let _ = writeln!(out, "{}}}", INDENT.repeat(depth));
+}
+
+fn print_statement(out: &mut String, statement: &Statement, depth: usize) {
+    let line = match statement {
+        Statement::AgentDeclaration { name, body } => {
+            return print_block(out, &format!("agent {}", name), body, depth)
+        }
+        Statement::OnInput { param, body } => {
+            return print_block(out, &format!("on input({})", param), body, depth)
+        }
+        Statement::OnSchedule { spec, body } => {
+            let head = match spec.strip_prefix("every ") {
+                Some(interval) if schedule::parse_interval(interval).is_ok() => spec.clone(),
+                _ => format!("on schedule({})", quote(spec)),
+            };
+            return print_block(out, &head, body, depth);
+        }
+        Statement::OnStart { body } => return print_block(out, "on start", body, depth),
+        Statement::OnStop { body } => return print_block(out, "on stop", body, depth),
+        Statement::OnOutput { param, body } => {
+            return print_block(out, &format!("on output({})", param), body, depth)
+        }
+        Statement::Reflect { body } => match body.as_slice() {
+            [Statement::ReflectAccess { mem_target, key }] => {
+                format!("reflect {{ mem.{}[{}] }}", mem_target, quote(key))
+            }
+            _ => {
+                // Memory reads in the block go without `reflect`.
+                let _ = writeln!(out, "{}reflect {{", INDENT.repeat(depth));
+                for inner in body {
+                    match inner {
+                        Statement::ReflectAccess { mem_target, key } => {
+                            let _ = writeln!(
+                                out,
+                                "{}mem.{}[{}]",
+                                INDENT.repeat(depth + 1),
+                                mem_target,
+                                quote(key)
+                            );
+                        }
+                        _ => print_statement(out, inner, depth + 1),
+                    }
+                }
+                let _ = writeln!(out, "{}}}", INDENT.repeat(depth));
+                return;
+            }
+        },
+        Statement::Train {
+            dataset: None,
+            body,
+        } => return print_block(out, "train", body, depth),
+        Statement::Train {
+            dataset: Some(path),
+            body,
+        } => {
+            let header = format!("train from {}", quote(path));
+            return print_block(out, &header, body, depth);
+        }
+        Statement::Evolve { body } => return print_block(out, "evolve", body, depth),
+        Statement::IfContextIncludes { values, body } => {
+            let values: Vec<String> = values.iter().map(|v| quote(v)).collect();
+            let header = format!("if context includes [{}]", values.join(", "));
+            return print_block(out, &header, body, depth);
+        }
+        Statement::IfElse { branch, otherwise } => {
+            return print_if_else(out, branch, otherwise, depth)
+        }
+        Statement::If { condition, body } => {
+            return print_block(
+                out,
+                &format!("if {}", print_condition(condition)),
+                body,
+                depth,
+            )
+        }
+        Statement::Function { name, params, body } => {
+            let header = format!("fn {}({})", name, params.join(", "));
+            return print_block(out, &header, body, depth);
+        }
+        Statement::While { condition, body } => {
+            return print_block(
+                out,
+                &format!("while {}", print_condition(condition)),
+                body,
+                depth,
+            )
+        }
+        Statement::For {
+            key,
+            value,
+            region,
+            body,
+        } => {
+            let header = format!("for {}, {} in mem.{}", key, value, region);
+            return print_block(out, &header, body, depth);
+        }
+        Statement::IfState {
+            drive,
+            op,
+            value,
+            body,
+        } => {
+            let header = format!("if state.{} {} {}", drive, op, value);
+            return print_block(out, &header, body, depth);
+        }
+        Statement::IfReward {
+            behavior,
+            stat,
+            op,
+            value,
+            body,
+        } => {
+            let header = format!("if reward.{}.{} {} {}", behavior, stat, op, value);
+            return print_block(out, &header, body, depth);
+        }
+        Statement::Reward(value) => format!("reward {}", value),
+        Statement::MemDeclaration { target } => format!("mem {}", target),
+        Statement::ReflectAccess { mem_target, key } => {
+            format!("reflect mem.{}[{}]", mem_target, quote(key))
+        }
+        Statement::Attention { top } => format!("attention top {}", top),
+        Statement::Pipeline { stages } => format!("pipeline {}", stages.join(" -> ")),
+        Statement::Import(module) => format!("import {}", module),
+        Statement::Lang(version) => format!("lang {}", version),
+        Statement::Goal(goal) => format!("goal: {}", quote(goal)),
+        Statement::Capabilities(capabilities) => {
+            format!("capabilities: {}", capabilities.join(", "))
+                .trim_end()
+                .to_string()
+        }
+        Statement::Embed { source, target } => format!("embed {} -> {}", source, target),
+        Statement::Template { name, text } => format!("template {} = {}", name, quote(text)),
+        Statement::Print(text) => format!("print {}", print_text(text)),
+        Statement::Ask {
+            prompt,
+            options,
+            target,
+            key,
+        } => {
+            let prompt = match prompt {
+                // Options would read as the arguments of a call.
+                Text::Expr(value) if !options.is_empty() => format!("({})", print_expr(value)),
+                _ => print_text(prompt),
+            };
+            request("ask", &prompt, options, target, key)
+        }
+        Statement::Fetch {
+            url: text,
+            options,
+            target,
+            key,
+        } => request("fetch", &quote(text), options, target, key),
+        Statement::Exec {
+            command: text,
+            options,
+            target,
+            key,
+        } => request("exec", &quote(text), options, target, key),
+        Statement::ReadFile { path, target, key } => {
+            format!("read {} -> mem.{}[{}]", quote(path), target, quote(key))
+        }
+        Statement::WriteFile { target, key, path } => {
+            format!("write mem.{}[{}] -> {}", target, quote(key), quote(path))
+        }
+        Statement::Assignment(name, value) => format!("{} = {}", name, quote(value)),
+        Statement::Assign { name, value } => format!("{} = {}", name, print_expr(value)),
+        Statement::Let { name, value } => format!("let {} = {}", name, print_expr(value)),
+        Statement::Recall { query, top } => format!("recall {} top {}", print_expr(query), top),
+        Statement::Send { agent, message } => format!("send {} {}", agent, print_expr(message)),
+        Statement::Emit(value) => format!("emit {}", print_expr(value)),
+        Statement::Return(None) => "return".to_string(),
+        Statement::Return(Some(value)) => format!("return {}", print_expr(value)),
+        Statement::Call { name, args } => call(name, args),
+        Statement::Propose(mutation) => format!("propose {}", print_mutation(mutation)),
+        Statement::Unknown(text) => text.clone(),
+        Statement::Location { .. } => return,
+    };
+    let _ = writeln!(out, "{}{}", INDENT.repeat(depth), line);
+}
+
+/// `branch` with its closing brace followed by `else` and `otherwise`,
+/// written as `else if` when `otherwise` is just another `if`.
+fn print_if_else(out: &mut String, branch: &Statement, otherwise: &[Statement], depth: usize) {
+    print_statement(out, branch, depth);
+    out.truncate(out.trim_end().len() - 1);
+    let mut statements = otherwise
+        .iter()
+        .filter(|stmt| !matches!(stmt, Statement::Location { .. }));
+    match (statements.next(), statements.next()) {
+        (
+            Some(
+                inner @ (Statement::If { .. }
+                | Statement::IfElse { .. }
+                | Statement::IfState { .. }
+                | Statement::IfReward { .. }
+                | Statement::IfContextIncludes { .. }),
+            ),
+            None,
+        ) => {
+            let start = out.len();
+            print_statement(out, inner, depth);
+            out.replace_range(start..start + INDENT.len() * depth, "} else ");
+        }
+        _ => {
+            out.push_str("} else {\n");
+            print_body(out, otherwise, depth + 1);
+            let _ = writeln!(out, "{}}}", INDENT.repeat(depth));
+        }
+    }
+}
+
+/// `mutation` as written after `propose`.
+pub fn print_mutation(mutation: &Mutation) -> String {
+    match mutation {
+        Mutation::Goal(goal) => format!("goal {}", quote(goal)),
+        Mutation::Threshold { drive, value } => format!("threshold {} {}", drive, value),
+        Mutation::Link { from, to } => format!("link {} -> {}", quote(from), quote(to)),
+    }
+}
+
+/// `expr` as written in source, with the parentheses its grouping needs.
+pub fn print_expr(expr: &Expr) -> String {
+    match expr {
+        Expr::Text(text) => quote(text),
+        Expr::Number(number) => number.clone(),
+        Expr::Bool(value) => value.to_string(),
+        Expr::Ident(name) => name.clone(),
+        Expr::Field(target, name) => format!("{}.{}", operand(target, POSTFIX), name),
+        Expr::Index(target, index) => {
+            format!("{}[{}]", operand(target, POSTFIX), print_expr(index))
+        }
+        Expr::Unary(op, expr) => format!("{}{}", op.as_str(), operand(expr, UNARY_PRECEDENCE)),
+        Expr::Binary(op, left, right) => format!(
+            "{} {} {}",
+            operand(left, op.precedence()),
+            op.as_str(),
+            operand(right, op.precedence() + 1)
+        ),
+        Expr::Call(name, args) => call(name, args),
+        Expr::List(items) => {
+            let items: Vec<String> = items.iter().map(print_expr).collect();
+            format!("[{}]", items.join(", "))
+        }
+        Expr::Map(entries) => {
+            let entries: Vec<String> = entries
+                .iter()
+                .map(|(key, value)| format!("{}: {}", print_expr(key), print_expr(value)))
+                .collect();
+            format!("{{{}}}", entries.join(", "))
+        }
+    }
+}
+
+/// The condition of an `if` or `while`, in parentheses when a map literal
+/// in it would otherwise read as the start of the body.
+fn print_condition(condition: &Expr) -> String {
+    fn bare_map(expr: &Expr) -> bool {
+        match expr {
+            Expr::Map(_) => true,
+            Expr::Field(target, _) | Expr::Index(target, _) => bare_map(target),
+            Expr::Unary(_, expr) => bare_map(expr),
+            Expr::Binary(_, left, right) => bare_map(left) || bare_map(right),
+            _ => false,
+        }
+    }
+    if bare_map(condition) {
+        format!("({})", print_expr(condition))
+    } else {
+        print_expr(condition)
+    }
+}
+
+/// `name(args)`, as a statement or in an expression.
+fn call(name: &str, args: &[Expr]) -> String {
+    let args: Vec<String> = args.iter().map(print_expr).collect();
+    format!("{}({})", name, args.join(", "))
+}
+
+/// Precedence of `.name` and `[index]`, which bind tighter than any prefix.
+const POSTFIX: u8 = UNARY_PRECEDENCE + 1;
+
+/// `expr` as an operand that must bind at least as tightly as `min`.
+fn operand(expr: &Expr, min: u8) -> String {
+    let precedence = match expr {
+        Expr::Binary(op, ..) => op.precedence(),
+        Expr::Unary(..) => UNARY_PRECEDENCE,
+        _ => u8::MAX,
+    };
+    if precedence < min {
+        format!("({})", print_expr(expr))
+    } else {
+        print_expr(expr)
+    }
+}
+
+/// A string, or a template call with its arguments.
+fn print_text(text: &Text) -> String {
+    match text {
+        Text::Literal(text) => quote(text),
+        Text::Expr(value) => print_expr(value),
+        Text::Template { name, args } => {
+            let args: Vec<String> = args
+                .iter()
+                .map(|(param, value)| format!("{}: {}", param, argument(value)))
+                .collect();
+            format!("{}({})", name, args.join(", "))
+        }
+    }
+}
+
+/// A template argument, written as the reference it was parsed from when
+/// it is nothing but one placeholder.
+fn argument(value: &str) -> String {
+    let word = |text: &str| {
+        text.starts_with(|c: char| c.is_alphabetic() || c == '_')
+            && text.chars().all(|c| c.is_alphanumeric() || c == '_')
+    };
+    let Some(reference) = value
+        .strip_prefix('{')
+        .and_then(|rest| rest.strip_suffix('}'))
+    else {
+        return quote(value);
+    };
+    if let Some((region, key)) = reference
+        .strip_prefix("mem.")
+        .and_then(|rest| rest.strip_suffix("\"]"))
+        .and_then(|rest| rest.split_once("[\""))
+    {
+        if word(region) && !key.contains(['"', '[', ']', '{', '}']) {
+            return format!("mem.{}[{}]", region, quote(key));
+        }
+    } else if !reference
+        .split('.')
+        .next()
+        .is_some_and(|first| first == "mem")
+    {
+        let mut parts = reference.split('.');
+        if parts.by_ref().take(2).all(word) && parts.next().is_none() {
+            return reference.to_string();
+        }
+    }
+    quote(value)
+}
+
+/// `ask`, `fetch` or `exec`, with its already written text, options and
+/// destination.
+fn request(
+    keyword: &str,
+    text: &str,
+    options: &[(String, String)],
+    target: &str,
+    key: &str,
+) -> String {
+    let mut line = format!("{} {}", keyword, text);
+    if !options.is_empty() {
+        let options: Vec<String> = options
+            .iter()
+            .map(|(name, value)| format!("{}: {}", name, quote(value)))
+            .collect();
+        let _ = write!(line, " ({})", options.join(", "));
+    }
+    let _ = write!(line, " -> mem.{}[{}]", target, quote(key));
+    line
+}
+
+/// `text` as a string literal the lexer reads back unchanged.
+pub fn quote(text: &str) -> String {
+    let mut quoted = String::with_capacity(text.len() + 2);
+    quoted.push('"');
+    for c in text.chars() {
+        match c {
+            '"' => quoted.push_str("\\\""),
+            '\\' => quoted.push_str("\\\\"),
+            '\n' => quoted.push_str("\\n"),
+            '\t' => quoted.push_str("\\t"),
+            c => quoted.push(c),
+        }
+    }
+    quoted.push('"');
+    quoted
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::lang::Version;
+    use crate::lexer::Lexer;
+    use crate::parser::Parser;
+    use crate::reward;
+    use crate::types::{BinaryOp, UnaryOp};
+
+    fn parse(source: &str) -> Program {
+        let mut lexer = Lexer::new(source);
+        Parser::new(&mut lexer).parse_program()
+    }
+
+    /// `source` read as `lang 0.2`, the oldest version with every statement
+    /// [`Gen`] makes.
+    fn parse_latest(source: &str) -> Program {
+        let mut lexer = Lexer::new(source);
+        let mut parser = Parser::new(&mut lexer).with_lang(Version::V0_2);
+        let program = parser.parse_program();
+        assert_eq!(parser.errors(), [], "{}", source);
+        program
+    }
+
+    /// Seeded generator of valid programs, so a failure can be reproduced.
+    struct Gen(u64);
+
+    impl Gen {
+        fn next(&mut self) -> u64 {
+            self.0 ^= self.0 << 13;
+            self.0 ^= self.0 >> 7;
+            self.0 ^= self.0 << 17;
+            self.0
+        }
+
+        fn below(&mut self, n: usize) -> usize {
+            (self.next() % n as u64) as usize
+        }
+
+        fn pick<'a>(&mut self, choices: &[&'a str]) -> &'a str {
+            choices[self.below(choices.len())]
+        }
+
+        fn ident(&mut self) -> String {
+            let ident = self.pick(&["msg", "x", "user_name", "a1", "Echo", "_tmp"]);
+            ident.to_string()
+        }
+
+        fn text(&mut self) -> String {
+            let parts = [
+                "hi",
+                " ",
+                "\"",
+                "\\",
+                "\n",
+                "\t",
+                "é",
+                "{",
+                "}",
+                "->",
+                "mem.short",
+            ];
+            (0..self.below(5)).map(|_| self.pick(&parts)).collect()
+        }
+
+        fn target(&mut self) -> String {
+            self.pick(&["short", "long"]).to_string()
+        }
+
+        fn options(&mut self) -> Vec<(String, String)> {
+            (0..self.below(3))
+                .map(|_| (self.ident(), self.text()))
+                .collect()
+        }
+
+        /// A string or a template call, with arguments that print as
+        /// references or as strings.
+        fn prompt(&mut self) -> Text {
+            match self.below(3) {
+                0 => return Text::Literal(self.text()),
+                // Not a lone string or number, which parse as a literal.
+                1 => {
+                    return Text::Expr(Expr::Binary(
+                        BinaryOp::Add,
+                        Box::new(Expr::Text(self.text())),
+                        Box::new(self.expr(1)),
+                    ))
+                }
+                _ => {}
+            }
+            // With no arguments, `name()` reads back as a function call.
+            Text::Template {
+                name: self.ident(),
+                args: (0..1 + self.below(2))
+                    .map(|_| {
+                        let value = match self.below(4) {
+                            0 => format!("{{{}}}", self.ident()),
+                            1 => format!("{{state.{}}}", self.ident()),
+                            2 => format!("{{mem.{}[\"{}\"]}}", self.target(), self.ident()),
+                            _ => self.text(),
+                        };
+                        (self.ident(), value)
+                    })
+                    .collect(),
+            }
+        }
+
+        /// An expression nested at most `depth` operators deep. Names avoid
+        /// `state` and `reward`, whose comparisons parse as other statements.
+        fn expr(&mut self, depth: usize) -> Expr {
+            let kinds = if depth > 0 { 11 } else { 5 };
+            match self.below(kinds) {
+                0 => Expr::Text(self.text()),
+                1 => Expr::Number(self.pick(&["0", "0.5", "3", "12"]).to_string()),
+                2 => Expr::Bool(self.below(2) == 0),
+                3 => Expr::Ident(self.ident()),
+                4 => Expr::Index(
+                    Box::new(Expr::Field(
+                        Box::new(Expr::Ident("mem".to_string())),
+                        self.target(),
+                    )),
+                    Box::new(Expr::Text(self.text())),
+                ),
+                5 => {
+                    // `3.x` would read as a number.
+                    let target = match self.expr(depth - 1) {
+                        Expr::Number(_) => Expr::Ident(self.ident()),
+                        target => target,
+                    };
+                    Expr::Field(Box::new(target), self.ident())
+                }
+                6 => {
+                    let op = [UnaryOp::Not, UnaryOp::Neg][self.below(2)];
+                    Expr::Unary(op, Box::new(self.expr(depth - 1)))
+                }
+                7 => Expr::Call(self.ident(), self.args(depth - 1)),
+                8 => Expr::List(self.args(depth - 1)),
+                9 => Expr::Map(
+                    (0..self.below(3))
+                        .map(|_| (Expr::Text(self.text()), self.expr(depth - 1)))
+                        .collect(),
+                ),
+                _ => Expr::Binary(
+                    BinaryOp::ALL[self.below(BinaryOp::ALL.len())],
+                    Box::new(self.expr(depth - 1)),
+                    Box::new(self.expr(depth - 1)),
+                ),
+            }
+        }
+
+        fn args(&mut self, depth: usize) -> Vec<Expr> {
+            (0..self.below(3)).map(|_| self.expr(depth)).collect()
+        }
+
+        /// One of the statements `else` can follow.
+        fn if_statement(&mut self, depth: usize) -> Statement {
+            loop {
+                let stmt = self.statement(depth);
+                if matches!(
+                    stmt,
+                    Statement::If { .. }
+                        | Statement::IfState { .. }
+                        | Statement::IfReward { .. }
+                        | Statement::IfContextIncludes { .. }
+                ) {
+                    return stmt;
+                }
+            }
+        }
+
+        fn body(&mut self, depth: usize) -> Vec<Statement> {
+            (0..self.below(4))
+                .map(|_| self.statement(depth + 1))
+                .collect()
+        }
+
+        fn statement(&mut self, depth: usize) -> Statement {
+            let kinds = if depth < 4 { 43 } else { 16 };
+            match self.below(kinds) {
+                0 => Statement::MemDeclaration {
+                    target: self.target(),
+                },
+                1 => Statement::ReflectAccess {
+                    mem_target: self.target(),
+                    key: self.text(),
+                },
+                2 => Statement::Goal(self.text()),
+                3 => Statement::Embed {
+                    source: self.ident(),
+                    target: format!("mem.{}", self.target()),
+                },
+                4 => Statement::Print(self.prompt()),
+                5 => Statement::Ask {
+                    prompt: self.prompt(),
+                    options: self.options(),
+                    target: self.target(),
+                    key: self.text(),
+                },
+                6 => Statement::Fetch {
+                    url: self.text(),
+                    options: self.options(),
+                    target: self.target(),
+                    key: self.text(),
+                },
+                7 => Statement::Exec {
+                    command: self.text(),
+                    options: self.options(),
+                    target: self.target(),
+                    key: self.text(),
+                },
+                8 => Statement::ReadFile {
+                    path: self.text(),
+                    target: self.target(),
+                    key: self.text(),
+                },
+                9 => Statement::WriteFile {
+                    target: self.target(),
+                    key: self.text(),
+                    path: self.text(),
+                },
+                10 => Statement::Assign {
+                    name: self.ident(),
+                    value: self.expr(2),
+                },
+                11 => Statement::Reflect {
+                    body: (0..1 + self.below(3))
+                        .map(|_| match self.below(2) {
+                            0 => Statement::ReflectAccess {
+                                mem_target: self.target(),
+                                key: self.text(),
+                            },
+                            _ => Statement::Attention { top: self.below(5) },
+                        })
+                        .collect(),
+                },
+                12 => Statement::OnSchedule {
+                    spec: self.text(),
+                    body: Vec::new(),
+                },
+                13 => Statement::Pipeline {
+                    stages: (0..2 + self.below(3)).map(|_| self.ident()).collect(),
+                },
+                14 => Statement::Capabilities(
+                    (0..self.below(3))
+                        .map(|_| {
+                            self.pick(&["net", "fs.read", "fs.write", "exec", "llm"])
+                                .to_string()
+                        })
+                        .collect(),
+                ),
+                15 => Statement::Let {
+                    name: self.ident(),
+                    value: self.expr(2),
+                },
+                16 => Statement::AgentDeclaration {
+                    name: self.ident(),
+                    body: self.body(depth),
+                },
+                17 => Statement::OnInput {
+                    param: self.ident(),
+                    body: self.body(depth),
+                },
+                18 => Statement::OnSchedule {
+                    spec: self.text(),
+                    body: self.body(depth),
+                },
+                19 => Statement::Train {
+                    dataset: (self.below(2) == 0).then(|| self.text()),
+                    body: self.body(depth),
+                },
+                20 => Statement::Evolve {
+                    body: self.body(depth),
+                },
+                21 => Statement::OnStart {
+                    body: self.body(depth),
+                },
+                22 => Statement::OnStop {
+                    body: self.body(depth),
+                },
+                23 => Statement::IfState {
+                    drive: self.ident(),
+                    op: self.pick(&["<", "<=", ">", ">=", "==", "!="]).to_string(),
+                    value: self.pick(&["0", "0.5", "1"]).to_string(),
+                    body: self.body(depth),
+                },
+                24 => Statement::Propose(match self.below(3) {
+                    0 => Mutation::Goal(self.text()),
+                    1 => Mutation::Threshold {
+                        drive: self.ident(),
+                        value: self.pick(&["0", "0.5", "1"]).to_string(),
+                    },
+                    _ => Mutation::Link {
+                        from: self.text(),
+                        to: self.text(),
+                    },
+                }),
+                25 => Statement::Reward(self.pick(&["0", "-1", "0.5", "2"]).to_string()),
+                26 => Statement::IfReward {
+                    behavior: self.ident(),
+                    stat: self.pick(&reward::STATS).to_string(),
+                    op: self.pick(&["<", "<=", ">", ">=", "==", "!="]).to_string(),
+                    value: self.pick(&["0", "-0.5", "1"]).to_string(),
+                    body: self.body(depth),
+                },
+                27 => Statement::Template {
+                    name: self.ident(),
+                    text: self.text(),
+                },
+                28 => Statement::Import(
+                    self.pick(&["std/text", "std/conversation", "my-agents/v1.2/input"])
+                        .to_string(),
+                ),
+                // A pragma is only read at the top level, and `lang 0.1` would
+                // read assignments and newer statements differently.
+                29 if depth == 1 => Statement::Lang(Version::ALL[1 + self.below(2)]),
+                30 => Statement::If {
+                    condition: self.expr(3),
+                    body: self.body(depth),
+                },
+                32 => Statement::Function {
+                    name: self.ident(),
+                    params: (0..self.below(3)).map(|_| self.ident()).collect(),
+                    body: self.body(depth),
+                },
+                33 => Statement::Return((self.below(2) == 0).then(|| self.expr(2))),
+                34 => Statement::Call {
+                    name: self.ident(),
+                    args: self.args(2),
+                },
+                35 => Statement::While {
+                    condition: self.expr(2),
+                    body: self.body(depth),
+                },
+                37 => Statement::Assign {
+                    name: self.ident(),
+                    value: Expr::Binary(
+                        BinaryOp::Add,
+                        Box::new(self.expr(1)),
+                        Box::new(self.expr(1)),
+                    ),
+                },
+                38 => Statement::Recall {
+                    query: self.expr(2),
+                    top: self.below(10),
+                },
+                39 => Statement::Send {
+                    agent: self.ident(),
+                    message: self.expr(2),
+                },
+                40 => Statement::Emit(self.expr(2)),
+                41 => Statement::OnOutput {
+                    param: self.ident(),
+                    body: self.body(depth),
+                },
+                36 => Statement::For {
+                    key: self.ident(),
+                    value: self.ident(),
+                    region: self.ident(),
+                    body: self.body(depth),
+                },
+                31 => Statement::IfElse {
+                    branch: Box::new(self.if_statement(depth)),
+                    otherwise: match self.below(3) {
+                        0 => vec![self.if_statement(depth)],
+                        1 => vec![self.statement(depth + 1)],
+                        _ => self.body(depth),
+                    },
+                },
+                _ => Statement::IfContextIncludes {
+                    values: (0..self.below(3)).map(|_| self.text()).collect(),
+                    body: self.body(depth),
+                },
+            }
+        }
+    }
+
+    #[test]
+    fn printed_programs_parse_back_to_themselves() {
+        for seed in 1..2_000u64 {
+            let mut gen = Gen(seed.wrapping_mul(0x9E37_79B9_7F4A_7C15));
+            let program = Program {
+                statements: gen.body(0),
+            };
+            let source = print(&program);
+            assert_eq!(parse_latest(&source), program, "seed {}:\n{}", seed, source);
+        }
+    }
+
+    #[test]
+    fn printing_is_stable() {
+        let source = "agent Echo {\n  mem short\n  on input(msg) {\n    embed msg -> mem.short\n    reflect { mem.short[\"msg\"] }\n  }\n}\n";
+        assert_eq!(print(&parse(source)), source);
+        let source = include_str!("../examples/conditions.sent");
+        assert_eq!(print(&parse(source)), source);
+        let source = "x = \"a b\"\ny = -1\n";
+        assert_eq!(print(&parse(source)), "x = \"a b\"\ny = \"-1\"\n");
+    }
+}
@@ -0,0 +1,166 @@
+//! Timing profile of a run as a Chrome trace: every `tracing` span
+//! (parsing, handlers, statements, memory operations, LLM calls) becomes a
+//! complete event, viewable in Perfetto or `chrome://tracing`.
+
+use serde_json::{json, Map, Value};
+use std::fs;
+use std::io;
+use std::path::PathBuf;
+use std::sync::{Arc, Mutex};
+use std::thread;
+use std::time::Instant;
+use tracing::field::{Field, Visit};
+use tracing::span::{Attributes, Id};
+use tracing::Subscriber;
+use tracing_subscriber::layer::{Context, Layer};
+use tracing_subscriber::registry::LookupSpan;
+
+/// Events recorded since the profile started.
+#[derive(Default)]
+struct Recording {
+    events: Vec<Value>,
+    threads: Vec<thread::ThreadId>,
+}
+
+/// A [`Layer`] recording the time spent in each span.
+pub struct ProfileLayer {
+    started: Instant,
+    recording: Arc<Mutex<Recording>>,
+}
+
+/// Writes the trace file when dropped.
+pub struct ProfileGuard {
+    path: PathBuf,
+    recording: Arc<Mutex<Recording>>,
+}
+
+/// Start time and fields of a span, kept in the registry's extensions
+/// until it closes.
+struct Opened(Instant, Map<String, Value>);
+
+impl ProfileLayer {
+    /// The layer, and the guard that writes the trace to `path`.
+    pub fn new(path: impl Into<PathBuf>) -> (Self, ProfileGuard) {
+        let recording = Arc::new(Mutex::new(Recording::default()));
+        (
+            Self {
+                started: Instant::now(),
+                recording: Arc::clone(&recording),
+            },
+            ProfileGuard {
+                path: path.into(),
+                recording,
+            },
+        )
+    }
+}
+
+impl<S> Layer<S> for ProfileLayer
+where
+    S: Subscriber + for<'a> LookupSpan<'a>,
+{
+    fn on_new_span(&self, attrs: &Attributes<'_>, id: &Id, ctx: Context<'_, S>) {
+        if let Some(span) = ctx.span(id) {
+            let mut fields = Map::new();
+            attrs.record(&mut ArgsVisitor(&mut fields));
+            span.extensions_mut().insert(Opened(Instant::now(), fields));
+        }
+    }
+
+    fn on_close(&self, id: Id, ctx: Context<'_, S>) {
+        let Some(span) = ctx.span(&id) else {
+            return;
+        };
+        let Some(Opened(opened, args)) = span.extensions_mut().remove::<Opened>() else {
+            return;
+        };
+        let ended = Instant::now();
+        let Ok(mut recording) = self.recording.lock() else {
+            return;
+        };
+        let current = thread::current().id();
+        let tid = match recording.threads.iter().position(|&t| t == current) {
+            Some(index) => index,
+            None => {
+                recording.threads.push(current);
+                recording.threads.len() - 1
+            }
+        };
+        let micros = |at: Instant| at.duration_since(self.started).as_secs_f64() * 1e6;
+        recording.events.push(json!({
+            "name": span.name(),
+            "cat": span.metadata().target(),
+            "ph": "X",
+            "ts": micros(opened),
+            "dur": micros(ended) - micros(opened),
+            "pid": std::process::id(),
+            "tid": tid,
+            "args": args,
+        }));
+    }
+}
+
+/// Span fields, shown as the event's arguments.
+struct ArgsVisitor<'a>(&'a mut Map<String, Value>);
+
+impl Visit for ArgsVisitor<'_> {
+    fn record_str(&mut self, field: &Field, value: &str) {
+        self.0.insert(field.name().to_string(), value.into());
+    }
+
+    fn record_debug(&mut self, field: &Field, value: &dyn std::fmt::Debug) {
+        self.0
+            .insert(field.name().to_string(), format!("{:?}", value).into());
+    }
+}
+
+impl ProfileGuard {
+    /// Write the trace recorded so far.
+    pub fn write(&self) -> io::Result<()> {
+        let recording = self
+            .recording
+            .lock()
+            .map_err(|_| io::Error::other("profile lock poisoned"))?;
+        let trace = json!({ "traceEvents": recording.events, "displayTimeUnit": "ms" });
+        fs::write(&self.path, trace.to_string())
+    }
+}
+
+impl Drop for ProfileGuard {
+    fn drop(&mut self) {
+        match self.write() {
+            Ok(()) => eprintln!("Profile written to {}", self.path.display()),
+            Err(e) => eprintln!("error: writing profile {}: {}", self.path.display(), e),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tracing_subscriber::prelude::*;
+
+    #[test]
+    fn records_spans_as_complete_events() {
+        let path = std::env::temp_dir().join(format!("profile-{}.json", std::process::id()));
+        let (layer, guard) = ProfileLayer::new(&path);
+        let subscriber = tracing_subscriber::registry().with(layer);
+        tracing::subscriber::with_default(subscriber, || {
+            let _outer = tracing::info_span!("handler").entered();
+            let _inner = tracing::trace_span!("statement", kind = "print").entered();
+        });
+        drop(guard);
+
+        let trace: Value = serde_json::from_str(&fs::read_to_string(&path).unwrap()).unwrap();
+        let names: Vec<_> = trace["traceEvents"]
+            .as_array()
+            .unwrap()
+            .iter()
+            .map(|e| e["name"].as_str().unwrap())
+            .collect();
+        assert_eq!(names, ["statement", "handler"]);
+        assert_eq!(trace["traceEvents"][0]["args"]["kind"], "print");
+        assert_eq!(trace["traceEvents"][1]["ph"], "X");
+        let _ = fs::remove_file(path);
+    }
+}
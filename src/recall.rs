@@ -0,0 +1,182 @@
+//! `recall <query> top <n>`: the memory entries closest in meaning to a
+//! query, ranked.
+//!
+//! ```text
+//! recall msg top 5
+//! ```
+//!
+//! prints up to five entries of short- and long-term memory as
+//! `mem.<region>["<key>"] <score>`, closest first. Entries are placed by the
+//! agent's [embedder](crate::llm::embedding): a vector `embed` stored is
+//! used as it is, and any other value by the vector of its key and value.
+//! Vectors are kept in a [`LatentIndex`] and only remade for entries written
+//! since the last `recall`. The `latent` config section picks the
+//! [`Metric`] and can fix the dimension vectors must have:
+//!
+//! ```json
+//! { "latent": { "metric": "euclidean", "dimensions": 768 } }
+//! ```
+
+use crate::config::LatentConfig;
+use crate::context::AgentContext;
+use crate::error::{RuntimeError, RuntimeErrorKind};
+use crate::sentience_core::latent::{DimensionError, LatentIndex, Metric};
+use std::collections::HashMap;
+
+/// Vectors of an agent's memory entries.
+#[derive(Clone, Debug, Default)]
+pub struct MemoryIndex {
+    index: LatentIndex,
+    /// The value each entry had when its vector was made, by entry.
+    embedded: HashMap<String, String>,
+}
+
+/// An entry found by [`nearest`].
+#[derive(Clone, Debug, PartialEq)]
+pub struct Hit {
+    /// The entry as written in a program, e.g. `mem.short["weather"]`.
+    pub entry: String,
+    /// How close the entry is to the query, by the index's [`Metric`].
+    pub score: f32,
+}
+
+impl MemoryIndex {
+    /// An empty index comparing vectors by `metric`, accepting only those
+    /// of `dimension` components if given.
+    pub fn new(metric: Metric, dimension: Option<usize>) -> Self {
+        let mut index = LatentIndex::new().with_metric(metric);
+        if let Some(dimension) = dimension {
+            index = index.with_dimension(dimension);
+        }
+        Self {
+            index,
+            embedded: HashMap::new(),
+        }
+    }
+
+    pub fn from_config(config: &LatentConfig) -> Result<Self, String> {
+        let metric = match &config.metric {
+            None => Metric::default(),
+            Some(name) => Metric::parse(name).ok_or_else(|| {
+                format!(
+                    "unknown latent metric `{}` (expected cosine, dot or euclidean)",
+                    name
+                )
+            })?,
+        };
+        Ok(Self::new(metric, config.dimensions))
+    }
+
+    pub fn metric(&self) -> Metric {
+        self.index.metric()
+    }
+
+    /// Entries with a vector.
+    pub fn len(&self) -> usize {
+        self.index.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.index.is_empty()
+    }
+}
+
+/// The `top` entries of `ctx`'s memory closest to `query`, closest first
+/// and then by entry. Fails if the embedder does, or a vector has another
+/// dimension than the index allows.
+pub fn nearest(ctx: &mut AgentContext, query: &str, top: usize) -> Result<Vec<Hit>, RuntimeError> {
+    let mut current = HashMap::new();
+    for region in ["short", "long"] {
+        for (key, value) in ctx.entries(region)? {
+            let entry = format!("mem.{}[\"{}\"]", region, key.replace('"', "\\\""));
+            current.insert(entry, (key, value.to_string()));
+        }
+    }
+
+    let embedder = ctx.embedder.clone();
+    let MemoryIndex { index, embedded } = &mut ctx.latent;
+    embedded.retain(|entry, _| {
+        let kept = current.contains_key(entry);
+        if !kept {
+            index.remove(entry);
+        }
+        kept
+    });
+    for (entry, (key, value)) in current {
+        if embedded.get(&entry) == Some(&value) {
+            continue;
+        }
+        let vector = match serde_json::from_str::<Vec<f32>>(&value) {
+            Ok(vector) => vector,
+            Err(_) => embedder.embed(&format!("{} {}", key, value))?,
+        };
+        index.insert(&entry, &vector).map_err(dimension)?;
+        embedded.insert(entry, value);
+    }
+
+    let query = embedder.embed(query)?;
+    if let Some(expected) = index.dimension().filter(|&d| d != query.len()) {
+        return Err(dimension(DimensionError {
+            expected,
+            found: query.len(),
+        }));
+    }
+    Ok(index
+        .nearest(&query, top)
+        .into_iter()
+        .map(|(entry, score)| Hit {
+            entry: entry.to_string(),
+            score,
+        })
+        .collect())
+}
+
+fn dimension(e: DimensionError) -> RuntimeError {
+    RuntimeError::new(RuntimeErrorKind::Vector(e))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::replkit::Repl;
+
+    #[test]
+    fn ranks_entries_by_closeness_to_the_query() {
+        let mut out = Vec::new();
+        let mut repl = Repl::new(&b""[..], &mut out);
+        repl.eval_source(concat!(
+            "lang 0.2\n",
+            "agent Librarian {\n",
+            "  on input(msg) {\n",
+            "    recall msg top 2\n",
+            "  }\n",
+            "}\n",
+            "weather = \"sunny in Belgrade\"\n",
+            "mood = \"cheerful\"\n",
+        ))
+        .unwrap();
+        repl.context_mut()
+            .set_mem("long", "trip", "a train to Belgrade");
+        repl.handle_command(".input sunny Belgrade").unwrap();
+        repl.context_mut().remove_mem("short", "weather");
+        repl.handle_command(".input sunny Belgrade").unwrap();
+        assert_eq!(repl.context().latent.len(), 3);
+
+        repl.context_mut().latent = MemoryIndex::new(Metric::Cosine, Some(3));
+        repl.handle_command(".input sunny").unwrap();
+        drop(repl);
+        let out = String::from_utf8(out).unwrap();
+        let lines: Vec<&str> = out.lines().filter(|l| l.starts_with("  mem.")).collect();
+        assert_eq!(
+            lines,
+            [
+                "  mem.short[\"msg\"] 0.816",
+                "  mem.short[\"weather\"] 0.707",
+                "  mem.short[\"msg\"] 0.816",
+                "  mem.long[\"trip\"] 0.316",
+            ]
+        );
+        assert!(out.contains("SEN4016"), "{}", out);
+        assert!(out.contains("not the index's 3"), "{}", out);
+    }
+}
@@ -0,0 +1,274 @@
+//! Recording the inputs an agent handles and replaying them against a
+//! changed program.
+//!
+//! A [`Recorder`] given to [`SentienceAgent::set_recorder`] appends one
+//! [`Turn`] per input to a JSON Lines file: when it arrived, its payload and
+//! metadata, what the `on input` handler answered and the memory it changed.
+//! [`replay`] sends the recorded inputs to another agent, e.g. one built from
+//! an edited program, and pairs each turn with what that agent did instead.
+
+use crate::adapters::InputMessage;
+use crate::error::RuntimeError;
+use crate::events::AgentEvent;
+use crate::SentienceAgent;
+use serde::{Deserialize, Serialize};
+use std::collections::VecDeque;
+use std::fmt;
+use std::fs::{File, OpenOptions};
+use std::io::{self, Write};
+use std::path::Path;
+use std::sync::{Arc, Mutex};
+use std::time::{SystemTime, UNIX_EPOCH};
+
+/// One memory value an input changed.
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Change {
+    pub region: String,
+    pub key: String,
+    pub value: String,
+}
+
+impl Change {
+    /// The change described by `event`, if it is a memory change.
+    pub fn from_event(event: &AgentEvent) -> Option<Self> {
+        match event {
+            AgentEvent::MemoryChanged { region, key, value } => Some(Self {
+                region: region.clone(),
+                key: key.clone(),
+                value: value.clone(),
+            }),
+            _ => None,
+        }
+    }
+}
+
+impl fmt::Display for Change {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "mem.{}[{:?}] = {:?}", self.region, self.key, self.value)
+    }
+}
+
+/// One input an agent handled.
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Turn {
+    /// When the input arrived, in Unix milliseconds.
+    pub timestamp: u64,
+    pub agent: String,
+    pub input: String,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub metadata: Vec<(String, String)>,
+    /// What the handler answered, unless it failed.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub output: Option<String>,
+    /// Why the handler failed.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+    /// Memory values the input changed, in the order they were written.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub changes: Vec<Change>,
+}
+
+impl Turn {
+    pub fn new(
+        agent: &str,
+        message: &InputMessage,
+        result: &Result<String, RuntimeError>,
+        changes: Vec<Change>,
+    ) -> Self {
+        Self {
+            timestamp: SystemTime::now()
+                .duration_since(UNIX_EPOCH)
+                .map(|d| d.as_millis() as u64)
+                .unwrap_or(0),
+            agent: agent.to_string(),
+            input: message.payload.clone(),
+            metadata: message.metadata.clone(),
+            output: result.as_ref().ok().cloned(),
+            error: result.as_ref().err().map(|e| e.to_string()),
+            changes,
+        }
+    }
+
+    /// The input as it was delivered.
+    pub fn message(&self) -> InputMessage {
+        InputMessage {
+            payload: self.input.clone(),
+            metadata: self.metadata.clone(),
+        }
+    }
+
+    /// Whether `other` answered and changed memory the same way.
+    pub fn same_outcome(&self, other: &Turn) -> bool {
+        self.output == other.output && self.error == other.error && self.changes == other.changes
+    }
+}
+
+enum Sink {
+    File(File),
+    /// The turns, and how many to keep if not all.
+    Memory(VecDeque<Turn>, Option<usize>),
+}
+
+/// Where turns are recorded. Clones share the sink, so the agents of one
+/// server can record to the same file.
+#[derive(Clone)]
+pub struct Recorder {
+    sink: Arc<Mutex<Sink>>,
+}
+
+impl Recorder {
+    /// Append turns to the file at `path`, creating it if needed.
+    pub fn open(path: &Path) -> io::Result<Self> {
+        let file = OpenOptions::new().create(true).append(true).open(path)?;
+        Ok(Self::with_sink(Sink::File(file)))
+    }
+
+    /// Keep turns in memory, to read back with [`turns`](Self::turns).
+    pub fn in_memory() -> Self {
+        Self::with_sink(Sink::Memory(VecDeque::new(), None))
+    }
+
+    /// Keep the last `capacity` turns in memory.
+    pub fn recent(capacity: usize) -> Self {
+        Self::with_sink(Sink::Memory(VecDeque::new(), Some(capacity)))
+    }
+
+    fn with_sink(sink: Sink) -> Self {
+        Self {
+            sink: Arc::new(Mutex::new(sink)),
+        }
+    }
+
+    pub fn record(&self, turn: Turn) -> io::Result<()> {
+        let mut sink = self.sink.lock().unwrap_or_else(|e| e.into_inner());
+        match &mut *sink {
+            Sink::File(file) => {
+                let mut line = serde_json::to_string(&turn)?;
+                line.push('\n');
+                file.write_all(line.as_bytes())
+            }
+            Sink::Memory(turns, capacity) => {
+                if capacity.is_some_and(|capacity| turns.len() >= capacity) {
+                    turns.pop_front();
+                }
+                turns.push_back(turn);
+                Ok(())
+            }
+        }
+    }
+
+    /// Turns recorded in memory; empty for a file.
+    pub fn turns(&self) -> Vec<Turn> {
+        match &*self.sink.lock().unwrap_or_else(|e| e.into_inner()) {
+            Sink::Memory(turns, _) => turns.iter().cloned().collect(),
+            Sink::File(_) => Vec::new(),
+        }
+    }
+}
+
+/// Parse a recording, one JSON turn per line.
+pub fn parse(text: &str) -> Result<Vec<Turn>, String> {
+    text.lines()
+        .enumerate()
+        .filter(|(_, line)| !line.trim().is_empty())
+        .map(|(n, line)| serde_json::from_str(line).map_err(|e| format!("line {}: {}", n + 1, e)))
+        .collect()
+}
+
+/// A recorded turn and what a replaying agent did with the same input.
+#[derive(Debug)]
+pub struct Replayed {
+    pub recorded: Turn,
+    pub replayed: Turn,
+}
+
+impl Replayed {
+    pub fn differs(&self) -> bool {
+        !self.recorded.same_outcome(&self.replayed)
+    }
+}
+
+/// Send the inputs of `turns` to `agent` in order.
+pub fn replay(agent: &mut SentienceAgent, turns: &[Turn]) -> Vec<Replayed> {
+    let recorder = Recorder::in_memory();
+    agent.set_recorder(recorder.clone());
+    for turn in turns {
+        // The outcome, error or not, is recorded.
+        let _ = agent.handle_message(&turn.message());
+    }
+    turns
+        .iter()
+        .cloned()
+        .zip(recorder.turns())
+        .map(|(recorded, replayed)| Replayed { recorded, replayed })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const PROGRAM: &str = concat!(
+        "agent Echo {\n",
+        "  on input(msg) {\n",
+        "    embed msg -> mem.short\n",
+        "    print \"heard\"\n",
+        "  }\n",
+        "}\n",
+    );
+
+    #[test]
+    fn records_inputs_and_replays_them_against_a_changed_agent() {
+        let mut agent = SentienceAgent::new();
+        agent.run_sentience(PROGRAM).unwrap();
+        let recorder = Recorder::in_memory();
+        agent.set_recorder(recorder.clone());
+        agent.handle_input("hello").unwrap();
+        agent
+            .handle_message(&InputMessage::new("bye").with_metadata("topic", "chat"))
+            .unwrap();
+
+        let turns = recorder.turns();
+        assert_eq!(turns.len(), 2);
+        assert_eq!(turns[0].agent, "Echo");
+        assert_eq!(turns[0].output.as_deref(), Some("heard"));
+        assert_eq!(
+            turns[0]
+                .changes
+                .iter()
+                .map(|c| c.to_string())
+                .collect::<Vec<_>>(),
+            ["mem.short[\"msg\"] = \"hello\""]
+        );
+        assert_eq!(
+            turns[1].metadata,
+            [("topic".to_string(), "chat".to_string())]
+        );
+
+        let log: String = turns
+            .iter()
+            .map(|turn| serde_json::to_string(turn).unwrap() + "\n")
+            .collect();
+        let turns = parse(&log).unwrap();
+
+        let mut same = SentienceAgent::new();
+        same.run_sentience(PROGRAM).unwrap();
+        assert!(replay(&mut same, &turns).iter().all(|r| !r.differs()));
+
+        let mut changed = SentienceAgent::new();
+        changed
+            .run_sentience(&PROGRAM.replace("heard", "got"))
+            .unwrap();
+        let replayed = replay(&mut changed, &turns);
+        assert!(replayed.iter().all(Replayed::differs));
+        assert_eq!(replayed[1].replayed.output.as_deref(), Some("got"));
+    }
+
+    #[test]
+    fn reports_the_line_of_a_bad_turn() {
+        assert_eq!(
+            parse("\n{}\n").unwrap_err(),
+            "line 2: missing field `timestamp` at line 1 column 2"
+        );
+    }
+}
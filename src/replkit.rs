@@ -0,0 +1,815 @@
+use crate::compiled;
+use crate::context::AgentContext;
+use crate::dream;
+use crate::error::{MemoryError, RuntimeError, RuntimeErrorKind};
+use crate::eval::{self, eval};
+use crate::evolve;
+use crate::goals::{self, GoalLog};
+use crate::history::{self, History};
+use crate::introspect;
+use crate::lexer::{self, Lexer};
+use crate::logging;
+use crate::parser::{Parser, StatementPool};
+use crate::schedule::Scheduler;
+use crate::transcript::Transcript;
+use crate::types::{Program, Statement};
+use std::collections::HashMap;
+use std::io::{self, BufRead, Write};
+use std::path::Path;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::mpsc::{Receiver, RecvTimeoutError};
+use std::time::Duration;
+
+/// Handler for a dot-command such as `.input hello`. Receives the agent
+/// context, the text after the command name and the REPL writer.
+pub type Command = Box<dyn FnMut(&mut AgentContext, &str, &mut dyn Write) -> io::Result<()> + Send>;
+
+/// Embeddable read-eval-print loop over any line reader and writer, so hosts
+/// can offer a Sentience console over SSH, HTTP or an in-app terminal.
+pub struct Repl<R: BufRead, W: Write> {
+    reader: R,
+    writer: W,
+    ctx: AgentContext,
+    commands: HashMap<String, Command>,
+    prompt: String,
+    /// Shown instead of the prompt while a statement is still open.
+    continuation: String,
+    /// Lines of a statement still waiting for its closing quote or braces.
+    pending: Vec<String>,
+    /// Allocations of the last chunk, reused for the next.
+    pool: StatementPool,
+    /// When the handlers `.start` runs are next due, and their specs.
+    due: Option<(u64, Vec<String>)>,
+}
+
+impl<R: BufRead, W: Write> Repl<R, W> {
+    /// Create a REPL with the built-in `.input`, `.train`, `.evolve`,
+    /// `.agents`, `.stats`, `.state`, `.reload`, `.at`, `.goals`, `.dream`,
+    /// `.proposals`, `.commit`, `.discard`, `.reward`, `.rewards`,
+    /// `.transcript` and `.log` commands, keeping the memory history `.at` reads, the
+    /// goal progress `.goals` reports and the turns `.transcript` writes.
+    pub fn new(reader: R, writer: W) -> Self {
+        let mut repl = Self::bare(reader, writer);
+        repl.ctx.history = Some(History::default());
+        repl.ctx.goals = Some(GoalLog::new());
+        repl.ctx.transcript = Some(Transcript::default());
+        repl.register(
+            "input",
+            Box::new(|ctx, arg, out| run_block(ctx, "input", arg, out)),
+        );
+        repl.register(
+            "train",
+            Box::new(|ctx, arg, out| run_block(ctx, "train", arg, out)),
+        );
+        repl.register(
+            "evolve",
+            Box::new(|ctx, arg, out| run_block(ctx, "evolve", arg, out)),
+        );
+        repl.register("agents", Box::new(|ctx, _, out| list_agents(ctx, out)));
+        repl.register("stats", Box::new(|ctx, _, out| print_stats(ctx, out)));
+        repl.register("state", Box::new(|ctx, _, out| print_state(ctx, out)));
+        repl.register("reload", Box::new(|ctx, arg, out| reload(ctx, arg, out)));
+        repl.register(
+            "at",
+            Box::new(|ctx, arg, out| print_memory_at(ctx, arg, out)),
+        );
+        repl.register(
+            "goals",
+            Box::new(|ctx, arg, out| print_goals(ctx, arg, out)),
+        );
+        repl.register("dream", Box::new(|ctx, _, out| dream(ctx, out)));
+        repl.register(
+            "proposals",
+            Box::new(|ctx, _, out| print_proposals(ctx, out)),
+        );
+        repl.register("commit", Box::new(|ctx, _, out| commit(ctx, out)));
+        repl.register(
+            "discard",
+            Box::new(|ctx, _, out| writeln!(out, "Discarded {} proposal(s)", evolve::discard(ctx))),
+        );
+        repl.register("reward", Box::new(|ctx, arg, out| reward(ctx, arg, out)));
+        repl.register(
+            "rewards",
+            Box::new(|ctx, _, out| {
+                for line in ctx.rewards.render() {
+                    writeln!(out, "{}", line)?;
+                }
+                Ok(())
+            }),
+        );
+        repl.register(
+            "transcript",
+            Box::new(|ctx, arg, out| write_transcript(ctx, arg, out)),
+        );
+        repl.register("log", Box::new(|_, arg, out| log_level(arg, out)));
+        repl
+    }
+
+    /// Create a REPL without any registered commands.
+    pub fn bare(reader: R, writer: W) -> Self {
+        Self {
+            reader,
+            writer,
+            ctx: AgentContext::new(),
+            commands: HashMap::new(),
+            prompt: ">>> ".to_string(),
+            continuation: "... ".to_string(),
+            pending: Vec::new(),
+            pool: StatementPool::new(),
+            due: None,
+        }
+    }
+
+    /// Register (or replace) a dot-command under `name`, without the leading dot.
+    pub fn register(&mut self, name: &str, command: Command) {
+        self.commands.insert(name.to_string(), command);
+    }
+
+    pub fn set_prompt(&mut self, prompt: &str) {
+        self.prompt = prompt.to_string();
+    }
+
+    /// Prompt asking for the rest of an unfinished statement.
+    pub fn set_continuation_prompt(&mut self, prompt: &str) {
+        self.continuation = prompt.to_string();
+    }
+
+    pub fn context(&self) -> &AgentContext {
+        &self.ctx
+    }
+
+    pub fn context_mut(&mut self) -> &mut AgentContext {
+        &mut self.ctx
+    }
+
+    /// Run until the reader is exhausted. Handlers started with `.start`
+    /// only run between lines here; [`Repl::run_until`] also runs them while
+    /// waiting for one.
+    pub fn run(&mut self) -> io::Result<()> {
+        self.print_prompt()?;
+
+        let mut line = String::new();
+        loop {
+            line.clear();
+            if self.reader.read_line(&mut line)? == 0 {
+                break;
+            }
+            self.run_due()?;
+            let done = self.feed(&line)?;
+            self.print_prompt_for(done)?;
+        }
+        self.stop()
+    }
+
+    /// Run on lines read by another thread until it hangs up or `shutdown`
+    /// is set, running the handlers started with `.start` as they come due
+    /// in between. The reader is not used.
+    pub fn run_until(&mut self, lines: Receiver<String>, shutdown: &AtomicBool) -> io::Result<()> {
+        self.print_prompt()?;
+
+        while !shutdown.load(Ordering::SeqCst) {
+            if self.run_due()? {
+                self.print_prompt_for(self.pending.is_empty())?;
+            }
+            // Wake at least every second to notice `shutdown`.
+            let wait = match &self.due {
+                Some((at, _)) => at.saturating_sub(now_secs()).min(1),
+                None => 1,
+            };
+            match lines.recv_timeout(Duration::from_secs(wait)) {
+                Ok(line) => {
+                    let done = self.feed(&line)?;
+                    self.print_prompt_for(done)?;
+                }
+                Err(RecvTimeoutError::Timeout) => {}
+                Err(RecvTimeoutError::Disconnected) => break,
+            }
+        }
+        self.stop()
+    }
+
+    /// `.start`: run the current agent's `on schedule` and `every` handlers
+    /// when they are due, until `.stop`.
+    fn start_timers(&mut self) -> io::Result<()> {
+        if self.ctx.current_agent.is_none() {
+            let e = RuntimeError::new(RuntimeErrorKind::NoAgent);
+            return writeln!(self.writer, "Error[{}]: {}", e.code(), e);
+        }
+        let scheduler = match Scheduler::for_context(&self.ctx) {
+            Ok(scheduler) => scheduler,
+            Err(e) => return writeln!(self.writer, "Error: {}", e),
+        };
+        self.due = scheduler.next_after(now_secs());
+        match &self.due {
+            Some(_) => writeln!(self.writer, "Started; .stop to stop"),
+            None => writeln!(
+                self.writer,
+                "The agent has no `on schedule` or `every` handlers to run"
+            ),
+        }
+    }
+
+    /// `.stop`: stop running handlers on time.
+    fn stop_timers(&mut self) -> io::Result<()> {
+        match self.due.take() {
+            Some(_) => writeln!(self.writer, "Stopped"),
+            None => writeln!(self.writer, "Nothing was started"),
+        }
+    }
+
+    /// Run the started handlers that are due, returning whether there were
+    /// any. Those that came due more than once since are run once.
+    fn run_due(&mut self) -> io::Result<bool> {
+        let Some((_, specs)) = self.due.take_if(|(at, _)| now_secs() >= *at) else {
+            return Ok(false);
+        };
+        for spec in &specs {
+            run_block(&mut self.ctx, "schedule", spec, &mut self.writer)?;
+        }
+        // The agent may have been redeclared or reloaded meanwhile.
+        self.due = Scheduler::for_context(&self.ctx)
+            .ok()
+            .and_then(|scheduler| scheduler.next_after(now_secs()));
+        Ok(true)
+    }
+
+    /// Run the registered agent's `on stop` block, if it has one.
+    pub fn stop(&mut self) -> io::Result<()> {
+        match eval::run_hook(&mut self.ctx, "stop", "") {
+            Ok(output) => {
+                for line in output {
+                    writeln!(self.writer, "{}", line)?;
+                }
+                Ok(())
+            }
+            Err(e) => writeln!(self.writer, "Error[{}]: {}", e.code(), e),
+        }
+    }
+
+    /// Evaluate several lines at once, as typed at the prompt, e.g. a
+    /// notebook cell. A statement left open at the end is discarded and
+    /// reported with where it starts.
+    pub fn eval_lines(&mut self, text: &str) -> io::Result<()> {
+        for line in text.lines() {
+            self.feed(line)?;
+        }
+        let pending = std::mem::take(&mut self.pending).join("\n");
+        if let Some(e) = lexer::unterminated(&pending) {
+            writeln!(self.writer, "Error[{}]: {}", e.code(), e)?;
+        }
+        Ok(())
+    }
+
+    /// Take one line of input, evaluating it once it completes a statement
+    /// or command. Returns whether it did; it has not while a string, block
+    /// or list is still open.
+    fn feed(&mut self, line: &str) -> io::Result<bool> {
+        let line = line.trim_end_matches(['\r', '\n']);
+        let trimmed = line.trim();
+
+        if self.pending.is_empty() {
+            if trimmed.is_empty() {
+                return Ok(true);
+            }
+            if trimmed.starts_with('.') {
+                self.handle_command(trimmed)?;
+                return Ok(true);
+            }
+            self.pending.push(trimmed.to_string());
+        } else {
+            // Keep the line as typed, which may be the middle of a string.
+            self.pending.push(line.to_string());
+        }
+
+        let full_input = self.pending.join("\n");
+        if lexer::unterminated(&full_input).is_some() {
+            return Ok(false);
+        }
+        self.pending.clear();
+        self.eval_source(&full_input)?;
+        Ok(true)
+    }
+
+    /// Parse and evaluate a complete chunk of source, writing any output.
+    pub fn eval_source(&mut self, src: &str) -> io::Result<()> {
+        let mut lexer = Lexer::new(src);
+        let mut parser = Parser::new(&mut lexer)
+            .with_pool(std::mem::take(&mut self.pool))
+            .with_lang(self.ctx.lang);
+        let program = parser.parse_program();
+        let errors = parser.errors().to_vec();
+        self.pool = parser.take_pool();
+        // Running the rest of a chunk with a statement missing could do
+        // something other than what was meant.
+        if !errors.is_empty() {
+            self.pool.recycle(program);
+            for e in errors {
+                writeln!(self.writer, "Error[{}]: {}", e.code(), e)?;
+            }
+            return Ok(());
+        }
+        let result = self.eval_program(&program);
+        self.pool.recycle(program);
+        result
+    }
+
+    fn eval_program(&mut self, program: &Program) -> io::Result<()> {
+        for stmt in &program.statements {
+            let mut output = Vec::new();
+            let result = eval(stmt, "", "", &mut self.ctx, &mut output);
+            for line in output {
+                writeln!(self.writer, "{}", line)?;
+            }
+            if let Err(e) = result {
+                writeln!(self.writer, "Error[{}]: {}", e.code(), e)?;
+            }
+        }
+        Ok(())
+    }
+
+    /// Dispatch a dot-command line such as `.input hello`. `.start` and
+    /// `.stop` are the REPL's own, as they change how it waits for input.
+    pub fn handle_command(&mut self, line: &str) -> io::Result<()> {
+        let after_dot = line.strip_prefix('.').unwrap_or(line);
+        let (cmd, rest) = after_dot.split_once(' ').unwrap_or((after_dot, ""));
+
+        match cmd {
+            "start" => return self.start_timers(),
+            "stop" => return self.stop_timers(),
+            _ => {}
+        }
+        match self.commands.get_mut(cmd) {
+            Some(command) => command(&mut self.ctx, rest.trim(), &mut self.writer),
+            None => writeln!(self.writer, "Unknown command: .{}", cmd),
+        }
+    }
+
+    fn print_prompt(&mut self) -> io::Result<()> {
+        self.print_prompt_for(true)
+    }
+
+    /// Print the prompt, or the continuation prompt if the statement is
+    /// not `done`.
+    fn print_prompt_for(&mut self, done: bool) -> io::Result<()> {
+        let prompt = if done {
+            &self.prompt
+        } else {
+            &self.continuation
+        };
+        write!(self.writer, "{}", prompt)?;
+        self.writer.flush()
+    }
+}
+
+/// Run the current agent's `on input`, `train` or `evolve` block with `input`.
+pub fn run_block(
+    ctx: &mut AgentContext,
+    kind: &str,
+    input: &str,
+    out: &mut dyn Write,
+) -> io::Result<()> {
+    if let Some(transcript) = &mut ctx.transcript {
+        let agent = match &ctx.current_agent {
+            Some(Statement::AgentDeclaration { name, .. }) => name.as_str(),
+            _ => "",
+        };
+        transcript.begin(agent, kind, input);
+    }
+    let result = eval::run_block(ctx, kind, input, "");
+    if let Some(transcript) = &mut ctx.transcript {
+        transcript.end(&result);
+    }
+    match result {
+        Ok(output) => {
+            for line in output {
+                writeln!(out, "  {}", line)?;
+            }
+            Ok(())
+        }
+        Err(e) => writeln!(out, "Error[{}]: {}", e.code(), e),
+    }
+}
+
+/// `.log` shows the level log output is written at, and `.log <level>`
+/// changes it.
+fn log_level(arg: &str, out: &mut dyn Write) -> io::Result<()> {
+    if arg.is_empty() {
+        return match logging::level() {
+            Some(level) => writeln!(out, "Log level: {}", level.as_str().to_lowercase()),
+            None => writeln!(out, "Logging is off"),
+        };
+    }
+    match logging::parse_level(arg).and_then(logging::set_level) {
+        Ok(()) => writeln!(out, "Log level: {}", arg.to_lowercase()),
+        Err(e) => writeln!(out, "Error: {}", e),
+    }
+}
+
+/// Write the session transcript to the file named by `arg`, or print it as
+/// Markdown without one.
+pub fn write_transcript(ctx: &mut AgentContext, arg: &str, out: &mut dyn Write) -> io::Result<()> {
+    let Some(transcript) = &ctx.transcript else {
+        return writeln!(out, "No transcript is kept");
+    };
+    if arg.is_empty() {
+        return write!(out, "{}", transcript.markdown());
+    }
+    let path = Path::new(arg);
+    match transcript.write(path) {
+        Ok(()) => writeln!(
+            out,
+            "Wrote {} turn{} to {}",
+            transcript.turns.len(),
+            if transcript.turns.len() == 1 { "" } else { "s" },
+            path.file_name()
+                .map_or(arg.into(), |name| name.to_string_lossy())
+        ),
+        Err(e) => {
+            let e = MemoryError::from(e);
+            writeln!(out, "Error[{}]: {}: {}", e.code(), arg, e)
+        }
+    }
+}
+
+/// Print the registered agent's handlers, goals, memory sizes and links.
+pub fn list_agents(ctx: &mut AgentContext, out: &mut dyn Write) -> io::Result<()> {
+    match introspect::describe(ctx) {
+        Some(info) => {
+            for line in info.render() {
+                writeln!(out, "{}", line)?;
+            }
+            Ok(())
+        }
+        None => {
+            let e = RuntimeError::new(RuntimeErrorKind::NoAgent);
+            writeln!(out, "Error[{}]: {}", e.code(), e)
+        }
+    }
+}
+
+/// Swap in the agent declared in the file at `path`, keeping memory.
+pub fn reload(ctx: &mut AgentContext, path: &str, out: &mut dyn Write) -> io::Result<()> {
+    let reloaded = compiled::load_file(Path::new(path))
+        .and_then(|program| eval::reload(ctx, &program).map_err(Into::into));
+    match reloaded {
+        Ok(line) => writeln!(out, "{}", line),
+        Err(e) => writeln!(out, "Error[{}]: {}", e.code(), e),
+    }
+}
+
+/// Print a memory region, or one key of it, as it was at a past moment, e.g.
+/// `.at "2024-05-01T10:00" mem short msg`, with when the value was written.
+pub fn print_memory_at(ctx: &mut AgentContext, arg: &str, out: &mut dyn Write) -> io::Result<()> {
+    const USAGE: &str = "Usage: .at \"<time>\" mem <short|long> [key]";
+    let (time, rest) = match arg.strip_prefix('"') {
+        Some(quoted) => quoted.split_once('"').unwrap_or((quoted, "")),
+        None => arg.split_once(' ').unwrap_or((arg, "")),
+    };
+    let words: Vec<&str> = rest.split_whitespace().collect();
+    let (region, key) = match words.as_slice() {
+        ["mem", region] => (*region, None),
+        ["mem", region, key] => (*region, Some(key.trim_matches('"'))),
+        _ => return writeln!(out, "{}", USAGE),
+    };
+    let Some(at) = history::parse_time(time) else {
+        return writeln!(
+            out,
+            "Error: invalid time `{}` (expected UTC, e.g. 2024-05-01T10:00)",
+            time
+        );
+    };
+    let entries = match ctx.memory_at(region, at) {
+        Ok(entries) => entries,
+        Err(e) => return writeln!(out, "Error[{}]: {}", e.code(), e),
+    };
+    let Some(key) = key else {
+        for (key, value) in &entries {
+            writeln!(out, "mem.{}[{:?}] = {:?}", region, key, value)?;
+        }
+        return Ok(());
+    };
+    let Some(history) = &ctx.history else {
+        return Ok(());
+    };
+    match (entries.get(key), history.last_write(region, key, at)) {
+        (Some(value), Some(write)) => writeln!(
+            out,
+            "mem.{}[{:?}] = {:?} (written {})",
+            region,
+            key,
+            value,
+            history::format_time(write.at)
+        ),
+        (Some(value), None) => writeln!(
+            out,
+            "mem.{}[{:?}] = {:?} (unchanged since {})",
+            region,
+            key,
+            value,
+            history::format_time(history.since())
+        ),
+        (None, _) => writeln!(out, "mem.{}[{:?}] was not set", region, key),
+    }
+}
+
+/// Print the registered agent's goal progress and what each kind of
+/// handler did to it this session or, given memory files (`.goals
+/// monday.json friday.json`), the progress saved in each.
+pub fn print_goals(ctx: &mut AgentContext, arg: &str, out: &mut dyn Write) -> io::Result<()> {
+    let lines = if arg.is_empty() {
+        goals::report(ctx).render()
+    } else {
+        let mut snapshots = Vec::new();
+        for path in arg.split_whitespace() {
+            match goals::read_snapshot(path) {
+                Ok(reading) => snapshots.push((path, reading)),
+                Err(e) => return writeln!(out, "Error[{}]: {}: {}", e.code(), path, e),
+            }
+        }
+        goals::compare(&snapshots)
+    };
+    for line in lines {
+        writeln!(out, "{}", line)?;
+    }
+    Ok(())
+}
+
+/// Print the level of each affect drive.
+pub fn print_state(ctx: &mut AgentContext, out: &mut dyn Write) -> io::Result<()> {
+    for (drive, level) in ctx.affect.levels() {
+        writeln!(out, "{}: {:.2}", drive, level)?;
+    }
+    Ok(())
+}
+
+/// Consolidate short-term memory with the default options and say what
+/// moved.
+pub fn dream(ctx: &mut AgentContext, out: &mut dyn Write) -> io::Result<()> {
+    for line in dream::consolidate(ctx, &dream::Options::default()).render() {
+        writeln!(out, "{}", line)?;
+    }
+    Ok(())
+}
+
+/// Credit the number `arg` to the kind of handler that ran last.
+pub fn reward(ctx: &mut AgentContext, arg: &str, out: &mut dyn Write) -> io::Result<()> {
+    let Ok(value) = arg.trim().parse::<f64>() else {
+        return writeln!(out, "Usage: .reward <number>");
+    };
+    match ctx.rewards.reward(value).map(str::to_string) {
+        Some(behavior) => {
+            let mean = ctx.rewards.of(&behavior).mean;
+            writeln!(out, "Rewarded {}: mean {:.2}", behavior, mean)
+        }
+        None => writeln!(out, "Nothing to reward yet"),
+    }
+}
+
+/// Print what committing the changes `evolve` proposed would do.
+pub fn print_proposals(ctx: &mut AgentContext, out: &mut dyn Write) -> io::Result<()> {
+    let diff = evolve::diff(ctx);
+    if diff.is_empty() {
+        return writeln!(out, "No proposals");
+    }
+    for line in diff {
+        writeln!(out, "{}", line)?;
+    }
+    Ok(())
+}
+
+/// Apply the changes `evolve` proposed to the registered agent.
+pub fn commit(ctx: &mut AgentContext, out: &mut dyn Write) -> io::Result<()> {
+    match evolve::commit(ctx) {
+        Ok(applied) if applied.is_empty() => writeln!(out, "No proposals"),
+        Ok(applied) => {
+            for change in applied {
+                writeln!(out, "Committed {}", change)?;
+            }
+            Ok(())
+        }
+        Err(e) => writeln!(out, "Error[{}]: {}", e.code(), e),
+    }
+}
+
+/// Print the entries and size of each memory region and the link count.
+pub fn print_stats(ctx: &mut AgentContext, out: &mut dyn Write) -> io::Result<()> {
+    let stats = ctx.stats();
+    for region in &stats.regions {
+        let paged = if region.loaded { "" } else { ", on disk" };
+        writeln!(
+            out,
+            "mem.{}: {} entries, {} bytes{}",
+            region.region, region.entries, region.bytes, paged
+        )?;
+    }
+    writeln!(out, "links: {}", stats.links)
+}
+
+/// Seconds since the Unix epoch now, as the scheduler counts them.
+fn now_secs() -> u64 {
+    logging::unix_millis() / 1000
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn run(input: &str) -> String {
+        let mut out = Vec::new();
+        let mut repl = Repl::new(input.as_bytes(), &mut out);
+        repl.set_prompt("");
+        repl.run().unwrap();
+        drop(repl);
+        String::from_utf8(out).unwrap()
+    }
+
+    #[test]
+    fn evaluates_multiline_agent_and_input() {
+        let out = run(concat!(
+            "agent Echo {\n",
+            "  on input(msg) {\n",
+            "    print \"got it\"\n",
+            "  }\n",
+            "}\n",
+            ".input hi\n",
+            ".agents\n",
+        ));
+        assert!(out.contains("Agent: Echo [registered]"));
+        assert!(out.contains("  got it"));
+        assert!(out.contains("  Events: input(msg)"));
+        assert!(out.contains("  mem.short: 1 entries"));
+    }
+
+    #[test]
+    fn reports_goal_progress() {
+        let out = run(concat!(
+            "agent Echo {\n",
+            "  goal: \"Greet\"\n",
+            "  on input(msg) {\n",
+            "    print \"hi\"\n",
+            "  }\n",
+            "}\n",
+            ".input hello\n",
+            ".goals\n",
+            ".goals /nonexistent/memory.json\n",
+        ));
+        assert!(out.contains("Goal: \"Greet\"\nNow: not reported, since "));
+        assert!(out.contains("  input: 1 run, +0%\n"));
+        assert!(out.contains("Error[SEN5002]: /nonexistent/memory.json: "));
+    }
+
+    #[test]
+    fn stops_the_agent_at_the_end_of_input() {
+        let out = run("agent A {\n  on stop {\n    print \"bye\"\n  }\n}\n");
+        assert!(out.ends_with("Agent: A [registered]\nbye\n"), "{}", out);
+    }
+
+    #[test]
+    fn runs_started_handlers_while_waiting_for_input() {
+        let (sender, lines) = std::sync::mpsc::channel();
+        for line in [
+            ".stop",
+            "lang 0.2",
+            "agent Clock {",
+            "  every 1s {",
+            "    print \"tick\"",
+            "  }",
+            "}",
+            ".start",
+        ] {
+            sender.send(line.to_string()).unwrap();
+        }
+        let typist = std::thread::spawn(move || {
+            std::thread::sleep(Duration::from_millis(2500));
+            sender.send(".stop".to_string()).unwrap();
+        });
+        let mut out = Vec::new();
+        let mut repl = Repl::new(&b""[..], &mut out);
+        repl.set_prompt("");
+        repl.set_continuation_prompt("");
+        repl.run_until(lines, &AtomicBool::new(false)).unwrap();
+        typist.join().unwrap();
+        drop(repl);
+        let out = String::from_utf8(out).unwrap();
+        assert!(out.starts_with("Nothing was started\n"), "{}", out);
+        assert!(out.contains("Started; .stop to stop\n  tick\n"), "{}", out);
+        assert!(out.ends_with("  tick\nStopped\n"), "{}", out);
+    }
+
+    #[test]
+    fn prints_memory_stats() {
+        let out = run(concat!(
+            "agent Echo {\n",
+            "  on input(msg) {\n",
+            "  }\n",
+            "}\n",
+            ".input hello\n",
+            ".stats\n",
+        ));
+        assert!(out.contains("mem.short: 1 entries, 8 bytes\n"), "{}", out);
+        assert!(out.contains("mem.long: 0 entries, 0 bytes\nlinks: 0\n"));
+    }
+
+    #[test]
+    fn shows_memory_at_a_past_moment() {
+        let out = run(concat!(
+            "agent Echo {\n",
+            "  on input(msg) {\n",
+            "  }\n",
+            "}\n",
+            ".input hello\n",
+            ".at \"2999-01-01T00:00\" mem short msg\n",
+            ".at \"2999-01-01\" mem short\n",
+            ".at \"2999-01-01\" mem long msg\n",
+            ".at \"2000-01-01\" mem short msg\n",
+            ".at soon mem short\n",
+            ".at \"2999-01-01\" msg\n",
+        ));
+        assert!(
+            out.contains("mem.short[\"msg\"] = \"hello\" (written 2"),
+            "{}",
+            out
+        );
+        assert!(out.contains("\nmem.short[\"msg\"] = \"hello\"\n"));
+        assert!(out.contains("mem.long[\"msg\"] was not set\n"));
+        assert!(out.contains("Error[SEN5004]: memory history starts at 2"));
+        assert!(out.contains("Error: invalid time `soon`"));
+        assert!(out.contains("Usage: .at \"<time>\" mem <short|long> [key]\n"));
+    }
+
+    #[test]
+    fn reloads_handlers_and_keeps_memory() {
+        let path = std::env::temp_dir().join(format!("repl-reload-{}.sent", std::process::id()));
+        std::fs::write(
+            &path,
+            "agent Echo {\n  on input(msg) {\n    print \"new\"\n  }\n}\n",
+        )
+        .unwrap();
+        let out = run(&format!(
+            concat!(
+                "agent Echo {{\n",
+                "  on input(msg) {{\n",
+                "    seen = \"yes\"\n",
+                "    print \"old\"\n",
+                "  }}\n",
+                "}}\n",
+                ".input first\n",
+                ".reload {}\n",
+                ".input second\n",
+                ".stats\n",
+            ),
+            path.display()
+        ));
+        std::fs::remove_file(&path).unwrap();
+        assert!(
+            out.contains("  old\nAgent: Echo [reloaded]\n  new\n"),
+            "{}",
+            out
+        );
+        assert!(out.contains("mem.short: 2 entries"), "{}", out);
+    }
+
+    #[test]
+    fn custom_commands_are_dispatched() {
+        let mut out = Vec::new();
+        let mut repl = Repl::bare(".ping a b\n.nope\n".as_bytes(), &mut out);
+        repl.set_prompt("");
+        repl.register(
+            "ping",
+            Box::new(|_ctx, arg, out| writeln!(out, "pong {}", arg)),
+        );
+        repl.run().unwrap();
+        drop(repl);
+        let out = String::from_utf8(out).unwrap();
+        assert!(out.contains("pong a b"));
+        assert!(out.contains("Unknown command: .nope"));
+    }
+
+    #[test]
+    fn waits_for_unterminated_constructs() {
+        let mut out = Vec::new();
+        let input = "print \"two\nlines\"\nagent A {\n  on input(m) {\n}\n}\n";
+        let mut repl = Repl::bare(input.as_bytes(), &mut out);
+        repl.set_prompt("> ");
+        repl.run().unwrap();
+        drop(repl);
+        let out = String::from_utf8(out).unwrap();
+        assert_eq!(
+            out,
+            "> ... two\nlines\n> ... ... ... Agent: A\nAgent: A [registered]\n> "
+        );
+    }
+
+    #[test]
+    fn reports_where_an_unfinished_cell_starts() {
+        let mut out = Vec::new();
+        let mut repl = Repl::bare(io::empty(), &mut out);
+        repl.eval_lines("agent A {\n  if context includes [\"a\" {\n}")
+            .unwrap();
+        drop(repl);
+        assert_eq!(
+            String::from_utf8(out).unwrap(),
+            "Error[SEN1006]: 2:23: unclosed `[`\n"
+        );
+    }
+}
@@ -0,0 +1,183 @@
+//! Rewards for reinforcement-style loops. `reward 1` in a handler, or
+//! [`SentienceAgent::reward`](crate::SentienceAgent::reward) from the host,
+//! credits the behavior that acted last: the kind of handler (`input`,
+//! `schedule`, `train`, `evolve`, `start` or `stop`) that ran most recently,
+//! or is running. Each behavior keeps running statistics of its rewards,
+//! which handlers, `evolve` blocks among them, read with
+//! `if reward.input.mean < 0 { ... }`.
+
+use serde::Serialize;
+use std::collections::BTreeMap;
+
+/// Statistics a condition can read.
+pub const STATS: [&str; 5] = ["count", "total", "mean", "last", "recent"];
+
+/// Weight of the newest reward in [`Stats::recent`].
+const RECENT_WEIGHT: f64 = 0.2;
+
+/// Rewards one behavior has received.
+#[derive(Clone, Copy, Debug, Default, PartialEq, Serialize)]
+pub struct Stats {
+    pub count: u64,
+    pub total: f64,
+    pub mean: f64,
+    pub last: f64,
+    /// Moving average that follows the latest rewards, each counting for
+    /// [`RECENT_WEIGHT`] of it.
+    pub recent: f64,
+}
+
+impl Stats {
+    fn add(&mut self, value: f64) {
+        self.count += 1;
+        self.total += value;
+        self.mean = self.total / self.count as f64;
+        self.last = value;
+        self.recent = if self.count == 1 {
+            value
+        } else {
+            self.recent + RECENT_WEIGHT * (value - self.recent)
+        };
+    }
+
+    /// The statistic named `stat`, one of [`STATS`].
+    pub fn get(&self, stat: &str) -> Option<f64> {
+        match stat {
+            "count" => Some(self.count as f64),
+            "total" => Some(self.total),
+            "mean" => Some(self.mean),
+            "last" => Some(self.last),
+            "recent" => Some(self.recent),
+            _ => None,
+        }
+    }
+}
+
+/// Which behavior acted last and what each has been rewarded.
+#[derive(Clone, Debug, Default, PartialEq)]
+pub struct Rewards {
+    last: Option<String>,
+    stats: BTreeMap<String, Stats>,
+}
+
+impl Rewards {
+    /// Note that `behavior` is acting, so rewards from now on go to it.
+    pub fn acted(&mut self, behavior: &str) {
+        self.last = Some(behavior.to_string());
+    }
+
+    /// The behavior rewards go to, if any has acted.
+    pub fn last_behavior(&self) -> Option<&str> {
+        self.last.as_deref()
+    }
+
+    /// Credit `value` to the behavior that acted last and return it; `None`
+    /// if nothing has acted yet or `value` is not finite.
+    pub fn reward(&mut self, value: f64) -> Option<&str> {
+        let behavior = self.last.as_deref().filter(|_| value.is_finite())?;
+        self.stats
+            .entry(behavior.to_string())
+            .or_default()
+            .add(value);
+        Some(behavior)
+    }
+
+    /// Statistics of `behavior`, all 0 if it was never rewarded.
+    pub fn of(&self, behavior: &str) -> Stats {
+        self.stats.get(behavior).copied().unwrap_or_default()
+    }
+
+    pub fn stats(&self) -> &BTreeMap<String, Stats> {
+        &self.stats
+    }
+
+    /// Lines for `.rewards`.
+    pub fn render(&self) -> Vec<String> {
+        if self.stats.is_empty() {
+            return vec!["No rewards".to_string()];
+        }
+        self.stats
+            .iter()
+            .map(|(behavior, stats)| {
+                format!(
+                    "{}: {} reward{}, total {:.2}, mean {:.2}, last {:.2}, recent {:.2}",
+                    behavior,
+                    stats.count,
+                    if stats.count == 1 { "" } else { "s" },
+                    stats.total,
+                    stats.mean,
+                    stats.last,
+                    stats.recent
+                )
+            })
+            .collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::replkit::Repl;
+
+    #[test]
+    fn credits_the_behavior_that_acted_last() {
+        let mut rewards = Rewards::default();
+        assert_eq!(rewards.reward(1.0), None);
+        rewards.acted("input");
+        assert_eq!(rewards.reward(1.0), Some("input"));
+        assert_eq!(rewards.reward(-0.5), Some("input"));
+        assert_eq!(rewards.reward(f64::NAN), None);
+        rewards.acted("train");
+        rewards.reward(2.0);
+
+        let input = rewards.of("input");
+        assert_eq!(input.count, 2);
+        assert_eq!(input.total, 0.5);
+        assert_eq!(input.mean, 0.25);
+        assert_eq!(input.last, -0.5);
+        assert!((input.recent - 0.7).abs() < 1e-9);
+        assert_eq!(input.get("count"), Some(2.0));
+        assert_eq!(input.get("median"), None);
+        assert_eq!(rewards.of("schedule"), Stats::default());
+        assert_eq!(
+            rewards.render(),
+            [
+                "input: 2 rewards, total 0.50, mean 0.25, last -0.50, recent 0.70",
+                "train: 1 reward, total 2.00, mean 2.00, last 2.00, recent 2.00",
+            ]
+        );
+    }
+
+    #[test]
+    fn handlers_reward_themselves_and_read_the_stats() {
+        let mut out = Vec::new();
+        let mut repl = Repl::new(&b""[..], &mut out);
+        repl.eval_source(concat!(
+            "agent Learner {\n",
+            "  on input(msg) {\n",
+            "    if reward.input.mean < 0 {\n",
+            "      print \"trying something else\"\n",
+            "    }\n",
+            "    reward 0.5\n",
+            "  }\n",
+            "}\n",
+        ))
+        .unwrap();
+        repl.handle_command(".input hi").unwrap();
+        repl.handle_command(".reward -2").unwrap();
+        repl.handle_command(".input hi").unwrap();
+        repl.handle_command(".rewards").unwrap();
+        drop(repl);
+        let out = String::from_utf8(out).unwrap();
+        assert_eq!(
+            out,
+            concat!(
+                "Agent: Learner\n",
+                "Agent: Learner [registered]\n",
+                "Rewarded input: mean -0.75\n",
+                "  trying something else\n",
+                "input: 3 rewards, total -1.00, mean -0.33, last 0.50, recent 0.10\n",
+            )
+        );
+    }
+}
@@ -0,0 +1,243 @@
+//! JSON-RPC 2.0 over newline-delimited JSON, so editors and other runtimes
+//! can drive an agent as a subprocess.
+//!
+//! Methods:
+//! - `input {text}` and `train {text}` run the handler and return `{output}`.
+//! - `getMem {region, key?}` returns one value, or the whole region as an
+//!   object when `key` is omitted.
+//! - `recall {query, region?, limit?}` returns matching `{region, key, value}`
+//!   entries.
+//!
+//! Errors raised by the agent carry its code in `error.data.code`, e.g.
+//! `{"code": "SEN4002"}`.
+
+use crate::error::{MemoryError, RuntimeError};
+use crate::SentienceAgent;
+use serde_json::{json, Value};
+use std::io::{self, BufRead, Write};
+
+pub const PARSE_ERROR: i64 = -32700;
+pub const INVALID_REQUEST: i64 = -32600;
+pub const METHOD_NOT_FOUND: i64 = -32601;
+pub const INVALID_PARAMS: i64 = -32602;
+/// The method ran but failed, e.g. the agent has no `on input` handler.
+pub const AGENT_ERROR: i64 = -32000;
+
+/// Entries returned by `recall` when no limit is given.
+const DEFAULT_RECALL_LIMIT: usize = 10;
+
+struct RpcError {
+    code: i64,
+    message: String,
+    /// Code of an error from the agent (see [`error`](crate::error)), sent
+    /// as `data.code`.
+    agent_code: Option<&'static str>,
+}
+
+impl RpcError {
+    fn new(code: i64, message: impl Into<String>) -> Self {
+        Self {
+            code,
+            message: message.into(),
+            agent_code: None,
+        }
+    }
+
+    fn with_agent_code(mut self, code: &'static str) -> Self {
+        self.agent_code = Some(code);
+        self
+    }
+}
+
+/// Answer one request per line of `reader` until it is exhausted. Blank
+/// lines are ignored and notifications (requests without an `id`) get no
+/// response.
+pub fn serve(
+    agent: &mut SentienceAgent,
+    reader: impl BufRead,
+    mut writer: impl Write,
+) -> io::Result<()> {
+    for line in reader.lines() {
+        let line = line?;
+        if line.trim().is_empty() {
+            continue;
+        }
+        let response = match serde_json::from_str::<Value>(&line) {
+            Ok(request) => handle(agent, &request),
+            Err(e) => Some(error_response(
+                Value::Null,
+                RpcError::new(PARSE_ERROR, e.to_string()),
+            )),
+        };
+        if let Some(response) = response {
+            writeln!(writer, "{}", response)?;
+            writer.flush()?;
+        }
+    }
+    Ok(())
+}
+
+/// Handle a single decoded request, returning the response to send, if any.
+pub fn handle(agent: &mut SentienceAgent, request: &Value) -> Option<Value> {
+    let id = request.get("id").cloned();
+    let method = match (
+        request.get("jsonrpc").and_then(Value::as_str),
+        request.get("method").and_then(Value::as_str),
+    ) {
+        (Some("2.0"), Some(method)) => method,
+        _ => {
+            return Some(error_response(
+                id.unwrap_or(Value::Null),
+                RpcError::new(INVALID_REQUEST, "expected a JSON-RPC 2.0 request"),
+            ))
+        }
+    };
+    let params = request.get("params").cloned().unwrap_or(Value::Null);
+
+    let result = call(agent, method, &params);
+    let id = id?;
+    Some(match result {
+        Ok(result) => json!({ "jsonrpc": "2.0", "id": id, "result": result }),
+        Err(e) => error_response(id, e),
+    })
+}
+
+fn call(agent: &mut SentienceAgent, method: &str, params: &Value) -> Result<Value, RpcError> {
+    let string = |name: &str| params.get(name).and_then(Value::as_str);
+    let required = |name: &str| {
+        string(name).ok_or_else(|| RpcError::new(INVALID_PARAMS, format!("`{}` is required", name)))
+    };
+    let agent_error =
+        |e: &RuntimeError| RpcError::new(AGENT_ERROR, e.to_string()).with_agent_code(e.code());
+    let memory_error =
+        |e: MemoryError| RpcError::new(INVALID_PARAMS, e.to_string()).with_agent_code(e.code());
+
+    match method {
+        "input" => agent
+            .handle_input(required("text")?)
+            .map(|output| json!({ "output": output }))
+            .map_err(|e| agent_error(&e)),
+        "train" => agent
+            .train(required("text")?)
+            .map(|output| json!({ "output": output }))
+            .map_err(|e| agent_error(&e)),
+        "getMem" => {
+            let region = required("region")?;
+            match string("key") {
+                Some(key) => agent
+                    .get_mem(region, key)
+                    .map(Value::from)
+                    .map_err(memory_error),
+                None => match region {
+                    "short" => Ok(json!(agent.all_short())),
+                    "long" => Ok(json!(agent.all_long())),
+                    other => Err(RpcError::new(
+                        INVALID_PARAMS,
+                        format!("unknown memory region `{}`", other),
+                    )),
+                },
+            }
+        }
+        "recall" => {
+            let limit = params
+                .get("limit")
+                .and_then(Value::as_u64)
+                .map(|n| n as usize)
+                .unwrap_or(DEFAULT_RECALL_LIMIT);
+            agent
+                .recall(required("query")?, string("region"), limit)
+                .map(|matches| json!(matches))
+                .map_err(memory_error)
+        }
+        other => Err(RpcError::new(
+            METHOD_NOT_FOUND,
+            format!("unknown method `{}`", other),
+        )),
+    }
+}
+
+fn error_response(id: Value, error: RpcError) -> Value {
+    let mut body = json!({ "code": error.code, "message": error.message });
+    if let Some(code) = error.agent_code {
+        body["data"] = json!({ "code": code });
+    }
+    json!({ "jsonrpc": "2.0", "id": id, "error": body })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn agent() -> SentienceAgent {
+        let mut agent = SentienceAgent::new();
+        agent
+            .run_sentience(
+                r#"agent Echo {
+                    on input(msg) {
+                        print "ok"
+                    }
+                }"#,
+            )
+            .unwrap();
+        agent
+    }
+
+    fn exchange(agent: &mut SentienceAgent, requests: &[&str]) -> Vec<Value> {
+        let mut out = Vec::new();
+        serve(agent, requests.join("\n").as_bytes(), &mut out).unwrap();
+        String::from_utf8(out)
+            .unwrap()
+            .lines()
+            .map(|line| serde_json::from_str(line).unwrap())
+            .collect()
+    }
+
+    #[test]
+    fn drives_an_agent() {
+        let mut agent = agent();
+        agent.set_long("city", "Belgrade");
+        let responses = exchange(
+            &mut agent,
+            &[
+                r#"{"jsonrpc":"2.0","id":1,"method":"input","params":{"text":"hello"}}"#,
+                r#"{"jsonrpc":"2.0","id":2,"method":"getMem","params":{"region":"short","key":"msg"}}"#,
+                r#"{"jsonrpc":"2.0","id":3,"method":"recall","params":{"query":"belgrade"}}"#,
+                r#"{"jsonrpc":"2.0","method":"input","params":{"text":"quiet"}}"#,
+            ],
+        );
+
+        assert_eq!(responses.len(), 3);
+        assert_eq!(responses[0]["id"], 1);
+        assert!(responses[0]["result"]["output"].is_string());
+        assert_eq!(responses[1]["result"], "hello");
+        assert_eq!(
+            responses[2]["result"],
+            json!([{ "region": "long", "key": "city", "value": "Belgrade" }])
+        );
+        assert_eq!(agent.get_short("msg"), "quiet");
+    }
+
+    #[test]
+    fn reports_errors() {
+        let mut agent = agent();
+        let responses = exchange(
+            &mut agent,
+            &[
+                "{not json",
+                r#"{"jsonrpc":"2.0","id":1,"method":"fly"}"#,
+                r#"{"jsonrpc":"2.0","id":2,"method":"input"}"#,
+                r#"{"jsonrpc":"2.0","id":3,"method":"train","params":{"text":"x"}}"#,
+            ],
+        );
+        let codes: Vec<_> = responses
+            .iter()
+            .map(|r| r["error"]["code"].clone())
+            .collect();
+        assert_eq!(
+            codes,
+            [PARSE_ERROR, METHOD_NOT_FOUND, INVALID_PARAMS, AGENT_ERROR]
+        );
+        assert_eq!(responses[3]["error"]["data"], json!({ "code": "SEN4002" }));
+        assert!(responses[0]["error"].get("data").is_none());
+    }
+}
@@ -0,0 +1,265 @@
+use crate::config::SandboxConfig;
+use crate::error::{RuntimeError, RuntimeErrorKind};
+use std::fs;
+use std::path::{Component, Path, PathBuf};
+
+/// Capabilities an agent can declare with `capabilities: net, fs.read`, and
+/// the statements each one allows.
+pub const CAPABILITIES: [(&str, &str); 5] = [
+    ("net", "fetch"),
+    ("fs.read", "read"),
+    ("fs.write", "write"),
+    ("exec", "exec"),
+    ("llm", "ask"),
+];
+
+/// What a program may touch outside its own memory. Everything is denied
+/// unless the embedding application or the config file allows it.
+#[derive(Clone, Debug, Default)]
+pub struct Sandbox {
+    /// Whether `fetch` may make network requests at all.
+    pub allow_net: bool,
+    /// Hosts `fetch` may contact; empty allows any host. `*.example.com`
+    /// matches subdomains of `example.com`.
+    pub allowed_hosts: Vec<String>,
+    /// Directory `read` and `write` are confined to; `None` denies file
+    /// access.
+    pub workspace: Option<PathBuf>,
+    /// Whether `exec` may run commands at all.
+    pub allow_exec: bool,
+    /// Programs `exec` may start, matched exactly against the first word
+    /// of the command.
+    pub exec_allowlist: Vec<String>,
+    /// Whether an agent without a `capabilities` declaration is denied every
+    /// capability rather than given all the sandbox allows.
+    pub require_capabilities: bool,
+}
+
+impl Sandbox {
+    pub fn from_config(config: &SandboxConfig) -> Self {
+        Self {
+            allow_net: config.allow_net,
+            allowed_hosts: config.allowed_hosts.clone(),
+            workspace: config.workspace.clone(),
+            allow_exec: config.allow_exec,
+            exec_allowlist: config.exec_allowlist.clone(),
+            require_capabilities: config.require_capabilities,
+        }
+    }
+
+    /// Sandbox that permits network access to any host.
+    pub fn permissive() -> Self {
+        Self {
+            allow_net: true,
+            ..Default::default()
+        }
+    }
+
+    /// Check that `agent` (empty outside any agent), which declared
+    /// `declared` capabilities or none at all, may use `capability`. The
+    /// sandbox still decides what the capability reaches.
+    pub fn check_capability(
+        &self,
+        agent: &str,
+        declared: Option<&[String]>,
+        capability: &str,
+    ) -> Result<(), RuntimeError> {
+        match declared {
+            Some(declared) if declared.iter().any(|c| c == capability) => Ok(()),
+            Some(_) => Err(denied(&format!(
+                "agent `{}` does not declare the `{}` capability",
+                agent, capability
+            ))),
+            None if self.require_capabilities && agent.is_empty() => Err(denied(
+                "statements outside an agent have no capabilities and sandbox.require_capabilities is set",
+            )),
+            None if self.require_capabilities => Err(denied(&format!(
+                "agent `{}` declares no capabilities and sandbox.require_capabilities is set",
+                agent
+            ))),
+            None => Ok(()),
+        }
+    }
+
+    pub fn check_host(&self, host: &str) -> Result<(), RuntimeError> {
+        if !self.allow_net {
+            return Err(denied(
+                "network access is disabled; enable it with --allow-net or sandbox.allow_net",
+            ));
+        }
+        if self.allowed_hosts.is_empty() || self.allowed_hosts.iter().any(|p| host_matches(p, host))
+        {
+            return Ok(());
+        }
+        Err(denied(&format!(
+            "host `{}` is not in sandbox.allowed_hosts",
+            host
+        )))
+    }
+
+    pub fn check_command(&self, program: &str) -> Result<(), RuntimeError> {
+        if !self.allow_exec {
+            return Err(denied(
+                "command execution is disabled; enable it with --allow-exec or sandbox.allow_exec",
+            ));
+        }
+        if self.exec_allowlist.iter().any(|allowed| allowed == program) {
+            return Ok(());
+        }
+        Err(denied(&format!(
+            "command `{}` is not in sandbox.exec_allowlist",
+            program
+        )))
+    }
+
+    pub fn read_file(&self, path: &str) -> Result<String, RuntimeError> {
+        let full = self.resolve(path)?;
+        fs::read_to_string(&full).map_err(|e| file_error(path, e))
+    }
+
+    /// Write `content` to `path`, creating missing directories inside the
+    /// workspace.
+    pub fn write_file(&self, path: &str, content: &str) -> Result<(), RuntimeError> {
+        let full = self.resolve(path)?;
+        if let Some(parent) = full.parent() {
+            fs::create_dir_all(parent).map_err(|e| file_error(path, e))?;
+        }
+        fs::write(&full, content).map_err(|e| file_error(path, e))
+    }
+
+    /// Map a program-supplied relative path into the workspace, rejecting
+    /// absolute paths, `..` and symlinks that lead outside it.
+    pub fn resolve(&self, path: &str) -> Result<PathBuf, RuntimeError> {
+        let workspace = self.workspace.as_ref().ok_or_else(|| {
+            denied("file access is disabled; set a workspace with --workspace or sandbox.workspace")
+        })?;
+        let relative = Path::new(path);
+        let escapes = relative
+            .components()
+            .any(|c| !matches!(c, Component::Normal(_) | Component::CurDir));
+        if path.is_empty() || escapes {
+            return Err(denied(&format!("path `{}` is outside the workspace", path)));
+        }
+
+        let root = workspace
+            .canonicalize()
+            .map_err(|e| file_error(&workspace.display().to_string(), e))?;
+        let outside = || denied(&format!("path `{}` is outside the workspace", path));
+
+        // Check each component that exists, as the file may not yet. A
+        // symlink must lead inside the workspace; one leading nowhere is
+        // refused too, since writing through it would create its target.
+        let mut full = root.clone();
+        for component in relative.components() {
+            full.push(component);
+            match fs::symlink_metadata(&full) {
+                Ok(meta) if meta.file_type().is_symlink() => {
+                    let real = full.canonicalize().map_err(|_| outside())?;
+                    if !real.starts_with(&root) {
+                        return Err(outside());
+                    }
+                }
+                Ok(_) => {}
+                Err(e) if e.kind() == std::io::ErrorKind::NotFound => break,
+                Err(e) => return Err(file_error(path, e)),
+            }
+        }
+        Ok(root.join(relative))
+    }
+}
+
+fn host_matches(pattern: &str, host: &str) -> bool {
+    let host = host.to_ascii_lowercase();
+    let pattern = pattern.to_ascii_lowercase();
+    match pattern.strip_prefix("*.") {
+        Some(domain) => host
+            .strip_suffix(domain)
+            .is_some_and(|rest| rest.ends_with('.')),
+        None => host == pattern,
+    }
+}
+
+fn file_error(path: &str, e: std::io::Error) -> RuntimeError {
+    RuntimeError::new(RuntimeErrorKind::File(format!("{}: {}", path, e)))
+}
+
+fn denied(msg: &str) -> RuntimeError {
+    RuntimeError::new(RuntimeErrorKind::Denied(msg.to_string()))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn denies_network_by_default() {
+        assert!(Sandbox::default().check_host("example.com").is_err());
+        assert!(Sandbox::permissive().check_host("example.com").is_ok());
+    }
+
+    #[test]
+    fn grants_only_declared_capabilities() {
+        let declared = ["net".to_string()];
+        let sandbox = Sandbox::default();
+        assert!(sandbox
+            .check_capability("A", Some(&declared), "net")
+            .is_ok());
+        assert!(sandbox
+            .check_capability("A", Some(&declared), "exec")
+            .is_err());
+        assert!(sandbox.check_capability("A", None, "exec").is_ok());
+        let strict = Sandbox {
+            require_capabilities: true,
+            ..Default::default()
+        };
+        assert!(strict.check_capability("A", None, "net").is_err());
+        assert!(strict.check_capability("A", Some(&declared), "net").is_ok());
+    }
+
+    #[test]
+    fn matches_allowed_hosts() {
+        let sandbox = Sandbox {
+            allow_net: true,
+            allowed_hosts: vec!["api.example.com".to_string(), "*.data.org".to_string()],
+            ..Default::default()
+        };
+        assert!(sandbox.check_host("API.example.com").is_ok());
+        assert!(sandbox.check_host("eu.data.org").is_ok());
+        assert!(sandbox.check_host("data.org").is_err());
+        assert!(sandbox.check_host("evildata.org").is_err());
+        assert!(sandbox.check_host("example.com").is_err());
+    }
+
+    #[test]
+    fn confines_files_to_workspace() {
+        let dir = std::env::temp_dir().join(format!("sentience-sandbox-{}", std::process::id()));
+        fs::create_dir_all(&dir).unwrap();
+        let sandbox = Sandbox {
+            workspace: Some(dir.clone()),
+            ..Default::default()
+        };
+
+        sandbox.write_file("notes/today.txt", "hello").unwrap();
+        assert_eq!(sandbox.read_file("./notes/today.txt").unwrap(), "hello");
+        for path in ["../escape.txt", "/etc/passwd", "notes/../../x", ""] {
+            let err = sandbox.resolve(path).unwrap_err();
+            assert!(matches!(err.kind, RuntimeErrorKind::Denied(_)), "{}", path);
+        }
+        assert!(Sandbox::default().read_file("notes/today.txt").is_err());
+
+        #[cfg(unix)]
+        {
+            std::os::unix::fs::symlink("/tmp", dir.join("out")).unwrap();
+            assert!(sandbox.write_file("out/x.txt", "no").is_err());
+            let target =
+                std::env::temp_dir().join(format!("sentience-dangling-{}", std::process::id()));
+            std::os::unix::fs::symlink(&target, dir.join("dangling")).unwrap();
+            let err = sandbox.write_file("dangling", "no").unwrap_err();
+            assert!(matches!(err.kind, RuntimeErrorKind::Denied(_)));
+            assert!(!target.exists());
+            std::os::unix::fs::symlink("notes", dir.join("inside")).unwrap();
+            assert_eq!(sandbox.read_file("inside/today.txt").unwrap(), "hello");
+        }
+        fs::remove_dir_all(&dir).unwrap();
+    }
+}
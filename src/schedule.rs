@@ -0,0 +1,521 @@
+//! Cron expressions for `on schedule("...")` handlers and a scheduler that
+//! works out which handlers are due next. Times are in UTC.
+//!
+//! A handler may also run at a fixed interval, written `every 5s { ... }`
+//! or `on tick(5s) { ... }` with a unit of `s`, `m` or `h`. Both are kept
+//! as `on schedule("every 5s")`.
+
+use crate::context::AgentContext;
+use crate::types::Statement;
+use std::fmt;
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct CronError {
+    pub spec: String,
+    pub message: String,
+}
+
+impl fmt::Display for CronError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "invalid schedule `{}`: {}", self.spec, self.message)
+    }
+}
+
+impl std::error::Error for CronError {}
+
+/// A standard five-field cron expression (`minute hour day-of-month month
+/// day-of-week`) supporting `*`, lists, ranges, steps and the `@hourly`,
+/// `@daily`, `@weekly`, `@monthly` and `@yearly` shorthands. Each field is
+/// kept as a bit set of allowed values.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct CronSchedule {
+    minutes: u64,
+    hours: u64,
+    days: u64,
+    months: u64,
+    weekdays: u64,
+    /// Both day fields were restricted, so either may match (cron's rule).
+    day_or_weekday: bool,
+}
+
+/// A UTC calendar time, precise to the minute.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+struct Civil {
+    year: i64,
+    month: u32,
+    day: u32,
+    hour: u32,
+    minute: u32,
+}
+
+impl CronSchedule {
+    pub fn parse(spec: &str) -> Result<Self, CronError> {
+        let err = |message: &str| CronError {
+            spec: spec.to_string(),
+            message: message.to_string(),
+        };
+        let expanded = match spec.trim() {
+            "@hourly" => "0 * * * *",
+            "@daily" | "@midnight" => "0 0 * * *",
+            "@weekly" => "0 0 * * 0",
+            "@monthly" => "0 0 1 * *",
+            "@yearly" | "@annually" => "0 0 1 1 *",
+            other => other,
+        };
+        let fields: Vec<&str> = expanded.split_whitespace().collect();
+        if fields.len() != 5 {
+            return Err(err("expected 5 fields: minute hour day month weekday"));
+        }
+
+        let mut weekdays = parse_field(fields[4], 0, 7).map_err(|m| err(&m))?;
+        // Both 0 and 7 mean Sunday.
+        if weekdays & (1 << 7) != 0 {
+            weekdays = (weekdays | 1) & !(1 << 7);
+        }
+        Ok(Self {
+            minutes: parse_field(fields[0], 0, 59).map_err(|m| err(&m))?,
+            hours: parse_field(fields[1], 0, 23).map_err(|m| err(&m))?,
+            days: parse_field(fields[2], 1, 31).map_err(|m| err(&m))?,
+            months: parse_field(fields[3], 1, 12).map_err(|m| err(&m))?,
+            weekdays,
+            day_or_weekday: !fields[2].starts_with('*') && !fields[4].starts_with('*'),
+        })
+    }
+
+    fn day_matches(&self, t: &Civil) -> bool {
+        let day = bit(self.days, t.day);
+        let weekday = bit(self.weekdays, weekday(t.year, t.month, t.day));
+        if self.day_or_weekday {
+            day || weekday
+        } else {
+            day && weekday
+        }
+    }
+
+    /// First matching time strictly after `unix_secs`, as Unix seconds.
+    /// `None` if nothing matches within five years (e.g. `0 0 30 2 *`).
+    pub fn next_after(&self, unix_secs: u64) -> Option<u64> {
+        let mut t = Civil::from_unix(unix_secs / 60 * 60 + 60);
+        let limit = t.year + 5;
+        while t.year <= limit {
+            if !bit(self.months, t.month) {
+                t = Civil {
+                    month: t.month + 1,
+                    day: 1,
+                    hour: 0,
+                    minute: 0,
+                    ..t
+                }
+                .normalized();
+                continue;
+            }
+            if !self.day_matches(&t) {
+                t = Civil {
+                    day: t.day + 1,
+                    hour: 0,
+                    minute: 0,
+                    ..t
+                }
+                .normalized();
+                continue;
+            }
+            if !bit(self.hours, t.hour) {
+                t = Civil {
+                    hour: t.hour + 1,
+                    minute: 0,
+                    ..t
+                }
+                .normalized();
+                continue;
+            }
+            if !bit(self.minutes, t.minute) {
+                t = Civil {
+                    minute: t.minute + 1,
+                    ..t
+                }
+                .normalized();
+                continue;
+            }
+            return Some(t.to_unix());
+        }
+        None
+    }
+}
+
+/// When a scheduled handler runs.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Timing {
+    Cron(CronSchedule),
+    /// Every so many seconds, counted from the Unix epoch, so `every 5m`
+    /// runs on the minutes divisible by 5 like `*/5 * * * *`.
+    Every(u64),
+}
+
+impl Timing {
+    /// Parse a schedule spec: `every <interval>` or a cron expression.
+    pub fn parse(spec: &str) -> Result<Self, CronError> {
+        match spec.trim().strip_prefix("every ") {
+            Some(interval) => parse_interval(interval.trim()).map(Timing::Every),
+            None => CronSchedule::parse(spec).map(Timing::Cron),
+        }
+    }
+
+    /// First time strictly after `unix_secs` at which the handler runs.
+    pub fn next_after(&self, unix_secs: u64) -> Option<u64> {
+        match self {
+            Timing::Cron(schedule) => schedule.next_after(unix_secs),
+            Timing::Every(seconds) => Some((unix_secs / seconds + 1) * seconds),
+        }
+    }
+}
+
+/// Parse an interval such as `30s`, `5m` or `1h` into seconds.
+pub fn parse_interval(interval: &str) -> Result<u64, CronError> {
+    let err = |message: &str| CronError {
+        spec: interval.to_string(),
+        message: message.to_string(),
+    };
+    let split = interval
+        .find(|c: char| !c.is_ascii_digit())
+        .ok_or_else(|| err("expected a unit: s, m or h"))?;
+    let (count, unit) = interval.split_at(split);
+    let count: u64 = count
+        .parse()
+        .map_err(|_| err("expected a whole number followed by s, m or h"))?;
+    let scale = match unit {
+        "s" => 1,
+        "m" => 60,
+        "h" => 3600,
+        _ => {
+            return Err(err(&format!(
+                "unknown unit `{}` (expected s, m or h)",
+                unit
+            )))
+        }
+    };
+    match count.checked_mul(scale) {
+        Some(0) => Err(err("interval must be positive")),
+        Some(seconds) => Ok(seconds),
+        None => Err(err("interval is too long")),
+    }
+}
+
+fn bit(set: u64, value: u32) -> bool {
+    set & (1 << value) != 0
+}
+
+/// Parse one comma-separated cron field into a bit set.
+fn parse_field(field: &str, min: u32, max: u32) -> Result<u64, String> {
+    let mut set = 0u64;
+    for part in field.split(',') {
+        let (range, step) = match part.split_once('/') {
+            Some((range, step)) => {
+                let step: u32 = step
+                    .parse()
+                    .map_err(|_| format!("invalid step `{}`", step))?;
+                if step == 0 {
+                    return Err("step must be positive".to_string());
+                }
+                (range, step)
+            }
+            None => (part, 1),
+        };
+        let (lo, hi) = if range == "*" {
+            (min, max)
+        } else if let Some((lo, hi)) = range.split_once('-') {
+            (number(lo, min, max)?, number(hi, min, max)?)
+        } else {
+            let n = number(range, min, max)?;
+            // `5/15` means every 15 starting at 5.
+            (n, if part.contains('/') { max } else { n })
+        };
+        if lo > hi {
+            return Err(format!("range `{}` is backwards", range));
+        }
+        for v in (lo..=hi).step_by(step as usize) {
+            set |= 1 << v;
+        }
+    }
+    Ok(set)
+}
+
+fn number(s: &str, min: u32, max: u32) -> Result<u32, String> {
+    let n: u32 = s.parse().map_err(|_| format!("invalid value `{}`", s))?;
+    if n < min || n > max {
+        return Err(format!("{} is outside {}-{}", n, min, max));
+    }
+    Ok(n)
+}
+
+impl Civil {
+    fn from_unix(secs: u64) -> Self {
+        let days = (secs / 86_400) as i64;
+        let rem = secs % 86_400;
+        let (year, month, day) = civil_from_days(days);
+        Civil {
+            year,
+            month,
+            day,
+            hour: (rem / 3600) as u32,
+            minute: (rem % 3600 / 60) as u32,
+        }
+    }
+
+    fn to_unix(self) -> u64 {
+        let days = days_from_civil(self.year, self.month, self.day);
+        (days * 86_400 + self.hour as i64 * 3600 + self.minute as i64 * 60) as u64
+    }
+
+    /// Carry overflowing minutes, hours, days and months upwards.
+    fn normalized(mut self) -> Self {
+        if self.minute >= 60 {
+            self.minute = 0;
+            self.hour += 1;
+        }
+        if self.hour >= 24 {
+            self.hour = 0;
+            self.day += 1;
+        }
+        if self.month <= 12 && self.day > days_in_month(self.year, self.month) {
+            self.day = 1;
+            self.month += 1;
+        }
+        if self.month > 12 {
+            self.month = 1;
+            self.year += 1;
+        }
+        self
+    }
+}
+
+fn days_in_month(year: i64, month: u32) -> u32 {
+    match month {
+        2 if (year % 4 == 0 && year % 100 != 0) || year % 400 == 0 => 29,
+        2 => 28,
+        4 | 6 | 9 | 11 => 30,
+        _ => 31,
+    }
+}
+
+/// 0 = Sunday.
+fn weekday(year: i64, month: u32, day: u32) -> u32 {
+    // 1970-01-01 was a Thursday.
+    (days_from_civil(year, month, day) + 4).rem_euclid(7) as u32
+}
+
+// Conversions between days since 1970-01-01 and proleptic Gregorian dates,
+// after Howard Hinnant's `chrono`-compatible algorithms.
+pub(crate) fn days_from_civil(year: i64, month: u32, day: u32) -> i64 {
+    let y = if month <= 2 { year - 1 } else { year };
+    let era = y.div_euclid(400);
+    let yoe = y - era * 400;
+    let m = month as i64;
+    let doy = (153 * (if m > 2 { m - 3 } else { m + 9 }) + 2) / 5 + day as i64 - 1;
+    let doe = yoe * 365 + yoe / 4 - yoe / 100 + doy;
+    era * 146_097 + doe - 719_468
+}
+
+pub(crate) fn civil_from_days(days: i64) -> (i64, u32, u32) {
+    let z = days + 719_468;
+    let era = z.div_euclid(146_097);
+    let doe = z - era * 146_097;
+    let yoe = (doe - doe / 1460 + doe / 36_524 - doe / 146_096) / 365;
+    let doy = doe - (365 * yoe + yoe / 4 - yoe / 100);
+    let mp = (5 * doy + 2) / 153;
+    let day = (doy - (153 * mp + 2) / 5 + 1) as u32;
+    let month = if mp < 10 { mp + 3 } else { mp - 9 } as u32;
+    let year = yoe + era * 400 + if month <= 2 { 1 } else { 0 };
+    (year, month, day)
+}
+
+/// The `on schedule` and `every` handlers of the current agent.
+pub struct Scheduler {
+    entries: Vec<(String, Timing)>,
+}
+
+impl Scheduler {
+    /// Collect the schedules declared by the agent registered in `ctx`.
+    pub fn for_context(ctx: &AgentContext) -> Result<Self, CronError> {
+        let mut entries = Vec::new();
+        if let Some(Statement::AgentDeclaration { body, .. }) = &ctx.current_agent {
+            for stmt in body {
+                if let Statement::OnSchedule { spec, .. } = stmt {
+                    entries.push((spec.clone(), Timing::parse(spec)?));
+                }
+            }
+        }
+        Ok(Self { entries })
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.entries.is_empty()
+    }
+
+    /// The earliest time after `unix_secs` at which a handler is due, with
+    /// the specs of every handler due then.
+    pub fn next_after(&self, unix_secs: u64) -> Option<(u64, Vec<String>)> {
+        let mut next: Option<(u64, Vec<String>)> = None;
+        for (spec, timing) in &self.entries {
+            let Some(at) = timing.next_after(unix_secs) else {
+                continue;
+            };
+            match &mut next {
+                Some((time, specs)) if *time == at => specs.push(spec.clone()),
+                Some((time, _)) if *time < at => {}
+                _ => next = Some((at, vec![spec.clone()])),
+            }
+        }
+        next
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn unix(year: i64, month: u32, day: u32, hour: u32, minute: u32) -> u64 {
+        Civil {
+            year,
+            month,
+            day,
+            hour,
+            minute,
+        }
+        .to_unix()
+    }
+
+    #[test]
+    fn converts_civil_dates() {
+        assert_eq!(unix(1970, 1, 1, 0, 0), 0);
+        assert_eq!(unix(2024, 2, 29, 12, 30), 1_709_209_800);
+        assert_eq!(
+            Civil::from_unix(1_709_209_800),
+            Civil {
+                year: 2024,
+                month: 2,
+                day: 29,
+                hour: 12,
+                minute: 30
+            }
+        );
+        assert_eq!(weekday(2024, 2, 29), 4);
+    }
+
+    #[test]
+    fn finds_next_fire_time() {
+        let daily = CronSchedule::parse("0 9 * * *").unwrap();
+        assert_eq!(
+            daily.next_after(unix(2024, 12, 31, 9, 0)),
+            Some(unix(2025, 1, 1, 9, 0))
+        );
+
+        let weekdays = CronSchedule::parse("*/15 8-17 * * 1-5").unwrap();
+        // Friday 17:50 -> Monday 08:00.
+        assert_eq!(
+            weekdays.next_after(unix(2024, 3, 1, 17, 50)),
+            Some(unix(2024, 3, 4, 8, 0))
+        );
+
+        let leap = CronSchedule::parse("0 0 29 2 *").unwrap();
+        assert_eq!(
+            leap.next_after(unix(2024, 3, 1, 0, 0)),
+            Some(unix(2028, 2, 29, 0, 0))
+        );
+        assert_eq!(
+            CronSchedule::parse("0 0 30 2 *").unwrap().next_after(0),
+            None
+        );
+
+        // Day-of-month and day-of-week restricted together match either.
+        let either = CronSchedule::parse("0 0 13 * 5").unwrap();
+        assert_eq!(
+            either.next_after(unix(2024, 9, 1, 0, 0)),
+            Some(unix(2024, 9, 6, 0, 0))
+        );
+        assert_eq!(CronSchedule::parse("@weekly").unwrap().weekdays, 1);
+    }
+
+    #[test]
+    fn runs_declared_schedules() {
+        let src = r#"
+agent Reporter {
+  on schedule("0 9 * * *") {
+    print "daily report"
+  }
+  on schedule("@hourly") {
+    print "tick"
+  }
+}
+"#;
+        let mut lexer = crate::lexer::Lexer::new(src);
+        let program = crate::parser::Parser::new(&mut lexer).parse_program();
+        let mut ctx = AgentContext::new();
+        let mut output = Vec::new();
+        crate::eval::eval(&program.statements[0], "", "", &mut ctx, &mut output).unwrap();
+
+        let scheduler = Scheduler::for_context(&ctx).unwrap();
+        let (at, specs) = scheduler.next_after(unix(2024, 5, 1, 8, 0)).unwrap();
+        assert_eq!(at, unix(2024, 5, 1, 9, 0));
+        assert_eq!(specs, ["0 9 * * *", "@hourly"]);
+
+        let output = crate::eval::run_block(&mut ctx, "schedule", "0 9 * * *", "").unwrap();
+        assert_eq!(output, ["daily report"]);
+    }
+
+    #[test]
+    fn runs_handlers_at_intervals() {
+        let src = concat!(
+            "agent Clock {\n",
+            "  every 90s {\n",
+            "    print \"tick\"\n",
+            "  }\n",
+            "  on tick(1m) {\n",
+            "    print \"minute\"\n",
+            "  }\n",
+            "}\n",
+        );
+        let mut lexer = crate::lexer::Lexer::new(src);
+        let program = crate::parser::Parser::new(&mut lexer).parse_program();
+        assert_eq!(
+            crate::printer::print(&program),
+            src.replace("on tick(1m)", "every 1m")
+        );
+        let mut ctx = AgentContext::new();
+        let mut output = Vec::new();
+        crate::eval::eval(&program.statements[0], "", "", &mut ctx, &mut output).unwrap();
+
+        let scheduler = Scheduler::for_context(&ctx).unwrap();
+        let start = unix(2024, 5, 1, 8, 0);
+        assert_eq!(
+            scheduler.next_after(start),
+            Some((start + 60, vec!["every 1m".to_string()]))
+        );
+        assert_eq!(
+            scheduler.next_after(start + 150),
+            Some((
+                start + 180,
+                vec!["every 90s".to_string(), "every 1m".to_string()]
+            ))
+        );
+        let output = crate::eval::run_block(&mut ctx, "schedule", "every 90s", "").unwrap();
+        assert_eq!(output, ["tick"]);
+
+        assert_eq!(parse_interval("2h"), Ok(7200));
+        for interval in ["0s", "5", "5d", "s", "1.5m", "99999999999999999h"] {
+            assert!(parse_interval(interval).is_err(), "{}", interval);
+        }
+    }
+
+    #[test]
+    fn rejects_bad_specs() {
+        for spec in [
+            "* * * *",
+            "60 * * * *",
+            "*/0 * * * *",
+            "5-1 * * * *",
+            "a * * * *",
+        ] {
+            assert!(CronSchedule::parse(spec).is_err(), "{}", spec);
+        }
+    }
+}
@@ -0,0 +1,463 @@
+//! Embedding storage for similarity search.
+//!
+//! Vectors of the same dimension are kept back to back in one `Vec<f32>`,
+//! so a brute-force search walks memory in order and the dot product
+//! vectorizes. The best `k` are kept in a bounded heap rather than sorting
+//! every score. Equal scores are ordered by id, so results do not depend on
+//! the order vectors were inserted or removed in.
+//!
+//! Vectors are compared by a [`Metric`], cosine similarity unless another
+//! is chosen. For cosine they are stored scaled to unit length, with
+//! lengths summed in `f64` so large components cannot overflow. A vector
+//! that is all zeros or has a NaN or infinite component has no direction;
+//! it is stored as zeros and scores 0 against everything, as does every
+//! vector against such a query. The other metrics keep vectors as given,
+//! with those having a NaN or infinite component stored as zeros.
+
+use std::cmp::{Ordering, Reverse};
+use std::collections::{BinaryHeap, HashMap};
+use std::fmt;
+
+/// How close two vectors are.
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub enum Metric {
+    /// The cosine of the angle between them, from -1 to 1; higher is
+    /// closer.
+    #[default]
+    Cosine,
+    /// Their dot product; higher is closer.
+    Dot,
+    /// The distance between their ends; lower is closer.
+    Euclidean,
+}
+
+impl Metric {
+    pub const ALL: [Metric; 3] = [Metric::Cosine, Metric::Dot, Metric::Euclidean];
+
+    /// The metric named `name`, such as `cosine`.
+    pub fn parse(name: &str) -> Option<Self> {
+        Self::ALL.into_iter().find(|metric| metric.as_str() == name)
+    }
+
+    pub fn as_str(self) -> &'static str {
+        match self {
+            Metric::Cosine => "cosine",
+            Metric::Dot => "dot",
+            Metric::Euclidean => "euclidean",
+        }
+    }
+
+    /// Score of `vector` against `query`, both as stored.
+    fn score(self, query: &[f32], vector: &[f32]) -> f32 {
+        match self {
+            // Rounding can take the product of unit vectors just past 1.
+            Metric::Cosine => dot(query, vector).clamp(-1.0, 1.0),
+            Metric::Dot => dot(query, vector),
+            Metric::Euclidean => query
+                .iter()
+                .zip(vector)
+                .map(|(a, b)| (a - b) * (a - b))
+                .sum::<f32>()
+                .sqrt(),
+        }
+    }
+
+    /// `score` turned so that higher is closer, and back.
+    fn rank(self, score: f32) -> f32 {
+        match self {
+            Metric::Euclidean => -score,
+            _ => score,
+        }
+    }
+}
+
+impl fmt::Display for Metric {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
+
+/// A vector refused by an index of a fixed dimension.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct DimensionError {
+    pub expected: usize,
+    pub found: usize,
+}
+
+impl fmt::Display for DimensionError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "vector has {} dimensions, not the index's {}",
+            self.found, self.expected
+        )
+    }
+}
+
+impl std::error::Error for DimensionError {}
+
+/// Embeddings by id, searchable by a [`Metric`].
+#[derive(Clone, Debug, Default)]
+pub struct LatentIndex {
+    groups: HashMap<usize, Group>,
+    /// Dimension and row of each id.
+    slots: HashMap<String, (usize, usize)>,
+    metric: Metric,
+    /// The only dimension accepted, if fixed.
+    dimension: Option<usize>,
+}
+
+/// All vectors of one dimension, each of unit length or all zeros.
+#[derive(Clone, Debug, Default)]
+struct Group {
+    values: Vec<f32>,
+    ids: Vec<String>,
+}
+
+/// A score with a total order, for the heap: higher scores first, then
+/// smaller ids.
+#[derive(Clone, Copy, PartialEq)]
+struct Scored<'a>(f32, &'a str);
+
+impl Eq for Scored<'_> {}
+
+impl PartialOrd for Scored<'_> {
+    fn partial_cmp(&self, other: &Self) -> Option<Ordering> {
+        Some(self.cmp(other))
+    }
+}
+
+impl Ord for Scored<'_> {
+    fn cmp(&self, other: &Self) -> Ordering {
+        self.0.total_cmp(&other.0).then(other.1.cmp(self.1))
+    }
+}
+
+impl LatentIndex {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Compare vectors by `metric` rather than cosine similarity. Set it
+    /// before inserting anything, as stored vectors are kept for the
+    /// metric.
+    pub fn with_metric(mut self, metric: Metric) -> Self {
+        self.metric = metric;
+        self
+    }
+
+    /// Accept only vectors of `dimension` components.
+    pub fn with_dimension(mut self, dimension: usize) -> Self {
+        self.dimension = Some(dimension);
+        self
+    }
+
+    pub fn metric(&self) -> Metric {
+        self.metric
+    }
+
+    /// The only dimension accepted, if fixed.
+    pub fn dimension(&self) -> Option<usize> {
+        self.dimension
+    }
+
+    pub fn len(&self) -> usize {
+        self.slots.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.slots.is_empty()
+    }
+
+    /// Dimensions of the stored vectors, each with how many there are,
+    /// smallest dimension first.
+    pub fn dimensions(&self) -> Vec<(usize, usize)> {
+        let mut dimensions: Vec<(usize, usize)> = self
+            .groups
+            .iter()
+            .filter(|(_, group)| !group.ids.is_empty())
+            .map(|(&dim, group)| (dim, group.ids.len()))
+            .collect();
+        dimensions.sort_unstable();
+        dimensions
+    }
+
+    /// Store `vector` for `id`, replacing any earlier one. Fails if the
+    /// index has a fixed dimension and `vector` is of another.
+    pub fn insert(&mut self, id: &str, vector: &[f32]) -> Result<(), DimensionError> {
+        let dim = vector.len();
+        if let Some(expected) = self.dimension.filter(|&expected| expected != dim) {
+            return Err(DimensionError {
+                expected,
+                found: dim,
+            });
+        }
+        let mut stored = vector.to_vec();
+        let usable = match self.metric {
+            Metric::Cosine => normalize(&mut stored),
+            Metric::Dot | Metric::Euclidean => stored.iter().all(|x| x.is_finite()),
+        };
+        if !usable {
+            stored.fill(0.0);
+        }
+        if let Some(&(old_dim, row)) = self.slots.get(id) {
+            if old_dim == dim {
+                let group = self.groups.get_mut(&dim).expect("slot has a group");
+                group.values[row * dim..(row + 1) * dim].copy_from_slice(&stored);
+                return Ok(());
+            }
+            self.remove(id);
+        }
+        let group = self.groups.entry(dim).or_default();
+        self.slots.insert(id.to_string(), (dim, group.ids.len()));
+        group.values.extend_from_slice(&stored);
+        group.ids.push(id.to_string());
+        Ok(())
+    }
+
+    /// Forget the vector of `id`.
+    pub fn remove(&mut self, id: &str) {
+        let Some((dim, row)) = self.slots.remove(id) else {
+            return;
+        };
+        let group = self.groups.get_mut(&dim).expect("slot has a group");
+        let last = group.ids.len() - 1;
+        if row != last {
+            group
+                .values
+                .copy_within(last * dim..(last + 1) * dim, row * dim);
+            group.ids.swap(row, last);
+            self.slots.insert(group.ids[row].clone(), (dim, row));
+        }
+        group.values.truncate(last * dim);
+        group.ids.pop();
+    }
+
+    /// Up to `k` ids with their score against `query`, closest first and
+    /// then by id. Cosine scores are always within `-1.0..=1.0`, and
+    /// vectors of another dimension, or without a direction, score 0. The
+    /// other metrics only score vectors of the query's dimension, and
+    /// nothing against a query with a NaN or infinite component.
+    pub fn nearest(&self, query: &[f32], k: usize) -> Vec<(&str, f32)> {
+        if k == 0 {
+            return Vec::new();
+        }
+        let mut query = query.to_vec();
+        let directed = match self.metric {
+            Metric::Cosine => normalize(&mut query),
+            Metric::Dot | Metric::Euclidean => query.iter().all(|x| x.is_finite()),
+        };
+        let dim = query.len();
+        let mut best: Vec<(&str, f32)> = Vec::with_capacity(k.min(self.len()));
+        if let Some(group) = self.groups.get(&dim).filter(|_| directed) {
+            let mut heap = BinaryHeap::with_capacity(k + 1);
+            for (row, vector) in group.values.chunks_exact(dim.max(1)).enumerate() {
+                let score = self.metric.rank(self.metric.score(&query, vector));
+                let scored = Scored(score, group.ids[row].as_str());
+                if heap.len() < k {
+                    heap.push(Reverse(scored));
+                } else if let Some(mut worst) = heap.peek_mut() {
+                    if scored > worst.0 {
+                        *worst = Reverse(scored);
+                    }
+                }
+            }
+            let mut scored: Vec<Scored> = heap.into_iter().map(|Reverse(s)| s).collect();
+            scored.sort_by(|a, b| b.cmp(a));
+            best.extend(scored.iter().map(|s| (s.1, self.metric.rank(s.0))));
+        }
+        if best.len() < k && self.metric == Metric::Cosine {
+            // Everything else scores 0; fill up as a full scan would.
+            let mut rest: Vec<&str> = self
+                .slots
+                .iter()
+                .filter(|(_, (d, _))| *d != dim || !directed)
+                .map(|(id, _)| id.as_str())
+                .collect();
+            rest.sort_unstable();
+            let scored = best.len();
+            best.extend(rest.into_iter().take(k - scored).map(|id| (id, 0.0)));
+            best.sort_by(|a, b| Scored(b.1, b.0).cmp(&Scored(a.1, a.0)));
+        }
+        best
+    }
+}
+
+/// Scale `vector` to unit length. Returns false, leaving it unchanged, if it
+/// has no direction: all its components are zero, or one is NaN or infinite.
+pub fn normalize(vector: &mut [f32]) -> bool {
+    if !vector.iter().all(|x| x.is_finite()) {
+        return false;
+    }
+    let norm = vector
+        .iter()
+        .map(|&x| f64::from(x) * f64::from(x))
+        .sum::<f64>()
+        .sqrt();
+    if norm == 0.0 {
+        return false;
+    }
+    for x in vector.iter_mut() {
+        *x = (f64::from(*x) / norm) as f32;
+    }
+    true
+}
+
+/// Dot product in eight independent lanes, which the compiler turns into
+/// SIMD instructions.
+fn dot(a: &[f32], b: &[f32]) -> f32 {
+    const LANES: usize = 8;
+    let mut sums = [0.0f32; LANES];
+    let (a_chunks, b_chunks) = (a.chunks_exact(LANES), b.chunks_exact(LANES));
+    let tail: f32 = a_chunks
+        .remainder()
+        .iter()
+        .zip(b_chunks.remainder())
+        .map(|(x, y)| x * y)
+        .sum();
+    for (x, y) in a_chunks.zip(b_chunks) {
+        for lane in 0..LANES {
+            sums[lane] += x[lane] * y[lane];
+        }
+    }
+    sums.iter().sum::<f32>() + tail
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn keeps_the_k_most_similar() {
+        let mut index = LatentIndex::new();
+        index.insert("east", &[1.0, 0.0]).unwrap();
+        index.insert("north", &[0.0, 1.0]).unwrap();
+        index.insert("northeast", &[1.0, 1.0]).unwrap();
+        index.insert("other", &[1.0, 0.0, 0.0]).unwrap();
+        index.insert("zero", &[0.0, 0.0]).unwrap();
+
+        let ids = |hits: Vec<(&str, f32)>| {
+            hits.into_iter()
+                .map(|(id, _)| id.to_string())
+                .collect::<Vec<_>>()
+        };
+        assert_eq!(ids(index.nearest(&[1.0, 0.1], 2)), ["east", "northeast"]);
+        assert_eq!(index.nearest(&[1.0, 0.1], 9).len(), 5);
+
+        index.insert("east", &[-1.0, 0.0]).unwrap();
+        index.remove("northeast");
+        assert_eq!(ids(index.nearest(&[1.0, 0.1], 1)), ["north"]);
+        assert_eq!(index.len(), 4);
+        assert_eq!(index.dimensions(), [(2, 3), (3, 1)]);
+    }
+
+    #[test]
+    fn orders_ties_by_id() {
+        let mut index = LatentIndex::new();
+        for id in ["c", "a", "d", "b"] {
+            index.insert(id, &[1.0, 0.0]).unwrap();
+        }
+        index.insert("flat", &[1.0, 0.0, 0.0]).unwrap();
+        index.insert("z", &[0.0, 0.0, 1.0]).unwrap();
+        index.remove("d");
+        index.insert("d", &[1.0, 0.0]).unwrap();
+
+        let ids = |hits: Vec<(&str, f32)>| {
+            hits.into_iter()
+                .map(|(id, _)| id.to_string())
+                .collect::<Vec<_>>()
+        };
+        assert_eq!(ids(index.nearest(&[1.0, 0.0], 2)), ["a", "b"]);
+        assert_eq!(
+            ids(index.nearest(&[0.0, 1.0], 6)),
+            ["a", "b", "c", "d", "flat", "z"]
+        );
+        assert_eq!(ids(index.nearest(&[0.0, 0.0], 3)), ["a", "b", "c"]);
+    }
+
+    #[test]
+    fn degenerate_vectors_score_zero() {
+        let mut index = LatentIndex::new();
+        index.insert("east", &[1.0, 0.0]).unwrap();
+        index.insert("huge", &[1e30, 1e30]).unwrap();
+        index.insert("tiny", &[1e-30, 0.0]).unwrap();
+        index.insert("inf", &[f32::INFINITY, 0.0]).unwrap();
+        index.insert("nan", &[f32::NAN, 1.0]).unwrap();
+        index.insert("zero", &[0.0, 0.0]).unwrap();
+        index.insert("max", &[-f32::MAX, f32::MAX]).unwrap();
+
+        let hits = index.nearest(&[1.0, 0.0], 7);
+        let ids: Vec<&str> = hits.iter().map(|(id, _)| *id).collect();
+        assert_eq!(ids, ["east", "tiny", "huge", "inf", "nan", "zero", "max"]);
+        assert_eq!(hits[0].1, 1.0);
+        assert!((hits[2].1 - std::f32::consts::FRAC_1_SQRT_2).abs() < 1e-6);
+        assert!((hits[6].1 + std::f32::consts::FRAC_1_SQRT_2).abs() < 1e-6);
+        assert_eq!(
+            &hits[3..6].iter().map(|h| h.1).collect::<Vec<_>>(),
+            &[0.0; 3]
+        );
+
+        assert_eq!(index.nearest(&[f32::MAX, 0.0], 1), [("east", 1.0)]);
+        for query in [[f32::NAN, 1.0], [f32::NEG_INFINITY, 0.0], [0.0, 0.0]] {
+            let hits = index.nearest(&query, 7);
+            assert_eq!(hits.len(), 7);
+            assert!(hits.iter().all(|(_, score)| *score == 0.0));
+            assert_eq!(hits[0].0, "east");
+        }
+    }
+
+    #[test]
+    fn ranks_by_the_chosen_metric() {
+        let near = |metric| {
+            let mut index = LatentIndex::new().with_metric(metric).with_dimension(2);
+            index.insert("small", &[1.0, 0.0]).unwrap();
+            index.insert("big", &[4.0, 3.0]).unwrap();
+            index.insert("away", &[-1.0, 0.0]).unwrap();
+            assert_eq!(
+                index.insert("flat", &[1.0, 0.0, 0.0]),
+                Err(DimensionError {
+                    expected: 2,
+                    found: 3
+                })
+            );
+            index
+                .nearest(&[1.0, 0.0], 3)
+                .into_iter()
+                .map(|(id, score)| (id.to_string(), score))
+                .collect::<Vec<_>>()
+        };
+        let ids = |hits: &[(String, f32)]| hits.iter().map(|h| h.0.clone()).collect::<Vec<_>>();
+
+        let cosine = near(Metric::Cosine);
+        assert_eq!(ids(&cosine), ["small", "big", "away"]);
+        assert_eq!(cosine[1].1, 0.8);
+        let dot = near(Metric::Dot);
+        assert_eq!(ids(&dot), ["big", "small", "away"]);
+        assert_eq!(dot[0].1, 4.0);
+        let euclidean = near(Metric::Euclidean);
+        assert_eq!(ids(&euclidean), ["small", "away", "big"]);
+        assert_eq!(euclidean[1].1, 2.0);
+        assert_eq!(Metric::parse("dot"), Some(Metric::Dot));
+    }
+
+    #[test]
+    fn normalizes_only_vectors_with_a_direction() {
+        let mut v = [3.0e20, 4.0e20];
+        assert!(normalize(&mut v));
+        assert_eq!(v, [0.6, 0.8]);
+        let mut zero = [0.0; 3];
+        assert!(!normalize(&mut zero));
+        let mut nan = [1.0, f32::NAN];
+        assert!(!normalize(&mut nan));
+        assert!(nan[1].is_nan());
+        assert!(!normalize(&mut []));
+    }
+
+    #[test]
+    fn dot_matches_a_plain_sum() {
+        let a: Vec<f32> = (0..19).map(|i| i as f32 * 0.5).collect();
+        let b: Vec<f32> = (0..19).map(|i| 3.0 - i as f32).collect();
+        let plain: f32 = a.iter().zip(&b).map(|(x, y)| x * y).sum();
+        assert!((dot(&a, &b) - plain).abs() < 1e-3);
+    }
+}
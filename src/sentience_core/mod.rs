@@ -2,6 +2,7 @@ pub mod ast;
 pub mod canonicalizer;
 pub mod executor;
 pub mod hasher;
+pub mod latent;
 pub mod parser;
 pub mod runtime;
 
@@ -92,7 +93,7 @@ mod symbolic_encoder {
         }
 
         // Normalize to unit length
-        normalize_vector(&mut embedding);
+        super::latent::normalize(&mut embedding);
         embedding
     }
 
@@ -110,15 +111,6 @@ mod symbolic_encoder {
         }
     }
 
-    fn normalize_vector(vec: &mut [f32]) {
-        let norm: f32 = vec.iter().map(|x| x * x).sum::<f32>().sqrt();
-        if norm > 0.0 {
-            for val in vec.iter_mut() {
-                *val /= norm;
-            }
-        }
-    }
-
     fn value_to_string(value: &Value) -> String {
         match value {
             Value::Str(s) => s.clone(),
@@ -1,4 +1,6 @@
+use crate::limits::{LimitError, Limits};
 use crate::sentience_core::ast::*;
+use crate::sentience_core::latent::LatentIndex;
 use std::collections::HashMap;
 
 /// Execution result from Sentience Core
@@ -88,24 +90,50 @@ impl TokenRef {
 /// In-memory Cortex implementation for testing
 pub struct InMemoryCortex {
     tokens: HashMap<String, SentienceToken>,
+    /// Token embeddings, for `recall_similar`.
+    latent: LatentIndex,
     edges: HashMap<String, Edge>,
     stm_window: Vec<String>,
     max_stm_size: usize,
+    /// Most vectors `latent` may hold; see [`Limits`](crate::limits::Limits).
+    max_vectors: Option<usize>,
 }
 
 impl InMemoryCortex {
     pub fn new(max_stm_size: usize) -> Self {
         Self {
             tokens: HashMap::new(),
+            latent: LatentIndex::new(),
             edges: HashMap::new(),
             stm_window: Vec::new(),
             max_stm_size,
+            max_vectors: None,
         }
     }
+
+    /// Dimensions of the stored embeddings with how many there are; see
+    /// [`LatentIndex::dimensions`].
+    pub fn vector_dimensions(&self) -> Vec<(usize, usize)> {
+        self.latent.dimensions()
+    }
+
+    /// Refuse to commit new tokens once `max` embeddings are stored.
+    pub fn with_max_vectors(mut self, max: usize) -> Self {
+        self.max_vectors = Some(max);
+        self
+    }
 }
 
 impl Cortex for InMemoryCortex {
     fn commit(&mut self, token: &SentienceToken, edges: &[Edge]) -> Result<String, String> {
+        if let Some(limit) = self.max_vectors {
+            if self.latent.len() >= limit && !self.tokens.contains_key(&token.id) {
+                return Err(LimitError::LatentVectors { limit }.to_string());
+            }
+        }
+        self.latent
+            .insert(&token.id, &token.embedding)
+            .map_err(|e| e.to_string())?;
         // Store token
         self.tokens.insert(token.id.clone(), token.clone());
 
@@ -124,23 +152,16 @@ impl Cortex for InMemoryCortex {
     }
 
     fn recall_similar(&self, vec: &[f32], k: usize) -> Vec<TokenRef> {
-        // Simple cosine similarity for now
-        let mut similarities: Vec<(String, f32)> = Vec::new();
-
-        for (id, token) in &self.tokens {
-            let similarity = cosine_similarity(vec, &token.embedding);
-            similarities.push((id.clone(), similarity));
-        }
-
-        // Sort by similarity and take top k
-        similarities.sort_by(|a, b| b.1.partial_cmp(&a.1).unwrap());
-
-        similarities
+        self.latent
+            .nearest(vec, k)
             .into_iter()
-            .take(k)
             .map(|(id, _)| {
-                let token = &self.tokens[&id];
-                TokenRef::new(id, token.ast.ttype.clone(), token.embedding.clone())
+                let token = &self.tokens[id];
+                TokenRef::new(
+                    id.to_string(),
+                    token.ast.ttype.clone(),
+                    token.embedding.clone(),
+                )
             })
             .collect()
     }
@@ -214,6 +235,14 @@ impl SimpleRuntime {
             superego: StubSuperego,
         }
     }
+
+    /// Apply [`Limits::max_latent_vectors`] to the cortex.
+    pub fn with_limits(mut self, limits: &Limits) -> Self {
+        if let Some(max) = limits.max_latent_vectors {
+            self.cortex = self.cortex.with_max_vectors(max);
+        }
+        self
+    }
 }
 
 impl Runtime for SimpleRuntime {
@@ -229,19 +258,3 @@ impl Runtime for SimpleRuntime {
         &self.superego
     }
 }
-
-fn cosine_similarity(a: &[f32], b: &[f32]) -> f32 {
-    if a.len() != b.len() {
-        return 0.0;
-    }
-
-    let dot_product: f32 = a.iter().zip(b.iter()).map(|(x, y)| x * y).sum();
-    let norm_a: f32 = a.iter().map(|x| x * x).sum::<f32>().sqrt();
-    let norm_b: f32 = b.iter().map(|x| x * x).sum::<f32>().sqrt();
-
-    if norm_a == 0.0 || norm_b == 0.0 {
-        0.0
-    } else {
-        dot_product / (norm_a * norm_b)
-    }
-}
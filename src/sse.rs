@@ -0,0 +1,148 @@
+//! Server-sent events stream of agent activity, so a web page can follow
+//! an agent with a plain `EventSource` instead of a WebSocket.
+//!
+//! Each [`AgentEvent`] becomes one SSE message named after the event, with
+//! the same JSON payload webhooks receive.
+
+use crate::events::AgentEvent;
+use crate::httpd;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::mpsc::{self, Sender};
+use std::sync::{Arc, Mutex};
+
+/// How long browsers wait before reconnecting, in milliseconds.
+const RETRY_MS: u64 = 3000;
+
+/// Fans events out to every connected client. Clones share the clients.
+#[derive(Clone, Default)]
+pub struct EventHub {
+    clients: Arc<Mutex<Vec<Sender<Vec<u8>>>>>,
+    next_id: Arc<AtomicU64>,
+}
+
+impl EventHub {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Number of connected clients.
+    pub fn clients(&self) -> usize {
+        self.clients.lock().map(|c| c.len()).unwrap_or(0)
+    }
+
+    /// Open a stream for a new client.
+    pub fn subscribe(&self) -> httpd::Response {
+        let (sender, receiver) = mpsc::channel();
+        if let Ok(mut clients) = self.clients.lock() {
+            clients.push(sender);
+        }
+        httpd::Response::stream(
+            "text/event-stream",
+            format!("retry: {}\n\n", RETRY_MS),
+            receiver,
+            b": keep-alive\n\n",
+        )
+    }
+
+    /// Send `event` of `agent` to every client, forgetting closed ones.
+    pub fn publish(&self, agent: &str, event: &AgentEvent) {
+        let id = self.next_id.fetch_add(1, Ordering::Relaxed) + 1;
+        let message = format!(
+            "id: {}\nevent: {}\ndata: {}\n\n",
+            id,
+            event.name(),
+            event.payload(agent)
+        )
+        .into_bytes();
+        if let Ok(mut clients) = self.clients.lock() {
+            clients.retain(|client| client.send(message.clone()).is_ok());
+        }
+    }
+
+    /// Callback for [`SentienceAgent::on_event`](crate::SentienceAgent::on_event).
+    pub fn sink(&self) -> impl FnMut(&str, &AgentEvent) + Send + 'static {
+        let hub = self.clone();
+        move |agent, event| hub.publish(agent, event)
+    }
+
+    /// HTTP handler serving the stream at `GET /events`.
+    pub fn handler(&self) -> Arc<httpd::Handler> {
+        let hub = self.clone();
+        Arc::new(move |request: &httpd::Request| {
+            match (request.method.as_str(), request.path.as_str()) {
+                ("GET", "/events") => hub.subscribe(),
+                (_, "/events") => httpd::Response::text(405, "method not allowed\n"),
+                _ => httpd::Response::not_found(),
+            }
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::io::{BufRead, BufReader, Write};
+    use std::net::TcpStream;
+
+    #[test]
+    fn streams_events_to_clients() {
+        let hub = EventHub::new();
+        let addr = httpd::spawn("127.0.0.1:0", hub.handler()).unwrap();
+        let mut stream = TcpStream::connect(addr).unwrap();
+        write!(stream, "GET /events HTTP/1.1\r\nHost: test\r\n\r\n").unwrap();
+        let mut reader = BufReader::new(stream);
+        let mut read_block = || {
+            let mut lines = Vec::new();
+            loop {
+                let mut line = String::new();
+                reader.read_line(&mut line).unwrap();
+                let line = line.trim_end().to_string();
+                if line.is_empty() {
+                    return lines;
+                }
+                lines.push(line);
+            }
+        };
+
+        let headers = read_block();
+        assert_eq!(headers[0], "HTTP/1.1 200 OK");
+        assert!(headers.contains(&"Content-Type: text/event-stream".to_string()));
+        assert!(!headers.iter().any(|h| h.starts_with("Content-Length")));
+        assert_eq!(read_block(), ["retry: 3000"]);
+        assert_eq!(hub.clients(), 1);
+
+        let mut sink = hub.sink();
+        sink(
+            "Echo",
+            &AgentEvent::ResponseProduced {
+                handler: "input".to_string(),
+                input: "hi".to_string(),
+                output: "line one\nline two".to_string(),
+            },
+        );
+        let message = read_block();
+        assert_eq!(message[..2], ["id: 1", "event: response_produced"]);
+        assert_eq!(message.len(), 3);
+        let data: serde_json::Value =
+            serde_json::from_str(message[2].strip_prefix("data: ").unwrap()).unwrap();
+        assert_eq!(data["agent"], "Echo");
+        assert_eq!(data["output"], "line one\nline two");
+
+        drop(reader);
+        // The closed client is noticed on the next publish.
+        for _ in 0..50 {
+            hub.publish(
+                "Echo",
+                &AgentEvent::GoalAchieved {
+                    goal: String::new(),
+                    value: "yes".to_string(),
+                },
+            );
+            if hub.clients() == 0 {
+                return;
+            }
+            std::thread::sleep(std::time::Duration::from_millis(20));
+        }
+        panic!("closed client was not removed");
+    }
+}
@@ -0,0 +1,101 @@
+//! The standard library: modules shipped inside the binary that a program
+//! brings in with `import std/<name>`, so it can start from a working agent
+//! rather than a blank file.
+//!
+//! Importing a module runs its statements where the `import` stands: its
+//! templates become known and its agents are registered as if they were
+//! declared there. The sources are in `std/` at the root of the repository.
+
+use crate::embedded::EmbeddedProgram;
+use crate::types::Statement;
+
+/// Prefix of the modules in the standard library.
+pub const PREFIX: &str = "std/";
+
+static MODULES: [EmbeddedProgram; 3] = [
+    EmbeddedProgram::new("std/conversation", include_str!("../std/conversation.sent")),
+    EmbeddedProgram::new("std/summarizer", include_str!("../std/summarizer.sent")),
+    EmbeddedProgram::new("std/text", include_str!("../std/text.sent")),
+];
+
+/// Every module of the standard library, by name.
+pub fn modules() -> &'static [EmbeddedProgram] {
+    &MODULES
+}
+
+/// The module called `name`, such as `std/text`.
+pub fn get(name: &str) -> Option<&'static EmbeddedProgram> {
+    MODULES.iter().find(|module| module.name() == name)
+}
+
+/// Names of the agents `module` declares.
+pub fn agents(module: &EmbeddedProgram) -> impl Iterator<Item = &str> {
+    module
+        .program()
+        .statements
+        .iter()
+        .filter_map(|stmt| match stmt {
+            Statement::AgentDeclaration { name, .. } => Some(name.as_str()),
+            _ => None,
+        })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyze::analyze;
+    use crate::replkit::Repl;
+    use crate::typecheck;
+
+    #[test]
+    fn modules_parse_and_check_clean() {
+        for module in modules() {
+            assert!(module.name().starts_with(PREFIX));
+            let program = module.program();
+            let diagnostics: Vec<String> = analyze(program)
+                .into_iter()
+                .chain(typecheck::check(program))
+                .map(|d| d.to_string())
+                .collect();
+            assert!(
+                diagnostics.is_empty(),
+                "{}: {:?}",
+                module.name(),
+                diagnostics
+            );
+        }
+        assert_eq!(
+            agents(get("std/conversation").unwrap()).collect::<Vec<_>>(),
+            ["Conversation"]
+        );
+        assert!(get("std/missing").is_none());
+    }
+
+    #[test]
+    fn import_declares_templates_and_agents() {
+        let mut out = Vec::new();
+        let mut repl = Repl::new(&b""[..], &mut out);
+        repl.eval_source(concat!(
+            "import std/text\n",
+            "import std/summarizer\n",
+            "agent Echo {\n",
+            "  on input(msg) {\n",
+            "    print quote(text: msg)\n",
+            "  }\n",
+            "}\n",
+            "import std/nothing\n",
+        ))
+        .unwrap();
+        repl.handle_command(".input hi").unwrap();
+        drop(repl);
+        let out = String::from_utf8(out).unwrap();
+        assert!(out.contains("Agent: Summarizer [registered]\n"), "{}", out);
+        assert!(out.contains("Agent: Echo [registered]\n"), "{}", out);
+        assert!(
+            out.contains("Error[SEN4013]: in import: unknown module `std/nothing`"),
+            "{}",
+            out
+        );
+        assert!(out.ends_with("  \"hi\"\n"), "{}", out);
+    }
+}
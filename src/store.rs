@@ -0,0 +1,301 @@
+//! Long-term memory kept on disk as it is written, so it survives restarts
+//! without a `.save`.
+//!
+//! A [`MemoryStore`] attached with
+//! [`AgentContext::attach_store`](crate::context::AgentContext::attach_store)
+//! fills `mem.long` from what it holds and is then written through: every
+//! change to `mem.long` is stored before the statement making it finishes,
+//! and loading or restoring memory replaces what is stored. The vectors
+//! `recall` searches are remade from the stored entries, and those `embed`
+//! wrote are stored like any other value.
+//!
+//! [`FileStore`] keeps the entries in a JSON Lines log, one write or
+//! deletion per line, which `--store <path>` opens. Opening a log with more
+//! superseded lines than live ones rewrites it with just the live entries,
+//! and a last line cut short by a crash is ignored.
+
+use crate::error::MemoryError;
+use crate::expr::Value;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fmt;
+use std::fs::{self, File, OpenOptions};
+use std::io::{self, BufRead, BufReader, Write};
+use std::ops::{Deref, DerefMut};
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+
+/// Lines a log may have before superseded ones are worth rewriting away.
+const COMPACT_AFTER: usize = 1024;
+
+/// Where long-term memory is kept between runs.
+pub trait MemoryStore: Send + Sync {
+    /// Every stored entry.
+    fn load(&self) -> Result<HashMap<String, Value>, MemoryError>;
+    fn put(&self, key: &str, value: &Value) -> Result<(), MemoryError>;
+    fn delete(&self, key: &str) -> Result<(), MemoryError>;
+    /// Store exactly `entries`, dropping everything else.
+    fn replace(&self, entries: &HashMap<String, Value>) -> Result<(), MemoryError>;
+}
+
+impl fmt::Debug for dyn MemoryStore {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("MemoryStore")
+    }
+}
+
+/// The store, if any, a context writes long-term memory through to. A
+/// clone starts detached, so a what-if copy stores nothing until
+/// [`AgentContext::commit`](crate::context::AgentContext::commit) takes its
+/// memory back.
+#[derive(Debug, Default)]
+pub struct Attached(Option<Arc<dyn MemoryStore>>);
+
+impl Clone for Attached {
+    fn clone(&self) -> Self {
+        Self(None)
+    }
+}
+
+impl Deref for Attached {
+    type Target = Option<Arc<dyn MemoryStore>>;
+
+    fn deref(&self) -> &Self::Target {
+        &self.0
+    }
+}
+
+impl DerefMut for Attached {
+    fn deref_mut(&mut self) -> &mut Self::Target {
+        &mut self.0
+    }
+}
+
+/// One line of a [`FileStore`] log: a write, or a deletion when `value` is
+/// absent.
+#[derive(Serialize, Deserialize)]
+struct Record {
+    key: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    value: Option<Value>,
+}
+
+/// Entries in an append-only JSON Lines file.
+pub struct FileStore {
+    path: PathBuf,
+    log: Mutex<Log>,
+}
+
+struct Log {
+    file: File,
+    /// Lines in the file.
+    lines: usize,
+}
+
+impl FileStore {
+    /// Open the log at `path`, creating it if it does not exist.
+    pub fn open(path: impl AsRef<Path>) -> Result<Self, MemoryError> {
+        let path = path.as_ref().to_path_buf();
+        let (entries, lines) = read(&path)?;
+        let store = Self {
+            log: Mutex::new(Log {
+                file: append(&path)?,
+                lines,
+            }),
+            path,
+        };
+        if lines > COMPACT_AFTER && lines > 2 * entries.len() {
+            store.replace(&entries)?;
+        }
+        Ok(store)
+    }
+
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    fn append(&self, record: &Record) -> Result<(), MemoryError> {
+        let mut line = serde_json::to_vec(record)?;
+        line.push(b'\n');
+        let mut log = self.log.lock().unwrap_or_else(|e| e.into_inner());
+        log.file.write_all(&line)?;
+        log.lines += 1;
+        Ok(())
+    }
+}
+
+impl MemoryStore for FileStore {
+    fn load(&self) -> Result<HashMap<String, Value>, MemoryError> {
+        read(&self.path).map(|(entries, _)| entries)
+    }
+
+    fn put(&self, key: &str, value: &Value) -> Result<(), MemoryError> {
+        self.append(&Record {
+            key: key.to_string(),
+            value: Some(value.clone()),
+        })
+    }
+
+    fn delete(&self, key: &str) -> Result<(), MemoryError> {
+        self.append(&Record {
+            key: key.to_string(),
+            value: None,
+        })
+    }
+
+    /// Write `entries` to a new file, sorted by key, and move it over the
+    /// log, so a crash leaves either the old log or the new one.
+    fn replace(&self, entries: &HashMap<String, Value>) -> Result<(), MemoryError> {
+        let mut sorted: Vec<_> = entries.iter().collect();
+        sorted.sort_by(|a, b| a.0.cmp(b.0));
+        let mut text = Vec::new();
+        for (key, value) in &sorted {
+            serde_json::to_writer(
+                &mut text,
+                &Record {
+                    key: key.to_string(),
+                    value: Some((*value).clone()),
+                },
+            )?;
+            text.push(b'\n');
+        }
+        let mut log = self.log.lock().unwrap_or_else(|e| e.into_inner());
+        let fresh = self.path.with_extension("compacting");
+        let mut file = File::create(&fresh)?;
+        file.write_all(&text)?;
+        file.sync_all()?;
+        fs::rename(&fresh, &self.path)?;
+        *log = Log {
+            file: append(&self.path)?,
+            lines: sorted.len(),
+        };
+        Ok(())
+    }
+}
+
+fn append(path: &Path) -> io::Result<File> {
+    OpenOptions::new().create(true).append(true).open(path)
+}
+
+/// The entries of the log at `path` and how many lines it has; nothing if
+/// it does not exist yet.
+fn read(path: &Path) -> Result<(HashMap<String, Value>, usize), MemoryError> {
+    let file = match File::open(path) {
+        Ok(file) => file,
+        Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok((HashMap::new(), 0)),
+        Err(e) => return Err(e.into()),
+    };
+    let mut entries = HashMap::new();
+    let mut lines = BufReader::new(file).lines().enumerate().peekable();
+    let mut count = 0;
+    while let Some((number, line)) = lines.next() {
+        let line = line?;
+        if line.trim().is_empty() {
+            continue;
+        }
+        let record: Record = match serde_json::from_str(&line) {
+            Ok(record) => record,
+            // Cut short while being written.
+            Err(_) if lines.peek().is_none() => break,
+            Err(e) => {
+                return Err(MemoryError::Format(format!(
+                    "{} line {}: {}",
+                    path.display(),
+                    number + 1,
+                    e
+                )))
+            }
+        };
+        count += 1;
+        match record.value {
+            Some(value) => entries.insert(record.key, value),
+            None => entries.remove(&record.key),
+        };
+    }
+    Ok((entries, count))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::adapters::InputMessage;
+    use crate::context::AgentContext;
+    use crate::sandbox::Sandbox;
+    use crate::SentienceAgent;
+
+    #[test]
+    fn keeps_long_term_memory_across_contexts() {
+        let path = std::env::temp_dir().join(format!("store-{}.jsonl", std::process::id()));
+        let _ = fs::remove_file(&path);
+
+        let mut ctx = AgentContext::new();
+        ctx.set_mem("long", "before", "kept");
+        ctx.attach_store(Arc::new(FileStore::open(&path).unwrap()))
+            .unwrap();
+        ctx.set_mem("long", "city", "Novi Sad");
+        ctx.set_mem("long", "city", "Belgrade");
+        ctx.set_mem("long", "pet", "cat");
+        ctx.set_mem("short", "msg", "not stored");
+        ctx.remove_mem("long", "pet");
+        drop(ctx);
+        // A crash in the middle of a write.
+        let mut file = append(&path).unwrap();
+        file.write_all(br#"{"key":"half"#).unwrap();
+
+        let mut ctx = AgentContext::new();
+        ctx.attach_store(Arc::new(FileStore::open(&path).unwrap()))
+            .unwrap();
+        assert_eq!(ctx.get_mem("long", "city"), "Belgrade");
+        assert_eq!(ctx.get_mem("long", "before"), "kept");
+        assert_eq!(ctx.get_mem("long", "pet"), "");
+        assert_eq!(ctx.get_mem("short", "msg"), "");
+
+        let mut snapshot = ctx.snapshot();
+        snapshot.mem_long.remove("before");
+        ctx.restore(snapshot);
+        let store = FileStore::open(&path).unwrap();
+        let stored = store.load().unwrap();
+        assert_eq!(stored.len(), 1);
+        assert_eq!(stored["city"], "Belgrade".into());
+        fs::remove_file(&path).unwrap();
+    }
+
+    #[test]
+    fn stores_what_if_and_session_writes_only_where_they_belong() {
+        let path = std::env::temp_dir().join(format!("store-apart-{}.jsonl", std::process::id()));
+        let _ = fs::remove_file(&path);
+        let stored = || FileStore::open(&path).unwrap().load().unwrap();
+
+        let mut ctx = AgentContext::new();
+        ctx.attach_store(Arc::new(FileStore::open(&path).unwrap()))
+            .unwrap();
+        let mut what_if = ctx.clone();
+        what_if.set_mem("long", "plan", "maybe");
+        assert!(stored().is_empty());
+        ctx.commit(what_if);
+        assert_eq!(stored()["plan"], "maybe".into());
+
+        let dir = std::env::temp_dir().join(format!("store-notes-{}", std::process::id()));
+        fs::create_dir_all(&dir).unwrap();
+        fs::write(dir.join("note.txt"), "secret").unwrap();
+        let mut agent = SentienceAgent::new();
+        agent.set_sandbox(Sandbox {
+            workspace: Some(dir.clone()),
+            ..Sandbox::default()
+        });
+        agent
+            .run_sentience("agent Notes {\n    on input(msg) {\n        read \"note.txt\" -> mem.long[\"note\"]\n    }\n}")
+            .unwrap();
+        agent
+            .set_store(Arc::new(FileStore::open(&path).unwrap()))
+            .unwrap();
+        agent
+            .handle_session("alice", &InputMessage::new("hi"))
+            .unwrap();
+        assert!(!stored().contains_key("note"));
+        agent.handle_input("hi").unwrap();
+        assert_eq!(stored()["note"], "secret".into());
+        fs::remove_dir_all(&dir).unwrap();
+        fs::remove_file(&path).unwrap();
+    }
+}
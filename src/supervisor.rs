@@ -0,0 +1,293 @@
+//! Restarting agents that crash in a long-running `serve`.
+//!
+//! A handler that panics or goes over one of the [`Limits`](crate::limits::Limits)
+//! (a full memory region, too many events, a timeout) crashes its agent. The
+//! [`Supervisor`] of the agent then keeps it down for a backoff that doubles
+//! with each crash in a row, after which the server builds a fresh agent from
+//! the program. Other agents keep running meanwhile. Every restart is counted
+//! in the `sentience_agent_restarts_total` metric.
+
+use crate::config::SupervisorConfig;
+use crate::error::{MemoryError, RuntimeError, RuntimeErrorKind};
+use crate::limits;
+use crate::metrics;
+use std::any::Any;
+use std::fmt;
+use std::panic::{self, AssertUnwindSafe};
+use std::time::{Duration, Instant};
+
+/// When to restart a crashed agent.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub struct RestartPolicy {
+    /// Restarts in a row, without a handler succeeding in between, before
+    /// the agent is left stopped.
+    pub max_restarts: Option<u32>,
+    /// Wait before the first restart.
+    pub backoff: Duration,
+    /// Longest wait between restarts.
+    pub max_backoff: Duration,
+}
+
+impl Default for RestartPolicy {
+    fn default() -> Self {
+        Self {
+            max_restarts: None,
+            backoff: Duration::from_secs(1),
+            max_backoff: Duration::from_secs(60),
+        }
+    }
+}
+
+impl RestartPolicy {
+    pub fn from_config(config: &SupervisorConfig) -> Self {
+        let default = Self::default();
+        Self {
+            max_restarts: config.max_restarts,
+            backoff: config
+                .backoff_secs
+                .and_then(limits::seconds)
+                .unwrap_or(default.backoff),
+            max_backoff: config
+                .max_backoff_secs
+                .and_then(limits::seconds)
+                .unwrap_or(default.max_backoff),
+        }
+    }
+
+    /// Wait before restarting after the `crashes`-th crash in a row.
+    pub fn backoff(&self, crashes: u32) -> Duration {
+        let factor = 2u32.saturating_pow(crashes.saturating_sub(1));
+        self.backoff
+            .checked_mul(factor)
+            .unwrap_or(self.max_backoff)
+            .min(self.max_backoff)
+    }
+}
+
+/// Why an agent crashed.
+#[derive(Debug)]
+pub enum Crash {
+    /// Evaluation panicked, with the panic message.
+    Panic(String),
+    /// A handler went over a limit.
+    Limit(RuntimeError),
+}
+
+impl fmt::Display for Crash {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Crash::Panic(message) => write!(f, "panicked: {}", message),
+            Crash::Limit(e) => write!(f, "{}", e),
+        }
+    }
+}
+
+/// What a supervised call returned instead of a result.
+#[derive(Debug)]
+pub enum Failure {
+    /// The handler failed and the agent keeps running.
+    Error(RuntimeError),
+    /// The agent crashed and is down until restarted.
+    Crashed(Crash),
+}
+
+impl fmt::Display for Failure {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Failure::Error(e) => write!(f, "{}", e),
+            Failure::Crashed(crash) => write!(f, "crashed: {}", crash),
+        }
+    }
+}
+
+/// Whether `error` came from going over one of the limits.
+pub fn over_limit(error: &RuntimeError) -> bool {
+    matches!(
+        error.kind,
+        RuntimeErrorKind::Memory(MemoryError::Limit(_)) | RuntimeErrorKind::Timeout(_)
+    )
+}
+
+/// Crash and restart state of one agent.
+#[derive(Debug)]
+pub struct Supervisor {
+    name: String,
+    policy: RestartPolicy,
+    /// Crashes since a handler last succeeded.
+    crashes: u32,
+    restarts: u64,
+    /// When a crashed agent may be restarted; `None` while it runs.
+    restart_at: Option<Instant>,
+    gave_up: bool,
+}
+
+impl Supervisor {
+    /// Supervise the agent called `name`, which labels its metrics.
+    pub fn new(name: &str, policy: RestartPolicy) -> Self {
+        Self {
+            name: name.to_string(),
+            policy,
+            crashes: 0,
+            restarts: 0,
+            restart_at: None,
+            gave_up: false,
+        }
+    }
+
+    pub fn name(&self) -> &str {
+        &self.name
+    }
+
+    /// Times the agent was restarted.
+    pub fn restarts(&self) -> u64 {
+        self.restarts
+    }
+
+    /// Whether the agent is running rather than crashed.
+    pub fn is_up(&self) -> bool {
+        self.restart_at.is_none() && !self.gave_up
+    }
+
+    /// Whether the agent crashed more often than the policy restarts it.
+    pub fn gave_up(&self) -> bool {
+        self.gave_up
+    }
+
+    /// `up`, `restarting` or `stopped`, for status displays.
+    pub fn status(&self) -> &'static str {
+        if self.gave_up {
+            "stopped"
+        } else if self.is_up() {
+            "up"
+        } else {
+            "restarting"
+        }
+    }
+
+    /// Whether the agent is down and its backoff has passed.
+    pub fn due(&self, now: Instant) -> bool {
+        !self.gave_up && self.restart_at.is_some_and(|at| now >= at)
+    }
+
+    /// Run a handler. A panic or an error over a limit crashes the agent;
+    /// other errors leave it running.
+    pub fn run<T>(&mut self, f: impl FnOnce() -> Result<T, RuntimeError>) -> Result<T, Failure> {
+        let crash = match panic::catch_unwind(AssertUnwindSafe(f)) {
+            Ok(Ok(value)) => {
+                self.crashes = 0;
+                return Ok(value);
+            }
+            Ok(Err(e)) if !over_limit(&e) => return Err(Failure::Error(e)),
+            Ok(Err(e)) => Crash::Limit(e),
+            Err(payload) => Crash::Panic(panic_message(payload.as_ref())),
+        };
+        self.crashed(Instant::now());
+        Err(Failure::Crashed(crash))
+    }
+
+    /// Run something other than a handler, e.g. an API request, where only
+    /// a panic crashes the agent.
+    pub fn guard<T>(&mut self, f: impl FnOnce() -> T) -> Result<T, Crash> {
+        panic::catch_unwind(AssertUnwindSafe(f)).map_err(|payload| {
+            self.crashed(Instant::now());
+            Crash::Panic(panic_message(payload.as_ref()))
+        })
+    }
+
+    /// Record a crash at `now` and schedule the restart, if the policy
+    /// allows another.
+    pub fn crashed(&mut self, now: Instant) {
+        self.crashes += 1;
+        if self
+            .policy
+            .max_restarts
+            .is_some_and(|max| self.crashes > max)
+        {
+            self.gave_up = true;
+            self.restart_at = None;
+            return;
+        }
+        self.restart_at = Some(now + self.policy.backoff(self.crashes));
+    }
+
+    /// Record that the server replaced the crashed agent with a fresh one.
+    pub fn restarted(&mut self) {
+        self.restart_at = None;
+        self.restarts += 1;
+        metrics::global().agent_restarted(&self.name);
+    }
+}
+
+fn panic_message(payload: &(dyn Any + Send)) -> String {
+    payload
+        .downcast_ref::<&str>()
+        .map(|s| s.to_string())
+        .or_else(|| payload.downcast_ref::<String>().cloned())
+        .unwrap_or_else(|| "unknown cause".to_string())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::limits::LimitError;
+
+    #[test]
+    fn doubles_the_backoff_up_to_the_maximum() {
+        let policy = RestartPolicy {
+            max_restarts: None,
+            backoff: Duration::from_secs(1),
+            max_backoff: Duration::from_secs(10),
+        };
+        let waits: Vec<u64> = (1..=6).map(|n| policy.backoff(n).as_secs()).collect();
+        assert_eq!(waits, [1, 2, 4, 8, 10, 10]);
+        assert_eq!(policy.backoff(200), Duration::from_secs(10));
+    }
+
+    #[test]
+    fn restarts_after_panics_and_limits_until_the_policy_gives_up() {
+        let policy = RestartPolicy {
+            max_restarts: Some(2),
+            backoff: Duration::from_secs(1),
+            max_backoff: Duration::from_secs(60),
+        };
+        let mut supervisor = Supervisor::new("Echo", policy);
+        let missing = || RuntimeError::new(RuntimeErrorKind::MissingHandler("train".into()));
+        assert!(matches!(
+            supervisor.run(|| Err::<(), _>(missing())),
+            Err(Failure::Error(_))
+        ));
+        assert!(supervisor.is_up());
+
+        let crashed = supervisor.run::<()>(|| panic!("boom"));
+        assert!(matches!(crashed, Err(Failure::Crashed(Crash::Panic(m))) if m == "boom"));
+        assert!(!supervisor.is_up());
+        let now = Instant::now();
+        assert!(!supervisor.due(now));
+        assert!(supervisor.due(now + Duration::from_secs(1)));
+        supervisor.restarted();
+        assert!(supervisor.is_up());
+
+        let full = LimitError::Events { limit: 1 };
+        let crashed =
+            supervisor.run::<()>(|| Err(RuntimeError::new(RuntimeErrorKind::Memory(full.into()))));
+        assert!(matches!(crashed, Err(Failure::Crashed(Crash::Limit(_)))));
+        assert!(supervisor.due(Instant::now() + Duration::from_secs(2)));
+        supervisor.restarted();
+        assert_eq!(supervisor.restarts(), 2);
+
+        assert!(supervisor.guard(|| panic!("again")).is_err());
+        assert!(supervisor.gave_up());
+        assert!(!supervisor.due(Instant::now() + Duration::from_secs(3600)));
+    }
+
+    #[test]
+    fn a_success_resets_the_backoff() {
+        let mut supervisor = Supervisor::new("Echo", RestartPolicy::default());
+        let now = Instant::now();
+        supervisor.crashed(now);
+        supervisor.restarted();
+        supervisor.run(|| Ok(())).unwrap();
+        supervisor.crashed(now);
+        assert!(supervisor.due(now + Duration::from_secs(1)));
+    }
+}
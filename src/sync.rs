@@ -0,0 +1,457 @@
+//! Two-way sync of long-term memory with a Qdrant collection, so several
+//! agent instances share what each of them learns.
+//!
+//! Every entry in the collection carries the time it was written and the
+//! instance that wrote it. Conflicting writes to the same key are resolved
+//! by last writer wins, with the instance name breaking ties. A local change
+//! counts as written when the sync that pushes it starts, except on an
+//! instance's first sync, where memory set up before joining yields to what
+//! the collection already holds.
+
+use crate::config::{env_or, SyncConfig};
+use crate::context::AgentContext;
+use crate::expr;
+use crate::sentience_core::latent;
+use crate::text;
+use serde::{Deserialize, Serialize};
+use serde_json::{json, Value};
+use sha2::{Digest, Sha256};
+use std::collections::HashMap;
+use std::fmt;
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+const DEFAULT_COLLECTION: &str = "sentience";
+const DEFAULT_INTERVAL_SECS: u64 = 30;
+/// Entries written up to this long before the last pull are read again, in
+/// case the writer's clock is behind ours.
+const CLOCK_SKEW_MS: u64 = 5_000;
+/// Dimensions of the vectors stored alongside entries.
+pub const VECTOR_SIZE: usize = 64;
+const PAGE_SIZE: usize = 256;
+
+#[derive(Debug)]
+pub enum SyncError {
+    /// The store could not be reached.
+    Http(String),
+    Api {
+        status: u16,
+        message: String,
+    },
+    Decode(String),
+}
+
+impl fmt::Display for SyncError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            SyncError::Http(msg) => write!(f, "sync request failed: {}", msg),
+            SyncError::Api { status, message } => {
+                write!(f, "vector store returned {}: {}", status, message)
+            }
+            SyncError::Decode(msg) => write!(f, "unexpected vector store response: {}", msg),
+        }
+    }
+}
+
+impl std::error::Error for SyncError {}
+
+/// A long-term memory entry as stored remotely.
+#[derive(Clone, Debug, PartialEq, Serialize, Deserialize)]
+pub struct SharedEntry {
+    pub key: String,
+    pub value: expr::Value,
+    /// Milliseconds since the Unix epoch.
+    pub updated_ms: u64,
+    /// Instance that wrote the entry.
+    pub origin: String,
+}
+
+impl SharedEntry {
+    /// Whether this write supersedes one made at `updated_ms` by `origin`.
+    fn newer_than(&self, updated_ms: u64, origin: &str) -> bool {
+        (self.updated_ms, self.origin.as_str()) > (updated_ms, origin)
+    }
+}
+
+/// Where shared entries are kept.
+pub trait SharedStore: Send {
+    /// Insert or replace entries by key.
+    fn push(&self, entries: &[SharedEntry]) -> Result<(), SyncError>;
+    /// Entries written after `since_ms`.
+    fn changed_since(&self, since_ms: u64) -> Result<Vec<SharedEntry>, SyncError>;
+}
+
+/// A collection in Qdrant, accessed through its REST API. Each entry is a
+/// point whose id is derived from the key and whose vector is
+/// [`embed`] of the key and value, so the collection can also be searched.
+pub struct QdrantStore {
+    url: String,
+    api_key: Option<String>,
+    collection: String,
+    client: reqwest::blocking::Client,
+}
+
+impl QdrantStore {
+    /// Open `collection`, creating it if it does not exist.
+    pub fn connect(
+        url: &str,
+        api_key: Option<String>,
+        collection: &str,
+    ) -> Result<Self, SyncError> {
+        let store = Self {
+            url: url.trim_end_matches('/').to_string(),
+            api_key,
+            collection: collection.to_string(),
+            client: reqwest::blocking::Client::builder()
+                .timeout(Duration::from_secs(30))
+                .build()
+                .map_err(|e| SyncError::Http(e.to_string()))?,
+        };
+        let path = format!("/collections/{}", store.collection);
+        match store.request(reqwest::Method::GET, &path, None) {
+            Ok(_) => {}
+            Err(SyncError::Api { status: 404, .. }) => {
+                let body = json!({ "vectors": { "size": VECTOR_SIZE, "distance": "Cosine" } });
+                store.request(reqwest::Method::PUT, &path, Some(body))?;
+            }
+            Err(e) => return Err(e),
+        }
+        Ok(store)
+    }
+
+    fn request(
+        &self,
+        method: reqwest::Method,
+        path: &str,
+        body: Option<Value>,
+    ) -> Result<Value, SyncError> {
+        let mut builder = self.client.request(method, format!("{}{}", self.url, path));
+        if let Some(key) = &self.api_key {
+            builder = builder.header("api-key", key);
+        }
+        if let Some(body) = body {
+            builder = builder.json(&body);
+        }
+        let response = builder.send().map_err(|e| SyncError::Http(e.to_string()))?;
+        let status = response.status();
+        if !status.is_success() {
+            return Err(SyncError::Api {
+                status: status.as_u16(),
+                message: response.text().unwrap_or_default(),
+            });
+        }
+        response
+            .json()
+            .map_err(|e| SyncError::Decode(e.to_string()))
+    }
+}
+
+impl SharedStore for QdrantStore {
+    fn push(&self, entries: &[SharedEntry]) -> Result<(), SyncError> {
+        if entries.is_empty() {
+            return Ok(());
+        }
+        let points: Vec<Value> = entries
+            .iter()
+            .map(|entry| {
+                json!({
+                    "id": point_id(&entry.key),
+                    "vector": embed(&format!("{} {}", entry.key, entry.value)),
+                    "payload": entry,
+                })
+            })
+            .collect();
+        self.request(
+            reqwest::Method::PUT,
+            &format!("/collections/{}/points?wait=true", self.collection),
+            Some(json!({ "points": points })),
+        )?;
+        Ok(())
+    }
+
+    fn changed_since(&self, since_ms: u64) -> Result<Vec<SharedEntry>, SyncError> {
+        let path = format!("/collections/{}/points/scroll", self.collection);
+        let mut entries = Vec::new();
+        let mut offset = Value::Null;
+        loop {
+            let reply = self.request(
+                reqwest::Method::POST,
+                &path,
+                Some(json!({
+                    "filter": { "must": [{ "key": "updated_ms", "range": { "gt": since_ms } }] },
+                    "limit": PAGE_SIZE,
+                    "with_payload": true,
+                    "with_vector": false,
+                    "offset": offset,
+                })),
+            )?;
+            let points = reply["result"]["points"]
+                .as_array()
+                .ok_or_else(|| SyncError::Decode("missing result.points".to_string()))?;
+            for point in points {
+                entries.push(
+                    serde_json::from_value(point["payload"].clone())
+                        .map_err(|e| SyncError::Decode(e.to_string()))?,
+                );
+            }
+            offset = reply["result"]["next_page_offset"].clone();
+            if offset.is_null() {
+                return Ok(entries);
+            }
+        }
+    }
+}
+
+/// What one [`MemorySync::sync`] did.
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+pub struct SyncReport {
+    pub pushed: usize,
+    pub pulled: usize,
+    /// Keys changed both here and remotely since the last sync.
+    pub conflicts: usize,
+}
+
+/// Last synced version of a key.
+struct Version {
+    value: expr::Value,
+    updated_ms: u64,
+    origin: String,
+}
+
+pub struct MemorySync {
+    store: Box<dyn SharedStore>,
+    instance: String,
+    interval: Duration,
+    last_run: Option<Instant>,
+    synced: HashMap<String, Version>,
+    /// Newest remote write seen so far.
+    pulled_until: u64,
+}
+
+impl MemorySync {
+    pub fn new(store: Box<dyn SharedStore>, instance: &str, interval: Duration) -> Self {
+        Self {
+            store,
+            instance: instance.to_string(),
+            interval,
+            last_run: None,
+            synced: HashMap::new(),
+            pulled_until: 0,
+        }
+    }
+
+    /// Sync against the Qdrant collection in `config`, or `None` when no URL
+    /// is configured.
+    pub fn configured(config: &SyncConfig) -> Result<Option<Self>, String> {
+        let Some(url) = env_or("SENTIENCE_SYNC_URL", config.url.as_ref()) else {
+            return Ok(None);
+        };
+        let collection = config.collection.as_deref().unwrap_or(DEFAULT_COLLECTION);
+        let store = QdrantStore::connect(
+            &url,
+            env_or("QDRANT_API_KEY", config.api_key.as_ref()),
+            collection,
+        )
+        .map_err(|e| format!("{}: {}", url, e))?;
+        let instance = config.instance.clone().unwrap_or_else(default_instance);
+        let interval =
+            Duration::from_secs(config.interval_secs.unwrap_or(DEFAULT_INTERVAL_SECS).max(1));
+        Ok(Some(Self::new(Box::new(store), &instance, interval)))
+    }
+
+    /// Whether the interval has passed since the last sync (or there has
+    /// been none).
+    pub fn is_due(&self) -> bool {
+        self.last_run
+            .map_or(true, |last| last.elapsed() >= self.interval)
+    }
+
+    /// Pull remote changes into `ctx.mem_long`, then push local ones.
+    pub fn sync(&mut self, ctx: &mut AgentContext) -> Result<SyncReport, SyncError> {
+        let _span = tracing::debug_span!("memory.sync", instance = %self.instance).entered();
+        let now = now_ms();
+        // Before the first sync, local memory is whatever the program set up
+        // and loses to anything already shared.
+        let local_ms = if self.last_run.is_none() { 0 } else { now };
+        self.last_run = Some(Instant::now());
+        let mut report = SyncReport::default();
+
+        let mut remote = self
+            .store
+            .changed_since(self.pulled_until.saturating_sub(CLOCK_SKEW_MS))?;
+        remote.sort_by_key(|entry| entry.updated_ms);
+        for entry in remote {
+            self.pulled_until = self.pulled_until.max(entry.updated_ms);
+            if let Some(synced) = self.synced.get(&entry.key) {
+                if !entry.newer_than(synced.updated_ms, &synced.origin) {
+                    continue;
+                }
+            }
+            let local = ctx.mem_long.get(entry.key.as_str());
+            let changed_locally =
+                local.is_some() && local != self.synced.get(&entry.key).map(|v| &v.value);
+            if changed_locally && local != Some(&entry.value) {
+                report.conflicts += 1;
+                if !entry.newer_than(local_ms, &self.instance) {
+                    continue;
+                }
+            }
+            if local != Some(&entry.value) {
+                ctx.set_value("long", &entry.key, entry.value.clone());
+                report.pulled += 1;
+            }
+            self.synced.insert(
+                entry.key,
+                Version {
+                    value: entry.value,
+                    updated_ms: entry.updated_ms,
+                    origin: entry.origin,
+                },
+            );
+        }
+
+        let mut changes: Vec<SharedEntry> = ctx
+            .mem_long
+            .iter()
+            .filter(|(key, value)| self.synced.get(&***key).map(|v| &v.value) != Some(*value))
+            .map(|(key, value)| SharedEntry {
+                key: key.to_string(),
+                value: value.clone(),
+                updated_ms: now,
+                origin: self.instance.clone(),
+            })
+            .collect();
+        changes.sort_by(|a, b| a.key.cmp(&b.key));
+        self.store.push(&changes)?;
+        report.pushed = changes.len();
+        for entry in changes {
+            self.synced.insert(
+                entry.key,
+                Version {
+                    value: entry.value,
+                    updated_ms: entry.updated_ms,
+                    origin: entry.origin,
+                },
+            );
+        }
+        tracing::debug!(
+            pushed = report.pushed,
+            pulled = report.pulled,
+            conflicts = report.conflicts,
+            "memory synced"
+        );
+        Ok(report)
+    }
+}
+
+/// A bag-of-words vector of `text`: each [folded](text::fold) word is hashed
+/// into one of [`VECTOR_SIZE`] buckets, and the result is normalized. Crude, but
+/// deterministic and enough to find entries sharing words.
+pub fn embed(text: &str) -> Vec<f32> {
+    let mut vector = vec![0f32; VECTOR_SIZE];
+    for word in text::words(text) {
+        let digest = Sha256::digest(word.as_bytes());
+        let bucket = u16::from_le_bytes([digest[0], digest[1]]) as usize % VECTOR_SIZE;
+        let sign = if digest[2] & 1 == 0 { 1.0 } else { -1.0 };
+        vector[bucket] += sign;
+    }
+    if !latent::normalize(&mut vector) {
+        // Cosine distance is undefined for the zero vector.
+        vector[0] = 1.0;
+    }
+    vector
+}
+
+/// Qdrant point id for `key`.
+fn point_id(key: &str) -> u64 {
+    let digest = Sha256::digest(key.as_bytes());
+    u64::from_le_bytes(digest[..8].try_into().expect("digest is 32 bytes"))
+}
+
+fn default_instance() -> String {
+    let host = std::env::var("HOSTNAME")
+        .ok()
+        .or_else(|| std::fs::read_to_string("/etc/hostname").ok())
+        .map(|h| h.trim().to_string())
+        .filter(|h| !h.is_empty())
+        .unwrap_or_else(|| "localhost".to_string());
+    format!("{}:{}", host, std::process::id())
+}
+
+fn now_ms() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_millis() as u64)
+        .unwrap_or(0)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::{Arc, Mutex};
+
+    /// A store shared by the instances of a test.
+    #[derive(Clone, Default)]
+    struct Shared(Arc<Mutex<HashMap<String, SharedEntry>>>);
+
+    impl SharedStore for Shared {
+        fn push(&self, entries: &[SharedEntry]) -> Result<(), SyncError> {
+            let mut map = self.0.lock().unwrap();
+            for entry in entries {
+                map.insert(entry.key.clone(), entry.clone());
+            }
+            Ok(())
+        }
+
+        fn changed_since(&self, since_ms: u64) -> Result<Vec<SharedEntry>, SyncError> {
+            let map = self.0.lock().unwrap();
+            Ok(map
+                .values()
+                .filter(|e| e.updated_ms > since_ms)
+                .cloned()
+                .collect())
+        }
+    }
+
+    fn instance(store: &Shared, name: &str) -> MemorySync {
+        MemorySync::new(Box::new(store.clone()), name, Duration::ZERO)
+    }
+
+    #[test]
+    fn shares_memory_between_instances() {
+        let store = Shared::default();
+        let (mut a, mut b) = (instance(&store, "a"), instance(&store, "b"));
+        let (mut ctx_a, mut ctx_b) = (AgentContext::new(), AgentContext::new());
+
+        ctx_a.set_mem("long", "capital", "Paris");
+        a.sync(&mut ctx_a).unwrap();
+        // b's program default yields to what a already shared.
+        ctx_b.set_mem("long", "capital", "unknown");
+        ctx_b.set_mem("long", "river", "Seine");
+        let report = b.sync(&mut ctx_b).unwrap();
+        assert_eq!((report.pulled, report.pushed, report.conflicts), (1, 1, 1));
+        assert_eq!(ctx_b.get_mem("long", "capital"), "Paris");
+
+        a.sync(&mut ctx_a).unwrap();
+        assert_eq!(ctx_a.get_mem("long", "river"), "Seine");
+
+        // Later local changes win over older remote ones.
+        ctx_b.set_mem("long", "capital", "Lyon");
+        b.sync(&mut ctx_b).unwrap();
+        ctx_a.set_mem("long", "capital", "Marseille");
+        std::thread::sleep(Duration::from_millis(2));
+        let report = a.sync(&mut ctx_a).unwrap();
+        assert_eq!(report.conflicts, 1);
+        assert_eq!(ctx_a.get_mem("long", "capital"), "Marseille");
+        b.sync(&mut ctx_b).unwrap();
+        assert_eq!(ctx_b.get_mem("long", "capital"), "Marseille");
+    }
+
+    #[test]
+    fn embeds_words_as_unit_vectors() {
+        let v = embed("Paris is the capital");
+        assert_eq!(v.len(), VECTOR_SIZE);
+        assert!((v.iter().map(|x| x * x).sum::<f32>() - 1.0).abs() < 1e-5);
+        assert_eq!(embed("paris"), embed("PARIS!"));
+        assert_eq!(embed("")[0], 1.0);
+    }
+}
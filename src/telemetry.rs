@@ -0,0 +1,351 @@
+//! Export of `tracing` spans to an OpenTelemetry collector over OTLP/HTTP
+//! (JSON encoding), so agent turns can be inspected in Jaeger or Tempo.
+//!
+//! Parsing, handlers, each evaluated statement, LLM calls and memory
+//! operations open spans; the [`layer`] installed by
+//! [`logging::init`](crate::logging::init) batches them to
+//! `<endpoint>/v1/traces`.
+
+use crate::config::TelemetryConfig;
+use serde_json::{json, Value};
+use std::collections::hash_map::RandomState;
+use std::hash::{BuildHasher, Hasher};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::mpsc::{self, Receiver, RecvTimeoutError, Sender};
+use std::thread;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+use tracing::field::{Field, Visit};
+use tracing::span::{Attributes, Id, Record};
+use tracing::{Event, Subscriber};
+use tracing_subscriber::layer::{Context, Layer};
+use tracing_subscriber::registry::LookupSpan;
+
+const DEFAULT_SERVICE_NAME: &str = "sentience";
+const BATCH_SIZE: usize = 512;
+const BATCH_INTERVAL: Duration = Duration::from_secs(2);
+const FLUSH_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// A finished span, as sent to the collector.
+#[derive(Clone, Debug)]
+pub struct SpanData {
+    pub trace_id: [u8; 16],
+    pub span_id: [u8; 8],
+    pub parent_span_id: Option<[u8; 8]>,
+    pub name: String,
+    pub start: SystemTime,
+    pub end: SystemTime,
+    pub attributes: Vec<(String, String)>,
+    /// Log events recorded inside the span, with their message.
+    pub events: Vec<(SystemTime, String)>,
+}
+
+enum Message {
+    Span(Box<SpanData>),
+    Flush(Sender<()>),
+}
+
+/// Flushes buffered spans when dropped, so short-lived commands do not lose
+/// their last batch.
+pub struct TelemetryGuard {
+    sender: Sender<Message>,
+}
+
+impl TelemetryGuard {
+    pub fn flush(&self) {
+        let (ack, done) = mpsc::channel();
+        if self.sender.send(Message::Flush(ack)).is_ok() {
+            let _ = done.recv_timeout(FLUSH_TIMEOUT);
+        }
+    }
+}
+
+impl Drop for TelemetryGuard {
+    fn drop(&mut self) {
+        self.flush();
+    }
+}
+
+/// The OTLP exporter layer when an endpoint is configured (or
+/// `OTEL_EXPORTER_OTLP_ENDPOINT` is set).
+pub fn layer(config: &TelemetryConfig) -> Option<(OtlpLayer, TelemetryGuard)> {
+    let endpoint =
+        crate::config::env_or("OTEL_EXPORTER_OTLP_ENDPOINT", config.otlp_endpoint.as_ref())?;
+    let service = crate::config::env_or("OTEL_SERVICE_NAME", config.service_name.as_ref())
+        .unwrap_or_else(|| DEFAULT_SERVICE_NAME.to_string());
+    Some(OtlpLayer::new(&endpoint, &service))
+}
+
+/// A [`Layer`] that turns closed spans into OTLP spans and hands them to a
+/// background exporter thread.
+pub struct OtlpLayer {
+    sender: Sender<Message>,
+}
+
+impl OtlpLayer {
+    pub fn new(endpoint: &str, service: &str) -> (Self, TelemetryGuard) {
+        let (sender, receiver) = mpsc::channel();
+        let url = format!("{}/v1/traces", endpoint.trim_end_matches('/'));
+        let service = service.to_string();
+        thread::spawn(move || export(receiver, &url, &service));
+        (
+            Self {
+                sender: sender.clone(),
+            },
+            TelemetryGuard { sender },
+        )
+    }
+}
+
+/// Span state kept in the registry's extensions until the span closes.
+struct OpenSpan(SpanData);
+
+impl<S> Layer<S> for OtlpLayer
+where
+    S: Subscriber + for<'a> LookupSpan<'a>,
+{
+    fn on_new_span(&self, attrs: &Attributes<'_>, id: &Id, ctx: Context<'_, S>) {
+        let Some(span) = ctx.span(id) else {
+            return;
+        };
+        let parent = span.parent().and_then(|parent| {
+            parent
+                .extensions()
+                .get::<OpenSpan>()
+                .map(|open| (open.0.trace_id, open.0.span_id))
+        });
+        let (trace_id, parent_span_id) = match parent {
+            Some((trace_id, span_id)) => (trace_id, Some(span_id)),
+            None => (new_trace_id(), None),
+        };
+
+        let mut data = SpanData {
+            trace_id,
+            span_id: random_u64().to_be_bytes(),
+            parent_span_id,
+            name: span.name().to_string(),
+            start: SystemTime::now(),
+            end: SystemTime::now(),
+            attributes: Vec::new(),
+            events: Vec::new(),
+        };
+        attrs.record(&mut FieldVisitor(&mut data.attributes));
+        span.extensions_mut().insert(OpenSpan(data));
+    }
+
+    fn on_record(&self, id: &Id, values: &Record<'_>, ctx: Context<'_, S>) {
+        if let Some(span) = ctx.span(id) {
+            if let Some(open) = span.extensions_mut().get_mut::<OpenSpan>() {
+                values.record(&mut FieldVisitor(&mut open.0.attributes));
+            }
+        }
+    }
+
+    fn on_event(&self, event: &Event<'_>, ctx: Context<'_, S>) {
+        let Some(span) = ctx.event_span(event) else {
+            return;
+        };
+        let mut fields = Vec::new();
+        event.record(&mut FieldVisitor(&mut fields));
+        let message = fields
+            .into_iter()
+            .find(|(name, _)| name == "message")
+            .map(|(_, value)| value)
+            .unwrap_or_else(|| event.metadata().name().to_string());
+        let mut extensions = span.extensions_mut();
+        if let Some(open) = extensions.get_mut::<OpenSpan>() {
+            open.0.events.push((SystemTime::now(), message));
+        }
+    }
+
+    fn on_close(&self, id: Id, ctx: Context<'_, S>) {
+        let Some(span) = ctx.span(&id) else {
+            return;
+        };
+        let Some(OpenSpan(mut data)) = span.extensions_mut().remove::<OpenSpan>() else {
+            return;
+        };
+        data.end = SystemTime::now();
+        let _ = self.sender.send(Message::Span(Box::new(data)));
+    }
+}
+
+struct FieldVisitor<'a>(&'a mut Vec<(String, String)>);
+
+impl Visit for FieldVisitor<'_> {
+    fn record_str(&mut self, field: &Field, value: &str) {
+        self.0.push((field.name().to_string(), value.to_string()));
+    }
+
+    fn record_debug(&mut self, field: &Field, value: &dyn std::fmt::Debug) {
+        self.0
+            .push((field.name().to_string(), format!("{:?}", value)));
+    }
+}
+
+/// Collect spans into batches and POST them, flushing when a batch is full,
+/// the interval passes, or a [`TelemetryGuard`] asks.
+fn export(receiver: Receiver<Message>, url: &str, service: &str) {
+    let client = reqwest::blocking::Client::new();
+    let mut batch = Vec::new();
+    loop {
+        let flushed = match receiver.recv_timeout(BATCH_INTERVAL) {
+            Ok(Message::Span(span)) => {
+                batch.push(*span);
+                if batch.len() < BATCH_SIZE {
+                    continue;
+                }
+                None
+            }
+            Ok(Message::Flush(ack)) => Some(ack),
+            Err(RecvTimeoutError::Timeout) => None,
+            Err(RecvTimeoutError::Disconnected) => break,
+        };
+        if !batch.is_empty() {
+            let body = encode(service, &std::mem::take(&mut batch));
+            if let Err(e) = client.post(url).json(&body).send() {
+                // Logging here would feed back into this exporter.
+                eprintln!("telemetry: export to {} failed: {}", url, e);
+            }
+        }
+        if let Some(ack) = flushed {
+            let _ = ack.send(());
+        }
+    }
+}
+
+/// The OTLP/JSON `ExportTraceServiceRequest` for `spans`.
+pub fn encode(service: &str, spans: &[SpanData]) -> Value {
+    let nanos = |t: &SystemTime| {
+        t.duration_since(UNIX_EPOCH)
+            .map(|d| d.as_nanos())
+            .unwrap_or(0)
+            .to_string()
+    };
+    let string_attributes = |attributes: &[(String, String)]| {
+        attributes
+            .iter()
+            .map(|(key, value)| json!({ "key": key, "value": { "stringValue": value } }))
+            .collect::<Vec<_>>()
+    };
+
+    let spans: Vec<Value> = spans
+        .iter()
+        .map(|span| {
+            let mut encoded = json!({
+                "traceId": hex::encode(span.trace_id),
+                "spanId": hex::encode(span.span_id),
+                "name": span.name,
+                "kind": 1,
+                "startTimeUnixNano": nanos(&span.start),
+                "endTimeUnixNano": nanos(&span.end),
+                "attributes": string_attributes(&span.attributes),
+                "events": span.events.iter().map(|(time, name)| {
+                    json!({ "timeUnixNano": nanos(time), "name": name })
+                }).collect::<Vec<_>>(),
+            });
+            if let Some(parent) = span.parent_span_id {
+                encoded["parentSpanId"] = hex::encode(parent).into();
+            }
+            encoded
+        })
+        .collect();
+
+    json!({
+        "resourceSpans": [{
+            "resource": {
+                "attributes": string_attributes(&[("service.name".to_string(), service.to_string())]),
+            },
+            "scopeSpans": [{ "scope": { "name": "sentience" }, "spans": spans }],
+        }]
+    })
+}
+
+/// A non-zero pseudo-random id; uniqueness, not secrecy, is what matters.
+fn random_u64() -> u64 {
+    static COUNTER: AtomicU64 = AtomicU64::new(0);
+    loop {
+        let mut hasher = RandomState::new().build_hasher();
+        hasher.write_u64(COUNTER.fetch_add(1, Ordering::Relaxed));
+        let id = hasher.finish();
+        if id != 0 {
+            return id;
+        }
+    }
+}
+
+fn new_trace_id() -> [u8; 16] {
+    let mut id = [0; 16];
+    id[..8].copy_from_slice(&random_u64().to_be_bytes());
+    id[8..].copy_from_slice(&random_u64().to_be_bytes());
+    id
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::io::{BufRead, BufReader, Read, Write};
+    use std::net::TcpListener;
+    use tracing_subscriber::prelude::*;
+
+    #[test]
+    fn exports_nested_spans() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let endpoint = format!("http://{}", listener.local_addr().unwrap());
+        let server = thread::spawn(move || {
+            let (stream, _) = listener.accept().unwrap();
+            let mut reader = BufReader::new(stream);
+            let mut request_line = String::new();
+            reader.read_line(&mut request_line).unwrap();
+            let mut length = 0;
+            loop {
+                let mut line = String::new();
+                reader.read_line(&mut line).unwrap();
+                if line.trim().is_empty() {
+                    break;
+                }
+                if let Some(v) = line.to_ascii_lowercase().strip_prefix("content-length:") {
+                    length = v.trim().parse().unwrap();
+                }
+            }
+            let mut body = vec![0; length];
+            reader.read_exact(&mut body).unwrap();
+            reader
+                .get_mut()
+                .write_all(b"HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\n{}")
+                .unwrap();
+            (
+                request_line,
+                serde_json::from_slice::<Value>(&body).unwrap(),
+            )
+        });
+
+        let (layer, guard) = OtlpLayer::new(&endpoint, "test-agent");
+        let subscriber = tracing_subscriber::registry().with(layer);
+        tracing::subscriber::with_default(subscriber, || {
+            let mut agent = crate::SentienceAgent::new();
+            agent
+                .run_sentience(r#"agent A { on input(msg) { print "hi" } }"#)
+                .unwrap();
+            agent.handle_input("hello").unwrap();
+        });
+        guard.flush();
+
+        let (request_line, body) = server.join().unwrap();
+        assert!(request_line.starts_with("POST /v1/traces "));
+        let resource = &body["resourceSpans"][0];
+        assert_eq!(
+            resource["resource"]["attributes"][0]["value"]["stringValue"],
+            "test-agent"
+        );
+        let spans = resource["scopeSpans"][0]["spans"].as_array().unwrap();
+        let find = |name: &str| spans.iter().find(|s| s["name"] == name).unwrap();
+        let handler = find("handler");
+        let print = spans
+            .iter()
+            .find(|s| s["name"] == "eval" && s["attributes"][0]["value"]["stringValue"] == "print")
+            .unwrap();
+        assert!(spans.iter().any(|s| s["name"] == "parse"));
+        assert_eq!(print["traceId"], handler["traceId"]);
+        assert_eq!(print["parentSpanId"], handler["spanId"]);
+    }
+}
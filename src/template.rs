@@ -0,0 +1,214 @@
+//! Prompt templates: text with named parameters that `print` and `ask`
+//! render with arguments, instead of building a message piece by piece.
+//!
+//! ```text
+//! template greet = "Hello {name}, today is {day}"
+//! print greet(name: msg, day: mem.long["today"])
+//! ask greet(name: "Ana", day: "{state.curiosity}") -> mem.short["reply"]
+//! ```
+//!
+//! An argument is a string, with its own placeholders filled in, or a
+//! reference such as `msg`, `state.curiosity` or `mem.short["key"]`.
+//! Placeholders no argument fills are resolved as in any other string, so
+//! `{input}` still reads the input. Templates declared in an agent belong
+//! to it; ones declared elsewhere are kept once they run, and the agent's
+//! own come first. A call that names no arguments, such as `greet(msg)`,
+//! reads as a function call and renders the template when no function has
+//! the name, filling the parameters in the order they first appear.
+
+use crate::context::AgentContext;
+use crate::error::{RuntimeError, RuntimeErrorKind};
+use crate::eval::{fill, interpolate, resolve_placeholder};
+use crate::expr::Value;
+use crate::types::Statement;
+
+/// The text of the template called `name`.
+pub fn find<'a>(ctx: &'a AgentContext, name: &str) -> Option<&'a str> {
+    let declared = match &ctx.current_agent {
+        Some(Statement::AgentDeclaration { body, .. }) => body.iter().find_map(|stmt| match stmt {
+            Statement::Template {
+                name: declared,
+                text,
+            } if declared == name => Some(text.as_str()),
+            _ => None,
+        }),
+        _ => None,
+    };
+    declared.or_else(|| ctx.templates.get(name).map(String::as_str))
+}
+
+/// The template called `name` with its parameters filled in from `args`.
+pub fn render(
+    ctx: &AgentContext,
+    name: &str,
+    args: &[(String, String)],
+    input: &str,
+) -> Result<String, RuntimeError> {
+    let text = find(ctx, name)
+        .ok_or_else(|| RuntimeError::new(RuntimeErrorKind::UnknownTemplate(name.to_string())))?;
+    Ok(fill(text, |expr| {
+        match args.iter().find(|(param, _)| param == expr) {
+            Some((_, value)) => Some(interpolate(value, input, ctx)),
+            None => resolve_placeholder(expr, input, ctx),
+        }
+    }))
+}
+
+/// The template called `name` with its parameters, in the order they first
+/// appear, filled in from `args`, for a call such as `greet(msg)` that does
+/// not name them. `None` if there is no such template.
+pub fn render_values(
+    ctx: &AgentContext,
+    name: &str,
+    args: &[Value],
+    input: &str,
+) -> Option<Result<String, RuntimeError>> {
+    let text = find(ctx, name)?;
+    let params = parameters(text);
+    if args.len() > params.len() {
+        return Some(Err(RuntimeError::new(RuntimeErrorKind::Expression(
+            format!(
+                "template `{}` takes {} argument(s), not {}",
+                name,
+                params.len(),
+                args.len()
+            ),
+        ))));
+    }
+    Some(Ok(fill(text, |expr| {
+        match params.iter().position(|param| param == expr) {
+            Some(index) if index < args.len() => Some(args[index].to_string()),
+            _ => resolve_placeholder(expr, input, ctx),
+        }
+    })))
+}
+
+/// Names of the placeholders in `text` an argument has to fill: plain
+/// words other than `input` and `msg`, each once.
+pub fn parameters(text: &str) -> Vec<String> {
+    let mut params: Vec<String> = Vec::new();
+    fill(text, |expr| {
+        let word = !expr.is_empty() && expr.chars().all(|c| c.is_alphanumeric() || c == '_');
+        if word && expr != "input" && expr != "msg" && !params.iter().any(|p| p == expr) {
+            params.push(expr.to_string());
+        }
+        None
+    });
+    params
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::eval::{eval, run_block};
+    use crate::lexer::Lexer;
+    use crate::llm::{LlmError, LlmProvider, LlmRequest, LlmResponse};
+    use crate::parser::Parser;
+    use std::sync::Arc;
+
+    struct Parrot;
+
+    impl LlmProvider for Parrot {
+        fn name(&self) -> &str {
+            "parrot"
+        }
+
+        fn complete(&self, request: &LlmRequest) -> Result<LlmResponse, LlmError> {
+            Ok(LlmResponse {
+                text: request.prompt.clone(),
+                ..Default::default()
+            })
+        }
+    }
+
+    #[test]
+    fn finds_the_parameters() {
+        assert_eq!(
+            parameters("{name}, {msg} on {day} {mem.short[\"x\"]} {name} { }"),
+            ["name", "day"]
+        );
+    }
+
+    fn parse(source: &str) -> Vec<Statement> {
+        let mut lexer = Lexer::new(source);
+        Parser::new(&mut lexer).parse_program().statements
+    }
+
+    #[test]
+    fn print_and_ask_render_templates() {
+        let source = concat!(
+            "template sign = \"-- {who}\"\n",
+            "agent Greeter {\n",
+            "  capabilities: llm\n",
+            "  template greet = \"Hello {name}, today is {day}. You said {input}.\"\n",
+            "  on input(msg) {\n",
+            "    print greet(name: \"Ana\", day: mem.long[\"today\"])\n",
+            "    ask greet(name: msg, day: \"{mem.long[\\\"today\\\"]}!\") -> mem.short[\"reply\"]\n",
+            "    print sign(who: mem.short[\"reply\"])\n",
+            "  }\n",
+            "}\n",
+        );
+        let mut ctx = AgentContext::new();
+        ctx.llm.register(Arc::new(Parrot));
+        ctx.set_mem("long", "today", "Monday");
+        let mut output = Vec::new();
+        for stmt in &parse(source) {
+            eval(stmt, "", "", &mut ctx, &mut output).unwrap();
+        }
+
+        assert_eq!(
+            run_block(&mut ctx, "input", "hi", "").unwrap(),
+            [
+                "Hello Ana, today is Monday. You said hi.",
+                "-- Hello hi, today is Monday!. You said hi.",
+            ]
+        );
+        assert_eq!(
+            ctx.get_mem("short", "reply"),
+            "Hello hi, today is Monday!. You said hi."
+        );
+
+        let err = eval(
+            &parse("print farewell(to: msg)")[0],
+            "",
+            "",
+            &mut ctx,
+            &mut output,
+        )
+        .unwrap_err();
+        assert_eq!(err.code(), "SEN4012");
+        assert_eq!(err.to_string(), "in print: unknown template `farewell`");
+    }
+
+    #[test]
+    fn renders_templates_declared_in_an_earlier_parse() {
+        let mut ctx = AgentContext::new();
+        let mut output = Vec::new();
+        for line in [
+            "lang 0.2",
+            "template greet = \"Hello {name}, it is {day}. {input}\"",
+            "print greet(msg, \"Monday\")",
+            "print greet()",
+        ] {
+            eval(&parse(line)[0], "", "hi", &mut ctx, &mut output).unwrap();
+        }
+        assert_eq!(
+            output,
+            [
+                "Hello hi, it is Monday. hi",
+                "Hello {name}, it is {day}. hi"
+            ]
+        );
+        let err = eval(
+            &parse("print greet(1, 2, 3)")[0],
+            "",
+            "",
+            &mut ctx,
+            &mut output,
+        );
+        assert_eq!(
+            err.unwrap_err().to_string(),
+            "in print: template `greet` takes 2 argument(s), not 3"
+        );
+    }
+}
@@ -0,0 +1,398 @@
+//! Serving one program to many clients. Each tenant in the `tenants`
+//! section of the config gets an agent of its own, built from the program,
+//! so tenants never see each other's memory. Requests say which tenant they
+//! are from with `Authorization: Bearer <token>` and are answered by the
+//! [HTTP API](crate::api) of that tenant's agent.
+//!
+//! Each tenant has its own [`Limits`](crate::limits::Limits), a rate limit
+//! on its requests, a file its memory is saved to and a [`Supervisor`]
+//! restarting its agent when it crashes. What each tenant used is counted in
+//! [`Usage`], served at `GET /usage`.
+
+use crate::api;
+use crate::config::TenantConfig;
+use crate::context::Stats;
+use crate::error::{MemoryError, RuntimeError};
+use crate::hmac::constant_time_eq;
+use crate::httpd::{Request, Response};
+use crate::supervisor::{Failure, RestartPolicy, Supervisor};
+use crate::SentienceAgent;
+use serde::Serialize;
+use serde_json::json;
+use std::path::PathBuf;
+use std::time::{Duration, Instant};
+
+/// How often a server saves the memory of tenants whose memory changed.
+pub const SAVE_INTERVAL: Duration = Duration::from_secs(10);
+
+/// What a tenant has used since the server started.
+#[derive(Clone, Debug, Default, PartialEq, Eq, Serialize)]
+pub struct Usage {
+    /// Requests answered, throttled ones aside.
+    pub requests: u64,
+    /// Inputs and training examples given to the agent's handlers.
+    pub handled: u64,
+    /// Requests answered with an error.
+    pub errors: u64,
+    /// Requests refused for going over the rate limit.
+    pub throttled: u64,
+    /// Time spent in handlers, in milliseconds.
+    pub handler_ms: u64,
+}
+
+/// Allows `per_minute` requests a minute, in bursts of up to as many.
+#[derive(Clone, Debug)]
+struct RateLimit {
+    per_minute: u32,
+    /// Requests that may be made now.
+    tokens: f64,
+    last: Option<Instant>,
+}
+
+impl RateLimit {
+    fn new(per_minute: u32) -> Self {
+        Self {
+            per_minute,
+            tokens: f64::from(per_minute),
+            last: None,
+        }
+    }
+
+    /// Whether a request made at `now` is within the limit.
+    fn allow(&mut self, now: Instant) -> bool {
+        let elapsed = self
+            .last
+            .map_or(Duration::ZERO, |last| now.saturating_duration_since(last));
+        self.last = Some(now);
+        let rate = f64::from(self.per_minute) / 60.0;
+        self.tokens = (self.tokens + elapsed.as_secs_f64() * rate).min(f64::from(self.per_minute));
+        if self.tokens < 1.0 {
+            return false;
+        }
+        self.tokens -= 1.0;
+        true
+    }
+}
+
+/// One tenant: its agent and what it may and did use.
+pub struct Tenant {
+    name: String,
+    token: String,
+    agent: SentienceAgent,
+    supervisor: Supervisor,
+    rate_limit: Option<RateLimit>,
+    memory: Option<PathBuf>,
+    usage: Usage,
+    /// Whether memory may have changed since it was last saved.
+    unsaved: bool,
+}
+
+impl Tenant {
+    /// `config`'s tenant, answered by `agent`.
+    pub fn new(config: &TenantConfig, agent: SentienceAgent, policy: RestartPolicy) -> Self {
+        Self {
+            name: config.name.clone(),
+            token: config.token.clone(),
+            agent,
+            supervisor: Supervisor::new(&config.name, policy),
+            rate_limit: config.requests_per_minute.map(RateLimit::new),
+            memory: config.memory.clone(),
+            usage: Usage::default(),
+            unsaved: false,
+        }
+    }
+
+    pub fn name(&self) -> &str {
+        &self.name
+    }
+
+    pub fn agent_mut(&mut self) -> &mut SentienceAgent {
+        &mut self.agent
+    }
+
+    pub fn supervisor(&self) -> &Supervisor {
+        &self.supervisor
+    }
+
+    pub fn supervisor_mut(&mut self) -> &mut Supervisor {
+        &mut self.supervisor
+    }
+
+    /// Answer with `agent` from now on, after a restart.
+    pub fn replace_agent(&mut self, agent: SentienceAgent) {
+        self.agent = agent;
+    }
+
+    pub fn usage(&self) -> &Usage {
+        &self.usage
+    }
+
+    /// Save the tenant's memory to its file, if it has one and memory may
+    /// have changed since the last save.
+    pub fn save(&mut self) -> Result<(), MemoryError> {
+        let Some(path) = self.memory.as_ref().filter(|_| self.unsaved) else {
+            return Ok(());
+        };
+        self.agent.freeze().save(&path.to_string_lossy())?;
+        self.unsaved = false;
+        Ok(())
+    }
+
+    /// Run a handler of the tenant's agent, e.g. a scheduled one, under its
+    /// supervisor; see [`Supervisor::run`].
+    pub fn run(
+        &mut self,
+        handler: impl FnOnce(&mut SentienceAgent) -> Result<String, RuntimeError>,
+    ) -> Result<String, Failure> {
+        self.unsaved = true;
+        let agent = &mut self.agent;
+        self.supervisor.run(|| handler(agent))
+    }
+
+    fn describe_usage(&self) -> serde_json::Value {
+        let stats: Stats = self.agent.stats();
+        let mut usage = json!(self.usage);
+        usage["tenant"] = json!(self.name);
+        usage["memory"] = json!(stats);
+        usage
+    }
+
+    fn handle(&mut self, request: &Request, now: Instant) -> Response {
+        if let Some(rate_limit) = &mut self.rate_limit {
+            if !rate_limit.allow(now) {
+                self.usage.throttled += 1;
+                return api::error(
+                    429,
+                    &format!(
+                        "tenant `{}` is over its limit of {} requests a minute",
+                        self.name, rate_limit.per_minute
+                    ),
+                );
+            }
+        }
+        self.usage.requests += 1;
+        let path = request.path.trim_matches('/');
+        if path == "usage" {
+            return match request.method.as_str() {
+                "GET" => Response::new(200, "application/json", self.describe_usage().to_string()),
+                _ => api::error(405, "method not allowed"),
+            };
+        }
+
+        let started = Instant::now();
+        let response = api::handle_supervised(&mut self.agent, &mut self.supervisor, request);
+        if request.method == "POST" && (path == "input" || path == "train") {
+            self.usage.handled += 1;
+            self.usage.handler_ms += started.elapsed().as_millis() as u64;
+        }
+        if response.status >= 400 {
+            self.usage.errors += 1;
+        }
+        if request.method != "GET" {
+            self.unsaved = true;
+        }
+        response
+    }
+}
+
+/// Every tenant of a server.
+#[derive(Default)]
+pub struct Tenants {
+    tenants: Vec<Tenant>,
+}
+
+impl Tenants {
+    /// Add `tenant`, which must differ from the others in name, token and
+    /// memory file.
+    pub fn add(&mut self, tenant: Tenant) -> Result<(), String> {
+        if tenant.name.is_empty() || tenant.token.is_empty() {
+            return Err("every tenant needs a `name` and a `token`".to_string());
+        }
+        for other in &self.tenants {
+            if other.name == tenant.name {
+                return Err(format!("tenant `{}` is configured twice", tenant.name));
+            }
+            if other.token == tenant.token {
+                return Err(format!(
+                    "tenants `{}` and `{}` have the same token",
+                    other.name, tenant.name
+                ));
+            }
+            if tenant.memory.is_some() && other.memory == tenant.memory {
+                return Err(format!(
+                    "tenants `{}` and `{}` save memory to the same file",
+                    other.name, tenant.name
+                ));
+            }
+        }
+        self.tenants.push(tenant);
+        Ok(())
+    }
+
+    pub fn len(&self) -> usize {
+        self.tenants.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.tenants.is_empty()
+    }
+
+    pub fn iter(&self) -> impl Iterator<Item = &Tenant> {
+        self.tenants.iter()
+    }
+
+    pub fn iter_mut(&mut self) -> impl Iterator<Item = &mut Tenant> {
+        self.tenants.iter_mut()
+    }
+
+    /// Answer `request`, made at `now`, for the tenant whose token it
+    /// carries. `/openapi.json` needs no token.
+    pub fn handle(&mut self, request: &Request, now: Instant) -> Response {
+        if request.method == "GET" && request.path.trim_matches('/') == "openapi.json" {
+            return Response::new(200, "application/json", api::openapi().to_string());
+        }
+        let token = request
+            .header("authorization")
+            .and_then(|value| value.strip_prefix("Bearer "))
+            .map(str::trim)
+            .unwrap_or_default();
+        // Every token is compared, so the time taken does not tell which
+        // tenant a guess came close to.
+        let mut found = None;
+        for (index, tenant) in self.tenants.iter().enumerate() {
+            if constant_time_eq(tenant.token.as_bytes(), token.as_bytes()) && !token.is_empty() {
+                found = Some(index);
+            }
+        }
+        match found {
+            Some(index) => self.tenants[index].handle(request, now),
+            None => api::error(401, "missing or unknown API token"),
+        }
+    }
+
+    /// Save the memory of every tenant whose memory may have changed,
+    /// returning the tenants it failed for.
+    pub fn save(&mut self) -> Vec<(String, MemoryError)> {
+        self.tenants
+            .iter_mut()
+            .filter_map(|tenant| tenant.save().err().map(|e| (tenant.name.clone(), e)))
+            .collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::Value;
+
+    const ECHO: &str =
+        "agent Echo {\n  on input(msg) {\n    reflect { mem.short[\"msg\"] }\n  }\n}";
+
+    fn tenant(name: &str, token: &str, per_minute: Option<u32>, memory: Option<PathBuf>) -> Tenant {
+        let mut agent = SentienceAgent::new();
+        agent.run_sentience(ECHO).unwrap();
+        let config = TenantConfig {
+            name: name.to_string(),
+            token: token.to_string(),
+            requests_per_minute: per_minute,
+            memory,
+            ..Default::default()
+        };
+        Tenant::new(&config, agent, RestartPolicy::default())
+    }
+
+    fn call(
+        tenants: &mut Tenants,
+        token: &str,
+        method: &str,
+        path: &str,
+        body: &str,
+        now: Instant,
+    ) -> (u16, Value) {
+        let request = Request {
+            method: method.to_string(),
+            path: path.to_string(),
+            headers: vec![("authorization".to_string(), format!("Bearer {}", token))],
+            body: body.as_bytes().to_vec(),
+            ..Default::default()
+        };
+        let response = tenants.handle(&request, now);
+        let value = serde_json::from_slice(&response.body).unwrap_or(Value::Null);
+        (response.status, value)
+    }
+
+    #[test]
+    fn isolates_tenants_and_counts_what_they_use() {
+        let path = std::env::temp_dir().join(format!("tenant-{}.json", std::process::id()));
+        let mut tenants = Tenants::default();
+        tenants
+            .add(tenant("acme", "a-token", Some(3), Some(path.clone())))
+            .unwrap();
+        tenants
+            .add(tenant("globex", "g-token", None, None))
+            .unwrap();
+        assert!(tenants.add(tenant("acme", "other", None, None)).is_err());
+        assert!(tenants
+            .add(tenant("initech", "g-token", None, None))
+            .is_err());
+        let now = Instant::now();
+
+        assert_eq!(
+            call(
+                &mut tenants,
+                "a-token",
+                "POST",
+                "/input",
+                r#"{"text":"hello"}"#,
+                now
+            )
+            .1["output"],
+            "  hello"
+        );
+        assert_eq!(
+            call(&mut tenants, "g-token", "GET", "/memory/short/msg", "", now).1["value"],
+            ""
+        );
+        assert_eq!(call(&mut tenants, "nope", "GET", "/stats", "", now).0, 401);
+        assert_eq!(call(&mut tenants, "", "GET", "/stats", "", now).0, 401);
+        assert_eq!(
+            call(&mut tenants, "", "GET", "/openapi.json", "", now).0,
+            200
+        );
+
+        assert_eq!(
+            call(
+                &mut tenants,
+                "a-token",
+                "GET",
+                "/memory/short/nothing/more",
+                "",
+                now
+            )
+            .0,
+            404
+        );
+        let (status, usage) = call(&mut tenants, "a-token", "GET", "/usage", "", now);
+        assert_eq!(status, 200);
+        assert_eq!(usage["tenant"], "acme");
+        assert_eq!(usage["requests"], 3);
+        assert_eq!(usage["handled"], 1);
+        assert_eq!(usage["errors"], 1);
+        assert_eq!(usage["memory"]["regions"][0]["entries"], 1);
+        assert_eq!(
+            call(&mut tenants, "a-token", "GET", "/usage", "", now).0,
+            429
+        );
+        let later = now + Duration::from_secs(20);
+        assert_eq!(
+            call(&mut tenants, "a-token", "GET", "/usage", "", later).1["throttled"],
+            1
+        );
+
+        assert!(tenants.save().is_empty());
+        let mut saved = crate::context::AgentContext::new();
+        saved.load(&path.to_string_lossy()).unwrap();
+        assert_eq!(saved.get_mem("short", "msg"), "hello");
+        let _ = std::fs::remove_file(path);
+    }
+}
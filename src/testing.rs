@@ -0,0 +1,94 @@
+//! Running a program against a transcript: the output of loading it, then
+//! each prompt followed by what the agent answered.
+//!
+//! ```text
+//! Agent: Echo [registered]
+//! > hello
+//! hello
+//! train> hi
+//! Training
+//! ```
+//!
+//! `> ` gives its text to `on input`, `train> ` to `train` and `schedule> `
+//! runs the `on schedule` handler with that spec. Other lines are what the
+//! agent is expected to answer; errors are written as
+//! `error[<code>]: <message>`. `sentience-repl test` and the golden-file
+//! tests of `examples/` compare the transcript a program produces with one
+//! written down.
+
+use crate::coverage::Coverage;
+use crate::error::Error;
+use crate::lexer::{self, Lexer};
+use crate::parser::Parser;
+use crate::types::Program;
+use crate::SentienceAgent;
+
+const PROMPTS: [(&str, &str); 3] = [
+    ("> ", "input"),
+    ("train> ", "train"),
+    ("schedule> ", "schedule"),
+];
+
+/// What running a program against a transcript produced.
+pub struct Outcome {
+    /// The transcript of this run, to compare with the expected one.
+    pub transcript: String,
+    /// The program, parsed with locations.
+    pub program: Program,
+    /// Statements of `program` run while loading it and answering prompts.
+    pub coverage: Coverage,
+}
+
+impl Outcome {
+    pub fn passed(&self, expected: &str) -> bool {
+        self.transcript == expected
+    }
+}
+
+/// Load `source` into `agent` and give it the prompts found in `expected`.
+pub fn run(agent: &mut SentienceAgent, source: &str, expected: &str) -> Outcome {
+    let mut lexer = Lexer::new(source);
+    let program = Parser::new(&mut lexer).with_locations().parse_program();
+    agent.record_coverage();
+    let mut out = String::new();
+    let loaded = match lexer::unterminated(source) {
+        Some(e) => Err(Error::from(e)),
+        None => agent.run_program(&program),
+    };
+    push(
+        &mut out,
+        loaded.map_err(|e| format!("error[{}]: {}", e.code(), e)),
+    );
+    for line in expected.lines() {
+        let Some((prompt, kind)) = PROMPTS.iter().find(|(prompt, _)| line.starts_with(prompt))
+        else {
+            continue;
+        };
+        let text = &line[prompt.len()..];
+        out.push_str(line);
+        out.push('\n');
+        let result = match *kind {
+            "input" => agent.handle_input(text),
+            "train" => agent.train(text),
+            _ => agent.run_schedule(text),
+        };
+        push(
+            &mut out,
+            result.map_err(|e| format!("error[{}]: {}", e.code(), e)),
+        );
+    }
+    Outcome {
+        transcript: out,
+        program,
+        coverage: agent.coverage().cloned().unwrap_or_default(),
+    }
+}
+
+/// Append the output of a step, or its error already formatted.
+fn push(out: &mut String, result: Result<String, String>) {
+    let text = result.unwrap_or_else(|e| e);
+    if !text.is_empty() {
+        out.push_str(&text);
+        out.push('\n');
+    }
+}
@@ -0,0 +1,131 @@
+//! Comparing text the way people read it rather than byte by byte:
+//! `if context includes`, [`AgentContext::recall`](crate::context::AgentContext::recall)
+//! and the word vectors of [`sync::embed`](crate::sync::embed) all go
+//! through [`fold`], so "ŠKOLA", "škola" and "skola" match.
+//!
+//! Folding lowercases, drops diacritics (`č`, `ć` → `c`, `đ` → `dj`, `ß` →
+//! `ss`) and writes Serbian Cyrillic in Latin (`Београд` → `beograd`), so a
+//! user can write in either script, with or without diacritics.
+
+/// `text` lowercased, without diacritics and in Latin script.
+pub fn fold(text: &str) -> String {
+    let mut folded = String::with_capacity(text.len());
+    for c in text.chars().flat_map(char::to_lowercase) {
+        match base(c) {
+            Some(base) => folded.push_str(base),
+            // Combining marks, as in a decomposed `c\u{30c}`.
+            None if ('\u{300}'..='\u{36f}').contains(&c) => {}
+            None => folded.push(c),
+        }
+    }
+    folded
+}
+
+/// Whether `a` and `b` are the same text once [folded](fold).
+pub fn equal(a: &str, b: &str) -> bool {
+    fold(a) == fold(b)
+}
+
+/// Whether `haystack` contains `needle`, both [folded](fold).
+pub fn contains(haystack: &str, needle: &str) -> bool {
+    fold(haystack).contains(&fold(needle))
+}
+
+/// The [folded](fold) words of `text`: runs of letters and digits.
+pub fn words(text: &str) -> Vec<String> {
+    fold(text)
+        .split(|c: char| !c.is_alphanumeric())
+        .filter(|word| !word.is_empty())
+        .map(str::to_string)
+        .collect()
+}
+
+/// What the lowercase letter `c` folds to, if not itself.
+fn base(c: char) -> Option<&'static str> {
+    Some(match c {
+        'à' | 'á' | 'â' | 'ã' | 'ä' | 'å' | 'ā' | 'ă' | 'ą' | 'а' => "a",
+        'æ' => "ae",
+        'б' => "b",
+        'ç' | 'ć' | 'ĉ' | 'ċ' | 'č' | 'ћ' | 'ц' | 'ч' => "c",
+        'ď' | 'ð' | 'д' => "d",
+        'đ' | 'ђ' => "dj",
+        'џ' => "dz",
+        'è' | 'é' | 'ê' | 'ë' | 'ē' | 'ĕ' | 'ė' | 'ę' | 'ě' | 'е' => "e",
+        'ф' => "f",
+        'ĝ' | 'ğ' | 'ġ' | 'ģ' | 'г' => "g",
+        'ĥ' | 'ħ' | 'х' => "h",
+        'ì' | 'í' | 'î' | 'ï' | 'ĩ' | 'ī' | 'ĭ' | 'į' | 'ı' | 'и' => "i",
+        'ĳ' => "ij",
+        'ĵ' | 'ј' => "j",
+        'ķ' | 'к' => "k",
+        'ĺ' | 'ļ' | 'ľ' | 'ŀ' | 'ł' | 'л' => "l",
+        'љ' => "lj",
+        'м' => "m",
+        'ñ' | 'ń' | 'ņ' | 'ň' | 'ŉ' | 'н' => "n",
+        'њ' => "nj",
+        'ò' | 'ó' | 'ô' | 'õ' | 'ö' | 'ø' | 'ō' | 'ŏ' | 'ő' | 'о' => "o",
+        'œ' => "oe",
+        'п' => "p",
+        'ŕ' | 'ŗ' | 'ř' | 'р' => "r",
+        'ś' | 'ŝ' | 'ş' | 'š' | 'ſ' | 'с' | 'ш' => "s",
+        'ß' => "ss",
+        'ţ' | 'ť' | 'ŧ' | 'т' => "t",
+        'þ' => "th",
+        'ù' | 'ú' | 'û' | 'ü' | 'ũ' | 'ū' | 'ŭ' | 'ů' | 'ű' | 'ų' | 'у' => "u",
+        'в' => "v",
+        'ŵ' => "w",
+        'ý' | 'ÿ' | 'ŷ' => "y",
+        'ź' | 'ż' | 'ž' | 'ж' | 'з' => "z",
+        _ => return None,
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::context::AgentContext;
+    use crate::replkit::Repl;
+
+    #[test]
+    fn folds_case_diacritics_and_script() {
+        assert_eq!(fold("Đorđe ČITA Straße"), "djordje cita strasse");
+        assert_eq!(
+            fold("Београд, Ђорђе, Љиљана, Џеп"),
+            "beograd, djordje, ljiljana, dzep"
+        );
+        assert_eq!(fold("c\u{30c}ovek İstanbul"), "covek istanbul");
+        assert!(equal("Šta radiš?", "sta RADIS?"));
+        assert!(!equal("kuca", "kuce"));
+        assert!(contains("Живим у Новом Саду", "novom sadu"));
+        assert_eq!(
+            words("Zdravo, svete! Ćao-ćao 2x"),
+            ["zdravo", "svete", "cao", "cao", "2x"]
+        );
+    }
+
+    #[test]
+    fn keyword_matching_and_recall_fold_text() {
+        let mut out = Vec::new();
+        let mut repl = Repl::new(&b""[..], &mut out);
+        repl.eval_source(concat!(
+            "agent Greeter {\n",
+            "  on input(msg) {\n",
+            "    if context includes [\"zdravo\"] {\n",
+            "      print \"Zdravo!\"\n",
+            "    }\n",
+            "  }\n",
+            "}\n",
+        ))
+        .unwrap();
+        repl.handle_command(".input ЗДРАВО свима").unwrap();
+        drop(repl);
+        assert!(String::from_utf8(out).unwrap().ends_with("  Zdravo!\n"));
+
+        let mut ctx = AgentContext::new();
+        ctx.set_mem("long", "grad", "Beograd na Dunavu");
+        ctx.set_mem("long", "reka", "Sava");
+        let found = ctx.recall("БЕОГРАД", None, 10).unwrap();
+        assert_eq!(found.len(), 1);
+        assert_eq!(found[0].key, "grad");
+    }
+}
@@ -0,0 +1,343 @@
+//! Training on a dataset: `train from "pairs.jsonl" { ... }` runs its body
+//! once per example and scores what it answers against what was expected.
+//!
+//! A dataset is JSON Lines, one object per line, or CSV with a header row
+//! (for paths ending in `.csv`). Each example has an `input` and an
+//! `expected` field. While the body runs for an example, both are in short
+//! memory under those names, and the input is also `msg` as in any `train`
+//! block. What the body prints is its prediction, scored by [`loss`].
+
+use crate::context::AgentContext;
+use crate::error::{RuntimeError, RuntimeErrorKind};
+use crate::eval::{eval_body, require};
+use crate::text;
+use crate::types::Statement;
+use serde::Serialize;
+use serde_json::Value;
+
+/// One example of a dataset.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct Example {
+    pub input: String,
+    pub expected: String,
+}
+
+/// How one pass over a dataset went.
+#[derive(Clone, Debug, PartialEq, Serialize)]
+pub struct Report {
+    pub dataset: String,
+    pub examples: usize,
+    /// Mean [`loss`] over the examples.
+    pub loss: f64,
+    /// Examples answered exactly as expected, ignoring surrounding space.
+    pub exact: usize,
+    /// Loss of the previous pass over the same dataset this session.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub previous_loss: Option<f64>,
+}
+
+impl Report {
+    pub fn summary(&self) -> String {
+        let mut line = format!(
+            "Trained on {} example{} from {}: loss {:.4}, {}/{} exact",
+            self.examples,
+            if self.examples == 1 { "" } else { "s" },
+            self.dataset,
+            self.loss,
+            self.exact,
+            self.examples
+        );
+        if let Some(previous) = self.previous_loss {
+            line.push_str(&format!(" (was {:.4})", previous));
+        }
+        line
+    }
+}
+
+/// Parse a dataset, as CSV if `path` ends in `.csv` and JSON Lines
+/// otherwise.
+pub fn parse(path: &str, text: &str) -> Result<Vec<Example>, String> {
+    if path.to_ascii_lowercase().ends_with(".csv") {
+        parse_csv(text)
+    } else {
+        parse_jsonl(text)
+    }
+}
+
+fn parse_jsonl(text: &str) -> Result<Vec<Example>, String> {
+    text.lines()
+        .enumerate()
+        .filter(|(_, line)| !line.trim().is_empty())
+        .map(|(n, line)| {
+            let object: serde_json::Map<String, Value> =
+                serde_json::from_str(line).map_err(|e| format!("line {}: {}", n + 1, e))?;
+            let field = |name: &str| match object.get(name) {
+                Some(Value::String(text)) => Ok(text.clone()),
+                Some(Value::Null) | None => Err(format!("line {}: no `{}` field", n + 1, name)),
+                Some(other) => Ok(other.to_string()),
+            };
+            Ok(Example {
+                input: field("input")?,
+                expected: field("expected")?,
+            })
+        })
+        .collect()
+}
+
+fn parse_csv(text: &str) -> Result<Vec<Example>, String> {
+    let mut rows = csv_rows(text)?.into_iter();
+    let header = rows.next().ok_or("the file is empty")?;
+    let column = |name: &str| {
+        header
+            .iter()
+            .position(|field| field.trim() == name)
+            .ok_or_else(|| format!("the header has no `{}` column", name))
+    };
+    let (input, expected) = (column("input")?, column("expected")?);
+    rows.enumerate()
+        .filter(|(_, row)| row.iter().any(|field| !field.is_empty()))
+        .map(|(n, row)| match (row.get(input), row.get(expected)) {
+            (Some(input), Some(expected)) => Ok(Example {
+                input: input.clone(),
+                expected: expected.clone(),
+            }),
+            _ => Err(format!("row {}: too few fields", n + 2)),
+        })
+        .collect()
+}
+
+/// Rows of comma-separated fields. Fields may be quoted, with `""` for a
+/// quote, and then hold commas and line breaks.
+fn csv_rows(text: &str) -> Result<Vec<Vec<String>>, String> {
+    let mut rows = Vec::new();
+    let mut row = Vec::new();
+    let mut field = String::new();
+    let mut quoted = false;
+    let mut chars = text.chars().peekable();
+    while let Some(c) = chars.next() {
+        match c {
+            '"' if quoted && chars.peek() == Some(&'"') => {
+                chars.next();
+                field.push('"');
+            }
+            '"' if quoted => quoted = false,
+            '"' if field.is_empty() => quoted = true,
+            ',' if !quoted => row.push(std::mem::take(&mut field)),
+            '\r' if !quoted => {}
+            '\n' if !quoted => {
+                row.push(std::mem::take(&mut field));
+                rows.push(std::mem::take(&mut row));
+            }
+            c => field.push(c),
+        }
+    }
+    if quoted {
+        return Err("a quoted field is never closed".to_string());
+    }
+    if !field.is_empty() || !row.is_empty() {
+        row.push(field);
+        rows.push(row);
+    }
+    Ok(rows)
+}
+
+/// Loss of `prediction` against `expected`: the squared error when both are
+/// numbers, and otherwise one minus the F1 score of their words, so 0 for
+/// the same words and 1 for none in common.
+pub fn loss(prediction: &str, expected: &str) -> f64 {
+    if let (Ok(predicted), Ok(expected)) = (
+        prediction.trim().parse::<f64>(),
+        expected.trim().parse::<f64>(),
+    ) {
+        return (predicted - expected).powi(2);
+    }
+    let (predicted, expected) = (text::words(prediction), text::words(expected));
+    if predicted.is_empty() || expected.is_empty() {
+        return if predicted == expected { 0.0 } else { 1.0 };
+    }
+    let mut unmatched = expected.clone();
+    let mut common = 0;
+    for word in &predicted {
+        if let Some(i) = unmatched.iter().position(|other| other == word) {
+            unmatched.swap_remove(i);
+            common += 1;
+        }
+    }
+    let precision = common as f64 / predicted.len() as f64;
+    let recall = common as f64 / expected.len() as f64;
+    if common == 0 {
+        1.0
+    } else {
+        1.0 - 2.0 * precision * recall / (precision + recall)
+    }
+}
+
+/// Run `body` once per example of the dataset at `path`, read through the
+/// sandbox like a `read` statement, and return the summary line.
+pub fn run(
+    ctx: &mut AgentContext,
+    path: &str,
+    body: &[Statement],
+    indent: &str,
+) -> Result<Vec<String>, RuntimeError> {
+    let _span = tracing::info_span!("train", dataset = path).entered();
+    require(ctx, "fs.read").map_err(|e| e.in_statement("train"))?;
+    let text = ctx
+        .sandbox
+        .read_file(path)
+        .map_err(|e| e.in_statement("train"))?;
+    let examples = parse(path, &text).map_err(|e| {
+        RuntimeError::new(RuntimeErrorKind::File(format!("{}: {}", path, e))).in_statement("train")
+    })?;
+
+    let mut total = 0.0;
+    let mut exact = 0;
+    for (n, example) in examples.iter().enumerate() {
+        for (key, value) in [
+            ("msg", &example.input),
+            ("input", &example.input),
+            ("expected", &example.expected),
+        ] {
+            ctx.try_set_mem("short", key, value)?;
+        }
+        let mut output = Vec::new();
+        eval_body(body, "", &example.input, ctx, &mut output)?;
+        let prediction = output.join("\n");
+        let loss = loss(&prediction, &example.expected);
+        tracing::debug!(example = n + 1, loss, "scored example");
+        total += loss;
+        if prediction.trim() == example.expected.trim() {
+            exact += 1;
+        }
+    }
+
+    let previous_loss = ctx
+        .training
+        .iter()
+        .find(|report| report.dataset == path)
+        .map(|report| report.loss);
+    let report = Report {
+        dataset: path.to_string(),
+        examples: examples.len(),
+        loss: if examples.is_empty() {
+            0.0
+        } else {
+            total / examples.len() as f64
+        },
+        exact,
+        previous_loss,
+    };
+    tracing::info!(
+        examples = report.examples,
+        loss = report.loss,
+        exact = report.exact,
+        "trained"
+    );
+    let agent = match &ctx.current_agent {
+        Some(Statement::AgentDeclaration { name, .. }) => name.as_str(),
+        _ => "",
+    };
+    crate::metrics::global().trained(agent, &report);
+    let summary = format!("{}{}", indent, report.summary());
+    ctx.training = Some(report);
+    Ok(vec![summary])
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::replkit::Repl;
+
+    #[test]
+    fn reads_jsonl_and_csv() {
+        assert_eq!(
+            parse(
+                "pairs.jsonl",
+                "{\"input\": \"2+2\", \"expected\": 4}\n\n{\"input\": \"hi\", \"expected\": \"hello\"}\n"
+            )
+            .unwrap(),
+            [
+                Example {
+                    input: "2+2".to_string(),
+                    expected: "4".to_string(),
+                },
+                Example {
+                    input: "hi".to_string(),
+                    expected: "hello".to_string(),
+                },
+            ]
+        );
+        assert_eq!(
+            parse("pairs.jsonl", "{\"input\": \"x\"}").unwrap_err(),
+            "line 1: no `expected` field"
+        );
+        let csv =
+            "id,input,expected\r\n1,\"hi, there\",\"say \"\"hello\"\"\"\n2,\"two\nlines\",ok\n";
+        assert_eq!(
+            parse("pairs.CSV", csv).unwrap(),
+            [
+                Example {
+                    input: "hi, there".to_string(),
+                    expected: "say \"hello\"".to_string(),
+                },
+                Example {
+                    input: "two\nlines".to_string(),
+                    expected: "ok".to_string(),
+                },
+            ]
+        );
+        assert_eq!(
+            parse("pairs.csv", "question,answer\n").unwrap_err(),
+            "the header has no `input` column"
+        );
+    }
+
+    #[test]
+    fn scores_words_and_numbers() {
+        assert_eq!(loss("Hello, world", "hello world"), 0.0);
+        assert_eq!(loss("goodbye", "hello"), 1.0);
+        assert!((loss("hello there", "hello") - (1.0 - 2.0 / 3.0)).abs() < 1e-9);
+        assert_eq!(loss("3", "4"), 1.0);
+        assert_eq!(loss("", ""), 0.0);
+    }
+
+    #[test]
+    fn trains_over_every_example() {
+        let dir = std::env::temp_dir().join(format!("sentience-train-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        std::fs::write(
+            dir.join("pairs.jsonl"),
+            concat!(
+                "{\"input\": \"hi\", \"expected\": \"hi\"}\n",
+                "{\"input\": \"bye\", \"expected\": \"see you\"}\n",
+            ),
+        )
+        .unwrap();
+        let mut out = Vec::new();
+        let mut repl = Repl::new(&b""[..], &mut out);
+        repl.context_mut().sandbox.workspace = Some(dir.clone());
+        repl.eval_source(concat!(
+            "agent Parrot {\n",
+            "  train from \"pairs.jsonl\" {\n",
+            "    reflect {\n",
+            "      mem.short[\"input\"]\n",
+            "    }\n",
+            "  }\n",
+            "}\n",
+        ))
+        .unwrap();
+        repl.handle_command(".train").unwrap();
+        repl.handle_command(".train").unwrap();
+        drop(repl);
+        std::fs::remove_dir_all(&dir).unwrap();
+        let out = String::from_utf8(out).unwrap();
+        assert!(
+            out.ends_with(concat!(
+                "  Trained on 2 examples from pairs.jsonl: loss 0.5000, 1/2 exact\n",
+                "  Trained on 2 examples from pairs.jsonl: loss 0.5000, 1/2 exact (was 0.5000)\n",
+            )),
+            "{}",
+            out
+        );
+    }
+}
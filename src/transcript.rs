@@ -0,0 +1,259 @@
+//! A readable log of a REPL session, to share or archive a conversation:
+//! `.transcript session.md` writes each input the agent handled, what it
+//! answered, the memory it changed and what its `reflect` blocks read, as
+//! Markdown, or as JSON for a path ending in `.json`.
+//!
+//! [`Repl::new`](crate::replkit::Repl::new) keeps a transcript in
+//! [`AgentContext::transcript`](crate::context::AgentContext::transcript).
+//! Memory changes and reflections are noted while a handler runs, so each
+//! belongs to the turn that caused it.
+
+use crate::error::RuntimeError;
+use crate::events::AgentEvent;
+use crate::history::format_time;
+use crate::logging;
+use crate::recording::Change;
+use serde::Serialize;
+use std::fmt::Write as _;
+use std::fs;
+use std::io;
+use std::path::Path;
+
+/// One input a handler ran for.
+#[derive(Clone, Debug, PartialEq, Eq, Serialize)]
+pub struct Turn {
+    /// When the input arrived, in Unix milliseconds.
+    pub timestamp: u64,
+    pub agent: String,
+    /// `input`, `train` or `evolve`.
+    pub handler: String,
+    pub input: String,
+    pub output: Vec<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+    /// Memory values the turn changed, in the order they were written.
+    pub changes: Vec<Change>,
+    /// Memory values `reflect` blocks read.
+    pub reflections: Vec<Change>,
+}
+
+/// The turns of a session, oldest first.
+#[derive(Clone, Debug, PartialEq, Eq, Serialize)]
+pub struct Transcript {
+    /// When the session started, in Unix milliseconds.
+    pub started: u64,
+    pub turns: Vec<Turn>,
+    /// Whether the last turn is still running.
+    #[serde(skip)]
+    open: bool,
+}
+
+impl Default for Transcript {
+    fn default() -> Self {
+        Self {
+            started: logging::unix_millis(),
+            turns: Vec::new(),
+            open: false,
+        }
+    }
+}
+
+impl Transcript {
+    /// Start a turn of `agent`'s `handler` for `input`.
+    pub fn begin(&mut self, agent: &str, handler: &str, input: &str) {
+        self.turns.push(Turn {
+            timestamp: logging::unix_millis(),
+            agent: agent.to_string(),
+            handler: handler.to_string(),
+            input: input.to_string(),
+            output: Vec::new(),
+            error: None,
+            changes: Vec::new(),
+            reflections: Vec::new(),
+        });
+        self.open = true;
+    }
+
+    /// Note a memory change or reflection of the running turn.
+    pub fn note(&mut self, event: &AgentEvent) {
+        let Some(turn) = self.turns.last_mut().filter(|_| self.open) else {
+            return;
+        };
+        match event {
+            AgentEvent::MemoryChanged { .. } => turn.changes.extend(Change::from_event(event)),
+            AgentEvent::Reflected { region, key, value } => turn.reflections.push(Change {
+                region: region.clone(),
+                key: key.clone(),
+                value: value.clone(),
+            }),
+            _ => {}
+        }
+    }
+
+    /// Finish the running turn with what the handler returned.
+    pub fn end(&mut self, result: &Result<Vec<String>, RuntimeError>) {
+        let Some(turn) = self.turns.last_mut().filter(|_| self.open) else {
+            return;
+        };
+        match result {
+            Ok(output) => turn.output = output.clone(),
+            Err(e) => turn.error = Some(format!("Error[{}]: {}", e.code(), e)),
+        }
+        self.open = false;
+    }
+
+    /// Write the transcript to `path`, as JSON if it ends in `.json` and
+    /// as Markdown otherwise.
+    pub fn write(&self, path: &Path) -> io::Result<()> {
+        let json = path
+            .extension()
+            .is_some_and(|extension| extension.eq_ignore_ascii_case("json"));
+        let text = if json {
+            serde_json::to_string_pretty(self)? + "\n"
+        } else {
+            self.markdown()
+        };
+        fs::write(path, text)
+    }
+
+    pub fn markdown(&self) -> String {
+        let mut out = String::from("# Session transcript\n\n");
+        let _ = writeln!(
+            out,
+            "Started {}, {} turn{}.",
+            format_time(self.started),
+            self.turns.len(),
+            if self.turns.len() == 1 { "" } else { "s" }
+        );
+        for (n, turn) in self.turns.iter().enumerate() {
+            let _ = write!(
+                out,
+                "\n## {}. {} to {}\n\n{}\n\n",
+                n + 1,
+                turn.handler,
+                turn.agent,
+                format_time(turn.timestamp)
+            );
+            if !turn.input.is_empty() {
+                for line in turn.input.lines() {
+                    let _ = writeln!(out, "> {}", line);
+                }
+                out.push('\n');
+            }
+            match &turn.error {
+                Some(error) => {
+                    let _ = writeln!(out, "**{}**", error);
+                }
+                None if turn.output.is_empty() => out.push_str("_No answer._\n"),
+                None => {
+                    let output = turn.output.join("\n");
+                    let fence = fence(&output);
+                    let _ = writeln!(out, "{}text\n{}\n{}", fence, output, fence);
+                }
+            }
+            for (title, changes) in [
+                ("Memory changes", &turn.changes),
+                ("Reflections", &turn.reflections),
+            ] {
+                if changes.is_empty() {
+                    continue;
+                }
+                let _ = writeln!(out, "\n{}:\n", title);
+                for change in changes {
+                    let _ = writeln!(out, "- {}", code(&change.to_string()));
+                }
+            }
+        }
+        out
+    }
+}
+
+/// A code fence longer than any run of backticks in `text`.
+pub(crate) fn fence(text: &str) -> String {
+    let longest = text.split(|c| c != '`').map(str::len).max().unwrap_or(0);
+    "`".repeat(longest.max(2) + 1)
+}
+
+/// `text` as inline code.
+fn code(text: &str) -> String {
+    if text.contains('`') {
+        format!("`` {} ``", text)
+    } else {
+        format!("`{}`", text)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::replkit::Repl;
+
+    #[test]
+    fn logs_turns_with_their_memory_changes_and_reflections() {
+        let dir = std::env::temp_dir().join(format!("sentience-transcript-{}", std::process::id()));
+        fs::create_dir_all(&dir).unwrap();
+        let mut out = Vec::new();
+        let mut repl = Repl::new(&b""[..], &mut out);
+        repl.eval_source(concat!(
+            "agent Echo {\n",
+            "  on input(msg) {\n",
+            "    reflect {\n",
+            "      mem.short[\"msg\"]\n",
+            "    }\n",
+            "  }\n",
+            "  train {\n",
+            "    print \"```\"\n",
+            "  }\n",
+            "}\n",
+        ))
+        .unwrap();
+        repl.handle_command(".input hello\nthere").unwrap();
+        repl.handle_command(".train").unwrap();
+        repl.handle_command(".evolve").unwrap();
+        repl.handle_command(&format!(".transcript {}", dir.join("chat.md").display()))
+            .unwrap();
+        repl.handle_command(&format!(".transcript {}", dir.join("chat.json").display()))
+            .unwrap();
+        drop(repl);
+        let markdown = fs::read_to_string(dir.join("chat.md")).unwrap();
+        let json: serde_json::Value =
+            serde_json::from_str(&fs::read_to_string(dir.join("chat.json")).unwrap()).unwrap();
+        fs::remove_dir_all(&dir).unwrap();
+
+        assert!(String::from_utf8(out)
+            .unwrap()
+            .ends_with("Wrote 3 turns to chat.json\n"));
+        let turns: Vec<&str> = markdown.split("\n## ").skip(1).collect();
+        assert_eq!(turns.len(), 3);
+        let (_, first) = turns[0].split_once("\n\n").unwrap();
+        let (time, first) = first.split_once("\n\n").unwrap();
+        assert!(time.ends_with('Z'), "{}", time);
+        assert_eq!(
+            first,
+            concat!(
+                "> hello\n",
+                "> there\n",
+                "\n",
+                "```text\n",
+                "  hello\n",
+                "there\n",
+                "```\n",
+                "\n",
+                "Memory changes:\n",
+                "\n",
+                "- `mem.short[\"msg\"] = \"hello\\nthere\"`\n",
+                "\n",
+                "Reflections:\n",
+                "\n",
+                "- `mem.short[\"msg\"] = \"hello\\nthere\"`\n",
+            )
+        );
+        assert!(turns[1].starts_with("2. train to Echo\n"));
+        assert!(turns[1].ends_with(
+            "````text\n```\n````\n\nMemory changes:\n\n- `mem.short[\"msg\"] = \"\"`\n"
+        ));
+        assert!(turns[2].ends_with("**Error[SEN4002]: agent has no evolve block**\n"));
+        assert_eq!(json["turns"][0]["input"], "hello\nthere");
+        assert_eq!(json["turns"][2]["handler"], "evolve");
+    }
+}
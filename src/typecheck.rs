@@ -0,0 +1,435 @@
+//! Optional check of the values in a program before it runs: that the
+//! options of `ask`, `fetch` and `exec` exist and hold values of the type
+//! they take, that `{...}` placeholders name something that exists, and
+//! that templates are rendered with the parameters they have.
+//!
+//! Every value in the language is a string, so these are the only places a
+//! value can have the wrong type. The checks mirror what
+//! [`LlmRequest::from_options`](crate::llm::LlmRequest::from_options),
+//! [`FetchRequest::from_options`](crate::fetch::FetchRequest::from_options)
+//! and [`ExecRequest::from_options`](crate::exec::ExecRequest::from_options)
+//! would reject at run time.
+
+use crate::analyze::{Diagnostic, Severity, REGIONS};
+use crate::lang::{self, Version};
+use crate::llm::tools;
+use crate::packages::Packages;
+use crate::template;
+use crate::types::{Program, Statement, Text};
+use std::collections::{HashMap, HashSet};
+use std::time::Duration;
+
+/// The type of an option's value.
+#[derive(Clone, Copy)]
+enum Type {
+    Text,
+    /// A number such as `0.7`.
+    Number,
+    /// A whole number that is not negative.
+    Count,
+    /// A duration in seconds.
+    Seconds,
+    /// `Name: value`.
+    Header,
+    /// `memory` or `memory.read`.
+    Tools,
+}
+
+impl Type {
+    fn accepts(self, value: &str) -> bool {
+        match self {
+            Type::Text => true,
+            Type::Number => value.parse::<f32>().is_ok(),
+            Type::Count => value.parse::<u32>().is_ok(),
+            Type::Seconds => value
+                .parse::<f64>()
+                .is_ok_and(|secs| Duration::try_from_secs_f64(secs).is_ok()),
+            Type::Header => value.contains(':'),
+            Type::Tools => tools::definitions(value).is_some(),
+        }
+    }
+
+    fn describe(self) -> &'static str {
+        match self {
+            Type::Text => "text",
+            Type::Number => "a number",
+            Type::Count => "a whole number",
+            Type::Seconds => "a number of seconds",
+            Type::Header => "a `Name: value` header",
+            Type::Tools => "`memory` or `memory.read`",
+        }
+    }
+}
+
+const ASK_OPTIONS: &[(&str, Type)] = &[
+    ("provider", Type::Text),
+    ("model", Type::Text),
+    ("temperature", Type::Number),
+    ("max_tokens", Type::Count),
+    ("tools", Type::Tools),
+];
+
+const FETCH_OPTIONS: &[(&str, Type)] = &[
+    ("method", Type::Text),
+    ("body", Type::Text),
+    ("timeout", Type::Seconds),
+    ("header", Type::Header),
+];
+
+const EXEC_OPTIONS: &[(&str, Type)] = &[("timeout", Type::Seconds)];
+
+/// Type errors in `program`, in source order. Lines are given when it was
+/// parsed [with locations](crate::parser::Parser::with_locations).
+pub fn check(program: &Program) -> Vec<Diagnostic> {
+    let mut checker = Checker {
+        lang: lang::default_version(),
+        ..Checker::default()
+    };
+    checker.declare(&program.statements);
+    checker.body(&program.statements);
+    checker.diagnostics
+}
+
+#[derive(Default)]
+struct Checker {
+    diagnostics: Vec<Diagnostic>,
+    line: Option<usize>,
+    /// Parameters of each template the program declares.
+    templates: HashMap<String, Vec<String>>,
+    /// Names bound with `let` anywhere in the program.
+    variables: HashSet<String>,
+    /// Version of the language of the statement being checked.
+    lang: Version,
+}
+
+impl Checker {
+    fn report(&mut self, code: &'static str, severity: Severity, message: String) {
+        self.diagnostics.push(Diagnostic {
+            code,
+            severity,
+            line: self.line,
+            column: None,
+            message,
+        });
+    }
+
+    /// Note the templates declared and variables bound anywhere in `body`,
+    /// or by a module it imports.
+    fn declare(&mut self, body: &[Statement]) {
+        for stmt in body {
+            match stmt {
+                Statement::Let { name, .. } => {
+                    self.variables.insert(name.clone());
+                }
+                Statement::For {
+                    key, value, body, ..
+                } => {
+                    self.variables.extend([key.clone(), value.clone()]);
+                    self.declare(body);
+                }
+                Statement::Function { params, body, .. } => {
+                    self.variables.extend(params.iter().cloned());
+                    self.declare(body);
+                }
+                Statement::Template { name, text } => {
+                    self.templates
+                        .insert(name.clone(), template::parameters(text));
+                }
+                Statement::Import(module) => {
+                    if let Ok(module) = Packages::default().load(module) {
+                        self.declare(&module.statements);
+                    }
+                }
+                Statement::AgentDeclaration { body, .. }
+                | Statement::OnInput { body, .. }
+                | Statement::OnSchedule { body, .. }
+                | Statement::OnStart { body }
+                | Statement::OnStop { body }
+                | Statement::OnOutput { body, .. }
+                | Statement::Train { body, .. }
+                | Statement::Evolve { body }
+                | Statement::IfContextIncludes { body, .. }
+                | Statement::IfState { body, .. }
+                | Statement::While { body, .. }
+                | Statement::If { body, .. }
+                | Statement::IfReward { body, .. } => self.declare(body),
+                Statement::IfElse { branch, otherwise } => {
+                    self.declare(std::slice::from_ref(branch));
+                    self.declare(otherwise);
+                }
+                _ => {}
+            }
+        }
+    }
+
+    fn body(&mut self, body: &[Statement]) {
+        for stmt in body {
+            self.statement(stmt);
+        }
+    }
+
+    fn statement(&mut self, stmt: &Statement) {
+        match stmt {
+            Statement::Location { line, .. } => self.line = Some(*line),
+            Statement::AgentDeclaration { body, .. }
+            | Statement::OnInput { body, .. }
+            | Statement::OnSchedule { body, .. }
+            | Statement::OnStart { body }
+            | Statement::OnStop { body }
+            | Statement::OnOutput { body, .. }
+            | Statement::Reflect { body }
+            | Statement::Train { body, .. }
+            | Statement::Evolve { body }
+            | Statement::IfContextIncludes { body, .. }
+            | Statement::IfState { body, .. }
+            | Statement::Function { body, .. }
+            | Statement::While { body, .. }
+            | Statement::For { body, .. }
+            | Statement::If { body, .. }
+            | Statement::IfReward { body, .. } => self.body(body),
+            Statement::IfElse { branch, otherwise } => {
+                self.statement(branch);
+                self.body(otherwise);
+            }
+            Statement::Template { text, .. } => {
+                let params = template::parameters(text);
+                self.placeholders_with(text, &params);
+            }
+            Statement::Lang(version) => self.lang = *version,
+            Statement::Print(Text::Literal(text)) if self.lang >= Version::V0_2 => {
+                self.placeholders(text)
+            }
+            Statement::Print(Text::Template { name, args }) => self.render("print", name, args),
+            Statement::Ask {
+                prompt, options, ..
+            } => {
+                match prompt {
+                    Text::Literal(text) => self.placeholders(text),
+                    Text::Expr(_) => {}
+                    Text::Template { name, args } => self.render("ask", name, args),
+                }
+                self.options("ask", options, ASK_OPTIONS, false);
+            }
+            Statement::Fetch { url, options, .. } => {
+                self.placeholders(url);
+                self.options("fetch", options, FETCH_OPTIONS, true);
+            }
+            Statement::Exec {
+                command, options, ..
+            } => {
+                self.placeholders(command);
+                self.options("exec", options, EXEC_OPTIONS, false);
+            }
+            Statement::ReadFile { path, .. } | Statement::WriteFile { path, .. } => {
+                self.placeholders(path)
+            }
+            _ => {}
+        }
+    }
+
+    /// Check `options` of `statement` against the ones it takes. Values of
+    /// statements that `interpolate` them are checked once they have no
+    /// placeholders left to fill in.
+    fn options(
+        &mut self,
+        statement: &str,
+        options: &[(String, String)],
+        takes: &[(&str, Type)],
+        interpolate: bool,
+    ) {
+        for (name, value) in options {
+            let Some(&(_, ty)) = takes.iter().find(|(known, _)| known == name) else {
+                let known: Vec<&str> = takes.iter().map(|(known, _)| *known).collect();
+                self.report(
+                    "SEN2101",
+                    Severity::Error,
+                    format!(
+                        "`{}` has no option `{}` (expected one of: {})",
+                        statement,
+                        name,
+                        known.join(", ")
+                    ),
+                );
+                continue;
+            };
+            if interpolate {
+                self.placeholders(value);
+                if value.contains('{') {
+                    continue;
+                }
+            }
+            if !ty.accepts(value) {
+                self.report(
+                    "SEN2102",
+                    Severity::Error,
+                    format!(
+                        "option `{}` of `{}` takes {}, found \"{}\"",
+                        name,
+                        statement,
+                        ty.describe(),
+                        value
+                    ),
+                );
+            }
+        }
+    }
+
+    /// Check the `{...}` placeholders in `template`. Braces around anything
+    /// but a name or a memory reference, such as a JSON body, are text.
+    /// Check that `statement` renders a template that exists, with an
+    /// argument for each of its parameters and no others.
+    fn render(&mut self, statement: &str, name: &str, args: &[(String, String)]) {
+        let Some(params) = self.templates.get(name).cloned() else {
+            self.report(
+                "SEN2105",
+                Severity::Error,
+                format!("`{}` renders unknown template `{}`", statement, name),
+            );
+            return;
+        };
+        for (param, value) in args {
+            if !params.contains(param) {
+                self.report(
+                    "SEN2106",
+                    Severity::Warning,
+                    format!("template `{}` has no parameter `{}`", name, param),
+                );
+            }
+            self.placeholders(value);
+        }
+        for param in params
+            .iter()
+            .filter(|p| !args.iter().any(|(arg, _)| arg == *p))
+        {
+            self.report(
+                "SEN2106",
+                Severity::Warning,
+                format!(
+                    "template `{}` is rendered without `{}`, which is left as written",
+                    name, param
+                ),
+            );
+        }
+    }
+
+    fn placeholders(&mut self, template: &str) {
+        self.placeholders_with(template, &[]);
+    }
+
+    /// Like [`placeholders`](Self::placeholders), where `params` name
+    /// template parameters.
+    fn placeholders_with(&mut self, template: &str, params: &[String]) {
+        let mut rest = template;
+        while let Some(open) = rest.find('{') {
+            let after = &rest[open + 1..];
+            let Some(close) = after.find('}') else {
+                return;
+            };
+            let expr = after[..close].trim();
+            rest = &after[close + 1..];
+            if let Some(reference) = expr.strip_prefix("mem.") {
+                let region = reference.split('[').next().unwrap_or_default().trim();
+                if !REGIONS.contains(&region) {
+                    self.report(
+                        "SEN2103",
+                        Severity::Error,
+                        format!(
+                            "placeholder `{{{}}}` reads unknown memory region `{}`",
+                            expr, region
+                        ),
+                    );
+                }
+            } else if is_name(expr)
+                && expr != "input"
+                && expr != "msg"
+                && !params.iter().any(|p| p == expr)
+                && !self.variables.contains(expr)
+            {
+                self.report(
+                    "SEN2104",
+                    Severity::Warning,
+                    format!(
+                        "placeholder `{{{}}}` names no variable and is left as written; \
+                         use `{{input}}`, `{{msg}}` or `{{mem.<region>[\"<key>\"]}}`",
+                        expr
+                    ),
+                );
+            }
+        }
+    }
+}
+
+fn is_name(text: &str) -> bool {
+    let mut chars = text.chars();
+    chars.next().is_some_and(|c| c.is_alphabetic() || c == '_')
+        && chars.all(|c| c.is_alphanumeric() || c == '_')
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::lexer::Lexer;
+    use crate::parser::Parser;
+
+    fn check_source(source: &str) -> Vec<String> {
+        let mut lexer = Lexer::new(source);
+        let program = Parser::new(&mut lexer).with_locations().parse_program();
+        check(&program).iter().map(|d| d.to_string()).collect()
+    }
+
+    #[test]
+    fn accepts_well_typed_options() {
+        let source = concat!(
+            "ask \"Summarize {input}\" (model: \"m\", temperature: \"0.2\", max_tokens: \"200\", tools: \"memory\") -> mem.long[\"s\"]\n",
+            "fetch \"https://x/{mem.short[\\\"id\\\"]}\" (body: \"{\\\"a\\\": 1}\", timeout: \"{msg}\") -> mem.short[\"r\"]\n",
+            "exec \"ls\" (timeout: \"1.5\") -> mem.short[\"ls\"]\n",
+        );
+        assert!(
+            check_source(source).is_empty(),
+            "{:?}",
+            check_source(source)
+        );
+    }
+
+    #[test]
+    fn reports_options_and_placeholders_of_the_wrong_type() {
+        let source = concat!(
+            "ask \"Hi {user}\" (max_tokens: \"many\", color: \"red\") -> mem.long[\"s\"]\n",
+            "fetch \"https://x\" (timeout: \"-1\", header: \"nocolon\") -> mem.short[\"r\"]\n",
+            "read \"{mem.disk[\\\"p\\\"]}\" -> mem.short[\"f\"]\n",
+            "print \"{user}\"\n",
+            "lang 0.2\n",
+            "print \"{user}\"\n",
+        );
+        assert_eq!(
+            check_source(source),
+            [
+                "1: warning[SEN2104]: placeholder `{user}` names no variable and is left as written; use `{input}`, `{msg}` or `{mem.<region>[\"<key>\"]}`",
+                "1: error[SEN2102]: option `max_tokens` of `ask` takes a whole number, found \"many\"",
+                "1: error[SEN2101]: `ask` has no option `color` (expected one of: provider, model, temperature, max_tokens, tools)",
+                "2: error[SEN2102]: option `timeout` of `fetch` takes a number of seconds, found \"-1\"",
+                "2: error[SEN2102]: option `header` of `fetch` takes a `Name: value` header, found \"nocolon\"",
+                "3: error[SEN2103]: placeholder `{mem.disk[\"p\"]}` reads unknown memory region `disk`",
+                "6: warning[SEN2104]: placeholder `{user}` names no variable and is left as written; use `{input}`, `{msg}` or `{mem.<region>[\"<key>\"]}`",
+            ]
+        );
+    }
+
+    #[test]
+    fn checks_template_parameters() {
+        let source = concat!(
+            "template greet = \"Hello {name}, it is {day}; you said {msg}\"\n",
+            "print greet(name: msg, day: \"{mem.long[\\\"today\\\"]}\")\n",
+            "print greet(name: \"Ana\", color: \"red\")\n",
+            "ask farewell(name: msg) -> mem.short[\"reply\"]\n",
+        );
+        assert_eq!(
+            check_source(source),
+            [
+                "3: warning[SEN2106]: template `greet` has no parameter `color`",
+                "3: warning[SEN2106]: template `greet` is rendered without `day`, which is left as written",
+                "4: error[SEN2105]: `ask` renders unknown template `farewell`",
+            ]
+        );
+    }
+}
@@ -1,8 +1,159 @@
+use crate::lang::Version;
+
 #[derive(Clone, Debug, PartialEq)]
 pub struct Program {
     pub statements: Vec<Statement>,
 }
 
+/// A change an agent can propose to its own definition.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub enum Mutation {
+    /// `propose goal "<text>"`
+    Goal(String),
+    /// `propose threshold <drive> <value>`: compare against `value` in every
+    /// `if state.<drive>` condition.
+    Threshold { drive: String, value: String },
+    /// `propose link "<from>" -> "<to>"`
+    Link { from: String, to: String },
+}
+
+/// What `print` says or `ask` sends.
+#[derive(Clone, Debug, PartialEq)]
+pub enum Text {
+    /// `"Hello"`
+    Literal(String),
+    /// Any other expression, e.g. `"Hello " + mem.short["name"]`, whose
+    /// strings have their placeholders filled in before it is evaluated.
+    Expr(Expr),
+    /// `greet(name: msg, day: "Monday")`: a template rendered with
+    /// arguments. Each value is text whose placeholders are filled in, so
+    /// `msg` is kept as `{msg}`.
+    Template {
+        name: String,
+        args: Vec<(String, String)>,
+    },
+}
+
+/// An expression, such as the condition of an `if`.
+#[derive(Clone, Debug, PartialEq)]
+pub enum Expr {
+    /// `"hi"`
+    Text(String),
+    /// `0.1`, as written.
+    Number(String),
+    /// `true` or `false`.
+    Bool(bool),
+    /// A name, such as a handler's parameter, `input` or `mem`.
+    Ident(String),
+    /// `<expr>.<name>`, e.g. `state.curiosity`.
+    Field(Box<Expr>, String),
+    /// `<expr>[<expr>]`, e.g. `mem.short["x"]`.
+    Index(Box<Expr>, Box<Expr>),
+    Unary(UnaryOp, Box<Expr>),
+    Binary(BinaryOp, Box<Expr>, Box<Expr>),
+    /// `<name>(<expr>, ...)`: the value a function returns.
+    Call(String, Vec<Expr>),
+    /// `[<expr>, ...]`: a list.
+    List(Vec<Expr>),
+    /// `{<expr>: <expr>, ...}`, e.g. `{"name": msg}`: a map, whose keys
+    /// are taken as text.
+    Map(Vec<(Expr, Expr)>),
+}
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum UnaryOp {
+    /// `!`
+    Not,
+    /// `-`
+    Neg,
+}
+
+impl UnaryOp {
+    pub fn as_str(self) -> &'static str {
+        match self {
+            UnaryOp::Not => "!",
+            UnaryOp::Neg => "-",
+        }
+    }
+}
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum BinaryOp {
+    Or,
+    And,
+    Eq,
+    Ne,
+    Lt,
+    Le,
+    Gt,
+    Ge,
+    Add,
+    Sub,
+    Mul,
+    Div,
+}
+
+impl BinaryOp {
+    pub const ALL: [BinaryOp; 12] = [
+        BinaryOp::Or,
+        BinaryOp::And,
+        BinaryOp::Eq,
+        BinaryOp::Ne,
+        BinaryOp::Lt,
+        BinaryOp::Le,
+        BinaryOp::Gt,
+        BinaryOp::Ge,
+        BinaryOp::Add,
+        BinaryOp::Sub,
+        BinaryOp::Mul,
+        BinaryOp::Div,
+    ];
+
+    /// The operator written as `op`, such as `&&`.
+    pub fn parse(op: &str) -> Option<Self> {
+        Self::ALL
+            .into_iter()
+            .find(|candidate| candidate.as_str() == op)
+    }
+
+    pub fn as_str(self) -> &'static str {
+        match self {
+            BinaryOp::Or => "||",
+            BinaryOp::And => "&&",
+            BinaryOp::Eq => "==",
+            BinaryOp::Ne => "!=",
+            BinaryOp::Lt => "<",
+            BinaryOp::Le => "<=",
+            BinaryOp::Gt => ">",
+            BinaryOp::Ge => ">=",
+            BinaryOp::Add => "+",
+            BinaryOp::Sub => "-",
+            BinaryOp::Mul => "*",
+            BinaryOp::Div => "/",
+        }
+    }
+
+    /// How tightly the operator binds its operands, from 1 for `||` to 5
+    /// for `*` and `/`. Operators of the same precedence group to the left.
+    pub fn precedence(self) -> u8 {
+        match self {
+            BinaryOp::Or => 1,
+            BinaryOp::And => 2,
+            BinaryOp::Eq
+            | BinaryOp::Ne
+            | BinaryOp::Lt
+            | BinaryOp::Le
+            | BinaryOp::Gt
+            | BinaryOp::Ge => 3,
+            BinaryOp::Add | BinaryOp::Sub => 4,
+            BinaryOp::Mul | BinaryOp::Div => 5,
+        }
+    }
+}
+
+/// Precedence of `!` and `-` before an operand, above every [`BinaryOp`].
+pub const UNARY_PRECEDENCE: u8 = 6;
+
 #[derive(Clone, Debug, PartialEq)]
 pub enum Statement {
     AgentDeclaration {
@@ -16,6 +167,38 @@ pub enum Statement {
         param: String,
         body: Vec<Statement>,
     },
+    /// `on schedule("<cron>") { ... }`, run by the scheduler in `serve`.
+    OnSchedule {
+        spec: String,
+        body: Vec<Statement>,
+    },
+    /// `on start { ... }`, run when the agent is registered.
+    OnStart {
+        body: Vec<Statement>,
+    },
+    /// `on stop { ... }`, run when another agent replaces it or the
+    /// program shuts down.
+    OnStop {
+        body: Vec<Statement>,
+    },
+    /// `on output(<param>) { ... }`, run with each response the agent's
+    /// other handlers `emit`.
+    OnOutput {
+        param: String,
+        body: Vec<Statement>,
+    },
+    /// `pipeline A -> B -> C`: input to the program goes to the first
+    /// agent, and each agent's output is the next one's input.
+    Pipeline {
+        stages: Vec<String>,
+    },
+    /// `lang 0.2`: read the statements after it as that version of the
+    /// language; see [`lang`](crate::lang).
+    Lang(Version),
+    /// `import std/conversation`: run the statements of a module of the
+    /// [standard library](crate::stdlib), or of one fetched with `get`
+    /// (see [`packages`](crate::packages)), here.
+    Import(String),
     Reflect {
         body: Vec<Statement>,
     },
@@ -23,13 +206,24 @@ pub enum Statement {
         mem_target: String,
         key: String,
     },
+    /// `attention top <n>` in a `reflect` block: the `n` short-term entries
+    /// that matter most for the current input.
+    Attention {
+        top: usize,
+    },
+    /// `train { ... }`, or `train from "pairs.jsonl" { ... }` to run the
+    /// body once per example of a dataset; see [`crate::training`].
     Train {
+        dataset: Option<String>,
         body: Vec<Statement>,
     },
     Evolve {
         body: Vec<Statement>,
     },
     Goal(String),
+    /// `capabilities: net, fs.read`: what the agent may do beyond its own
+    /// memory; see [`Sandbox::check_capability`](crate::sandbox::Sandbox::check_capability).
+    Capabilities(Vec<String>),
     Embed {
         source: String,
         target: String,
@@ -38,7 +232,150 @@ pub enum Statement {
         values: Vec<String>,
         body: Vec<Statement>,
     },
-    Print(String),
+    /// `if <condition> { ... }`, for conditions other than the ones
+    /// [`IfState`](Statement::IfState) and [`IfReward`](Statement::IfReward)
+    /// stand for.
+    If {
+        condition: Expr,
+        body: Vec<Statement>,
+    },
+    /// `<if> else { ... }`, where `<if>` is any of the `if` statements:
+    /// runs `otherwise` when `branch` does not run its body. `else if`
+    /// is an `otherwise` of one `if`.
+    IfElse {
+        branch: Box<Statement>,
+        otherwise: Vec<Statement>,
+    },
+    /// `if state.<drive> > 0.7 { ... }`: runs the body if the agent's
+    /// [affect](crate::affect) drive compares true with the number.
+    IfState {
+        drive: String,
+        op: String,
+        value: String,
+        body: Vec<Statement>,
+    },
+    /// `if reward.<behavior>.<stat> < 0 { ... }`: runs the body if a
+    /// [reward](crate::reward) statistic compares true with the number.
+    IfReward {
+        behavior: String,
+        stat: String,
+        op: String,
+        value: String,
+        body: Vec<Statement>,
+    },
+    /// `reward <number>`: credit the behavior that acted last.
+    Reward(String),
+    /// `template <name> = "Hello {name}"`: text `print` and `ask` can
+    /// render with arguments; see [`template`](crate::template).
+    Template {
+        name: String,
+        text: String,
+    },
+    Print(Text),
+    /// `ask "<prompt>" (model: "...") -> mem.<target>["<key>"]`
+    Ask {
+        prompt: Text,
+        options: Vec<(String, String)>,
+        target: String,
+        key: String,
+    },
+    /// `fetch "<url>" (method: "POST") -> mem.<target>["<key>"]`
+    Fetch {
+        url: String,
+        options: Vec<(String, String)>,
+        target: String,
+        key: String,
+    },
+    /// `exec "<command>" (timeout: "5") -> mem.<target>["<key>"]`
+    Exec {
+        command: String,
+        options: Vec<(String, String)>,
+        target: String,
+        key: String,
+    },
+    /// `read "<path>" -> mem.<target>["<key>"]`
+    ReadFile {
+        path: String,
+        target: String,
+        key: String,
+    },
+    /// `write mem.<target>["<key>"] -> "<path>"`
+    WriteFile {
+        target: String,
+        key: String,
+        path: String,
+    },
+    /// `<name> = <value>` under `lang 0.1`, which stores the value as
+    /// written.
     Assignment(String, String),
+    /// `<name> = <expr>` from `lang 0.2`: updates the variable `name` if
+    /// one is bound, and otherwise stores the value in short-term memory
+    /// like an [`Assignment`](Statement::Assignment).
+    Assign {
+        name: String,
+        value: Expr,
+    },
+    /// `fn <name>(<param>, ...) { ... }`: a function, called by name from
+    /// the agent's blocks; see [`functions`](crate::functions).
+    Function {
+        name: String,
+        params: Vec<String>,
+        body: Vec<Statement>,
+    },
+    /// `return` or `return <expr>`: ends the function being run.
+    Return(Option<Expr>),
+    /// `<name>(<expr>, ...)`: runs a function for what it does, leaving
+    /// what it returns.
+    Call {
+        name: String,
+        args: Vec<Expr>,
+    },
+    /// `while <expr> { ... }`: runs the body for as long as the condition
+    /// holds, up to [`Limits::loop_iterations`](crate::limits::Limits::loop_iterations)
+    /// times.
+    While {
+        condition: Expr,
+        body: Vec<Statement>,
+    },
+    /// `for <key>, <value> in mem.<region> { ... }`: runs the body once per
+    /// entry of the region, in key order, with the two variables bound.
+    For {
+        key: String,
+        value: String,
+        region: String,
+        body: Vec<Statement>,
+    },
+    /// `recall <expr> top <n>`: the `n` memory entries closest to the
+    /// query; see [`recall`](crate::recall).
+    Recall {
+        query: Expr,
+        top: usize,
+    },
+    /// `send <Agent> <expr>`: runs the `on input` handler of another
+    /// declared agent with the value; see [`agents`](crate::agents).
+    Send {
+        agent: String,
+        message: Expr,
+    },
+    /// `emit <expr>`: prints the value and gives it as the agent's
+    /// response, collected in
+    /// [`AgentContext::responses`](crate::context::AgentContext::responses).
+    Emit(Expr),
+    /// `let <name> = <expr>`: binds a variable for the rest of the block,
+    /// see [`Variables`](crate::expr::Variables).
+    Let {
+        name: String,
+        value: Expr,
+    },
+    /// `propose ...` in an `evolve` block: a change to the agent itself,
+    /// held until it is committed; see [`evolve`](crate::evolve).
+    Propose(Mutation),
     Unknown(String),
+    /// Line of the statement that follows, emitted by
+    /// [`Parser::with_locations`](crate::parser::Parser::with_locations)
+    /// for the debugger. `depth` is its nesting, 1 at the top level.
+    Location {
+        line: usize,
+        depth: usize,
+    },
 }
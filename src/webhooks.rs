@@ -0,0 +1,193 @@
+//! Delivery of agent events to configured webhook URLs. Requests are sent
+//! from a background thread so slow endpoints never hold up a handler.
+
+use crate::config::WebhookConfig;
+use crate::events::AgentEvent;
+use serde_json::Value;
+use std::sync::mpsc::{self, Sender};
+use std::thread::{self, JoinHandle};
+use std::time::Duration;
+
+const DEFAULT_MAX_RETRIES: u32 = 3;
+const DEFAULT_TIMEOUT_SECS: u64 = 10;
+
+/// A running webhook dispatcher. Dropping it waits for queued deliveries,
+/// including their retries, to finish.
+pub struct Webhooks {
+    hooks: Vec<WebhookConfig>,
+    sender: Option<Sender<(usize, Value)>>,
+    worker: Option<JoinHandle<()>>,
+}
+
+impl Webhooks {
+    pub fn new(hooks: Vec<WebhookConfig>) -> Result<Self, String> {
+        if let Some(hook) = hooks.iter().find(|h| reqwest::Url::parse(&h.url).is_err()) {
+            return Err(format!("invalid webhook url `{}`", hook.url));
+        }
+        let client = reqwest::blocking::Client::new();
+        let (sender, receiver) = mpsc::channel::<(usize, Value)>();
+        let worker_hooks = hooks.clone();
+        let worker = thread::spawn(move || {
+            for (index, payload) in receiver {
+                let hook = &worker_hooks[index];
+                if let Err(e) = deliver(&client, hook, &payload) {
+                    tracing::warn!("webhook {} failed: {}", hook.url, e);
+                }
+            }
+        });
+        Ok(Self {
+            hooks,
+            sender: Some(sender),
+            worker: Some(worker),
+        })
+    }
+
+    /// Queue `event` for every webhook whose filters match it.
+    pub fn dispatch(&self, agent: &str, event: &AgentEvent) {
+        let Some(sender) = &self.sender else {
+            return;
+        };
+        let payload = event.payload(agent);
+
+        for (index, hook) in self.hooks.iter().enumerate() {
+            if matches(hook, event) {
+                let _ = sender.send((index, payload.clone()));
+            }
+        }
+    }
+}
+
+impl Drop for Webhooks {
+    fn drop(&mut self) {
+        self.sender.take();
+        if let Some(worker) = self.worker.take() {
+            let _ = worker.join();
+        }
+    }
+}
+
+fn matches(hook: &WebhookConfig, event: &AgentEvent) -> bool {
+    if !hook.events.is_empty() && !hook.events.iter().any(|e| e == event.name()) {
+        return false;
+    }
+    match event {
+        AgentEvent::MemoryChanged { key, .. } => hook.keys.is_empty() || hook.keys.contains(key),
+        _ => true,
+    }
+}
+
+/// POST `payload`, retrying connection failures, rate limits and server
+/// errors with exponential backoff.
+fn deliver(
+    client: &reqwest::blocking::Client,
+    hook: &WebhookConfig,
+    payload: &Value,
+) -> Result<(), String> {
+    let max_retries = hook.max_retries.unwrap_or(DEFAULT_MAX_RETRIES);
+    let timeout = Duration::from_secs(hook.timeout_secs.unwrap_or(DEFAULT_TIMEOUT_SECS));
+    let mut attempt = 0;
+    loop {
+        let mut builder = client.post(&hook.url).timeout(timeout).json(payload);
+        for (name, value) in &hook.headers {
+            builder = builder.header(name, value);
+        }
+
+        let error = match builder.send() {
+            Ok(response) if response.status().is_success() => return Ok(()),
+            Ok(response) => {
+                let status = response.status();
+                if status.as_u16() != 429 && !status.is_server_error() {
+                    return Err(format!("rejected with {}", status));
+                }
+                format!("returned {}", status)
+            }
+            Err(e) => e.to_string(),
+        };
+
+        if attempt >= max_retries {
+            return Err(error);
+        }
+        thread::sleep(Duration::from_millis(500 * 2u64.pow(attempt)));
+        attempt += 1;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::io::{BufRead, BufReader, Read, Write};
+    use std::net::TcpListener;
+
+    /// Answer one request per status, returning each request body.
+    fn serve(statuses: &[u16]) -> (String, JoinHandle<Vec<String>>) {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let url = format!("http://{}/hook", listener.local_addr().unwrap());
+        let statuses = statuses.to_vec();
+        let handle = thread::spawn(move || {
+            let mut bodies = Vec::new();
+            for status in statuses {
+                let (stream, _) = listener.accept().unwrap();
+                let mut reader = BufReader::new(stream);
+                let mut length = 0;
+                loop {
+                    let mut line = String::new();
+                    reader.read_line(&mut line).unwrap();
+                    if line.trim().is_empty() {
+                        break;
+                    }
+                    if let Some(v) = line.to_ascii_lowercase().strip_prefix("content-length:") {
+                        length = v.trim().parse().unwrap();
+                    }
+                }
+                let mut body = vec![0; length];
+                reader.read_exact(&mut body).unwrap();
+                bodies.push(String::from_utf8(body).unwrap());
+                let reply = format!(
+                    "HTTP/1.1 {} X\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+                    status
+                );
+                reader.get_mut().write_all(reply.as_bytes()).unwrap();
+            }
+            bodies
+        });
+        (url, handle)
+    }
+
+    #[test]
+    fn retries_failed_deliveries() {
+        let (url, server) = serve(&[503, 200]);
+        let hooks = Webhooks::new(vec![WebhookConfig {
+            url,
+            events: vec!["memory_changed".to_string()],
+            keys: vec!["status".to_string()],
+            ..Default::default()
+        }])
+        .unwrap();
+
+        let changed = |key: &str| AgentEvent::MemoryChanged {
+            region: "long".to_string(),
+            key: key.to_string(),
+            value: "done".to_string(),
+        };
+        hooks.dispatch("Watcher", &changed("other"));
+        hooks.dispatch("Watcher", &changed("status"));
+        drop(hooks);
+
+        let bodies = server.join().unwrap();
+        assert_eq!(bodies.len(), 2);
+        assert_eq!(bodies[0], bodies[1]);
+        let payload: Value = serde_json::from_str(&bodies[1]).unwrap();
+        assert_eq!(payload["event"], "memory_changed");
+        assert_eq!(payload["agent"], "Watcher");
+        assert_eq!(payload["key"], "status");
+    }
+
+    #[test]
+    fn rejects_invalid_urls() {
+        let hook = WebhookConfig {
+            url: "not a url".to_string(),
+            ..Default::default()
+        };
+        assert!(Webhooks::new(vec![hook]).is_err());
+    }
+}
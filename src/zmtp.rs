@@ -0,0 +1,239 @@
+//! Just enough of ZMTP 3.0, the ZeroMQ wire protocol, to talk to ZeroMQ
+//! peers over TCP without linking libzmq: the NULL security mechanism and
+//! multipart messages. Routing between several peers is left to the caller,
+//! which owns one [`Peer`] per connection.
+
+use std::io::{self, BufReader, Read, Write};
+use std::net::TcpStream;
+use std::sync::{Arc, Mutex};
+
+const MORE: u8 = 0x01;
+const LONG: u8 = 0x02;
+const COMMAND: u8 = 0x04;
+
+/// One connected peer.
+pub struct Peer {
+    reader: BufReader<TcpStream>,
+    writer: PeerWriter,
+    /// `Socket-Type` the peer announced, e.g. `DEALER`.
+    pub socket_type: String,
+}
+
+/// Sending half of a [`Peer`], which can be shared between threads.
+#[derive(Clone)]
+pub struct PeerWriter(Arc<Mutex<TcpStream>>);
+
+impl Peer {
+    /// Exchange greetings and `READY` commands on `stream`, presenting
+    /// ourselves as a `socket_type` socket (`ROUTER`, `PUB`, `REP`, ...).
+    pub fn handshake(stream: TcpStream, socket_type: &str) -> io::Result<Peer> {
+        stream.set_nodelay(true)?;
+        let mut writer = stream.try_clone()?;
+        let mut reader = BufReader::new(stream);
+
+        writer.write_all(&greeting())?;
+        let mut theirs = [0u8; 64];
+        reader.read_exact(&mut theirs)?;
+        if theirs[0] != 0xFF || theirs[9] != 0x7F {
+            return Err(invalid("not a ZMTP peer"));
+        }
+        if theirs[10] < 3 {
+            return Err(invalid("ZMTP 3.0 or later is required"));
+        }
+        if !theirs[12..32].starts_with(b"NULL\0") {
+            return Err(invalid("only the NULL security mechanism is supported"));
+        }
+
+        let mut ready = command_body("READY");
+        push_property(&mut ready, "Socket-Type", socket_type.as_bytes());
+        write_frame(&mut writer, COMMAND, &ready)?;
+
+        let (flags, body) = read_frame(&mut reader)?;
+        if flags & COMMAND == 0 {
+            return Err(invalid("expected READY"));
+        }
+        let (name, properties) = parse_command(&body)?;
+        if name != "READY" {
+            return Err(invalid(&format!("expected READY, got {}", name)));
+        }
+        let socket_type = properties
+            .iter()
+            .find(|(name, _)| name.eq_ignore_ascii_case("Socket-Type"))
+            .map(|(_, value)| String::from_utf8_lossy(value).into_owned())
+            .unwrap_or_default();
+        Ok(Peer {
+            reader,
+            writer: PeerWriter(Arc::new(Mutex::new(writer))),
+            socket_type,
+        })
+    }
+
+    /// Wait for the next message. Commands from the peer are answered
+    /// (`PING`) or skipped.
+    pub fn recv(&mut self) -> io::Result<Vec<Vec<u8>>> {
+        let mut frames = Vec::new();
+        loop {
+            let (flags, body) = read_frame(&mut self.reader)?;
+            if flags & COMMAND != 0 {
+                let (name, _) = parse_command(&body)?;
+                if name == "PING" && body.len() >= 7 {
+                    // Name length and name, then a 2 byte TTL, then context.
+                    let mut pong = command_body("PONG");
+                    pong.extend_from_slice(&body[7..]);
+                    self.writer.send_frame(COMMAND, &pong)?;
+                }
+                continue;
+            }
+            frames.push(body);
+            if flags & MORE == 0 {
+                return Ok(frames);
+            }
+        }
+    }
+
+    pub fn send(&self, frames: &[Vec<u8>]) -> io::Result<()> {
+        self.writer.send(frames)
+    }
+
+    pub fn writer(&self) -> PeerWriter {
+        self.writer.clone()
+    }
+}
+
+impl PeerWriter {
+    /// Send a multipart message.
+    pub fn send(&self, frames: &[Vec<u8>]) -> io::Result<()> {
+        let mut out = Vec::new();
+        for (i, frame) in frames.iter().enumerate() {
+            let flags = if i + 1 < frames.len() { MORE } else { 0 };
+            write_frame(&mut out, flags, frame)?;
+        }
+        if frames.is_empty() {
+            write_frame(&mut out, 0, &[])?;
+        }
+        self.write_all(&out)
+    }
+
+    fn send_frame(&self, flags: u8, body: &[u8]) -> io::Result<()> {
+        let mut out = Vec::new();
+        write_frame(&mut out, flags, body)?;
+        self.write_all(&out)
+    }
+
+    fn write_all(&self, bytes: &[u8]) -> io::Result<()> {
+        let mut stream = self
+            .0
+            .lock()
+            .map_err(|_| io::Error::new(io::ErrorKind::Other, "writer poisoned"))?;
+        stream.write_all(bytes)?;
+        stream.flush()
+    }
+}
+
+/// Signature, version 3.0, the NULL mechanism and the server flag (unused
+/// by NULL), padded to 64 bytes.
+fn greeting() -> [u8; 64] {
+    let mut greeting = [0u8; 64];
+    greeting[0] = 0xFF;
+    greeting[9] = 0x7F;
+    greeting[10] = 3;
+    greeting[12..16].copy_from_slice(b"NULL");
+    greeting
+}
+
+fn command_body(name: &str) -> Vec<u8> {
+    let mut body = vec![name.len() as u8];
+    body.extend_from_slice(name.as_bytes());
+    body
+}
+
+fn push_property(body: &mut Vec<u8>, name: &str, value: &[u8]) {
+    body.push(name.len() as u8);
+    body.extend_from_slice(name.as_bytes());
+    body.extend_from_slice(&(value.len() as u32).to_be_bytes());
+    body.extend_from_slice(value);
+}
+
+/// Name and, for `READY`, properties of a command.
+fn parse_command(body: &[u8]) -> io::Result<(String, Vec<(String, Vec<u8>)>)> {
+    let truncated = || invalid("truncated command");
+    let len = *body.first().ok_or_else(truncated)? as usize;
+    let name = body.get(1..1 + len).ok_or_else(truncated)?;
+    let name = String::from_utf8_lossy(name).into_owned();
+    let mut properties = Vec::new();
+    if name == "READY" {
+        let mut rest = &body[1 + len..];
+        while !rest.is_empty() {
+            let name_len = rest[0] as usize;
+            let key = rest.get(1..1 + name_len).ok_or_else(truncated)?;
+            let size = rest.get(1 + name_len..5 + name_len).ok_or_else(truncated)?;
+            let size = u32::from_be_bytes(size.try_into().expect("4 bytes")) as usize;
+            let value = rest
+                .get(5 + name_len..5 + name_len + size)
+                .ok_or_else(truncated)?;
+            properties.push((String::from_utf8_lossy(key).into_owned(), value.to_vec()));
+            rest = &rest[5 + name_len + size..];
+        }
+    }
+    Ok((name, properties))
+}
+
+fn read_frame(reader: &mut impl Read) -> io::Result<(u8, Vec<u8>)> {
+    let mut flags = [0u8; 1];
+    reader.read_exact(&mut flags)?;
+    let size = if flags[0] & LONG != 0 {
+        let mut size = [0u8; 8];
+        reader.read_exact(&mut size)?;
+        u64::from_be_bytes(size) as usize
+    } else {
+        let mut size = [0u8; 1];
+        reader.read_exact(&mut size)?;
+        size[0] as usize
+    };
+    let mut body = vec![0; size];
+    reader.read_exact(&mut body)?;
+    Ok((flags[0], body))
+}
+
+fn write_frame(out: &mut impl Write, flags: u8, body: &[u8]) -> io::Result<()> {
+    if body.len() > u8::MAX as usize {
+        out.write_all(&[flags | LONG])?;
+        out.write_all(&(body.len() as u64).to_be_bytes())?;
+    } else {
+        out.write_all(&[flags, body.len() as u8])?;
+    }
+    out.write_all(body)
+}
+
+fn invalid(message: &str) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidData, message.to_string())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::net::TcpListener;
+    use std::thread;
+
+    #[test]
+    fn exchanges_multipart_messages() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = listener.local_addr().unwrap();
+        let server = thread::spawn(move || {
+            let (stream, _) = listener.accept().unwrap();
+            let mut peer = Peer::handshake(stream, "REP").unwrap();
+            let message = peer.recv().unwrap();
+            peer.send(&message).unwrap();
+            peer.socket_type
+        });
+
+        let mut client = Peer::handshake(TcpStream::connect(addr).unwrap(), "REQ").unwrap();
+        let long = vec![7u8; 300];
+        client
+            .send(&[Vec::new(), b"ping".to_vec(), long.clone()])
+            .unwrap();
+        assert_eq!(client.recv().unwrap(), [Vec::new(), b"ping".to_vec(), long]);
+        assert_eq!(client.socket_type, "REP");
+        assert_eq!(server.join().unwrap(), "REQ");
+    }
+}